@@ -1,6 +1,6 @@
 #! /bin/sh -x
 
-apk add --no-cache ca-certificates tzdata bash curl krb5-dev
+apk add --no-cache ca-certificates tzdata bash curl krb5-dev lz4 pigz
 
 # Install GnuPG
 if [ "_${MGOB_EN_GPG}" = "_true" ]
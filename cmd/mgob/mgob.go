@@ -1,20 +1,36 @@
 package main
 
 import (
-	"github.com/kelseyhightower/envconfig"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
 	"os"
 	"os/signal"
 	"path"
+	"strings"
 	"syscall"
+	"time"
 
+	"github.com/dustin/go-humanize"
+	"github.com/kelseyhightower/envconfig"
 	log "github.com/sirupsen/logrus"
 	"github.com/urfave/cli"
+	"gopkg.in/yaml.v2"
 
+	"github.com/stefanprodan/mgob/pkg/agent"
 	"github.com/stefanprodan/mgob/pkg/api"
 	"github.com/stefanprodan/mgob/pkg/backup"
 	"github.com/stefanprodan/mgob/pkg/config"
+	"github.com/stefanprodan/mgob/pkg/controller"
 	"github.com/stefanprodan/mgob/pkg/db"
+	"github.com/stefanprodan/mgob/pkg/extract"
+	"github.com/stefanprodan/mgob/pkg/logging"
+	"github.com/stefanprodan/mgob/pkg/metrics"
+	"github.com/stefanprodan/mgob/pkg/restore"
 	"github.com/stefanprodan/mgob/pkg/scheduler"
+	"github.com/stefanprodan/mgob/pkg/selftest"
 )
 
 var (
@@ -29,13 +45,12 @@ func beforeApp(c *cli.Context) error {
 	if err != nil {
 		log.Fatalf("unable to determine and set log level: %+v", err)
 	}
-	log.SetLevel(level)
-
 	if c.GlobalBool("JSONLog") {
 		// platforms such as Google StackDriver want logs to stdout
 		log.SetOutput(os.Stdout)
 		log.SetFormatter(&log.JSONFormatter{})
 	}
+	logging.Setup(level)
 
 	log.Debug("log level set to ", c.GlobalString("LogLevel"))
 	return nil
@@ -59,6 +74,10 @@ func main() {
 			Usage: "backup storage",
 			Value: "/storage",
 		},
+		cli.BoolFlag{
+			Name:  "StorageWatch",
+			Usage: "register the archives copied into the plan storage dirs in the catalog",
+		},
 		cli.StringFlag{
 			Name:  "TmpPath,t",
 			Usage: "temporary backup storage",
@@ -69,16 +88,117 @@ func main() {
 			Usage: "db dir",
 			Value: "/data",
 		},
+		cli.StringFlag{
+			Name:  "HomePath",
+			Usage: "home dir of the gpg and cloud CLIs config files, defaults to $HOME",
+		},
 		cli.IntFlag{
 			Name:  "Port,p",
-			Usage: "Port to bind the HTTP server on",
+			Usage: "Port to bind the HTTP server on, the API is disabled when 0 and no socket is set",
 			Value: 8090,
 		},
+		cli.StringFlag{
+			Name:  "Socket",
+			Usage: "unix socket to serve the HTTP API on instead of the port, @name for a Linux abstract socket",
+		},
+		cli.IntFlag{
+			Name:  "DebugPort",
+			Usage: "Port to bind the pprof and expvar endpoints on, disabled when 0",
+			Value: 0,
+		},
+		cli.IntFlag{
+			Name:  "AgentPort",
+			Usage: "Port to bind the agent TLS server on, disabled when 0",
+			Value: 0,
+		},
+		cli.StringFlag{
+			Name:  "TenantsPath",
+			Usage: "yaml file of the admin and tenant API tokens, the API has no auth when empty",
+		},
+		cli.StringFlag{
+			Name:  "PricingPath",
+			Usage: "yaml file of the destination storage prices in $ per GB-month, the costs aren't estimated when empty",
+		},
+		cli.StringFlag{
+			Name:  "SetsPath",
+			Usage: "yaml file of the backup sets, plans backed up together between hooks",
+		},
+		cli.StringFlag{
+			Name:  "AgentCert",
+			Usage: "agent TLS certificate, of the server or of the agent",
+		},
+		cli.StringFlag{
+			Name:  "AgentKey",
+			Usage: "agent TLS private key",
+		},
+		cli.StringFlag{
+			Name:  "AgentCA",
+			Usage: "CA the agent TLS peer certificates are verified with",
+		},
+		cli.BoolFlag{
+			Name:  "Controller",
+			Usage: "aggregate the status and metrics of registered mgob instances and distribute plans to them",
+		},
 		cli.StringFlag{
 			Name:  "Bind,b",
 			Usage: "Host to bind the HTTP server on",
 			Value: "",
 		},
+		cli.StringFlag{
+			Name:  "UserAgent",
+			Usage: "User-Agent of the cloud storage requests, defaults to mgob/<version>",
+		},
+		cli.StringFlag{
+			Name:  "ManifestKey",
+			Usage: "ed25519 PEM key the run manifests are signed with, defaults to <DataPath>/manifest.key",
+		},
+		cli.IntFlag{
+			Name:  "MaxUploads",
+			Usage: "delay the scheduled dumps while this many backups are uploading, disabled when 0",
+		},
+		cli.StringFlag{
+			Name:  "MaxTmp",
+			Usage: "delay the scheduled dumps while the tmp dir holds more than this, e.g. 50GB",
+		},
+		cli.StringFlag{
+			Name:  "CacheSize",
+			Usage: "keep the archives downloaded for restores up to this size, e.g. 500GB, least recently used first out, disabled when empty",
+		},
+		cli.StringFlag{
+			Name:  "CachePath",
+			Usage: "dir of the download cache, defaults to <DataPath>/cache",
+		},
+		cli.IntFlag{
+			Name:  "MaxConcurrentBackups",
+			Usage: "run at most this many backups at once, the others wait for a slot in the order they started, unlimited when 0",
+		},
+		cli.IntFlag{
+			Name:  "MaxDelay",
+			Usage: "minutes a delayed dump waits before it's skipped",
+			Value: 60,
+		},
+		cli.IntFlag{
+			Name:  "CompactInterval",
+			Usage: "hours between two compactions of mgob.db, disabled when 0",
+			Value: 24,
+		},
+		cli.IntFlag{
+			Name:  "ReloadInterval",
+			Usage: "seconds between two checks of the plan and key files, changed plans are reloaded, disabled when 0",
+		},
+		cli.IntFlag{
+			Name:  "CatalogMaxAge",
+			Usage: "days the catalog records of archives no longer in the storage dir are kept, forever when 0",
+		},
+		cli.StringFlag{
+			Name:  "MetricsLabels",
+			Usage: "optional labels of the metrics: plan,database,destination, all when empty",
+		},
+		cli.IntFlag{
+			Name:  "MetricsMaxDatabases",
+			Usage: "database series per plan, the smallest databases above it are summed as _other, no limit when 0",
+			Value: 100,
+		},
 		cli.BoolFlag{
 			Name:  "JSONLog,j",
 			Usage: "logs in JSON format",
@@ -89,24 +209,202 @@ func main() {
 			Value: "info",
 		},
 	}
+	app.Commands = []cli.Command{
+		{
+			Name:   "selftest",
+			Usage:  "run a backup and restore round trip of a plan against a disposable database",
+			Action: runSelfTest,
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "plan",
+					Usage: "plan name",
+				},
+				cli.StringFlag{
+					Name:  "key",
+					Usage: "gpg private key file used to decrypt the test backup",
+				},
+			},
+		},
+		{
+			Name:   "backup",
+			Usage:  "run a backup of a plan once, outside of the scheduler",
+			Action: runBackup,
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "plan",
+					Usage: "plan name",
+				},
+				cli.BoolFlag{
+					Name:  "stdout",
+					Usage: "write the archive to stdout instead of storing and uploading it",
+				},
+			},
+		},
+		{
+			Name:   "restore",
+			Usage:  "restore a plan to its state at a time through the API of the running mgob",
+			Action: runRestore,
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "plan",
+					Usage: "plan name",
+				},
+				cli.StringFlag{
+					Name:  "at",
+					Usage: "time to restore to, RFC3339 (UTC when the zone is omitted) or unix seconds, e.g. 2024-06-01T03:00Z",
+				},
+				cli.BoolFlag{
+					Name:  "yes",
+					Usage: "restore without asking for confirmation",
+				},
+				cli.BoolFlag{
+					Name:  "dry-run",
+					Usage: "validate the archives with mongorestore --dryRun, nothing is written",
+				},
+				cli.StringFlag{
+					Name:  "server",
+					Usage: "mgob API URL, defaults to the socket or to localhost on the port",
+				},
+				cli.StringFlag{
+					Name:   "token",
+					Usage:  "API bearer token, required with tenants",
+					EnvVar: "MGOB_TOKEN",
+				},
+			},
+		},
+		{
+			Name:   "reencrypt",
+			Usage:  "re-encrypt the archives of a plan for the recipients of its encryption config, with mgob stopped",
+			Action: runReencrypt,
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "plan",
+					Usage: "plan name",
+				},
+				cli.StringFlag{
+					Name:  "key",
+					Usage: "gpg private key file the archives are currently encrypted for",
+				},
+			},
+		},
+		{
+			Name:   "export-plans",
+			Usage:  "write the plans of the config dir as a bundle another mgob can import",
+			Action: runExportPlans,
+			Flags: []cli.Flag{
+				cli.StringSliceFlag{
+					Name:  "plan",
+					Usage: "plan name, repeat it for several plans, all plans when unset",
+				},
+				cli.StringFlag{
+					Name:  "secrets",
+					Value: string(config.SecretsStrip),
+					Usage: "strip, ref (${MGOB_SECRET_...} env references) or include",
+				},
+				cli.StringFlag{
+					Name:  "out",
+					Usage: "bundle file, defaults to stdout",
+				},
+			},
+		},
+		{
+			Name:   "import-plans",
+			Usage:  "save the plans of a bundle to the config dir, they are scheduled on the next start",
+			Action: runImportPlans,
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "file",
+					Usage: "bundle file",
+				},
+			},
+		},
+		{
+			Name:   "agent",
+			Usage:  "run the dumps of the plans bound to this agent and stream them to the mgob server",
+			Action: runAgent,
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "server",
+					Usage: "mgob agent server URL, e.g. https://mgob:8443",
+				},
+			},
+		},
+	}
 	app.Run(os.Args)
 }
 
-func start(c *cli.Context) error {
-	log.Infof("mgob %v", version)
-
-	appConfig.LogLevel = c.String("LogLevel")
-	appConfig.JSONLog = c.Bool("JSONLog")
-	appConfig.Port = c.Int("Port")
-	appConfig.Host = c.String("Bind")
-	appConfig.ConfigPath = c.String("ConfigPath")
-	appConfig.StoragePath = c.String("StoragePath")
-	appConfig.TmpPath = c.String("TmpPath")
-	appConfig.DataPath = c.String("DataPath")
+func loadConfig(c *cli.Context) {
+	appConfig.LogLevel = c.GlobalString("LogLevel")
+	appConfig.JSONLog = c.GlobalBool("JSONLog")
+	appConfig.Port = c.GlobalInt("Port")
+	appConfig.Socket = c.GlobalString("Socket")
+	appConfig.DebugPort = c.GlobalInt("DebugPort")
+	appConfig.AgentPort = c.GlobalInt("AgentPort")
+	appConfig.TenantsPath = c.GlobalString("TenantsPath")
+	appConfig.PricingPath = c.GlobalString("PricingPath")
+	appConfig.SetsPath = c.GlobalString("SetsPath")
+	appConfig.AgentCert = c.GlobalString("AgentCert")
+	appConfig.AgentKey = c.GlobalString("AgentKey")
+	appConfig.AgentCA = c.GlobalString("AgentCA")
+	appConfig.Controller = c.GlobalBool("Controller")
+	appConfig.Host = c.GlobalString("Bind")
+	appConfig.ConfigPath = c.GlobalString("ConfigPath")
+	appConfig.StoragePath = c.GlobalString("StoragePath")
+	appConfig.StorageWatch = c.GlobalBool("StorageWatch")
+	appConfig.TmpPath = c.GlobalString("TmpPath")
+	appConfig.DataPath = c.GlobalString("DataPath")
+	appConfig.HomePath = c.GlobalString("HomePath")
 	appConfig.Version = version
+	appConfig.UserAgent = c.GlobalString("UserAgent")
+	if appConfig.UserAgent == "" {
+		appConfig.UserAgent = fmt.Sprintf("%v/%v", name, version)
+	}
+	backup.SetUserAgent(appConfig.UserAgent)
+	appConfig.ManifestKey = c.GlobalString("ManifestKey")
+	appConfig.MaxUploads = c.GlobalInt("MaxUploads")
+	appConfig.MaxTmp = c.GlobalString("MaxTmp")
+	appConfig.CacheSize = c.GlobalString("CacheSize")
+	appConfig.CachePath = c.GlobalString("CachePath")
+	appConfig.MaxDelay = c.GlobalInt("MaxDelay")
+	appConfig.MaxConcurrentBackups = c.GlobalInt("MaxConcurrentBackups")
+	appConfig.CompactInterval = c.GlobalInt("CompactInterval")
+	appConfig.ReloadInterval = c.GlobalInt("ReloadInterval")
+	appConfig.CatalogMaxAge = c.GlobalInt("CatalogMaxAge")
+	appConfig.MetricsLabels = c.GlobalString("MetricsLabels")
+	appConfig.MetricsMaxDatabases = c.GlobalInt("MetricsMaxDatabases")
+	if _, err := metrics.ParseLabels(appConfig.MetricsLabels, appConfig.MetricsMaxDatabases); err != nil {
+		log.Fatal(err)
+	}
+	if appConfig.PricingPath != "" {
+		pricing, err := config.LoadPricing(appConfig.PricingPath)
+		if err != nil {
+			log.Fatal(err)
+		}
+		appConfig.Pricing = pricing
+	}
+	if appConfig.SetsPath != "" {
+		sets, err := config.LoadSets(appConfig.SetsPath, appConfig.MaxConcurrentBackups)
+		if err != nil {
+			log.Fatal(err)
+		}
+		appConfig.Sets = sets
+	}
+	if appConfig.ManifestKey == "" {
+		appConfig.ManifestKey = path.Join(appConfig.DataPath, "manifest.key")
+	}
+	if appConfig.CacheSize != "" {
+		if _, err := humanize.ParseBytes(appConfig.CacheSize); err != nil {
+			log.Fatalf("Invalid cache size %v %v", appConfig.CacheSize, err)
+		}
+		if appConfig.CachePath == "" {
+			appConfig.CachePath = path.Join(appConfig.DataPath, "cache")
+		}
+	}
 
 	log.Infof("starting with config: %+v", appConfig)
 
+	setupPaths()
+
 	err := envconfig.Process(name, modules)
 	if err != nil {
 		log.Fatal(err.Error())
@@ -120,13 +418,258 @@ func start(c *cli.Context) error {
 		log.Fatal(err)
 	}
 	log.Info(info)
+	appConfig.MongodumpVersion = strings.TrimSpace(strings.SplitN(info, "\n", 2)[0])
 
 	checkClients()
+}
+
+func runSelfTest(c *cli.Context) error {
+	log.Infof("mgob %v self-test", version)
+	loadConfig(c)
+
+	if c.String("plan") == "" {
+		return cli.NewExitError("the --plan flag is required", 1)
+	}
+	plan, err := config.LoadPlan(appConfig.ConfigPath, c.String("plan"))
+	if err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		<-sigChan
+		cancel()
+	}()
+
+	if key := c.String("key"); key != "" {
+		if err := restore.ImportKey(ctx, key); err != nil {
+			return cli.NewExitError(err.Error(), 1)
+		}
+	}
+
+	report := selftest.Run(ctx, plan, appConfig, modules)
+	if appConfig.JSONLog {
+		json.NewEncoder(os.Stdout).Encode(report)
+	} else {
+		for _, step := range report.Steps {
+			status := "PASS"
+			if !step.Passed {
+				status = "FAIL"
+			}
+			fmt.Printf("%v  %-16v %v %v\n", status, step.Name, step.Duration.Round(time.Millisecond), step.Error)
+		}
+	}
+
+	if !report.Passed {
+		return cli.NewExitError(fmt.Sprintf("self-test of plan %v failed", plan.Name), 1)
+	}
+	fmt.Printf("self-test of plan %v passed\n", plan.Name)
+	return nil
+}
+
+func runBackup(c *cli.Context) error {
+	if c.Bool("stdout") {
+		// the archive owns stdout, logs go to stderr whatever the format
+		log.SetOutput(os.Stderr)
+		if fi, err := os.Stdout.Stat(); err == nil && fi.Mode()&os.ModeCharDevice != 0 {
+			return cli.NewExitError("stdout is a terminal, pipe it to a file or a command", 1)
+		}
+	}
+	log.Infof("mgob %v backup", version)
+	loadConfig(c)
+
+	if c.String("plan") == "" {
+		return cli.NewExitError("the --plan flag is required", 1)
+	}
+	plan, err := config.LoadPlan(appConfig.ConfigPath, c.String("plan"))
+	if err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		<-sigChan
+		cancel()
+	}()
+
+	var res backup.Result
+	if c.Bool("stdout") {
+		res, err = backup.ToWriter(ctx, plan, appConfig, os.Stdout)
+	} else {
+		res, err = backup.Run(ctx, plan, appConfig, modules)
+	}
+	if err != nil {
+		return cli.NewExitError(fmt.Sprintf("backup of plan %v failed: %v", plan.Name, err), 1)
+	}
+	log.WithFields(log.Fields{
+		"plan":     plan.Name,
+		"size":     res.Size,
+		"checksum": res.Checksum,
+	}).Infof("%v written in %v", res.Name, res.Duration.Round(time.Millisecond))
+	return nil
+}
+
+func runExportPlans(c *cli.Context) error {
+	// the bundle may go to stdout
+	log.SetOutput(os.Stderr)
+
+	b, err := config.ExportPlans(c.GlobalString("ConfigPath"), c.StringSlice("plan"), config.SecretsMode(c.String("secrets")))
+	if err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
+	data, err := yaml.Marshal(b)
+	if err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
+	if out := c.String("out"); out != "" {
+		if err := ioutil.WriteFile(out, data, 0600); err != nil {
+			return cli.NewExitError(err.Error(), 1)
+		}
+		log.Infof("%v plans exported to %v", len(b.Plans), out)
+		return nil
+	}
+	os.Stdout.Write(data)
+	return nil
+}
+
+func runImportPlans(c *cli.Context) error {
+	if c.String("file") == "" {
+		return cli.NewExitError("the --file flag is required", 1)
+	}
+	data, err := ioutil.ReadFile(c.String("file"))
+	if err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
+	var b config.Bundle
+	if err := yaml.Unmarshal(data, &b); err != nil {
+		return cli.NewExitError(fmt.Sprintf("parsing %v failed: %v", c.String("file"), err), 1)
+	}
+	plans, err := config.ImportPlans(b)
+	if err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
+	for _, p := range plans {
+		if err := config.SavePlan(c.GlobalString("ConfigPath"), p.Plan.Name, p.Data); err != nil {
+			return cli.NewExitError(err.Error(), 1)
+		}
+		if len(p.Missing) > 0 {
+			log.WithField("plan", p.Plan.Name).Warnf("Plan imported without the stripped secrets %v", strings.Join(p.Missing, ", "))
+			continue
+		}
+		log.WithField("plan", p.Plan.Name).Info("Plan imported")
+	}
+	return nil
+}
+
+func runReencrypt(c *cli.Context) error {
+	log.Infof("mgob %v re-encryption", version)
+	loadConfig(c)
+
+	if c.String("plan") == "" {
+		return cli.NewExitError("the --plan flag is required", 1)
+	}
+	plan, err := config.LoadPlan(appConfig.ConfigPath, c.String("plan"))
+	if err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
+
+	// the catalog can't be shared with a running mgob
+	store, err := db.Open(path.Join(appConfig.DataPath, "mgob.db"))
+	if err != nil {
+		return cli.NewExitError(fmt.Sprintf("%v, stop mgob before re-encrypting", err), 1)
+	}
+	defer store.Close()
+	catalogStore, err := db.NewCatalogStore(store)
+	if err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		<-sigChan
+		cancel()
+	}()
+
+	if key := c.String("key"); key != "" {
+		if err := restore.ImportKey(ctx, key); err != nil {
+			return cli.NewExitError(err.Error(), 1)
+		}
+	}
+
+	sch := scheduler.New([]config.Plan{plan}, appConfig, modules, nil, catalogStore, nil, nil)
+	report := sch.Reencrypt(ctx, plan)
+	if appConfig.JSONLog {
+		json.NewEncoder(os.Stdout).Encode(report)
+	} else {
+		for _, name := range report.Reencrypted {
+			fmt.Printf("DONE  %v\n", name)
+		}
+		for _, p := range report.Problems {
+			fmt.Printf("FAIL  %v\n", p)
+		}
+		fmt.Printf("%v re-encrypted, %v already done for %v\n",
+			len(report.Reencrypted), report.Skipped, strings.Join(report.Recipients, ", "))
+	}
+
+	if len(report.Problems) > 0 {
+		return cli.NewExitError(fmt.Sprintf("re-encryption of plan %v is incomplete, run it again to resume", plan.Name), 1)
+	}
+	return nil
+}
+
+func runAgent(c *cli.Context) error {
+	log.Infof("mgob %v agent", version)
+	loadConfig(c)
+
+	if c.String("server") == "" {
+		return cli.NewExitError("the --server flag is required", 1)
+	}
+	tlsConfig, err := agent.TLSConfig(appConfig.AgentCert, appConfig.AgentKey, appConfig.AgentCA, false)
+	if err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		sig := <-sigChan
+		log.Infof("shutting down %v signal received", sig)
+		cancel()
+	}()
+
+	log.Infof("polling %v for jobs", c.String("server"))
+	agent.New(c.String("server"), tlsConfig, appConfig).Run(ctx)
+	return nil
+}
+
+func start(c *cli.Context) error {
+	log.Infof("mgob %v", version)
+	loadConfig(c)
 
 	plans, err := config.LoadPlans(appConfig.ConfigPath)
 	if err != nil {
 		log.Fatal(err)
 	}
+	for _, plan := range plans {
+		if plan.Debug {
+			logging.SetPlanDebug(plan.Name, true)
+		}
+	}
+
+	if err := config.CheckWritable(appConfig.StoragePath, appConfig.DataPath); err != nil {
+		log.Fatal(err)
+	}
 
 	store, err := db.Open(path.Join(appConfig.DataPath, "mgob.db"))
 	if err != nil {
@@ -136,27 +679,128 @@ func start(c *cli.Context) error {
 	if err != nil {
 		log.Fatal(err)
 	}
-	sch := scheduler.New(plans, appConfig, modules, statusStore)
-	sch.Start()
+	catalogStore, err := db.NewCatalogStore(store)
+	if err != nil {
+		log.Fatal(err)
+	}
+	signingKey, err := db.LoadSigningKey(appConfig.ManifestKey)
+	if err != nil {
+		log.Fatal(err)
+	}
+	manifestStore, err := db.NewManifestStore(store, signingKey)
+	if err != nil {
+		log.Fatal(err)
+	}
+	setStore, err := db.NewSetStore(store)
+	if err != nil {
+		log.Fatal(err)
+	}
+	sch := scheduler.New(plans, appConfig, modules, statusStore, catalogStore, manifestStore, setStore)
+	if err := sch.Start(); err != nil {
+		log.Fatal(err)
+	}
+
+	var hub *agent.Hub
+	var agentTLS *tls.Config
+	if appConfig.AgentPort > 0 {
+		agentTLS, err = agent.TLSConfig(appConfig.AgentCert, appConfig.AgentKey, appConfig.AgentCA, true)
+		if err != nil {
+			log.Fatal(err)
+		}
+		hub = agent.NewHub(appConfig)
+		backup.SetDispatcher(hub)
+	}
+
+	var ctl *controller.Controller
+	if appConfig.Controller {
+		instanceStore, err := db.NewInstanceStore(store)
+		if err != nil {
+			log.Fatal(err)
+		}
+		ctl = controller.New(instanceStore)
+	}
+
+	var tenants *config.Tenants
+	if appConfig.TenantsPath != "" {
+		if tenants, err = config.LoadTenants(appConfig.TenantsPath); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	extracts := extract.NewManager(appConfig)
+	extracts.Prune(plans)
 
 	server := &api.HttpServer{
-		Config:  appConfig,
-		Modules: modules,
-		Stats:   statusStore,
+		Tenants:    tenants,
+		Config:     appConfig,
+		Modules:    modules,
+		Stats:      statusStore,
+		Scheduler:  sch,
+		Extracts:   extracts,
+		Agents:     hub,
+		Controller: ctl,
+	}
+	switch {
+	case appConfig.Socket != "":
+		log.Infof("starting http server on socket %v", appConfig.Socket)
+		go server.Start(appConfig.Version)
+	case appConfig.Port > 0:
+		log.Infof("starting http server on port %v", appConfig.Port)
+		go server.Start(appConfig.Version)
+	default:
+		log.Info("http server disabled")
+	}
+	if appConfig.DebugPort > 0 {
+		log.Infof("starting debug server on port %v", appConfig.DebugPort)
+		go server.StartDebug()
+	}
+	if hub != nil {
+		log.Infof("starting agent server on port %v", appConfig.AgentPort)
+		go server.StartAgents(agentTLS)
 	}
-	log.Infof("starting http server on port %v", appConfig.Port)
-	go server.Start(appConfig.Version)
 
-	// wait for SIGINT (Ctrl+C) or SIGTERM (docker stop)
+	// wait for SIGINT (Ctrl+C) or SIGTERM (docker stop), SIGHUP reloads the plans
 	sigChan := make(chan os.Signal, 1)
-	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
+	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
 	sig := <-sigChan
+	for sig == syscall.SIGHUP {
+		if applied, err := sch.Reload(); err != nil {
+			log.Errorf("Config reload failed %v", err)
+		} else {
+			log.Infof("SIGHUP received, reloaded plans %v", strings.Join(applied, ", "))
+		}
+		sig = <-sigChan
+	}
 
 	log.Infof("shutting down %v signal received", sig)
+	sch.Stop(30 * time.Second)
+	extracts.Close()
 
 	return nil
 }
 
+// setupPaths points the child processes at the writable volumes, the root
+// filesystem can be read-only and the user doesn't have to be root.
+func setupPaths() {
+	if appConfig.HomePath != "" {
+		// aws, mc, gcloud, az and gpg keep their config and keys under $HOME
+		if err := os.MkdirAll(appConfig.HomePath, 0700); err != nil {
+			log.Fatal(err)
+		}
+		os.Setenv("HOME", appConfig.HomePath)
+	}
+	// temp files of the tools and of mgob go to the tmp volume instead of /tmp
+	os.Setenv("TMPDIR", appConfig.TmpPath)
+
+	if err := config.CheckWritable(appConfig.TmpPath); err != nil {
+		log.Fatal(err)
+	}
+	// only the plans using a cloud CLI or gpg need it
+	if home, err := os.UserHomeDir(); err != nil || config.CheckWritable(home) != nil {
+		log.Warnf("home dir %q is not writable, set --HomePath to a writable volume", home)
+	}
+}
+
 func checkClients() {
 	if modules.MinioClient {
 		info, err := backup.CheckMinioClient()
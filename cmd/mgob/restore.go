@@ -0,0 +1,239 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"github.com/urfave/cli"
+
+	"github.com/stefanprodan/mgob/pkg/restore"
+	"github.com/stefanprodan/mgob/pkg/scheduler"
+)
+
+// atLayouts are the time formats --at accepts besides unix seconds.
+var atLayouts = []string{
+	time.RFC3339,
+	"2006-01-02T15:04Z07:00",
+	"2006-01-02T15:04:05",
+	"2006-01-02T15:04",
+	"2006-01-02 15:04:05",
+	"2006-01-02 15:04",
+	"2006-01-02",
+}
+
+// parseAt reads the --at time, in UTC when it has no zone.
+func parseAt(v string) (time.Time, error) {
+	if unix, err := strconv.ParseInt(v, 10, 64); err == nil {
+		return time.Unix(unix, 0), nil
+	}
+	for _, layout := range atLayouts {
+		if t, err := time.Parse(layout, v); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, errors.Errorf("invalid time %v, use RFC3339 e.g. 2024-06-01T03:00Z or unix seconds", v)
+}
+
+// apiClient calls the API of the running mgob, on its socket when it serves one.
+type apiClient struct {
+	http  *http.Client
+	base  string
+	token string
+}
+
+func newAPIClient(server string, token string) *apiClient {
+	c := &apiClient{http: &http.Client{}, base: strings.TrimSuffix(server, "/"), token: token}
+	if server == "" && appConfig.Socket != "" {
+		socket := appConfig.Socket
+		c.http.Transport = &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", socket)
+			},
+		}
+		c.base = "http://mgob"
+	} else if server == "" {
+		c.base = fmt.Sprintf("http://localhost:%v", appConfig.Port)
+	}
+	return c
+}
+
+// call sends the request and returns the status and body of the response,
+// the error message of the API for the statuses over 299.
+func (c *apiClient) call(ctx context.Context, method string, uri string) (int, []byte, error) {
+	req, err := http.NewRequest(method, c.base+uri, nil)
+	if err != nil {
+		return 0, nil, err
+	}
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+	resp, err := c.http.Do(req.WithContext(ctx))
+	if err != nil {
+		return 0, nil, errors.Wrapf(err, "%v %v failed", method, uri)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return resp.StatusCode, nil, errors.Wrapf(err, "reading the response of %v %v failed", method, uri)
+	}
+	if resp.StatusCode > 299 {
+		var e struct {
+			Error string `json:"error"`
+		}
+		if json.Unmarshal(body, &e) == nil && e.Error != "" {
+			return resp.StatusCode, body, errors.New(e.Error)
+		}
+		return resp.StatusCode, body, errors.Errorf("%v %v failed with status %v", method, uri, resp.StatusCode)
+	}
+	return resp.StatusCode, body, nil
+}
+
+// restoreCall sends a restore request and decodes the response into v. It
+// returns the approval id when the plan approval holds the request.
+func (c *apiClient) restoreCall(ctx context.Context, uri string, v interface{}) (string, error) {
+	status, body, err := c.call(ctx, "POST", uri)
+	if err != nil {
+		return "", err
+	}
+	if status == http.StatusAccepted {
+		var approval struct {
+			ID string `json:"id"`
+		}
+		if err := json.Unmarshal(body, &approval); err != nil {
+			return "", errors.Wrapf(err, "parsing the response of POST %v failed", uri)
+		}
+		return approval.ID, nil
+	}
+	if err := json.Unmarshal(body, v); err != nil {
+		return "", errors.Wrapf(err, "parsing the response of POST %v failed", uri)
+	}
+	return "", nil
+}
+
+// runRestore restores a plan to the state it had at a time through the API
+// of the running mgob: the newest backup taken before it, replayed up to it
+// when the oplog chain covers it.
+func runRestore(c *cli.Context) error {
+	log.Infof("mgob %v restore", version)
+	loadConfig(c)
+
+	if c.String("plan") == "" || c.String("at") == "" {
+		return cli.NewExitError("the --plan and --at flags are required", 1)
+	}
+	at, err := parseAt(c.String("at"))
+	if err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
+	plan := c.String("plan")
+	dryRun := c.Bool("dry-run")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	client := newAPIClient(c.String("server"), c.String("token"))
+
+	var res scheduler.Resolution
+	uri := fmt.Sprintf("/backups/%v/resolve?time=%v", url.PathEscape(plan), at.Unix())
+	_, body, err := client.call(ctx, "GET", uri)
+	if err == nil {
+		err = json.Unmarshal(body, &res)
+	}
+	if err != nil {
+		return cli.NewExitError(fmt.Sprintf("resolving %v of plan %v failed: %v", at.UTC(), plan, err), 1)
+	}
+	printResolution(os.Stdout, res)
+	if res.Exact && dryRun {
+		fmt.Println("dry run: the archives are validated, the oplog segments aren't replayed")
+	}
+
+	if !c.Bool("yes") && !dryRun {
+		ok, err := confirm(os.Stdin, os.Stdout, fmt.Sprintf("Restore plan %v into its restore target? [y/N] ", plan))
+		if err != nil {
+			return cli.NewExitError(err.Error(), 1)
+		}
+		if !ok {
+			return cli.NewExitError("restore canceled", 1)
+		}
+	}
+
+	if res.Exact && !dryRun {
+		var p scheduler.PointInTime
+		approval, err := client.restoreCall(ctx, fmt.Sprintf("/restore/%v?time=%v", url.PathEscape(plan), at.Unix()), &p)
+		if err != nil {
+			return cli.NewExitError(fmt.Sprintf("restore of plan %v failed: %v", plan, err), 1)
+		}
+		if approval != "" {
+			return pendingApproval(approval)
+		}
+		fmt.Printf("plan %v restored to %v from %v and %v oplog segments in %v\n",
+			plan, p.Time.UTC(), p.Full, len(p.Segments), p.Duration.Round(time.Millisecond))
+		return nil
+	}
+
+	for _, a := range res.Archives {
+		uri := fmt.Sprintf("/restore/%v/%v?wait=true", url.PathEscape(plan), url.PathEscape(a.Name))
+		if dryRun {
+			uri += "&dryRun=true"
+		}
+		var r restore.Result
+		approval, err := client.restoreCall(ctx, uri, &r)
+		if err != nil {
+			return cli.NewExitError(fmt.Sprintf("restore of %v failed: %v", a.Name, err), 1)
+		}
+		if approval != "" {
+			return pendingApproval(approval)
+		}
+		fmt.Printf("%v %v from %v in %v\n", r.Status, a.Name, r.Source, r.Duration.Round(time.Millisecond))
+	}
+	return nil
+}
+
+func printResolution(w io.Writer, res scheduler.Resolution) {
+	fmt.Fprintf(w, "plan:      %v\n", res.Plan)
+	fmt.Fprintf(w, "time:      %v\n", res.Time.UTC())
+	fmt.Fprintf(w, "backup:    %v\n", res.Timestamp.UTC())
+	for _, a := range append(res.Archives, res.Segments...) {
+		where := append([]string{}, a.Destinations...)
+		if a.Local {
+			where = append([]string{"Local"}, where...)
+		}
+		fmt.Fprintf(w, "archive:   %v (%v)\n", a.Name, strings.Join(where, ", "))
+	}
+	if res.Exact {
+		fmt.Fprintf(w, "restores:  the state at %v, the oplog chain %v is replayed\n", res.Time.UTC(), res.Chain)
+	} else {
+		fmt.Fprintf(w, "restores:  the state of the backup, %v before the requested time\n", res.Time.Sub(res.Timestamp).Round(time.Second))
+	}
+}
+
+// confirm asks question and reports whether the answer is yes, a closed
+// input is a no.
+func confirm(r io.Reader, w io.Writer, question string) (bool, error) {
+	fmt.Fprint(w, question)
+	line, err := bufio.NewReader(r).ReadString('\n')
+	if err != nil && err != io.EOF {
+		return false, err
+	}
+	answer := strings.ToLower(strings.TrimSpace(line))
+	return answer == "y" || answer == "yes", nil
+}
+
+// pendingApproval reports a restore held by the plan approval, another
+// token approves it.
+func pendingApproval(id string) error {
+	fmt.Printf("restore pending approval %v, approve it with POST /approvals/%v/approve\n", id, id)
+	return nil
+}
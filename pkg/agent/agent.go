@@ -0,0 +1,213 @@
+package agent
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/stefanprodan/mgob/pkg/backup"
+	"github.com/stefanprodan/mgob/pkg/config"
+)
+
+// retryInterval is the pause after a failed poll.
+var retryInterval = 10 * time.Second
+
+// Agent runs the dumps queued by the mgob server and streams the archives back to it.
+type Agent struct {
+	server string
+	conf   *config.AppConfig
+	client *http.Client
+}
+
+func New(server string, tlsConfig *tls.Config, conf *config.AppConfig) *Agent {
+	return &Agent{
+		server: strings.TrimSuffix(server, "/"),
+		conf:   conf,
+		client: &http.Client{Transport: &http.Transport{
+			TLSClientConfig:   tlsConfig,
+			ForceAttemptHTTP2: true,
+		}},
+	}
+}
+
+// Run polls the server for jobs until ctx is cancelled.
+func (a *Agent) Run(ctx context.Context) {
+	for ctx.Err() == nil {
+		j, err := a.poll(ctx)
+		if err != nil {
+			if ctx.Err() == nil {
+				log.Errorf("Polling %v failed %v", a.server, err)
+				select {
+				case <-time.After(retryInterval):
+				case <-ctx.Done():
+				}
+			}
+			continue
+		}
+		if j != nil {
+			a.run(ctx, j)
+		}
+	}
+}
+
+func (a *Agent) poll(ctx context.Context) (*Job, error) {
+	pctx, cancel := context.WithTimeout(ctx, pollTimeout+30*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(pctx, "GET", a.server+"/agent/v1/jobs", nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusNoContent:
+		return nil, nil
+	case http.StatusOK:
+		var j Job
+		if err := json.NewDecoder(resp.Body).Decode(&j); err != nil {
+			return nil, errors.Wrap(err, "decoding job failed")
+		}
+		return &j, nil
+	default:
+		return nil, responseError(resp)
+	}
+}
+
+func (a *Agent) run(ctx context.Context, j *Job) {
+	plan := j.Job.Plan.Name
+	log.WithField("plan", plan).Infof("Dump %v started", j.ID)
+
+	status := Status{}
+	var mlog []byte
+	var err error
+	if backup.Streams(j.Job) {
+		mlog, err = a.stream(ctx, j)
+	} else {
+		mlog, err = a.dumpAndUpload(ctx, j)
+	}
+	status.Log = string(mlog)
+	if err != nil {
+		log.WithField("plan", plan).Errorf("Dump %v failed %v", j.ID, err)
+		status.Error = err.Error()
+	}
+
+	body, _ := json.Marshal(status)
+	if err := a.send(ctx, "POST", fmt.Sprintf("/agent/v1/jobs/%v/done", url.PathEscape(j.ID)), bytes.NewReader(body), -1); err != nil {
+		log.WithField("plan", plan).Errorf("Reporting dump %v failed %v", j.ID, err)
+		return
+	}
+	log.WithField("plan", plan).Infof("Dump %v finished", j.ID)
+}
+
+// stream pipes the mongodump stdout into the archive upload, the archive
+// never touches the disk of the agent.
+func (a *Agent) stream(ctx context.Context, j *Job) ([]byte, error) {
+	sctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	pr, pw := io.Pipe()
+	var mlog []byte
+	dumped := make(chan error, 1)
+	go func() {
+		var err error
+		mlog, err = backup.DumpTo(sctx, j.Job, a.conf, pw)
+		dumped <- err
+		// a dump error aborts the upload, the server drops the partial archive
+		pw.CloseWithError(err)
+	}()
+
+	err := a.send(sctx, "PUT", archivePath(j, backup.StreamName(j.Job, a.conf)), pr, -1)
+	if err != nil {
+		select {
+		case derr := <-dumped:
+			if derr != nil {
+				return mlog, derr
+			}
+		default:
+			// stop mongodump, nothing reads its output anymore
+			cancel()
+			pr.CloseWithError(err)
+			<-dumped
+		}
+		return mlog, errors.Wrap(err, "streaming archive failed")
+	}
+	return mlog, <-dumped
+}
+
+// dumpAndUpload dumps to the tmp dir the archives mongodump can't write to
+// stdout, e.g. the directory format, then uploads the file.
+func (a *Agent) dumpAndUpload(ctx context.Context, j *Job) ([]byte, error) {
+	archive, mlog, err := backup.Dump(ctx, j.Job, a.conf)
+	if archive != "" {
+		defer os.Remove(archive)
+	}
+	var data []byte
+	if mlog != "" {
+		data, _ = ioutil.ReadFile(mlog)
+		os.Remove(mlog)
+	}
+	if err != nil {
+		return data, err
+	}
+	return data, a.upload(ctx, j, archive)
+}
+
+func (a *Agent) upload(ctx context.Context, j *Job, archive string) error {
+	f, err := os.Open(archive)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	return errors.Wrap(a.send(ctx, "PUT", archivePath(j, filepath.Base(archive)), f, fi.Size()), "uploading archive failed")
+}
+
+func archivePath(j *Job, name string) string {
+	return fmt.Sprintf("/agent/v1/jobs/%v/archive?name=%v", url.PathEscape(j.ID), url.QueryEscape(name))
+}
+
+func (a *Agent) send(ctx context.Context, method string, path string, body io.Reader, size int64) error {
+	req, err := http.NewRequestWithContext(ctx, method, a.server+path, body)
+	if err != nil {
+		return err
+	}
+	if size >= 0 {
+		req.ContentLength = size
+	}
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return responseError(resp)
+	}
+	return nil
+}
+
+func responseError(resp *http.Response) error {
+	var body struct {
+		Error string `json:"error"`
+	}
+	json.NewDecoder(resp.Body).Decode(&body)
+	return errors.Errorf("server responded %v %v", resp.Status, body.Error)
+}
@@ -0,0 +1,100 @@
+//go:build !windows
+// +build !windows
+
+package agent
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stefanprodan/mgob/pkg/backup"
+	"github.com/stefanprodan/mgob/pkg/config"
+)
+
+// fakeMongodump puts a mongodump on PATH running script.
+func fakeMongodump(t *testing.T, script string) {
+	dir, err := ioutil.TempDir("", "mgob-bin-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	if err := ioutil.WriteFile(filepath.Join(dir, "mongodump"), []byte("#!/bin/sh\n"+script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	path := os.Getenv("PATH")
+	os.Setenv("PATH", dir+string(os.PathListSeparator)+path)
+	t.Cleanup(func() { os.Setenv("PATH", path) })
+}
+
+func TestStream(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "mgob-agent-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	type upload struct {
+		name   string
+		length int64
+		body   string
+		err    error
+	}
+	uploads := make(chan upload, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := ioutil.ReadAll(r.Body)
+		uploads <- upload{r.URL.Query().Get("name"), r.ContentLength, string(body), err}
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+		}
+	}))
+	defer srv.Close()
+
+	a := New(srv.URL, nil, &config.AppConfig{TmpPath: tmp})
+	ts := time.Unix(1494256295, 0)
+	j := &Job{ID: "1", Job: backup.DumpJob{
+		Plan:      config.Plan{Name: "test", Target: config.Target{Host: "mongo", Port: 27017}},
+		Name:      "test",
+		Timestamp: ts,
+		Gzip:      true,
+	}}
+	if !backup.Streams(j.Job) {
+		t.Fatal("an archive dump isn't streamed")
+	}
+
+	fakeMongodump(t, `case "$1" in --archive) ;; *) exit 2 ;; esac
+echo "writing archive" >&2
+printf archive-data`)
+	mlog, err := a.stream(context.Background(), j)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u := <-uploads
+	if u.err != nil || u.body != "archive-data" || u.name != "test-1494256295.gz" {
+		t.Fatalf("uploaded %q as %v, read error %v", u.body, u.name, u.err)
+	}
+	if u.length != -1 {
+		t.Errorf("the upload has a content length %v", u.length)
+	}
+	if !strings.Contains(string(mlog), "writing archive") {
+		t.Errorf("mongodump log %q", mlog)
+	}
+	if files, _ := ioutil.ReadDir(tmp); len(files) != 0 {
+		t.Errorf("the agent wrote %v to its tmp dir", files[0].Name())
+	}
+
+	// a failed dump aborts the upload
+	fakeMongodump(t, `printf partial; echo "connection refused" >&2; exit 1`)
+	if _, err := a.stream(context.Background(), j); err == nil || !strings.Contains(err.Error(), "connection refused") {
+		t.Fatalf("the failed dump returned %v", err)
+	}
+	if u := <-uploads; u.err == nil {
+		t.Fatalf("the server read a complete archive %q from a failed dump", u.body)
+	}
+}
@@ -0,0 +1,290 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-chi/chi"
+	"github.com/go-chi/render"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/stefanprodan/mgob/pkg/backup"
+	"github.com/stefanprodan/mgob/pkg/clock"
+	"github.com/stefanprodan/mgob/pkg/config"
+)
+
+// pollTimeout is how long a job request waits before the agent polls again.
+var pollTimeout = 30 * time.Second
+
+// Job is a dump assigned to an agent.
+type Job struct {
+	ID  string         `json:"id"`
+	Job backup.DumpJob `json:"job"`
+}
+
+// Status is the agent report sent when a job is done.
+type Status struct {
+	Log   string `json:"log"`
+	Error string `json:"error,omitempty"`
+}
+
+// Info describes a connected agent.
+type Info struct {
+	Name     string    `json:"name"`
+	LastSeen time.Time `json:"last_seen"`
+	Queued   int       `json:"queued"`
+	Running  []string  `json:"running"`
+}
+
+type job struct {
+	Job
+	agent   string
+	archive string
+	mlog    string
+	err     error
+	taken   bool
+	done    chan struct{}
+}
+
+// Hub queues the dumps of agent plans until their agent picks them up and
+// receives the archives streamed back. It implements backup.Dispatcher.
+type Hub struct {
+	conf   *config.AppConfig
+	mu     sync.Mutex
+	queues map[string]chan *job
+	jobs   map[string]*job
+	seen   map[string]time.Time
+	lastID int
+}
+
+func NewHub(conf *config.AppConfig) *Hub {
+	return &Hub{
+		conf:   conf,
+		queues: make(map[string]chan *job),
+		jobs:   make(map[string]*job),
+		seen:   make(map[string]time.Time),
+	}
+}
+
+func (h *Hub) queue(agent string) chan *job {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	q, ok := h.queues[agent]
+	if !ok {
+		q = make(chan *job, 100)
+		h.queues[agent] = q
+	}
+	return q
+}
+
+// Dump queues job for the plan agent and waits for the agent to report it done.
+func (h *Hub) Dump(ctx context.Context, dj backup.DumpJob) (string, string, error) {
+	h.mu.Lock()
+	h.lastID++
+	j := &job{
+		Job:   Job{ID: fmt.Sprintf("%v-%v", dj.Name, h.lastID), Job: dj},
+		agent: dj.Plan.Agent,
+		done:  make(chan struct{}),
+	}
+	h.jobs[j.ID] = j
+	h.mu.Unlock()
+
+	defer func() {
+		h.mu.Lock()
+		delete(h.jobs, j.ID)
+		h.mu.Unlock()
+	}()
+
+	select {
+	case h.queue(j.agent) <- j:
+	default:
+		return "", "", errors.Errorf("agent %v queue is full", j.agent)
+	}
+	log.WithField("plan", dj.Plan.Name).Infof("Dump queued for agent %v", j.agent)
+
+	select {
+	case <-j.done:
+		return j.archive, j.mlog, j.err
+	case <-ctx.Done():
+		return "", "", errors.Wrapf(ctx.Err(), "waiting for agent %v failed", j.agent)
+	}
+}
+
+// Agents lists the agents that polled or have jobs queued.
+func (h *Hub) Agents() []Info {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	list := make([]Info, 0)
+	for name, q := range h.queues {
+		info := Info{Name: name, LastSeen: h.seen[name], Queued: len(q), Running: make([]string, 0)}
+		for _, j := range h.jobs {
+			if j.agent == name && j.taken {
+				info.Running = append(info.Running, j.ID)
+			}
+		}
+		list = append(list, info)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list
+}
+
+// Handler serves the agent endpoints, the agent name is the CN of its client certificate.
+func (h *Hub) Handler() http.Handler {
+	r := chi.NewRouter()
+	r.Get("/agent/v1/jobs", h.getJob)
+	r.Put("/agent/v1/jobs/{id}/archive", h.putArchive)
+	r.Post("/agent/v1/jobs/{id}/done", h.postDone)
+	return r
+}
+
+func agentName(r *http.Request) string {
+	if r.TLS == nil || len(r.TLS.PeerCertificates) == 0 {
+		return ""
+	}
+	return r.TLS.PeerCertificates[0].Subject.CommonName
+}
+
+func (h *Hub) getJob(w http.ResponseWriter, r *http.Request) {
+	name := agentName(r)
+	if name == "" {
+		render.Status(r, 401)
+		render.JSON(w, r, map[string]string{"error": "client certificate required"})
+		return
+	}
+	q := h.queue(name)
+	h.mu.Lock()
+	h.seen[name] = clock.Now().UTC()
+	h.mu.Unlock()
+
+	timer := time.NewTimer(pollTimeout)
+	defer timer.Stop()
+	for {
+		select {
+		case j := <-q:
+			h.mu.Lock()
+			_, active := h.jobs[j.ID]
+			j.taken = active
+			h.mu.Unlock()
+			if !active {
+				// the run was cancelled while queued
+				continue
+			}
+			log.WithField("plan", j.Job.Job.Plan.Name).Infof("Dump %v picked up by agent %v", j.ID, name)
+			render.JSON(w, r, j.Job)
+			return
+		case <-timer.C:
+			w.WriteHeader(http.StatusNoContent)
+			return
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+func (h *Hub) takenJob(w http.ResponseWriter, r *http.Request) *job {
+	h.mu.Lock()
+	j, ok := h.jobs[chi.URLParam(r, "id")]
+	h.mu.Unlock()
+	if !ok || !j.taken || j.agent != agentName(r) {
+		render.Status(r, 404)
+		render.JSON(w, r, map[string]string{"error": "job not found"})
+		return nil
+	}
+	return j
+}
+
+func (h *Hub) putArchive(w http.ResponseWriter, r *http.Request) {
+	j := h.takenJob(w, r)
+	if j == nil {
+		return
+	}
+	name := filepath.Base(r.URL.Query().Get("name"))
+	if !strings.HasPrefix(name, fmt.Sprintf("%v-%v.", j.Job.Job.Name, j.Job.Job.Timestamp.Unix())) {
+		render.Status(r, 400)
+		render.JSON(w, r, map[string]string{"error": "invalid archive name " + name})
+		return
+	}
+
+	archive := filepath.Join(h.conf.TmpPath, name)
+	f, err := os.Create(archive)
+	if err == nil {
+		_, err = io.Copy(f, r.Body)
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+	}
+	if err != nil {
+		os.Remove(archive)
+		render.Status(r, 500)
+		render.JSON(w, r, map[string]string{"error": err.Error()})
+		return
+	}
+
+	h.mu.Lock()
+	_, active := h.jobs[j.ID]
+	if active {
+		j.archive = archive
+	}
+	h.mu.Unlock()
+	if !active {
+		os.Remove(archive)
+		render.Status(r, 410)
+		render.JSON(w, r, map[string]string{"error": "job cancelled"})
+		return
+	}
+	render.JSON(w, r, map[string]string{"message": "archive received"})
+}
+
+func (h *Hub) postDone(w http.ResponseWriter, r *http.Request) {
+	j := h.takenJob(w, r)
+	if j == nil {
+		return
+	}
+	var s Status
+	if err := json.NewDecoder(r.Body).Decode(&s); err != nil {
+		render.Status(r, 400)
+		render.JSON(w, r, map[string]string{"error": err.Error()})
+		return
+	}
+
+	dj := j.Job.Job
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if _, active := h.jobs[j.ID]; !active {
+		render.Status(r, 410)
+		render.JSON(w, r, map[string]string{"error": "job cancelled"})
+		return
+	}
+	select {
+	case <-j.done:
+		render.Status(r, 409)
+		render.JSON(w, r, map[string]string{"error": "job already done"})
+		return
+	default:
+	}
+
+	j.mlog = fmt.Sprintf("%v/%v-%v.log", h.conf.TmpPath, dj.Name, dj.Timestamp.Unix())
+	if err := ioutil.WriteFile(j.mlog, []byte(s.Log), 0644); err != nil {
+		log.WithField("plan", dj.Plan.Name).Warnf("Saving agent log failed %v", err)
+	}
+	switch {
+	case s.Error != "":
+		j.err = errors.Errorf("agent %v dump failed %v", j.agent, s.Error)
+	case j.archive == "":
+		j.err = errors.Errorf("agent %v sent no archive", j.agent)
+	}
+	close(j.done)
+	render.JSON(w, r, map[string]string{"message": "job done"})
+}
@@ -0,0 +1,24 @@
+package api
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/go-chi/render"
+
+	"github.com/stefanprodan/mgob/pkg/agent"
+)
+
+func agentsCtx(hub *agent.Hub) func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			r = r.WithContext(context.WithValue(r.Context(), "app.agents", hub))
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+func getAgents(w http.ResponseWriter, r *http.Request) {
+	hub := r.Context().Value("app.agents").(*agent.Hub)
+	render.JSON(w, r, hub.Agents())
+}
@@ -0,0 +1,203 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/go-chi/chi"
+	"github.com/go-chi/render"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/stefanprodan/mgob/pkg/clock"
+	"github.com/stefanprodan/mgob/pkg/scheduler"
+)
+
+// Approval is a restore held until a second token approves it, the request is
+// replayed with the approver's token once approved.
+type Approval struct {
+	ID          string    `json:"id"`
+	Plan        string    `json:"plan"`
+	Operation   string    `json:"operation"`
+	Method      string    `json:"method"`
+	Path        string    `json:"path"`
+	RequestedBy string    `json:"requestedBy"`
+	Requested   time.Time `json:"requested"`
+	Expires     time.Time `json:"expires"`
+	body        []byte
+}
+
+// approvals holds the pending requests in memory, a restart drops them.
+type approvals struct {
+	mu      sync.Mutex
+	pending map[string]*Approval
+	// router replays the approved requests
+	router http.Handler
+	// enabled is false without tenants, the requests have no identity
+	enabled bool
+}
+
+func newApprovals(enabled bool) *approvals {
+	return &approvals{pending: make(map[string]*Approval), enabled: enabled}
+}
+
+// list returns the pending requests, oldest first, dropping the expired ones.
+func (a *approvals) list() []Approval {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	now := clock.Now()
+	list := make([]Approval, 0, len(a.pending))
+	for id, p := range a.pending {
+		if now.After(p.Expires) {
+			log.WithField("plan", p.Plan).Warnf("Approval %v of %v %v expired", id, p.Method, p.Path)
+			delete(a.pending, id)
+			continue
+		}
+		list = append(list, *p)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Requested.Before(list[j].Requested) })
+	return list
+}
+
+func (a *approvals) get(id string) (*Approval, bool) {
+	for _, p := range a.list() {
+		if p.ID == id {
+			return &p, true
+		}
+	}
+	return nil, false
+}
+
+func (a *approvals) take(id string) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	_, ok := a.pending[id]
+	delete(a.pending, id)
+	return ok
+}
+
+// gate holds the requests of the plans with an approval, the route must have
+// a planID param. Dry runs and the replays of approved requests pass.
+func (a *approvals) gate(operation string) func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			sch := r.Context().Value("app.scheduler").(*scheduler.Scheduler)
+			plan, ok := sch.Lookup(chi.URLParam(r, "planID"))
+			if !ok || plan.Approval == nil || r.URL.Query().Get("dryRun") == "true" || r.Context().Value("app.approved") != nil {
+				next.ServeHTTP(w, r)
+				return
+			}
+			if !a.enabled {
+				render.Status(r, 403)
+				render.JSON(w, r, map[string]string{"error": "Plan " + plan.Name + " requires approvals, they need API tokens"})
+				return
+			}
+			body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, 1<<20))
+			if err != nil {
+				render.Status(r, 400)
+				render.JSON(w, r, map[string]string{"error": "Invalid request body " + err.Error()})
+				return
+			}
+			ttl := plan.Approval.TTL
+			if ttl <= 0 {
+				ttl = 60
+			}
+			id := make([]byte, 8)
+			rand.Read(id)
+			p := &Approval{
+				ID:          hex.EncodeToString(id),
+				Plan:        plan.Name,
+				Operation:   operation,
+				Method:      r.Method,
+				Path:        r.URL.RequestURI(),
+				RequestedBy: accessOf(r).identity,
+				Requested:   clock.Now(),
+				Expires:     clock.Now().Add(time.Duration(ttl) * time.Minute),
+				body:        body,
+			}
+			a.mu.Lock()
+			a.pending[p.ID] = p
+			a.mu.Unlock()
+
+			log.WithField("plan", plan.Name).Infof("%v %v by %v is pending approval %v", p.Method, p.Path, p.RequestedBy, p.ID)
+			w.Header().Set("Location", "/approvals/"+p.ID)
+			render.Status(r, 202)
+			render.JSON(w, r, p)
+		})
+	}
+}
+
+func (a *approvals) getApprovals(w http.ResponseWriter, r *http.Request) {
+	acc := accessOf(r)
+	list := make([]Approval, 0)
+	for _, p := range a.list() {
+		if acc.visible(p.Plan) {
+			list = append(list, p)
+		}
+	}
+	render.JSON(w, r, list)
+}
+
+func (a *approvals) getApproval(w http.ResponseWriter, r *http.Request) {
+	p, ok := a.get(chi.URLParam(r, "id"))
+	if !ok || !accessOf(r).owns(p.Plan) {
+		render.Status(r, 404)
+		render.JSON(w, r, map[string]string{"error": "Approval " + chi.URLParam(r, "id") + " not found"})
+		return
+	}
+	render.JSON(w, r, p)
+}
+
+// postApprove replays the pending request with the token of the approver,
+// which must differ from the one of the requester. The response is the one
+// of the approved request.
+func (a *approvals) postApprove(w http.ResponseWriter, r *http.Request) {
+	acc := accessOf(r)
+	p, ok := a.get(chi.URLParam(r, "id"))
+	if !ok || !acc.owns(p.Plan) {
+		render.Status(r, 404)
+		render.JSON(w, r, map[string]string{"error": "Approval " + chi.URLParam(r, "id") + " not found"})
+		return
+	}
+	if acc.identity == "" || acc.identity == p.RequestedBy {
+		render.Status(r, 403)
+		render.JSON(w, r, map[string]string{"error": "The request must be approved with another token"})
+		return
+	}
+	if !a.take(p.ID) {
+		render.Status(r, 409)
+		render.JSON(w, r, map[string]string{"error": "Approval " + p.ID + " was already handled"})
+		return
+	}
+	log.WithField("plan", p.Plan).Infof("%v %v approved by %v, approval %v", p.Method, p.Path, acc.identity, p.ID)
+
+	// a fresh route context, the router matches the replay from its root
+	ctx := context.WithValue(context.WithValue(r.Context(), chi.RouteCtxKey, nil), "app.approved", p.ID)
+	replay, err := http.NewRequest(p.Method, p.Path, bytes.NewReader(p.body))
+	if err != nil {
+		render.Status(r, 500)
+		render.JSON(w, r, map[string]string{"error": err.Error()})
+		return
+	}
+	replay.Header = r.Header.Clone()
+	a.router.ServeHTTP(w, replay.WithContext(ctx))
+}
+
+// deleteApproval rejects a pending request, the requester can withdraw it.
+func (a *approvals) deleteApproval(w http.ResponseWriter, r *http.Request) {
+	acc := accessOf(r)
+	p, ok := a.get(chi.URLParam(r, "id"))
+	if !ok || !acc.owns(p.Plan) || !a.take(p.ID) {
+		render.Status(r, 404)
+		render.JSON(w, r, map[string]string{"error": "Approval " + chi.URLParam(r, "id") + " not found"})
+		return
+	}
+	log.WithField("plan", p.Plan).Infof("%v %v rejected by %v, approval %v", p.Method, p.Path, acc.identity, p.ID)
+	render.JSON(w, r, map[string]string{"message": "Approval " + p.ID + " rejected"})
+}
@@ -13,22 +13,25 @@ import (
 
 	"github.com/stefanprodan/mgob/pkg/backup"
 	"github.com/stefanprodan/mgob/pkg/config"
-	"github.com/stefanprodan/mgob/pkg/notifier"
+	"github.com/stefanprodan/mgob/pkg/scheduler"
 )
 
-func configCtx(data config.AppConfig, modules config.ModuleConfig) func(next http.Handler) http.Handler {
+func configCtx(data config.AppConfig, modules config.ModuleConfig, sch *scheduler.Scheduler) func(next http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 			r = r.WithContext(context.WithValue(r.Context(), "app.config", data))
 			r = r.WithContext(context.WithValue(r.Context(), "app.modules", modules))
+			r = r.WithContext(context.WithValue(r.Context(), "app.scheduler", sch))
 			next.ServeHTTP(w, r)
 		})
 	}
 }
 
+// postBackup starts an on demand backup and returns 202 with the run location,
+// with wait=true it blocks until the run returns and responds with its result.
 func postBackup(w http.ResponseWriter, r *http.Request) {
 	cfg := r.Context().Value("app.config").(config.AppConfig)
-	modules := r.Context().Value("app.modules").(config.ModuleConfig)
+	sch := r.Context().Value("app.scheduler").(*scheduler.Scheduler)
 	planID := chi.URLParam(r, "planID")
 	plan, err := config.LoadPlan(cfg.ConfigPath, planID)
 	if err != nil {
@@ -37,28 +40,120 @@ func postBackup(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	log.WithField("plan", planID).Info("On demand backup started")
+	run := sch.StartRun(plan)
+	if r.URL.Query().Get("wait") != "true" {
+		w.Header().Set("Location", "/runs/"+run.ID)
+		render.Status(r, 202)
+		render.JSON(w, r, run)
+		return
+	}
 
-	res, err := backup.Run(plan, &cfg, &modules)
+	run, err = sch.WaitRun(r.Context(), run.ID)
+	if err != nil {
+		render.Status(r, 500)
+		render.JSON(w, r, map[string]string{"error": err.Error()})
+		return
+	}
+	switch {
+	case run.Status == "ok":
+		render.JSON(w, r, toBackupResult(run))
+	case run.Status == "skipped" && !run.Unhealthy:
+		render.JSON(w, r, map[string]string{"message": "No new dumps"})
+	case run.Unhealthy:
+		render.Status(r, 503)
+		render.JSON(w, r, map[string]string{"error": run.Error})
+	default:
+		render.Status(r, 500)
+		render.JSON(w, r, map[string]string{"error": run.Error})
+	}
+}
+
+func getResumeRecord(w http.ResponseWriter, r *http.Request) {
+	cfg := r.Context().Value("app.config").(config.AppConfig)
+	planID := chi.URLParam(r, "planID")
+	rec, err := backup.ReadResume(&cfg, planID)
+	if err != nil {
+		render.Status(r, 500)
+		render.JSON(w, r, map[string]string{"error": err.Error()})
+		return
+	}
+	if rec == nil {
+		render.Status(r, 404)
+		render.JSON(w, r, map[string]string{"error": backup.ErrNothingToResume.Error()})
+		return
+	}
+	render.JSON(w, r, rec)
+}
+
+func postResumeRun(w http.ResponseWriter, r *http.Request) {
+	cfg := r.Context().Value("app.config").(config.AppConfig)
+	sch := r.Context().Value("app.scheduler").(*scheduler.Scheduler)
+	planID := chi.URLParam(r, "planID")
+	plan, err := config.LoadPlan(cfg.ConfigPath, planID)
 	if err != nil {
-		log.WithField("plan", planID).Errorf("On demand backup failed %v", err)
-		if err := notifier.SendNotification(fmt.Sprintf("%v on demand backup failed", planID),
-			err.Error(), true, plan); err != nil {
-			log.WithField("plan", plan.Name).Errorf("Notifier failed for on demand backup %v", err)
-		}
 		render.Status(r, 500)
 		render.JSON(w, r, map[string]string{"error": err.Error()})
-	} else {
-		log.WithField("plan", plan.Name).Infof("On demand backup finished in %v archive %v size %v",
-			res.Duration, res.Name, humanize.Bytes(uint64(res.Size)))
-		if err := notifier.SendNotification(fmt.Sprintf("%v on demand backup finished", plan.Name),
-			fmt.Sprintf("%v backup finished in %v archive size %v",
-				res.Name, res.Duration, humanize.Bytes(uint64(res.Size))),
-			false, plan); err != nil {
-			log.WithField("plan", plan.Name).Errorf("Notifier failed for on demand backup %v", err)
+		return
+	}
+	if plan.Mode != config.BackupModeDatabase {
+		render.Status(r, 400)
+		render.JSON(w, r, map[string]string{"error": fmt.Sprintf("only '%s' backup mode runs can be resumed", config.BackupModeDatabase)})
+		return
+	}
+
+	run, err := sch.ResumeRun(plan)
+	switch {
+	case err == backup.ErrNothingToResume:
+		render.Status(r, 404)
+		render.JSON(w, r, map[string]string{"error": err.Error()})
+		return
+	case err != nil:
+		render.Status(r, 500)
+		render.JSON(w, r, map[string]string{"error": err.Error()})
+		return
+	}
+	w.Header().Set("Location", "/runs/"+run.ID)
+	render.Status(r, 202)
+	render.JSON(w, r, run)
+}
+
+func getRuns(w http.ResponseWriter, r *http.Request) {
+	sch := r.Context().Value("app.scheduler").(*scheduler.Scheduler)
+	a := accessOf(r)
+	list := make([]scheduler.Run, 0)
+	for _, run := range sch.Runs(r.URL.Query().Get("plan")) {
+		if a.visible(run.Plan) {
+			list = append(list, run)
 		}
-		render.JSON(w, r, toBackupResult(res))
 	}
+	render.JSON(w, r, list)
+}
+
+func getRun(w http.ResponseWriter, r *http.Request) {
+	sch := r.Context().Value("app.scheduler").(*scheduler.Scheduler)
+	id := chi.URLParam(r, "id")
+
+	run, ok := sch.GetRun(id)
+	if !ok || !accessOf(r).owns(run.Plan) {
+		render.Status(r, 404)
+		render.JSON(w, r, map[string]string{"error": "Run " + id + " not found"})
+		return
+	}
+	render.JSON(w, r, run)
+}
+
+func deleteBackup(w http.ResponseWriter, r *http.Request) {
+	sch := r.Context().Value("app.scheduler").(*scheduler.Scheduler)
+	planID := chi.URLParam(r, "planID")
+
+	if !sch.Cancel(planID) {
+		render.Status(r, 404)
+		render.JSON(w, r, map[string]string{"error": "No backup running for plan " + planID})
+		return
+	}
+
+	log.WithField("plan", planID).Info("Backup cancelled on demand")
+	render.JSON(w, r, map[string]string{"message": "Backup cancelled"})
 }
 
 type backupResult struct {
@@ -69,12 +164,12 @@ type backupResult struct {
 	Timestamp time.Time `json:"timestamp"`
 }
 
-func toBackupResult(res backup.Result) backupResult {
+func toBackupResult(run scheduler.Run) backupResult {
 	return backupResult{
-		Plan:      res.Plan,
-		Duration:  fmt.Sprintf("%v", res.Duration),
-		File:      res.Name,
-		Size:      humanize.Bytes(uint64(res.Size)),
-		Timestamp: res.Timestamp,
+		Plan:      run.Plan,
+		Duration:  fmt.Sprintf("%v", run.Finished.Sub(run.Started)),
+		File:      run.File,
+		Size:      humanize.Bytes(uint64(run.Size)),
+		Timestamp: run.Started,
 	}
 }
@@ -0,0 +1,70 @@
+package api
+
+import (
+	"fmt"
+	"html"
+	"net/http"
+
+	"github.com/dustin/go-humanize"
+	"github.com/go-chi/chi"
+
+	"github.com/stefanprodan/mgob/pkg/clock"
+	"github.com/stefanprodan/mgob/pkg/db"
+)
+
+const badgeTemplate = `<svg xmlns="http://www.w3.org/2000/svg" width="%[1]d" height="20" role="img" aria-label="%[2]s: %[3]s">
+<title>%[2]s: %[3]s</title>
+<linearGradient id="s" x2="0" y2="100%%"><stop offset="0" stop-color="#bbb" stop-opacity=".1"/><stop offset="1" stop-opacity=".1"/></linearGradient>
+<clipPath id="r"><rect width="%[1]d" height="20" rx="3" fill="#fff"/></clipPath>
+<g clip-path="url(#r)"><rect width="%[4]d" height="20" fill="#555"/><rect x="%[4]d" width="%[5]d" height="20" fill="%[6]s"/><rect width="%[1]d" height="20" fill="url(#s)"/></g>
+<g fill="#fff" text-anchor="middle" font-family="Verdana,Geneva,DejaVu Sans,sans-serif" font-size="11">
+<text x="%[7]d" y="15" fill="#010101" fill-opacity=".3">%[2]s</text><text x="%[7]d" y="14">%[2]s</text>
+<text x="%[8]d" y="15" fill="#010101" fill-opacity=".3">%[3]s</text><text x="%[8]d" y="14">%[3]s</text>
+</g>
+</svg>
+`
+
+// badgeWidth approximates the Verdana 11px text width plus padding.
+func badgeWidth(text string) int {
+	return len(text)*7 + 10
+}
+
+// getBadge serves a shields style SVG with the last run status and age of a plan.
+func getBadge(w http.ResponseWriter, r *http.Request) {
+	data := r.Context().Value("app.status").(appStatus)
+	planID := chi.URLParam(r, "planID")
+
+	var status *db.Status
+	for _, s := range data {
+		if s.Plan == planID {
+			status = s
+		}
+	}
+	if status == nil {
+		http.Error(w, "Plan not found", 404)
+		return
+	}
+
+	label := r.URL.Query().Get("label")
+	if label == "" {
+		label = planID
+	}
+	message, color := "never run", "#9f9f9f"
+	if status.LastRun != nil {
+		age := humanize.RelTime(*status.LastRun, clock.Now(), "ago", "from now")
+		switch status.LastRunStatus {
+		case "200":
+			message, color = "ok "+age, "#4c1"
+		case "503":
+			message, color = "skipped "+age, "#fe7d37"
+		default:
+			message, color = "failed "+age, "#e05d44"
+		}
+	}
+
+	lw, mw := badgeWidth(label), badgeWidth(message)
+	w.Header().Set("Content-Type", "image/svg+xml")
+	w.Header().Set("Cache-Control", "no-cache, max-age=0")
+	fmt.Fprintf(w, badgeTemplate, lw+mw, html.EscapeString(label), html.EscapeString(message),
+		lw, mw, color, lw/2, lw+mw/2)
+}
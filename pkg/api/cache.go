@@ -0,0 +1,25 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/go-chi/render"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/stefanprodan/mgob/pkg/scheduler"
+)
+
+func getCache(w http.ResponseWriter, r *http.Request) {
+	sch := r.Context().Value("app.scheduler").(*scheduler.Scheduler)
+	render.JSON(w, r, sch.CachedArchives())
+}
+
+// deleteCache evicts the cached archives of the plan param, all when empty.
+func deleteCache(w http.ResponseWriter, r *http.Request) {
+	sch := r.Context().Value("app.scheduler").(*scheduler.Scheduler)
+	plan := r.URL.Query().Get("plan")
+	n := sch.PurgeCache(plan)
+	log.Infof("Download cache purged, %v archives evicted", n)
+	render.JSON(w, r, map[string]string{"message": fmt.Sprintf("%v archives evicted", n)})
+}
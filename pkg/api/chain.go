@@ -0,0 +1,49 @@
+package api
+
+import (
+	"net/http"
+
+	"github.com/go-chi/chi"
+	"github.com/go-chi/render"
+
+	"github.com/stefanprodan/mgob/pkg/config"
+	"github.com/stefanprodan/mgob/pkg/scheduler"
+)
+
+func getChains(w http.ResponseWriter, r *http.Request) {
+	sch := r.Context().Value("app.scheduler").(*scheduler.Scheduler)
+	planID := chi.URLParam(r, "planID")
+
+	chains, err := sch.Chains(planID)
+	if err != nil {
+		render.Status(r, 500)
+		render.JSON(w, r, map[string]string{"error": err.Error()})
+		return
+	}
+	render.JSON(w, r, chains)
+}
+
+// getVerifyChain checks a full backup and its incremental segments, 409 when the chain is broken.
+func getVerifyChain(w http.ResponseWriter, r *http.Request) {
+	cfg := r.Context().Value("app.config").(config.AppConfig)
+	sch := r.Context().Value("app.scheduler").(*scheduler.Scheduler)
+	planID := chi.URLParam(r, "planID")
+
+	plan, err := config.LoadPlan(cfg.ConfigPath, planID)
+	if err != nil {
+		render.Status(r, 500)
+		render.JSON(w, r, map[string]string{"error": err.Error()})
+		return
+	}
+
+	report, err := sch.VerifyChain(r.Context(), plan, chi.URLParam(r, "chain"))
+	if err != nil {
+		render.Status(r, 500)
+		render.JSON(w, r, map[string]string{"error": err.Error()})
+		return
+	}
+	if !report.Valid {
+		render.Status(r, 409)
+	}
+	render.JSON(w, r, report)
+}
@@ -0,0 +1,148 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"html/template"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/go-chi/chi"
+	"github.com/go-chi/render"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/stefanprodan/mgob/pkg/controller"
+	"github.com/stefanprodan/mgob/pkg/db"
+)
+
+func controllerCtx(ctl *controller.Controller) func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			r = r.WithContext(context.WithValue(r.Context(), "app.controller", ctl))
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+func getInstances(w http.ResponseWriter, r *http.Request) {
+	ctl := r.Context().Value("app.controller").(*controller.Controller)
+	list, err := ctl.Instances()
+	if err != nil {
+		render.Status(r, 500)
+		render.JSON(w, r, map[string]string{"error": err.Error()})
+		return
+	}
+	for n, i := range list {
+		list[n] = withoutToken(i)
+	}
+	render.JSON(w, r, list)
+}
+
+// withoutToken is a copy of the instance that is safe to respond with.
+func withoutToken(i *db.Instance) *db.Instance {
+	c := *i
+	c.Token = ""
+	return &c
+}
+
+func putInstance(w http.ResponseWriter, r *http.Request) {
+	ctl := r.Context().Value("app.controller").(*controller.Controller)
+	var body struct {
+		URL   string `json:"url"`
+		Token string `json:"token"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		render.Status(r, 400)
+		render.JSON(w, r, map[string]string{"error": err.Error()})
+		return
+	}
+	i, err := ctl.Register(chi.URLParam(r, "name"), body.URL, body.Token)
+	if err != nil {
+		render.Status(r, 400)
+		render.JSON(w, r, map[string]string{"error": err.Error()})
+		return
+	}
+	log.Infof("Instance %v registered at %v", i.Name, i.URL)
+	render.JSON(w, r, withoutToken(i))
+}
+
+func deleteInstance(w http.ResponseWriter, r *http.Request) {
+	ctl := r.Context().Value("app.controller").(*controller.Controller)
+	found, err := ctl.Remove(chi.URLParam(r, "name"))
+	if err != nil {
+		render.Status(r, 500)
+		render.JSON(w, r, map[string]string{"error": err.Error()})
+		return
+	}
+	if !found {
+		render.Status(r, 404)
+		render.JSON(w, r, map[string]string{"error": "Instance not found"})
+		return
+	}
+	render.JSON(w, r, map[string]string{"message": "Instance removed"})
+}
+
+func putInstancePlan(w http.ResponseWriter, r *http.Request) {
+	ctl := r.Context().Value("app.controller").(*controller.Controller)
+	name := chi.URLParam(r, "name")
+	planID := chi.URLParam(r, "planID")
+
+	data, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, 1<<20))
+	if err == nil {
+		err = ctl.Distribute(r.Context(), name, planID, data)
+	}
+	if err != nil {
+		render.Status(r, 502)
+		render.JSON(w, r, map[string]string{"error": err.Error()})
+		return
+	}
+	log.WithField("plan", planID).Infof("Plan distributed to %v", name)
+	render.JSON(w, r, map[string]string{"message": "Plan applied"})
+}
+
+func getFleetStatus(w http.ResponseWriter, r *http.Request) {
+	ctl := r.Context().Value("app.controller").(*controller.Controller)
+	list, err := ctl.Status(r.Context())
+	if err != nil {
+		render.Status(r, 500)
+		render.JSON(w, r, map[string]string{"error": err.Error()})
+		return
+	}
+	render.JSON(w, r, list)
+}
+
+func getFleetMetrics(w http.ResponseWriter, r *http.Request) {
+	ctl := r.Context().Value("app.controller").(*controller.Controller)
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	if err := ctl.Metrics(r.Context(), w); err != nil {
+		log.Errorf("Fleet metrics failed %v", err)
+	}
+}
+
+var dashboard = template.Must(template.New("dashboard").Parse(`<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><meta http-equiv="refresh" content="30"><title>mgob fleet</title>
+<style>body{font-family:sans-serif}table{border-collapse:collapse}td,th{border:1px solid #ccc;padding:4px 8px}.down,.failed{color:#c00}</style>
+</head>
+<body>
+<h1>mgob fleet</h1>
+<table>
+<tr><th>Instance</th><th>Plan</th><th>Last run</th><th>Status</th><th>Next run</th><th>Log</th></tr>
+{{range .}}{{$i := .}}{{if not .Up}}<tr class="down"><td>{{.Instance}}</td><td colspan="5">down {{.Error}}</td></tr>{{end}}{{range .Plans}}<tr{{if and .LastRunStatus (ne .LastRunStatus "200")}} class="failed"{{end}}><td>{{$i.Instance}}</td><td>{{.Plan}}</td><td>{{if .LastRun}}{{.LastRun.Format "2006-01-02 15:04:05"}}{{end}}</td><td>{{.LastRunStatus}}{{if .Paused}} paused{{end}}</td><td>{{.NextRun.Format "2006-01-02 15:04:05"}}</td><td>{{.LastRunLog}}</td></tr>
+{{end}}{{end}}</table>
+</body>
+</html>
+`))
+
+func getDashboard(w http.ResponseWriter, r *http.Request) {
+	ctl := r.Context().Value("app.controller").(*controller.Controller)
+	list, err := ctl.Status(r.Context())
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := dashboard.Execute(w, list); err != nil {
+		log.Errorf("Dashboard render failed %v", err)
+	}
+}
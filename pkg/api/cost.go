@@ -0,0 +1,33 @@
+package api
+
+import (
+	"net/http"
+
+	"github.com/go-chi/render"
+
+	"github.com/stefanprodan/mgob/pkg/backup"
+	"github.com/stefanprodan/mgob/pkg/scheduler"
+)
+
+func getCosts(w http.ResponseWriter, r *http.Request) {
+	sch := r.Context().Value("app.scheduler").(*scheduler.Scheduler)
+	if sch.Config.Pricing == nil {
+		render.Status(r, 404)
+		render.JSON(w, r, map[string]string{"error": "No pricing configured"})
+		return
+	}
+	costs, err := sch.Costs()
+	if err != nil {
+		render.Status(r, 500)
+		render.JSON(w, r, map[string]string{"error": err.Error()})
+		return
+	}
+	a := accessOf(r)
+	list := make([]*backup.CostEstimate, 0, len(costs))
+	for _, c := range costs {
+		if a.visible(c.Plan) {
+			list = append(list, c)
+		}
+	}
+	render.JSON(w, r, list)
+}
@@ -0,0 +1,90 @@
+package api
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+
+	"github.com/go-chi/chi"
+	"github.com/go-chi/render"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/stefanprodan/mgob/pkg/config"
+	"github.com/stefanprodan/mgob/pkg/extract"
+)
+
+func extractCtx(data config.AppConfig, extracts *extract.Manager) func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			r = r.WithContext(context.WithValue(r.Context(), "app.config", data))
+			r = r.WithContext(context.WithValue(r.Context(), "app.extracts", extracts))
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+func getExtracts(w http.ResponseWriter, r *http.Request) {
+	extracts := r.Context().Value("app.extracts").(*extract.Manager)
+	a := accessOf(r)
+	list := make([]*extract.Instance, 0)
+	for _, inst := range extracts.List() {
+		if a.visible(inst.Plan) {
+			list = append(list, inst)
+		}
+	}
+	render.JSON(w, r, list)
+}
+
+func postExtract(w http.ResponseWriter, r *http.Request) {
+	cfg := r.Context().Value("app.config").(config.AppConfig)
+	extracts := r.Context().Value("app.extracts").(*extract.Manager)
+	planID := chi.URLParam(r, "planID")
+	archive := chi.URLParam(r, "archive")
+
+	ttl := 0
+	if v := r.URL.Query().Get("ttl"); v != "" {
+		i, err := strconv.Atoi(v)
+		if err != nil || i < 1 {
+			render.Status(r, 400)
+			render.JSON(w, r, map[string]string{"error": "Invalid ttl value " + v})
+			return
+		}
+		ttl = i
+	}
+
+	plan, err := config.LoadPlan(cfg.ConfigPath, planID)
+	if err != nil {
+		render.Status(r, 500)
+		render.JSON(w, r, map[string]string{"error": err.Error()})
+		return
+	}
+
+	inst, err := extracts.Start(r.Context(), plan, archive, ttl)
+	if err != nil {
+		log.WithField("plan", planID).Errorf("Extract failed %v", err)
+		render.Status(r, 500)
+		render.JSON(w, r, map[string]string{"error": err.Error()})
+		return
+	}
+
+	render.JSON(w, r, inst)
+}
+
+func deleteExtract(w http.ResponseWriter, r *http.Request) {
+	extracts := r.Context().Value("app.extracts").(*extract.Manager)
+	id := chi.URLParam(r, "id")
+
+	owned := false
+	for _, inst := range extracts.List() {
+		if inst.ID == id {
+			owned = accessOf(r).owns(inst.Plan)
+		}
+	}
+	if !owned || !extracts.Stop(id) {
+		render.Status(r, 404)
+		render.JSON(w, r, map[string]string{"error": "Extract " + id + " not found"})
+		return
+	}
+
+	render.JSON(w, r, map[string]string{"message": "Extract removed"})
+}
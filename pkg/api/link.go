@@ -0,0 +1,75 @@
+package api
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi"
+	"github.com/go-chi/render"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/stefanprodan/mgob/pkg/backup"
+	"github.com/stefanprodan/mgob/pkg/config"
+	"github.com/stefanprodan/mgob/pkg/scheduler"
+)
+
+const (
+	defaultLinkTTL = 60
+	// S3 presigned URLs are valid for at most 7 days
+	maxLinkTTL = 7 * 24 * 60
+)
+
+type linkResult struct {
+	Plan        string    `json:"plan"`
+	Archive     string    `json:"archive"`
+	Destination string    `json:"destination"`
+	URL         string    `json:"url"`
+	Expires     time.Time `json:"expires"`
+}
+
+// postLink signs a time-limited download URL of the remote copy of an archive.
+func postLink(w http.ResponseWriter, r *http.Request) {
+	cfg := r.Context().Value("app.config").(config.AppConfig)
+	sch := r.Context().Value("app.scheduler").(*scheduler.Scheduler)
+	planID := chi.URLParam(r, "planID")
+	archive := chi.URLParam(r, "archive")
+
+	ttl := defaultLinkTTL
+	if v := r.URL.Query().Get("ttl"); v != "" {
+		i, err := strconv.Atoi(v)
+		if err != nil || i < 1 || i > maxLinkTTL {
+			render.Status(r, 400)
+			render.JSON(w, r, map[string]string{"error": "Invalid ttl value " + v})
+			return
+		}
+		ttl = i
+	}
+
+	plan, err := config.LoadPlan(cfg.ConfigPath, planID)
+	if err != nil {
+		render.Status(r, 500)
+		render.JSON(w, r, map[string]string{"error": err.Error()})
+		return
+	}
+	// the catalog knows the run timestamp and route, older archives fall back to the name
+	plan, ts, ok := sch.Locate(plan, archive)
+	if !ok {
+		render.Status(r, 400)
+		render.JSON(w, r, map[string]string{"error": "Invalid archive " + archive})
+		return
+	}
+
+	expires := time.Now().Add(time.Duration(ttl) * time.Minute).UTC()
+	dst, url, err := backup.Link(r.Context(), plan, &cfg, ts, archive, r.URL.Query().Get("destination"),
+		time.Duration(ttl)*time.Minute)
+	if err != nil {
+		log.WithField("plan", planID).Errorf("Download link of %v failed %v", archive, err)
+		render.Status(r, 500)
+		render.JSON(w, r, map[string]string{"error": err.Error()})
+		return
+	}
+
+	log.WithField("plan", planID).Infof("Download link of %v at %v expires %v", archive, dst, expires)
+	render.JSON(w, r, linkResult{Plan: planID, Archive: archive, Destination: dst, URL: url, Expires: expires})
+}
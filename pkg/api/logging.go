@@ -0,0 +1,56 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/go-chi/chi"
+	"github.com/go-chi/render"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/stefanprodan/mgob/pkg/logging"
+)
+
+func getLogLevel(w http.ResponseWriter, r *http.Request) {
+	render.JSON(w, r, map[string]interface{}{
+		"level":       logging.Level().String(),
+		"debug_plans": logging.DebugPlans(),
+	})
+}
+
+func putLogLevel(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Level string `json:"level"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		render.Status(r, 400)
+		render.JSON(w, r, map[string]string{"error": err.Error()})
+		return
+	}
+	level, err := log.ParseLevel(body.Level)
+	if err != nil {
+		render.Status(r, 400)
+		render.JSON(w, r, map[string]string{"error": err.Error()})
+		return
+	}
+
+	logging.SetLevel(level)
+	log.Infof("log level set to %v", level)
+	getLogLevel(w, r)
+}
+
+func putPlanDebug(w http.ResponseWriter, r *http.Request) {
+	planID := chi.URLParam(r, "planID")
+	var body struct {
+		Debug bool `json:"debug"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		render.Status(r, 400)
+		render.JSON(w, r, map[string]string{"error": err.Error()})
+		return
+	}
+
+	logging.SetPlanDebug(planID, body.Debug)
+	log.WithField("plan", planID).Infof("debug logging set to %v", body.Debug)
+	getLogLevel(w, r)
+}
@@ -0,0 +1,58 @@
+package api
+
+import (
+	"net/http"
+
+	"github.com/go-chi/chi"
+	"github.com/go-chi/render"
+
+	"github.com/stefanprodan/mgob/pkg/db"
+	"github.com/stefanprodan/mgob/pkg/scheduler"
+)
+
+func getManifests(w http.ResponseWriter, r *http.Request) {
+	sch := r.Context().Value("app.scheduler").(*scheduler.Scheduler)
+	list, err := sch.Manifests.List(chi.URLParam(r, "planID"))
+	if err != nil {
+		render.Status(r, 500)
+		render.JSON(w, r, map[string]string{"error": err.Error()})
+		return
+	}
+	if chi.URLParam(r, "planID") == "" {
+		a := accessOf(r)
+		visible := make([]*db.Manifest, 0, len(list))
+		for _, m := range list {
+			if a.visible(m.Plan) {
+				visible = append(visible, m)
+			}
+		}
+		list = visible
+	}
+	render.JSON(w, r, list)
+}
+
+func getManifestKey(w http.ResponseWriter, r *http.Request) {
+	sch := r.Context().Value("app.scheduler").(*scheduler.Scheduler)
+	key, err := sch.Manifests.PublicKey()
+	if err != nil {
+		render.Status(r, 500)
+		render.JSON(w, r, map[string]string{"error": err.Error()})
+		return
+	}
+	w.Header().Set("Content-Type", "application/x-pem-file")
+	w.Write(key)
+}
+
+func getManifestsVerify(w http.ResponseWriter, r *http.Request) {
+	sch := r.Context().Value("app.scheduler").(*scheduler.Scheduler)
+	problems, err := sch.Manifests.Verify()
+	if err != nil {
+		render.Status(r, 500)
+		render.JSON(w, r, map[string]string{"error": err.Error()})
+		return
+	}
+	if len(problems) > 0 {
+		render.Status(r, 409)
+	}
+	render.JSON(w, r, map[string]interface{}{"valid": len(problems) == 0, "problems": problems})
+}
@@ -4,14 +4,49 @@ import (
 	"net/http"
 
 	"github.com/go-chi/chi"
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+	dto "github.com/prometheus/client_model/go"
 )
 
+var promHandler = promhttp.Handler()
+
 func metricsRouter() http.Handler {
-	promHandler := func(next http.Handler) http.Handler { return promhttp.Handler() }
-	emptyHandler := func(w http.ResponseWriter, r *http.Request) {}
 	r := chi.NewRouter()
-	r.Use(promHandler)
-	r.Get("/", emptyHandler)
+	r.Get("/", getMetrics)
 	return r
 }
+
+// getMetrics serves the metrics of every plan, or of the plans of the tenant
+// the request is scoped to. The series without a plan label are global.
+func getMetrics(w http.ResponseWriter, r *http.Request) {
+	a := accessOf(r)
+	if a.tenant == "" {
+		promHandler.ServeHTTP(w, r)
+		return
+	}
+	gatherer := prometheus.GathererFunc(func() ([]*dto.MetricFamily, error) {
+		families, err := prometheus.DefaultGatherer.Gather()
+		if err != nil {
+			return nil, err
+		}
+		scoped := make([]*dto.MetricFamily, 0, len(families))
+		for _, mf := range families {
+			metrics := make([]*dto.Metric, 0, len(mf.Metric))
+			for _, m := range mf.Metric {
+				for _, l := range m.Label {
+					if l.GetName() == "plan" && a.visible(l.GetValue()) {
+						metrics = append(metrics, m)
+						break
+					}
+				}
+			}
+			if len(metrics) > 0 {
+				mf.Metric = metrics
+				scoped = append(scoped, mf)
+			}
+		}
+		return scoped, nil
+	})
+	promhttp.HandlerFor(gatherer, promhttp.HandlerOpts{}).ServeHTTP(w, r)
+}
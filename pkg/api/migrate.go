@@ -0,0 +1,31 @@
+package api
+
+import (
+	"net/http"
+
+	"github.com/go-chi/render"
+
+	"github.com/stefanprodan/mgob/pkg/backup"
+)
+
+func getMigrations(w http.ResponseWriter, r *http.Request) {
+	a := accessOf(r)
+	list := make([]backup.MigrationStatus, 0)
+	for _, m := range backup.Migrations() {
+		if a.visible(m.Plan) {
+			list = append(list, m)
+		}
+	}
+	render.JSON(w, r, list)
+}
+
+func getDumps(w http.ResponseWriter, r *http.Request) {
+	a := accessOf(r)
+	list := make([]backup.DumpStatus, 0)
+	for _, d := range backup.Dumps() {
+		if a.visible(d.Plan) {
+			list = append(list, d)
+		}
+	}
+	render.JSON(w, r, list)
+}
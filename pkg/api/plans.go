@@ -0,0 +1,159 @@
+package api
+
+import (
+	"io/ioutil"
+	"net/http"
+
+	"github.com/go-chi/chi"
+	"github.com/go-chi/render"
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v2"
+
+	"github.com/stefanprodan/mgob/pkg/config"
+	"github.com/stefanprodan/mgob/pkg/logging"
+	"github.com/stefanprodan/mgob/pkg/scheduler"
+)
+
+// putPlan saves the yaml plan in the request body and schedules it right away.
+func putPlan(w http.ResponseWriter, r *http.Request) {
+	cfg := r.Context().Value("app.config").(config.AppConfig)
+	sch := r.Context().Value("app.scheduler").(*scheduler.Scheduler)
+	planID := chi.URLParam(r, "planID")
+
+	data, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, 1<<20))
+	if err != nil {
+		render.Status(r, 400)
+		render.JSON(w, r, map[string]string{"error": err.Error()})
+		return
+	}
+	plan, err := config.ParsePlan(planID, data)
+	if err == nil && !accessOf(r).canApply(plan) {
+		render.Status(r, 403)
+		render.JSON(w, r, map[string]string{"error": "Plan " + planID + " is not in the tenant of the token"})
+		return
+	}
+	if err == nil {
+		// scheduling validates the cron expressions before the plan is saved
+		err = sch.Apply(plan)
+	}
+	if err != nil {
+		render.Status(r, 400)
+		render.JSON(w, r, map[string]string{"error": err.Error()})
+		return
+	}
+	if err := config.SavePlan(cfg.ConfigPath, planID, data); err != nil {
+		render.Status(r, 500)
+		render.JSON(w, r, map[string]string{"error": err.Error()})
+		return
+	}
+
+	logging.SetPlanDebug(plan.Name, plan.Debug)
+	log.WithField("plan", planID).Info("Plan applied")
+	render.JSON(w, r, map[string]string{"message": "Plan applied"})
+}
+
+// getPlansExport writes the plans named by the plan query params, all when
+// none, as a yaml bundle. The secrets query param is strip (default), ref or include.
+func getPlansExport(w http.ResponseWriter, r *http.Request) {
+	cfg := r.Context().Value("app.config").(config.AppConfig)
+	mode := config.SecretsMode(r.URL.Query().Get("secrets"))
+	if mode == "" {
+		mode = config.SecretsStrip
+	}
+
+	names := r.URL.Query()["plan"]
+	if a := accessOf(r); a.tenant != "" {
+		// scoped to a tenant, all means all the plans of the tenant
+		sch := r.Context().Value("app.scheduler").(*scheduler.Scheduler)
+		if len(names) == 0 {
+			info, _ := sch.Info(0)
+			for _, p := range info {
+				if a.visible(p.Plan) {
+					names = append(names, p.Plan)
+				}
+			}
+			if len(names) == 0 {
+				render.Status(r, 404)
+				render.JSON(w, r, map[string]string{"error": "Tenant " + a.tenant + " has no plans"})
+				return
+			}
+		}
+		for _, name := range names {
+			if !a.visible(name) {
+				render.Status(r, 404)
+				render.JSON(w, r, map[string]string{"error": "Plan " + name + " not found"})
+				return
+			}
+		}
+	}
+
+	b, err := config.ExportPlans(cfg.ConfigPath, names, mode)
+	if err != nil {
+		render.Status(r, 400)
+		render.JSON(w, r, map[string]string{"error": err.Error()})
+		return
+	}
+	data, err := yaml.Marshal(b)
+	if err != nil {
+		render.Status(r, 500)
+		render.JSON(w, r, map[string]string{"error": err.Error()})
+		return
+	}
+	w.Header().Set("Content-Type", "application/x-yaml")
+	w.Write(data)
+}
+
+// postPlansImport applies and saves the plans of the yaml bundle in the request body,
+// the bundle is rejected as a whole when a plan is invalid or references an unset secret.
+func postPlansImport(w http.ResponseWriter, r *http.Request) {
+	cfg := r.Context().Value("app.config").(config.AppConfig)
+	sch := r.Context().Value("app.scheduler").(*scheduler.Scheduler)
+
+	data, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, 16<<20))
+	if err != nil {
+		render.Status(r, 400)
+		render.JSON(w, r, map[string]string{"error": err.Error()})
+		return
+	}
+	var b config.Bundle
+	if err := yaml.Unmarshal(data, &b); err != nil {
+		render.Status(r, 400)
+		render.JSON(w, r, map[string]string{"error": err.Error()})
+		return
+	}
+	plans, err := config.ImportPlans(b)
+	if err != nil {
+		render.Status(r, 400)
+		render.JSON(w, r, map[string]string{"error": err.Error()})
+		return
+	}
+	for _, p := range plans {
+		if !accessOf(r).canApply(p.Plan) {
+			render.Status(r, 403)
+			render.JSON(w, r, map[string]string{"error": "Plan " + p.Plan.Name + " is not in the tenant of the token"})
+			return
+		}
+	}
+
+	imported := make([]string, 0, len(plans))
+	missing := make(map[string][]string)
+	for _, p := range plans {
+		if err := sch.Apply(p.Plan); err != nil {
+			render.Status(r, 400)
+			render.JSON(w, r, map[string]interface{}{"error": err.Error(), "imported": imported})
+			return
+		}
+		if err := config.SavePlan(cfg.ConfigPath, p.Plan.Name, p.Data); err != nil {
+			render.Status(r, 500)
+			render.JSON(w, r, map[string]interface{}{"error": err.Error(), "imported": imported})
+			return
+		}
+		logging.SetPlanDebug(p.Plan.Name, p.Plan.Debug)
+		log.WithField("plan", p.Plan.Name).Info("Plan imported")
+		imported = append(imported, p.Plan.Name)
+		if len(p.Missing) > 0 {
+			missing[p.Plan.Name] = p.Missing
+		}
+	}
+	render.JSON(w, r, map[string]interface{}{"imported": imported, "missing": missing})
+}
@@ -0,0 +1,201 @@
+package api
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi"
+	"github.com/go-chi/render"
+
+	"github.com/stefanprodan/mgob/pkg/clock"
+	"github.com/stefanprodan/mgob/pkg/config"
+	"github.com/stefanprodan/mgob/pkg/restore"
+	"github.com/stefanprodan/mgob/pkg/scheduler"
+)
+
+type restoreRequest struct {
+	// Uri of the mongod or mongos the backup is loaded into
+	Uri string `json:"uri"`
+	// KeyFile is the gpg private key of encrypted backups (optional)
+	KeyFile string `json:"keyFile"`
+}
+
+// postRestore restores a plan to the time query param, RFC3339 or unix seconds,
+// from the full backup and the oplog segments of the chain that covers it.
+func postRestore(w http.ResponseWriter, r *http.Request) {
+	cfg := r.Context().Value("app.config").(config.AppConfig)
+	sch := r.Context().Value("app.scheduler").(*scheduler.Scheduler)
+	planID := chi.URLParam(r, "planID")
+
+	t, err := parseTime(r.URL.Query().Get("time"))
+	if err != nil {
+		render.Status(r, 400)
+		render.JSON(w, r, map[string]string{"error": "Invalid time value " + r.URL.Query().Get("time")})
+		return
+	}
+	var req restoreRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+		render.Status(r, 400)
+		render.JSON(w, r, map[string]string{"error": "Invalid request body " + err.Error()})
+		return
+	}
+
+	plan, err := config.LoadPlan(cfg.ConfigPath, planID)
+	if err != nil {
+		render.Status(r, 500)
+		render.JSON(w, r, map[string]string{"error": err.Error()})
+		return
+	}
+	// the plan restore target is used unless the request names one
+	if req.Uri == "" && plan.Restore != nil {
+		req.Uri, req.KeyFile = plan.Restore.Uri, plan.Restore.KeyFile
+	}
+	if req.Uri == "" {
+		render.Status(r, 400)
+		render.JSON(w, r, map[string]string{"error": "Plan " + plan.Name + " has no restore target, set the request uri"})
+		return
+	}
+
+	p, err := sch.ResolvePointInTime(plan.Name, t)
+	if err != nil {
+		render.Status(r, 409)
+		render.JSON(w, r, map[string]string{"error": err.Error()})
+		return
+	}
+
+	if req.KeyFile != "" {
+		if err := restore.ImportKey(r.Context(), req.KeyFile); err != nil {
+			render.Status(r, 500)
+			render.JSON(w, r, map[string]string{"error": err.Error()})
+			return
+		}
+	}
+	if err := sch.RestorePointInTime(r.Context(), plan, p, req.Uri); err != nil {
+		render.Status(r, 500)
+		render.JSON(w, r, map[string]string{"error": err.Error()})
+		return
+	}
+	render.JSON(w, r, p)
+}
+
+// postRestoreArchive loads an archive of the plan storage dir into the plan restore target
+// in the background and responds with the job to poll under /restores, with dryRun=true
+// mongorestore only validates it, with wait=true the response is the restore result.
+// The priority param overrides the plan restore priority.
+func postRestoreArchive(w http.ResponseWriter, r *http.Request) {
+	cfg := r.Context().Value("app.config").(config.AppConfig)
+	sch := r.Context().Value("app.scheduler").(*scheduler.Scheduler)
+	planID := chi.URLParam(r, "planID")
+	archive := chi.URLParam(r, "archive")
+
+	plan, err := config.LoadPlan(cfg.ConfigPath, planID)
+	if err != nil {
+		render.Status(r, 500)
+		render.JSON(w, r, map[string]string{"error": err.Error()})
+		return
+	}
+	if plan.Restore == nil || plan.Restore.Uri == "" {
+		render.Status(r, 400)
+		render.JSON(w, r, map[string]string{"error": "Plan " + plan.Name + " has no restore target"})
+		return
+	}
+	if _, _, ok := sch.Locate(plan, archive); !ok {
+		render.Status(r, 400)
+		render.JSON(w, r, map[string]string{"error": "Invalid archive " + archive})
+		return
+	}
+	if plan, err = scheduler.WithPriority(plan, r.URL.Query().Get("priority")); err != nil {
+		render.Status(r, 400)
+		render.JSON(w, r, map[string]string{"error": err.Error()})
+		return
+	}
+
+	job, err := sch.StartRestore(plan, archive, r.URL.Query().Get("dryRun") == "true")
+	if err == scheduler.ErrRestoreRunning {
+		render.Status(r, 409)
+		render.JSON(w, r, map[string]string{"error": err.Error()})
+		return
+	}
+	if r.URL.Query().Get("wait") != "true" {
+		w.Header().Set("Location", "/restores/"+job.ID)
+		render.Status(r, 202)
+		render.JSON(w, r, job)
+		return
+	}
+
+	job, err = sch.WaitRestore(r.Context(), job.ID)
+	if err != nil {
+		render.Status(r, 500)
+		render.JSON(w, r, map[string]string{"error": err.Error()})
+		return
+	}
+	switch {
+	case job.Err == scheduler.ErrNotStored:
+		render.Status(r, 404)
+		render.JSON(w, r, map[string]string{"error": "Archive " + archive + " not found"})
+		return
+	case job.Err != nil:
+		render.Status(r, 500)
+	}
+	render.JSON(w, r, job.Result)
+}
+
+func getRestores(w http.ResponseWriter, r *http.Request) {
+	sch := r.Context().Value("app.scheduler").(*scheduler.Scheduler)
+	a := accessOf(r)
+	list := make([]scheduler.RestoreJob, 0)
+	for _, job := range sch.Restores(r.URL.Query().Get("plan")) {
+		if a.visible(job.Plan) {
+			list = append(list, job)
+		}
+	}
+	render.JSON(w, r, list)
+}
+
+func getRestoreJob(w http.ResponseWriter, r *http.Request) {
+	sch := r.Context().Value("app.scheduler").(*scheduler.Scheduler)
+	id := chi.URLParam(r, "id")
+
+	job, ok := sch.GetRestore(id)
+	if !ok || !accessOf(r).owns(job.Plan) {
+		render.Status(r, 404)
+		render.JSON(w, r, map[string]string{"error": "Restore job " + id + " not found"})
+		return
+	}
+	render.JSON(w, r, job)
+}
+
+func parseTime(v string) (time.Time, error) {
+	if unix, err := strconv.ParseInt(v, 10, 64); err == nil {
+		return time.Unix(unix, 0), nil
+	}
+	return time.Parse(time.RFC3339, v)
+}
+
+// getResolve tells which archives and oplog segments restore a plan to the time
+// query param, RFC3339 or unix seconds, now when omitted.
+func getResolve(w http.ResponseWriter, r *http.Request) {
+	sch := r.Context().Value("app.scheduler").(*scheduler.Scheduler)
+	planID := chi.URLParam(r, "planID")
+
+	t := clock.Now()
+	if v := r.URL.Query().Get("time"); v != "" {
+		var err error
+		if t, err = parseTime(v); err != nil {
+			render.Status(r, 400)
+			render.JSON(w, r, map[string]string{"error": "Invalid time value " + v})
+			return
+		}
+	}
+
+	res, err := sch.Resolve(planID, t)
+	if err != nil {
+		render.Status(r, 404)
+		render.JSON(w, r, map[string]string{"error": err.Error()})
+		return
+	}
+	render.JSON(w, r, res)
+}
@@ -0,0 +1,125 @@
+package api
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+
+	"github.com/go-chi/chi"
+	"github.com/go-chi/render"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/stefanprodan/mgob/pkg/scheduler"
+)
+
+const (
+	defaultNextRuns = 5
+	maxNextRuns     = 100
+)
+
+func schedulerCtx(sch *scheduler.Scheduler) func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			r = r.WithContext(context.WithValue(r.Context(), "app.scheduler", sch))
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+func getScheduler(w http.ResponseWriter, r *http.Request) {
+	sch := r.Context().Value("app.scheduler").(*scheduler.Scheduler)
+
+	n := defaultNextRuns
+	if v := r.URL.Query().Get("next"); v != "" {
+		i, err := strconv.Atoi(v)
+		if err != nil || i < 0 {
+			render.Status(r, 400)
+			render.JSON(w, r, map[string]string{"error": "Invalid next value " + v})
+			return
+		}
+		n = i
+		if n > maxNextRuns {
+			n = maxNextRuns
+		}
+	}
+
+	data, err := sch.Info(n)
+	if err != nil {
+		render.Status(r, 500)
+		render.JSON(w, r, map[string]string{"error": err.Error()})
+		return
+	}
+	a := accessOf(r)
+	list := make([]scheduler.PlanSchedule, 0, len(data))
+	for _, p := range data {
+		if a.visible(p.Plan) {
+			list = append(list, p)
+		}
+	}
+	render.JSON(w, r, list)
+}
+
+func postReconcile(w http.ResponseWriter, r *http.Request) {
+	sch := r.Context().Value("app.scheduler").(*scheduler.Scheduler)
+	planID := chi.URLParam(r, "planID")
+
+	if plan, ok := sch.Lookup(planID); ok {
+		render.JSON(w, r, sch.Reconcile(r.Context(), plan))
+		return
+	}
+
+	render.Status(r, 404)
+	render.JSON(w, r, map[string]string{"error": "Plan not found"})
+}
+
+// postVerify restores the latest backup into the plan verify target and
+// responds with the sanity checks report, 409 when a check failed.
+func postVerify(w http.ResponseWriter, r *http.Request) {
+	sch := r.Context().Value("app.scheduler").(*scheduler.Scheduler)
+	planID := chi.URLParam(r, "planID")
+
+	plan, ok := sch.Lookup(planID)
+	if !ok {
+		render.Status(r, 404)
+		render.JSON(w, r, map[string]string{"error": "Plan not found"})
+		return
+	}
+	if plan.Verify == nil {
+		render.Status(r, 400)
+		render.JSON(w, r, map[string]string{"error": "Plan " + plan.Name + " has no verify target"})
+		return
+	}
+	report := sch.Verify(r.Context(), plan)
+	if report.Status != "ok" {
+		render.Status(r, 409)
+	}
+	render.JSON(w, r, report)
+}
+
+func postPause(w http.ResponseWriter, r *http.Request) {
+	setPaused(w, r, true)
+}
+
+func postResume(w http.ResponseWriter, r *http.Request) {
+	setPaused(w, r, false)
+}
+
+func setPaused(w http.ResponseWriter, r *http.Request, paused bool) {
+	sch := r.Context().Value("app.scheduler").(*scheduler.Scheduler)
+	planID := chi.URLParam(r, "planID")
+
+	var err error
+	if paused {
+		err = sch.Pause(planID)
+	} else {
+		err = sch.Resume(planID)
+	}
+	if err != nil {
+		log.WithField("plan", planID).Errorf("Changing paused state failed %v", err)
+		render.Status(r, 404)
+		render.JSON(w, r, map[string]string{"error": err.Error()})
+		return
+	}
+
+	render.JSON(w, r, map[string]interface{}{"plan": planID, "paused": paused})
+}
@@ -1,54 +1,254 @@
 package api
 
 import (
+	"crypto/tls"
 	"fmt"
+	"net"
 	"net/http"
+	"os"
 	"strings"
 
 	"github.com/go-chi/chi"
 	"github.com/go-chi/chi/middleware"
+	"github.com/pkg/errors"
 	log "github.com/sirupsen/logrus"
 
+	"github.com/stefanprodan/mgob/pkg/agent"
 	"github.com/stefanprodan/mgob/pkg/config"
+	"github.com/stefanprodan/mgob/pkg/controller"
 	"github.com/stefanprodan/mgob/pkg/db"
+	"github.com/stefanprodan/mgob/pkg/extract"
+	"github.com/stefanprodan/mgob/pkg/scheduler"
 )
 
 type HttpServer struct {
-	Config  *config.AppConfig
-	Modules *config.ModuleConfig
-	Stats   *db.StatusStore
+	// Tenants holds the API tokens, the API has no auth when nil
+	Tenants   *config.Tenants
+	Config    *config.AppConfig
+	Modules   *config.ModuleConfig
+	Stats     *db.StatusStore
+	Scheduler *scheduler.Scheduler
+	Extracts  *extract.Manager
+	Agents    *agent.Hub
+	// Controller is set when the instance aggregates a fleet of mgob instances
+	Controller *controller.Controller
+	approvals  *approvals
 }
 
 func (s *HttpServer) Start(version string) {
 
 	r := chi.NewRouter()
+	s.approvals = newApprovals(s.Tenants != nil)
+	s.approvals.router = r
 	r.Use(middleware.Recoverer)
 	if s.Config.LogLevel == "debug" {
 		r.Use(middleware.DefaultLogger)
 	}
 
-	r.Mount("/metrics", metricsRouter())
-	r.Mount("/debug", middleware.Profiler())
-
 	r.Route("/version", func(r chi.Router) {
 		r.Use(appVersionCtx(version))
 		r.Get("/", getVersion)
 	})
 
+	r.Group(func(r chi.Router) {
+		r.Use(tenantCtx(s.Tenants, s.Scheduler))
+		s.routes(r)
+	})
+
+	ln, err := s.listen()
+	if err != nil {
+		log.Error(err)
+		return
+	}
+	log.Error(http.Serve(ln, r))
+}
+
+// routes registers the API behind the token check.
+func (s *HttpServer) routes(r chi.Router) {
+	r.Mount("/metrics", metricsRouter())
+
 	r.Route("/status", func(r chi.Router) {
 		r.Use(statusCtx(s.Stats))
 		r.Get("/", getStatus)
-		r.Get("/{planID}", getPlanStatus)
+		r.With(planAccess).Get("/{planID}", getPlanStatus)
+	})
+
+	r.Route("/badge", func(r chi.Router) {
+		r.Use(statusCtx(s.Stats))
+		r.With(planAccess).Get("/{planID}", getBadge)
+	})
+
+	r.Route("/log", func(r chi.Router) {
+		r.Use(adminOnly)
+		r.Get("/", getLogLevel)
+		r.Put("/level", putLogLevel)
+		r.Put("/plans/{planID}", putPlanDebug)
+	})
+
+	r.Route("/plans", func(r chi.Router) {
+		r.Use(configCtx(*s.Config, *s.Modules, s.Scheduler))
+		r.Get("/export", getPlansExport)
+		r.Post("/import", postPlansImport)
+		r.Put("/{planID}", putPlan)
+	})
+
+	r.Route("/simulate", func(r chi.Router) {
+		r.Use(schedulerCtx(s.Scheduler))
+		r.Post("/", postSimulate)
 	})
 
 	r.Route("/backup", func(r chi.Router) {
-		r.Use(configCtx(*s.Config, *s.Modules))
-		r.Post("/{planID}", postBackup)
+		r.Use(configCtx(*s.Config, *s.Modules, s.Scheduler))
+		r.With(planAccess).Post("/{planID}", postBackup)
+		r.With(planAccess).Delete("/{planID}", deleteBackup)
+		r.With(planAccess).Get("/{planID}/resume", getResumeRecord)
+		r.With(planAccess).Post("/{planID}/resume", postResumeRun)
+	})
+
+	r.Route("/runs", func(r chi.Router) {
+		r.Use(schedulerCtx(s.Scheduler))
+		r.Get("/", getRuns)
+		r.Get("/{id}", getRun)
+	})
+
+	r.Route("/backups", func(r chi.Router) {
+		r.Use(configCtx(*s.Config, *s.Modules, s.Scheduler))
+		r.With(planAccess).Get("/{planID}/chains", getChains)
+		r.With(planAccess).Get("/{planID}/resolve", getResolve)
+		r.With(planAccess).Get("/{planID}/{chain}/verify-chain", getVerifyChain)
+		r.With(planAccess).Post("/{planID}/{archive}/link", postLink)
+	})
+
+	r.Route("/restore", func(r chi.Router) {
+		r.Use(configCtx(*s.Config, *s.Modules, s.Scheduler))
+		r.With(planAccess, s.approvals.gate("restore")).Post("/{planID}", postRestore)
+		r.With(planAccess, s.approvals.gate("restore")).Post("/{planID}/{archive}", postRestoreArchive)
+	})
+
+	r.Route("/approvals", func(r chi.Router) {
+		r.Get("/", s.approvals.getApprovals)
+		r.Get("/{id}", s.approvals.getApproval)
+		r.Post("/{id}/approve", s.approvals.postApprove)
+		r.Delete("/{id}", s.approvals.deleteApproval)
+	})
+
+	r.Route("/cache", func(r chi.Router) {
+		r.Use(adminOnly, schedulerCtx(s.Scheduler))
+		r.Get("/", getCache)
+		r.Delete("/", deleteCache)
+	})
+
+	r.Route("/sets", func(r chi.Router) {
+		r.Use(schedulerCtx(s.Scheduler))
+		r.Get("/", getSets)
+		r.With(setAccess).Get("/{set}", getSetRuns)
+		r.With(setAccess).Post("/{set}", postSet)
+		r.With(setAccess).Get("/{set}/{id}", getSetRun)
+		r.With(setAccess).Post("/{set}/{id}/restore", postSetRestore)
+	})
+
+	r.Route("/restores", func(r chi.Router) {
+		r.Use(schedulerCtx(s.Scheduler))
+		r.Get("/", getRestores)
+		r.Get("/{id}", getRestoreJob)
+	})
+
+	r.Get("/migrations", getMigrations)
+	r.Get("/dumps", getDumps)
+
+	r.Route("/costs", func(r chi.Router) {
+		r.Use(schedulerCtx(s.Scheduler))
+		r.Get("/", getCosts)
+	})
+
+	r.Route("/scheduler", func(r chi.Router) {
+		r.Use(schedulerCtx(s.Scheduler))
+		r.Get("/", getScheduler)
+		r.With(planAccess).Post("/{planID}/pause", postPause)
+		r.With(planAccess).Post("/{planID}/resume", postResume)
+		r.With(planAccess).Post("/{planID}/reconcile", postReconcile)
+		r.With(planAccess).Post("/{planID}/verify", postVerify)
+	})
+
+	r.Route("/manifests", func(r chi.Router) {
+		r.Use(schedulerCtx(s.Scheduler))
+		r.Get("/", getManifests)
+		r.Get("/key", getManifestKey)
+		r.With(adminOnly).Get("/verify", getManifestsVerify)
+		r.With(planAccess).Get("/{planID}", getManifests)
+	})
+
+	r.Route("/extract", func(r chi.Router) {
+		r.Use(extractCtx(*s.Config, s.Extracts))
+		r.Get("/", getExtracts)
+		r.With(planAccess).Post("/{planID}/{archive}", postExtract)
+		r.Delete("/{id}", deleteExtract)
+	})
+
+	if s.Agents != nil {
+		r.Route("/agents", func(r chi.Router) {
+			r.Use(adminOnly, agentsCtx(s.Agents))
+			r.Get("/", getAgents)
+		})
+	}
+
+	if s.Controller != nil {
+		r.Route("/controller", func(r chi.Router) {
+			r.Use(adminOnly, controllerCtx(s.Controller))
+			r.Get("/instances", getInstances)
+			r.Put("/instances/{name}", putInstance)
+			r.Delete("/instances/{name}", deleteInstance)
+			r.Put("/instances/{name}/plans/{planID}", putInstancePlan)
+			r.Get("/status", getFleetStatus)
+			r.Get("/metrics", getFleetMetrics)
+			r.Get("/", getDashboard)
+		})
+	}
+
+	r.Group(func(r chi.Router) {
+		r.Use(storageAccess)
+		FileServer(r, "/storage", http.Dir(s.Config.StoragePath))
 	})
+}
 
-	FileServer(r, "/storage", http.Dir(s.Config.StoragePath))
+// listen opens the API unix socket when set, names starting with @ are
+// Linux abstract sockets, otherwise the TCP port.
+func (s *HttpServer) listen() (net.Listener, error) {
+	if s.Config.Socket == "" {
+		return net.Listen("tcp", fmt.Sprintf("%s:%v", s.Config.Host, s.Config.Port))
+	}
+	if !strings.HasPrefix(s.Config.Socket, "@") {
+		// a socket left by a previous run blocks the bind
+		if fi, err := os.Lstat(s.Config.Socket); err == nil && fi.Mode()&os.ModeSocket != 0 {
+			os.Remove(s.Config.Socket)
+		}
+	}
+	ln, err := net.Listen("unix", s.Config.Socket)
+	if err != nil {
+		return nil, errors.Wrapf(err, "listening on %v failed", s.Config.Socket)
+	}
+	return ln, nil
+}
 
-	log.Error(http.ListenAndServe(fmt.Sprintf("%s:%v", s.Config.Host, s.Config.Port), r))
+// StartDebug serves pprof and expvar on the debug port, apart from the API
+// so profiling can be enabled without exposing it with the backups.
+func (s *HttpServer) StartDebug() {
+	r := chi.NewRouter()
+	r.Use(middleware.Recoverer)
+	r.Mount("/debug", middleware.Profiler())
+
+	log.Error(http.ListenAndServe(fmt.Sprintf("%s:%v", s.Config.Host, s.Config.DebugPort), r))
+}
+
+// StartAgents serves the agent endpoints over mutual TLS, agents authenticate
+// with a client certificate whose CN is the agent name of their plans.
+func (s *HttpServer) StartAgents(tlsConfig *tls.Config) {
+	srv := &http.Server{
+		Addr:      fmt.Sprintf("%s:%v", s.Config.Host, s.Config.AgentPort),
+		Handler:   s.Agents.Handler(),
+		TLSConfig: tlsConfig,
+	}
+	log.Error(srv.ListenAndServeTLS("", ""))
 }
 
 func FileServer(r chi.Router, path string, root http.FileSystem) {
@@ -0,0 +1,144 @@
+package api
+
+import (
+	"net/http"
+	"sort"
+
+	"github.com/go-chi/chi"
+	"github.com/go-chi/render"
+	"github.com/pkg/errors"
+
+	"github.com/stefanprodan/mgob/pkg/config"
+	"github.com/stefanprodan/mgob/pkg/db"
+	"github.com/stefanprodan/mgob/pkg/scheduler"
+)
+
+// BackupSet is a backup set as listed by the API.
+type BackupSet struct {
+	Name  string   `json:"name"`
+	Plans []string `json:"plans"`
+	Cron  string   `json:"cron,omitempty"`
+}
+
+// setAccess responds 404 unless the request owns every plan of the set param,
+// a set spanning several tenants is only reachable with the admin token.
+func setAccess(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sch := r.Context().Value("app.scheduler").(*scheduler.Scheduler)
+		set, ok := sch.Config.Sets[chi.URLParam(r, "set")]
+		if !ok || !ownsSet(accessOf(r), set) {
+			render.Status(r, 404)
+			render.JSON(w, r, map[string]string{"error": "Backup set " + chi.URLParam(r, "set") + " not found"})
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func ownsSet(a access, set config.BackupSet) bool {
+	for _, plan := range set.Plans {
+		if !a.owns(plan) {
+			return false
+		}
+	}
+	return true
+}
+
+func getSets(w http.ResponseWriter, r *http.Request) {
+	sch := r.Context().Value("app.scheduler").(*scheduler.Scheduler)
+	a := accessOf(r)
+	list := make([]BackupSet, 0, len(sch.Config.Sets))
+	for name, set := range sch.Config.Sets {
+		visible := true
+		for _, plan := range set.Plans {
+			visible = visible && a.visible(plan)
+		}
+		if visible {
+			list = append(list, BackupSet{Name: name, Plans: set.Plans, Cron: set.Cron})
+		}
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	render.JSON(w, r, list)
+}
+
+// getSetRuns responds with the runs of the set, newest first.
+func getSetRuns(w http.ResponseWriter, r *http.Request) {
+	sch := r.Context().Value("app.scheduler").(*scheduler.Scheduler)
+	runs, err := sch.SetRuns.List(chi.URLParam(r, "set"))
+	if err != nil {
+		render.Status(r, 500)
+		render.JSON(w, r, map[string]string{"error": err.Error()})
+		return
+	}
+	render.JSON(w, r, runs)
+}
+
+func getSetRun(w http.ResponseWriter, r *http.Request) {
+	run, ok := setRun(w, r)
+	if ok {
+		render.JSON(w, r, run)
+	}
+}
+
+// postSet starts a run of the set and returns 202 with its location.
+func postSet(w http.ResponseWriter, r *http.Request) {
+	sch := r.Context().Value("app.scheduler").(*scheduler.Scheduler)
+	run, err := sch.StartSet(chi.URLParam(r, "set"))
+	switch {
+	case err == scheduler.ErrSetRunning:
+		render.Status(r, 409)
+		render.JSON(w, r, map[string]string{"error": err.Error()})
+	case err != nil:
+		render.Status(r, 500)
+		render.JSON(w, r, map[string]string{"error": err.Error()})
+	default:
+		w.Header().Set("Location", "/sets/"+run.Set+"/"+run.ID)
+		render.Status(r, 202)
+		render.JSON(w, r, run)
+	}
+}
+
+// postSetRestore restores every archive of the set run into the restore
+// target of its plan and responds with the restore jobs to poll under
+// /restores, with dryRun=true mongorestore only validates them.
+func postSetRestore(w http.ResponseWriter, r *http.Request) {
+	sch := r.Context().Value("app.scheduler").(*scheduler.Scheduler)
+	run, ok := setRun(w, r)
+	if !ok {
+		return
+	}
+	jobs, err := sch.RestoreSet(run.ID, r.URL.Query().Get("dryRun") == "true")
+	switch {
+	case err != nil && len(jobs) > 0:
+		// some restores started, the response lists them along with the error
+		render.Status(r, 500)
+		render.JSON(w, r, map[string]interface{}{"error": err.Error(), "restores": jobs})
+	case errors.Cause(err) == scheduler.ErrRestoreRunning:
+		render.Status(r, 409)
+		render.JSON(w, r, map[string]string{"error": err.Error()})
+	case err != nil:
+		render.Status(r, 400)
+		render.JSON(w, r, map[string]string{"error": err.Error()})
+	default:
+		render.Status(r, 202)
+		render.JSON(w, r, jobs)
+	}
+}
+
+// setRun loads the run of the id param, it responds 404 and returns false
+// when the run isn't one of the set param.
+func setRun(w http.ResponseWriter, r *http.Request) (*db.SetRun, bool) {
+	sch := r.Context().Value("app.scheduler").(*scheduler.Scheduler)
+	run, err := sch.SetRuns.Get(chi.URLParam(r, "id"))
+	if err != nil {
+		render.Status(r, 500)
+		render.JSON(w, r, map[string]string{"error": err.Error()})
+		return nil, false
+	}
+	if run == nil || run.Set != chi.URLParam(r, "set") {
+		render.Status(r, 404)
+		render.JSON(w, r, map[string]string{"error": "Backup set run " + chi.URLParam(r, "id") + " not found"})
+		return nil, false
+	}
+	return run, true
+}
@@ -0,0 +1,55 @@
+package api
+
+import (
+	"io/ioutil"
+	"net/http"
+	"strconv"
+
+	"github.com/go-chi/render"
+
+	"github.com/stefanprodan/mgob/pkg/config"
+	"github.com/stefanprodan/mgob/pkg/scheduler"
+)
+
+// postSimulate responds with what mgob would do with the yaml plan in the request
+// body, named by the plan query param, without saving or scheduling it.
+func postSimulate(w http.ResponseWriter, r *http.Request) {
+	sch := r.Context().Value("app.scheduler").(*scheduler.Scheduler)
+
+	n := defaultNextRuns
+	if v := r.URL.Query().Get("next"); v != "" {
+		i, err := strconv.Atoi(v)
+		if err != nil || i < 0 || i > maxNextRuns {
+			render.Status(r, 400)
+			render.JSON(w, r, map[string]string{"error": "Invalid next value " + v})
+			return
+		}
+		n = i
+	}
+
+	data, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, 1<<20))
+	if err != nil {
+		render.Status(r, 400)
+		render.JSON(w, r, map[string]string{"error": err.Error()})
+		return
+	}
+	plan, err := config.ParsePlan(r.URL.Query().Get("plan"), data)
+	if err != nil {
+		render.Status(r, 400)
+		render.JSON(w, r, map[string]string{"error": err.Error()})
+		return
+	}
+	if !accessOf(r).canApply(plan) {
+		render.Status(r, 403)
+		render.JSON(w, r, map[string]string{"error": "Plan " + plan.Name + " is not in the tenant of the token"})
+		return
+	}
+
+	sim, err := sch.Simulate(plan, n)
+	if err != nil {
+		render.Status(r, 400)
+		render.JSON(w, r, map[string]string{"error": err.Error()})
+		return
+	}
+	render.JSON(w, r, sim)
+}
@@ -34,7 +34,14 @@ func statusCtx(store *db.StatusStore) func(next http.Handler) http.Handler {
 
 func getStatus(w http.ResponseWriter, r *http.Request) {
 	data := r.Context().Value("app.status").(appStatus)
-	render.JSON(w, r, data)
+	a := accessOf(r)
+	list := make(appStatus, 0, len(data))
+	for _, s := range data {
+		if a.visible(s.Plan) {
+			list = append(list, s)
+		}
+	}
+	render.JSON(w, r, list)
 }
 
 func getPlanStatus(w http.ResponseWriter, r *http.Request) {
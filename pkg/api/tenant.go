@@ -0,0 +1,134 @@
+package api
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"path"
+	"strings"
+
+	"github.com/go-chi/chi"
+	"github.com/go-chi/render"
+
+	"github.com/stefanprodan/mgob/pkg/config"
+	"github.com/stefanprodan/mgob/pkg/scheduler"
+)
+
+// access is what the token of a request reaches. Admins reach every plan and
+// filter the lists with the tenant query param, a tenant token is bound to its tenant.
+type access struct {
+	admin  bool
+	tenant string
+	// identity names the token without revealing it, empty without tenants
+	identity string
+	lookup   func(name string) (config.Plan, bool)
+}
+
+// owns reports whether the request may act on the plan.
+func (a access) owns(plan string) bool {
+	if a.admin {
+		return true
+	}
+	p, ok := a.lookup(plan)
+	return ok && p.Tenant == a.tenant
+}
+
+// visible reports whether the plan is in the lists of the request.
+func (a access) visible(plan string) bool {
+	if a.tenant == "" {
+		return a.admin
+	}
+	p, ok := a.lookup(plan)
+	return ok && p.Tenant == a.tenant
+}
+
+// canApply reports whether the request may save plan, a tenant token can't
+// move a plan out of its tenant nor replace the plan of another tenant.
+func (a access) canApply(plan config.Plan) bool {
+	if a.admin {
+		return true
+	}
+	if plan.Tenant != a.tenant {
+		return false
+	}
+	p, ok := a.lookup(plan.Name)
+	return !ok || p.Tenant == a.tenant
+}
+
+func accessOf(r *http.Request) access {
+	return r.Context().Value("app.access").(access)
+}
+
+// tenantCtx authenticates the bearer token of the request when tenants are
+// configured, without tenants every request is admin.
+func tenantCtx(tenants *config.Tenants, sch *scheduler.Scheduler) func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			a := access{admin: true, tenant: r.URL.Query().Get("tenant"), lookup: sch.Lookup}
+			if tenants != nil {
+				token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+				tenant, admin, ok := tenants.Authenticate(token)
+				if !ok {
+					w.Header().Set("WWW-Authenticate", `Bearer realm="mgob"`)
+					render.Status(r, 401)
+					render.JSON(w, r, map[string]string{"error": "Invalid or missing token"})
+					return
+				}
+				if !admin {
+					a.admin, a.tenant = false, tenant
+				}
+				a.identity = tokenIdentity(tenant, admin, token)
+			}
+			r = r.WithContext(context.WithValue(r.Context(), "app.access", a))
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// tokenIdentity is the tenant, or admin, and the start of the token sha256.
+func tokenIdentity(tenant string, admin bool, token string) string {
+	sum := sha256.Sum256([]byte(token))
+	if admin {
+		tenant = "admin"
+	}
+	return tenant + ":" + hex.EncodeToString(sum[:6])
+}
+
+// adminOnly rejects the tenant tokens.
+func adminOnly(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !accessOf(r).admin {
+			render.Status(r, 403)
+			render.JSON(w, r, map[string]string{"error": "Admin token required"})
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// planAccess hides the plans of the other tenants, the route must have a planID param.
+func planAccess(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !accessOf(r).owns(chi.URLParam(r, "planID")) {
+			render.Status(r, 404)
+			render.JSON(w, r, map[string]string{"error": "Plan not found"})
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// storageAccess limits the tenant tokens to the tenant dir of the storage.
+func storageAccess(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		a := accessOf(r)
+		p := strings.TrimPrefix(path.Clean(r.URL.Path), "/storage")
+		if !a.admin && p != "/"+a.tenant && !strings.HasPrefix(p, "/"+a.tenant+"/") {
+			render.Status(r, 404)
+			render.JSON(w, r, map[string]string{"error": "Not found"})
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,395 @@
+package backup
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/stefanprodan/mgob/pkg/clock"
+	"github.com/stefanprodan/mgob/pkg/config"
+	"github.com/stefanprodan/mgob/pkg/db"
+)
+
+// AtlasRecordExt is the extension of the file recording the Atlas snapshot of a run in the plan dir.
+const AtlasRecordExt = ".atlas.json"
+
+const (
+	defaultAtlasURL       = "https://cloud.mongodb.com/api/atlas/v1.0"
+	defaultAtlasTimeout   = 120 * time.Minute
+	defaultAtlasRetention = 7
+)
+
+// AtlasPollInterval is the delay between two state checks of the Atlas snapshots and exports.
+var AtlasPollInterval = 30 * time.Second
+
+// AtlasRecord is stored in the plan dir for each run, the retention of the
+// records deletes the snapshots.
+type AtlasRecord struct {
+	Plan      string           `json:"plan"`
+	Timestamp time.Time        `json:"timestamp"`
+	Snapshot  db.AtlasSnapshot `json:"snapshot"`
+}
+
+// checkAtlas validates the plans of the atlas mode, the snapshots stay in
+// Atlas so the plan can't have a pipeline.
+func checkAtlas(plan config.Plan) error {
+	if plan.Mode != config.BackupModeAtlas {
+		if plan.Atlas != nil {
+			return errors.Errorf("atlas requires '%s' backup mode", config.BackupModeAtlas)
+		}
+		return nil
+	}
+	a := plan.Atlas
+	t := plan.Target
+	switch {
+	case a == nil || a.GroupID == "" || a.Cluster == "":
+		return errors.Errorf("'%s' backup mode requires an atlas groupId and cluster", plan.Mode)
+	case a.PublicKey == "" || a.PrivateKey == "":
+		return errors.New("atlas requires a publicKey and privateKey")
+	case a.RetentionDays < 0 || a.Timeout < 0:
+		return errors.New("atlas retentionDays and timeout can't be negative")
+	case plan.Agent != "" || plan.Executor != nil:
+		return errors.Errorf("'%s' backup mode can't run on an agent or executor", plan.Mode)
+	case t.PointInTime || plan.PITR != nil:
+		return errors.Errorf("pointInTime and pitr can't be used with '%s' backup mode", plan.Mode)
+	case plan.Streaming || len(plan.Pipeline) > 0 || plan.Encryption != nil || plan.Compression != nil:
+		return errors.New("the Atlas snapshots stay in Atlas, streaming, pipeline, encryption and compression can't be used")
+	case plan.Scan != nil || plan.Standby != nil:
+		return errors.New("scan and standby need a local archive, they can't be used with atlas")
+	case t.Database != "" || t.Collection != "" || len(t.IncludeDatabases) != 0 || len(t.ExcludeDatabases) != 0:
+		return errors.Errorf("'%s' backup mode snapshots the whole cluster, it can't select databases or collections", plan.Mode)
+	}
+	return nil
+}
+
+// runAtlas takes an on-demand snapshot of the cluster, exports it to the S3
+// export bucket when the plan has one, and records it in the plan dir. The
+// record is uploaded to the plan destinations.
+func runAtlas(ctx context.Context, c *dumpConfig) (Result, error) {
+	res := errRes(c)
+	a := c.plan.Atlas
+	timeout := defaultAtlasTimeout
+	if a.Timeout > 0 {
+		timeout = time.Duration(a.Timeout) * time.Minute
+	}
+	wctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	api := newAtlasClient(a)
+	rec := AtlasRecord{Plan: c.name, Timestamp: c.ts.UTC(), Snapshot: db.AtlasSnapshot{GroupID: a.GroupID, Cluster: a.Cluster}}
+	days := a.RetentionDays
+	if days == 0 {
+		days = defaultAtlasRetention
+	}
+	var snap struct {
+		ID     string `json:"id"`
+		Status string `json:"status"`
+	}
+	err := api.do(wctx, "POST", api.cluster("backup/snapshots"), map[string]interface{}{
+		"description":     fmt.Sprintf("mgob %v-%v", c.name, c.ts.Unix()),
+		"retentionInDays": days,
+	}, &snap)
+	if err != nil {
+		return res, errors.Wrapf(err, "Atlas snapshot of %v failed", a.Cluster)
+	}
+	rec.Snapshot.ID = snap.ID
+	log.WithField("plan", c.name).Infof("Atlas snapshot %v of %v queued", snap.ID, a.Cluster)
+
+	if err := api.wait(wctx, api.cluster("backup/snapshots/"+snap.ID), "status", "completed", "failed"); err != nil {
+		// the snapshot is recorded for the retention to delete it
+		writeAtlasRecord(c, rec)
+		return res, errors.Wrapf(err, "Atlas snapshot %v", snap.ID)
+	}
+
+	if a.ExportBucketID != "" {
+		var export struct {
+			ID string `json:"id"`
+		}
+		err := api.do(wctx, "POST", api.cluster("backup/exports"), map[string]interface{}{
+			"snapshotId":     snap.ID,
+			"exportBucketId": a.ExportBucketID,
+			"customData": []map[string]string{
+				{"key": "mgob-plan", "value": c.name},
+				{"key": "mgob-timestamp", "value": fmt.Sprint(c.ts.Unix())},
+			},
+		}, &export)
+		if err == nil {
+			rec.Snapshot.ExportID = export.ID
+			log.WithField("plan", c.name).Infof("Atlas export %v of snapshot %v queued", export.ID, snap.ID)
+			err = api.wait(wctx, api.cluster("backup/exports/"+export.ID), "state", "Successful", "Failed", "Cancelled")
+		}
+		if err != nil {
+			writeAtlasRecord(c, rec)
+			return res, errors.Wrapf(err, "Atlas export of snapshot %v to bucket %v failed", snap.ID, a.ExportBucketID)
+		}
+		var done struct {
+			Prefix string `json:"prefix"`
+		}
+		if err := api.do(wctx, "GET", api.cluster("backup/exports/"+export.ID), nil, &done); err == nil {
+			rec.Snapshot.ExportPrefix = done.Prefix
+		}
+	}
+
+	file, data, err := writeAtlasRecord(c, rec)
+	if err != nil {
+		return res, err
+	}
+	res.Name = filepath.Base(file)
+	res.AtlasSnapshot = &rec.Snapshot
+
+	if c.plan.Scheduler.Retention > 0 {
+		if err := expireAtlas(ctx, c, api); err != nil {
+			return res, errors.Wrap(err, "retention job failed")
+		}
+		if err := retain(ctx, c); err != nil {
+			return res, errors.Wrap(err, "retention job failed")
+		}
+	}
+
+	u, err := upload(ctx, c, RoutedPlan{Plan: c.plan}, file)
+	if err != nil {
+		return res, err
+	}
+	res.Uploads = append(res.Uploads, u)
+	res.Files = []string{file}
+	res.Size = int64(len(data))
+	res.Chain = fmt.Sprintf("%v-%v", c.name, c.ts.Unix())
+	res.Status = 200
+	res.Duration = clock.Since(c.ts)
+	log.WithFields(log.Fields{
+		"plan":     c.name,
+		"snapshot": snap.ID,
+		"export":   rec.Snapshot.ExportID,
+		"duration": res.Duration.String(),
+	}).Infof("Atlas snapshot succeeded")
+	return res, nil
+}
+
+// writeAtlasRecord writes rec in the plan dir.
+func writeAtlasRecord(c *dumpConfig, rec AtlasRecord) (string, []byte, error) {
+	if err := os.MkdirAll(c.planDir, 0755); err != nil {
+		return "", nil, errors.Wrapf(err, "creating dir %v in %v failed", c.name, c.storagePath)
+	}
+	data, err := json.MarshalIndent(rec, "", "  ")
+	if err != nil {
+		return "", nil, errors.Wrap(err, "encoding atlas record failed")
+	}
+	file := filepath.Join(c.planDir, fmt.Sprintf("%v-%v%v", c.name, c.ts.Unix(), AtlasRecordExt))
+	if err := ioutil.WriteFile(file, data, 0644); err != nil {
+		return "", nil, errors.Wrapf(err, "writing atlas record %v failed", file)
+	}
+	return file, data, nil
+}
+
+// expireAtlas deletes the snapshots of the records the retention removes.
+// The exported data stays in the bucket, it expires with the bucket lifecycle rules.
+func expireAtlas(ctx context.Context, c *dumpConfig, api *atlasClient) error {
+	files, err := ioutil.ReadDir(c.planDir)
+	if err != nil {
+		return errors.Wrapf(err, "reading %v failed", c.planDir)
+	}
+	backups, stamps := retentionGroups(files, c.name)
+	for i := c.plan.Scheduler.Retention; i < len(stamps); i++ {
+		for _, file := range backups[stamps[i]] {
+			if !strings.HasSuffix(file, AtlasRecordExt) {
+				continue
+			}
+			data, err := ioutil.ReadFile(filepath.Join(c.planDir, file))
+			if err != nil {
+				return errors.Wrapf(err, "reading %v failed", file)
+			}
+			var rec AtlasRecord
+			if err := json.Unmarshal(data, &rec); err != nil {
+				return errors.Wrapf(err, "parsing %v failed", file)
+			}
+			s := rec.Snapshot
+			if s.ID == "" {
+				continue
+			}
+			path := fmt.Sprintf("/groups/%v/clusters/%v/backup/snapshots/%v", s.GroupID, s.Cluster, s.ID)
+			// Atlas deletes the snapshots once retentionInDays is over
+			if err := api.do(ctx, "DELETE", path, nil, nil); err != nil && !isAtlasNotFound(err) {
+				return errors.Wrapf(err, "deleting Atlas snapshot %v failed", s.ID)
+			}
+			log.WithField("plan", c.name).Infof("Atlas snapshot %v deleted", s.ID)
+		}
+	}
+	return nil
+}
+
+// atlasClient calls the Atlas Admin API with HTTP digest authentication.
+type atlasClient struct {
+	url     string
+	groupID string
+	name    string
+	public  string
+	private string
+	client  *http.Client
+}
+
+// atlasError is the error body of the Admin API.
+type atlasError struct {
+	Status    int    `json:"error"`
+	ErrorCode string `json:"errorCode"`
+	Detail    string `json:"detail"`
+}
+
+func (e *atlasError) Error() string {
+	return fmt.Sprintf("%v %v: %v", e.Status, e.ErrorCode, e.Detail)
+}
+
+func isAtlasNotFound(err error) bool {
+	e, ok := errors.Cause(err).(*atlasError)
+	return ok && e.Status == 404
+}
+
+func newAtlasClient(a *config.Atlas) *atlasClient {
+	url := a.URL
+	if url == "" {
+		url = defaultAtlasURL
+	}
+	return &atlasClient{
+		url:     strings.TrimSuffix(url, "/"),
+		groupID: a.GroupID,
+		name:    a.Cluster,
+		public:  a.PublicKey,
+		private: a.PrivateKey,
+		client:  &http.Client{Timeout: time.Minute},
+	}
+}
+
+// cluster is the path of a resource of the plan cluster.
+func (a *atlasClient) cluster(resource string) string {
+	return fmt.Sprintf("/groups/%v/clusters/%v/%v", a.groupID, a.name, resource)
+}
+
+// do sends in as json and decodes the response into out, the first request
+// gets the digest challenge.
+func (a *atlasClient) do(ctx context.Context, method string, path string, in interface{}, out interface{}) error {
+	var body []byte
+	if in != nil {
+		var err error
+		if body, err = json.Marshal(in); err != nil {
+			return errors.Wrap(err, "encoding request failed")
+		}
+	}
+	send := func(auth string) (*http.Response, error) {
+		req, err := http.NewRequest(method, a.url+path, bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		req = req.WithContext(ctx)
+		req.Header.Set("Accept", "application/json")
+		if body != nil {
+			req.Header.Set("Content-Type", "application/json")
+		}
+		if auth != "" {
+			req.Header.Set("Authorization", auth)
+		}
+		return a.client.Do(req)
+	}
+	resp, err := send("")
+	if err != nil {
+		return errors.Wrapf(err, "%v %v failed", method, path)
+	}
+	if resp.StatusCode == http.StatusUnauthorized {
+		challenge := resp.Header.Get("WWW-Authenticate")
+		resp.Body.Close()
+		auth, err := digestAuth(challenge, method, resp.Request.URL.RequestURI(), a.public, a.private)
+		if err != nil {
+			return err
+		}
+		if resp, err = send(auth); err != nil {
+			return errors.Wrapf(err, "%v %v failed", method, path)
+		}
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return errors.Wrapf(err, "reading %v %v response failed", method, path)
+	}
+	if resp.StatusCode >= 300 {
+		e := &atlasError{}
+		if json.Unmarshal(data, e) != nil || e.Status == 0 {
+			e = &atlasError{Status: resp.StatusCode, Detail: strings.TrimSpace(string(data))}
+		}
+		return errors.Wrapf(e, "%v %v failed", method, path)
+	}
+	if out == nil || len(data) == 0 {
+		return nil
+	}
+	return errors.Wrapf(json.Unmarshal(data, out), "decoding %v %v response failed", method, path)
+}
+
+// wait polls the state field of the resource at path until it's done or one of the failed states.
+func (a *atlasClient) wait(ctx context.Context, path string, field string, done string, failed ...string) error {
+	for {
+		var out map[string]interface{}
+		if err := a.do(ctx, "GET", path, nil, &out); err != nil {
+			return err
+		}
+		state := fmt.Sprint(out[field])
+		if state == done {
+			return nil
+		}
+		for _, f := range failed {
+			if state == f {
+				return errors.Errorf("%v %v", field, state)
+			}
+		}
+		select {
+		case <-time.After(AtlasPollInterval):
+		case <-ctx.Done():
+			return errors.Wrapf(ctx.Err(), "waiting with %v %v", field, state)
+		}
+	}
+}
+
+// digestAuth answers the digest challenge of the Admin API, qop auth with MD5.
+func digestAuth(challenge string, method string, uri string, user string, password string) (string, error) {
+	if !strings.HasPrefix(challenge, "Digest ") {
+		return "", errors.New("Atlas API key rejected, no digest challenge")
+	}
+	params := make(map[string]string)
+	for _, p := range strings.Split(strings.TrimPrefix(challenge, "Digest "), ",") {
+		kv := strings.SplitN(strings.TrimSpace(p), "=", 2)
+		if len(kv) == 2 {
+			params[kv[0]] = strings.Trim(kv[1], `"`)
+		}
+	}
+	if params["nonce"] == "" {
+		return "", errors.New("Atlas API key rejected, the digest challenge has no nonce")
+	}
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	cnonce := hex.EncodeToString(b)
+	h := func(s string) string {
+		sum := md5.Sum([]byte(s))
+		return hex.EncodeToString(sum[:])
+	}
+	ha1 := h(user + ":" + params["realm"] + ":" + password)
+	ha2 := h(method + ":" + uri)
+	const nc = "00000001"
+	response := h(strings.Join([]string{ha1, params["nonce"], nc, cnonce, "auth", ha2}, ":"))
+	auth := fmt.Sprintf(`Digest username="%v", realm="%v", nonce="%v", uri="%v", qop=auth, nc=%v, cnonce="%v", response="%v", algorithm=MD5`,
+		user, params["realm"], params["nonce"], uri, nc, cnonce, response)
+	if params["opaque"] != "" {
+		auth += fmt.Sprintf(`, opaque="%v"`, params["opaque"])
+	}
+	return auth, nil
+}
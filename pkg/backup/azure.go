@@ -1,22 +1,146 @@
 package backup
 
 import (
-	"fmt"
+	"context"
+	"os/exec"
+	"strconv"
 	"strings"
 	"time"
 
-	"github.com/codeskyblue/go-sh"
 	"github.com/pkg/errors"
 
 	"github.com/stefanprodan/mgob/pkg/config"
 )
 
-func azureUpload(file string, plan config.Plan) (string, error) {
-	azurefile := strings.TrimLeft(file, "!/")
-	upload := fmt.Sprintf("az storage blob upload -c '%v' --file '%v' --name '%v' --connection-string '%v'",
-		plan.Azure.ContainerName, file, azurefile, plan.Azure.ConnectionString)
+type azureDestination struct {
+	plan config.Plan
+}
+
+func newAzureDestination(plan config.Plan, conf *config.AppConfig, ts time.Time) Destination {
+	if plan.Azure == nil {
+		return nil
+	}
+	return &azureDestination{plan: plan}
+}
+
+func (d *azureDestination) Name() string {
+	return "Azure"
+}
+
+func (d *azureDestination) Upload(ctx context.Context, file string) (string, error) {
+	output, err := azureUpload(ctx, file, d.plan)
+	if err != nil {
+		return "", err
+	}
+	if err := d.checksum(ctx, file); err != nil {
+		return "", err
+	}
+	return output, nil
+}
+
+func (d *azureDestination) List(ctx context.Context) ([]Object, error) {
+	output, err := runCmd(ctx, "az", "storage", "blob", "list", "-c", d.plan.Azure.ContainerName,
+		"--connection-string", d.plan.Azure.ConnectionString,
+		"--query", "[].[name, properties.contentLength]", "-o", "tsv")
+	if err != nil {
+		return nil, errors.Wrapf(err, "Azure listing %v failed", d.plan.Azure.ContainerName)
+	}
+	objects := make([]Object, 0)
+	for _, line := range strings.Split(output, "\n") {
+		fields := strings.Split(line, "\t")
+		if len(fields) != 2 {
+			continue
+		}
+		size, _ := strconv.ParseInt(fields[1], 10, 64)
+		objects = append(objects, Object{Name: fields[0], Size: size})
+	}
+	return objects, nil
+}
+
+func (d *azureDestination) Delete(ctx context.Context, name string) error {
+	_, err := runCmd(ctx, "az", "storage", "blob", "delete", "-c", d.plan.Azure.ContainerName,
+		"--name", name, "--connection-string", d.plan.Azure.ConnectionString)
+	if err != nil {
+		return errors.Wrapf(err, "Azure deleting %v from %v failed", name, d.plan.Azure.ContainerName)
+	}
+	return nil
+}
+
+func (d *azureDestination) Verify(ctx context.Context, file string) error {
+	name := azureBlobName(file)
+	output, err := runCmd(ctx, "az", "storage", "blob", "show", "-c", d.plan.Azure.ContainerName,
+		"--name", name, "--connection-string", d.plan.Azure.ConnectionString,
+		"--query", "properties.contentLength", "-o", "tsv")
+	if err != nil {
+		return errors.Wrapf(err, "Azure verifying %v in %v failed", name, d.plan.Azure.ContainerName)
+	}
+	size, err := strconv.ParseInt(output, 10, 64)
+	if err != nil {
+		return errors.Wrapf(err, "Azure verifying %v in %v failed", name, d.plan.Azure.ContainerName)
+	}
+	if err := checkSize(file, size); err != nil {
+		return err
+	}
+	return d.checksum(ctx, file)
+}
+
+// checksum compares the Content-MD5 of the uploaded copy of file with the local one.
+func (d *azureDestination) checksum(ctx context.Context, file string) error {
+	name := azureBlobName(file)
+	output, err := runCmd(ctx, "az", "storage", "blob", "show", "-c", d.plan.Azure.ContainerName,
+		"--name", name, "--connection-string", d.plan.Azure.ConnectionString,
+		"--query", "properties.contentSettings.contentMd5", "-o", "tsv")
+	if err != nil {
+		return errors.Wrapf(err, "Azure reading the checksum of %v failed", name)
+	}
+	sums, err := digestFile(file)
+	if err != nil {
+		return err
+	}
+	return checkDigest(file, "Azure md5", b64(sums.MD5), output)
+}
+
+func (d *azureDestination) Download(ctx context.Context, file string, dst string) error {
+	name := azureBlobName(file)
+	_, err := runCmd(ctx, "az", "storage", "blob", "download", "-c", d.plan.Azure.ContainerName,
+		"--name", name, "--file", dst, "--connection-string", d.plan.Azure.ConnectionString)
+	if err != nil {
+		return errors.Wrapf(err, "Azure downloading %v from %v failed", name, d.plan.Azure.ContainerName)
+	}
+	return nil
+}
+
+func (d *azureDestination) Link(ctx context.Context, file string, ttl time.Duration) (string, error) {
+	name := azureBlobName(file)
+	output, err := runCmd(ctx, "az", "storage", "blob", "generate-sas", "-c", d.plan.Azure.ContainerName,
+		"--name", name, "--permissions", "r", "--https-only", "--full-uri",
+		"--expiry", time.Now().Add(ttl).UTC().Format("2006-01-02T15:04Z"),
+		"--connection-string", d.plan.Azure.ConnectionString, "-o", "tsv")
+	if err != nil {
+		return "", errors.Wrapf(err, "Azure signing %v in %v failed", name, d.plan.Azure.ContainerName)
+	}
+	return output, nil
+}
+
+func azureBlobName(file string) string {
+	return strings.TrimLeft(file, "!/")
+}
+
+func azureUpload(ctx context.Context, file string, plan config.Plan) (string, error) {
+	azurefile := azureBlobName(file)
+	sums, err := digestFile(file)
+	if err != nil {
+		return "", err
+	}
+	// the service checks each block against its MD5 and stores the blob one
+	args := []string{"storage", "blob", "upload", "-c", plan.Azure.ContainerName, "--file", file,
+		"--name", azurefile, "--connection-string", plan.Azure.ConnectionString,
+		"--validate-content", "--content-md5", b64(sums.MD5)}
+	if len(plan.Tags) > 0 {
+		args = append(append(args, "--metadata"), azureMetadata(plan)...)
+	}
 
-	result, err := sh.Command("/bin/sh", "-c", upload).SetTimeout(time.Duration(plan.Scheduler.Timeout) * time.Minute).CombinedOutput()
+	result, err := combinedOutput(ctx, exec.Command("az", args...))
 	output := ""
 	if len(result) > 0 {
 		output = strings.Replace(string(result), "\n", " ", -1)
@@ -0,0 +1,45 @@
+package backup
+
+import (
+	"fmt"
+	"sync/atomic"
+
+	"github.com/dustin/go-humanize"
+	"github.com/pkg/errors"
+
+	"github.com/stefanprodan/mgob/pkg/config"
+)
+
+// uploading is the number of backups copying their archives to the destinations.
+var uploading int32
+
+// Uploading returns the number of backups in their upload phase.
+func Uploading() int {
+	return int(atomic.LoadInt32(&uploading))
+}
+
+// Pressure tells why a new dump should wait, uploads when conf.MaxUploads backups
+// are uploading or tmp when the tmp dir holds more than conf.MaxTmp. It returns
+// an empty reason when both are below the thresholds or disabled.
+func Pressure(conf *config.AppConfig) (string, string, error) {
+	if conf.MaxUploads > 0 {
+		if n := Uploading(); n >= conf.MaxUploads {
+			return "uploads", fmt.Sprintf("%v backups are uploading, limit %v", n, conf.MaxUploads), nil
+		}
+	}
+	if conf.MaxTmp != "" {
+		limit, err := humanize.ParseBytes(conf.MaxTmp)
+		if err != nil {
+			return "", "", errors.Wrapf(err, "invalid tmp threshold '%s'", conf.MaxTmp)
+		}
+		used, err := dirSize(conf.TmpPath, "")
+		if err != nil {
+			return "", "", err
+		}
+		if uint64(used) > limit {
+			return "tmp", fmt.Sprintf("%v holds %v, limit %v", conf.TmpPath,
+				humanize.Bytes(uint64(used)), humanize.Bytes(limit)), nil
+		}
+	}
+	return "", "", nil
+}
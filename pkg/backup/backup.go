@@ -5,17 +5,18 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
+	"sync/atomic"
 	"time"
 
-	"github.com/codeskyblue/go-sh"
 	"github.com/dustin/go-humanize"
 	"github.com/pkg/errors"
 	log "github.com/sirupsen/logrus"
-	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
 
+	"github.com/stefanprodan/mgob/pkg/clock"
 	"github.com/stefanprodan/mgob/pkg/config"
 )
 
@@ -30,28 +31,199 @@ type dumpConfig struct {
 	ts          time.Time
 	name        string
 	database    string
+	// source is the dump produced by other tooling in watch mode
+	source string
 }
 
-func Run(plan config.Plan, conf *config.AppConfig, modules *config.ModuleConfig) (Result, error) {
+func Run(ctx context.Context, plan config.Plan, conf *config.AppConfig, modules *config.ModuleConfig) (Result, error) {
 	c := &dumpConfig{
 		plan:        plan,
 		database:    plan.Target.Database,
 		conf:        conf,
 		tmpPath:     conf.TmpPath,
 		storagePath: conf.StoragePath,
-		ts:          time.Now(),
-		planDir:     fmt.Sprintf("%v/%v", conf.StoragePath, plan.Name),
+		ts:          clock.Now(),
+		planDir:     config.PlanDir(conf.StoragePath, plan),
 		name:        plan.Name,
 	}
-	log.WithField("plan", c.plan.Name).Info("Initiating backup (mode=%s)", config.BackupModeSingle)
+	log.WithField("plan", c.plan.Name).Infof("Initiating backup (mode=%s)", plan.Mode)
+	ctx = WithEnv(ctx, plan)
+	// the watch, exec and atlas modes don't dump the target, nor the csi and disk modes without a lock
+	noTarget := plan.Mode == config.BackupModeWatch || plan.Mode == config.BackupModeExec || plan.Mode == config.BackupModeAtlas ||
+		((plan.Mode == config.BackupModeCSI || plan.Mode == config.BackupModeDisk) && plan.Target.Uri == "")
+	if plan.Agent != "" && (plan.Mode == config.BackupModeDatabase || noTarget) {
+		return errRes(c), errors.Errorf("'%s' backup mode can't run on an agent", plan.Mode)
+	}
+	if plan.Executor != nil && plan.Agent != "" {
+		return errRes(c), errors.New("a plan can't have both an agent and an executor")
+	}
+	if plan.Executor != nil && noTarget {
+		return errRes(c), errors.Errorf("'%s' backup mode can't run on an executor", plan.Mode)
+	}
+	// agent targets may only resolve from the agent network
+	if plan.Agent == "" && !noTarget {
+		if err := checkTarget(plan.Target); err != nil {
+			return errRes(c), err
+		}
+	}
+	if err := checkRoutes(plan); err != nil {
+		return errRes(c), err
+	}
+	if err := checkPatterns(plan.Target); err != nil {
+		return errRes(c), err
+	}
+	if err := checkQuery(plan); err != nil {
+		return errRes(c), err
+	}
+	if err := checkStreaming(plan); err != nil {
+		return errRes(c), err
+	}
+	if err := checkDbHash(plan); err != nil {
+		return errRes(c), err
+	}
+	if err := checkReadPreference(plan); err != nil {
+		return errRes(c), err
+	}
+	if err := checkFlavor(plan); err != nil {
+		return errRes(c), err
+	}
+	if err := checkSharded(plan); err != nil {
+		return errRes(c), err
+	}
+	if err := checkPBM(plan); err != nil {
+		return errRes(c), err
+	}
+	if err := checkSnapshot(plan); err != nil {
+		return errRes(c), err
+	}
+	if err := checkCSI(plan); err != nil {
+		return errRes(c), err
+	}
+	if err := checkDisk(plan); err != nil {
+		return errRes(c), err
+	}
+	if err := checkAtlas(plan); err != nil {
+		return errRes(c), err
+	}
+	if err := checkMigrate(plan); err != nil {
+		return errRes(c), err
+	}
+	if err := checkExport(plan); err != nil {
+		return errRes(c), err
+	}
+	if err := checkMetadataMode(plan); err != nil {
+		return errRes(c), err
+	}
+	if err := checkNaming(plan); err != nil {
+		return errRes(c), err
+	}
+	if err := checkTimeouts(plan); err != nil {
+		return errRes(c), err
+	}
+	if err := checkFieldEncryption(plan); err != nil {
+		return errRes(c), err
+	}
+	if rp := plan.Target.ReadPreference; rp != nil && plan.Target.Uri != "" {
+		plan.Target.Uri = uriWithReadPreference(plan.Target.Uri, rp)
+		c.plan = plan
+	}
+	if plan.Target.Uri != "" {
+		plan.Target.Uri = UriWithFlavor(plan.Target)
+		c.plan = plan
+	}
+	switch plan.Target.Format {
+	case "", config.DumpFormatArchive:
+	case config.DumpFormatDirectory:
+		if plan.Mode != "" && plan.Mode != config.BackupModeSingle && plan.Mode != config.BackupModeDatabase {
+			return errRes(c), errors.Errorf("'%s' format can't be used with '%s' backup mode", plan.Target.Format, plan.Mode)
+		}
+	default:
+		return errRes(c), errors.Errorf("unknown format: '%s'", plan.Target.Format)
+	}
+	if plan.Target.PerCollection {
+		switch {
+		case plan.Target.Format != config.DumpFormatDirectory:
+			return errRes(c), errors.Errorf("perCollection requires '%s' format", config.DumpFormatDirectory)
+		case plan.Agent != "" || plan.Executor != nil:
+			return errRes(c), errors.New("perCollection can't be used on an agent or executor")
+		case plan.Scan != nil || plan.Standby != nil:
+			return errRes(c), errors.New("scan and standby need a single archive, they can't be used with perCollection")
+		}
+	}
+	if plan.Transform != nil && plan.Mode != config.BackupModeSample {
+		return errRes(c), errors.Errorf("transform requires '%s' backup mode", config.BackupModeSample)
+	}
+	// each shard is dumped with its own oplog
+	if plan.Target.PointInTime && plan.Agent == "" && plan.Mode != config.BackupModeSharded {
+		if err := CheckPointInTime(ctx, plan); err != nil {
+			return errRes(c), err
+		}
+	}
+	if plan.Health != nil && plan.Agent == "" && !noTarget {
+		if err := healthGate(ctx, c); err != nil {
+			return errRes(c), err
+		}
+	}
+	if plan.Target.FieldEncryption != nil && plan.Agent == "" && plan.Target.Uri != "" {
+		if err := checkKeyVault(ctx, c); err != nil {
+			return errRes(c), err
+		}
+	}
+	ctx, usage := withUsage(ctx)
+	ctx, phases := withPhases(ctx)
+	tctx, cancel := withTimeout(ctx, plan.Scheduler.TotalTimeout())
+	defer cancel()
+	res, err := runMode(tctx, c)
+	res.Usage = usage.usage()
+	res.Phases, res.Outcomes = phases.result()
+	if res.Archive == "" && len(res.Files) > 0 {
+		res.Archive = res.Files[0]
+	}
+	if err != nil && ctx.Err() == nil && tctx.Err() == context.DeadlineExceeded {
+		err = errors.Wrapf(err, "plan deadline of %v minutes exceeded", plan.Scheduler.TotalTimeout())
+	}
+	return res, err
+}
+
+// runMode runs the backup of the plan mode.
+func runMode(ctx context.Context, c *dumpConfig) (Result, error) {
+	plan := c.plan
+	if resuming(ctx) && plan.Mode != config.BackupModeDatabase {
+		return errRes(c), errors.Errorf("only '%s' backup mode runs can be resumed", config.BackupModeDatabase)
+	}
 	switch plan.Mode {
 	case config.BackupModeDatabase:
-		return runDumpPerDBAndUpload(c)
+		return runDumpPerDBAndUpload(ctx, c)
+	case config.BackupModeSample, config.BackupModeMetadata:
+		return runDumpAndUpload(ctx, c)
+	case config.BackupModeWatch:
+		return runWatch(ctx, c)
+	case config.BackupModeExec:
+		return runDumpAndUpload(ctx, c)
+	case config.BackupModeSharded:
+		return runSharded(ctx, c)
+	case config.BackupModePBM:
+		return runPBM(ctx, c)
+	case config.BackupModeSnapshot:
+		return runDumpAndUpload(ctx, c)
+	case config.BackupModeCSI:
+		return runCSI(ctx, c)
+	case config.BackupModeDisk:
+		return runDisk(ctx, c)
+	case config.BackupModeAtlas:
+		return runAtlas(ctx, c)
+	case config.BackupModeMigrate:
+		return runMigrate(ctx, c)
+	case config.BackupModeExport:
+		return runDumpAndUpload(ctx, c)
 	case "", config.BackupModeSingle:
 		if len(c.plan.Target.ExcludeDatabases) != 0 {
 			return errRes(c), fmt.Errorf("cannot exclude databases with '%s' (default) backup mode", config.BackupModeSingle)
 		}
-		return runDumpAndUpload(c)
+		if len(c.plan.Target.IncludeDatabases) != 0 {
+			return errRes(c), fmt.Errorf("cannot include databases with '%s' (default) backup mode", config.BackupModeSingle)
+		}
+		return runDumpAndUpload(ctx, c)
 	default:
 		return errRes(c), fmt.Errorf("unknown mode: '%s'", plan.Mode)
 	}
@@ -65,18 +237,18 @@ func errRes(c *dumpConfig) Result {
 	}
 }
 
-func getDBNames(c *dumpConfig) ([]string, error) {
-	mdbCtx, cancel := context.WithTimeout(context.Background(), mongodbDatabaseListTimeout)
+func getDBNames(ctx context.Context, c *dumpConfig) ([]string, error) {
+	mdbCtx, cancel := context.WithTimeout(ctx, mongodbDatabaseListTimeout)
 	defer cancel()
 
 	log.WithField("plan", c.plan.Name).Info("Listing MonogoDB databases: connecting")
 	client, err := mongo.Connect(mdbCtx, options.Client().ApplyURI(c.plan.Target.Uri))
 	if err != nil {
-		return nil, fmt.Errorf("failed to connect to MongoDB: %s", err)
+		return nil, fmt.Errorf("failed to connect to MongoDB %s: %s", redactUri(c.plan.Target.Uri), err)
 	}
 	log.WithField("plan", c.plan.Name).Info("Listing MonogoDB databases: connected")
 	defer client.Disconnect(context.Background())
-	dbNames, err := client.ListDatabaseNames(mdbCtx, bson.D{})
+	dbNames, err := listDatabaseNames(mdbCtx, client, c.plan.Target)
 	if err != nil {
 		return nil, fmt.Errorf("failed to list databases: %s", err)
 	}
@@ -84,52 +256,174 @@ func getDBNames(c *dumpConfig) ([]string, error) {
 	return dbNames, nil
 }
 
-func runDumpPerDBAndUpload(c *dumpConfig) (Result, error) {
+// runDumpPerDBAndUpload dumps and uploads each database on its own. When some
+// fail the ones that succeeded are recorded, a resumed run only dumps the
+// others under the timestamp of the failed run.
+func runDumpPerDBAndUpload(ctx context.Context, c *dumpConfig) (Result, error) {
 	if c.plan.Target.Uri == "" {
 		return errRes(c), fmt.Errorf("must use MongoDB URI with '%s' backup mode", c.plan.Mode)
 	}
 
-	dbNames, err := getDBNames(c)
+	t1 := clock.Now()
+	rec := &ResumeRecord{Plan: c.plan.Name, Succeeded: make(map[string]DatabaseBackup)}
+	if resuming(ctx) {
+		prev, err := ReadResume(c.conf, c.plan.Name)
+		if err != nil {
+			return errRes(c), err
+		}
+		if prev == nil {
+			return errRes(c), ErrNothingToResume
+		}
+		rec.Succeeded = prev.Succeeded
+		c.ts = prev.Timestamp
+		log.WithField("plan", c.name).Infof("Resuming the run of %v, %v databases already backed up", c.ts.UTC(), len(rec.Succeeded))
+	}
+	rec.Timestamp = c.ts.UTC()
+
+	dbNames, err := getDBNames(ctx, c)
 	if err != nil {
 		return errRes(c), err
 	}
 
 	attempts := 0
-	totalSize := int64(0)
 	failedDBs := make([]string, 0)
-dbLoop:
+	failed := make(map[string]string)
 	for _, dbName := range dbNames {
-		for _, excluded := range c.plan.Target.ExcludeDatabases {
-			if dbName == excluded {
-				continue dbLoop
-			}
+		if skipDatabase(c.plan.Target, dbName) {
 			log.WithField("plan", c.name).Infof("Excluded backup of DB '%s'", dbName)
+			continue
+		}
+		if _, ok := rec.Succeeded[dbName]; ok {
+			log.WithField("plan", c.name).Infof("DB '%s' already backed up by the resumed run", dbName)
+			continue
+		}
+		if ctx.Err() != nil {
+			failedDBs = append(failedDBs, dbName)
+			failed[dbName] = ctx.Err().Error()
+			continue
 		}
 		attempts++
 		dbConf := *c
 		dbConf.database = dbName
 		dbConf.name = fmt.Sprintf("%s-%s", c.plan.Name, dbName)
-		res, err := runDumpAndUpload(&dbConf)
+		res, err := runDumpAndUpload(ctx, &dbConf)
 		if err != nil {
 			log.WithField("plan", c.name).Errorf("Backup failed: %s", err)
 			failedDBs = append(failedDBs, dbName)
+			failed[dbName] = err.Error()
 		} else {
-			totalSize += res.Size
+			rec.Succeeded[dbName] = DatabaseBackup{
+				Size:     res.Size,
+				Files:    res.Files,
+				Uploads:  res.Uploads,
+				Hashes:   res.Hashes[dbName],
+				Estimate: res.Estimate,
+			}
 		}
 	}
 	res := errRes(c)
-	res.Duration = time.Since(c.ts)
+	res.Duration = clock.Since(t1)
 	if len(failedDBs) > 0 {
+		rec.Failed = failed
+		if err := writeResume(c.conf, rec); err != nil {
+			log.WithField("plan", c.name).Errorf("Recording the failed databases failed %v", err)
+		}
 		return res, fmt.Errorf("%d of %d database backups failed: %s", len(failedDBs), attempts, strings.Join(failedDBs, ","))
 	}
+	if err := removeResume(c.conf, c.plan.Name); err != nil {
+		log.WithField("plan", c.name).Warn(err)
+	}
+
 	res.Status = 200
-	res.Size = totalSize
+	res.Files = make([]string, 0)
+	res.Uploads = make([]Upload, 0)
+	res.Databases = make(map[string]int64)
+	hashes := make(map[string]map[string]string)
+	names := make([]string, 0, len(rec.Succeeded))
+	for name := range rec.Succeeded {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		b := rec.Succeeded[name]
+		res.Size += b.Size
+		res.Estimate += b.Estimate
+		res.Databases[name] = b.Size
+		res.Files = append(res.Files, b.Files...)
+		res.Uploads = append(res.Uploads, b.Uploads...)
+		if b.Hashes != nil {
+			hashes[name] = b.Hashes
+		}
+	}
+	if len(hashes) > 0 {
+		res.Hashes = hashes
+	}
 	return res, nil
 }
 
-func runDumpAndUpload(c *dumpConfig) (Result, error) {
+func runDumpAndUpload(ctx context.Context, c *dumpConfig) (Result, error) {
+	if c.plan.Streaming {
+		return runStreaming(ctx, c)
+	}
+	res := errRes(c)
+
+	routed := routePlan(c.plan, c.database)
+	if routed.Route != "" {
+		log.WithField("plan", c.name).Infof("Database %v routed by %v", c.database, routed.Route)
+	}
+
+	p, err := newPipeline(ctx, c.plan, c.conf)
+	if err != nil {
+		return res, err
+	}
 
-	archive, mlog, err := dump(c)
+	q := newQuota(c.plan)
+	if err := q.check(c.planDir); err != nil {
+		// the retention only runs after a dump, apply it first or the plan stays over its quota
+		if c.plan.Scheduler.Retention < 1 {
+			return res, err
+		}
+		log.WithField("plan", c.name).Warnf("%v, keeping the last %v backups before the dump", err, c.plan.Scheduler.Retention-1)
+		if err := keepBackups(c, c.plan.Scheduler.Retention-1); err != nil {
+			return res, errors.Wrap(err, "retention job failed")
+		}
+		if err := q.check(c.planDir); err != nil {
+			return res, err
+		}
+	}
+	if estimates(c.plan) {
+		if res.Estimate, err = estimateSize(ctx, c); err != nil {
+			log.WithField("plan", c.name).Warnf("Estimating the dump size failed %v", err)
+		} else {
+			log.WithField("plan", c.name).Infof("Estimated dump size %v", humanize.Bytes(uint64(res.Estimate)))
+		}
+	}
+	expected := expectedDumpSize(c, res.Estimate, p.compresses())
+	if err := checkFreeSpace(c, res.Estimate, expected); err != nil {
+		return res, err
+	}
+
+	dctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	tmpWatch := q.watch(dctx, cancel, "tmp", c.tmpPath, fmt.Sprintf("%v-%v.", c.name, c.ts.Unix()))
+	stopProgress := watchDump(c, res.Estimate, expected)
+	dumpFunc := executorDump
+	if c.source != "" {
+		dumpFunc = dumpSource
+	} else if c.plan.Mode == config.BackupModeExec {
+		dumpFunc = dumpExec
+	} else if c.plan.Mode == config.BackupModeSnapshot {
+		dumpFunc = dumpSnapshot
+	} else if c.plan.Mode == config.BackupModeExport {
+		dumpFunc = dumpExport
+	}
+	start := clock.Now()
+	archive, mlog, err := dumpFunc(withStage(dctx, UsageDump), c, !p.compresses())
+	recordPhase(ctx, PhaseDump, start)
+	stopProgress()
+	if qerr := tmpWatch.stop(); qerr != nil {
+		err = qerr
+	}
 	log.WithFields(log.Fields{
 		"archive": archive,
 		"mlog":    mlog,
@@ -137,108 +431,93 @@ func runDumpAndUpload(c *dumpConfig) (Result, error) {
 		"err":     err,
 	}).Info("new dump")
 
-	res := errRes(c)
 	_, res.Name = filepath.Split(archive)
 
 	if err != nil {
 		return res, err
 	}
 
-	err = sh.Command("mkdir", "-p", c.planDir).Run()
+	if c.plan.Target.DbHash {
+		if res.Hashes, err = captureHashes(ctx, c); err != nil {
+			os.RemoveAll(archive)
+			return res, err
+		}
+	}
+
+	err = os.MkdirAll(c.planDir, 0755)
 	if err != nil {
 		return res, errors.Wrapf(err, "creating dir %v in %v failed", c.name, c.storagePath)
 	}
 
-	fi, err := os.Stat(archive)
+	storageWatch := q.watch(dctx, cancel, "storage", c.planDir, "")
+	pctx, pcancel := withTimeout(dctx, c.plan.Scheduler.EncryptTimeout())
+	start = clock.Now()
+	var out pipelineResult
+	if c.plan.Target.PerCollection {
+		out, err = runCollections(pctx, c, p, archive)
+	} else {
+		out, err = p.run(pctx, archive, c.planDir)
+	}
+	recordPhase(ctx, PhaseEncrypt, start)
+	pcancel()
+	if qerr := storageWatch.stop(); qerr != nil {
+		err = qerr
+	}
 	if err != nil {
-		return res, errors.Wrapf(err, "stat file %v failed", archive)
+		os.RemoveAll(archive)
+		return res, err
+	}
+	res.Name = out.Name
+	res.Size = out.Size
+	res.Checksum = out.Checksum
+	res.Files = out.Files
+	res.Chain = fmt.Sprintf("%v-%v", c.name, c.ts.Unix())
+	if err := writeMetadata(c, p, &res); err != nil {
+		return res, err
 	}
-	res.Size = fi.Size()
 
-	err = sh.Command("mv", archive, c.planDir).Run()
-	if err != nil {
-		return res, errors.Wrapf(err, "moving file from %v to %v failed", archive, c.planDir)
+	if c.plan.Scan != nil {
+		if err := scan(ctx, c, out.Files); err != nil {
+			return res, err
+		}
 	}
 
 	// check if log file exists, is not always created
 	if _, err := os.Stat(mlog); os.IsNotExist(err) {
-		log.Debug("appears no log file was generated")
+		log.WithField("plan", c.name).Debug("appears no log file was generated")
 	} else {
-		err = sh.Command("mv", mlog, c.planDir).Run()
+		err = moveFile(mlog, filepath.Join(c.planDir, filepath.Base(mlog)))
 		if err != nil {
 			return res, errors.Wrapf(err, "moving file from %v to %v failed", mlog, c.planDir)
 		}
 	}
 
 	if c.plan.Scheduler.Retention > 0 {
-		err = applyRetention(c.planDir, c.plan.Scheduler.Retention)
+		err = retain(ctx, c)
 		if err != nil {
 			return res, errors.Wrap(err, "retention job failed")
 		}
 	}
 
-	file := filepath.Join(c.planDir, res.Name)
-
-	if c.plan.Encryption != nil {
-		encryptedFile := fmt.Sprintf("%v.encrypted", file)
-		output, err := encrypt(file, encryptedFile, c.plan, c.conf)
-		if err != nil {
-			return res, err
-		} else {
-			removeUnencrypted(file, encryptedFile)
-			file = encryptedFile
-			log.WithField("plan", c.name).Infof("Encryption finished %v", output)
-		}
-	}
-
-	if c.plan.SFTP != nil {
-		sftpOutput, err := sftpUpload(file, c.plan)
-		if err != nil {
-			return res, err
-		} else {
-			log.WithField("plan", c.name).Info(sftpOutput)
-		}
-	}
-
-	if c.plan.S3 != nil {
-		s3Output, err := s3Upload(file, c.plan, c.ts, c.conf.UseAwsCli)
+	atomic.AddInt32(&uploading, 1)
+	for _, file := range res.Files {
+		u, err := upload(ctx, c, routed, file)
 		if err != nil {
+			atomic.AddInt32(&uploading, -1)
 			return res, err
-		} else {
-			log.WithField("plan", c.name).Infof("S3 upload finished %v", s3Output)
 		}
+		res.Uploads = append(res.Uploads, u)
 	}
+	atomic.AddInt32(&uploading, -1)
 
-	if c.plan.GCloud != nil {
-		gCloudOutput, err := gCloudUpload(file, c.plan)
-		if err != nil {
+	if c.plan.Standby != nil {
+		if err := seedStandby(ctx, c, out.Files[0]); err != nil {
 			return res, err
-		} else {
-			log.WithField("plan", c.name).Infof("GCloud upload finished %v", gCloudOutput)
 		}
 	}
 
-	if c.plan.Azure != nil {
-		azureOutput, err := azureUpload(file, c.plan)
-		if err != nil {
-			return res, err
-		} else {
-			log.WithField("plan", c.name).Infof("Azure upload finished %v", azureOutput)
-		}
-	}
-
-	if c.plan.Rclone != nil {
-		rcloneOutput, err := rcloneUpload(file, c.plan)
-		if err != nil {
-			return res, err
-		} else {
-			log.WithField("plan", c.name).Infof("Rclone upload finished %v", rcloneOutput)
-		}
-	}
-
-	t2 := time.Now()
 	res.Status = 200
-	res.Duration = t2.Sub(c.ts)
+	res.Duration = clock.Since(c.ts)
 	log.WithFields(log.Fields{
 		"plan":     c.name,
 		"size":     humanize.Bytes(uint64(res.Size)),
@@ -247,3 +526,46 @@ func runDumpAndUpload(c *dumpConfig) (Result, error) {
 	}).Infof("dump succeeded")
 	return res, nil
 }
+
+// upload copies file to the destinations of the routed plan and returns the remote ones.
+// With the probe breaker on, the destinations found down are skipped and returned as
+// pending, as are the ones whose upload fails.
+func upload(ctx context.Context, c *dumpConfig, routed RoutedPlan, file string) (Upload, error) {
+	u := Upload{File: file, Route: routed.Route, Destinations: make([]string, 0)}
+	ctx = withStage(ctx, UsageUpload)
+	defer recordPhase(ctx, PhaseUpload, clock.Now())
+	breaker := c.plan.Probe != nil && c.plan.Probe.Breaker
+	for _, d := range Destinations(routed.Plan, c.conf, c.ts) {
+		_, local := d.(*localDestination)
+		if breaker && !local && !DestinationUp(c.plan.Name, routed.Route, d.Name()) {
+			log.WithField("plan", c.name).Warnf("%v is down, %v queued for upload", d.Name(), filepath.Base(file))
+			u.Pending = append(u.Pending, d.Name())
+			recordUpload(ctx, d.Name(), routed.Route, file, UploadPending, 0, nil)
+			continue
+		}
+		uctx, cancel := withTimeout(ctx, c.plan.Scheduler.UploadTimeout())
+		start := clock.Now()
+		output, err := d.Upload(uctx, file)
+		cancel()
+		if err != nil {
+			if !breaker || local || ctx.Err() != nil {
+				recordUpload(ctx, d.Name(), routed.Route, file, UploadFailed, clock.Since(start), err)
+				return u, err
+			}
+			SetDestinationUp(c.plan.Name, routed.Route, d.Name(), false)
+			log.WithField("plan", c.name).Warnf("%v upload failed, %v queued for upload: %v", d.Name(), filepath.Base(file), err)
+			u.Pending = append(u.Pending, d.Name())
+			recordUpload(ctx, d.Name(), routed.Route, file, UploadPending, clock.Since(start), err)
+			continue
+		}
+		recordUpload(ctx, d.Name(), routed.Route, file, UploadUploaded, clock.Since(start), nil)
+		log.WithField("plan", c.name).Infof("%v upload finished %v", d.Name(), output)
+		if !local {
+			u.Destinations = append(u.Destinations, d.Name())
+			if size, err := fileSize(file); err == nil {
+				addNet(ctx, size)
+			}
+		}
+	}
+	return u, nil
+}
@@ -0,0 +1,34 @@
+package backup
+
+import (
+	"sync"
+)
+
+// breaker holds the destinations the last probe found down, by plan, route and name.
+var breaker = struct {
+	sync.Mutex
+	down map[string]bool
+}{down: make(map[string]bool)}
+
+func breakerKey(plan string, route string, destination string) string {
+	return plan + "\x00" + route + "\x00" + destination
+}
+
+// SetDestinationUp records the outcome of a probe of a destination of plan.
+func SetDestinationUp(plan string, route string, destination string, up bool) {
+	breaker.Lock()
+	defer breaker.Unlock()
+	if up {
+		delete(breaker.down, breakerKey(plan, route, destination))
+	} else {
+		breaker.down[breakerKey(plan, route, destination)] = true
+	}
+}
+
+// DestinationUp is false when the last probe of the destination failed,
+// destinations never probed are up.
+func DestinationUp(plan string, route string, destination string) bool {
+	breaker.Lock()
+	defer breaker.Unlock()
+	return !breaker.down[breakerKey(plan, route, destination)]
+}
@@ -0,0 +1,31 @@
+package backup
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+)
+
+// A chain is a full backup followed by incremental segments that can only be
+// restored on top of it. Segments are named after the full's prefix
+// (<name>-<unix ts>) so retention keeps or removes a chain as a whole.
+
+var segmentName = regexp.MustCompile(`^(.+-\d+)\.inc(\d+)\.`)
+
+// SegmentName returns the file name of the seq-th incremental segment of chain.
+func SegmentName(chain string, seq int, ext string) string {
+	return fmt.Sprintf("%v.inc%06d%v", chain, seq, ext)
+}
+
+// ParseSegment returns the chain and sequence number of an incremental segment file name.
+func ParseSegment(name string) (string, int, bool) {
+	m := segmentName.FindStringSubmatch(name)
+	if m == nil {
+		return "", 0, false
+	}
+	seq, err := strconv.Atoi(m[2])
+	if err != nil {
+		return "", 0, false
+	}
+	return m[1], seq, true
+}
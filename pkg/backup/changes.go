@@ -0,0 +1,111 @@
+package backup
+
+import (
+	"context"
+	"strings"
+
+	"github.com/pkg/errors"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"github.com/stefanprodan/mgob/pkg/config"
+)
+
+// CheckTrigger validates the change stream trigger of plan.
+func CheckTrigger(plan config.Plan) error {
+	t := plan.Trigger
+	if t.Collection == "" && t.Writes == 0 && !t.SkipIdle {
+		return errors.New("trigger requires a collection, writes or skipIdle")
+	}
+	if t.Collection != "" {
+		if i := strings.Index(t.Collection, "."); i < 1 || i == len(t.Collection)-1 {
+			return errors.Errorf("invalid trigger collection %v, use database.collection", t.Collection)
+		}
+	}
+	if t.Writes < 0 || t.MinInterval < 0 {
+		return errors.New("trigger writes and minInterval can't be negative")
+	}
+	if plan.Target.Uri == "" {
+		return errors.New("trigger requires a target uri")
+	}
+	if plan.Agent != "" {
+		return errors.New("trigger can't watch the target of an agent")
+	}
+	return nil
+}
+
+// changeEvent is the part of a change stream event the trigger reads.
+type changeEvent struct {
+	NS struct {
+		DB   string `bson:"db"`
+		Coll string `bson:"coll"`
+	} `bson:"ns"`
+}
+
+// WatchChanges opens the change stream of the trigger of plan, after token
+// when set, calls opened once it's open and fn with each write, marker set
+// for the writes to the trigger collection. It returns when ctx is done or
+// the stream fails, with the resume token of the last write seen. Only the
+// marker collection is watched unless writes are counted.
+func WatchChanges(ctx context.Context, plan config.Plan, token bson.Raw, opened func(), fn func(marker bool)) (bson.Raw, error) {
+	t := plan.Trigger
+	client, err := mongo.Connect(ctx, options.Client().ApplyURI(plan.Target.Uri))
+	if err != nil {
+		return token, errors.Wrapf(err, "failed to connect to MongoDB %s", redactUri(plan.Target.Uri))
+	}
+	defer client.Disconnect(context.Background())
+
+	pipeline := mongo.Pipeline{{{Key: "$match", Value: bson.D{{Key: "operationType", Value: bson.D{
+		{Key: "$in", Value: bson.A{"insert", "update", "replace", "delete"}},
+	}}}}}}
+	opts := options.ChangeStream()
+	if token != nil {
+		opts.SetResumeAfter(token)
+	}
+	var markerDB, markerColl string
+	if t.Collection != "" {
+		i := strings.Index(t.Collection, ".")
+		markerDB, markerColl = t.Collection[:i], t.Collection[i+1:]
+	}
+
+	var stream *mongo.ChangeStream
+	switch {
+	case t.Writes == 0 && !t.SkipIdle:
+		stream, err = client.Database(markerDB).Collection(markerColl).Watch(ctx, pipeline, opts)
+	case plan.Target.Database != "" && (markerDB == "" || markerDB == plan.Target.Database):
+		stream, err = client.Database(plan.Target.Database).Watch(ctx, pipeline, opts)
+	default:
+		stream, err = client.Watch(ctx, pipeline, opts)
+	}
+	if err != nil {
+		return token, errors.Wrap(err, "opening the change stream failed")
+	}
+	defer stream.Close(context.Background())
+	opened()
+
+	for stream.Next(ctx) {
+		var e changeEvent
+		if err := stream.Decode(&e); err != nil {
+			return token, errors.Wrap(err, "decoding the change event failed")
+		}
+		token = stream.ResumeToken()
+		marker := e.NS.DB == markerDB && e.NS.Coll == markerColl
+		if !marker && !dumpsDatabase(plan.Target, e.NS.DB) {
+			continue
+		}
+		fn(marker)
+	}
+	if ctx.Err() != nil {
+		return token, ctx.Err()
+	}
+	return token, errors.Wrap(stream.Err(), "change stream failed")
+}
+
+// dumpsDatabase tells if the writes to dbName are in the dumps of target.
+func dumpsDatabase(target config.Target, dbName string) bool {
+	if target.Database != "" {
+		return target.Database == dbName
+	}
+	return !skipDatabase(target, dbName)
+}
@@ -1,99 +1,67 @@
 package backup
 
 import (
+	"os/exec"
 	"strings"
 
-	"github.com/codeskyblue/go-sh"
 	"github.com/pkg/errors"
+
+	"github.com/stefanprodan/mgob/pkg/command"
 )
 
 func CheckMongodump() (string, error) {
-	output, err := sh.Command("/bin/sh", "-c", "mongodump --version").CombinedOutput()
-	if err != nil {
-		ex := ""
-		if len(output) > 0 {
-			ex = strings.Replace(string(output), "\n", " ", -1)
-		}
-		return "", errors.Wrapf(err, "mongodump failed %v", ex)
-	}
-
-	return strings.Replace(string(output), "\n", " ", -1), nil
+	return checkVersion("mongodump", "", "--version")
 }
 
 func CheckMinioClient() (string, error) {
-	output, err := sh.Command("/bin/sh", "-c", "mc version").CombinedOutput()
-	if err != nil {
-		ex := ""
-		if len(output) > 0 {
-			ex = strings.Replace(string(output), "\n", " ", -1)
-		}
-		return "", errors.Wrapf(err, "mc failed %v", ex)
-	}
-
-	return strings.Replace(string(output), "\n", " ", -1), nil
+	return checkVersion("mc", "", "version")
 }
 
 func CheckAWSClient() (string, error) {
-	output, err := sh.Command("/bin/sh", "-c", "aws --version").CombinedOutput()
-	if err != nil {
-		ex := ""
-		if len(output) > 0 {
-			ex = strings.Replace(string(output), "\n", " ", -1)
-		}
-		return "", errors.Wrapf(err, "aws failed %v", ex)
-	}
-
-	return strings.Replace(string(output), "\n", " ", -1), nil
+	return checkVersion("aws", "", "--version")
 }
 
 func CheckGpg() (string, error) {
-	output, err := sh.Command("/bin/sh", "-c", "gpg --version").CombinedOutput()
-	if err != nil {
-		ex := ""
-		if len(output) > 0 {
-			ex = strings.Replace(string(output), "\n", " ", -1)
-		}
-		return "", errors.Wrapf(err, "gpg failed %v", ex)
-	}
-
-	return strings.Replace(string(output), "\n", " ", -1), nil
+	return checkVersion("gpg", "", "--version")
 }
 
 func CheckGCloudClient() (string, error) {
-	output, err := sh.Command("/bin/sh", "-c", "gcloud --version").CombinedOutput()
-	if err != nil {
-		ex := ""
-		if len(output) > 0 {
-			ex = strings.Replace(string(output), "\n", " ", -1)
-		}
-		return "", errors.Wrapf(err, "gcloud failed %v", ex)
-	}
-
-	return strings.Replace(string(output), "\n", " ", -1), nil
+	return checkVersion("gcloud", "", "--version")
 }
 
 func CheckAzureClient() (string, error) {
-	output, err := sh.Command("/bin/sh", "-c", "az --version | grep 'azure-cli'").CombinedOutput()
-	if err != nil {
-		ex := ""
-		if len(output) > 0 {
-			ex = strings.Replace(string(output), "\n", " ", -1)
-		}
-		return "", errors.Wrapf(err, "az failed %v", ex)
-	}
-
-	return strings.Replace(string(output), "\n", " ", -1), nil
+	return checkVersion("az", "azure-cli", "--version")
 }
 
 func CheckRCloneClient() (string, error) {
-	output, err := sh.Command("/bin/sh", "-c", "rclone version | grep 'rclone'").CombinedOutput()
+	return checkVersion("rclone", "rclone", "version")
+}
+
+// checkVersion runs the version command of a tool, when filter is set
+// only the output lines containing it are returned.
+func checkVersion(name string, filter string, args ...string) (string, error) {
+	output, err := command.CombinedOutput(exec.Command(name, args...))
 	if err != nil {
 		ex := ""
 		if len(output) > 0 {
 			ex = strings.Replace(string(output), "\n", " ", -1)
 		}
-		return "", errors.Wrapf(err, "rclone failed %v", ex)
+		return "", errors.Wrapf(err, "%v failed %v", name, ex)
+	}
+
+	lines := strings.Split(string(output), "\n")
+	if filter != "" {
+		matched := make([]string, 0)
+		for _, line := range lines {
+			if strings.Contains(line, filter) {
+				matched = append(matched, line)
+			}
+		}
+		if len(matched) == 0 {
+			return "", errors.Errorf("%v failed, no %v in %v", name, filter, strings.Join(lines, " "))
+		}
+		lines = matched
 	}
 
-	return strings.Replace(string(output), "\n", " ", -1), nil
+	return strings.Join(lines, " "), nil
 }
@@ -0,0 +1,63 @@
+package backup
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"hash"
+	"io"
+
+	"github.com/pkg/errors"
+
+	"github.com/stefanprodan/mgob/pkg/config"
+)
+
+func init() {
+	RegisterStage(config.StageChecksum, newChecksumStage)
+}
+
+type checksumStage struct {
+	algorithm string
+	hash      hash.Hash
+}
+
+func newChecksumStage(ctx context.Context, s config.Stage, plan config.Plan, conf *config.AppConfig) (Stage, error) {
+	switch s.Algorithm {
+	case "", "sha256":
+		return &checksumStage{algorithm: "sha256", hash: sha256.New()}, nil
+	case "md5":
+		return &checksumStage{algorithm: "md5", hash: md5.New()}, nil
+	default:
+		return nil, errors.Errorf("unsupported checksum algorithm '%s'", s.Algorithm)
+	}
+}
+
+func (s *checksumStage) Name() string {
+	return "checksum/" + s.algorithm
+}
+
+func (s *checksumStage) Ext() string {
+	return ""
+}
+
+func (s *checksumStage) Wrap(ctx context.Context, w io.Writer) (io.WriteCloser, error) {
+	s.hash.Reset()
+	return nopCloser{io.MultiWriter(s.hash, w)}, nil
+}
+
+func (s *checksumStage) Algorithm() string {
+	return s.algorithm
+}
+
+func (s *checksumStage) Sum() string {
+	return hex.EncodeToString(s.hash.Sum(nil))
+}
+
+type nopCloser struct {
+	io.Writer
+}
+
+func (nopCloser) Close() error {
+	return nil
+}
@@ -0,0 +1,64 @@
+package backup
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+
+	"github.com/stefanprodan/mgob/pkg/restore"
+)
+
+// runCollections runs each file of the mongodump directory dir through the
+// pipeline into the plan dir as <plan>-<ts>.collections.<db>.<file> and
+// writes the index mapping them back to the directory layout. The index
+// follows the files so the uploads of a backup finish with it.
+func runCollections(ctx context.Context, c *dumpConfig, p *pipeline, dir string) (pipelineResult, error) {
+	prefix := fmt.Sprintf("%v-%v", c.name, c.ts.Unix())
+	res := pipelineResult{Name: prefix + restore.CollectionsExt}
+	idx := restore.Collections{Files: make([]restore.CollectionFile, 0)}
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		src := filepath.Join(c.tmpPath, prefix+".collections."+strings.Replace(rel, "/", ".", -1))
+		if err := moveFile(path, src); err != nil {
+			return errors.Wrapf(err, "moving %v failed", path)
+		}
+		out, err := p.run(ctx, src, c.planDir)
+		if err != nil {
+			os.Remove(src)
+			return err
+		}
+		res.Files = append(res.Files, out.Files...)
+		res.Size += out.Size
+		idx.Files = append(idx.Files, restore.CollectionFile{Path: rel, File: filepath.Base(out.Files[0]), Size: out.Size})
+		return nil
+	})
+	os.RemoveAll(dir)
+	if err != nil {
+		return res, err
+	}
+
+	data, err := json.MarshalIndent(idx, "", "  ")
+	if err != nil {
+		return res, errors.Wrap(err, "encoding collections index failed")
+	}
+	index := filepath.Join(c.planDir, res.Name)
+	if err := ioutil.WriteFile(index, data, 0644); err != nil {
+		return res, errors.Wrapf(err, "writing collections index %v failed", index)
+	}
+	res.Files = append(res.Files, index)
+	res.Size += int64(len(data))
+	return res, nil
+}
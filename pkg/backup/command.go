@@ -0,0 +1,60 @@
+package backup
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// dumpExec runs the plan command and archives the artifact it reports like a
+// watched dump. The artifact is removed once copied to the tmp dir.
+func dumpExec(ctx context.Context, c *dumpConfig, compress bool) (string, string, error) {
+	if c.plan.Exec == nil || c.plan.Exec.Command.Empty() {
+		return "", "", errors.Errorf("'%s' backup mode requires an exec command", c.plan.Mode)
+	}
+
+	dctx, cancel := withTimeout(ctx, c.plan.Scheduler.DumpTimeout())
+	defer cancel()
+
+	var stdout, stderr bytes.Buffer
+	cmd := userCommand(c.plan.Exec.Command)
+	cmd.Env = append(os.Environ(),
+		"MGOB_PLAN="+c.plan.Name,
+		"MGOB_TMP_PATH="+c.tmpPath,
+		fmt.Sprintf("MGOB_TIMESTAMP=%v", c.ts.Unix()),
+	)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	log.WithField("plan", c.name).Debugf("exec cmd: %v", c.plan.Exec.Command)
+	p, err := startProcess(dctx, cmd)
+	if err == nil {
+		err = p.Wait()
+	}
+	if err != nil {
+		return "", "", errors.Wrapf(err, "exec log %v", strings.Replace(stderr.String(), "\n", " ", -1))
+	}
+
+	lines := strings.Split(strings.TrimSpace(stdout.String()), "\n")
+	artifact := strings.TrimSpace(lines[len(lines)-1])
+	if artifact == "" {
+		return "", "", errors.New("exec command printed no artifact path")
+	}
+
+	sc := *c
+	sc.source = artifact
+	archive, mlog, err := dumpSource(dctx, &sc, compress)
+	if err != nil {
+		return "", "", err
+	}
+	if err := os.RemoveAll(artifact); err != nil {
+		log.WithField("plan", c.name).Warnf("Removing %v failed %v", artifact, err)
+	}
+	logToFile(mlog, append(stdout.Bytes(), stderr.Bytes()...))
+
+	return archive, mlog, nil
+}
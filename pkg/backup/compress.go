@@ -0,0 +1,110 @@
+package backup
+
+import (
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"os/exec"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/pkg/errors"
+
+	"github.com/stefanprodan/mgob/pkg/config"
+)
+
+func init() {
+	RegisterStage(config.StageCompress, newCompressStage)
+}
+
+type compressStage struct {
+	plan      string
+	algorithm string
+	level     int
+	// threads > 1 runs gzip through pigz
+	threads int
+}
+
+func newCompressStage(ctx context.Context, s config.Stage, plan config.Plan, conf *config.AppConfig) (Stage, error) {
+	switch s.Algorithm {
+	case "", "gzip":
+		level := s.Level
+		if level == 0 {
+			level = gzip.DefaultCompression
+		}
+		if level < gzip.HuffmanOnly || level > gzip.BestCompression {
+			return nil, errors.Errorf("invalid gzip level %v", s.Level)
+		}
+		if s.Threads > 1 && level < gzip.NoCompression {
+			// pigz has no huffman only mode, -1 is the zlib default
+			if level == gzip.HuffmanOnly {
+				return nil, errors.Errorf("gzip level %v isn't supported with threads", s.Level)
+			}
+			level = 6
+		}
+		return &compressStage{plan: plan.Name, algorithm: "gzip", level: level, threads: s.Threads}, nil
+	case "zstd":
+		level := s.Level
+		if level == 0 {
+			level = 3
+		}
+		if level < 1 || level > 22 {
+			return nil, errors.Errorf("invalid zstd level %v", s.Level)
+		}
+		return &compressStage{plan: plan.Name, algorithm: "zstd", level: level}, nil
+	case "lz4":
+		level := s.Level
+		if level == 0 {
+			level = 1
+		}
+		if level < 1 || level > 12 {
+			return nil, errors.Errorf("invalid lz4 level %v", s.Level)
+		}
+		return &compressStage{plan: plan.Name, algorithm: "lz4", level: level}, nil
+	default:
+		return nil, errors.Errorf("unsupported compression algorithm '%s'", s.Algorithm)
+	}
+}
+
+func (s *compressStage) Name() string {
+	return "compress/" + s.algorithm
+}
+
+func (s *compressStage) Ext() string {
+	switch s.algorithm {
+	case "zstd":
+		return ".zst"
+	case "lz4":
+		return ".lz4"
+	default:
+		return ".gz"
+	}
+}
+
+func (s *compressStage) Wrap(ctx context.Context, w io.Writer) (io.WriteCloser, error) {
+	switch s.algorithm {
+	case "zstd":
+		return zstd.NewWriter(w, zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(s.level)))
+	case "lz4":
+		// lz4 runs through its CLI, like gpg
+		cmd := exec.Command("lz4", fmt.Sprintf("-%v", s.level), "-c")
+		return startPipe(ctx, cmd, w, fmt.Sprintf("Compression for plan %v failed", s.plan))
+	default:
+		if s.threads > 1 {
+			cmd := exec.Command("pigz", fmt.Sprintf("-%v", s.level), "-p", fmt.Sprint(s.threads), "-c")
+			return startPipe(ctx, cmd, w, fmt.Sprintf("Compression for plan %v failed", s.plan))
+		}
+		return gzip.NewWriterLevel(w, s.level)
+	}
+}
+
+// compressionStage returns the compress stage of the plan compression config,
+// nil for none.
+func compressionStage(ctx context.Context, plan config.Plan, conf *config.AppConfig) (Stage, error) {
+	c := plan.Compression
+	if c.Type == "none" {
+		return nil, nil
+	}
+	return newCompressStage(ctx, config.Stage{Type: config.StageCompress, Algorithm: c.Type, Level: c.Level, Threads: c.Threads},
+		plan, conf)
+}
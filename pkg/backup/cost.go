@@ -0,0 +1,134 @@
+package backup
+
+import (
+	"io/ioutil"
+	"math"
+	"os"
+	"sort"
+
+	"github.com/pkg/errors"
+
+	"github.com/stefanprodan/mgob/pkg/clock"
+	"github.com/stefanprodan/mgob/pkg/config"
+)
+
+// CostEstimate is the projected monthly storage cost of a plan under its
+// retention. Every destination is assumed to keep the backups the retention
+// keeps, route destinations the whole backup.
+type CostEstimate struct {
+	Plan      string `json:"plan"`
+	Retention int    `json:"retention"`
+	// Backups is the number of backups kept, of each database or shard in the database and sharded modes
+	Backups int `json:"backups"`
+	// Size is the average size of a stored backup
+	Size int64 `json:"size"`
+	// Stored is the size kept at each destination
+	Stored       int64             `json:"stored"`
+	Destinations []DestinationCost `json:"destinations"`
+	// Unpriced lists the destinations the pricing has no price of
+	Unpriced   []string `json:"unpriced,omitempty"`
+	Monthly    float64  `json:"monthly"`
+	Budget     float64  `json:"budget,omitempty"`
+	OverBudget bool     `json:"overBudget"`
+	// Unbounded is set when the plan has no retention, the cost grows with every run
+	Unbounded bool `json:"unbounded,omitempty"`
+}
+
+// DestinationCost is the monthly cost of the backups kept at a destination.
+type DestinationCost struct {
+	Destination  string  `json:"destination"`
+	Route        string  `json:"route,omitempty"`
+	StorageClass string  `json:"storageClass,omitempty"`
+	Price        float64 `json:"price"`
+	Monthly      float64 `json:"monthly"`
+}
+
+// EstimateCost projects the monthly storage cost of plan from the average
+// size of the backups in its plan dir and the configured pricing. A plan
+// without stored backups is estimated at 0.
+func EstimateCost(plan config.Plan, conf *config.AppConfig) (*CostEstimate, error) {
+	if conf.Pricing == nil {
+		return nil, errors.New("no pricing configured")
+	}
+	est := &CostEstimate{
+		Plan:         plan.Name,
+		Retention:    plan.Scheduler.Retention,
+		Budget:       plan.Budget,
+		Destinations: make([]DestinationCost, 0),
+		Unbounded:    plan.Scheduler.Retention <= 0,
+	}
+
+	dir := config.PlanDir(conf.StoragePath, plan)
+	files, err := ioutil.ReadDir(dir)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, errors.Wrapf(err, "reading %v failed", dir)
+	}
+	sizes := make(map[string]int64, len(files))
+	for _, f := range files {
+		sizes[f.Name()] = f.Size()
+	}
+	for name := range retentionNames(plan, files) {
+		backups, stamps := retentionGroups(files, name)
+		if len(stamps) == 0 {
+			continue
+		}
+		var total int64
+		for _, stamp := range stamps {
+			for _, f := range backups[stamp] {
+				total += sizes[f]
+			}
+		}
+		// without retention the stored backups are the estimate
+		kept := plan.Scheduler.Retention
+		if kept <= 0 {
+			kept = len(stamps)
+		}
+		est.Backups += kept
+		est.Stored += total / int64(len(stamps)) * int64(kept)
+	}
+	if est.Backups > 0 {
+		est.Size = est.Stored / int64(est.Backups)
+	}
+
+	gb := float64(est.Stored) / (1 << 30)
+	now := clock.Now()
+	unpriced := map[string]bool{}
+	for _, routed := range RoutedPlans(plan) {
+		// the local copy is priced once
+		dests := Destinations(routed.Plan, conf, now)
+		if routed.Route != "" {
+			dests = RemoteDestinations(routed.Plan, conf, now)
+		}
+		for _, d := range dests {
+			class := ""
+			if d.Name() == "S3" && routed.Plan.S3 != nil {
+				class = routed.Plan.S3.StorageClass
+			}
+			price, ok := conf.Pricing.Price(d.Name(), class)
+			if !ok {
+				unpriced[d.Name()] = true
+				continue
+			}
+			cost := DestinationCost{
+				Destination:  d.Name(),
+				Route:        routed.Route,
+				StorageClass: class,
+				Price:        price,
+				Monthly:      roundCents(gb * price),
+			}
+			est.Destinations = append(est.Destinations, cost)
+			est.Monthly += cost.Monthly
+		}
+	}
+	for name := range unpriced {
+		est.Unpriced = append(est.Unpriced, name)
+	}
+	sort.Strings(est.Unpriced)
+	est.Monthly = roundCents(est.Monthly)
+	est.OverBudget = est.Budget > 0 && est.Monthly > est.Budget
+	return est, nil
+}
+
+func roundCents(v float64) float64 {
+	return math.Round(v*100) / 100
+}
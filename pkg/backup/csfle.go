@@ -0,0 +1,181 @@
+package backup
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"github.com/stefanprodan/mgob/pkg/config"
+)
+
+// kmipDialTimeout bounds the TLS handshake with the KMIP server.
+const kmipDialTimeout = 10 * time.Second
+
+// kmsProviders are the KMS providers a data key can be wrapped with.
+var kmsProviders = map[string]bool{"local": true, "aws": true, "azure": true, "gcp": true, "kmip": true}
+
+// kmsType is the type of a provider, the named providers of MongoDB 7 are type:name.
+func kmsType(provider string) string {
+	if i := strings.Index(provider, ":"); i >= 0 {
+		return provider[:i]
+	}
+	return provider
+}
+
+// queryableState is the prefix of the state collections of the queryable
+// encryption collections, the restored collections can't be queried without them.
+const queryableState = "enxcol_."
+
+// checkFieldEncryption validates the key vault and KMS providers of the target and
+// rejects the options that lose the encrypted fields or the encryptedFields
+// options of the queryable encryption collections.
+func checkFieldEncryption(plan config.Plan) error {
+	e := plan.Target.FieldEncryption
+	if e == nil {
+		return nil
+	}
+	kvDB, kvColl := e.KeyVault()
+	if kvDB == "" || kvColl == "" {
+		return errors.Errorf("invalid keyVaultNamespace %v, use database.collection", e.KeyVaultNamespace)
+	}
+	for _, p := range e.Providers {
+		if !kmsProviders[kmsType(p)] {
+			return errors.Errorf("unknown KMS provider %v, use local, aws, azure, gcp or kmip", p)
+		}
+	}
+	if k := e.KMIP; k != nil && (k.Endpoint == "" || k.CertificateKeyFile == "") {
+		return errors.New("fieldEncryption.kmip requires an endpoint and a certificateKeyFile")
+	}
+	switch {
+	case plan.Mode == config.BackupModeExport:
+		return errors.New("mongoexport drops the encryptedFields of the collections, fieldEncryption can't be used with export mode")
+	case plan.Transform != nil:
+		return errors.New("encrypted fields can't be transformed, fieldEncryption can't be used with transform")
+	}
+	for _, excluded := range plan.Target.ExcludeDatabases {
+		if matchName(excluded, kvDB) {
+			return errors.Errorf("the key vault database %v can't be excluded", kvDB)
+		}
+	}
+	for _, excluded := range plan.Target.ExcludeCollections {
+		if strings.HasPrefix(excluded, queryableState) {
+			return errors.Errorf("the queryable encryption state collection %v can't be excluded", excluded)
+		}
+		if plan.Target.Database == kvDB && matchName(excluded, kvColl) {
+			return errors.Errorf("the key vault collection %v can't be excluded", kvColl)
+		}
+	}
+	params := plan.Target.Params
+	if plan.Restore != nil {
+		params += " " + plan.Restore.Params
+		for _, ns := range plan.Restore.Namespaces {
+			if strings.HasPrefix(ns.From, kvDB+".") {
+				return errors.Errorf("the key vault %v.%v can't be renamed, the clients find the data keys by its namespace", kvDB, kvColl)
+			}
+		}
+	}
+	if plan.Migrate != nil {
+		params += " " + plan.Migrate.Params
+	}
+	for _, p := range config.SplitParams(params) {
+		if p == "--noOptionsRestore" {
+			return errors.New("--noOptionsRestore drops the encryptedFields of the queryable encryption collections")
+		}
+	}
+	return nil
+}
+
+// checkKeyVault checks the data keys of the key vault before the dump: the
+// providers they are wrapped with must be configured and the KMIP server
+// reachable, a backup whose keys can't be unwrapped restores unreadable fields.
+func checkKeyVault(ctx context.Context, c *dumpConfig) error {
+	e := c.plan.Target.FieldEncryption
+	kvDB, kvColl := e.KeyVault()
+	uri := c.plan.Target.Uri
+	kctx, cancel := context.WithTimeout(ctx, mongodbDatabaseListTimeout)
+	defer cancel()
+	client, err := mongo.Connect(kctx, options.Client().ApplyURI(uri).SetReadPreference(targetReadPref(uri)))
+	if err != nil {
+		return errors.Wrapf(err, "failed to connect to MongoDB %s", redactUri(uri))
+	}
+	defer client.Disconnect(context.Background())
+
+	values, err := client.Database(kvDB).Collection(kvColl).Distinct(kctx, "masterKey.provider", bson.D{})
+	if err != nil {
+		return errors.Wrapf(err, "reading the key vault %v.%v failed", kvDB, kvColl)
+	}
+	providers := make([]string, 0, len(values))
+	for _, v := range values {
+		providers = append(providers, fmt.Sprint(v))
+	}
+	sort.Strings(providers)
+	if len(providers) == 0 {
+		log.WithField("plan", c.name).Warnf("Key vault %v.%v has no data keys", kvDB, kvColl)
+	}
+	if len(e.Providers) > 0 {
+		for _, p := range providers {
+			if !hasProvider(e.Providers, p) {
+				return errors.Errorf("data keys of the key vault %v.%v are wrapped with the %v KMS provider, it isn't in fieldEncryption.providers", kvDB, kvColl, p)
+			}
+		}
+	}
+	if t := c.plan.Target; (t.Database != "" && t.Database != kvDB) || t.Collection != "" {
+		log.WithField("plan", c.name).Warnf("Key vault %v.%v isn't in the dump of %v, back it up with another plan", kvDB, kvColl, t.Database)
+	}
+	if e.KMIP != nil {
+		if err := dialKMIP(e.KMIP); err != nil {
+			return err
+		}
+	}
+	log.WithField("plan", c.name).Infof("Key vault %v.%v has data keys of %v", kvDB, kvColl, strings.Join(providers, ", "))
+	return nil
+}
+
+func hasProvider(providers []string, provider string) bool {
+	for _, p := range providers {
+		if p == provider || p == kmsType(provider) {
+			return true
+		}
+	}
+	return false
+}
+
+// dialKMIP completes a mutual TLS handshake with the KMIP server.
+func dialKMIP(k *config.KMIP) error {
+	cert, err := tls.LoadX509KeyPair(k.CertificateKeyFile, k.CertificateKeyFile)
+	if err != nil {
+		return errors.Wrapf(err, "loading the KMIP certificate %v failed", k.CertificateKeyFile)
+	}
+	cfg := &tls.Config{Certificates: []tls.Certificate{cert}}
+	if k.CAFile != "" {
+		pem, err := ioutil.ReadFile(k.CAFile)
+		if err != nil {
+			return errors.Wrapf(err, "reading the KMIP CA %v failed", k.CAFile)
+		}
+		cfg.RootCAs = x509.NewCertPool()
+		if !cfg.RootCAs.AppendCertsFromPEM(pem) {
+			return errors.Errorf("no certificate found in the KMIP CA %v", k.CAFile)
+		}
+	}
+	addr := k.Endpoint
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		addr = net.JoinHostPort(addr, "5696")
+	}
+	conn, err := tls.DialWithDialer(&net.Dialer{Timeout: kmipDialTimeout}, "tcp", addr, cfg)
+	if err != nil {
+		return errors.Wrapf(err, "KMIP server %v unreachable", addr)
+	}
+	return conn.Close()
+}
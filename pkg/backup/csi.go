@@ -0,0 +1,284 @@
+package backup
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/stefanprodan/mgob/pkg/clock"
+	"github.com/stefanprodan/mgob/pkg/config"
+	"github.com/stefanprodan/mgob/pkg/db"
+)
+
+// CSIRecordExt is the extension of the file recording a VolumeSnapshot in the plan dir.
+const CSIRecordExt = ".csi.json"
+
+const defaultCSITimeout = 10 * time.Minute
+
+// CSIPollInterval is the delay between two status checks of a VolumeSnapshot.
+var CSIPollInterval = 5 * time.Second
+
+var kubeNameChars = regexp.MustCompile(`[^a-z0-9-]+`)
+
+// CSIRecord is stored in the plan dir for each snapshot, the retention of the
+// records deletes the VolumeSnapshots.
+type CSIRecord struct {
+	db.VolumeSnapshot
+	Plan      string    `json:"plan"`
+	Timestamp time.Time `json:"timestamp"`
+	// Member is the secondary locked while the snapshot was cut
+	Member string `json:"member,omitempty"`
+}
+
+// volumeSnapshot is the part of the VolumeSnapshot status mgob reads.
+type volumeSnapshot struct {
+	Status struct {
+		BoundVolumeSnapshotContentName string `json:"boundVolumeSnapshotContentName"`
+		CreationTime                   string `json:"creationTime"`
+		ReadyToUse                     bool   `json:"readyToUse"`
+		RestoreSize                    string `json:"restoreSize"`
+		Error                          *struct {
+			Message string `json:"message"`
+		} `json:"error"`
+	} `json:"status"`
+}
+
+// checkCSI validates the plans of the csi mode, the snapshot stays in the
+// cluster so the plan can't have a pipeline.
+func checkCSI(plan config.Plan) error {
+	if plan.Mode != config.BackupModeCSI {
+		if plan.CSI != nil {
+			return errors.Errorf("csi requires '%s' backup mode", config.BackupModeCSI)
+		}
+		return nil
+	}
+	s := plan.CSI
+	t := plan.Target
+	switch {
+	case s == nil || s.Namespace == "" || s.PVC == "":
+		return errors.Errorf("'%s' backup mode requires a csi namespace and pvc", plan.Mode)
+	case s.Lock && t.Uri == "":
+		return errors.New("csi lock requires target.uri")
+	case s.Member != "" && !s.Lock:
+		return errors.New("csi member is the member locked, it requires lock")
+	case s.Timeout < 0:
+		return errors.New("csi timeout can't be negative")
+	case plan.Agent != "" || plan.Executor != nil:
+		return errors.Errorf("'%s' backup mode can't run on an agent or executor", plan.Mode)
+	case t.PointInTime || plan.PITR != nil:
+		return errors.Errorf("pointInTime and pitr can't be used with '%s' backup mode", plan.Mode)
+	case plan.Streaming || len(plan.Pipeline) > 0 || plan.Encryption != nil || plan.Compression != nil:
+		return errors.New("the VolumeSnapshot stays in the cluster, streaming, pipeline, encryption and compression can't be used")
+	case plan.Scan != nil || plan.Standby != nil:
+		return errors.New("scan and standby need a local archive, they can't be used with csi")
+	case t.Database != "" || t.Collection != "" || len(t.IncludeDatabases) != 0 || len(t.ExcludeDatabases) != 0:
+		return errors.Errorf("'%s' backup mode snapshots the whole volume, it can't select databases or collections", plan.Mode)
+	}
+	return nil
+}
+
+// runCSI creates a VolumeSnapshot of the data PVC, with the member locked
+// until the snapshot is cut when lock is on, waits for it to be ready and
+// records it in the plan dir. The record is uploaded to the plan destinations.
+func runCSI(ctx context.Context, c *dumpConfig) (Result, error) {
+	res := errRes(c)
+	s := c.plan.CSI
+	timeout := defaultCSITimeout
+	if s.Timeout > 0 {
+		timeout = time.Duration(s.Timeout) * time.Minute
+	}
+	wctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	rec := CSIRecord{Plan: c.name, Timestamp: c.ts.UTC()}
+	rec.Namespace = s.Namespace
+	rec.PVC = s.PVC
+	rec.Name = kubeNameChars.ReplaceAllString(strings.ToLower(fmt.Sprintf("%v-%v", c.name, c.ts.Unix())), "-")
+
+	unlock := func() {}
+	if s.Lock {
+		rec.Member = s.Member
+		if rec.Member == "" {
+			var err error
+			if rec.Member, err = secondaryMember(ctx, c.plan.Target.Uri); err != nil {
+				return res, err
+			}
+		}
+		var err error
+		if unlock, err = lockMember(wctx, c, rec.Member); err != nil {
+			return res, err
+		}
+	}
+	defer unlock()
+
+	manifest := map[string]interface{}{
+		"apiVersion": "snapshot.storage.k8s.io/v1",
+		"kind":       "VolumeSnapshot",
+		"metadata": map[string]interface{}{
+			"name":      rec.Name,
+			"namespace": s.Namespace,
+			"labels":    map[string]string{"mgob.plan": kubeNameChars.ReplaceAllString(strings.ToLower(c.plan.Name), "-")},
+		},
+		"spec": map[string]interface{}{
+			"source": map[string]string{"persistentVolumeClaimName": s.PVC},
+		},
+	}
+	if s.SnapshotClass != "" {
+		manifest["spec"].(map[string]interface{})["volumeSnapshotClassName"] = s.SnapshotClass
+	}
+	data, err := json.Marshal(manifest)
+	if err != nil {
+		return res, errors.Wrap(err, "encoding VolumeSnapshot failed")
+	}
+	if err := kubectl(wctx, s, data, nil, "create", "-f", "-"); err != nil {
+		return res, errors.Wrapf(err, "creating VolumeSnapshot %v/%v failed", s.Namespace, rec.Name)
+	}
+	log.WithField("plan", c.name).Infof("VolumeSnapshot %v/%v of %v created", s.Namespace, rec.Name, s.PVC)
+
+	// the volume is consistent once the snapshot is cut, the upload to the
+	// storage provider may go on after the unlock
+	var vs volumeSnapshot
+	for {
+		vs = volumeSnapshot{}
+		if err := kubectl(wctx, s, nil, &vs, "get", "volumesnapshot", rec.Name, "-n", s.Namespace, "-o", "json"); err != nil {
+			return res, err
+		}
+		if vs.Status.Error != nil && vs.Status.Error.Message != "" {
+			return res, errors.Errorf("VolumeSnapshot %v/%v failed %v", s.Namespace, rec.Name, vs.Status.Error.Message)
+		}
+		if vs.Status.CreationTime != "" {
+			unlock()
+		}
+		if vs.Status.ReadyToUse {
+			break
+		}
+		select {
+		case <-time.After(CSIPollInterval):
+		case <-wctx.Done():
+			return res, errors.Wrapf(wctx.Err(), "waiting for VolumeSnapshot %v/%v", s.Namespace, rec.Name)
+		}
+	}
+	rec.Content = vs.Status.BoundVolumeSnapshotContentName
+	rec.RestoreSize = vs.Status.RestoreSize
+	var content struct {
+		Status struct {
+			SnapshotHandle string `json:"snapshotHandle"`
+		} `json:"status"`
+	}
+	if err := kubectl(wctx, s, nil, &content, "get", "volumesnapshotcontent", rec.Content, "-o", "json"); err != nil {
+		return res, err
+	}
+	rec.Handle = content.Status.SnapshotHandle
+
+	if err := os.MkdirAll(c.planDir, 0755); err != nil {
+		return res, errors.Wrapf(err, "creating dir %v in %v failed", c.name, c.storagePath)
+	}
+	data, err = json.MarshalIndent(rec, "", "  ")
+	if err != nil {
+		return res, errors.Wrap(err, "encoding csi record failed")
+	}
+	res.Name = fmt.Sprintf("%v-%v%v", c.name, c.ts.Unix(), CSIRecordExt)
+	file := filepath.Join(c.planDir, res.Name)
+	if err := ioutil.WriteFile(file, data, 0644); err != nil {
+		return res, errors.Wrapf(err, "writing csi record %v failed", file)
+	}
+	snapshot := rec.VolumeSnapshot
+	res.VolumeSnapshot = &snapshot
+
+	if c.plan.Scheduler.Retention > 0 {
+		if err := expireCSI(ctx, c); err != nil {
+			return res, errors.Wrap(err, "retention job failed")
+		}
+		if err := retain(ctx, c); err != nil {
+			return res, errors.Wrap(err, "retention job failed")
+		}
+	}
+
+	u, err := upload(ctx, c, RoutedPlan{Plan: c.plan}, file)
+	if err != nil {
+		return res, err
+	}
+	res.Uploads = append(res.Uploads, u)
+	res.Files = []string{file}
+	res.Size = int64(len(data))
+	res.Chain = fmt.Sprintf("%v-%v", c.name, c.ts.Unix())
+	res.Status = 200
+	res.Duration = clock.Since(c.ts)
+	log.WithFields(log.Fields{
+		"plan":     c.name,
+		"snapshot": rec.Name,
+		"handle":   rec.Handle,
+		"duration": res.Duration.String(),
+	}).Infof("csi snapshot succeeded")
+	return res, nil
+}
+
+// expireCSI deletes the VolumeSnapshots of the records the retention removes.
+func expireCSI(ctx context.Context, c *dumpConfig) error {
+	files, err := ioutil.ReadDir(c.planDir)
+	if err != nil {
+		return errors.Wrapf(err, "reading %v failed", c.planDir)
+	}
+	backups, stamps := retentionGroups(files, c.name)
+	for i := c.plan.Scheduler.Retention; i < len(stamps); i++ {
+		for _, file := range backups[stamps[i]] {
+			if !strings.HasSuffix(file, CSIRecordExt) {
+				continue
+			}
+			data, err := ioutil.ReadFile(filepath.Join(c.planDir, file))
+			if err != nil {
+				return errors.Wrapf(err, "reading %v failed", file)
+			}
+			var rec CSIRecord
+			if err := json.Unmarshal(data, &rec); err != nil {
+				return errors.Wrapf(err, "parsing %v failed", file)
+			}
+			err = kubectl(ctx, c.plan.CSI, nil, nil, "delete", "volumesnapshot", rec.Name, "-n", rec.Namespace, "--ignore-not-found")
+			if err != nil {
+				return err
+			}
+			log.WithField("plan", c.name).Infof("VolumeSnapshot %v/%v deleted", rec.Namespace, rec.Name)
+		}
+	}
+	return nil
+}
+
+// kubectl runs kubectl with args, stdin when not nil, and decodes its json output into out.
+func kubectl(ctx context.Context, s *config.CSI, stdin []byte, out interface{}, args ...string) error {
+	bin := s.Kubectl
+	if bin == "" {
+		bin = "kubectl"
+	}
+	var stdout, stderr bytes.Buffer
+	cmd := exec.Command(bin, args...)
+	if stdin != nil {
+		cmd.Stdin = bytes.NewReader(stdin)
+	}
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	p, err := startProcess(ctx, cmd)
+	if err == nil {
+		err = p.Wait()
+	}
+	if err != nil {
+		return errors.Wrapf(err, "kubectl %v failed %v", args[0], strings.Replace(strings.TrimSpace(stderr.String()), "\n", " ", -1))
+	}
+	if out == nil {
+		return nil
+	}
+	if err := json.Unmarshal(stdout.Bytes(), out); err != nil {
+		return errors.Wrapf(err, "parsing kubectl %v output failed", args[0])
+	}
+	return nil
+}
@@ -0,0 +1,118 @@
+package backup
+
+import (
+	"context"
+	"strings"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"github.com/stefanprodan/mgob/pkg/config"
+)
+
+// checkDbHash validates the plans capturing collection hashes.
+func checkDbHash(plan config.Plan) error {
+	if !plan.Target.DbHash {
+		return nil
+	}
+	switch {
+	case plan.Target.Uri == "":
+		return errors.New("dbHash requires target.uri")
+	case plan.Agent != "":
+		return errors.New("dbHash can't be combined with an agent")
+	case plan.Mode != "" && plan.Mode != config.BackupModeSingle && plan.Mode != config.BackupModeDatabase:
+		return errors.Errorf("dbHash can't be used with '%s' backup mode", plan.Mode)
+	}
+	return nil
+}
+
+// captureHashes runs dbHash on the collections of the dumped databases, on the
+// member mongodump read from. It returns the md5 of each collection by database.
+func captureHashes(ctx context.Context, c *dumpConfig) (map[string]map[string]string, error) {
+	hctx, cancel := context.WithTimeout(ctx, mongodbDatabaseListTimeout)
+	defer cancel()
+	uri := c.plan.Target.Uri
+	client, err := mongo.Connect(hctx, options.Client().ApplyURI(uri).SetReadPreference(targetReadPref(uri)))
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to connect to MongoDB %s", redactUri(uri))
+	}
+	defer client.Disconnect(context.Background())
+
+	databases := []string{c.database}
+	if c.database == "" {
+		databases, err = UserDatabases(hctx, client)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	hashes := make(map[string]map[string]string)
+	for _, database := range databases {
+		names, err := client.Database(database).ListCollectionNames(hctx, bson.D{{Key: "type", Value: "collection"}})
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to list the collections of %v", database)
+		}
+		colls := make([]string, 0, len(names))
+		for _, name := range names {
+			if dumpsCollection(c.plan.Target, name) {
+				colls = append(colls, name)
+			}
+		}
+		if len(colls) == 0 {
+			continue
+		}
+		sums, err := DbHash(hctx, client, database, colls)
+		if err != nil {
+			return nil, err
+		}
+		hashes[database] = sums
+	}
+	log.WithField("plan", c.name).Debugf("dbHash captured for %v databases", len(hashes))
+	return hashes, nil
+}
+
+// dumpsCollection is false for the system collections and the ones the target excludes.
+func dumpsCollection(t config.Target, name string) bool {
+	if strings.HasPrefix(name, "system.") {
+		return false
+	}
+	if t.Collection != "" {
+		return name == t.Collection
+	}
+	for _, entry := range t.ExcludeCollections {
+		if matchName(entry, name) {
+			return false
+		}
+	}
+	return true
+}
+
+// DbHash returns the dbHash md5 of the collections of database.
+func DbHash(ctx context.Context, client *mongo.Client, database string, collections []string) (map[string]string, error) {
+	var out struct {
+		Collections map[string]string `bson:"collections"`
+	}
+	cmd := bson.D{{Key: "dbHash", Value: 1}, {Key: "collections", Value: collections}}
+	if err := client.Database(database).RunCommand(ctx, cmd).Decode(&out); err != nil {
+		return nil, errors.Wrapf(err, "dbHash of %v failed", database)
+	}
+	return out.Collections, nil
+}
+
+// UserDatabases lists the databases of client except admin, local and config.
+func UserDatabases(ctx context.Context, client *mongo.Client) ([]string, error) {
+	names, err := client.ListDatabaseNames(ctx, bson.D{})
+	if err != nil {
+		return nil, errors.Wrap(err, "listing databases failed")
+	}
+	list := make([]string, 0, len(names))
+	for _, name := range names {
+		if name != "admin" && name != "local" && name != "config" {
+			list = append(list, name)
+		}
+	}
+	return list, nil
+}
@@ -0,0 +1,142 @@
+package backup
+
+import (
+	"context"
+	"io"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/stefanprodan/mgob/pkg/config"
+)
+
+// Destination is a storage backend archives are copied to.
+type Destination interface {
+	Name() string
+	// Upload copies the local file to the destination and returns the tool output.
+	Upload(ctx context.Context, file string) (string, error)
+	// List returns the objects stored at the destination.
+	List(ctx context.Context) ([]Object, error)
+	// Delete removes an object returned by List.
+	Delete(ctx context.Context, name string) error
+	// Verify checks the uploaded copy of the local file exists and has the same size,
+	// and the same checksum where the destination computes one.
+	Verify(ctx context.Context, file string) error
+	// Download fetches the uploaded copy of the local file into dst.
+	Download(ctx context.Context, file string, dst string) error
+}
+
+// Linker is implemented by destinations that can sign time-limited download URLs.
+type Linker interface {
+	// Link returns a URL the uploaded copy of the local file can be downloaded from until ttl elapses.
+	Link(ctx context.Context, file string, ttl time.Duration) (string, error)
+}
+
+// Streamer is implemented by destinations that can store an object of unknown size.
+type Streamer interface {
+	// Stream uploads the data read from r until EOF as name and returns the tool output.
+	Stream(ctx context.Context, name string, r io.Reader) (string, error)
+}
+
+// Object is a file stored at a destination, Name is relative to the destination root.
+type Object struct {
+	Name string `json:"name"`
+	Size int64  `json:"size"`
+}
+
+// DestinationFactory returns the destination configured in the plan,
+// or nil when the plan doesn't use it.
+type DestinationFactory func(plan config.Plan, conf *config.AppConfig, ts time.Time) Destination
+
+type destinationEntry struct {
+	name    string
+	factory DestinationFactory
+}
+
+var destinationRegistry []destinationEntry
+
+func init() {
+	// built-in destinations, local first as the archive is already in the storage dir
+	RegisterDestination("local", newLocalDestination)
+	RegisterDestination("sftp", newSFTPDestination)
+	RegisterDestination("s3", newS3Destination)
+	RegisterDestination("gcloud", newGCloudDestination)
+	RegisterDestination("azure", newAzureDestination)
+	RegisterDestination("rclone", newRcloneDestination)
+}
+
+// RegisterDestination adds a destination type, uploads run in registration order.
+func RegisterDestination(name string, f DestinationFactory) {
+	destinationRegistry = append(destinationRegistry, destinationEntry{name: name, factory: f})
+}
+
+// Destinations returns all destinations configured in the plan.
+func Destinations(plan config.Plan, conf *config.AppConfig, ts time.Time) []Destination {
+	list := make([]Destination, 0)
+	for _, e := range destinationRegistry {
+		d := e.factory(plan, conf, ts)
+		switch {
+		case d == nil:
+		case e.name == "local":
+			list = append(list, d)
+		default:
+			list = append(list, contentNamed(plan, conf, d))
+		}
+	}
+	return list
+}
+
+// RemoteDestinations returns the destinations configured in the plan except the local storage.
+func RemoteDestinations(plan config.Plan, conf *config.AppConfig, ts time.Time) []Destination {
+	list := make([]Destination, 0)
+	for _, e := range destinationRegistry {
+		if e.name == "local" {
+			continue
+		}
+		if d := e.factory(plan, conf, ts); d != nil {
+			list = append(list, contentNamed(plan, conf, d))
+		}
+	}
+	return list
+}
+
+// Link signs a download URL of the remote copy of archive at the named destination,
+// or at the first destination of the plan that supports it when name is empty.
+// It returns the destination name and the URL.
+func Link(ctx context.Context, plan config.Plan, conf *config.AppConfig, ts time.Time, archive string,
+	name string, ttl time.Duration) (string, string, error) {
+	file := filepath.Join(config.PlanDir(conf.StoragePath, plan), archive)
+	ctx = WithEnv(ctx, plan)
+	for _, d := range RemoteDestinations(plan, conf, ts) {
+		if name != "" && !strings.EqualFold(d.Name(), name) {
+			continue
+		}
+		l, ok := d.(Linker)
+		if !ok {
+			if name != "" {
+				return "", "", errors.Errorf("%v doesn't support download links", d.Name())
+			}
+			continue
+		}
+		url, err := l.Link(ctx, file, ttl)
+		return d.Name(), url, err
+	}
+	if name != "" {
+		return "", "", errors.Errorf("Plan %v has no %v destination", plan.Name, name)
+	}
+	return "", "", errors.Errorf("Plan %v has no destination that supports download links", plan.Name)
+}
+
+// checkSize compares the local file size with the remote size.
+func checkSize(file string, remote int64) error {
+	local, err := fileSize(file)
+	if err != nil {
+		return err
+	}
+	if local != remote {
+		return errors.Errorf("size mismatch for %v local %v remote %v", file, local, remote)
+	}
+	return nil
+}
@@ -0,0 +1,334 @@
+package backup
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/stefanprodan/mgob/pkg/clock"
+	"github.com/stefanprodan/mgob/pkg/config"
+	"github.com/stefanprodan/mgob/pkg/db"
+)
+
+// DiskRecordExt is the extension of the file recording the disk snapshots of a run in the plan dir.
+const DiskRecordExt = ".disk.json"
+
+const defaultDiskTimeout = 60 * time.Minute
+
+// DiskPollInterval is the delay between two state checks of the EBS snapshots.
+var DiskPollInterval = 30 * time.Second
+
+// DiskRecord is stored in the plan dir for each run, the retention of the
+// records deletes the snapshots.
+type DiskRecord struct {
+	Plan      string            `json:"plan"`
+	Timestamp time.Time         `json:"timestamp"`
+	Snapshots []db.DiskSnapshot `json:"snapshots"`
+	// Region and Project locate the snapshots to delete them
+	Region  string `json:"region,omitempty"`
+	Project string `json:"project,omitempty"`
+	// Member is the secondary locked while the snapshots were started
+	Member string `json:"member,omitempty"`
+}
+
+// checkDisk validates the plans of the disk mode, the snapshots stay in the
+// cloud account so the plan can't have a pipeline.
+func checkDisk(plan config.Plan) error {
+	if plan.Mode != config.BackupModeDisk {
+		if plan.Disk != nil {
+			return errors.Errorf("disk requires '%s' backup mode", config.BackupModeDisk)
+		}
+		return nil
+	}
+	d := plan.Disk
+	t := plan.Target
+	switch {
+	case d == nil || len(d.Volumes) == 0:
+		return errors.Errorf("'%s' backup mode requires disk volumes", plan.Mode)
+	case d.Provider != "aws" && d.Provider != "gcloud" && d.Provider != "azure":
+		return errors.Errorf("unknown disk provider '%s', one of aws, gcloud or azure", d.Provider)
+	case d.Provider == "azure" && d.ResourceGroup == "":
+		return errors.New("azure disk snapshots require a resourceGroup")
+	case d.Lock && t.Uri == "":
+		return errors.New("disk lock requires target.uri")
+	case d.Member != "" && !d.Lock:
+		return errors.New("disk member is the member locked, it requires lock")
+	case d.Timeout < 0:
+		return errors.New("disk timeout can't be negative")
+	case plan.Agent != "" || plan.Executor != nil:
+		return errors.Errorf("'%s' backup mode can't run on an agent or executor", plan.Mode)
+	case t.PointInTime || plan.PITR != nil:
+		return errors.Errorf("pointInTime and pitr can't be used with '%s' backup mode", plan.Mode)
+	case plan.Streaming || len(plan.Pipeline) > 0 || plan.Encryption != nil || plan.Compression != nil:
+		return errors.New("the disk snapshots stay in the cloud account, streaming, pipeline, encryption and compression can't be used")
+	case plan.Scan != nil || plan.Standby != nil:
+		return errors.New("scan and standby need a local archive, they can't be used with disk")
+	case t.Database != "" || t.Collection != "" || len(t.IncludeDatabases) != 0 || len(t.ExcludeDatabases) != 0:
+		return errors.Errorf("'%s' backup mode snapshots whole volumes, it can't select databases or collections", plan.Mode)
+	}
+	return nil
+}
+
+// runDisk snapshots the plan volumes with the provider CLI, with the member
+// locked until every snapshot is started when lock is on, waits for them to
+// complete and records them in the plan dir. The record is uploaded to the plan destinations.
+func runDisk(ctx context.Context, c *dumpConfig) (Result, error) {
+	res := errRes(c)
+	d := c.plan.Disk
+	timeout := defaultDiskTimeout
+	if d.Timeout > 0 {
+		timeout = time.Duration(d.Timeout) * time.Minute
+	}
+	wctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	rec := DiskRecord{Plan: c.name, Timestamp: c.ts.UTC(), Region: d.Region, Project: d.Project}
+	unlock := func() {}
+	if d.Lock {
+		rec.Member = d.Member
+		if rec.Member == "" {
+			var err error
+			if rec.Member, err = secondaryMember(ctx, c.plan.Target.Uri); err != nil {
+				return res, err
+			}
+		}
+		var err error
+		if unlock, err = lockMember(wctx, c, rec.Member); err != nil {
+			return res, err
+		}
+	}
+	defer unlock()
+
+	name := kubeNameChars.ReplaceAllString(strings.ToLower(fmt.Sprintf("%v-%v", c.name, c.ts.Unix())), "-")
+	snapshots, err := createDiskSnapshots(wctx, c, name)
+	// the snapshots are point in time once started, they complete after the unlock
+	unlock()
+	rec.Snapshots = snapshots
+	if err == nil && d.Provider == "aws" {
+		log.WithField("plan", c.name).Infof("%v EBS snapshots started", len(snapshots))
+		err = waitEBS(wctx, d.Region, snapshots)
+	}
+	if err != nil {
+		// the snapshots started before the failure are recorded for the retention to delete them
+		if len(snapshots) > 0 {
+			writeDiskRecord(c, rec)
+		}
+		return res, err
+	}
+
+	file, data, err := writeDiskRecord(c, rec)
+	if err != nil {
+		return res, err
+	}
+	res.Name = filepath.Base(file)
+	res.DiskSnapshots = snapshots
+
+	if c.plan.Scheduler.Retention > 0 {
+		if err := expireDisk(ctx, c); err != nil {
+			return res, errors.Wrap(err, "retention job failed")
+		}
+		if err := retain(ctx, c); err != nil {
+			return res, errors.Wrap(err, "retention job failed")
+		}
+	}
+
+	u, err := upload(ctx, c, RoutedPlan{Plan: c.plan}, file)
+	if err != nil {
+		return res, err
+	}
+	res.Uploads = append(res.Uploads, u)
+	res.Files = []string{file}
+	res.Size = int64(len(data))
+	res.Chain = fmt.Sprintf("%v-%v", c.name, c.ts.Unix())
+	res.Status = 200
+	res.Duration = clock.Since(c.ts)
+	log.WithFields(log.Fields{
+		"plan":      c.name,
+		"snapshots": len(snapshots),
+		"duration":  res.Duration.String(),
+	}).Infof("disk snapshot succeeded")
+	return res, nil
+}
+
+// createDiskSnapshots starts a snapshot of each volume tagged with the plan
+// and the timestamp, it returns the snapshots started before an error.
+func createDiskSnapshots(ctx context.Context, c *dumpConfig, name string) ([]db.DiskSnapshot, error) {
+	d := c.plan.Disk
+	label := kubeNameChars.ReplaceAllString(strings.ToLower(c.name), "-")
+	ts := fmt.Sprint(c.ts.Unix())
+	snapshots := make([]db.DiskSnapshot, 0, len(d.Volumes))
+
+	switch d.Provider {
+	case "aws":
+		tags := fmt.Sprintf("ResourceType=snapshot,Tags=[{Key=mgob.plan,Value=%v},{Key=mgob.timestamp,Value=%v}]", c.name, ts)
+		for _, vol := range d.Volumes {
+			output, err := runCmd(ctx, "aws", awsRegion(d.Region, []string{"ec2", "create-snapshot",
+				"--volume-id", vol, "--description", "mgob " + name, "--tag-specifications", tags, "--output", "json"})...)
+			if err != nil {
+				return snapshots, errors.Wrapf(err, "EBS snapshot of %v failed", vol)
+			}
+			var out struct {
+				SnapshotId string `json:"SnapshotId"`
+			}
+			if err := json.Unmarshal([]byte(output), &out); err != nil || out.SnapshotId == "" {
+				return snapshots, errors.Errorf("EBS snapshot of %v returned no id %v", vol, output)
+			}
+			snapshots = append(snapshots, db.DiskSnapshot{Provider: d.Provider, Volume: vol, ID: out.SnapshotId})
+		}
+	case "gcloud":
+		// a single call snapshots the disks at once
+		names := make([]string, len(d.Volumes))
+		for i := range d.Volumes {
+			names[i] = fmt.Sprintf("%v-%v", name, i)
+		}
+		args := append([]string{"compute", "disks", "snapshot"}, d.Volumes...)
+		args = append(args, "--snapshot-names", strings.Join(names, ","),
+			"--labels", fmt.Sprintf("mgob-plan=%v,mgob-timestamp=%v", label, ts), "--quiet")
+		if d.Zone != "" {
+			args = append(args, "--zone", d.Zone)
+		}
+		if _, err := runCmd(ctx, "gcloud", gcloudProject(d.Project, args)...); err != nil {
+			return snapshots, errors.Wrap(err, "GCE disk snapshot failed")
+		}
+		for i, vol := range d.Volumes {
+			snapshots = append(snapshots, db.DiskSnapshot{Provider: d.Provider, Volume: vol, ID: names[i]})
+		}
+	case "azure":
+		for i, vol := range d.Volumes {
+			output, err := runCmd(ctx, "az", "snapshot", "create", "-g", d.ResourceGroup,
+				"-n", fmt.Sprintf("%v-%v", name, i), "--source", vol, "--incremental", "true",
+				"--tags", "mgob-plan="+c.name, "mgob-timestamp="+ts, "--query", "id", "-o", "tsv")
+			if err != nil {
+				return snapshots, errors.Wrapf(err, "Azure snapshot of %v failed", vol)
+			}
+			snapshots = append(snapshots, db.DiskSnapshot{Provider: d.Provider, Volume: vol, ID: strings.TrimSpace(output)})
+		}
+	}
+	return snapshots, nil
+}
+
+// waitEBS polls the state of the snapshots until they are all completed.
+func waitEBS(ctx context.Context, region string, snapshots []db.DiskSnapshot) error {
+	args := []string{"ec2", "describe-snapshots", "--query", "Snapshots[].[SnapshotId,State,StateMessage]", "--output", "text", "--snapshot-ids"}
+	for _, s := range snapshots {
+		args = append(args, s.ID)
+	}
+	for {
+		output, err := runCmd(ctx, "aws", awsRegion(region, args)...)
+		if err != nil {
+			return errors.Wrap(err, "describing the EBS snapshots failed")
+		}
+		done := 0
+		for _, line := range strings.Split(output, "\n") {
+			fields := strings.Fields(line)
+			switch {
+			case len(fields) < 2:
+			case fields[1] == "completed":
+				done++
+			case fields[1] == "error":
+				return errors.Errorf("EBS snapshot %v failed %v", fields[0], strings.Join(fields[2:], " "))
+			}
+		}
+		if done == len(snapshots) {
+			return nil
+		}
+		select {
+		case <-time.After(DiskPollInterval):
+		case <-ctx.Done():
+			return errors.Wrap(ctx.Err(), "waiting for the EBS snapshots")
+		}
+	}
+}
+
+// writeDiskRecord writes rec in the plan dir.
+func writeDiskRecord(c *dumpConfig, rec DiskRecord) (string, []byte, error) {
+	if err := os.MkdirAll(c.planDir, 0755); err != nil {
+		return "", nil, errors.Wrapf(err, "creating dir %v in %v failed", c.name, c.storagePath)
+	}
+	data, err := json.MarshalIndent(rec, "", "  ")
+	if err != nil {
+		return "", nil, errors.Wrap(err, "encoding disk record failed")
+	}
+	file := filepath.Join(c.planDir, fmt.Sprintf("%v-%v%v", c.name, c.ts.Unix(), DiskRecordExt))
+	if err := ioutil.WriteFile(file, data, 0644); err != nil {
+		return "", nil, errors.Wrapf(err, "writing disk record %v failed", file)
+	}
+	return file, data, nil
+}
+
+// expireDisk deletes the snapshots of the records the retention removes.
+func expireDisk(ctx context.Context, c *dumpConfig) error {
+	files, err := ioutil.ReadDir(c.planDir)
+	if err != nil {
+		return errors.Wrapf(err, "reading %v failed", c.planDir)
+	}
+	backups, stamps := retentionGroups(files, c.name)
+	for i := c.plan.Scheduler.Retention; i < len(stamps); i++ {
+		for _, file := range backups[stamps[i]] {
+			if !strings.HasSuffix(file, DiskRecordExt) {
+				continue
+			}
+			data, err := ioutil.ReadFile(filepath.Join(c.planDir, file))
+			if err != nil {
+				return errors.Wrapf(err, "reading %v failed", file)
+			}
+			var rec DiskRecord
+			if err := json.Unmarshal(data, &rec); err != nil {
+				return errors.Wrapf(err, "parsing %v failed", file)
+			}
+			for _, s := range rec.Snapshots {
+				if err := deleteDiskSnapshot(ctx, rec, s); err != nil {
+					return err
+				}
+				log.WithField("plan", c.name).Infof("%v snapshot %v deleted", s.Provider, s.ID)
+			}
+		}
+	}
+	return nil
+}
+
+func deleteDiskSnapshot(ctx context.Context, rec DiskRecord, s db.DiskSnapshot) error {
+	var err error
+	switch s.Provider {
+	case "aws":
+		_, err = runCmd(ctx, "aws", awsRegion(rec.Region, []string{"ec2", "delete-snapshot", "--snapshot-id", s.ID})...)
+		if err != nil && strings.Contains(err.Error(), "InvalidSnapshot.NotFound") {
+			err = nil
+		}
+	case "gcloud":
+		_, err = runCmd(ctx, "gcloud", gcloudProject(rec.Project, []string{"compute", "snapshots", "delete", s.ID, "--quiet"})...)
+		if err != nil && strings.Contains(err.Error(), "was not found") {
+			err = nil
+		}
+	case "azure":
+		_, err = runCmd(ctx, "az", "snapshot", "delete", "--ids", s.ID)
+	default:
+		err = errors.Errorf("unknown disk provider '%s'", s.Provider)
+	}
+	if err != nil {
+		return errors.Wrapf(err, "deleting %v snapshot %v failed", s.Provider, s.ID)
+	}
+	return nil
+}
+
+func awsRegion(region string, args []string) []string {
+	if region == "" {
+		return args
+	}
+	return append(args, "--region", region)
+}
+
+func gcloudProject(project string, args []string) []string {
+	if project == "" {
+		return args
+	}
+	return append(args, "--project", project)
+}
@@ -1,92 +1,201 @@
 package backup
 
 import (
+	"bytes"
+	"context"
 	"fmt"
-	"github.com/codeskyblue/go-sh"
-	"github.com/pkg/errors"
-	log "github.com/sirupsen/logrus"
-	"github.com/stefanprodan/mgob/pkg/config"
+	"io"
 	"os"
+	"os/exec"
 	"regexp"
+	"sort"
 	"strings"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/stefanprodan/mgob/pkg/config"
 )
 
-func encrypt(file string, encryptedFile string, plan config.Plan, conf *config.AppConfig) (string, error) {
+func init() {
+	RegisterStage(config.StageEncrypt, newEncryptStage)
+}
+
+func newEncryptStage(ctx context.Context, s config.Stage, plan config.Plan, conf *config.AppConfig) (Stage, error) {
+	if plan.Encryption == nil {
+		return nil, errors.Errorf("Encryption stage requires an encryption config")
+	}
 	if plan.Encryption.Gpg != nil {
 		if !conf.HasGpg {
-			return "", errors.Errorf("GPG configuration is present, but no GPG binary is found! Uploading unencrypted backup.")
+			return nil, errors.Errorf("GPG configuration is present, but no GPG binary is found! Uploading unencrypted backup.")
 		}
-		return gpgEncrypt(file, encryptedFile, plan)
+		recipients, err := gpgRecipients(ctx, plan)
+		if err != nil {
+			return nil, err
+		}
+		keyServer := plan.Encryption.Gpg.KeyServer
+		if keyServer == "" {
+			keyServer = "hkps://keys.openpgp.org"
+		}
+		return &gpgStage{plan: plan.Name, recipients: recipients, keyServer: keyServer}, nil
 	}
 
-	return "", errors.Errorf("Encryption config is not valid!")
+	return nil, errors.Errorf("Encryption config is not valid!")
 }
 
-func removeUnencrypted(file string, encryptedFile string) {
-	// Check if encrypted file exists and remove original
-	stat, err := os.Stat(encryptedFile)
-	if err == nil && stat.Size() > 0 {
-		os.Remove(file)
-	}
-}
-
-func gpgEncrypt(file string, encryptedFile string, plan config.Plan) (string, error) {
+// gpgRecipients imports the plan key file, if any, and returns the encryption recipients.
+func gpgRecipients(ctx context.Context, plan config.Plan) ([]string, error) {
 	output := ""
-	recipient := ""
-
-	recipients := plan.Encryption.Gpg.Recipients
+	recipients := append([]string{}, plan.Encryption.Gpg.Recipients...)
 
 	keyFile := plan.Encryption.Gpg.KeyFile
 	if keyFile != "" {
 		keyFileStat, err := os.Stat(keyFile)
 		if err == nil && !keyFileStat.IsDir() {
 			// import key from file
-			importCmd := fmt.Sprintf("gpg --batch --import  %v", keyFile)
-
-			result, err := sh.Command("/bin/sh", "-c", importCmd).CombinedOutput()
+			result, err := combinedOutput(ctx, exec.Command("gpg", "--batch", "--import", keyFile))
 			if len(result) > 0 {
 				output += strings.Replace(string(result), "\n", " ", -1)
 			}
 			if err != nil {
-				return "", errors.Wrapf(err, "Importing encryption key for plan %v failed %s", plan.Name, output)
+				return nil, errors.Wrapf(err, "Importing encryption key for plan %v failed %s", plan.Name, output)
 			}
 			if !strings.Contains(output, "imported: 1") && !strings.Contains(output, "unchanged: 1") {
-				return "", errors.Errorf("Importing encryption key failed %v", output)
+				return nil, errors.Errorf("Importing encryption key failed %v", output)
 			}
 
 			re := regexp.MustCompile(`key ([0-9A-F]+):`)
 			keyMatch := re.FindStringSubmatch(output)
 			log.WithField("plan", plan.Name).Debugf("Import output: %v", output)
-			log.WithField("plan", plan.Name).Debugf("Parsed key id: %v", keyMatch[1])
 			if keyMatch != nil {
+				log.WithField("plan", plan.Name).Debugf("Parsed key id: %v", keyMatch[1])
 				recipients = append(recipients, keyMatch[1])
 			}
 		}
 	}
 
-	recipient = strings.Join(recipients, " -r ")
+	if len(recipients) == 0 {
+		return nil, errors.Errorf("GPG configuration is present, but no encryption key is configured! %v", output)
+	}
+
+	return recipients, nil
+}
+
+// gpgStage encrypts the stream by piping it through gpg.
+type gpgStage struct {
+	plan       string
+	recipients []string
+	keyServer  string
+}
+
+func (s *gpgStage) Name() string {
+	return "encrypt/gpg"
+}
+
+func (s *gpgStage) Ext() string {
+	return ".encrypted"
+}
 
-	if recipient == "" {
-		return "", errors.Errorf("GPG configuration is present, but no encryption key is configured! %v", output)
+func (s *gpgStage) Wrap(ctx context.Context, w io.Writer) (io.WriteCloser, error) {
+	args := []string{"-v", "--batch", "--yes", "--trust-model", "always",
+		"--auto-key-locate", "local," + s.keyServer, "-e"}
+	for _, r := range s.recipients {
+		args = append(args, "-r", r)
 	}
 
-	keyServer := plan.Encryption.Gpg.KeyServer
-	if keyServer == "" {
-		keyServer = "hkps://keys.openpgp.org"
+	cmd := exec.Command("gpg", args...)
+	return startPipe(ctx, cmd, w, fmt.Sprintf("Encryption for plan %v failed", s.plan))
+}
+
+// cmdWriter feeds a child process through its stdin, the process output
+// goes to the next writer in the pipeline.
+type cmdWriter struct {
+	io.WriteCloser
+	proc   *process
+	stderr *bytes.Buffer
+	msg    string
+}
+
+func startPipe(ctx context.Context, cmd *exec.Cmd, w io.Writer, msg string) (io.WriteCloser, error) {
+	stderr := &bytes.Buffer{}
+	cmd.Stdout = w
+	cmd.Stderr = stderr
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, errors.Wrap(err, msg)
+	}
+	proc, err := startProcess(ctx, cmd)
+	if err != nil {
+		return nil, errors.Wrap(err, msg)
+	}
+	return &cmdWriter{WriteCloser: stdin, proc: proc, stderr: stderr, msg: msg}, nil
+}
+
+func (c *cmdWriter) Close() error {
+	c.WriteCloser.Close()
+	if err := c.proc.Wait(); err != nil {
+		return errors.Wrapf(err, "%v %v", c.msg, strings.Replace(c.stderr.String(), "\n", " ", -1))
+	}
+	return nil
+}
+
+// Recipients returns the gpg recipients of the plan encryption config sorted,
+// importing its key file if any.
+func Recipients(ctx context.Context, plan config.Plan) ([]string, error) {
+	if plan.Encryption == nil || plan.Encryption.Gpg == nil {
+		return nil, errors.Errorf("Plan %v has no gpg encryption config", plan.Name)
 	}
+	recipients, err := gpgRecipients(WithEnv(ctx, plan), plan)
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(recipients)
+	return recipients, nil
+}
 
-	// encrypt file
-	encryptCmd := fmt.Sprintf(
-		"gpg -v --batch --yes --trust-model always --auto-key-locate local,%v -e -r %v -o %v %v",
-		keyServer, recipient, encryptedFile, file)
+// Reencrypt decrypts the archive in src with the keys of the gpg keyring and
+// writes it to dst encrypted for the current plan recipients.
+func Reencrypt(ctx context.Context, plan config.Plan, conf *config.AppConfig, src string, dst string) error {
+	stage, err := newEncryptStage(ctx, config.Stage{Type: config.StageEncrypt}, plan, conf)
+	if err != nil {
+		return err
+	}
+	ctx = WithEnv(ctx, plan)
 
-	result, err := sh.Command("/bin/sh", "-c", encryptCmd).CombinedOutput()
-	if len(result) > 0 {
-		output += strings.Replace(string(result), "\n", " ", -1)
+	in, err := os.Open(src)
+	if err != nil {
+		return errors.Wrapf(err, "Opening %v failed", src)
 	}
+	defer in.Close()
+	out, err := os.Create(dst)
 	if err != nil {
-		return "", errors.Wrapf(err, "Encryption for plan %v failed %s", plan.Name, output)
+		return errors.Wrapf(err, "Creating %v failed", dst)
 	}
+	defer out.Close()
 
-	return output, nil
+	enc, err := stage.Wrap(ctx, out)
+	if err != nil {
+		return err
+	}
+	var stderr bytes.Buffer
+	dec := exec.Command("gpg", "--batch", "--yes", "--decrypt")
+	dec.Stdin = in
+	dec.Stdout = enc
+	dec.Stderr = &stderr
+	p, err := startProcess(ctx, dec)
+	if err == nil {
+		err = p.Wait()
+	}
+	if cerr := enc.Close(); err == nil {
+		err = cerr
+	} else {
+		err = errors.Wrapf(err, "Decrypting %v failed %v", src, strings.Replace(stderr.String(), "\n", " ", -1))
+	}
+	if err != nil {
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return errors.Wrapf(err, "Writing %v failed", dst)
+	}
+	return nil
 }
@@ -0,0 +1,44 @@
+package backup
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"sort"
+
+	"github.com/stefanprodan/mgob/pkg/config"
+)
+
+type envKey struct{}
+
+// WithEnv returns a context whose child processes get the plan env
+// on top of the mgob process env.
+func WithEnv(ctx context.Context, plan config.Plan) context.Context {
+	if len(plan.Env) == 0 {
+		return ctx
+	}
+	// sorted so the child env doesn't change between runs
+	keys := make([]string, 0, len(plan.Env))
+	for k := range plan.Env {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	env := make([]string, 0, len(keys))
+	for _, k := range keys {
+		env = append(env, fmt.Sprintf("%v=%v", k, plan.Env[k]))
+	}
+	return context.WithValue(ctx, envKey{}, env)
+}
+
+// applyEnv adds the plan env of ctx to cmd, later entries override the process env.
+func applyEnv(ctx context.Context, cmd *exec.Cmd) {
+	env, ok := ctx.Value(envKey{}).([]string)
+	if !ok {
+		return
+	}
+	if cmd.Env == nil {
+		cmd.Env = os.Environ()
+	}
+	cmd.Env = append(cmd.Env, env...)
+}
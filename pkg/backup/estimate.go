@@ -0,0 +1,182 @@
+package backup
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/dustin/go-humanize"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"github.com/stefanprodan/mgob/pkg/config"
+)
+
+// DumpProgressInterval is the delay between two progress checks of a running dump.
+var DumpProgressInterval = 30 * time.Second
+
+// DumpStatus is the progress of a running dump, Written is the size of its
+// files in the tmp dir. Percent is only set when the size of the dump is
+// expected, from the estimate or the last backup.
+type DumpStatus struct {
+	Plan     string    `json:"plan"`
+	Name     string    `json:"name"`
+	Started  time.Time `json:"started"`
+	Estimate int64     `json:"estimate,omitempty"`
+	Expected int64     `json:"expected,omitempty"`
+	Written  int64     `json:"written"`
+	Percent  float64   `json:"percent,omitempty"`
+}
+
+var (
+	dumpsMu sync.Mutex
+	dumps   = make(map[string]*DumpStatus)
+)
+
+// Dumps returns the dumps running, ordered by name.
+func Dumps() []DumpStatus {
+	dumpsMu.Lock()
+	defer dumpsMu.Unlock()
+	list := make([]DumpStatus, 0, len(dumps))
+	for _, d := range dumps {
+		list = append(list, *d)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list
+}
+
+// estimates reports whether the size of the dumps of plan is estimated from
+// the target stats, mgob must reach the target and mongodump dump it whole.
+func estimates(plan config.Plan) bool {
+	switch plan.Mode {
+	case "", config.BackupModeSingle, config.BackupModeDatabase:
+		return plan.Target.Uri != "" && plan.Agent == ""
+	}
+	return false
+}
+
+// estimateSize sums the dataSize dbStats reports for the dumped databases, or
+// the size collStats reports for the dumped collections when the target
+// selects or excludes collections. It's the size of the uncompressed BSON
+// mongodump writes, a query only makes it smaller.
+func estimateSize(ctx context.Context, c *dumpConfig) (int64, error) {
+	ectx, cancel := context.WithTimeout(ctx, mongodbDatabaseListTimeout)
+	defer cancel()
+	uri := c.plan.Target.Uri
+	client, err := mongo.Connect(ectx, options.Client().ApplyURI(uri).SetReadPreference(targetReadPref(uri)))
+	if err != nil {
+		return 0, errors.Wrapf(err, "failed to connect to MongoDB %s", redactUri(uri))
+	}
+	defer client.Disconnect(context.Background())
+
+	databases := []string{c.database}
+	if c.database == "" {
+		names, err := listDatabaseNames(ectx, client, c.plan.Target)
+		if err != nil {
+			return 0, errors.Wrap(err, "failed to list databases")
+		}
+		databases = make([]string, 0, len(names))
+		for _, name := range names {
+			// mongodump skips them
+			if name != "local" && name != "config" {
+				databases = append(databases, name)
+			}
+		}
+	}
+
+	t := c.plan.Target
+	var size float64
+	for _, database := range databases {
+		if t.Collection == "" && len(t.ExcludeCollections) == 0 {
+			var stats struct {
+				DataSize float64 `bson:"dataSize"`
+			}
+			if err := client.Database(database).RunCommand(ectx, bson.D{{Key: "dbStats", Value: 1}}).Decode(&stats); err != nil {
+				return 0, errors.Wrapf(err, "dbStats of %v failed", database)
+			}
+			size += stats.DataSize
+			continue
+		}
+		names, err := client.Database(database).ListCollectionNames(ectx, bson.D{{Key: "type", Value: "collection"}})
+		if err != nil {
+			return 0, errors.Wrapf(err, "failed to list the collections of %v", database)
+		}
+		for _, name := range names {
+			if !dumpsCollection(t, name) {
+				continue
+			}
+			var stats struct {
+				Size float64 `bson:"size"`
+			}
+			if err := client.Database(database).RunCommand(ectx, bson.D{{Key: "collStats", Value: name}}).Decode(&stats); err != nil {
+				return 0, errors.Wrapf(err, "collStats of %v.%v failed", database, name)
+			}
+			size += stats.Size
+		}
+	}
+	return int64(size), nil
+}
+
+// expectedDumpSize is the size the dump of c is expected to take in the tmp
+// dir: the estimate when mongodump writes uncompressed BSON, the last backup
+// otherwise, 0 when unknown.
+func expectedDumpSize(c *dumpConfig, estimate int64, uncompressed bool) int64 {
+	if estimate > 0 && uncompressed {
+		return estimate
+	}
+	return lastBackupSize(c.planDir, c.name)
+}
+
+// watchDump lists the dump of c in Dumps and logs its progress every
+// DumpProgressInterval until stopped.
+func watchDump(c *dumpConfig, estimate int64, expected int64) func() {
+	status := &DumpStatus{Plan: c.plan.Name, Name: c.name, Started: c.ts.UTC(), Estimate: estimate, Expected: expected}
+	dumpsMu.Lock()
+	dumps[c.name] = status
+	dumpsMu.Unlock()
+
+	prefix := fmt.Sprintf("%v-%v.", c.name, c.ts.Unix())
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(DumpProgressInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				written, err := dirSize(c.tmpPath, prefix)
+				if err != nil {
+					continue
+				}
+				dumpsMu.Lock()
+				status.Written = written
+				if expected > 0 {
+					status.Percent = float64(written) * 100 / float64(expected)
+					if status.Percent > 100 {
+						status.Percent = 100
+					}
+				}
+				st := *status
+				dumpsMu.Unlock()
+				if expected > 0 {
+					log.WithField("plan", c.name).Infof("Dump at %.0f%%, %v of ~%v written",
+						st.Percent, humanize.Bytes(uint64(written)), humanize.Bytes(uint64(expected)))
+				} else {
+					log.WithField("plan", c.name).Infof("Dump running, %v written", humanize.Bytes(uint64(written)))
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+	return func() {
+		close(done)
+		dumpsMu.Lock()
+		delete(dumps, c.name)
+		dumpsMu.Unlock()
+	}
+}
@@ -0,0 +1,125 @@
+package backup
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/stefanprodan/mgob/pkg/command"
+	"github.com/stefanprodan/mgob/pkg/config"
+)
+
+// userCommand returns the cmd of a command of the config, a list is started
+// directly with args appended, a command line runs through the shell.
+func userCommand(c config.Command, args ...string) *exec.Cmd {
+	if len(c.Args) > 0 {
+		return exec.Command(c.Args[0], append(append([]string(nil), c.Args[1:]...), args...)...)
+	}
+	return shellCommand(c.Line, args...)
+}
+
+// process is a child process bound to a context. When the context is done
+// the whole process group is killed so no child outlives the run.
+type process struct {
+	cmd  *exec.Cmd
+	ctx  context.Context
+	done chan struct{}
+}
+
+func startProcess(ctx context.Context, cmd *exec.Cmd) (*process, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	setProcessGroup(cmd)
+	applyEnv(ctx, cmd)
+	if err := command.Start(cmd); err != nil {
+		return nil, err
+	}
+	p := &process{cmd: cmd, ctx: ctx, done: make(chan struct{})}
+	go func() {
+		select {
+		case <-ctx.Done():
+			killProcessGroup(cmd)
+		case <-p.done:
+		}
+	}()
+	return p, nil
+}
+
+// Wait waits for the process to exit, reporting the cancellation cause if any.
+// The process usage is accounted to the stage of its context.
+func (p *process) Wait() error {
+	var io procIO
+	if r, _ := recorderOf(p.ctx); r != nil {
+		io = exitedIO(p.cmd.Process)
+	}
+	err := p.cmd.Wait()
+	close(p.done)
+	recordProcess(p.ctx, p.cmd.ProcessState, io)
+	if err != nil && p.ctx.Err() != nil {
+		return errors.Wrap(p.ctx.Err(), err.Error())
+	}
+	return err
+}
+
+// combinedOutput runs cmd until it exits or ctx is done.
+func combinedOutput(ctx context.Context, cmd *exec.Cmd) ([]byte, error) {
+	var b bytes.Buffer
+	cmd.Stdout = &b
+	cmd.Stderr = &b
+	p, err := startProcess(ctx, cmd)
+	if err != nil {
+		return nil, err
+	}
+	err = p.Wait()
+	return b.Bytes(), err
+}
+
+// runCmd runs name with args, without a shell, and returns its trimmed output.
+func runCmd(ctx context.Context, name string, args ...string) (string, error) {
+	result, err := combinedOutput(ctx, exec.Command(name, args...))
+	output := strings.TrimSpace(string(result))
+	if err != nil {
+		return output, errors.Wrapf(err, "%v", strings.Replace(output, "\n", " ", -1))
+	}
+	return output, nil
+}
+
+// ctxReader stops a copy loop as soon as ctx is done.
+type ctxReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (r ctxReader) Read(p []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return r.r.Read(p)
+}
+
+// closeOnDone closes c when ctx is done, the returned func stops watching.
+func closeOnDone(ctx context.Context, c io.Closer) func() {
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			c.Close()
+		case <-done:
+		}
+	}()
+	return func() { close(done) }
+}
+
+// withTimeout bounds ctx by a timeout in minutes, zero means no timeout.
+func withTimeout(ctx context.Context, minutes int) (context.Context, context.CancelFunc) {
+	if minutes > 0 {
+		return context.WithTimeout(ctx, time.Duration(minutes)*time.Minute)
+	}
+	return context.WithCancel(ctx)
+}
@@ -0,0 +1,38 @@
+//go:build !windows
+// +build !windows
+
+package backup
+
+import (
+	"os/exec"
+	"syscall"
+)
+
+// shellCommand returns a shell command for a command line of the config,
+// args are passed as positional parameters so they are never interpreted.
+func shellCommand(command string, args ...string) *exec.Cmd {
+	return exec.Command("/bin/sh", append([]string{"-c", command + ` "$@"`, "sh"}, args...)...)
+}
+
+func setProcessGroup(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+}
+
+func killProcessGroup(cmd *exec.Cmd) {
+	if cmd.Process != nil {
+		// negative pid signals the whole group
+		syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+	}
+}
+
+// pauseProcessGroup stops or continues the whole process group.
+func pauseProcessGroup(cmd *exec.Cmd, pause bool) error {
+	if cmd.Process == nil {
+		return nil
+	}
+	sig := syscall.SIGCONT
+	if pause {
+		sig = syscall.SIGSTOP
+	}
+	return syscall.Kill(-cmd.Process.Pid, sig)
+}
@@ -0,0 +1,37 @@
+//go:build !windows
+// +build !windows
+
+package backup
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/stefanprodan/mgob/pkg/config"
+)
+
+func TestUserCommand(t *testing.T) {
+	tests := []struct {
+		command config.Command
+		args    []string
+		want    []string
+	}{
+		{config.Command{Args: []string{"clamdscan", "--no-summary"}}, []string{"/tmp/a b.gz"}, []string{"clamdscan", "--no-summary", "/tmp/a b.gz"}},
+		{config.Command{Args: []string{"/scripts/export.sh"}}, nil, []string{"/scripts/export.sh"}},
+		{config.Command{Line: "clamdscan --no-summary"}, []string{"/tmp/a b.gz"}, []string{"/bin/sh", "-c", `clamdscan --no-summary "$@"`, "sh", "/tmp/a b.gz"}},
+	}
+	for _, tt := range tests {
+		if got := userCommand(tt.command, tt.args...).Args; !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("userCommand(%v, %v) = %q, want %q", tt.command, tt.args, got, tt.want)
+		}
+	}
+
+	// a list isn't interpreted, the args are passed as is
+	out, err := userCommand(config.Command{Args: []string{"echo", "$HOME;", "'x'"}}).Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(out) != "$HOME; 'x'\n" {
+		t.Errorf("echo printed %q", out)
+	}
+}
@@ -0,0 +1,32 @@
+//go:build windows
+// +build windows
+
+package backup
+
+import (
+	"errors"
+	"os/exec"
+	"syscall"
+)
+
+// shellCommand returns a cmd.exe command for a command line of the config,
+// args are quoted so their spaces and quotes are kept.
+func shellCommand(command string, args ...string) *exec.Cmd {
+	line := command
+	for _, arg := range args {
+		line += " " + syscall.EscapeArg(arg)
+	}
+	return exec.Command("cmd", "/C", line)
+}
+
+func setProcessGroup(cmd *exec.Cmd) {}
+
+func killProcessGroup(cmd *exec.Cmd) {
+	if cmd.Process != nil {
+		cmd.Process.Kill()
+	}
+}
+
+func pauseProcessGroup(cmd *exec.Cmd, pause bool) error {
+	return errors.New("pausing processes is not supported on windows")
+}
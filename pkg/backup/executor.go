@@ -0,0 +1,86 @@
+package backup
+
+import (
+	"context"
+
+	"github.com/stefanprodan/mgob/pkg/config"
+)
+
+// Executor runs the dump of a job and returns the archive and the log it
+// left in the tmp dir.
+type Executor interface {
+	Name() string
+	Dump(ctx context.Context, job DumpJob) (string, string, error)
+}
+
+// ExecutorFactory returns the executor configured in the plan,
+// or nil when the plan doesn't use it.
+type ExecutorFactory func(plan config.Plan, conf *config.AppConfig) Executor
+
+type executorEntry struct {
+	name    string
+	factory ExecutorFactory
+}
+
+var executorRegistry []executorEntry
+
+func init() {
+	RegisterExecutor("agent", newAgentExecutor)
+	RegisterExecutor("ssh", newSSHExecutor)
+}
+
+// RegisterExecutor adds an executor type, the first one configured in a plan runs its dumps.
+func RegisterExecutor(name string, f ExecutorFactory) {
+	executorRegistry = append(executorRegistry, executorEntry{name: name, factory: f})
+}
+
+// ExecutorFor returns the executor of the plan, the local one when none is configured.
+func ExecutorFor(plan config.Plan, conf *config.AppConfig) Executor {
+	for _, e := range executorRegistry {
+		if ex := e.factory(plan, conf); ex != nil {
+			return ex
+		}
+	}
+	return &localExecutor{conf: conf}
+}
+
+// executorDump runs the dump of c on the executor of its plan.
+func executorDump(ctx context.Context, c *dumpConfig, gzip bool) (string, string, error) {
+	job := DumpJob{Plan: c.plan, Name: c.name, Timestamp: c.ts, Gzip: gzip, Database: c.database}
+	return ExecutorFor(c.plan, c.conf).Dump(ctx, job)
+}
+
+// jobConfig returns the dump config of job on this host.
+func jobConfig(job DumpJob, conf *config.AppConfig) *dumpConfig {
+	database := job.Database
+	if database == "" {
+		database = job.Plan.Target.Database
+	}
+	return &dumpConfig{
+		plan:        job.Plan,
+		database:    database,
+		conf:        conf,
+		tmpPath:     conf.TmpPath,
+		storagePath: conf.StoragePath,
+		ts:          job.Timestamp,
+		planDir:     config.PlanDir(conf.StoragePath, job.Plan),
+		name:        job.Name,
+	}
+}
+
+// localExecutor runs mongodump on this host.
+type localExecutor struct {
+	conf *config.AppConfig
+}
+
+func (e *localExecutor) Name() string {
+	return "local"
+}
+
+func (e *localExecutor) Dump(ctx context.Context, job DumpJob) (string, string, error) {
+	c := jobConfig(job, e.conf)
+	if c.plan.Mode == config.BackupModeSample || c.plan.Mode == config.BackupModeMetadata {
+		return dumpSample(ctx, c, job.Gzip)
+	}
+	return dump(ctx, c, job.Gzip)
+}
@@ -0,0 +1,170 @@
+package backup
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson"
+
+	"github.com/stefanprodan/mgob/pkg/config"
+)
+
+// checkExport validates the plans of the export mode.
+func checkExport(plan config.Plan) error {
+	if plan.Mode != config.BackupModeExport {
+		if plan.Export != nil {
+			return errors.Errorf("export requires '%s' backup mode", config.BackupModeExport)
+		}
+		return nil
+	}
+	e := plan.Export
+	t := plan.Target
+	if e == nil {
+		e = &config.Export{}
+	}
+	switch {
+	case t.Database == "":
+		return errors.Errorf("'%s' backup mode requires a target database", plan.Mode)
+	case t.Collection == "" && len(e.Collections) == 0:
+		return errors.Errorf("'%s' backup mode requires a target collection or export collections", plan.Mode)
+	case t.Collection != "" && len(e.Collections) > 0:
+		return errors.New("set the exported collections in either target.collection or export.collections")
+	case e.Type != "" && e.Type != "json" && e.Type != "csv":
+		return errors.Errorf("unknown export type '%s', json or csv", e.Type)
+	case e.Type == "csv" && len(e.Fields) == 0:
+		return errors.New("csv exports require fields")
+	case e.Type == "csv" && e.JSONArray:
+		return errors.New("jsonArray can't be used with csv exports")
+	case e.Type != "csv" && e.NoHeaderLine:
+		return errors.New("noHeaderLine requires csv exports")
+	case e.Limit < 0:
+		return errors.New("export limit can't be negative")
+	case plan.Agent != "" || plan.Executor != nil:
+		return errors.Errorf("'%s' backup mode can't run on an agent or executor", plan.Mode)
+	case t.PointInTime || plan.PITR != nil:
+		return errors.Errorf("pointInTime and pitr can't be used with '%s' backup mode", plan.Mode)
+	case len(t.IncludeDatabases) != 0 || len(t.ExcludeDatabases) != 0 || len(t.ExcludeCollections) != 0:
+		return errors.Errorf("'%s' backup mode exports the listed collections, it can't include or exclude others", plan.Mode)
+	case plan.Scan != nil || plan.Standby != nil:
+		return errors.New("scan and standby restore a mongodump archive, they can't be used with export")
+	}
+	if e.Sort != "" {
+		var doc bson.D
+		if err := bson.UnmarshalExtJSON([]byte(e.Sort), false, &doc); err != nil {
+			return errors.Wrapf(err, "invalid export sort %v", e.Sort)
+		}
+	}
+	return nil
+}
+
+// exportCollections returns the collections of the export plan.
+func exportCollections(plan config.Plan) []string {
+	if plan.Export != nil && len(plan.Export.Collections) > 0 {
+		return plan.Export.Collections
+	}
+	return []string{plan.Target.Collection}
+}
+
+// exportExt returns the extension of the files mongoexport writes.
+func exportExt(plan config.Plan) string {
+	if plan.Export != nil && plan.Export.Type == "csv" {
+		return ".csv"
+	}
+	return ".json"
+}
+
+// exportArgs returns the mongoexport arguments writing collection to file.
+func exportArgs(c *dumpConfig, collection string, file string) []string {
+	t := c.plan.Target
+	e := c.plan.Export
+	if e == nil {
+		e = &config.Export{}
+	}
+	args := []string{"--out=" + file}
+	if t.Uri != "" {
+		args = append(args, "--uri", uriForDatabase(t.Uri, t.Database))
+	} else {
+		args = append(args, hostArgs(t)...)
+		args = append(args, tlsArgs(t)...)
+		if t.Username != "" && t.Password != "" {
+			args = append(args, "-u", t.Username, "-p", t.Password)
+		}
+		if rp := t.ReadPreference; rp != nil {
+			args = append(args, "--readPreference", readPreferenceArg(rp))
+		}
+	}
+	args = append(args, "--db", t.Database, "--collection", collection)
+	if e.Type == "csv" {
+		args = append(args, "--type", "csv")
+	}
+	if len(e.Fields) > 0 {
+		args = append(args, "--fields", strings.Join(e.Fields, ","))
+	}
+	if t.Query != "" {
+		args = append(args, "--query", string(t.Query))
+	}
+	if e.Sort != "" {
+		args = append(args, "--sort", string(e.Sort))
+	}
+	if e.Limit > 0 {
+		args = append(args, "--limit", fmt.Sprint(e.Limit))
+	}
+	if e.JSONArray {
+		args = append(args, "--jsonArray")
+	}
+	if e.NoHeaderLine {
+		args = append(args, "--noHeaderLine")
+	}
+	if t.ForceTableScan {
+		args = append(args, "--forceTableScan")
+	}
+	return append(args, config.SplitParams(t.Params)...)
+}
+
+// dumpExport runs mongoexport for each collection of the plan. A single
+// collection is stored as <plan>-<ts>.json or .csv, several as a tar of
+// <database>.<collection> files, gzipped unless the pipeline compresses.
+func dumpExport(ctx context.Context, c *dumpConfig, compress bool) (string, string, error) {
+	ext := exportExt(c.plan)
+	dir := fmt.Sprintf("%v/%v-%v.export", c.tmpPath, c.name, c.ts.Unix())
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", "", errors.Wrapf(err, "creating %v failed", dir)
+	}
+	defer os.RemoveAll(dir)
+
+	dctx, cancel := withTimeout(ctx, c.plan.Scheduler.DumpTimeout())
+	defer cancel()
+
+	collections := exportCollections(c.plan)
+	var output []byte
+	files := make([]string, 0, len(collections))
+	for _, coll := range collections {
+		file := filepath.Join(dir, c.plan.Target.Database+"."+coll+ext)
+		args := exportArgs(c, coll, file)
+		log.WithField("plan", c.name).Debugf("export cmd: mongoexport %v", strings.Join(maskArgs(args), " "))
+		out, err := combinedOutput(dctx, exec.Command("mongoexport", args...))
+		output = append(output, out...)
+		if err != nil {
+			return "", "", errors.Wrapf(err, "mongoexport of %v log %v", coll, strings.Replace(string(out), "\n", " ", -1))
+		}
+		files = append(files, file)
+	}
+
+	sc := *c
+	sc.source = dir
+	if len(files) == 1 {
+		sc.source = files[0]
+	}
+	archive, mlog, err := dumpSource(dctx, &sc, compress)
+	if err != nil {
+		return "", "", err
+	}
+	logToFile(mlog, output)
+	return archive, mlog, nil
+}
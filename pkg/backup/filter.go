@@ -0,0 +1,127 @@
+package backup
+
+import (
+	"context"
+	"path"
+	"regexp"
+	"strings"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"github.com/stefanprodan/mgob/pkg/config"
+)
+
+// skipDatabase tells if dbName is left out by the include and exclude lists of
+// the target, the exclude list wins when a database is in both.
+func skipDatabase(target config.Target, dbName string) bool {
+	for _, excluded := range target.ExcludeDatabases {
+		if matchName(excluded, dbName) {
+			return true
+		}
+	}
+	if len(target.IncludeDatabases) == 0 {
+		return false
+	}
+	// the data keys are needed to read the encrypted fields of the included databases
+	if target.FieldEncryption != nil {
+		if kv, _ := target.FieldEncryption.KeyVault(); kv == dbName {
+			return false
+		}
+	}
+	for _, included := range target.IncludeDatabases {
+		if matchName(included, dbName) {
+			return false
+		}
+	}
+	return true
+}
+
+// isPattern tells if an include or exclude entry is a regex, starting with ^,
+// or a glob with *, ? or [ instead of a name.
+func isPattern(entry string) bool {
+	return strings.HasPrefix(entry, "^") || strings.ContainsAny(entry, "*?[")
+}
+
+// matchName matches a database or collection name against an include or
+// exclude entry. Invalid patterns match nothing, checkPatterns reports them
+// before the run.
+func matchName(entry string, name string) bool {
+	switch {
+	case strings.HasPrefix(entry, "^"):
+		re, err := regexp.Compile(entry)
+		return err == nil && re.MatchString(name)
+	case isPattern(entry):
+		ok, err := path.Match(entry, name)
+		return err == nil && ok
+	default:
+		return entry == name
+	}
+}
+
+// checkPatterns validates the regexes and globs of the database and collection lists.
+func checkPatterns(target config.Target) error {
+	entries := append(append([]string{}, target.IncludeDatabases...), target.ExcludeDatabases...)
+	for _, entry := range append(entries, target.ExcludeCollections...) {
+		switch {
+		case strings.HasPrefix(entry, "^"):
+			if _, err := regexp.Compile(entry); err != nil {
+				return errors.Wrapf(err, "invalid regex %v", entry)
+			}
+		case isPattern(entry):
+			if _, err := path.Match(entry, ""); err != nil {
+				return errors.Wrapf(err, "invalid glob %v", entry)
+			}
+		}
+	}
+	return nil
+}
+
+// expandCollections returns the excluded collections of the dumped database,
+// the patterns of excludeCollections are replaced by the collections they match.
+func expandCollections(ctx context.Context, c *dumpConfig) ([]string, error) {
+	entries := c.plan.Target.ExcludeCollections
+	patterns := false
+	for _, entry := range entries {
+		patterns = patterns || isPattern(entry)
+	}
+	if !patterns {
+		return entries, nil
+	}
+	if c.database == "" {
+		return nil, errors.New("excludeCollections patterns require a database")
+	}
+	if c.plan.Target.Uri == "" {
+		return nil, errors.New("excludeCollections patterns require a target uri")
+	}
+
+	lctx, cancel := context.WithTimeout(ctx, mongodbDatabaseListTimeout)
+	defer cancel()
+	client, err := mongo.Connect(lctx, options.Client().ApplyURI(c.plan.Target.Uri))
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to connect to MongoDB %s", redactUri(c.plan.Target.Uri))
+	}
+	defer client.Disconnect(context.Background())
+	names, err := client.Database(c.database).ListCollectionNames(lctx, bson.D{})
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to list the collections of %v", c.database)
+	}
+
+	excluded := make([]string, 0)
+	for _, entry := range entries {
+		if !isPattern(entry) {
+			excluded = append(excluded, entry)
+			continue
+		}
+		for _, name := range names {
+			if matchName(entry, name) {
+				excluded = append(excluded, name)
+			}
+		}
+	}
+	log.WithField("plan", c.name).Debugf("Excluded collections %v", strings.Join(excluded, ", "))
+	return excluded, nil
+}
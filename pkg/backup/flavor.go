@@ -0,0 +1,123 @@
+package backup
+
+import (
+	"context"
+	"net/url"
+	"strings"
+
+	"github.com/pkg/errors"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+
+	"github.com/stefanprodan/mgob/pkg/config"
+)
+
+// compatible tells if the target is a MongoDB API compatible service.
+func compatible(t config.Target) bool {
+	return t.Flavor == config.FlavorDocumentDB || t.Flavor == config.FlavorCosmosDB
+}
+
+// checkFlavor validates the target flavor, the options relying on commands
+// the service doesn't implement are rejected.
+func checkFlavor(plan config.Plan) error {
+	t := plan.Target
+	switch t.Flavor {
+	case "", config.FlavorMongoDB:
+		return nil
+	case config.FlavorDocumentDB, config.FlavorCosmosDB:
+	default:
+		return errors.Errorf("unknown target flavor '%s', mongodb, documentdb or cosmosdb", t.Flavor)
+	}
+	switch plan.Mode {
+	case "", config.BackupModeSingle, config.BackupModeDatabase, config.BackupModeSample, config.BackupModeMigrate, config.BackupModeExport:
+	default:
+		return errors.Errorf("'%s' backup mode can't be used with a %s target", plan.Mode, t.Flavor)
+	}
+	switch {
+	case t.Flavor == config.FlavorDocumentDB && t.CAFile == "" && uriOption(t.Uri, "tlsCAFile", "sslCAFile") == "":
+		return errors.New("documentdb targets require target.caFile, the RDS CA bundle")
+	case t.PointInTime || plan.PITR != nil:
+		return errors.Errorf("%s has no oplog, pointInTime and pitr can't be used", t.Flavor)
+	case t.DbHash:
+		return errors.Errorf("%s has no dbHash command, dbHash can't be used", t.Flavor)
+	case plan.Health != nil:
+		return errors.Errorf("%s has no replSetGetStatus command, health can't be used", t.Flavor)
+	case plan.Throttle != nil && t.Flavor == config.FlavorCosmosDB:
+		return errors.Errorf("%s has no currentOp command, throttle can't be used", t.Flavor)
+	}
+	return nil
+}
+
+// UriWithFlavor adds the TLS options of the target and, for the compatible
+// services, disables retryable writes. Options the uri sets are kept.
+func UriWithFlavor(t config.Target) string {
+	q := url.Values{}
+	if (compatible(t) || t.CAFile != "") && uriOption(t.Uri, "tls", "ssl") == "" {
+		q.Set("tls", "true")
+	}
+	if t.CAFile != "" && uriOption(t.Uri, "tlsCAFile", "sslCAFile") == "" {
+		q.Set("tlsCAFile", t.CAFile)
+	}
+	if compatible(t) && uriOption(t.Uri, "retryWrites") == "" {
+		q.Set("retryWrites", "false")
+	}
+	return uriWithOptions(t.Uri, q)
+}
+
+// uriOption returns the value of the first of names set in the uri query,
+// option names are case insensitive.
+func uriOption(uri string, names ...string) string {
+	i := strings.Index(uri, "?")
+	if i < 0 {
+		return ""
+	}
+	q, err := url.ParseQuery(uri[i+1:])
+	if err != nil {
+		return ""
+	}
+	for _, name := range names {
+		for k, v := range q {
+			if strings.EqualFold(k, name) && len(v) > 0 {
+				return v[0]
+			}
+		}
+	}
+	return ""
+}
+
+// tlsArgs returns the mongodump TLS flags of a host/port target.
+func tlsArgs(t config.Target) []string {
+	if !compatible(t) && t.CAFile == "" {
+		return nil
+	}
+	args := []string{"--ssl"}
+	if t.CAFile != "" {
+		args = append(args, "--sslCAFile", t.CAFile)
+	}
+	return args
+}
+
+// listDatabaseNames lists the databases of the target. The compatible
+// services get a plain listDatabases, some reject the nameOnly the driver
+// sends, and their system databases can't be dumped.
+func listDatabaseNames(ctx context.Context, client *mongo.Client, t config.Target) ([]string, error) {
+	if !compatible(t) {
+		return client.ListDatabaseNames(ctx, bson.D{})
+	}
+	var out struct {
+		Databases []struct {
+			Name string `bson:"name"`
+		} `bson:"databases"`
+	}
+	if err := client.Database("admin").RunCommand(ctx, bson.D{{Key: "listDatabases", Value: 1}}).Decode(&out); err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(out.Databases))
+	for _, db := range out.Databases {
+		if db.Name == "admin" || db.Name == "config" || db.Name == "local" {
+			continue
+		}
+		names = append(names, db.Name)
+	}
+	return names, nil
+}
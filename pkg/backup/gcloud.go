@@ -1,37 +1,191 @@
 package backup
 
 import (
+	"context"
 	"fmt"
+	"io"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
 	"strings"
 	"time"
 
-	"github.com/codeskyblue/go-sh"
 	"github.com/pkg/errors"
 
 	"github.com/stefanprodan/mgob/pkg/config"
 )
 
-func gCloudUpload(file string, plan config.Plan) (string, error) {
+type gCloudDestination struct {
+	plan config.Plan
+}
+
+func newGCloudDestination(plan config.Plan, conf *config.AppConfig, ts time.Time) Destination {
+	if plan.GCloud == nil {
+		return nil
+	}
+	return &gCloudDestination{plan: plan}
+}
+
+func (d *gCloudDestination) Name() string {
+	return "GCloud"
+}
+
+func (d *gCloudDestination) Upload(ctx context.Context, file string) (string, error) {
+	output, err := gCloudUpload(ctx, file, d.plan)
+	if err != nil {
+		return "", err
+	}
+	if err := d.checksum(ctx, file); err != nil {
+		return "", err
+	}
+	return output, nil
+}
+
+// Stream uploads the data read from r without a checksum check, there is no local copy to compare.
+func (d *gCloudDestination) Stream(ctx context.Context, name string, r io.Reader) (string, error) {
+	return gCloudCopy(ctx, "-", fmt.Sprintf("gs://%v/%v", d.plan.GCloud.Bucket, name), r, d.plan)
+}
+
+func (d *gCloudDestination) List(ctx context.Context) ([]Object, error) {
+	if err := gCloudAuth(ctx, d.plan); err != nil {
+		return nil, err
+	}
+	root := fmt.Sprintf("gs://%v/", d.plan.GCloud.Bucket)
+	output, err := runCmd(ctx, "gsutil", "ls", "-l", root+"**")
+	if err != nil {
+		return nil, errors.Wrapf(err, "GCloud listing %v failed", root)
+	}
+	objects := make([]Object, 0)
+	//    1234  2021-01-01T00:00:00Z  gs://bucket/name.gz
+	for _, line := range strings.Split(output, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 3 && strings.HasPrefix(fields[2], root) {
+			size, _ := strconv.ParseInt(fields[0], 10, 64)
+			objects = append(objects, Object{Name: strings.TrimPrefix(fields[2], root), Size: size})
+		}
+	}
+	return objects, nil
+}
+
+func (d *gCloudDestination) Delete(ctx context.Context, name string) error {
+	if err := gCloudAuth(ctx, d.plan); err != nil {
+		return err
+	}
+	if _, err := runCmd(ctx, "gsutil", "rm", fmt.Sprintf("gs://%v/%v", d.plan.GCloud.Bucket, name)); err != nil {
+		return errors.Wrapf(err, "GCloud deleting %v from gs://%v failed", name, d.plan.GCloud.Bucket)
+	}
+	return nil
+}
+
+var (
+	gsContentLength = regexp.MustCompile(`Content-Length:\s+(\d+)`)
+	gsCRC32C        = regexp.MustCompile(`Hash \(crc32c\):\s+(\S+)`)
+)
+
+func (d *gCloudDestination) Verify(ctx context.Context, file string) error {
+	if err := gCloudAuth(ctx, d.plan); err != nil {
+		return err
+	}
+	object := fmt.Sprintf("gs://%v/%v", d.plan.GCloud.Bucket, filepath.Base(file))
+	output, err := runCmd(ctx, "gsutil", "stat", object)
+	if err != nil {
+		return errors.Wrapf(err, "GCloud verifying %v failed", object)
+	}
+	m := gsContentLength.FindStringSubmatch(output)
+	if m == nil {
+		return errors.Errorf("GCloud verifying %v failed, no size in %v", object, output)
+	}
+	size, _ := strconv.ParseInt(m[1], 10, 64)
+	if err := checkSize(file, size); err != nil {
+		return err
+	}
+	return checkCRC32C(file, object, output)
+}
+
+// checksum compares the crc32c GCS computed for the uploaded copy of file with the local one.
+func (d *gCloudDestination) checksum(ctx context.Context, file string) error {
+	object := fmt.Sprintf("gs://%v/%v", d.plan.GCloud.Bucket, filepath.Base(file))
+	output, err := runCmd(ctx, "gsutil", "stat", object)
+	if err != nil {
+		return errors.Wrapf(err, "GCloud reading the checksum of %v failed", object)
+	}
+	return checkCRC32C(file, object, output)
+}
+
+func checkCRC32C(file string, object string, stat string) error {
+	m := gsCRC32C.FindStringSubmatch(stat)
+	if m == nil {
+		return errors.Errorf("GCloud object %v has no crc32c in %v", object, stat)
+	}
+	sums, err := digestFile(file)
+	if err != nil {
+		return err
+	}
+	return checkDigest(file, "GCloud crc32c", b64(sums.CRC32C), m[1])
+}
+
+func (d *gCloudDestination) Download(ctx context.Context, file string, dst string) error {
+	if err := gCloudAuth(ctx, d.plan); err != nil {
+		return err
+	}
+	object := fmt.Sprintf("gs://%v/%v", d.plan.GCloud.Bucket, filepath.Base(file))
+	if _, err := runCmd(ctx, "gsutil", "cp", object, dst); err != nil {
+		return errors.Wrapf(err, "GCloud downloading %v failed", object)
+	}
+	return nil
+}
+
+func (d *gCloudDestination) Link(ctx context.Context, file string, ttl time.Duration) (string, error) {
+	object := fmt.Sprintf("gs://%v/%v", d.plan.GCloud.Bucket, filepath.Base(file))
+	output, err := runCmd(ctx, "gsutil", "signurl", "-d", fmt.Sprintf("%vm", int64(ttl.Minutes())),
+		d.plan.GCloud.KeyFilePath, object)
+	if err != nil {
+		return "", errors.Wrapf(err, "GCloud signing %v failed", object)
+	}
+	// URL  HTTP Method  Expiration  Signed URL
+	lines := strings.Split(output, "\n")
+	fields := strings.Split(lines[len(lines)-1], "\t")
+	url := strings.TrimSpace(fields[len(fields)-1])
+	if !strings.HasPrefix(url, "https://") {
+		return "", errors.Errorf("GCloud signing %v failed, no URL in %v", object, output)
+	}
+	return url, nil
+}
 
-	register := fmt.Sprintf("gcloud auth activate-service-account --key-file=%v",
-		plan.GCloud.KeyFilePath)
+func gCloudAuth(ctx context.Context, plan config.Plan) error {
+	register := exec.Command("gcloud", "auth", "activate-service-account", "--key-file="+plan.GCloud.KeyFilePath)
 
-	_, err := sh.Command("/bin/sh", "-c", register).CombinedOutput()
+	_, err := combinedOutput(ctx, register)
 	if err != nil {
-		return "", errors.Wrapf(err, "gcloud auth for plan %v failed", plan.Name)
+		return errors.Wrapf(err, "gcloud auth for plan %v failed", plan.Name)
+	}
+	return nil
+}
+
+func gCloudUpload(ctx context.Context, file string, plan config.Plan) (string, error) {
+	return gCloudCopy(ctx, file, "gs://"+plan.GCloud.Bucket+"/", nil, plan)
+}
+
+// gCloudCopy uploads src to dst, src is - to upload the data read from stdin.
+func gCloudCopy(ctx context.Context, src string, dst string, stdin io.Reader, plan config.Plan) (string, error) {
+
+	if err := gCloudAuth(ctx, plan); err != nil {
+		return "", err
 	}
 
-	upload := fmt.Sprintf("gsutil cp %v gs://%v",
-		file, plan.GCloud.Bucket)
+	args := append(gCloudHeaders(plan), "cp", src, dst)
 
-	result, err := sh.Command("/bin/sh", "-c", upload).SetTimeout(time.Duration(plan.Scheduler.Timeout) * time.Minute).CombinedOutput()
+	cmd := exec.Command("gsutil", args...)
+	cmd.Stdin = stdin
+	result, err := combinedOutput(ctx, cmd)
 	output := ""
 	if len(result) > 0 {
 		output = strings.Replace(string(result), "\n", " ", -1)
 	}
 
 	if err != nil {
-		return "", errors.Wrapf(err, "GCloud uploading %v to gs://%v failed %v", file, plan.GCloud.Bucket, output)
+		return "", errors.Wrapf(err, "GCloud uploading %v to %v failed %v", src, dst, output)
 	}
 
 	if strings.Contains(output, "<ERROR>") {
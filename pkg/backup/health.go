@@ -0,0 +1,176 @@
+package backup
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.mongodb.org/mongo-driver/mongo/readpref"
+	"go.mongodb.org/mongo-driver/x/mongo/driver/connstring"
+
+	"github.com/stefanprodan/mgob/pkg/config"
+)
+
+var healthCheckTimeout = 1 * time.Minute
+
+// UnhealthyError is returned when the backup is skipped because the target
+// failed the plan health thresholds.
+type UnhealthyError struct {
+	Reasons []string
+}
+
+func (e *UnhealthyError) Error() string {
+	return "target unhealthy: " + strings.Join(e.Reasons, ", ")
+}
+
+// IsUnhealthy reports whether the run was skipped by the health gate.
+func IsUnhealthy(err error) bool {
+	_, ok := errors.Cause(err).(*UnhealthyError)
+	return ok
+}
+
+type replMember struct {
+	Name       string    `bson:"name"`
+	StateStr   string    `bson:"stateStr"`
+	OptimeDate time.Time `bson:"optimeDate"`
+	Self       bool      `bson:"self"`
+}
+
+type serverLoad struct {
+	GlobalLock struct {
+		CurrentQueue struct {
+			Total int64 `bson:"total"`
+		} `bson:"currentQueue"`
+	} `bson:"globalLock"`
+	Connections struct {
+		Current int64 `bson:"current"`
+	} `bson:"connections"`
+}
+
+// healthGate checks the target until it is healthy, the delay action retries
+// the check before giving up with an UnhealthyError.
+func healthGate(ctx context.Context, c *dumpConfig) error {
+	h := c.plan.Health
+	if c.plan.Target.Uri == "" {
+		return errors.New("health gate requires a target uri")
+	}
+	if h.Action != "" && h.Action != config.HealthSkip && h.Action != config.HealthDelay {
+		return errors.Errorf("invalid health action %v", h.Action)
+	}
+
+	for attempt := 0; ; attempt++ {
+		reasons, err := checkHealth(ctx, c.plan.Target.Uri, h)
+		if err != nil {
+			return err
+		}
+		if len(reasons) == 0 {
+			return nil
+		}
+		if h.Action != config.HealthDelay || attempt >= h.Retries {
+			return &UnhealthyError{Reasons: reasons}
+		}
+
+		delay := time.Duration(h.Delay) * time.Minute
+		if delay == 0 {
+			delay = time.Minute
+		}
+		log.WithField("plan", c.name).Warnf("Target unhealthy %v, retrying in %v", strings.Join(reasons, ", "), delay)
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// targetReadPref returns the read preference of the uri, primary when unset.
+func targetReadPref(uri string) *readpref.ReadPref {
+	if cs, err := connstring.Parse(uri); err == nil && cs.ReadPreference != "" {
+		var maxStaleness time.Duration
+		if cs.MaxStalenessSet {
+			maxStaleness = cs.MaxStaleness
+		}
+		if p, err := newReadPref(cs.ReadPreference, cs.ReadPreferenceTagSets, maxStaleness); err == nil {
+			return p
+		}
+	}
+	return readpref.Primary()
+}
+
+// checkHealth returns the thresholds the member selected by the uri read preference exceeds.
+func checkHealth(ctx context.Context, uri string, h *config.Health) ([]string, error) {
+	hctx, cancel := context.WithTimeout(ctx, healthCheckTimeout)
+	defer cancel()
+
+	client, err := mongo.Connect(hctx, options.Client().ApplyURI(uri))
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to MongoDB %s: %s", redactUri(uri), err)
+	}
+	defer client.Disconnect(context.Background())
+
+	// run the checks on the member mongodump reads from
+	admin := client.Database("admin")
+	cmdOpts := options.RunCmd().SetReadPreference(targetReadPref(uri))
+
+	reasons := make([]string, 0)
+	var repl struct {
+		Members []replMember `bson:"members"`
+	}
+	err = admin.RunCommand(hctx, bson.D{{Key: "replSetGetStatus", Value: 1}}, cmdOpts).Decode(&repl)
+	if cmdErr, ok := err.(mongo.CommandError); ok && cmdErr.Code == 76 {
+		// standalone, no replication checks
+		err = nil
+		if h.Member == "secondary" {
+			reasons = append(reasons, "target is not a replica set member")
+		}
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "replSetGetStatus failed")
+	}
+
+	var self, primary *replMember
+	for i := range repl.Members {
+		m := &repl.Members[i]
+		if m.Self {
+			self = m
+		}
+		if m.StateStr == "PRIMARY" {
+			primary = m
+		}
+	}
+	if self != nil {
+		if self.StateStr != "PRIMARY" && self.StateStr != "SECONDARY" {
+			reasons = append(reasons, fmt.Sprintf("member %v is %v", self.Name, self.StateStr))
+		} else if h.Member != "" && !strings.EqualFold(h.Member, self.StateStr) {
+			reasons = append(reasons, fmt.Sprintf("member %v is %v not %v", self.Name, self.StateStr, h.Member))
+		}
+		if h.MaxLag > 0 && self.StateStr == "SECONDARY" {
+			if primary == nil {
+				reasons = append(reasons, "replica set has no primary")
+			} else if lag := primary.OptimeDate.Sub(self.OptimeDate); lag > time.Duration(h.MaxLag)*time.Second {
+				reasons = append(reasons, fmt.Sprintf("member %v lags %v", self.Name, lag))
+			}
+		}
+	}
+
+	if h.MaxQueue > 0 || h.MaxConnections > 0 {
+		var load serverLoad
+		if err := admin.RunCommand(hctx, bson.D{{Key: "serverStatus", Value: 1}}, cmdOpts).Decode(&load); err != nil {
+			return nil, errors.Wrap(err, "serverStatus failed")
+		}
+		if q := load.GlobalLock.CurrentQueue.Total; h.MaxQueue > 0 && q > h.MaxQueue {
+			reasons = append(reasons, fmt.Sprintf("%v operations queued", q))
+		}
+		if n := load.Connections.Current; h.MaxConnections > 0 && n > h.MaxConnections {
+			reasons = append(reasons, fmt.Sprintf("%v connections open", n))
+		}
+	}
+
+	return reasons, nil
+}
@@ -0,0 +1,24 @@
+package backup
+
+import (
+	"context"
+	"strings"
+
+	"github.com/pkg/errors"
+
+	"github.com/stefanprodan/mgob/pkg/config"
+)
+
+// RunHook runs command with a timeout in minutes and returns its output,
+// the hooks of the backup sets quiesce the application.
+func RunHook(ctx context.Context, command config.Command, timeout int) (string, error) {
+	hctx, cancel := withTimeout(ctx, timeout)
+	defer cancel()
+
+	output, err := combinedOutput(hctx, userCommand(command))
+	out := strings.Replace(strings.TrimSpace(string(output)), "\n", " ", -1)
+	if err != nil {
+		return out, errors.Wrapf(err, "hook %v failed %v", command, out)
+	}
+	return out, nil
+}
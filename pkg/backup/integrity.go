@@ -0,0 +1,103 @@
+package backup
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"hash"
+	"hash/crc32"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// fileDigests are the checksums of a local file the destinations compute too.
+type fileDigests struct {
+	SHA256 []byte
+	CRC32C []byte
+	MD5    []byte
+}
+
+func digestFile(file string) (*fileDigests, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, errors.Wrapf(err, "opening %v failed", file)
+	}
+	defer f.Close()
+
+	s, c, m := sha256.New(), crc32.New(crc32.MakeTable(crc32.Castagnoli)), md5.New()
+	if _, err := io.Copy(io.MultiWriter(s, c, m), f); err != nil {
+		return nil, errors.Wrapf(err, "reading %v failed", file)
+	}
+	return &fileDigests{SHA256: s.Sum(nil), CRC32C: c.Sum(nil), MD5: m.Sum(nil)}, nil
+}
+
+// compositeDigest is the checksum S3 reports for multipart uploads: the hash of
+// the concatenated part hashes. It returns the raw hash and the number of parts.
+func compositeDigest(file string, partSize int64, newHash func() hash.Hash) ([]byte, int, error) {
+	if partSize <= 0 {
+		return nil, 0, errors.Errorf("invalid part size %v", partSize)
+	}
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, 0, errors.Wrapf(err, "opening %v failed", file)
+	}
+	defer f.Close()
+
+	all, parts := newHash(), 0
+	for {
+		h := newHash()
+		n, err := io.CopyN(h, f, partSize)
+		if n > 0 {
+			all.Write(h.Sum(nil))
+			parts++
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, 0, errors.Wrapf(err, "reading %v failed", file)
+		}
+	}
+	return all.Sum(nil), parts, nil
+}
+
+// splitParts splits an S3 checksum or ETag into the value and the number of
+// parts, 0 when the object was uploaded in a single request.
+func splitParts(v string) (string, int) {
+	v = strings.Trim(strings.TrimSpace(v), `"`)
+	i := strings.LastIndex(v, "-")
+	if i < 0 {
+		return v, 0
+	}
+	n, err := strconv.Atoi(v[i+1:])
+	if err != nil {
+		return v, 0
+	}
+	return v[:i], n
+}
+
+func checkDigest(file string, kind string, local string, remote string) error {
+	if local != remote {
+		return errors.Errorf("%v mismatch for %v local %v remote %v", kind, file, local, remote)
+	}
+	return nil
+}
+
+func b64(b []byte) string {
+	return base64.StdEncoding.EncodeToString(b)
+}
+
+// minioPartSize is the part size mc picks for an upload of size bytes,
+// 16MiB until the object needs more than 10000 parts.
+func minioPartSize(size int64) int64 {
+	const min, maxParts = 16 << 20, 10000
+	parts := (size/maxParts + min - 1) / min
+	if parts < 1 {
+		parts = 1
+	}
+	return parts * min
+}
@@ -1,22 +1,36 @@
 package backup
 
 import (
+	"context"
 	"fmt"
 	"io/ioutil"
 	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sort"
 	"strings"
 	"time"
 
-	"github.com/codeskyblue/go-sh"
 	"github.com/pkg/errors"
 	log "github.com/sirupsen/logrus"
-)
 
-func dump(c *dumpConfig) (string, string, error) {
+	"github.com/stefanprodan/mgob/pkg/clock"
+	"github.com/stefanprodan/mgob/pkg/config"
+)
 
-	archive := fmt.Sprintf("%v/%v-%v.gz", c.tmpPath, c.name, c.ts.Unix())
+func dump(ctx context.Context, c *dumpConfig, gzip bool) (string, string, error) {
+	excluded, err := expandCollections(ctx, c)
+	if err != nil {
+		return "", "", err
+	}
+	expanded := *c
+	expanded.plan.Target.ExcludeCollections = excluded
+	archive, dir, args := dumpArgs(&expanded, gzip)
 	mlog := fmt.Sprintf("%v/%v-%v.log", c.tmpPath, c.name, c.ts.Unix())
-	dump := fmt.Sprintf("mongodump --archive=%v --gzip ", archive)
+	if dir != "" && dir != archive {
+		defer os.RemoveAll(dir)
+	}
 
 	log.WithFields(log.Fields{
 		"database": c.database,
@@ -25,52 +39,144 @@ func dump(c *dumpConfig) (string, string, error) {
 		"planDir":  c.planDir,
 	}).Info("starting dump")
 
+	log.WithField("plan", c.name).Debugf("dump cmd: mongodump %v", strings.Join(maskArgs(args), " "))
+	dctx, cancel := withTimeout(ctx, c.plan.Scheduler.DumpTimeout())
+	defer cancel()
+	var output []byte
+	if c.plan.Throttle != nil {
+		output, err = throttledOutput(dctx, c, exec.Command("mongodump", args...))
+	} else {
+		output, err = combinedOutput(dctx, exec.Command("mongodump", args...))
+	}
+	if err != nil {
+		ex := ""
+		if len(output) > 0 {
+			ex = strings.Replace(string(output), "\n", " ", -1)
+		}
+		// Try and clean up tmp file after an error
+		os.RemoveAll(archive)
+		return "", "", errors.Wrapf(err, "mongodump log %v", ex)
+	}
+	logToFile(mlog, output)
+
+	if dir != "" && dir != archive {
+		if err := tarDir(dctx, dir, archive, gzip); err != nil {
+			os.Remove(archive)
+			return "", "", err
+		}
+	}
+
+	return archive, mlog, nil
+}
+
+// dumpArgs returns the archive mongodump writes, the dump dir of the directory
+// format or empty, and the mongodump arguments. Per collection dumps have the
+// dir as archive, its files are compressed by mongodump.
+func dumpArgs(c *dumpConfig, gzip bool) (string, string, []string) {
+	archive := fmt.Sprintf("%v/%v-%v.gz", c.tmpPath, c.name, c.ts.Unix())
+	args := []string{"--archive=" + archive, "--gzip"}
+	if !gzip {
+		// compression is done by the pipeline
+		archive = fmt.Sprintf("%v/%v-%v.archive", c.tmpPath, c.name, c.ts.Unix())
+		args = []string{"--archive=" + archive}
+	}
+	dir := ""
+	if c.plan.Target.Format == config.DumpFormatDirectory {
+		// the files are left uncompressed, the tar is gzipped as a whole
+		dir = fmt.Sprintf("%v/%v-%v.dump", c.tmpPath, c.name, c.ts.Unix())
+		archive = fmt.Sprintf("%v/%v-%v.tar", c.tmpPath, c.name, c.ts.Unix())
+		if gzip {
+			archive += ".gz"
+		}
+		args = []string{"--out=" + dir}
+		if c.plan.Target.PerCollection {
+			archive = dir
+			if gzip {
+				args = append(args, "--gzip")
+			}
+		}
+	}
+
 	if c.plan.Target.Uri != "" {
 		// using uri (New in version 3.4.6)
 		// host/port/username/password are incompatible with uri
 		// https://docs.mongodb.com/manual/reference/program/mongodump/#cmdoption-mongodump-uri
-		dump += fmt.Sprintf(`--uri "%v" `, c.plan.Target.Uri)
+		args = append(args, "--uri", uriForDatabase(c.plan.Target.Uri, c.database))
 	} else {
 		// use older host/port
-		dump += fmt.Sprintf("--host %v --port %v ", c.plan.Target.Host, c.plan.Target.Port)
+		args = append(args, hostArgs(c.plan.Target)...)
+		args = append(args, tlsArgs(c.plan.Target)...)
 
 		if c.plan.Target.Username != "" && c.plan.Target.Password != "" {
-			dump += fmt.Sprintf(`-u "%v" -p "%v" `, c.plan.Target.Username, c.plan.Target.Password)
+			args = append(args, "-u", c.plan.Target.Username, "-p", c.plan.Target.Password)
+		}
+		// uri targets carry it in the connection string
+		if rp := c.plan.Target.ReadPreference; rp != nil {
+			args = append(args, "--readPreference", readPreferenceArg(rp))
 		}
 	}
 
 	if c.database != "" {
-		dump += fmt.Sprintf("--db %v ", c.database)
+		args = append(args, "--db", c.database)
 	}
 	if c.plan.Target.Collection != "" {
-		dump += fmt.Sprintf("--collection %v ", c.plan.Target.Collection)
+		args = append(args, "--collection", c.plan.Target.Collection)
+	}
+	if c.plan.Target.Query != "" {
+		args = append(args, "--query", string(c.plan.Target.Query))
+	}
+	if c.plan.Target.ReadConcern != "" {
+		args = append(args, "--readConcern", c.plan.Target.ReadConcern)
+	}
+	if c.plan.Target.ForceTableScan {
+		args = append(args, "--forceTableScan")
+	}
+	if n := c.plan.Target.NumParallelCollections; n > 0 {
+		args = append(args, fmt.Sprintf("--numParallelCollections=%v", n))
+	}
+	if c.plan.Target.ViewsAsCollections {
+		args = append(args, "--viewsAsCollections")
+	}
+	if c.plan.Target.DumpDbUsersAndRoles && c.database != "" {
+		args = append(args, "--dumpDbUsersAndRoles")
+	}
+	for _, prefix := range c.plan.Target.ExcludeCollectionsWithPrefix {
+		args = append(args, "--excludeCollectionsWithPrefix", prefix)
 	}
 
 	for _, excludeCollection := range c.plan.Target.ExcludeCollections {
 		if excludeCollection != "" {
-			dump += fmt.Sprintf("--excludeCollection %v ", excludeCollection)
+			args = append(args, "--excludeCollection", excludeCollection)
 		}
 	}
 
-	if c.plan.Target.Params != "" {
-		dump += fmt.Sprintf("%v", c.plan.Target.Params)
+	if c.plan.Target.PointInTime {
+		// the oplog entries written during the dump make it a consistent snapshot
+		args = append(args, "--oplog")
 	}
 
-	// TODO: mask password
-	log.Debugf("dump cmd: %v", dump)
-	output, err := sh.Command("/bin/sh", "-c", dump).SetTimeout(time.Duration(c.plan.Scheduler.Timeout) * time.Minute).CombinedOutput()
-	if err != nil {
-		ex := ""
-		if len(output) > 0 {
-			ex = strings.Replace(string(output), "\n", " ", -1)
+	args = append(args, config.SplitParams(c.plan.Target.Params)...)
+	return archive, dir, args
+}
+
+// maskArgs hides the passwords and the uri credentials of mongodump arguments.
+func maskArgs(args []string) []string {
+	masked := make([]string, len(args))
+	for i, arg := range args {
+		switch {
+		case i > 0 && (args[i-1] == "-p" || args[i-1] == "--password"):
+			masked[i] = "***"
+		case i > 0 && args[i-1] == "--uri":
+			masked[i] = redactUri(arg)
+		case strings.HasPrefix(arg, "--password="):
+			masked[i] = "--password=***"
+		case strings.HasPrefix(arg, "--uri="):
+			masked[i] = "--uri=" + redactUri(strings.TrimPrefix(arg, "--uri="))
+		default:
+			masked[i] = arg
 		}
-		// Try and clean up tmp file after an error
-		os.Remove(archive)
-		return "", "", errors.Wrapf(err, "mongodump log %v", ex)
 	}
-	logToFile(mlog, output)
-
-	return archive, mlog, nil
+	return masked
 }
 
 func logToFile(file string, data []byte) error {
@@ -84,27 +190,101 @@ func logToFile(file string, data []byte) error {
 	return nil
 }
 
-func applyRetention(path string, retention int) error {
-	gz := fmt.Sprintf("cd %v && rm -f $(ls -1t *.gz *.gz.encrypted | tail -n +%v)", path, retention+1)
-	err := sh.Command("/bin/sh", "-c", gz).Run()
-	if err != nil {
-		return errors.Wrapf(err, "removing old gz files from %v failed", path)
+// retained is told the files the local retention removed from a plan dir.
+var retained func(plan string, files []string)
+
+// OnRetention sets f to be called with the files the local retention removes,
+// e.g. to drop them from the catalog.
+func OnRetention(f func(plan string, files []string)) {
+	retained = f
+}
+
+// retain applies the local retention of the plan of c, timed as the retention phase.
+func retain(ctx context.Context, c *dumpConfig) error {
+	defer recordPhase(ctx, PhaseRetention, clock.Now())
+	return keepBackups(c, c.plan.Scheduler.Retention)
+}
+
+// keepBackups keeps the newest n backups of c in its plan dir.
+func keepBackups(c *dumpConfig, n int) error {
+	removed, err := applyRetention(c.planDir, c.name, n)
+	if len(removed) > 0 && retained != nil {
+		retained(c.plan.Name, removed)
 	}
+	return err
+}
 
-	log.Debug("apply retention")
-	log := fmt.Sprintf("cd %v && rm -f $(ls -1t *.log | tail -n +%v)", path, retention+1)
-	err = sh.Command("/bin/sh", "-c", log).Run()
+// applyRetention keeps the newest retention backups of name in path and
+// returns the removed files. All files sharing a backup prefix (archive,
+// checksum, split parts, log, incremental segments) are removed together, so
+// a full is never removed before its chain.
+func applyRetention(path string, name string, retention int) ([]string, error) {
+	files, err := ioutil.ReadDir(path)
 	if err != nil {
-		return errors.Wrapf(err, "removing old log files from %v failed", path)
+		return nil, errors.Wrapf(err, "reading %v failed", path)
 	}
 
-	return nil
+	backups, stamps := retentionGroups(files, name)
+	log.WithField("plan", name).Debug("apply retention")
+	removed := make([]string, 0)
+	for i := retention; i < len(stamps); i++ {
+		for _, file := range backups[stamps[i]] {
+			if err := os.Remove(filepath.Join(path, file)); err != nil {
+				return removed, errors.Wrapf(err, "removing old file %v from %v failed", file, path)
+			}
+			removed = append(removed, file)
+		}
+	}
+
+	return removed, nil
+}
+
+// retentionGroups groups the files of the backups of name by their unix
+// timestamp and returns the timestamps newest first.
+func retentionGroups(files []os.FileInfo, name string) (map[string][]string, []string) {
+	re := regexp.MustCompile(`^` + regexp.QuoteMeta(name) + `-(\d+)\.`)
+	backups := map[string][]string{}
+	stamps := make([]string, 0)
+	for _, f := range files {
+		m := re.FindStringSubmatch(f.Name())
+		if f.IsDir() || m == nil {
+			continue
+		}
+		if _, ok := backups[m[1]]; !ok {
+			stamps = append(stamps, m[1])
+		}
+		backups[m[1]] = append(backups[m[1]], f.Name())
+	}
+
+	// unix timestamps, newest first
+	sort.Slice(stamps, func(i, j int) bool {
+		if len(stamps[i]) != len(stamps[j]) {
+			return len(stamps[i]) > len(stamps[j])
+		}
+		return stamps[i] > stamps[j]
+	})
+
+	return backups, stamps
 }
 
 // TmpCleanup remove files older than one day
 func TmpCleanup(path string) error {
-	rm := fmt.Sprintf("find %v -not -name \"mgob.db\" -mtime +%v -type f -delete", path, 1)
-	err := sh.Command("/bin/sh", "-c", rm).Run()
+	limit := time.Now().Add(-24 * time.Hour)
+	err := filepath.Walk(path, func(file string, fi os.FileInfo, err error) error {
+		if err != nil {
+			// files removed by a running backup meanwhile
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if fi.Mode().IsRegular() && fi.Name() != "mgob.db" && fi.ModTime().Before(limit) {
+			if err := os.Remove(file); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+		return nil
+	})
 	if err != nil {
 		return errors.Wrapf(err, "%v cleanup failed", path)
 	}
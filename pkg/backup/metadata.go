@@ -0,0 +1,163 @@
+package backup
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/stefanprodan/mgob/pkg/config"
+	"github.com/stefanprodan/mgob/pkg/db"
+)
+
+// MetadataVersion is the version of the metadata sidecar format, it is bumped
+// on every change that readers of older sidecars can't ignore.
+const MetadataVersion = 1
+
+// MetadataExt is the extension of the sidecar written next to each artifact.
+const MetadataExt = ".meta.json"
+
+// Metadata describes how an artifact was produced.
+type Metadata struct {
+	Version   int            `json:"version"`
+	Plan      string         `json:"plan"`
+	Mode      string         `json:"mode"`
+	Format    string         `json:"format"`
+	Timestamp time.Time      `json:"timestamp"`
+	Source    MetadataSource `json:"source"`
+	Tools     MetadataTools  `json:"tools"`
+	// Pipeline lists the stages the dump went through, in order
+	Pipeline    []string            `json:"pipeline,omitempty"`
+	Compression string              `json:"compression,omitempty"`
+	Encryption  *MetadataEncryption `json:"encryption,omitempty"`
+	Chain       string              `json:"chain"`
+	Seq         int                 `json:"seq,omitempty"`
+	Oplog       *db.OplogRange      `json:"oplog,omitempty"`
+	Files       []MetadataFile      `json:"files"`
+	Checksum    string              `json:"checksum,omitempty"`
+}
+
+type MetadataSource struct {
+	Uri         string `json:"uri,omitempty"`
+	Host        string `json:"host,omitempty"`
+	Database    string `json:"database,omitempty"`
+	Collection  string `json:"collection,omitempty"`
+	PointInTime bool   `json:"pointInTime,omitempty"`
+	Executor    string `json:"executor,omitempty"`
+}
+
+type MetadataTools struct {
+	Mgob      string `json:"mgob"`
+	Mongodump string `json:"mongodump,omitempty"`
+}
+
+type MetadataEncryption struct {
+	Type       string   `json:"type"`
+	Recipients []string `json:"recipients,omitempty"`
+}
+
+type MetadataFile struct {
+	Name string `json:"name"`
+	Size int64  `json:"size"`
+}
+
+// ReadMetadata loads an artifact sidecar and rejects the ones written by a
+// newer format version.
+func ReadMetadata(file string) (Metadata, error) {
+	var m Metadata
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return m, errors.Wrapf(err, "reading %v failed", file)
+	}
+	if err := json.Unmarshal(data, &m); err != nil {
+		return m, errors.Wrapf(err, "parsing %v failed", file)
+	}
+	if m.Version > MetadataVersion {
+		return m, errors.Errorf("%v has metadata version %v, this mgob reads up to %v", file, m.Version, MetadataVersion)
+	}
+	return m, nil
+}
+
+// writeMetadata stores the sidecar of res in the plan dir and adds it to res,
+// streamed lists the files uploaded without a local copy.
+func writeMetadata(c *dumpConfig, p *pipeline, res *Result, streamed ...MetadataFile) error {
+	m := Metadata{
+		Version:   MetadataVersion,
+		Plan:      c.name,
+		Mode:      string(c.plan.Mode),
+		Format:    string(c.plan.Target.Format),
+		Timestamp: c.ts.UTC(),
+		Source: MetadataSource{
+			Uri:         redactUri(c.plan.Target.Uri),
+			Host:        c.plan.Target.Host,
+			Database:    c.database,
+			Collection:  c.plan.Target.Collection,
+			PointInTime: c.plan.Target.PointInTime,
+		},
+		Tools:    MetadataTools{Mgob: c.conf.Version},
+		Chain:    res.Chain,
+		Seq:      res.Seq,
+		Oplog:    res.Oplog,
+		Checksum: res.Checksum,
+	}
+	if c.plan.Mode == config.BackupModeExport {
+		m.Format = "json"
+		if c.plan.Export != nil && c.plan.Export.Type != "" {
+			m.Format = c.plan.Export.Type
+		}
+	}
+	if m.Format == "" {
+		m.Format = string(config.DumpFormatArchive)
+	}
+	if c.source == "" && c.plan.Mode != config.BackupModeExec && c.plan.Mode != config.BackupModeSnapshot && c.plan.Mode != config.BackupModeExport && res.Oplog == nil {
+		ex := ExecutorFor(c.plan, c.conf)
+		m.Source.Executor = ex.Name()
+		if _, ok := ex.(*localExecutor); ok {
+			m.Tools.Mongodump = c.conf.MongodumpVersion
+		}
+		if !p.compresses() {
+			m.Compression = "gzip"
+		}
+	} else if res.Oplog != nil && !p.compresses() {
+		m.Compression = "gzip"
+	}
+
+	for _, st := range p.stages {
+		m.Pipeline = append(m.Pipeline, st.Name())
+		switch s := st.(type) {
+		case *compressStage:
+			m.Compression = s.algorithm
+		case *gpgStage:
+			m.Encryption = &MetadataEncryption{Type: "gpg", Recipients: s.recipients}
+		}
+	}
+	if p.sink != nil {
+		if st, ok := p.sink.(Stage); ok {
+			m.Pipeline = append(m.Pipeline, st.Name())
+		}
+	}
+
+	m.Files = append(m.Files, streamed...)
+	for _, file := range res.Files {
+		fi, err := os.Stat(file)
+		if err != nil {
+			return errors.Wrapf(err, "stat file %v failed", file)
+		}
+		m.Files = append(m.Files, MetadataFile{Name: filepath.Base(file), Size: fi.Size()})
+	}
+
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return errors.Wrap(err, "encoding metadata failed")
+	}
+	file := filepath.Join(c.planDir, res.Name+MetadataExt)
+	if err := ioutil.WriteFile(file, data, 0644); err != nil {
+		return errors.Wrapf(err, "writing metadata %v failed", file)
+	}
+	res.Files = append(res.Files, file)
+	res.Size += int64(len(data))
+	return nil
+}
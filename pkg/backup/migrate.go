@@ -0,0 +1,290 @@
+package backup
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dustin/go-humanize"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/x/mongo/driver/connstring"
+
+	"github.com/stefanprodan/mgob/pkg/clock"
+	"github.com/stefanprodan/mgob/pkg/config"
+	"github.com/stefanprodan/mgob/pkg/restore"
+)
+
+// MigrateRecordExt is the extension of the file recording a migration in the plan dir.
+const MigrateRecordExt = ".migrate.json"
+
+// MigrateLogInterval is the delay between two progress logs of a running migration.
+var MigrateLogInterval = 30 * time.Second
+
+// MigrateRecord is stored in the plan dir for each migration.
+type MigrateRecord struct {
+	Plan      string        `json:"plan"`
+	Timestamp time.Time     `json:"timestamp"`
+	Target    string        `json:"target"`
+	Bytes     int64         `json:"bytes"`
+	Documents int64         `json:"documents"`
+	Failures  int64         `json:"failures"`
+	Duration  time.Duration `json:"duration"`
+}
+
+// MigrationStatus is the progress of a running migration, Progress.Bytes is
+// the size of the archive streamed so far.
+type MigrationStatus struct {
+	Plan     string                 `json:"plan"`
+	Started  time.Time              `json:"started"`
+	Target   string                 `json:"target"`
+	Progress restore.ProgressStatus `json:"progress"`
+}
+
+type migration struct {
+	started  time.Time
+	target   string
+	progress *restore.Progress
+}
+
+var (
+	migrationsMu sync.Mutex
+	migrations   = make(map[string]*migration)
+)
+
+// Migrations returns the migrations running, by plan name.
+func Migrations() []MigrationStatus {
+	migrationsMu.Lock()
+	defer migrationsMu.Unlock()
+	list := make([]MigrationStatus, 0, len(migrations))
+	for plan, m := range migrations {
+		list = append(list, MigrationStatus{Plan: plan, Started: m.started, Target: m.target, Progress: m.progress.Status()})
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Plan < list[j].Plan })
+	return list
+}
+
+// checkMigrate validates the plans of the migrate mode, nothing is stored
+// so the plan can't have a pipeline.
+func checkMigrate(plan config.Plan) error {
+	if plan.Mode != config.BackupModeMigrate {
+		if plan.Migrate != nil {
+			return errors.Errorf("migrate requires '%s' backup mode", config.BackupModeMigrate)
+		}
+		return nil
+	}
+	m := plan.Migrate
+	switch {
+	case m == nil || m.Uri == "":
+		return errors.Errorf("'%s' backup mode requires a migrate uri", plan.Mode)
+	case m.Uri == plan.Target.Uri:
+		return errors.New("migrate uri is the target uri, the target would be dropped")
+	case plan.Agent != "" || plan.Executor != nil:
+		return errors.Errorf("'%s' backup mode can't run on an agent or executor", plan.Mode)
+	case plan.PITR != nil:
+		return errors.Errorf("pitr can't be used with '%s' backup mode", plan.Mode)
+	case plan.Streaming || len(plan.Pipeline) > 0 || plan.Encryption != nil || plan.Compression != nil:
+		return errors.New("the dump goes straight to mongorestore, streaming, pipeline, encryption and compression can't be used")
+	case plan.Scan != nil || plan.Standby != nil:
+		return errors.New("scan and standby need a local archive, they can't be used with migrate")
+	case plan.Target.Format == config.DumpFormatDirectory:
+		return errors.Errorf("'%s' format can't be migrated", plan.Target.Format)
+	}
+	for _, ns := range m.Namespaces {
+		if ns.From == "" || ns.To == "" {
+			return errors.New("migrate namespaces require from and to")
+		}
+	}
+	if _, err := connstring.ParseAndValidate(m.Uri); err != nil {
+		return errors.Wrapf(err, "invalid migrate uri %v", redactUri(m.Uri))
+	}
+	return nil
+}
+
+// runMigrate pipes the mongodump archive of the target into mongorestore on
+// the migrate uri, nothing is written to disk. The progress is logged and
+// listed by Migrations, a record of the migration is stored in the plan dir.
+func runMigrate(ctx context.Context, c *dumpConfig) (Result, error) {
+	res := errRes(c)
+	m := c.plan.Migrate
+	mctx, cancel := withTimeout(ctx, c.plan.Scheduler.DumpTimeout())
+	defer cancel()
+
+	excluded, err := expandCollections(mctx, c)
+	if err != nil {
+		return res, err
+	}
+	expanded := *c
+	expanded.plan.Target.ExcludeCollections = excluded
+	_, _, dargs := dumpArgs(&expanded, false)
+	// without a path mongodump writes the archive to stdout
+	dargs[0] = "--archive"
+
+	rargs := make([]string, 0)
+	if c.plan.Target.PointInTime {
+		rargs = append(rargs, "--oplogReplay")
+	}
+	if !m.NoDrop {
+		rargs = append(rargs, "--drop")
+	}
+	for _, ns := range m.Include {
+		rargs = append(rargs, "--nsInclude", ns)
+	}
+	for _, ns := range m.Exclude {
+		rargs = append(rargs, "--nsExclude", ns)
+	}
+	for _, ns := range m.Namespaces {
+		rargs = append(rargs, "--nsFrom", ns.From, "--nsTo", ns.To)
+	}
+	rargs = append(rargs, config.SplitParams(m.Params)...)
+
+	target := redactUri(m.Uri)
+	p := restore.NewProgress()
+	migrationsMu.Lock()
+	if _, ok := migrations[c.name]; ok {
+		migrationsMu.Unlock()
+		return res, errors.Errorf("a migration of %v is already running", c.name)
+	}
+	migrations[c.name] = &migration{started: c.ts.UTC(), target: target, progress: p}
+	migrationsMu.Unlock()
+	defer func() {
+		migrationsMu.Lock()
+		delete(migrations, c.name)
+		migrationsMu.Unlock()
+	}()
+	stopLog := logMigration(c.name, target, p)
+	defer stopLog()
+
+	log.WithField("plan", c.name).Infof("Migration to %v started", target)
+	log.WithField("plan", c.name).Debugf("dump cmd: mongodump %v", strings.Join(maskArgs(dargs), " "))
+	pr, pw := io.Pipe()
+	out := &countWriter{w: progressWriter{w: pw, p: p}}
+	dumped := make(chan error, 1)
+	go func() {
+		var stderr bytes.Buffer
+		cmd := exec.Command("mongodump", dargs...)
+		cmd.Stdout = out
+		cmd.Stderr = &stderr
+		proc, err := startProcess(mctx, cmd)
+		if err == nil {
+			err = proc.Wait()
+		}
+		if err != nil {
+			err = errors.Wrapf(err, "mongodump log %v", strings.Replace(stderr.String(), "\n", " ", -1))
+		}
+		// sent before mongorestore reads the end of the stream
+		dumped <- err
+		pw.CloseWithError(err)
+	}()
+	output, rerr := restore.FromReader(mctx, pr, m.Uri, p, rargs)
+	log.WithField("plan", c.name).Debugf("Restore output: %v", output)
+	var derr error
+	select {
+	case derr = <-dumped:
+		// a failed dump fails mongorestore too
+		if derr != nil {
+			return res, errors.Wrapf(derr, "migration to %v failed", target)
+		}
+	default:
+		if rerr != nil {
+			// mongodump is stopped when mongorestore gives up
+			cancel()
+		}
+		pr.Close()
+		derr = <-dumped
+	}
+	if rerr != nil {
+		return res, errors.Wrapf(rerr, "migration to %v failed", target)
+	}
+	if derr != nil {
+		return res, errors.Wrapf(derr, "migration to %v failed", target)
+	}
+
+	st := p.Status()
+	rec := MigrateRecord{
+		Plan:      c.name,
+		Timestamp: c.ts.UTC(),
+		Target:    target,
+		Bytes:     out.n,
+		Documents: st.Documents,
+		Failures:  st.Failures,
+		Duration:  clock.Since(c.ts),
+	}
+	if err := os.MkdirAll(c.planDir, 0755); err != nil {
+		return res, errors.Wrapf(err, "creating dir %v in %v failed", c.name, c.storagePath)
+	}
+	data, err := json.MarshalIndent(rec, "", "  ")
+	if err != nil {
+		return res, errors.Wrap(err, "encoding migrate record failed")
+	}
+	res.Name = fmt.Sprintf("%v-%v%v", c.name, c.ts.Unix(), MigrateRecordExt)
+	file := filepath.Join(c.planDir, res.Name)
+	if err := ioutil.WriteFile(file, data, 0644); err != nil {
+		return res, errors.Wrapf(err, "writing migrate record %v failed", file)
+	}
+	if c.plan.Scheduler.Retention > 0 {
+		if err := retain(ctx, c); err != nil {
+			return res, errors.Wrap(err, "retention job failed")
+		}
+	}
+
+	res.Files = []string{file}
+	res.Size = out.n
+	res.Status = 200
+	res.Duration = rec.Duration
+	fields := log.Fields{
+		"plan":      c.name,
+		"size":      humanize.Bytes(uint64(out.n)),
+		"documents": st.Documents,
+		"duration":  res.Duration.String(),
+	}
+	if st.Failures > 0 {
+		fields["failures"] = st.Failures
+		log.WithFields(fields).Warnf("Migration to %v finished with %v documents failing to restore", target, st.Failures)
+	} else {
+		log.WithFields(fields).Infof("Migration to %v succeeded", target)
+	}
+	return res, nil
+}
+
+// progressWriter reports the bytes written through it as the progress of the restore.
+type progressWriter struct {
+	w io.Writer
+	p *restore.Progress
+}
+
+func (w progressWriter) Write(b []byte) (int, error) {
+	n, err := w.w.Write(b)
+	w.p.Add(int64(n))
+	return n, err
+}
+
+// logMigration logs the progress every MigrateLogInterval until stopped.
+func logMigration(plan string, target string, p *restore.Progress) func() {
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(MigrateLogInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				st := p.Status()
+				log.WithField("plan", plan).Infof("Migration to %v: %v streamed, %v documents restored, at %v",
+					target, humanize.Bytes(uint64(st.Bytes)), st.Documents, st.Namespace)
+			case <-done:
+				return
+			}
+		}
+	}()
+	return func() { close(done) }
+}
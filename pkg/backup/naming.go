@@ -0,0 +1,432 @@
+package backup
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/stefanprodan/mgob/pkg/clock"
+	"github.com/stefanprodan/mgob/pkg/config"
+)
+
+// ObjectIndex maps the archives of a plan to the objects named by content
+// that store them. It's kept in the data dir and uploaded next to the objects
+// as <plan>.index.json.
+type ObjectIndex struct {
+	Plan    string          `json:"plan"`
+	Objects []IndexedObject `json:"objects"`
+}
+
+// IndexedObject is an archive stored under its sha256.
+type IndexedObject struct {
+	Name     string    `json:"name"`
+	Object   string    `json:"object"`
+	Size     int64     `json:"size"`
+	Uploaded time.Time `json:"uploaded"`
+}
+
+var indexMu sync.Mutex
+
+// checkNaming validates the naming of the remote objects. Content naming
+// hashes the archive before the upload, a date prefix would split the objects
+// of the same content.
+func checkNaming(plan config.Plan) error {
+	switch plan.Naming {
+	case "", config.NamingName:
+		return nil
+	case config.NamingContent:
+	default:
+		return errors.Errorf("unknown naming '%s', name or content", plan.Naming)
+	}
+	switch {
+	case plan.Streaming:
+		return errors.New("content naming can't be used with streaming, the archive is hashed before the upload")
+	case plan.S3 != nil && plan.S3.AddDatePrefix:
+		return errors.New("content naming can't be used with s3 addDatePrefix")
+	}
+	return nil
+}
+
+func indexName(plan string) string {
+	return plan + ".index.json"
+}
+
+func indexPath(conf *config.AppConfig, plan string) string {
+	return filepath.Join(conf.DataPath, "objects", indexName(plan))
+}
+
+// ReadObjectIndex loads the object index of plan, empty when nothing was
+// uploaded under its content yet.
+func ReadObjectIndex(conf *config.AppConfig, plan string) (*ObjectIndex, error) {
+	index := &ObjectIndex{Plan: plan, Objects: make([]IndexedObject, 0)}
+	data, err := ioutil.ReadFile(indexPath(conf, plan))
+	if os.IsNotExist(err) {
+		return index, nil
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "reading the object index of %v failed", plan)
+	}
+	if err := json.Unmarshal(data, index); err != nil {
+		return nil, errors.Wrapf(err, "parsing the object index of %v failed", plan)
+	}
+	return index, nil
+}
+
+func (x *ObjectIndex) lookup(name string) (IndexedObject, bool) {
+	for _, o := range x.Objects {
+		if o.Name == name {
+			return o, true
+		}
+	}
+	return IndexedObject{}, false
+}
+
+// set adds or replaces the entry of o.Name, keeping the list ordered by name.
+func (x *ObjectIndex) set(o IndexedObject) {
+	for i := range x.Objects {
+		if x.Objects[i].Name == o.Name {
+			x.Objects[i] = o
+			return
+		}
+	}
+	x.Objects = append(x.Objects, o)
+	sort.Slice(x.Objects, func(i, j int) bool { return x.Objects[i].Name < x.Objects[j].Name })
+}
+
+func (x *ObjectIndex) remove(name string) {
+	for i := range x.Objects {
+		if x.Objects[i].Name == name {
+			x.Objects = append(x.Objects[:i], x.Objects[i+1:]...)
+			return
+		}
+	}
+}
+
+// referenced reports whether an entry of x is stored in object.
+func (x *ObjectIndex) referenced(object string) bool {
+	for _, o := range x.Objects {
+		if o.Object == object {
+			return true
+		}
+	}
+	return false
+}
+
+func writeObjectIndex(conf *config.AppConfig, x *ObjectIndex) (string, error) {
+	file := indexPath(conf, x.Plan)
+	if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+		return "", errors.Wrapf(err, "creating dir %v failed", filepath.Dir(file))
+	}
+	data, err := json.MarshalIndent(x, "", "  ")
+	if err != nil {
+		return "", errors.Wrap(err, "encoding the object index failed")
+	}
+	if err := ioutil.WriteFile(file+".tmp", data, 0644); err != nil {
+		return "", errors.Wrapf(err, "writing %v failed", file)
+	}
+	return file, os.Rename(file+".tmp", file)
+}
+
+// contentDestination stores the archives of a plan at a remote destination
+// under their sha256, an upload of content already stored is skipped. The
+// other methods are given the archive names and resolve the objects from the
+// index, archives missing from it were uploaded under their name.
+type contentDestination struct {
+	Destination
+	plan string
+	conf *config.AppConfig
+}
+
+// contentLinker is a contentDestination whose destination signs download URLs.
+type contentLinker struct {
+	*contentDestination
+}
+
+// contentNamed wraps the remote destination d when plan names its objects by content.
+func contentNamed(plan config.Plan, conf *config.AppConfig, d Destination) Destination {
+	if plan.Naming != config.NamingContent {
+		return d
+	}
+	cd := &contentDestination{Destination: d, plan: plan.Name, conf: conf}
+	if _, ok := d.(Linker); ok {
+		return contentLinker{cd}
+	}
+	return cd
+}
+
+func (d *contentDestination) Upload(ctx context.Context, file string) (string, error) {
+	sum, err := sha256File(file)
+	if err != nil {
+		return "", err
+	}
+	dir, err := ioutil.TempDir(d.conf.TmpPath, "objects-")
+	if err != nil {
+		return "", errors.Wrap(err, "creating the object dir failed")
+	}
+	defer os.RemoveAll(dir)
+
+	obj := filepath.Join(dir, sum)
+	if err := os.Link(file, obj); err != nil {
+		if err := copyFile(file, obj); err != nil {
+			return "", err
+		}
+	}
+	var output string
+	if err := d.Destination.Verify(ctx, obj); err == nil {
+		output = fmt.Sprintf("`%v` already stored as `%v`, upload skipped", filepath.Base(file), sum)
+	} else {
+		if output, err = d.Destination.Upload(ctx, obj); err != nil {
+			return "", err
+		}
+	}
+
+	size, err := fileSize(file)
+	if err != nil {
+		return "", err
+	}
+	indexMu.Lock()
+	defer indexMu.Unlock()
+	index, err := ReadObjectIndex(d.conf, d.plan)
+	if err != nil {
+		return "", err
+	}
+	// on a new host the entries uploaded are kept
+	if len(index.Objects) == 0 {
+		if err := d.merge(ctx, index); err != nil {
+			return "", err
+		}
+	}
+	index.set(IndexedObject{Name: filepath.Base(file), Object: sum, Size: size, Uploaded: clock.Now().UTC()})
+	if err := d.uploadIndex(ctx, index, dir); err != nil {
+		return "", err
+	}
+	return output, nil
+}
+
+// uploadIndex saves index and uploads a copy of it, the caller must hold indexMu.
+func (d *contentDestination) uploadIndex(ctx context.Context, index *ObjectIndex, dir string) error {
+	file, err := writeObjectIndex(d.conf, index)
+	if err != nil {
+		return err
+	}
+	dst := filepath.Join(dir, indexName(d.plan))
+	if err := copyFile(file, dst); err != nil {
+		return err
+	}
+	if _, err := d.Destination.Upload(ctx, dst); err != nil {
+		return errors.Wrapf(err, "%v uploading the object index of %v failed", d.Name(), d.plan)
+	}
+	return nil
+}
+
+// object returns the path of the object storing the archive file, the file
+// itself when it's not indexed.
+func (d *contentDestination) object(ctx context.Context, file string) (string, error) {
+	indexMu.Lock()
+	defer indexMu.Unlock()
+	_, o, ok, err := d.resolve(ctx, filepath.Base(file))
+	if err != nil || !ok {
+		return file, err
+	}
+	return filepath.Join(filepath.Dir(file), o.Object), nil
+}
+
+// resolve looks the archive name up in the local index, merged with the index
+// uploaded when it doesn't know the archive, e.g. on another host. The caller
+// must hold indexMu.
+func (d *contentDestination) resolve(ctx context.Context, name string) (*ObjectIndex, IndexedObject, bool, error) {
+	index, err := ReadObjectIndex(d.conf, d.plan)
+	if err != nil {
+		return nil, IndexedObject{}, false, err
+	}
+	if o, ok := index.lookup(name); ok {
+		return index, o, true, nil
+	}
+	if err := d.merge(ctx, index); err != nil {
+		return nil, IndexedObject{}, false, err
+	}
+	o, ok := index.lookup(name)
+	return index, o, ok, nil
+}
+
+// merge adds the entries of the index uploaded that index misses and saves
+// it, the caller must hold indexMu.
+func (d *contentDestination) merge(ctx context.Context, index *ObjectIndex) error {
+	dir, err := ioutil.TempDir(d.conf.TmpPath, "objects-")
+	if err != nil {
+		return errors.Wrap(err, "creating the object dir failed")
+	}
+	defer os.RemoveAll(dir)
+	dst := filepath.Join(dir, indexName(d.plan))
+	if err := d.Destination.Download(ctx, dst, dst); err != nil {
+		log.WithField("plan", d.plan).Debugf("%v object index not found %v", d.Name(), err)
+		return nil
+	}
+	data, err := ioutil.ReadFile(dst)
+	if err != nil {
+		return errors.Wrapf(err, "reading %v failed", dst)
+	}
+	remote := &ObjectIndex{}
+	if err := json.Unmarshal(data, remote); err != nil {
+		return errors.Wrapf(err, "parsing the %v object index of %v failed", d.Name(), d.plan)
+	}
+	merged := 0
+	for _, o := range remote.Objects {
+		if _, ok := index.lookup(o.Name); !ok {
+			index.set(o)
+			merged++
+		}
+	}
+	if merged > 0 {
+		if _, err := writeObjectIndex(d.conf, index); err != nil {
+			log.WithField("plan", d.plan).Warn(err)
+		}
+	}
+	return nil
+}
+
+// List returns the objects under the names of the archives they store, the
+// objects of several archives with the same content are listed once for each.
+func (d *contentDestination) List(ctx context.Context) ([]Object, error) {
+	objects, err := d.Destination.List(ctx)
+	if err != nil {
+		return nil, err
+	}
+	indexMu.Lock()
+	index, err := ReadObjectIndex(d.conf, d.plan)
+	if err == nil && len(index.Objects) == 0 {
+		err = d.merge(ctx, index)
+	}
+	indexMu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	names := make(map[string][]string)
+	for _, o := range index.Objects {
+		names[o.Object] = append(names[o.Object], o.Name)
+	}
+	list := make([]Object, 0, len(objects))
+	for _, obj := range objects {
+		archives, ok := names[path.Base(obj.Name)]
+		if !ok {
+			list = append(list, obj)
+			continue
+		}
+		for _, name := range archives {
+			list = append(list, Object{Name: path.Join(path.Dir(obj.Name), name), Size: obj.Size})
+		}
+	}
+	return list, nil
+}
+
+// Delete removes the archive name from the index, its object is deleted
+// once no other archive of the plan is stored in it.
+func (d *contentDestination) Delete(ctx context.Context, name string) error {
+	indexMu.Lock()
+	defer indexMu.Unlock()
+	index, o, ok, err := d.resolve(ctx, path.Base(name))
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return d.Destination.Delete(ctx, name)
+	}
+	index.remove(o.Name)
+	if !index.referenced(o.Object) && !d.shared(o.Object) {
+		if err := d.Destination.Delete(ctx, path.Join(path.Dir(name), o.Object)); err != nil {
+			return err
+		}
+	}
+	dir, err := ioutil.TempDir(d.conf.TmpPath, "objects-")
+	if err != nil {
+		return errors.Wrap(err, "creating the object dir failed")
+	}
+	defer os.RemoveAll(dir)
+	return d.uploadIndex(ctx, index, dir)
+}
+
+// shared reports whether the index of another plan references object, the
+// plans sharing a bucket store the same content once.
+func (d *contentDestination) shared(object string) bool {
+	files, err := ioutil.ReadDir(filepath.Dir(indexPath(d.conf, d.plan)))
+	if err != nil {
+		return false
+	}
+	for _, f := range files {
+		plan := strings.TrimSuffix(f.Name(), ".index.json")
+		if plan == d.plan || plan == f.Name() {
+			continue
+		}
+		if index, err := ReadObjectIndex(d.conf, plan); err == nil && index.referenced(object) {
+			return true
+		}
+	}
+	return false
+}
+
+// Verify checks the object of the local file, linked under the object name
+// as the destinations compare the local size and checksums.
+func (d *contentDestination) Verify(ctx context.Context, file string) error {
+	obj, err := d.object(ctx, file)
+	if err != nil {
+		return err
+	}
+	if obj == file {
+		return d.Destination.Verify(ctx, file)
+	}
+	dir, err := ioutil.TempDir(d.conf.TmpPath, "objects-")
+	if err != nil {
+		return errors.Wrap(err, "creating the object dir failed")
+	}
+	defer os.RemoveAll(dir)
+	link := filepath.Join(dir, filepath.Base(obj))
+	if err := os.Link(file, link); err != nil {
+		if err := copyFile(file, link); err != nil {
+			return err
+		}
+	}
+	return d.Destination.Verify(ctx, link)
+}
+
+func (d *contentDestination) Download(ctx context.Context, file string, dst string) error {
+	obj, err := d.object(ctx, file)
+	if err != nil {
+		return err
+	}
+	return d.Destination.Download(ctx, obj, dst)
+}
+
+func (d contentLinker) Link(ctx context.Context, file string, ttl time.Duration) (string, error) {
+	obj, err := d.object(ctx, file)
+	if err != nil {
+		return "", err
+	}
+	return d.Destination.(Linker).Link(ctx, obj, ttl)
+}
+
+func sha256File(file string) (string, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return "", errors.Wrapf(err, "opening %v failed", file)
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", errors.Wrapf(err, "reading %v failed", file)
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
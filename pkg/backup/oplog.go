@@ -0,0 +1,51 @@
+package backup
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/pkg/errors"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"github.com/stefanprodan/mgob/pkg/config"
+)
+
+// CheckPointInTime validates an oplog capturing plan, mongodump --oplog only
+// captures full instance dumps of a replica set member.
+func CheckPointInTime(ctx context.Context, plan config.Plan) error {
+	t := plan.Target
+	if plan.Mode != "" && plan.Mode != config.BackupModeSingle {
+		return errors.Errorf("pointInTime requires '%s' backup mode", config.BackupModeSingle)
+	}
+	if t.Database != "" || t.Collection != "" {
+		return errors.New("pointInTime can't be used with target.database or target.collection")
+	}
+	if t.Uri == "" {
+		return errors.New("pointInTime requires a target uri")
+	}
+
+	hctx, cancel := context.WithTimeout(ctx, healthCheckTimeout)
+	defer cancel()
+	client, err := mongo.Connect(hctx, options.Client().ApplyURI(t.Uri))
+	if err != nil {
+		return fmt.Errorf("failed to connect to MongoDB %s: %s", redactUri(t.Uri), err)
+	}
+	defer client.Disconnect(context.Background())
+
+	var hello struct {
+		SetName string `bson:"setName"`
+		Msg     string `bson:"msg"`
+	}
+	if err := client.Database("admin").RunCommand(hctx, bson.D{{Key: "isMaster", Value: 1}}).Decode(&hello); err != nil {
+		return errors.Wrapf(err, "isMaster on %v failed", redactUri(t.Uri))
+	}
+	if hello.Msg == "isdbgrid" {
+		return errors.New("pointInTime isn't supported on mongos, the oplog is per shard")
+	}
+	if hello.SetName == "" {
+		return errors.New("pointInTime requires a replica set target, a standalone has no oplog")
+	}
+	return nil
+}
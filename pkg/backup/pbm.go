@@ -0,0 +1,140 @@
+package backup
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/dustin/go-humanize"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/stefanprodan/mgob/pkg/clock"
+	"github.com/stefanprodan/mgob/pkg/config"
+	"github.com/stefanprodan/mgob/pkg/pbm"
+)
+
+// checkPBM validates the plans of the pbm mode, PBM compresses and stores the
+// backups itself so the plan can't have a pipeline or destinations.
+func checkPBM(plan config.Plan) error {
+	if plan.Mode != config.BackupModePBM {
+		if plan.PBM != nil {
+			return errors.Errorf("pbm requires '%s' backup mode", config.BackupModePBM)
+		}
+		return nil
+	}
+	switch {
+	case plan.Target.Uri == "":
+		return errors.Errorf("must use MongoDB URI with '%s' backup mode", plan.Mode)
+	case plan.Agent != "" || plan.Executor != nil:
+		return errors.Errorf("'%s' backup mode can't run on an agent or executor", plan.Mode)
+	case plan.Target.PointInTime || plan.PITR != nil:
+		return errors.New("pointInTime and pitr can't be used with pbm, enable the PBM point in time recovery instead")
+	case plan.Streaming || len(plan.Pipeline) > 0 || plan.Encryption != nil || plan.Compression != nil:
+		return errors.New("pbm compresses and stores the backups, streaming, pipeline, encryption and compression can't be used")
+	case plan.S3 != nil || plan.GCloud != nil || plan.Rclone != nil || plan.Azure != nil || plan.SFTP != nil || len(plan.Routes) > 0:
+		return errors.New("pbm uploads the backups to its own storage, the plan can't have destinations")
+	case plan.Scan != nil || plan.Standby != nil:
+		return errors.New("scan and standby need a local archive, they can't be used with pbm")
+	}
+	if plan.PBM != nil {
+		switch plan.PBM.Type {
+		case "", "logical", "physical", "incremental":
+		default:
+			return errors.Errorf("unsupported pbm backup type '%s', use logical, physical or incremental", plan.PBM.Type)
+		}
+	}
+	return nil
+}
+
+// runPBM starts a pbm backup, waits for it and records it in the plan dir.
+// The retention of the records deletes the PBM backups they point to.
+func runPBM(ctx context.Context, c *dumpConfig) (Result, error) {
+	res := errRes(c)
+	client := pbm.NewClient(c.plan, c.plan.Target.Uri)
+	typ, compression := "", ""
+	if c.plan.PBM != nil {
+		typ, compression = c.plan.PBM.Type, c.plan.PBM.Compression
+	}
+
+	dctx, cancel := withTimeout(ctx, c.plan.Scheduler.DumpTimeout())
+	defer cancel()
+	name, err := client.StartBackup(dctx, typ, compression)
+	if err != nil {
+		return res, err
+	}
+	log.WithField("plan", c.name).Infof("PBM backup %v started", name)
+	b, err := client.WaitBackup(dctx, name)
+	if err != nil {
+		return res, err
+	}
+
+	if err := os.MkdirAll(c.planDir, 0755); err != nil {
+		return res, errors.Wrapf(err, "creating dir %v in %v failed", c.name, c.storagePath)
+	}
+	data, err := json.MarshalIndent(pbm.Record{Backup: b, Plan: c.name, Timestamp: c.ts.UTC()}, "", "  ")
+	if err != nil {
+		return res, errors.Wrap(err, "encoding pbm record failed")
+	}
+	res.Name = fmt.Sprintf("%v-%v%v", c.name, c.ts.Unix(), pbm.RecordExt)
+	file := filepath.Join(c.planDir, res.Name)
+	if err := ioutil.WriteFile(file, data, 0644); err != nil {
+		return res, errors.Wrapf(err, "writing pbm record %v failed", file)
+	}
+
+	if c.plan.Scheduler.Retention > 0 {
+		if err := expirePBM(ctx, c, client); err != nil {
+			return res, errors.Wrap(err, "retention job failed")
+		}
+		if err := retain(ctx, c); err != nil {
+			return res, errors.Wrap(err, "retention job failed")
+		}
+	}
+
+	res.Size = b.Size
+	res.Files = []string{file}
+	res.Chain = fmt.Sprintf("%v-%v", c.name, c.ts.Unix())
+	res.Status = 200
+	res.Duration = clock.Since(c.ts)
+	log.WithFields(log.Fields{
+		"plan":     c.name,
+		"size":     humanize.Bytes(uint64(res.Size)),
+		"backup":   b.Name,
+		"duration": res.Duration.String(),
+	}).Infof("pbm backup succeeded")
+	return res, nil
+}
+
+// expirePBM deletes the PBM backups of the records the retention removes, the
+// ones PBM no longer knows are skipped.
+func expirePBM(ctx context.Context, c *dumpConfig, client pbm.Client) error {
+	files, err := ioutil.ReadDir(c.planDir)
+	if err != nil {
+		return errors.Wrapf(err, "reading %v failed", c.planDir)
+	}
+	backups, stamps := retentionGroups(files, c.name)
+	for i := c.plan.Scheduler.Retention; i < len(stamps); i++ {
+		for _, file := range backups[stamps[i]] {
+			if !strings.HasSuffix(file, pbm.RecordExt) {
+				continue
+			}
+			rec, err := pbm.ReadRecord(filepath.Join(c.planDir, file))
+			if err != nil {
+				return err
+			}
+			if err := client.Delete(ctx, rec.Name); err != nil {
+				if _, derr := client.Describe(ctx, rec.Name); derr != nil {
+					log.WithField("plan", c.name).Warnf("PBM backup %v not found, %v", rec.Name, derr)
+					continue
+				}
+				return err
+			}
+			log.WithField("plan", c.name).Infof("PBM backup %v deleted", rec.Name)
+		}
+	}
+	return nil
+}
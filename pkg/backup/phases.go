@@ -0,0 +1,129 @@
+package backup
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/stefanprodan/mgob/pkg/clock"
+	"github.com/stefanprodan/mgob/pkg/db"
+)
+
+// The timed phases of a run, the uploads are also timed by destination.
+const (
+	PhaseDump      = "dump"
+	PhaseEncrypt   = "encrypt"
+	PhaseUpload    = "upload"
+	PhaseRetention = "retention"
+)
+
+// The outcomes of an upload to a destination.
+const (
+	UploadUploaded = "uploaded"
+	UploadFailed   = "failed"
+	UploadPending  = "pending"
+)
+
+type phasesKey struct{}
+
+// phaseRecorder sums the durations of the phases of a run and lists the
+// outcomes of its uploads.
+type phaseRecorder struct {
+	mu       sync.Mutex
+	phases   map[string]time.Duration
+	outcomes []db.UploadOutcome
+}
+
+// withPhases returns a context whose phases are timed in the returned recorder.
+func withPhases(ctx context.Context) (context.Context, *phaseRecorder) {
+	r := &phaseRecorder{phases: make(map[string]time.Duration)}
+	return context.WithValue(ctx, phasesKey{}, r), r
+}
+
+func phasesOf(ctx context.Context) *phaseRecorder {
+	r, _ := ctx.Value(phasesKey{}).(*phaseRecorder)
+	return r
+}
+
+// recordPhase adds the time since start to phase, the phases of the
+// databases of a database mode run are summed.
+func recordPhase(ctx context.Context, phase string, start time.Time) {
+	r := phasesOf(ctx)
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	r.phases[phase] += clock.Since(start)
+	r.mu.Unlock()
+}
+
+// recordUpload adds the outcome of the upload of file to destination.
+func recordUpload(ctx context.Context, destination string, route string, file string, status string, d time.Duration, err error) {
+	r := phasesOf(ctx)
+	if r == nil {
+		return
+	}
+	o := db.UploadOutcome{Destination: destination, File: filepath.Base(file), Route: route, Status: status, Duration: d}
+	if err != nil {
+		o.Error = err.Error()
+	}
+	r.mu.Lock()
+	r.outcomes = append(r.outcomes, o)
+	r.mu.Unlock()
+}
+
+func (r *phaseRecorder) result() (map[string]time.Duration, []db.UploadOutcome) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var phases map[string]time.Duration
+	if len(r.phases) > 0 {
+		phases = make(map[string]time.Duration, len(r.phases))
+		for phase, d := range r.phases {
+			phases[phase] = d
+		}
+	}
+	return phases, append([]db.UploadOutcome(nil), r.outcomes...)
+}
+
+// UploadDurations sums the durations of the uploads of res by destination.
+func (res Result) UploadDurations() map[string]time.Duration {
+	out := make(map[string]time.Duration)
+	for _, o := range res.Outcomes {
+		out[o.Destination] += o.Duration
+	}
+	return out
+}
+
+// PhaseSummary describes the phases of res, e.g. for notifications:
+// dump 2m1.2s, encrypt 20s, upload 41s (S3 30s, GCloud 11s), retention 3ms.
+func (res Result) PhaseSummary() string {
+	parts := make([]string, 0, 4)
+	for _, phase := range []string{PhaseDump, PhaseEncrypt, PhaseUpload, PhaseRetention} {
+		d, ok := res.Phases[phase]
+		if !ok {
+			continue
+		}
+		part := fmt.Sprintf("%v %v", phase, d.Round(time.Millisecond))
+		if phase == PhaseUpload {
+			durations := res.UploadDurations()
+			names := make([]string, 0, len(durations))
+			for name := range durations {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+			dests := make([]string, 0, len(names))
+			for _, name := range names {
+				dests = append(dests, fmt.Sprintf("%v %v", name, durations[name].Round(time.Millisecond)))
+			}
+			if len(dests) > 0 {
+				part += fmt.Sprintf(" (%v)", strings.Join(dests, ", "))
+			}
+		}
+		parts = append(parts, part)
+	}
+	return strings.Join(parts, ", ")
+}
@@ -0,0 +1,299 @@
+package backup
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/stefanprodan/mgob/pkg/config"
+)
+
+// Stage is a streaming step of the post-dump pipeline. Data written to the
+// writer returned by Wrap is processed and passed on to w.
+type Stage interface {
+	Name() string
+	// Ext is appended to the artifact name, e.g. ".gz" or ".encrypted".
+	Ext() string
+	Wrap(ctx context.Context, w io.Writer) (io.WriteCloser, error)
+}
+
+// Sink is implemented by stages that control how the pipeline output is
+// written to disk. A sink stage must be the last one in the pipeline.
+type Sink interface {
+	Create(file string) (io.WriteCloser, error)
+	Files() []string
+}
+
+// Checksummer is implemented by stages that hash the data passing through.
+type Checksummer interface {
+	Algorithm() string
+	Sum() string
+}
+
+// StageFactory builds a stage from its plan configuration.
+type StageFactory func(ctx context.Context, s config.Stage, plan config.Plan, conf *config.AppConfig) (Stage, error)
+
+var stageFactories = map[config.StageType]StageFactory{}
+
+// RegisterStage makes a pipeline stage type available to plans.
+func RegisterStage(t config.StageType, f StageFactory) {
+	stageFactories[t] = f
+}
+
+type pipeline struct {
+	plan   string
+	stages []Stage
+	sink   Sink
+	// uncompressed is set by the none compression, the archive is left as is
+	uncompressed bool
+}
+
+type pipelineResult struct {
+	Name     string
+	Files    []string
+	Size     int64
+	Checksum string
+}
+
+func newPipeline(ctx context.Context, plan config.Plan, conf *config.AppConfig) (*pipeline, error) {
+	cfg := plan.Pipeline
+	if len(cfg) == 0 && plan.Encryption != nil {
+		// plans without a pipeline keep the classic dump -> encrypt flow
+		cfg = []config.Stage{{Type: config.StageEncrypt}}
+	}
+
+	p := &pipeline{plan: plan.Name}
+	for i, sc := range cfg {
+		factory, ok := stageFactories[sc.Type]
+		if !ok {
+			return nil, errors.Errorf("unknown pipeline stage '%s'", sc.Type)
+		}
+		st, err := factory(ctx, sc, plan, conf)
+		if err != nil {
+			return nil, errors.Wrapf(err, "pipeline stage %s init failed", sc.Type)
+		}
+		if sink, ok := st.(Sink); ok {
+			if i != len(cfg)-1 {
+				return nil, errors.Errorf("pipeline stage %s must be the last one", sc.Type)
+			}
+			p.sink = sink
+			continue
+		}
+		p.stages = append(p.stages, st)
+	}
+
+	if plan.Compression != nil {
+		if p.compresses() {
+			return nil, errors.New("compression can't be combined with a compress stage")
+		}
+		st, err := compressionStage(ctx, plan, conf)
+		if err != nil {
+			return nil, errors.Wrap(err, "compression init failed")
+		}
+		if st == nil {
+			p.uncompressed = true
+		} else {
+			// compress before any encryption
+			p.stages = append([]Stage{st}, p.stages...)
+		}
+	}
+
+	return p, nil
+}
+
+// compresses reports whether the pipeline takes care of compression, or
+// leaves the archive uncompressed, in which case mongodump must not gzip it.
+func (p *pipeline) compresses() bool {
+	if p.uncompressed {
+		return true
+	}
+	for _, st := range p.stages {
+		if _, ok := st.(*compressStage); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// run streams src through all stages into dir and returns the produced files.
+func (p *pipeline) run(ctx context.Context, src string, dir string) (pipelineResult, error) {
+	res := pipelineResult{Name: filepath.Base(src)}
+	for _, st := range p.stages {
+		res.Name += st.Ext()
+	}
+	dst := filepath.Join(dir, res.Name)
+
+	if len(p.stages) == 0 && p.sink == nil {
+		if err := moveFile(src, dst); err != nil {
+			return res, err
+		}
+		res.Files = []string{dst}
+		return res, p.stat(&res)
+	}
+
+	in, err := os.Open(src)
+	if err != nil {
+		return res, errors.Wrapf(err, "opening %v failed", src)
+	}
+	defer in.Close()
+
+	var out io.WriteCloser
+	if p.sink != nil {
+		out, err = p.sink.Create(dst)
+	} else {
+		out, err = os.Create(dst)
+	}
+	if err != nil {
+		return res, errors.Wrapf(err, "creating %v failed", dst)
+	}
+
+	w, closers, err := p.wrap(ctx, out)
+	if err != nil {
+		p.cleanup(dst)
+		return res, err
+	}
+
+	if _, err := io.Copy(w, ctxReader{ctx, in}); err != nil {
+		closeAll(closers)
+		p.cleanup(dst)
+		return res, errors.Wrapf(err, "pipeline processing of %v failed", src)
+	}
+	if err := closeAll(closers); err != nil {
+		p.cleanup(dst)
+		return res, errors.Wrapf(err, "pipeline processing of %v failed", src)
+	}
+	log.WithField("plan", p.plan).Infof("Pipeline finished %v", p)
+
+	if p.sink != nil {
+		res.Files = p.sink.Files()
+	} else {
+		res.Files = []string{dst}
+	}
+
+	sums, err := p.writeSums(&res, dst)
+	if err != nil {
+		return res, err
+	}
+	res.Files = append(res.Files, sums...)
+
+	if err := os.Remove(src); err != nil {
+		log.WithField("plan", p.plan).Warnf("Removing %v failed %v", src, err)
+	}
+
+	return res, p.stat(&res)
+}
+
+// wrap chains the stages back to front onto out so the first stage receives
+// the dump, the returned closers flush the chain when passed to closeAll.
+func (p *pipeline) wrap(ctx context.Context, out io.WriteCloser) (io.Writer, []io.Closer, error) {
+	closers := []io.Closer{out}
+	var w io.Writer = out
+	for i := len(p.stages) - 1; i >= 0; i-- {
+		wc, err := p.stages[i].Wrap(ctx, w)
+		if err != nil {
+			closeAll(closers)
+			return nil, nil, errors.Wrapf(err, "pipeline stage %s failed", p.stages[i].Name())
+		}
+		closers = append(closers, wc)
+		w = wc
+	}
+	return w, closers, nil
+}
+
+// writeSums stores the checksum files of the checksum stages next to dst
+// and sets the result checksum.
+func (p *pipeline) writeSums(res *pipelineResult, dst string) ([]string, error) {
+	files := make([]string, 0)
+	for _, st := range p.stages {
+		if cs, ok := st.(Checksummer); ok {
+			res.Checksum = cs.Sum()
+			sumFile := fmt.Sprintf("%v.%v", dst, cs.Algorithm())
+			line := fmt.Sprintf("%v  %v\n", cs.Sum(), res.Name)
+			if err := ioutil.WriteFile(sumFile, []byte(line), 0644); err != nil {
+				return files, errors.Wrapf(err, "writing checksum %v failed", sumFile)
+			}
+			files = append(files, sumFile)
+		}
+	}
+	return files, nil
+}
+
+func (p *pipeline) stat(res *pipelineResult) error {
+	for _, file := range res.Files {
+		fi, err := os.Stat(file)
+		if err != nil {
+			return errors.Wrapf(err, "stat file %v failed", file)
+		}
+		res.Size += fi.Size()
+	}
+	return nil
+}
+
+func (p *pipeline) cleanup(dst string) {
+	files := []string{dst}
+	if p.sink != nil {
+		files = p.sink.Files()
+	}
+	for _, file := range files {
+		os.Remove(file)
+	}
+}
+
+func (p *pipeline) String() string {
+	s := "dump"
+	for _, st := range p.stages {
+		s += " -> " + st.Name()
+	}
+	if p.sink != nil {
+		s += " -> split"
+	}
+	return s
+}
+
+// closeAll closes writers from the head of the chain down to the file,
+// so each stage can flush into the next one.
+func closeAll(closers []io.Closer) error {
+	var first error
+	for i := len(closers) - 1; i >= 0; i-- {
+		if err := closers[i].Close(); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+// moveFile renames src to dst, falling back to copy when they are on different volumes.
+func moveFile(src string, dst string) error {
+	if err := os.Rename(src, dst); err == nil {
+		return nil
+	}
+	if err := copyFile(src, dst); err != nil {
+		return errors.Wrapf(err, "moving file from %v to %v failed", src, dst)
+	}
+	return os.Remove(src)
+}
+
+func copyFile(src string, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return errors.Wrapf(err, "opening %v failed", src)
+	}
+	defer in.Close()
+
+	out, err := os.Create(dst)
+	if err != nil {
+		return errors.Wrapf(err, "creating %v failed", dst)
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		os.Remove(dst)
+		return err
+	}
+	return out.Close()
+}
@@ -0,0 +1,183 @@
+package backup
+
+import (
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"github.com/stefanprodan/mgob/pkg/clock"
+	"github.com/stefanprodan/mgob/pkg/config"
+	"github.com/stefanprodan/mgob/pkg/db"
+)
+
+// ErrNoOplog is returned when no oplog entry was written during a slice.
+var ErrNoOplog = errors.New("no new oplog entries")
+
+const defaultPITRInterval = 10
+
+// PITRInterval returns the length of the plan oplog slices.
+func PITRInterval(plan config.Plan) time.Duration {
+	if plan.PITR == nil || plan.PITR.Interval < 1 {
+		return defaultPITRInterval * time.Minute
+	}
+	return time.Duration(plan.PITR.Interval) * time.Minute
+}
+
+// OplogSlice tails the target oplog after from for one interval and stores the
+// entries as the seq-th segment of chain, through the plan pipeline and destinations.
+func OplogSlice(ctx context.Context, plan config.Plan, conf *config.AppConfig, chain string, seq int,
+	from primitive.Timestamp) (Result, error) {
+	c := &dumpConfig{
+		plan:        plan,
+		conf:        conf,
+		tmpPath:     conf.TmpPath,
+		storagePath: conf.StoragePath,
+		ts:          clock.Now(),
+		planDir:     config.PlanDir(conf.StoragePath, plan),
+		name:        plan.Name,
+	}
+	res := errRes(c)
+	ctx = WithEnv(ctx, plan)
+
+	p, err := newPipeline(ctx, plan, conf)
+	if err != nil {
+		return res, err
+	}
+	compress := !p.compresses()
+	tmp := filepath.Join(c.tmpPath, SegmentName(chain, seq, ".oplog.bson"))
+	if compress {
+		tmp += ".gz"
+	}
+
+	to, count, err := tailOplog(ctx, plan.Target.Uri, from, PITRInterval(plan), tmp, compress)
+	if err != nil || count == 0 {
+		os.Remove(tmp)
+		if err == nil {
+			err = ErrNoOplog
+		}
+		return res, err
+	}
+
+	if err := os.MkdirAll(c.planDir, 0755); err != nil {
+		return res, errors.Wrapf(err, "creating dir %v in %v failed", c.name, c.storagePath)
+	}
+	out, err := p.run(ctx, tmp, c.planDir)
+	if err != nil {
+		os.Remove(tmp)
+		return res, err
+	}
+	res.Name = out.Name
+	res.Size = out.Size
+	res.Checksum = out.Checksum
+	res.Files = out.Files
+	res.Chain = chain
+	res.Seq = seq
+	res.Oplog = &db.OplogRange{From: from, To: to}
+	if err := writeMetadata(c, p, &res); err != nil {
+		return res, err
+	}
+
+	if plan.Scan != nil {
+		if err := scan(ctx, c, out.Files); err != nil {
+			return res, err
+		}
+	}
+
+	for _, file := range res.Files {
+		u, err := upload(ctx, c, RoutedPlan{Plan: plan}, file)
+		if err != nil {
+			return res, err
+		}
+		res.Uploads = append(res.Uploads, u)
+	}
+
+	res.Status = 200
+	res.Duration = clock.Since(c.ts)
+	log.WithField("plan", plan.Name).Infof("Oplog segment %v holds %v entries up to %v", res.Name, count, time.Unix(int64(to.T), 0).UTC())
+	return res, nil
+}
+
+// tailOplog writes the oplog entries after from into file until d elapses,
+// it returns the timestamp of the last entry and the number of entries.
+func tailOplog(ctx context.Context, uri string, from primitive.Timestamp, d time.Duration,
+	file string, compress bool) (primitive.Timestamp, int, error) {
+	last := from
+	client, err := mongo.Connect(ctx, options.Client().ApplyURI(uri).SetReadPreference(targetReadPref(uri)))
+	if err != nil {
+		return last, 0, fmt.Errorf("failed to connect to MongoDB %s: %s", redactUri(uri), err)
+	}
+	defer client.Disconnect(context.Background())
+	oplog := client.Database("local").Collection("oplog.rs")
+
+	// a gap between from and the oldest entry would break the chain
+	var oldest struct {
+		TS primitive.Timestamp `bson:"ts"`
+	}
+	err = oplog.FindOne(ctx, bson.D{}, options.FindOne().SetSort(bson.D{{Key: "$natural", Value: 1}})).Decode(&oldest)
+	if err != nil {
+		return last, 0, errors.Wrap(err, "reading the oplog failed")
+	}
+	if !from.IsZero() && primitive.CompareTimestamp(oldest.TS, from) > 0 {
+		return last, 0, errors.Errorf("the oplog starts at %v after the chain end %v, entries were lost",
+			time.Unix(int64(oldest.TS.T), 0).UTC(), time.Unix(int64(from.T), 0).UTC())
+	}
+
+	f, err := os.Create(file)
+	if err != nil {
+		return last, 0, errors.Wrapf(err, "creating %v failed", file)
+	}
+	defer f.Close()
+	var w io.Writer = f
+	var zw *gzip.Writer
+	if compress {
+		zw = gzip.NewWriter(f)
+		w = zw
+	}
+
+	tctx, cancel := context.WithTimeout(ctx, d)
+	defer cancel()
+	opts := options.Find().SetCursorType(options.TailableAwait).SetMaxAwaitTime(5 * time.Second)
+	cur, err := oplog.Find(tctx, bson.M{"ts": bson.M{"$gt": from}}, opts)
+	if err != nil {
+		return last, 0, errors.Wrap(err, "tailing the oplog failed")
+	}
+	defer cur.Close(context.Background())
+
+	count := 0
+	for cur.Next(tctx) {
+		if _, err := w.Write(cur.Current); err != nil {
+			return last, count, errors.Wrapf(err, "writing %v failed", file)
+		}
+		t, i := cur.Current.Lookup("ts").Timestamp()
+		last = primitive.Timestamp{T: t, I: i}
+		count++
+	}
+	// the slice ends when its interval is over, not on errors
+	if err := ctx.Err(); err != nil {
+		return last, count, err
+	}
+	if err := cur.Err(); err != nil && tctx.Err() == nil {
+		return last, count, errors.Wrap(err, "tailing the oplog failed")
+	}
+
+	if zw != nil {
+		if err := zw.Close(); err != nil {
+			return last, count, errors.Wrapf(err, "writing %v failed", file)
+		}
+	}
+	if err := f.Close(); err != nil {
+		return last, count, errors.Wrapf(err, "writing %v failed", file)
+	}
+	return last, count, nil
+}
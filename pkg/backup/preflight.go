@@ -0,0 +1,87 @@
+package backup
+
+import (
+	"io/ioutil"
+	"strings"
+
+	"github.com/dustin/go-humanize"
+	"github.com/pkg/errors"
+)
+
+// preflightMargin is the headroom kept over the estimated size of a backup.
+const preflightMargin = 1.2
+
+// checkFreeSpace fails the run before the dump when the tmp or the storage
+// filesystem can't hold the backup of c.name plus a margin, both when they're
+// the same filesystem. The tmp dir must hold the expected dump, the storage
+// dir the last backup, or the estimate without a previous backup. Runs
+// without either and platforms without statfs aren't checked.
+func checkFreeSpace(c *dumpConfig, estimate int64, expected int64) error {
+	last := lastBackupSize(c.planDir, c.name)
+	stored := last
+	if stored == 0 {
+		stored = estimate
+	}
+	if expected == 0 {
+		expected = stored
+	}
+	if stored == 0 {
+		return nil
+	}
+	basis := make([]string, 0)
+	if last > 0 {
+		basis = append(basis, "last backup "+humanize.Bytes(uint64(last)))
+	}
+	if estimate > 0 {
+		basis = append(basis, "estimate "+humanize.Bytes(uint64(estimate)))
+	}
+	tmpNeed := uint64(float64(expected) * preflightMargin)
+	need := uint64(float64(stored) * preflightMargin)
+	tmpFree, tmpFS, ok := diskFree(c.tmpPath)
+	if !ok {
+		return nil
+	}
+	storageFree, storageFS, ok := diskFree(c.storagePath)
+	if !ok {
+		return nil
+	}
+	if tmpFS == storageFS {
+		if tmpFree < tmpNeed+need {
+			return errors.Errorf("not enough free space for the backup of %v: %v free on %v, which holds the tmp and storage dirs, %v needed (%v)",
+				c.name, humanize.Bytes(tmpFree), c.tmpPath, humanize.Bytes(tmpNeed+need), strings.Join(basis, ", "))
+		}
+		return nil
+	}
+	if tmpFree < tmpNeed {
+		return errors.Errorf("not enough free space for the backup of %v: %v free on %v, %v needed (%v)",
+			c.name, humanize.Bytes(tmpFree), c.tmpPath, humanize.Bytes(tmpNeed), strings.Join(basis, ", "))
+	}
+	if storageFree < need {
+		return errors.Errorf("not enough free space for the backup of %v: %v free on %v, %v needed (%v)",
+			c.name, humanize.Bytes(storageFree), c.storagePath, humanize.Bytes(need), strings.Join(basis, ", "))
+	}
+	return nil
+}
+
+// lastBackupSize sums the files of the newest backup of name in dir, 0 when there's none.
+func lastBackupSize(dir string, name string) int64 {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return 0
+	}
+	backups, stamps := retentionGroups(files, name)
+	if len(stamps) == 0 {
+		return 0
+	}
+	newest := make(map[string]bool)
+	for _, f := range backups[stamps[0]] {
+		newest[f] = true
+	}
+	var size int64
+	for _, f := range files {
+		if newest[f.Name()] {
+			size += f.Size()
+		}
+	}
+	return size
+}
@@ -0,0 +1,14 @@
+package backup
+
+import (
+	"syscall"
+)
+
+// diskFree returns the bytes available to mgob on the filesystem of path and its id.
+func diskFree(path string) (uint64, syscall.Fsid, bool) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(path, &st); err != nil {
+		return 0, syscall.Fsid{}, false
+	}
+	return st.Bavail * uint64(st.Bsize), st.Fsid, true
+}
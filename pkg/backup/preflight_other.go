@@ -0,0 +1,9 @@
+//go:build !linux
+// +build !linux
+
+package backup
+
+// diskFree isn't implemented, the free space isn't checked.
+func diskFree(path string) (uint64, struct{}, bool) {
+	return 0, struct{}{}, false
+}
@@ -0,0 +1,128 @@
+package backup
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dustin/go-humanize"
+	"github.com/pkg/errors"
+
+	"github.com/stefanprodan/mgob/pkg/config"
+)
+
+var quotaCheckInterval = 5 * time.Second
+
+type quota struct {
+	tmp     uint64
+	storage uint64
+}
+
+// newQuota returns the plan quota, a nil quota enforces nothing.
+func newQuota(plan config.Plan) *quota {
+	if plan.Quota == nil {
+		return nil
+	}
+	return &quota{tmp: uint64(plan.Quota.Tmp), storage: uint64(plan.Quota.Storage)}
+}
+
+// check returns an error if the plan dir already exceeds the storage quota.
+func (q *quota) check(planDir string) error {
+	if q == nil || q.storage == 0 {
+		return nil
+	}
+	used, err := dirSize(planDir, "")
+	if err != nil {
+		return err
+	}
+	if uint64(used) > q.storage {
+		return errors.Errorf("storage quota exceeded: %v uses %v of %v",
+			planDir, humanize.Bytes(uint64(used)), humanize.Bytes(q.storage))
+	}
+	return nil
+}
+
+// quotaWatch cancels a run when the watched files grow over the limit.
+type quotaWatch struct {
+	done chan struct{}
+	wg   sync.WaitGroup
+	mu   sync.Mutex
+	err  error
+}
+
+// watch polls the size of the files in dir starting with prefix, an empty
+// prefix counts the whole dir. Stop returns the quota error if it was hit.
+func (q *quota) watch(ctx context.Context, cancel context.CancelFunc, kind string, dir string, prefix string) *quotaWatch {
+	w := &quotaWatch{done: make(chan struct{})}
+	limit := uint64(0)
+	if q != nil {
+		limit = q.tmp
+		if kind == "storage" {
+			limit = q.storage
+		}
+	}
+	if limit == 0 {
+		return w
+	}
+
+	w.wg.Add(1)
+	go func() {
+		defer w.wg.Done()
+		ticker := time.NewTicker(quotaCheckInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-w.done:
+				return
+			case <-ticker.C:
+				used, err := dirSize(dir, prefix)
+				if err == nil && uint64(used) > limit {
+					w.mu.Lock()
+					w.err = errors.Errorf("%v quota exceeded: %v uses %v of %v, run aborted",
+						kind, dir, humanize.Bytes(uint64(used)), humanize.Bytes(limit))
+					w.mu.Unlock()
+					cancel()
+					return
+				}
+			}
+		}
+	}()
+	return w
+}
+
+func (w *quotaWatch) stop() error {
+	close(w.done)
+	w.wg.Wait()
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.err
+}
+
+// dirSize sums the size of the regular files in dir starting with prefix.
+func dirSize(dir string, prefix string) (int64, error) {
+	var size int64
+	err := filepath.Walk(dir, func(path string, f os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if !f.Mode().IsRegular() {
+			return nil
+		}
+		if prefix == "" || strings.HasPrefix(f.Name(), prefix) {
+			size += f.Size()
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, errors.Wrapf(err, "computing size of %v failed", dir)
+	}
+	return size, nil
+}
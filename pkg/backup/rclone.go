@@ -1,18 +1,135 @@
 package backup
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
 	"fmt"
+	"io"
+	"os"
+	"os/exec"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"time"
 
-	"github.com/codeskyblue/go-sh"
 	"github.com/pkg/errors"
 
 	"github.com/stefanprodan/mgob/pkg/config"
 )
 
-func rcloneUpload(file string, plan config.Plan) (string, error) {
+type rcloneDestination struct {
+	plan config.Plan
+}
+
+func newRcloneDestination(plan config.Plan, conf *config.AppConfig, ts time.Time) Destination {
+	if plan.Rclone == nil {
+		return nil
+	}
+	return &rcloneDestination{plan: plan}
+}
+
+func (d *rcloneDestination) Name() string {
+	return "Rclone"
+}
+
+func (d *rcloneDestination) Upload(ctx context.Context, file string) (string, error) {
+	return rcloneUpload(ctx, file, d.plan)
+}
+
+// Stream uploads the data read from r with rclone rcat.
+func (d *rcloneDestination) Stream(ctx context.Context, name string, r io.Reader) (string, error) {
+	cmd := exec.Command("rclone", rcloneArgs(d.plan, "rcat", d.remote(name))...)
+	cmd.Stdin = r
+	result, err := combinedOutput(ctx, cmd)
+	output := strings.Replace(string(result), "\n", " ", -1)
+	if err != nil {
+		return "", errors.Wrapf(err, "Rclone uploading %v to %v failed %v", name, d.remote(name), output)
+	}
+	return output, nil
+}
+
+func (d *rcloneDestination) List(ctx context.Context) ([]Object, error) {
+	output, err := runCmd(ctx, "rclone", rcloneArgs(d.plan, "lsf", "--files-only", "-R", "--format", "sp", d.remote(""))...)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Rclone listing %v failed", d.remote(""))
+	}
+	objects := make([]Object, 0)
+	// 1234;name.gz
+	for _, line := range strings.Split(output, "\n") {
+		fields := strings.SplitN(line, ";", 2)
+		if len(fields) != 2 {
+			continue
+		}
+		size, _ := strconv.ParseInt(fields[0], 10, 64)
+		objects = append(objects, Object{Name: fields[1], Size: size})
+	}
+	return objects, nil
+}
+
+func (d *rcloneDestination) Delete(ctx context.Context, name string) error {
+	if _, err := runCmd(ctx, "rclone", rcloneArgs(d.plan, "deletefile", d.remote(name))...); err != nil {
+		return errors.Wrapf(err, "Rclone deleting %v failed", d.remote(name))
+	}
+	return nil
+}
+
+func (d *rcloneDestination) Verify(ctx context.Context, file string) error {
+	remote := d.remote(filepath.Base(file))
+	output, err := runCmd(ctx, "rclone", rcloneArgs(d.plan, "size", "--json", remote)...)
+	if err != nil {
+		return errors.Wrapf(err, "Rclone verifying %v failed", remote)
+	}
+	var size struct {
+		Count int   `json:"count"`
+		Bytes int64 `json:"bytes"`
+	}
+	if err := json.Unmarshal([]byte(output), &size); err != nil {
+		return errors.Wrapf(err, "Rclone verifying %v failed", remote)
+	}
+	if size.Count == 0 {
+		return errors.Errorf("Rclone verifying %v failed, object not found", remote)
+	}
+	return checkSize(file, size.Bytes)
+}
+
+func (d *rcloneDestination) Download(ctx context.Context, file string, dst string) error {
+	// cat works whether the object is stored as bucket/name or bucket/name/name
+	remote := d.remote(filepath.Base(file))
+	f, err := os.Create(dst)
+	if err != nil {
+		return errors.Wrapf(err, "creating %v failed", dst)
+	}
+	defer f.Close()
+
+	var stderr bytes.Buffer
+	cmd := exec.Command("rclone", rcloneArgs(d.plan, "cat", remote)...)
+	cmd.Stdout = f
+	cmd.Stderr = &stderr
+	p, err := startProcess(ctx, cmd)
+	if err == nil {
+		err = p.Wait()
+	}
+	if err != nil {
+		return errors.Wrapf(err, "Rclone downloading %v failed %v", remote, strings.Replace(stderr.String(), "\n", " ", -1))
+	}
+	return f.Close()
+}
+
+func (d *rcloneDestination) remote(name string) string {
+	configSection := d.plan.Rclone.ConfigSection
+	if "" == configSection {
+		configSection = d.plan.Name
+	}
+	return fmt.Sprintf("%v:%v/%v", configSection, d.plan.Rclone.Bucket, name)
+}
+
+// rcloneArgs returns the rclone arguments with the plan config file and the mgob User-Agent.
+func rcloneArgs(plan config.Plan, args ...string) []string {
+	return append([]string{"--config=" + plan.Rclone.ConfigFilePath, "--user-agent", userAgent}, args...)
+}
+
+func rcloneUpload(ctx context.Context, file string, plan config.Plan) (string, error) {
 
 	fileName := filepath.Base(file)
 
@@ -21,10 +138,10 @@ func rcloneUpload(file string, plan config.Plan) (string, error) {
 		configSection = plan.Name
 	}
 
-	upload := fmt.Sprintf("rclone --config=\"%v\" copy %v %v:%v/%v",
-		plan.Rclone.ConfigFilePath, file, configSection, plan.Rclone.Bucket, fileName)
+	upload := exec.Command("rclone", rcloneArgs(plan, "copy", file,
+		fmt.Sprintf("%v:%v/%v", configSection, plan.Rclone.Bucket, fileName))...)
 
-	result, err := sh.Command("/bin/sh", "-c", upload).SetTimeout(time.Duration(plan.Scheduler.Timeout) * time.Minute).CombinedOutput()
+	result, err := combinedOutput(ctx, upload)
 	output := ""
 	if len(result) > 0 {
 		output = strings.Replace(string(result), "\n", " ", -1)
@@ -0,0 +1,153 @@
+package backup
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/stefanprodan/mgob/pkg/config"
+)
+
+// DumpJob is a dump handed over to the agent of a plan.
+type DumpJob struct {
+	Plan      config.Plan `json:"plan"`
+	Name      string      `json:"name"`
+	Timestamp time.Time   `json:"timestamp"`
+	Gzip      bool        `json:"gzip"`
+	// Database is the database dumped, the plan target one when empty
+	Database string `json:"database,omitempty"`
+}
+
+// Dispatcher runs the dumps of the plans bound to an agent and returns the
+// archive and log received from it, both written to the tmp dir.
+type Dispatcher interface {
+	Dump(ctx context.Context, job DumpJob) (string, string, error)
+}
+
+var dispatcher Dispatcher
+
+// SetDispatcher enables plans with an agent, their dumps are sent to d.
+func SetDispatcher(d Dispatcher) {
+	dispatcher = d
+}
+
+// agentExecutor hands the dumps of a plan bound to an agent to the dispatcher.
+type agentExecutor struct {
+	agent string
+}
+
+func newAgentExecutor(plan config.Plan, conf *config.AppConfig) Executor {
+	if plan.Agent == "" {
+		return nil
+	}
+	return &agentExecutor{agent: plan.Agent}
+}
+
+func (e *agentExecutor) Name() string {
+	return "agent"
+}
+
+func (e *agentExecutor) Dump(ctx context.Context, job DumpJob) (string, string, error) {
+	if dispatcher == nil {
+		return "", "", errors.Errorf("plan %v requires agent %v but the agent server is disabled", job.Name, e.agent)
+	}
+	dctx, cancel := withTimeout(ctx, job.Plan.Scheduler.DumpTimeout())
+	defer cancel()
+	return dispatcher.Dump(dctx, job)
+}
+
+// Dump runs job in the tmp dir, this is the agent side of a remote dump.
+func Dump(ctx context.Context, job DumpJob, conf *config.AppConfig) (string, string, error) {
+	ctx, c, err := remoteConfig(ctx, job, conf)
+	if err != nil {
+		return "", "", err
+	}
+	dctx, cancel := withTimeout(ctx, c.plan.Scheduler.DumpTimeout())
+	defer cancel()
+	if c.plan.Mode == config.BackupModeSample || c.plan.Mode == config.BackupModeMetadata {
+		return dumpSample(dctx, c, job.Gzip)
+	}
+	return dump(dctx, c, job.Gzip)
+}
+
+// Streams tells if job is an archive mongodump writes to stdout, the agent
+// then streams it with DumpTo instead of writing it to the tmp dir.
+func Streams(job DumpJob) bool {
+	p := job.Plan
+	switch p.Mode {
+	case "", config.BackupModeSingle, config.BackupModeDatabase:
+	default:
+		return false
+	}
+	return p.Target.Format != config.DumpFormatDirectory && p.Throttle == nil
+}
+
+// StreamName is the name of the archive DumpTo writes for job.
+func StreamName(job DumpJob, conf *config.AppConfig) string {
+	archive, _, _ := dumpArgs(jobConfig(job, conf), job.Gzip)
+	return filepath.Base(archive)
+}
+
+// DumpTo runs the dump of job with mongodump writing the archive to w, no
+// file is written on this host. It returns the mongodump log.
+func DumpTo(ctx context.Context, job DumpJob, conf *config.AppConfig, w io.Writer) ([]byte, error) {
+	if !Streams(job) {
+		return nil, errors.Errorf("the dump of plan %v can't be streamed", job.Plan.Name)
+	}
+	ctx, c, err := remoteConfig(ctx, job, conf)
+	if err != nil {
+		return nil, err
+	}
+	excluded, err := expandCollections(ctx, c)
+	if err != nil {
+		return nil, err
+	}
+	expanded := *c
+	expanded.plan.Target.ExcludeCollections = excluded
+	_, _, args := dumpArgs(&expanded, job.Gzip)
+	// without a path mongodump writes the archive to stdout
+	args[0] = "--archive"
+	log.WithField("plan", c.name).Debugf("dump cmd: mongodump %v", strings.Join(maskArgs(args), " "))
+
+	dctx, cancel := withTimeout(ctx, c.plan.Scheduler.DumpTimeout())
+	defer cancel()
+	var stderr bytes.Buffer
+	cmd := exec.Command("mongodump", args...)
+	cmd.Stdout = w
+	cmd.Stderr = &stderr
+	proc, err := startProcess(dctx, cmd)
+	if err == nil {
+		err = proc.Wait()
+	}
+	if err != nil {
+		return stderr.Bytes(), errors.Wrapf(err, "mongodump log %v", strings.Replace(stderr.String(), "\n", " ", -1))
+	}
+	return stderr.Bytes(), nil
+}
+
+// remoteConfig returns the dump config of job after the checks of its plan.
+func remoteConfig(ctx context.Context, job DumpJob, conf *config.AppConfig) (context.Context, *dumpConfig, error) {
+	c := jobConfig(job, conf)
+	ctx = WithEnv(ctx, job.Plan)
+	if err := checkTarget(c.plan.Target); err != nil {
+		return ctx, nil, err
+	}
+	if c.plan.Target.PointInTime {
+		if err := CheckPointInTime(ctx, c.plan); err != nil {
+			return ctx, nil, err
+		}
+	}
+	if c.plan.Health != nil {
+		if err := healthGate(ctx, c); err != nil {
+			return ctx, nil, err
+		}
+	}
+	return ctx, c, nil
+}
@@ -1,6 +1,10 @@
 package backup
 
-import "time"
+import (
+	"time"
+
+	"github.com/stefanprodan/mgob/pkg/db"
+)
 
 type Result struct {
 	Name      string        `json:"name"`
@@ -9,4 +13,46 @@ type Result struct {
 	Size      int64         `json:"size"`
 	Status    int           `json:"status"`
 	Timestamp time.Time     `json:"timestamp"`
+	Checksum  string        `json:"checksum,omitempty"`
+	// Estimate is the uncompressed size of the dumped data the target reported before the dump
+	Estimate int64 `json:"estimate,omitempty"`
+	// Chain is the name prefix shared by a full backup and its incremental segments,
+	// Seq is 0 for the full and the segment number otherwise
+	Chain string `json:"chain,omitempty"`
+	Seq   int    `json:"seq,omitempty"`
+	// Oplog is the oplog interval of a PITR segment
+	Oplog   *db.OplogRange `json:"oplog,omitempty"`
+	Files   []string       `json:"files,omitempty"`
+	Uploads []Upload       `json:"uploads,omitempty"`
+	// Databases are the archive sizes of each database in database mode
+	Databases map[string]int64 `json:"databases,omitempty"`
+	// Hashes are the dbHash md5 of the dumped collections by database
+	Hashes map[string]map[string]string `json:"hashes,omitempty"`
+	// Shards are the archive sizes of the config server and each shard in sharded mode
+	Shards map[string]int64 `json:"shards,omitempty"`
+	// Usage is the resources the dump and upload processes used, by stage
+	Usage map[string]db.Usage `json:"usage,omitempty"`
+	// VolumeSnapshot is the snapshot taken in csi mode
+	VolumeSnapshot *db.VolumeSnapshot `json:"volumeSnapshot,omitempty"`
+	// DiskSnapshots are the snapshots taken in disk mode
+	DiskSnapshots []db.DiskSnapshot `json:"diskSnapshots,omitempty"`
+	// AtlasSnapshot is the snapshot taken in atlas mode
+	AtlasSnapshot *db.AtlasSnapshot `json:"atlasSnapshot,omitempty"`
+	// Phases are the durations of the dump, encrypt, upload and retention phases
+	Phases map[string]time.Duration `json:"phases,omitempty"`
+	// Outcomes are the uploads of each file to each destination, failed ones included
+	Outcomes []db.UploadOutcome `json:"outcomes,omitempty"`
+	// Archive is the local path of the archive
+	Archive string `json:"archive,omitempty"`
+}
+
+// Upload records the remote destinations a file was copied to.
+type Upload struct {
+	File         string   `json:"file"`
+	Route        string   `json:"route,omitempty"`
+	Destinations []string `json:"destinations"`
+	// Size is set for streamed files, they have no local copy
+	Size int64 `json:"size,omitempty"`
+	// Pending are the destinations the file is queued for, the probe breaker skipped them
+	Pending []string `json:"pending,omitempty"`
 }
@@ -0,0 +1,97 @@
+package backup
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/stefanprodan/mgob/pkg/config"
+)
+
+// ErrNothingToResume is returned when resuming a plan whose last database
+// mode run didn't fail.
+var ErrNothingToResume = errors.New("no failed database mode run to resume")
+
+// ResumeRecord is kept after a database mode run where some databases
+// failed, a resumed run only dumps the databases that aren't in Succeeded.
+type ResumeRecord struct {
+	Plan      string    `json:"plan"`
+	Timestamp time.Time `json:"timestamp"`
+	// Succeeded are the backups of the databases that were dumped and uploaded
+	Succeeded map[string]DatabaseBackup `json:"succeeded"`
+	// Failed are the errors of the databases that failed, by name
+	Failed map[string]string `json:"failed"`
+}
+
+// DatabaseBackup is the backup of a database of a database mode run.
+type DatabaseBackup struct {
+	Size    int64             `json:"size"`
+	Files   []string          `json:"files"`
+	Uploads []Upload          `json:"uploads"`
+	Hashes  map[string]string `json:"hashes,omitempty"`
+	// Estimate is the dbStats estimate of the database
+	Estimate int64 `json:"estimate,omitempty"`
+}
+
+type resumeKey struct{}
+
+// WithResume makes the database mode run of ctx resume the last failed run
+// of its plan, under the timestamp of that run.
+func WithResume(ctx context.Context) context.Context {
+	return context.WithValue(ctx, resumeKey{}, true)
+}
+
+func resuming(ctx context.Context) bool {
+	r, _ := ctx.Value(resumeKey{}).(bool)
+	return r
+}
+
+// resumePath is the record of plan in the data dir, out of the storage dir
+// served over HTTP.
+func resumePath(conf *config.AppConfig, plan string) string {
+	return filepath.Join(conf.DataPath, "resume", plan+".json")
+}
+
+// ReadResume loads the resume record of plan, nil when its last database mode
+// run didn't fail.
+func ReadResume(conf *config.AppConfig, plan string) (*ResumeRecord, error) {
+	data, err := ioutil.ReadFile(resumePath(conf, plan))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "reading the resume record of %v failed", plan)
+	}
+	r := &ResumeRecord{}
+	if err := json.Unmarshal(data, r); err != nil {
+		return nil, errors.Wrapf(err, "parsing the resume record of %v failed", plan)
+	}
+	return r, nil
+}
+
+func writeResume(conf *config.AppConfig, r *ResumeRecord) error {
+	file := resumePath(conf, r.Plan)
+	if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+		return errors.Wrapf(err, "creating dir %v failed", filepath.Dir(file))
+	}
+	data, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return errors.Wrap(err, "encoding the resume record failed")
+	}
+	if err := ioutil.WriteFile(file+".tmp", data, 0644); err != nil {
+		return errors.Wrapf(err, "writing %v failed", file)
+	}
+	return os.Rename(file+".tmp", file)
+}
+
+func removeResume(conf *config.AppConfig, plan string) error {
+	if err := os.Remove(resumePath(conf, plan)); err != nil && !os.IsNotExist(err) {
+		return errors.Wrapf(err, "removing the resume record of %v failed", plan)
+	}
+	return nil
+}
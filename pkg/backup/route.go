@@ -0,0 +1,58 @@
+package backup
+
+import (
+	"regexp"
+
+	"github.com/pkg/errors"
+
+	"github.com/stefanprodan/mgob/pkg/config"
+)
+
+// RoutedPlan is a plan with the destinations of one route, Route is the
+// route regex or empty for the plan own destinations.
+type RoutedPlan struct {
+	Route string
+	Plan  config.Plan
+}
+
+// checkRoutes validates the route regexes.
+func checkRoutes(plan config.Plan) error {
+	for _, r := range plan.Routes {
+		if _, err := regexp.Compile(r.Match); err != nil {
+			return errors.Wrapf(err, "invalid route %v", r.Match)
+		}
+	}
+	return nil
+}
+
+// routePlan returns the plan with its destinations replaced by those of the
+// first route matching the database, the plan is returned as is when none does.
+func routePlan(plan config.Plan, database string) RoutedPlan {
+	if database != "" {
+		for _, r := range plan.Routes {
+			if re, err := regexp.Compile(r.Match); err == nil && re.MatchString(database) {
+				return RoutedPlan{Route: r.Match, Plan: withRoute(plan, r)}
+			}
+		}
+	}
+	return RoutedPlan{Plan: plan}
+}
+
+// RoutedPlans returns the plan followed by one plan per route.
+func RoutedPlans(plan config.Plan) []RoutedPlan {
+	list := []RoutedPlan{{Plan: plan}}
+	for _, r := range plan.Routes {
+		list = append(list, RoutedPlan{Route: r.Match, Plan: withRoute(plan, r)})
+	}
+	return list
+}
+
+func withRoute(plan config.Plan, r config.Route) config.Plan {
+	plan.S3 = r.S3
+	plan.GCloud = r.GCloud
+	plan.Rclone = r.Rclone
+	plan.Azure = r.Azure
+	plan.SFTP = r.SFTP
+	plan.Routes = nil
+	return plan
+}
@@ -1,75 +1,398 @@
 package backup
 
 import (
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
+	"io"
 	"net/url"
+	"os/exec"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"time"
 
-	"github.com/codeskyblue/go-sh"
 	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
 
 	"github.com/stefanprodan/mgob/pkg/config"
 )
 
-func s3Upload(file string, plan config.Plan, t time.Time, useAwsCli bool) (string, error) {
+type s3Destination struct {
+	plan      config.Plan
+	ts        time.Time
+	useAwsCli bool
+}
 
-	s3Url, err := url.Parse(plan.S3.URL)
+func newS3Destination(plan config.Plan, conf *config.AppConfig, ts time.Time) Destination {
+	if plan.S3 == nil {
+		return nil
+	}
+	return &s3Destination{plan: plan, ts: ts, useAwsCli: conf.UseAwsCli}
+}
+
+func (d *s3Destination) Name() string {
+	return "S3"
+}
 
+func (d *s3Destination) Upload(ctx context.Context, file string) (string, error) {
+	aws, err := d.aws()
 	if err != nil {
-		return "", errors.Wrapf(err, "invalid S3 url for plan %v: %s", plan.Name, plan.S3.URL)
+		return "", err
 	}
+	var output string
+	if aws {
+		output, err = awsUpload(ctx, file, d.plan, d.ts)
+	} else {
+		output, err = minioUpload(ctx, file, d.plan)
+	}
+	if err != nil {
+		return "", err
+	}
+	if err := d.checksum(ctx, file, aws); err != nil {
+		return "", err
+	}
+	return output, nil
+}
 
-	if useAwsCli && strings.HasSuffix(s3Url.Hostname(), "amazonaws.com") {
-		return awsUpload(file, plan, t)
+// Stream uploads the data read from r without a checksum check, there is no local copy to compare.
+func (d *s3Destination) Stream(ctx context.Context, name string, r io.Reader) (string, error) {
+	aws, err := d.aws()
+	if err != nil {
+		return "", err
+	}
+	if aws {
+		return awsCopy(ctx, "-", s3Key(name, d.plan, d.ts), r, d.plan)
 	}
+	return minioCopy(ctx, "", name, r, d.plan)
+}
 
-	return minioUpload(file, plan)
+func (d *s3Destination) List(ctx context.Context) ([]Object, error) {
+	aws, err := d.aws()
+	if err != nil {
+		return nil, err
+	}
+
+	objects := make([]Object, 0)
+	if aws {
+		if err := awsConfigure(ctx, d.plan); err != nil {
+			return nil, err
+		}
+		output, err := runCmd(ctx, "aws", "s3", "ls", "--recursive", fmt.Sprintf("s3://%v/%v", d.plan.S3.Bucket, d.plan.S3.Prefix))
+		if err != nil {
+			return nil, errors.Wrapf(err, "S3 listing %v failed", d.plan.S3.Bucket)
+		}
+		// 2021-01-01 00:00:00       1234 prefix/name.gz
+		for _, line := range strings.Split(output, "\n") {
+			fields := strings.Fields(line)
+			if len(fields) == 4 {
+				size, _ := strconv.ParseInt(fields[2], 10, 64)
+				objects = append(objects, Object{Name: fields[3], Size: size})
+			}
+		}
+		return objects, nil
+	}
+
+	if err := minioRegister(ctx, d.plan); err != nil {
+		return nil, err
+	}
+	output, err := runCmd(ctx, "mc", "--json", "ls", "--recursive", fmt.Sprintf("%v/%v", d.plan.Name, d.plan.S3.Bucket))
+	if err != nil {
+		return nil, errors.Wrapf(err, "S3 listing %v failed", d.plan.S3.Bucket)
+	}
+	for _, line := range strings.Split(output, "\n") {
+		var item struct {
+			Key  string `json:"key"`
+			Size int64  `json:"size"`
+		}
+		if json.Unmarshal([]byte(line), &item) == nil && item.Key != "" {
+			objects = append(objects, Object{Name: item.Key, Size: item.Size})
+		}
+	}
+	return objects, nil
 }
 
-func awsUpload(file string, plan config.Plan, t time.Time) (string, error) {
+func (d *s3Destination) Delete(ctx context.Context, name string) error {
+	aws, err := d.aws()
+	if err != nil {
+		return err
+	}
 
-	output := ""
-	if len(plan.S3.AccessKey) > 0 && len(plan.S3.SecretKey) > 0 {
-		// Let's use credentials given
-		configure := fmt.Sprintf("aws configure set aws_access_key_id %v && aws configure set aws_secret_access_key %v",
-			plan.S3.AccessKey, plan.S3.SecretKey)
+	cmd := []string{"mc", "rm", fmt.Sprintf("%v/%v/%v", d.plan.Name, d.plan.S3.Bucket, name)}
+	if aws {
+		err = awsConfigure(ctx, d.plan)
+		cmd = []string{"aws", "s3", "rm", fmt.Sprintf("s3://%v/%v", d.plan.S3.Bucket, name)}
+	} else {
+		err = minioRegister(ctx, d.plan)
+	}
+	if err != nil {
+		return err
+	}
 
-		result, err := sh.Command("/bin/sh", "-c", configure).CombinedOutput()
-		if len(result) > 0 {
-			output += strings.Replace(string(result), "\n", " ", -1)
+	if _, err := runCmd(ctx, cmd[0], cmd[1:]...); err != nil {
+		return errors.Wrapf(err, "S3 deleting %v from %v failed", name, d.plan.S3.Bucket)
+	}
+	return nil
+}
+
+func (d *s3Destination) Verify(ctx context.Context, file string) error {
+	aws, err := d.aws()
+	if err != nil {
+		return err
+	}
+
+	var size int64
+	if aws {
+		if err := awsConfigure(ctx, d.plan); err != nil {
+			return err
+		}
+		key := s3Key(file, d.plan, d.ts)
+		output, err := runCmd(ctx, "aws", "s3api", "head-object", "--bucket", d.plan.S3.Bucket, "--key", key,
+			"--query", "ContentLength", "--output", "text")
+		if err != nil {
+			return errors.Wrapf(err, "S3 verifying %v in %v failed", key, d.plan.S3.Bucket)
 		}
+		size, err = strconv.ParseInt(output, 10, 64)
 		if err != nil {
-			return "", errors.Wrapf(err, "aws configure for plan %v failed %s", plan.Name, output)
+			return errors.Wrapf(err, "S3 verifying %v in %v failed", key, d.plan.S3.Bucket)
 		}
+	} else {
+		if err := minioRegister(ctx, d.plan); err != nil {
+			return err
+		}
+		name := filepath.Base(file)
+		output, err := runCmd(ctx, "mc", "--json", "stat", fmt.Sprintf("%v/%v/%v", d.plan.Name, d.plan.S3.Bucket, name))
+		if err != nil {
+			return errors.Wrapf(err, "S3 verifying %v in %v failed", name, d.plan.S3.Bucket)
+		}
+		var stat struct {
+			Size int64 `json:"size"`
+		}
+		if err := json.Unmarshal([]byte(output), &stat); err != nil {
+			return errors.Wrapf(err, "S3 verifying %v in %v failed", name, d.plan.S3.Bucket)
+		}
+		size = stat.Size
 	}
 
-	fileName := filepath.Base(file)
+	if err := checkSize(file, size); err != nil {
+		return err
+	}
+	return d.checksum(ctx, file, aws)
+}
 
-	encrypt := ""
-	if len(plan.S3.KmsKeyId) > 0 {
-		encrypt = fmt.Sprintf(" --sse aws:kms --sse-kms-key-id %v", plan.S3.KmsKeyId)
+// checksum compares the checksum S3 computed for the uploaded copy of file with
+// the local one: the SHA256 checksum for AWS and the MD5 ETag for the other
+// S3 compatible stores. Multipart checksums are the hash of the part hashes.
+func (d *s3Destination) checksum(ctx context.Context, file string, aws bool) error {
+	if aws {
+		key := s3Key(file, d.plan, d.ts)
+		output, err := runCmd(ctx, "aws", "s3api", "head-object", "--bucket", d.plan.S3.Bucket, "--key", key,
+			"--checksum-mode", "ENABLED", "--query", "ChecksumSHA256", "--output", "text")
+		if err != nil {
+			return errors.Wrapf(err, "S3 reading the checksum of %v failed", key)
+		}
+		remote, parts := splitParts(output)
+		if remote == "" || remote == "None" {
+			return errors.Errorf("S3 object %v has no SHA256 checksum", key)
+		}
+		if parts == 0 {
+			sums, err := digestFile(file)
+			if err != nil {
+				return err
+			}
+			return checkDigest(file, "S3 sha256", b64(sums.SHA256), remote)
+		}
+
+		// the CLI part size is a setting, the first part tells which one was used
+		output, err = runCmd(ctx, "aws", "s3api", "head-object", "--bucket", d.plan.S3.Bucket, "--key", key,
+			"--part-number", "1", "--query", "ContentLength", "--output", "text")
+		if err != nil {
+			return errors.Wrapf(err, "S3 reading the part size of %v failed", key)
+		}
+		partSize, err := strconv.ParseInt(output, 10, 64)
+		if err != nil {
+			return errors.Wrapf(err, "S3 reading the part size of %v failed", key)
+		}
+		sum, n, err := compositeDigest(file, partSize, sha256.New)
+		if err != nil {
+			return err
+		}
+		return checkDigest(file, "S3 sha256", fmt.Sprintf("%v-%v", b64(sum), n), fmt.Sprintf("%v-%v", remote, parts))
 	}
 
-	storage := ""
-	if len(plan.S3.StorageClass) > 0 {
-		storage = fmt.Sprintf(" --storage-class %v", plan.S3.StorageClass)
+	name := filepath.Base(file)
+	output, err := runCmd(ctx, "mc", "--json", "stat", fmt.Sprintf("%v/%v/%v", d.plan.Name, d.plan.S3.Bucket, name))
+	if err != nil {
+		return errors.Wrapf(err, "S3 reading the ETag of %v failed", name)
+	}
+	var stat struct {
+		ETag string `json:"etag"`
+		Size int64  `json:"size"`
+	}
+	if err := json.Unmarshal([]byte(output), &stat); err != nil {
+		return errors.Wrapf(err, "S3 reading the ETag of %v failed", name)
+	}
+	remote, parts := splitParts(stat.ETag)
+	if _, err := hex.DecodeString(remote); err != nil || len(remote) != 32 {
+		// server side encrypted objects don't have an MD5 ETag
+		log.WithField("plan", d.plan.Name).Debugf("S3 ETag %v of %v is not a MD5, checksum skipped", stat.ETag, name)
+		return nil
+	}
+	if parts == 0 {
+		sums, err := digestFile(file)
+		if err != nil {
+			return err
+		}
+		return checkDigest(file, "S3 md5", hex.EncodeToString(sums.MD5), remote)
+	}
+	sum, n, err := compositeDigest(file, minioPartSize(stat.Size), md5.New)
+	if err != nil {
+		return err
 	}
+	if n != parts {
+		log.WithField("plan", d.plan.Name).Warnf("S3 object %v has %v parts, expected %v, checksum skipped", name, parts, n)
+		return nil
+	}
+	return checkDigest(file, "S3 md5", hex.EncodeToString(sum), remote)
+}
 
-	s3Filename := fmt.Sprintf("%s%s", plan.S3.Prefix, fileName)
-	if plan.S3.AddDatePrefix {
-		s3Filename = fmt.Sprintf("%s%d/%s", plan.S3.Prefix, t.Unix(), fileName)
+func (d *s3Destination) Download(ctx context.Context, file string, dst string) error {
+	aws, err := d.aws()
+	if err != nil {
+		return err
 	}
-	upload := fmt.Sprintf("aws --quiet s3 cp %v s3://%v/%v%v%v",
-		file, plan.S3.Bucket, s3Filename, encrypt, storage)
 
-	result, err := sh.Command("/bin/sh", "-c", upload).SetTimeout(time.Duration(plan.Scheduler.Timeout) * time.Minute).CombinedOutput()
-	if len(result) > 0 {
-		output += strings.Replace(string(result), "\n", " ", -1)
+	src := fmt.Sprintf("%v/%v/%v", d.plan.Name, d.plan.S3.Bucket, filepath.Base(file))
+	cmd := []string{"mc", "--quiet", "cp", src, dst}
+	if aws {
+		err = awsConfigure(ctx, d.plan)
+		src = fmt.Sprintf("s3://%v/%v", d.plan.S3.Bucket, s3Key(file, d.plan, d.ts))
+		cmd = []string{"aws", "--quiet", "s3", "cp", src, dst}
+	} else {
+		err = minioRegister(ctx, d.plan)
 	}
 	if err != nil {
-		return "", errors.Wrapf(err, "S3 uploading %v to %v/%v failed %v", file, plan.Name, plan.S3.Bucket, output)
+		return err
+	}
+
+	if _, err := runCmd(ctx, cmd[0], cmd[1:]...); err != nil {
+		return errors.Wrapf(err, "S3 downloading %v failed", src)
+	}
+	return nil
+}
+
+func (d *s3Destination) Link(ctx context.Context, file string, ttl time.Duration) (string, error) {
+	aws, err := d.aws()
+	if err != nil {
+		return "", err
+	}
+
+	if aws {
+		if err := awsConfigure(ctx, d.plan); err != nil {
+			return "", err
+		}
+		src := fmt.Sprintf("s3://%v/%v", d.plan.S3.Bucket, s3Key(file, d.plan, d.ts))
+		output, err := runCmd(ctx, "aws", "s3", "presign", src, "--expires-in", strconv.FormatInt(int64(ttl.Seconds()), 10))
+		if err != nil {
+			return "", errors.Wrapf(err, "S3 presigning %v failed", src)
+		}
+		return output, nil
+	}
+
+	if err := minioRegister(ctx, d.plan); err != nil {
+		return "", err
+	}
+	src := fmt.Sprintf("%v/%v/%v", d.plan.Name, d.plan.S3.Bucket, filepath.Base(file))
+	output, err := runCmd(ctx, "mc", "--json", "share", "download", "--expire", ttl.String(), src)
+	if err != nil {
+		return "", errors.Wrapf(err, "S3 presigning %v failed", src)
+	}
+	var share struct {
+		Share string `json:"share"`
+	}
+	if err := json.Unmarshal([]byte(output), &share); err != nil || share.Share == "" {
+		return "", errors.Errorf("S3 presigning %v failed, no URL in %v", src, output)
+	}
+	return share.Share, nil
+}
+
+func (d *s3Destination) aws() (bool, error) {
+	s3Url, err := url.Parse(d.plan.S3.URL)
+	if err != nil {
+		return false, errors.Wrapf(err, "invalid S3 url for plan %v: %s", d.plan.Name, d.plan.S3.URL)
+	}
+	return d.useAwsCli && strings.HasSuffix(s3Url.Hostname(), "amazonaws.com"), nil
+}
+
+// s3Key returns the object key the AWS upload uses for file.
+func s3Key(file string, plan config.Plan, t time.Time) string {
+	fileName := filepath.Base(file)
+	if plan.S3.AddDatePrefix {
+		return fmt.Sprintf("%s%d/%s", plan.S3.Prefix, t.Unix(), fileName)
+	}
+	return fmt.Sprintf("%s%s", plan.S3.Prefix, fileName)
+}
+
+func awsConfigure(ctx context.Context, plan config.Plan) error {
+	if len(plan.S3.AccessKey) > 0 && len(plan.S3.SecretKey) > 0 {
+		// Let's use credentials given
+		settings := [][]string{
+			{"aws_access_key_id", plan.S3.AccessKey},
+			{"aws_secret_access_key", plan.S3.SecretKey},
+		}
+		for _, kv := range settings {
+			result, err := combinedOutput(ctx, exec.Command("aws", "configure", "set", kv[0], kv[1]))
+			output := ""
+			if len(result) > 0 {
+				output = strings.Replace(string(result), "\n", " ", -1)
+			}
+			if err != nil {
+				return errors.Wrapf(err, "aws configure for plan %v failed %s", plan.Name, output)
+			}
+		}
+	}
+	return nil
+}
+
+func awsUpload(ctx context.Context, file string, plan config.Plan, t time.Time) (string, error) {
+	return awsCopy(ctx, file, s3Key(file, plan, t), nil, plan)
+}
+
+// awsCopy uploads src as key, src is - to upload the data read from stdin.
+func awsCopy(ctx context.Context, src string, key string, stdin io.Reader, plan config.Plan) (string, error) {
+
+	if err := awsConfigure(ctx, plan); err != nil {
+		return "", err
+	}
+
+	args := []string{"--quiet", "s3", "cp", "--checksum-algorithm", "SHA256", src, fmt.Sprintf("s3://%v/%v", plan.S3.Bucket, key)}
+	if len(plan.S3.KmsKeyId) > 0 {
+		args = append(args, "--sse", "aws:kms", "--sse-kms-key-id", plan.S3.KmsKeyId)
+	}
+	if len(plan.S3.StorageClass) > 0 {
+		args = append(args, "--storage-class", plan.S3.StorageClass)
+	}
+
+	cp := exec.Command("aws", args...)
+	cp.Stdin = stdin
+	cmds := []*exec.Cmd{cp}
+	if len(plan.Tags) > 0 {
+		cmds = append(cmds, exec.Command("aws", "s3api", "put-object-tagging",
+			"--bucket", plan.S3.Bucket, "--key", key, "--tagging", s3Tagging(plan)))
+	}
+
+	output := ""
+	for _, cmd := range cmds {
+		result, err := combinedOutput(ctx, cmd)
+		if len(result) > 0 {
+			output += strings.Replace(string(result), "\n", " ", -1)
+		}
+		if err != nil {
+			return "", errors.Wrapf(err, "S3 uploading %v to %v/%v failed %v", key, plan.Name, plan.S3.Bucket, output)
+		}
 	}
 
 	if strings.Contains(output, "<ERROR>") {
@@ -79,33 +402,54 @@ func awsUpload(file string, plan config.Plan, t time.Time) (string, error) {
 	return strings.Replace(output, "\n", " ", -1), nil
 }
 
-func minioUpload(file string, plan config.Plan) (string, error) {
+func minioRegister(ctx context.Context, plan config.Plan) error {
+	register := exec.Command("mc", "config", "host", "add",
+		plan.Name, plan.S3.URL, plan.S3.AccessKey, plan.S3.SecretKey, "--api", plan.S3.API)
 
-	register := fmt.Sprintf("mc config host add %v %v %v %v --api %v",
-		plan.Name, plan.S3.URL, plan.S3.AccessKey, plan.S3.SecretKey, plan.S3.API)
-
-	result, err := sh.Command("/bin/sh", "-c", register).CombinedOutput()
+	result, err := combinedOutput(ctx, register)
 	output := ""
 	if len(result) > 0 {
 		output = strings.Replace(string(result), "\n", " ", -1)
 	}
 	if err != nil {
-		return "", errors.Wrapf(err, "mc config host for plan %v failed %s", plan.Name, output)
+		return errors.Wrapf(err, "mc config host for plan %v failed %s", plan.Name, output)
 	}
+	return nil
+}
 
-	fileName := filepath.Base(file)
+func minioUpload(ctx context.Context, file string, plan config.Plan) (string, error) {
+	return minioCopy(ctx, file, filepath.Base(file), nil, plan)
+}
 
-	upload := fmt.Sprintf("mc --quiet cp %v %v/%v/%v",
-		file, plan.Name, plan.S3.Bucket, fileName)
+// minioCopy uploads src as name, with mc pipe when src is empty to upload the data read from stdin.
+func minioCopy(ctx context.Context, src string, name string, stdin io.Reader, plan config.Plan) (string, error) {
 
-	result, err = sh.Command("/bin/sh", "-c", upload).SetTimeout(time.Duration(plan.Scheduler.Timeout) * time.Minute).CombinedOutput()
-	output = ""
+	if err := minioRegister(ctx, plan); err != nil {
+		return "", err
+	}
+
+	args := []string{"--quiet", "cp"}
+	if src == "" {
+		args = []string{"--quiet", "pipe"}
+	}
+	if len(plan.Tags) > 0 {
+		args = append(args, "--tags", minioTags(plan))
+	}
+	if src != "" {
+		args = append(args, src)
+	}
+	args = append(args, fmt.Sprintf("%v/%v/%v", plan.Name, plan.S3.Bucket, name))
+
+	cmd := exec.Command("mc", args...)
+	cmd.Stdin = stdin
+	result, err := combinedOutput(ctx, cmd)
+	output := ""
 	if len(result) > 0 {
 		output = strings.Replace(string(result), "\n", " ", -1)
 	}
 
 	if err != nil {
-		return "", errors.Wrapf(err, "S3 uploading %v to %v/%v failed %v", file, plan.Name, plan.S3.Bucket, output)
+		return "", errors.Wrapf(err, "S3 uploading %v to %v/%v failed %v", name, plan.Name, plan.S3.Bucket, output)
 	}
 
 	if strings.Contains(output, "<ERROR>") {
@@ -0,0 +1,285 @@
+package backup
+
+import (
+	"archive/tar"
+	"bufio"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.mongodb.org/mongo-driver/mongo/readconcern"
+
+	"github.com/stefanprodan/mgob/pkg/config"
+)
+
+// dumpSample exports a $sample of every collection in the mongodump directory
+// layout, <db>/<collection>.bson with the indexes in <collection>.metadata.json,
+// and packs it as a tar archive that mongorestore can load once extracted.
+// The metadata mode writes the collections empty along with the users and roles.
+func dumpSample(ctx context.Context, c *dumpConfig, gzip bool) (string, string, error) {
+	if c.plan.Target.Uri == "" {
+		return "", "", errors.Errorf("must use MongoDB URI with '%s' backup mode", c.plan.Mode)
+	}
+	if s := c.plan.Sample; c.plan.Mode == config.BackupModeSample {
+		if s == nil || (s.Percent <= 0 && s.Limit <= 0) {
+			return "", "", errors.New("sample mode requires a sample percent or limit")
+		}
+		if s.Percent > 100 {
+			return "", "", errors.Errorf("invalid sample percent %v", s.Percent)
+		}
+	}
+	tr, err := newTransformer(c.plan.Transform)
+	if err != nil {
+		return "", "", err
+	}
+
+	archive := fmt.Sprintf("%v/%v-%v.tar", c.tmpPath, c.name, c.ts.Unix())
+	if gzip {
+		archive += ".gz"
+	}
+	mlog := fmt.Sprintf("%v/%v-%v.log", c.tmpPath, c.name, c.ts.Unix())
+	dir := fmt.Sprintf("%v/%v-%v.sample", c.tmpPath, c.name, c.ts.Unix())
+	defer os.RemoveAll(dir)
+
+	dctx, cancel := withTimeout(ctx, c.plan.Scheduler.DumpTimeout())
+	defer cancel()
+
+	opts := options.Client().ApplyURI(c.plan.Target.Uri)
+	if c.plan.Target.ReadConcern != "" {
+		opts.SetReadConcern(readconcern.New(readconcern.Level(c.plan.Target.ReadConcern)))
+	}
+	client, err := mongo.Connect(dctx, opts)
+	if err != nil {
+		return "", "", fmt.Errorf("failed to connect to MongoDB %s: %s", redactUri(c.plan.Target.Uri), err)
+	}
+	defer client.Disconnect(context.Background())
+
+	dbNames := []string{c.database}
+	if c.database == "" {
+		dbNames, err = listDatabaseNames(dctx, client, c.plan.Target)
+		if err != nil {
+			return "", "", fmt.Errorf("failed to list databases: %s", err)
+		}
+	}
+
+	var report strings.Builder
+	for _, dbName := range dbNames {
+		if dbName == "admin" || dbName == "config" || dbName == "local" {
+			continue
+		}
+		if skipDatabase(c.plan.Target, dbName) {
+			continue
+		}
+		if err := sampleDatabase(dctx, c, tr, client.Database(dbName), filepath.Join(dir, dbName), &report); err != nil {
+			return "", "", err
+		}
+	}
+	if c.plan.Mode == config.BackupModeMetadata {
+		if err := dumpUsersAndRoles(dctx, c, client.Database("admin"), filepath.Join(dir, "admin"), &report); err != nil {
+			return "", "", err
+		}
+	}
+
+	if err := tarDir(dctx, dir, archive, gzip); err != nil {
+		os.Remove(archive)
+		return "", "", err
+	}
+	logToFile(mlog, []byte(report.String()))
+
+	log.WithField("plan", c.name).Infof("Sample export finished %v", archive)
+	return archive, mlog, nil
+}
+
+type collectionSpec struct {
+	Name    string   `bson:"name"`
+	Type    string   `bson:"type"`
+	Options bson.Raw `bson:"options"`
+}
+
+func sampleDatabase(ctx context.Context, c *dumpConfig, tr *transformer, db *mongo.Database, dir string, report io.Writer) error {
+	cur, err := db.ListCollections(ctx, bson.D{})
+	if err != nil {
+		return errors.Wrapf(err, "listing collections of %v failed", db.Name())
+	}
+	specs := make([]collectionSpec, 0)
+	if err := cur.All(ctx, &specs); err != nil {
+		return errors.Wrapf(err, "listing collections of %v failed", db.Name())
+	}
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return errors.Wrapf(err, "creating dir %v failed", dir)
+	}
+
+specLoop:
+	for _, spec := range specs {
+		if spec.Type == "view" || strings.HasPrefix(spec.Name, "system.") {
+			continue
+		}
+		if c.plan.Target.Collection != "" && spec.Name != c.plan.Target.Collection {
+			continue
+		}
+		for _, excluded := range c.plan.Target.ExcludeCollections {
+			if matchName(excluded, spec.Name) {
+				continue specLoop
+			}
+		}
+
+		n, err := sampleCollection(ctx, c, tr, db.Collection(spec.Name), spec, dir)
+		if err != nil {
+			return err
+		}
+		if c.plan.Mode == config.BackupModeMetadata {
+			fmt.Fprintf(report, "dumped the metadata of %v.%v\n", db.Name(), spec.Name)
+		} else {
+			fmt.Fprintf(report, "sampled %v documents from %v.%v\n", n, db.Name(), spec.Name)
+		}
+	}
+	return nil
+}
+
+func sampleCollection(ctx context.Context, c *dumpConfig, tr *transformer, coll *mongo.Collection, spec collectionSpec, dir string) (int64, error) {
+	ns := coll.Database().Name() + "." + coll.Name()
+	size := int64(0)
+	if c.plan.Mode == config.BackupModeSample {
+		count, err := coll.EstimatedDocumentCount(ctx)
+		if err != nil {
+			return 0, errors.Wrapf(err, "counting %v failed", ns)
+		}
+		size = c.plan.Sample.Limit
+		if c.plan.Sample.Percent > 0 {
+			size = int64(math.Ceil(float64(count) * c.plan.Sample.Percent / 100))
+			if c.plan.Sample.Limit > 0 && size > c.plan.Sample.Limit {
+				size = c.plan.Sample.Limit
+			}
+		}
+	}
+
+	f, err := os.Create(filepath.Join(dir, coll.Name()+".bson"))
+	if err != nil {
+		return 0, errors.Wrapf(err, "creating %v dump failed", ns)
+	}
+	defer f.Close()
+	w := bufio.NewWriter(f)
+	rule := tr.forNamespace(ns)
+
+	written := int64(0)
+	if size > 0 {
+		pipeline := mongo.Pipeline{{{Key: "$sample", Value: bson.D{{Key: "size", Value: size}}}}}
+		cur, err := coll.Aggregate(ctx, pipeline, options.Aggregate().SetAllowDiskUse(true))
+		if err != nil {
+			return 0, errors.Wrapf(err, "sampling %v failed", ns)
+		}
+		defer cur.Close(ctx)
+		for cur.Next(ctx) {
+			doc := cur.Current
+			if rule != nil {
+				if doc, err = tr.apply(rule, doc); err != nil {
+					return 0, errors.Wrapf(err, "transforming %v failed", ns)
+				}
+			}
+			if _, err := w.Write(doc); err != nil {
+				return 0, errors.Wrapf(err, "writing %v dump failed", ns)
+			}
+			written++
+		}
+		if err := cur.Err(); err != nil {
+			return 0, errors.Wrapf(err, "sampling %v failed", ns)
+		}
+	}
+	if err := w.Flush(); err != nil {
+		return 0, errors.Wrapf(err, "writing %v dump failed", ns)
+	}
+
+	// the indexes and options keep the sample structurally complete
+	icur, err := coll.Indexes().List(ctx)
+	if err != nil {
+		return 0, errors.Wrapf(err, "listing indexes of %v failed", ns)
+	}
+	indexes := make([]bson.Raw, 0)
+	if err := icur.All(ctx, &indexes); err != nil {
+		return 0, errors.Wrapf(err, "listing indexes of %v failed", ns)
+	}
+	opts := spec.Options
+	if opts == nil {
+		opts = bson.Raw{5, 0, 0, 0, 0}
+	}
+	metadata, err := bson.MarshalExtJSON(bson.D{
+		{Key: "options", Value: opts},
+		{Key: "indexes", Value: indexes},
+		{Key: "collectionName", Value: coll.Name()},
+	}, true, false)
+	if err != nil {
+		return 0, errors.Wrapf(err, "encoding %v metadata failed", ns)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, coll.Name()+".metadata.json"), metadata, 0644); err != nil {
+		return 0, errors.Wrapf(err, "writing %v metadata failed", ns)
+	}
+
+	return written, nil
+}
+
+// tarDir packs the files under dir into archive with paths relative to dir.
+func tarDir(ctx context.Context, dir string, archive string, compress bool) error {
+	f, err := os.Create(archive)
+	if err != nil {
+		return errors.Wrapf(err, "creating %v failed", archive)
+	}
+	defer f.Close()
+
+	var w io.Writer = f
+	var gz *gzip.Writer
+	if compress {
+		gz = gzip.NewWriter(f)
+		w = gz
+	}
+	tw := tar.NewWriter(w)
+
+	err = filepath.Walk(dir, func(path string, fi os.FileInfo, err error) error {
+		if err != nil || path == dir {
+			return err
+		}
+		hdr, err := tar.FileInfoHeader(fi, "")
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		hdr.Name = filepath.ToSlash(rel)
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if fi.IsDir() {
+			return nil
+		}
+		in, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer in.Close()
+		_, err = io.Copy(tw, ctxReader{ctx: ctx, r: in})
+		return err
+	})
+	if err == nil {
+		err = tw.Close()
+	}
+	if err == nil && gz != nil {
+		err = gz.Close()
+	}
+	if err != nil {
+		return errors.Wrapf(err, "packing %v failed", archive)
+	}
+	return f.Close()
+}
@@ -0,0 +1,57 @@
+package backup
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// scanRejected is the scanner exit code for an archive that must not be uploaded.
+const scanRejected = 1
+
+// scan runs the plan scanner with the archive files as arguments. Rejected
+// files are moved to the quarantine dir, any other failure leaves them in place,
+// in both cases the run fails before the upload.
+func scan(ctx context.Context, c *dumpConfig, files []string) error {
+	s := c.plan.Scan
+	if s.Command.Empty() {
+		return errors.New("scan requires a command")
+	}
+
+	sctx, cancel := withTimeout(ctx, s.Timeout)
+	defer cancel()
+
+	output, err := combinedOutput(sctx, userCommand(s.Command, files...))
+	out := strings.Replace(strings.TrimSpace(string(output)), "\n", " ", -1)
+	if err == nil {
+		log.WithField("plan", c.name).Infof("Scan passed %v", out)
+		return nil
+	}
+
+	exitErr, ok := errors.Cause(err).(*exec.ExitError)
+	if !ok || exitErr.ExitCode() != scanRejected || sctx.Err() != nil {
+		return errors.Wrapf(err, "scan of %v failed %v", c.name, out)
+	}
+
+	dir := s.Quarantine
+	if dir == "" {
+		// not under the storage path, it's served over HTTP
+		dir = filepath.Join(c.conf.DataPath, "quarantine")
+	}
+	dir = filepath.Join(dir, c.plan.Name)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return errors.Wrapf(err, "archive rejected by scan %v, creating quarantine dir %v failed", out, dir)
+	}
+	for _, file := range files {
+		if err := moveFile(file, filepath.Join(dir, filepath.Base(file))); err != nil {
+			return errors.Wrapf(err, "archive rejected by scan %v, quarantine failed", out)
+		}
+	}
+	log.WithField("plan", c.name).Warnf("Archive rejected by scan, moved to %v", dir)
+	return errors.Errorf("archive rejected by scan and quarantined in %v %v", dir, out)
+}
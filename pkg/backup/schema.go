@@ -0,0 +1,87 @@
+package backup
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+
+	"github.com/stefanprodan/mgob/pkg/config"
+)
+
+// checkMetadataMode validates the plans of the metadata mode, no documents
+// are dumped so the options selecting or replaying them are rejected.
+func checkMetadataMode(plan config.Plan) error {
+	if plan.Mode != config.BackupModeMetadata {
+		return nil
+	}
+	switch {
+	case plan.Target.PointInTime || plan.PITR != nil:
+		return errors.Errorf("pointInTime and pitr can't be used with '%s' backup mode", plan.Mode)
+	case plan.Sample != nil:
+		return errors.Errorf("sample requires '%s' backup mode", config.BackupModeSample)
+	}
+	return nil
+}
+
+// dumpUsersAndRoles writes the users and roles of the dumped database, all
+// when the plan has none, as admin/system.users.bson and system.roles.bson
+// along with the auth schema version mongorestore checks before loading them.
+func dumpUsersAndRoles(ctx context.Context, c *dumpConfig, admin *mongo.Database, dir string, report io.Writer) error {
+	filter := bson.D{}
+	if c.database != "" {
+		filter = bson.D{{Key: "db", Value: c.database}}
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return errors.Wrapf(err, "creating dir %v failed", dir)
+	}
+	users, err := dumpAdminCollection(ctx, admin.Collection("system.users"), filter, dir)
+	if err != nil {
+		return err
+	}
+	roles, err := dumpAdminCollection(ctx, admin.Collection("system.roles"), filter, dir)
+	if err != nil {
+		return err
+	}
+	if _, err := dumpAdminCollection(ctx, admin.Collection("system.version"), bson.D{{Key: "_id", Value: "authSchema"}}, dir); err != nil {
+		return err
+	}
+	fmt.Fprintf(report, "dumped %v users and %v roles\n", users, roles)
+	return nil
+}
+
+func dumpAdminCollection(ctx context.Context, coll *mongo.Collection, filter bson.D, dir string) (int64, error) {
+	ns := "admin." + coll.Name()
+	cur, err := coll.Find(ctx, filter)
+	if err != nil {
+		return 0, errors.Wrapf(err, "reading %v failed", ns)
+	}
+	defer cur.Close(ctx)
+
+	f, err := os.Create(filepath.Join(dir, coll.Name()+".bson"))
+	if err != nil {
+		return 0, errors.Wrapf(err, "creating %v dump failed", ns)
+	}
+	defer f.Close()
+	w := bufio.NewWriter(f)
+	written := int64(0)
+	for cur.Next(ctx) {
+		if _, err := w.Write(cur.Current); err != nil {
+			return 0, errors.Wrapf(err, "writing %v dump failed", ns)
+		}
+		written++
+	}
+	if err := cur.Err(); err != nil {
+		return 0, errors.Wrapf(err, "reading %v failed", ns)
+	}
+	if err := w.Flush(); err != nil {
+		return 0, errors.Wrapf(err, "writing %v dump failed", ns)
+	}
+	return written, nil
+}
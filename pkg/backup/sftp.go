@@ -1,11 +1,11 @@
 package backup
 
 import (
+	"context"
 	"fmt"
 	"io"
-	"io/ioutil"
-	"net"
 	"os"
+	"path"
 	"path/filepath"
 	"time"
 
@@ -13,57 +13,142 @@ import (
 	"github.com/pkg/sftp"
 	"golang.org/x/crypto/ssh"
 
+	"github.com/stefanprodan/mgob/pkg/clock"
 	"github.com/stefanprodan/mgob/pkg/config"
 )
 
-func sftpUpload(file string, plan config.Plan) (string, error) {
-	t1 := time.Now()
-	var ams []ssh.AuthMethod
-	if plan.SFTP.Password != "" {
-		ams = append(ams, ssh.Password(plan.SFTP.Password))
+type sftpDestination struct {
+	plan config.Plan
+}
+
+func newSFTPDestination(plan config.Plan, conf *config.AppConfig, ts time.Time) Destination {
+	if plan.SFTP == nil {
+		return nil
 	}
+	return &sftpDestination{plan: plan}
+}
 
-	if plan.SFTP.PrivateKey != "" {
-		key, err := ioutil.ReadFile(plan.SFTP.PrivateKey)
-		if err != nil {
-			return "", errors.Wrapf(err, "Reading private_key from file %s", plan.SFTP.PrivateKey)
-		}
+func (d *sftpDestination) Name() string {
+	return "SFTP"
+}
+
+func (d *sftpDestination) Upload(ctx context.Context, file string) (string, error) {
+	return sftpUpload(ctx, file, d.plan)
+}
+
+func (d *sftpDestination) List(ctx context.Context) ([]Object, error) {
+	sshCon, sftpClient, err := sftpConnect(ctx, d.plan)
+	if err != nil {
+		return nil, err
+	}
+	defer sshCon.Close()
+	defer sftpClient.Close()
+	defer closeOnDone(ctx, sshCon)()
 
-		var signer ssh.Signer
-		switch {
-		case plan.SFTP.PrivateKey != "" && plan.SFTP.Passphrase != "":
-			signer, err = ssh.ParsePrivateKeyWithPassphrase(key, []byte(plan.SFTP.Passphrase))
-			if err != nil {
-				return "", errors.Wrapf(err, "Parsing private key from file %s", plan.SFTP.PrivateKey)
-			}
-		case plan.SFTP.PrivateKey != "":
-			signer, err = ssh.ParsePrivateKey(key)
-			if err != nil {
-				return "", errors.Wrapf(err, "Parsing private key from file %s", plan.SFTP.PrivateKey)
-			}
+	list, err := sftpClient.ReadDir(d.plan.SFTP.Dir)
+	if err != nil {
+		return nil, errors.Wrapf(err, "SFTP reading %v dir failed", d.plan.SFTP.Dir)
+	}
+	objects := make([]Object, 0)
+	for _, item := range list {
+		if !item.IsDir() {
+			objects = append(objects, Object{Name: item.Name(), Size: item.Size()})
 		}
-		ams = append(ams, ssh.PublicKeys(signer))
 	}
+	return objects, nil
+}
 
-	sshConf := &ssh.ClientConfig{
-		User: plan.SFTP.Username,
-		Auth: ams,
-		HostKeyCallback: func(hostname string, remote net.Addr, key ssh.PublicKey) error {
-			return nil
-		},
+func (d *sftpDestination) Delete(ctx context.Context, name string) error {
+	sshCon, sftpClient, err := sftpConnect(ctx, d.plan)
+	if err != nil {
+		return err
+	}
+	defer sshCon.Close()
+	defer sftpClient.Close()
+	defer closeOnDone(ctx, sshCon)()
+
+	dstPath := path.Join(d.plan.SFTP.Dir, name)
+	if err := sftpClient.Remove(dstPath); err != nil {
+		return errors.Wrapf(err, "SFTP %v:%v deleting file %v failed", d.plan.SFTP.Host, d.plan.SFTP.Port, dstPath)
+	}
+	return nil
+}
+
+func (d *sftpDestination) Verify(ctx context.Context, file string) error {
+	sshCon, sftpClient, err := sftpConnect(ctx, d.plan)
+	if err != nil {
+		return err
+	}
+	defer sshCon.Close()
+	defer sftpClient.Close()
+	defer closeOnDone(ctx, sshCon)()
+
+	dstPath := path.Join(d.plan.SFTP.Dir, filepath.Base(file))
+	fi, err := sftpClient.Stat(dstPath)
+	if err != nil {
+		return errors.Wrapf(err, "SFTP %v:%v verifying file %v failed", d.plan.SFTP.Host, d.plan.SFTP.Port, dstPath)
 	}
+	return checkSize(file, fi.Size())
+}
 
-	sshCon, err := ssh.Dial("tcp", fmt.Sprintf("%v:%v", plan.SFTP.Host, plan.SFTP.Port), sshConf)
+func (d *sftpDestination) Download(ctx context.Context, file string, dst string) error {
+	sshCon, sftpClient, err := sftpConnect(ctx, d.plan)
 	if err != nil {
-		return "", errors.Wrapf(err, "SSH dial to %v:%v failed", plan.SFTP.Host, plan.SFTP.Port)
+		return err
 	}
 	defer sshCon.Close()
+	defer sftpClient.Close()
+	defer closeOnDone(ctx, sshCon)()
+
+	srcPath := path.Join(d.plan.SFTP.Dir, filepath.Base(file))
+	sf, err := sftpClient.Open(srcPath)
+	if err != nil {
+		return errors.Wrapf(err, "SFTP %v:%v opening file %v failed", d.plan.SFTP.Host, d.plan.SFTP.Port, srcPath)
+	}
+	defer sf.Close()
+
+	f, err := os.Create(dst)
+	if err != nil {
+		return errors.Wrapf(err, "Creating file %v failed", dst)
+	}
+	if _, err := io.Copy(f, ctxReader{ctx, sf}); err != nil {
+		f.Close()
+		return errors.Wrapf(err, "SFTP %v:%v download file %v failed", d.plan.SFTP.Host, d.plan.SFTP.Port, srcPath)
+	}
+	return f.Close()
+}
+
+func sftpConnect(ctx context.Context, plan config.Plan) (*ssh.Client, *sftp.Client, error) {
+	sshCon, err := sshConnect(ctx, sshTarget{
+		Host:       plan.SFTP.Host,
+		Port:       plan.SFTP.Port,
+		Username:   plan.SFTP.Username,
+		Password:   plan.SFTP.Password,
+		PrivateKey: plan.SFTP.PrivateKey,
+		Passphrase: plan.SFTP.Passphrase,
+	})
+	if err != nil {
+		return nil, nil, err
+	}
 
 	sftpClient, err := sftp.NewClient(sshCon)
 	if err != nil {
-		return "", errors.Wrapf(err, "SFTP client init %v:%v failed", plan.SFTP.Host, plan.SFTP.Port)
+		sshCon.Close()
+		return nil, nil, errors.Wrapf(err, "SFTP client init %v:%v failed", plan.SFTP.Host, plan.SFTP.Port)
 	}
+
+	return sshCon, sftpClient, nil
+}
+
+func sftpUpload(ctx context.Context, file string, plan config.Plan) (string, error) {
+	t1 := clock.Now()
+	sshCon, sftpClient, err := sftpConnect(ctx, plan)
+	if err != nil {
+		return "", err
+	}
+	defer sshCon.Close()
 	defer sftpClient.Close()
+	defer closeOnDone(ctx, sshCon)()
 
 	f, err := os.Open(file)
 	if err != nil {
@@ -71,6 +156,11 @@ func sftpUpload(file string, plan config.Plan) (string, error) {
 	}
 	defer f.Close()
 
+	if plan.Tenant != "" {
+		if err := sftpClient.MkdirAll(plan.SFTP.Dir); err != nil {
+			return "", errors.Wrapf(err, "SFTP %v:%v creating tenant dir %v failed", plan.SFTP.Host, plan.SFTP.Port, plan.SFTP.Dir)
+		}
+	}
 	_, fname := filepath.Split(file)
 	dstPath := filepath.Join(plan.SFTP.Dir, fname)
 	sf, err := sftpClient.Create(dstPath)
@@ -78,29 +168,14 @@ func sftpUpload(file string, plan config.Plan) (string, error) {
 		return "", errors.Wrapf(err, "SFTP %v:%v creating file %v failed", plan.SFTP.Host, plan.SFTP.Port, dstPath)
 	}
 
-	_, err = io.Copy(sf, f)
+	_, err = io.Copy(sf, ctxReader{ctx, f})
 	if err != nil {
 		return "", errors.Wrapf(err, "SFTP %v:%v upload file %v failed", plan.SFTP.Host, plan.SFTP.Port, dstPath)
 	}
 	sf.Close()
 
-	//listSftpBackups(sftpClient, plan.SFTP.Dir)
-
-	t2 := time.Now()
-	msg := fmt.Sprintf("SFTP upload finished `%v` -> `%v` Duration: %v",
+	t2 := clock.Now()
+	msg := fmt.Sprintf("`%v` -> `%v` Duration: %v",
 		file, dstPath, t2.Sub(t1))
 	return msg, nil
 }
-
-func listSftpBackups(client *sftp.Client, dir string) error {
-	list, err := client.ReadDir(fmt.Sprintf("/%v", dir))
-	if err != nil {
-		return errors.Wrapf(err, "SFTP reading %v dir failed", dir)
-	}
-
-	for _, item := range list {
-		fmt.Println(item.Name())
-	}
-
-	return nil
-}
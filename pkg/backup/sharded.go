@@ -0,0 +1,327 @@
+package backup
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"github.com/stefanprodan/mgob/pkg/clock"
+	"github.com/stefanprodan/mgob/pkg/config"
+)
+
+// ClusterManifestExt is the extension of the file listing the archives of a sharded backup.
+const ClusterManifestExt = ".cluster.json"
+
+const defaultBalancerTimeout = 300 * time.Second
+
+// ClusterManifest lists the archives a sharded backup produced, one for the
+// config server and one for each shard.
+type ClusterManifest struct {
+	Plan      string    `json:"plan"`
+	Timestamp time.Time `json:"timestamp"`
+	// Balancer is the balancer mode before the backup, it was stopped during the dumps
+	Balancer   string             `json:"balancer"`
+	Components []ClusterComponent `json:"components"`
+}
+
+type ClusterComponent struct {
+	// Name is config or the shard id
+	Name string `json:"name"`
+	// Host is the replica set connection string mongos reports, e.g. rs0/h1:27018,h2:27018
+	Host     string `json:"host"`
+	Archive  string `json:"archive"`
+	Checksum string `json:"checksum,omitempty"`
+	Size     int64  `json:"size"`
+}
+
+// checkSharded validates the plans of the sharded mode.
+func checkSharded(plan config.Plan) error {
+	if plan.Mode != config.BackupModeSharded {
+		if plan.Sharded != nil {
+			return errors.Errorf("sharded requires '%s' backup mode", config.BackupModeSharded)
+		}
+		return nil
+	}
+	t := plan.Target
+	switch {
+	case t.Uri == "":
+		return errors.Errorf("must use MongoDB URI with '%s' backup mode", plan.Mode)
+	case plan.Agent != "" || plan.Executor != nil:
+		return errors.Errorf("'%s' backup mode dumps each shard from this host, it can't run on an agent or executor", plan.Mode)
+	case plan.Health != nil || plan.Throttle != nil:
+		return errors.Errorf("health and throttle check a replica set, they can't be used with '%s' backup mode", plan.Mode)
+	case plan.PITR != nil:
+		return errors.Errorf("pitr can't be used with '%s' backup mode", plan.Mode)
+	case t.PointInTime && (t.Database != "" || t.Collection != ""):
+		return errors.New("pointInTime can't be used with target.database or target.collection")
+	case len(t.IncludeDatabases) != 0 || len(t.ExcludeDatabases) != 0:
+		return errors.Errorf("cannot include or exclude databases with '%s' backup mode", plan.Mode)
+	}
+	if plan.Sharded != nil && plan.Sharded.Parallel < 0 {
+		return errors.New("sharded parallel can't be negative")
+	}
+	return nil
+}
+
+// runSharded stops the balancer so no chunk moves between the dumps, then dumps
+// the config server and every shard replica set to their own archives and
+// writes the cluster manifest listing them. The balancer is restarted when it was running.
+func runSharded(ctx context.Context, c *dumpConfig) (Result, error) {
+	res := errRes(c)
+	cctx, cancel := context.WithTimeout(ctx, mongodbDatabaseListTimeout)
+	defer cancel()
+	client, err := mongo.Connect(cctx, options.Client().ApplyURI(c.plan.Target.Uri))
+	if err != nil {
+		return res, fmt.Errorf("failed to connect to MongoDB %s: %s", redactUri(c.plan.Target.Uri), err)
+	}
+	defer client.Disconnect(context.Background())
+
+	components, err := clusterComponents(cctx, client)
+	if err != nil {
+		return res, err
+	}
+
+	mode, err := stopBalancer(ctx, client, c.plan.Sharded)
+	if err != nil {
+		return res, err
+	}
+	if mode != "off" {
+		log.WithField("plan", c.name).Infof("Balancer stopped, %v components to dump", len(components))
+		defer func() {
+			bctx, cancel := context.WithTimeout(context.Background(), mongodbDatabaseListTimeout)
+			defer cancel()
+			err := client.Database("admin").RunCommand(bctx, bson.D{{Key: "balancerStart", Value: 1}}).Err()
+			if err != nil {
+				log.WithField("plan", c.name).Errorf("Restarting the balancer failed: %v", err)
+				return
+			}
+			log.WithField("plan", c.name).Info("Balancer restarted")
+		}()
+	}
+
+	parallel := 1
+	if c.plan.Sharded != nil && c.plan.Sharded.Parallel > 0 {
+		parallel = c.plan.Sharded.Parallel
+	}
+	results := make([]Result, len(components))
+	errs := make([]error, len(components))
+	sem := make(chan struct{}, parallel)
+	var wg sync.WaitGroup
+	for n, comp := range components {
+		uri, err := componentUri(c.plan.Target.Uri, comp.Host)
+		if err != nil {
+			errs[n] = err
+			continue
+		}
+		wg.Add(1)
+		go func(n int, comp ClusterComponent, uri string) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			if ctx.Err() != nil {
+				errs[n] = ctx.Err()
+				return
+			}
+			compConf := *c
+			compConf.name = fmt.Sprintf("%s-%s", c.plan.Name, comp.Name)
+			compConf.plan.Target.Uri = uri
+			log.WithField("plan", c.name).Infof("Dumping %v %v", comp.Name, comp.Host)
+			results[n], errs[n] = runDumpAndUpload(ctx, &compConf)
+		}(n, comp, uri)
+	}
+	wg.Wait()
+
+	failed := make([]string, 0)
+	for n, err := range errs {
+		if err != nil {
+			log.WithField("plan", c.name).Errorf("Backup of %v failed: %s", components[n].Name, err)
+			failed = append(failed, components[n].Name)
+		}
+	}
+	res.Duration = clock.Since(c.ts)
+	if len(failed) > 0 {
+		return res, fmt.Errorf("%d of %d component backups failed: %s", len(failed), len(components), strings.Join(failed, ","))
+	}
+
+	m := ClusterManifest{Plan: c.name, Timestamp: c.ts.UTC(), Balancer: mode}
+	res.Shards = make(map[string]int64, len(components))
+	for n, comp := range components {
+		r := results[n]
+		comp.Archive = r.Name
+		comp.Checksum = r.Checksum
+		comp.Size = r.Size
+		m.Components = append(m.Components, comp)
+		res.Shards[comp.Name] = r.Size
+		res.Size += r.Size
+		res.Files = append(res.Files, r.Files...)
+		res.Uploads = append(res.Uploads, r.Uploads...)
+	}
+
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return res, errors.Wrap(err, "encoding cluster manifest failed")
+	}
+	res.Name = fmt.Sprintf("%v-%v%v", c.name, c.ts.Unix(), ClusterManifestExt)
+	file := filepath.Join(c.planDir, res.Name)
+	if err := ioutil.WriteFile(file, data, 0644); err != nil {
+		return res, errors.Wrapf(err, "writing cluster manifest %v failed", file)
+	}
+	res.Files = append(res.Files, file)
+	res.Size += int64(len(data))
+	if c.plan.Scheduler.Retention > 0 {
+		if err := retain(ctx, c); err != nil {
+			return res, errors.Wrap(err, "retention job failed")
+		}
+	}
+	u, err := upload(ctx, c, RoutedPlan{Plan: c.plan}, file)
+	if err != nil {
+		return res, err
+	}
+	res.Uploads = append(res.Uploads, u)
+
+	res.Chain = fmt.Sprintf("%v-%v", c.name, c.ts.Unix())
+	res.Status = 200
+	res.Duration = clock.Since(c.ts)
+	log.WithField("plan", c.name).Infof("sharded dump of %v components succeeded", len(components))
+	return res, nil
+}
+
+// clusterComponents returns the config server and the shards of the cluster
+// behind the mongos client, the config server first.
+func clusterComponents(ctx context.Context, client *mongo.Client) ([]ClusterComponent, error) {
+	admin := client.Database("admin")
+	var hello struct {
+		Msg string `bson:"msg"`
+	}
+	if err := admin.RunCommand(ctx, bson.D{{Key: "isMaster", Value: 1}}).Decode(&hello); err != nil {
+		return nil, errors.Wrap(err, "isMaster failed")
+	}
+	if hello.Msg != "isdbgrid" {
+		return nil, errors.Errorf("'%s' backup mode requires a mongos target", config.BackupModeSharded)
+	}
+
+	var shardMap struct {
+		Map map[string]string `bson:"map"`
+	}
+	if err := admin.RunCommand(ctx, bson.D{{Key: "getShardMap", Value: 1}}).Decode(&shardMap); err != nil {
+		return nil, errors.Wrap(err, "getShardMap failed")
+	}
+	csrs := shardMap.Map["config"]
+	if csrs == "" {
+		return nil, errors.New("getShardMap returned no config server")
+	}
+
+	var list struct {
+		Shards []struct {
+			ID   string `bson:"_id"`
+			Host string `bson:"host"`
+		} `bson:"shards"`
+	}
+	if err := admin.RunCommand(ctx, bson.D{{Key: "listShards", Value: 1}}).Decode(&list); err != nil {
+		return nil, errors.Wrap(err, "listShards failed")
+	}
+	if len(list.Shards) == 0 {
+		return nil, errors.New("listShards returned no shards")
+	}
+	sort.Slice(list.Shards, func(i, j int) bool { return list.Shards[i].ID < list.Shards[j].ID })
+
+	components := []ClusterComponent{{Name: "config", Host: csrs}}
+	for _, s := range list.Shards {
+		components = append(components, ClusterComponent{Name: s.ID, Host: s.Host})
+	}
+	return components, nil
+}
+
+// stopBalancer stops the balancer once the running round ends and returns the
+// mode it was in, off when it was already stopped.
+func stopBalancer(ctx context.Context, client *mongo.Client, s *config.Sharded) (string, error) {
+	admin := client.Database("admin")
+	var status struct {
+		Mode string `bson:"mode"`
+	}
+	if err := admin.RunCommand(ctx, bson.D{{Key: "balancerStatus", Value: 1}}).Decode(&status); err != nil {
+		return "", errors.Wrap(err, "balancerStatus failed")
+	}
+	if status.Mode == "off" {
+		return status.Mode, nil
+	}
+
+	timeout := defaultBalancerTimeout
+	if s != nil && s.BalancerTimeout > 0 {
+		timeout = time.Duration(s.BalancerTimeout) * time.Second
+	}
+	cmd := bson.D{{Key: "balancerStop", Value: 1}, {Key: "maxTimeMS", Value: timeout.Milliseconds()}}
+	if err := admin.RunCommand(ctx, cmd).Err(); err != nil {
+		return "", errors.Wrapf(err, "stopping the balancer failed within %v", timeout)
+	}
+	return status.Mode, nil
+}
+
+// componentUri points the mongos uri at a replica set of the cluster, host is
+// the rs/host1,host2 string mongos reports. The credentials and options are
+// kept, SRV uris are turned into a seedlist with tls on.
+func componentUri(uri string, host string) (string, error) {
+	i := strings.Index(uri, "://")
+	if i < 0 {
+		return "", errors.Errorf("invalid target uri %v", redactUri(uri))
+	}
+	srv := strings.HasPrefix(uri, srvScheme)
+	rest := uri[i+3:]
+	end := strings.IndexAny(rest, "/?")
+	if end < 0 {
+		end = len(rest)
+	}
+	userinfo := ""
+	if at := strings.LastIndex(rest[:end], "@"); at >= 0 {
+		userinfo = rest[:at+1]
+	}
+	path := "/"
+	rawQuery := ""
+	tail := rest[end:]
+	if q := strings.Index(tail, "?"); q >= 0 {
+		rawQuery = tail[q+1:]
+		tail = tail[:q]
+	}
+	if tail != "" {
+		path = tail
+	}
+	query, err := url.ParseQuery(rawQuery)
+	if err != nil {
+		return "", errors.Wrapf(err, "invalid target uri %v", redactUri(uri))
+	}
+
+	setName, hosts := "", host
+	if slash := strings.Index(host, "/"); slash >= 0 {
+		setName, hosts = host[:slash], host[slash+1:]
+	}
+	query.Del("replicaSet")
+	if setName != "" {
+		query.Set("replicaSet", setName)
+	}
+	if srv {
+		if query.Get("tls") == "" && query.Get("ssl") == "" {
+			query.Set("tls", "true")
+		}
+		if userinfo != "" && query.Get("authSource") == "" {
+			query.Set("authSource", "admin")
+		}
+	}
+	out := "mongodb://" + userinfo + hosts + path
+	if len(query) > 0 {
+		out += "?" + query.Encode()
+	}
+	return out, nil
+}
@@ -0,0 +1,111 @@
+package backup
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"sort"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/stefanprodan/mgob/pkg/config"
+)
+
+// DumpCommand returns the command a run of plan at ts starts, with the
+// credentials masked. Database mode runs it once per database, named
+// {database} here. It's empty for the sample and csi modes which don't run
+// mongodump and the snapshot mode without a command.
+func DumpCommand(plan config.Plan, conf *config.AppConfig, ts time.Time) []string {
+	c := &dumpConfig{
+		plan:     plan,
+		database: plan.Target.Database,
+		conf:     conf,
+		tmpPath:  conf.TmpPath,
+		ts:       ts,
+		name:     plan.Name,
+	}
+	switch plan.Mode {
+	case config.BackupModeSample, config.BackupModeMetadata, config.BackupModeWatch, config.BackupModeCSI, config.BackupModeDisk, config.BackupModeAtlas:
+		return nil
+	case config.BackupModeExec:
+		if plan.Exec == nil {
+			return nil
+		}
+		return userCommand(plan.Exec.Command).Args
+	case config.BackupModeSnapshot:
+		if plan.Snapshot == nil || plan.Snapshot.Command.Empty() {
+			return nil
+		}
+		return userCommand(plan.Snapshot.Command).Args
+	case config.BackupModeDatabase:
+		c.database = "{database}"
+		c.name = fmt.Sprintf("%s-%s", plan.Name, c.database)
+	case config.BackupModeSharded:
+		c.name = fmt.Sprintf("%s-{shard}", plan.Name)
+	case config.BackupModeMigrate:
+		// the archive is piped to mongorestore
+		_, _, args := dumpArgs(c, false)
+		args[0] = "--archive"
+		return append([]string{"mongodump"}, maskArgs(args)...)
+	case config.BackupModeExport:
+		// the first collection, the others run the same command
+		coll := exportCollections(plan)[0]
+		file := fmt.Sprintf("%v/%v-%v.export/%v.%v%v", c.tmpPath, c.name, ts.Unix(), plan.Target.Database, coll, exportExt(plan))
+		return append([]string{"mongoexport"}, maskArgs(exportArgs(c, coll, file))...)
+	}
+	compresses := false
+	for _, st := range plan.Pipeline {
+		if st.Type == config.StageCompress {
+			compresses = true
+		}
+	}
+	_, _, args := dumpArgs(c, !compresses)
+	return append([]string{"mongodump"}, maskArgs(args)...)
+}
+
+// ExpiredFiles returns the files of the plan dir the retention of the next run
+// removes, it keeps retention backups including the new one.
+func ExpiredFiles(plan config.Plan, conf *config.AppConfig) ([]string, error) {
+	retention := plan.Scheduler.Retention
+	if retention <= 0 {
+		return []string{}, nil
+	}
+	dir := config.PlanDir(conf.StoragePath, plan)
+	files, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return []string{}, nil
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "reading %v failed", dir)
+	}
+
+	list := make([]string, 0)
+	for name := range retentionNames(plan, files) {
+		backups, stamps := retentionGroups(files, name)
+		for i := retention - 1; i < len(stamps); i++ {
+			list = append(list, backups[stamps[i]]...)
+		}
+	}
+	sort.Strings(list)
+	return list, nil
+}
+
+// retentionNames returns the backup names the retention rotates on their own,
+// each database or shard in the database and sharded modes.
+func retentionNames(plan config.Plan, files []os.FileInfo) map[string]bool {
+	names := map[string]bool{}
+	if plan.Mode != config.BackupModeDatabase {
+		names[plan.Name] = true
+	}
+	if plan.Mode == config.BackupModeDatabase || plan.Mode == config.BackupModeSharded {
+		re := regexp.MustCompile(`^(` + regexp.QuoteMeta(plan.Name) + `-.+)-\d+\.`)
+		for _, f := range files {
+			if m := re.FindStringSubmatch(f.Name()); m != nil && !f.IsDir() {
+				names[m[1]] = true
+			}
+		}
+	}
+	return names
+}
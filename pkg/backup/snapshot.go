@@ -0,0 +1,207 @@
+package backup
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"github.com/stefanprodan/mgob/pkg/clock"
+	"github.com/stefanprodan/mgob/pkg/config"
+)
+
+const defaultLockTimeout = 10 * time.Minute
+
+// checkSnapshot validates the plans of the snapshot mode.
+func checkSnapshot(plan config.Plan) error {
+	if plan.Mode != config.BackupModeSnapshot {
+		if plan.Snapshot != nil {
+			return errors.Errorf("snapshot requires '%s' backup mode", config.BackupModeSnapshot)
+		}
+		return nil
+	}
+	t := plan.Target
+	s := plan.Snapshot
+	switch {
+	case t.Uri == "":
+		return errors.Errorf("must use MongoDB URI with '%s' backup mode", plan.Mode)
+	case s == nil || (s.DbPath == "" && s.Command.Empty()):
+		return errors.Errorf("'%s' backup mode requires a snapshot dbPath or command", plan.Mode)
+	case s.DbPath != "" && !s.Command.Empty():
+		return errors.New("snapshot dbPath and command can't be used together, the command gets the dbPath from the member")
+	case s.LockTimeout < 0:
+		return errors.New("snapshot lockTimeout can't be negative")
+	case plan.Agent != "" || plan.Executor != nil:
+		return errors.Errorf("'%s' backup mode can't run on an agent or executor", plan.Mode)
+	case t.PointInTime || plan.PITR != nil:
+		return errors.Errorf("pointInTime and pitr can't be used with '%s' backup mode, the locked member has no writes to capture", plan.Mode)
+	case t.Database != "" || t.Collection != "" || len(t.IncludeDatabases) != 0 || len(t.ExcludeDatabases) != 0:
+		return errors.Errorf("'%s' backup mode copies the whole dbPath, it can't select databases or collections", plan.Mode)
+	}
+	return nil
+}
+
+// dumpSnapshot locks a secondary with fsyncLock and archives its dbPath, or
+// runs the snapshot command and archives the copy it reports once unlocked.
+// The member is unlocked when the lock timeout elapses.
+func dumpSnapshot(ctx context.Context, c *dumpConfig, compress bool) (string, string, error) {
+	s := c.plan.Snapshot
+	timeout := defaultLockTimeout
+	if s.LockTimeout > 0 {
+		timeout = time.Duration(s.LockTimeout) * time.Minute
+	}
+
+	member := s.Member
+	if member == "" {
+		var err error
+		if member, err = secondaryMember(ctx, c.plan.Target.Uri); err != nil {
+			return "", "", err
+		}
+	}
+	lctx, lcancel := context.WithTimeout(ctx, timeout)
+	defer lcancel()
+	unlock, err := lockMember(lctx, c, member)
+	if err != nil {
+		return "", "", err
+	}
+	defer unlock()
+
+	sc := *c
+	if s.Command.Empty() {
+		sc.source = s.DbPath
+		archive, mlog, err := dumpSource(lctx, &sc, compress)
+		if err != nil {
+			return "", "", errors.Wrapf(err, "copying %v of %v locked for %v", s.DbPath, member, timeout)
+		}
+		return archive, mlog, nil
+	}
+
+	var stdout, stderr bytes.Buffer
+	cmd := userCommand(s.Command)
+	cmd.Env = append(os.Environ(),
+		"MGOB_PLAN="+c.plan.Name,
+		"MGOB_TMP_PATH="+c.tmpPath,
+		fmt.Sprintf("MGOB_TIMESTAMP=%v", c.ts.Unix()),
+		"MGOB_MEMBER="+member,
+	)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	log.WithField("plan", c.name).Debugf("snapshot cmd: %v", s.Command)
+	p, err := startProcess(lctx, cmd)
+	if err == nil {
+		err = p.Wait()
+	}
+	unlock()
+	if err != nil {
+		return "", "", errors.Wrapf(err, "snapshot log %v", strings.Replace(stderr.String(), "\n", " ", -1))
+	}
+
+	lines := strings.Split(strings.TrimSpace(stdout.String()), "\n")
+	artifact := strings.TrimSpace(lines[len(lines)-1])
+	if artifact == "" {
+		return "", "", errors.New("snapshot command printed no copy path")
+	}
+	sc.source = artifact
+	archive, mlog, err := dumpSource(ctx, &sc, compress)
+	if err != nil {
+		return "", "", err
+	}
+	if err := os.RemoveAll(artifact); err != nil {
+		log.WithField("plan", c.name).Warnf("Removing %v failed %v", artifact, err)
+	}
+	logToFile(mlog, append(stdout.Bytes(), stderr.Bytes()...))
+	return archive, mlog, nil
+}
+
+// secondaryMember returns the first healthy secondary of the replica set of uri.
+func secondaryMember(ctx context.Context, uri string) (string, error) {
+	cctx, cancel := context.WithTimeout(ctx, mongodbDatabaseListTimeout)
+	defer cancel()
+	client, err := mongo.Connect(cctx, options.Client().ApplyURI(uri))
+	if err != nil {
+		return "", fmt.Errorf("failed to connect to MongoDB %s: %s", redactUri(uri), err)
+	}
+	defer client.Disconnect(context.Background())
+
+	var status struct {
+		Members []struct {
+			Name   string `bson:"name"`
+			State  int    `bson:"state"`
+			Health int    `bson:"health"`
+		} `bson:"members"`
+	}
+	if err := client.Database("admin").RunCommand(cctx, bson.D{{Key: "replSetGetStatus", Value: 1}}).Decode(&status); err != nil {
+		return "", errors.Wrap(err, "replSetGetStatus failed")
+	}
+	secondaries := make([]string, 0)
+	for _, m := range status.Members {
+		// state 2 is SECONDARY
+		if m.State == 2 && m.Health == 1 {
+			secondaries = append(secondaries, m.Name)
+		}
+	}
+	if len(secondaries) == 0 {
+		return "", errors.Errorf("the target has no healthy secondary to lock")
+	}
+	sort.Strings(secondaries)
+	return secondaries[0], nil
+}
+
+// lockMember connects to the member of the target replica set and locks it
+// with fsyncLock, the primary is never locked. The returned func unlocks it
+// once and disconnects, it's safe to call again.
+func lockMember(ctx context.Context, c *dumpConfig, member string) (func(), error) {
+	uri, err := componentUri(c.plan.Target.Uri, member)
+	if err != nil {
+		return nil, err
+	}
+	cctx, cancel := context.WithTimeout(ctx, mongodbDatabaseListTimeout)
+	defer cancel()
+	client, err := mongo.Connect(cctx, options.Client().ApplyURI(uri).SetDirect(true))
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to MongoDB %s: %s", redactUri(uri), err)
+	}
+	admin := client.Database("admin")
+
+	var hello struct {
+		Secondary bool `bson:"secondary"`
+	}
+	if err := admin.RunCommand(cctx, bson.D{{Key: "isMaster", Value: 1}}).Decode(&hello); err != nil {
+		client.Disconnect(context.Background())
+		return nil, errors.Wrapf(err, "isMaster on %v failed", member)
+	}
+	if !hello.Secondary {
+		client.Disconnect(context.Background())
+		return nil, errors.Errorf("%v is not a secondary, the primary is never locked", member)
+	}
+
+	if err := admin.RunCommand(ctx, bson.D{{Key: "fsync", Value: 1}, {Key: "lock", Value: true}}).Err(); err != nil {
+		client.Disconnect(context.Background())
+		return nil, errors.Wrapf(err, "fsyncLock on %v failed", member)
+	}
+	locked := clock.Now()
+	log.WithField("plan", c.name).Infof("%v locked", member)
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			defer client.Disconnect(context.Background())
+			uctx, cancel := context.WithTimeout(context.Background(), mongodbDatabaseListTimeout)
+			defer cancel()
+			if err := admin.RunCommand(uctx, bson.D{{Key: "fsyncUnlock", Value: 1}}).Err(); err != nil {
+				log.WithField("plan", c.name).Errorf("fsyncUnlock on %v failed, the member stays locked: %v", member, err)
+				return
+			}
+			log.WithField("plan", c.name).Infof("%v unlocked after %v", member, clock.Since(locked).Round(time.Second))
+		})
+	}, nil
+}
@@ -0,0 +1,112 @@
+package backup
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/dustin/go-humanize"
+	"github.com/pkg/errors"
+
+	"github.com/stefanprodan/mgob/pkg/config"
+)
+
+func init() {
+	RegisterStage(config.StageSplit, newSplitStage)
+}
+
+// splitStage writes the pipeline output as numbered parts of a fixed size.
+type splitStage struct {
+	size  int64
+	files []string
+}
+
+func newSplitStage(ctx context.Context, s config.Stage, plan config.Plan, conf *config.AppConfig) (Stage, error) {
+	size, err := humanize.ParseBytes(s.Size)
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid split size '%s'", s.Size)
+	}
+	if size == 0 {
+		return nil, errors.New("split size must be greater than zero")
+	}
+	return &splitStage{size: int64(size)}, nil
+}
+
+func (s *splitStage) Name() string {
+	return "split"
+}
+
+func (s *splitStage) Ext() string {
+	return ""
+}
+
+func (s *splitStage) Wrap(ctx context.Context, w io.Writer) (io.WriteCloser, error) {
+	return nopCloser{w}, nil
+}
+
+func (s *splitStage) Create(file string) (io.WriteCloser, error) {
+	s.files = nil
+	return &splitWriter{stage: s, base: file}, nil
+}
+
+func (s *splitStage) Files() []string {
+	return s.files
+}
+
+type splitWriter struct {
+	stage   *splitStage
+	base    string
+	current *os.File
+	written int64
+}
+
+func (w *splitWriter) Write(p []byte) (int, error) {
+	total := 0
+	for len(p) > 0 {
+		if w.current == nil || w.written == w.stage.size {
+			if err := w.next(); err != nil {
+				return total, err
+			}
+		}
+		chunk := p
+		if left := w.stage.size - w.written; int64(len(chunk)) > left {
+			chunk = chunk[:left]
+		}
+		n, err := w.current.Write(chunk)
+		total += n
+		w.written += int64(n)
+		if err != nil {
+			return total, err
+		}
+		p = p[n:]
+	}
+	return total, nil
+}
+
+func (w *splitWriter) next() error {
+	if w.current != nil {
+		if err := w.current.Close(); err != nil {
+			return err
+		}
+	}
+	name := fmt.Sprintf("%v.part%03d", w.base, len(w.stage.files))
+	f, err := os.Create(name)
+	if err != nil {
+		return errors.Wrapf(err, "creating %v failed", name)
+	}
+	w.stage.files = append(w.stage.files, name)
+	w.current = f
+	w.written = 0
+	return nil
+}
+
+func (w *splitWriter) Close() error {
+	if w.current == nil {
+		// empty input still produces one (empty) part
+		if err := w.next(); err != nil {
+			return err
+		}
+	}
+	return w.current.Close()
+}
@@ -0,0 +1,183 @@
+package backup
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+
+	"github.com/stefanprodan/mgob/pkg/config"
+)
+
+// sshTarget is the host and the credentials of an ssh connection.
+type sshTarget struct {
+	Host       string
+	Port       int
+	Username   string
+	Password   string
+	PrivateKey string
+	Passphrase string
+	KnownHosts string
+}
+
+func sshConnect(ctx context.Context, t sshTarget) (*ssh.Client, error) {
+	var ams []ssh.AuthMethod
+	if t.Password != "" {
+		ams = append(ams, ssh.Password(t.Password))
+	}
+
+	if t.PrivateKey != "" {
+		key, err := ioutil.ReadFile(t.PrivateKey)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Reading private_key from file %s", t.PrivateKey)
+		}
+
+		var signer ssh.Signer
+		switch {
+		case t.PrivateKey != "" && t.Passphrase != "":
+			signer, err = ssh.ParsePrivateKeyWithPassphrase(key, []byte(t.Passphrase))
+			if err != nil {
+				return nil, errors.Wrapf(err, "Parsing private key from file %s", t.PrivateKey)
+			}
+		case t.PrivateKey != "":
+			signer, err = ssh.ParsePrivateKey(key)
+			if err != nil {
+				return nil, errors.Wrapf(err, "Parsing private key from file %s", t.PrivateKey)
+			}
+		}
+		ams = append(ams, ssh.PublicKeys(signer))
+	}
+
+	// host keys are only checked when a known_hosts file is set
+	hostKeys := ssh.InsecureIgnoreHostKey()
+	if t.KnownHosts != "" {
+		var err error
+		if hostKeys, err = knownhosts.New(t.KnownHosts); err != nil {
+			return nil, errors.Wrapf(err, "Reading known_hosts from file %s", t.KnownHosts)
+		}
+	}
+	sshConf := &ssh.ClientConfig{
+		User:            t.Username,
+		Auth:            ams,
+		HostKeyCallback: hostKeys,
+	}
+
+	dialer := net.Dialer{}
+	conn, err := dialer.DialContext(ctx, "tcp", fmt.Sprintf("%v:%v", t.Host, t.Port))
+	if err != nil {
+		return nil, errors.Wrapf(err, "SSH dial to %v:%v failed", t.Host, t.Port)
+	}
+	c, chans, reqs, err := ssh.NewClientConn(conn, conn.RemoteAddr().String(), sshConf)
+	if err != nil {
+		conn.Close()
+		return nil, errors.Wrapf(err, "SSH dial to %v:%v failed", t.Host, t.Port)
+	}
+
+	return ssh.NewClient(c, chans, reqs), nil
+}
+
+// sshExecutor runs mongodump on a remote host and streams the archive back.
+type sshExecutor struct {
+	cfg  config.SSHExecutor
+	conf *config.AppConfig
+}
+
+func newSSHExecutor(plan config.Plan, conf *config.AppConfig) Executor {
+	if plan.Executor == nil || plan.Executor.SSH == nil {
+		return nil
+	}
+	return &sshExecutor{cfg: *plan.Executor.SSH, conf: conf}
+}
+
+func (e *sshExecutor) Name() string {
+	return "ssh"
+}
+
+func (e *sshExecutor) Dump(ctx context.Context, job DumpJob) (string, string, error) {
+	c := jobConfig(job, e.conf)
+	if c.plan.Mode == config.BackupModeSample || c.plan.Mode == config.BackupModeMetadata || c.plan.Target.Format == config.DumpFormatDirectory {
+		return "", "", errors.New("the ssh executor only runs archive dumps of the single and database modes")
+	}
+	excluded, err := expandCollections(ctx, c)
+	if err != nil {
+		return "", "", err
+	}
+	expanded := *c
+	expanded.plan.Target.ExcludeCollections = excluded
+	archive, _, args := dumpArgs(&expanded, job.Gzip)
+	mlog := fmt.Sprintf("%v/%v-%v.log", c.tmpPath, c.name, c.ts.Unix())
+	// without a path mongodump writes the archive to stdout
+	args[0] = "--archive"
+
+	mongodump := e.cfg.Mongodump
+	if mongodump == "" {
+		mongodump = "mongodump"
+	}
+	cmd := shellQuote(mongodump)
+	for _, arg := range args {
+		cmd += " " + shellQuote(arg)
+	}
+	port := e.cfg.Port
+	if port == 0 {
+		port = 22
+	}
+	log.WithField("plan", c.name).Debugf("dump cmd: ssh %v@%v mongodump %v", e.cfg.Username, e.cfg.Host,
+		strings.Join(maskArgs(args), " "))
+
+	dctx, cancel := withTimeout(ctx, c.plan.Scheduler.DumpTimeout())
+	defer cancel()
+	client, err := sshConnect(dctx, sshTarget{
+		Host:       e.cfg.Host,
+		Port:       port,
+		Username:   e.cfg.Username,
+		Password:   e.cfg.Password,
+		PrivateKey: e.cfg.PrivateKey,
+		Passphrase: e.cfg.Passphrase,
+		KnownHosts: e.cfg.KnownHosts,
+	})
+	if err != nil {
+		return "", "", err
+	}
+	defer client.Close()
+	defer closeOnDone(dctx, client)()
+	session, err := client.NewSession()
+	if err != nil {
+		return "", "", errors.Wrapf(err, "SSH session to %v failed", e.cfg.Host)
+	}
+	defer session.Close()
+
+	f, err := os.Create(archive)
+	if err != nil {
+		return "", "", errors.Wrapf(err, "creating %v failed", archive)
+	}
+	var output bytes.Buffer
+	session.Stdout = f
+	session.Stderr = &output
+	err = session.Run(cmd)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(archive)
+		if dctx.Err() != nil {
+			err = dctx.Err()
+		}
+		return "", "", errors.Wrapf(err, "mongodump on %v log %v", e.cfg.Host,
+			strings.Replace(output.String(), "\n", " ", -1))
+	}
+	logToFile(mlog, output.Bytes())
+	return archive, mlog, nil
+}
+
+// shellQuote quotes s for a POSIX shell.
+func shellQuote(s string) string {
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
@@ -0,0 +1,51 @@
+package backup
+
+import (
+	"context"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/stefanprodan/mgob/pkg/clock"
+	"github.com/stefanprodan/mgob/pkg/config"
+	"github.com/stefanprodan/mgob/pkg/restore"
+)
+
+// seedStandby restores the archive into the plan standby cluster. Existing
+// collections are dropped unless noDrop is set, the admin system collections
+// are never restored so the standby keeps its own users.
+func seedStandby(ctx context.Context, c *dumpConfig, archive string) error {
+	standby := c.plan.Standby
+	if standby.Uri == "" {
+		return errors.New("standby requires a MongoDB URI")
+	}
+	t1 := clock.Now()
+
+	if standby.KeyFile != "" {
+		if err := restore.ImportKey(ctx, standby.KeyFile); err != nil {
+			return err
+		}
+	}
+
+	args := []string{"--nsExclude", "admin.system.*"}
+	if c.plan.Target.PointInTime {
+		args = append(args, "--oplogReplay")
+	}
+	if !standby.NoDrop {
+		args = append(args, "--drop")
+	}
+	for _, ns := range standby.Namespaces {
+		args = append(args, "--nsFrom", ns.From, "--nsTo", ns.To)
+	}
+	args = append(args, config.SplitParams(standby.Params)...)
+
+	rctx, cancel := withTimeout(ctx, c.plan.Scheduler.Timeout)
+	defer cancel()
+	output, err := restore.FromFile(rctx, archive, standby.Uri, args...)
+	if err != nil {
+		return errors.Wrapf(err, "seeding standby from %v failed", archive)
+	}
+	log.WithField("plan", c.name).Debugf("Standby restore output: %v", output)
+	log.WithField("plan", c.name).Infof("Standby seeded from %v in %v", archive, clock.Since(t1))
+	return nil
+}
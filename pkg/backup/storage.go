@@ -0,0 +1,80 @@
+package backup
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/stefanprodan/mgob/pkg/config"
+)
+
+// localDestination is the plan dir inside the storage path, the pipeline
+// writes the artifacts there so there is nothing left to upload.
+type localDestination struct {
+	dir string
+}
+
+func newLocalDestination(plan config.Plan, conf *config.AppConfig, ts time.Time) Destination {
+	return &localDestination{dir: config.PlanDir(conf.StoragePath, plan)}
+}
+
+func (d *localDestination) Name() string {
+	return "Local"
+}
+
+func (d *localDestination) Upload(ctx context.Context, file string) (string, error) {
+	if filepath.Dir(file) != d.dir {
+		return "", errors.Errorf("%v is not stored in %v", file, d.dir)
+	}
+	return fmt.Sprintf("`%v` stored in `%v`", filepath.Base(file), d.dir), nil
+}
+
+func (d *localDestination) List(ctx context.Context) ([]Object, error) {
+	files, err := ioutil.ReadDir(d.dir)
+	if err != nil {
+		return nil, errors.Wrapf(err, "reading %v failed", d.dir)
+	}
+	objects := make([]Object, 0)
+	for _, f := range files {
+		if !f.IsDir() {
+			objects = append(objects, Object{Name: f.Name(), Size: f.Size()})
+		}
+	}
+	return objects, nil
+}
+
+func (d *localDestination) Delete(ctx context.Context, name string) error {
+	if err := os.Remove(filepath.Join(d.dir, filepath.Base(name))); err != nil {
+		return errors.Wrapf(err, "removing %v from %v failed", name, d.dir)
+	}
+	return nil
+}
+
+func (d *localDestination) Verify(ctx context.Context, file string) error {
+	fi, err := os.Stat(filepath.Join(d.dir, filepath.Base(file)))
+	if err != nil {
+		return errors.Wrapf(err, "stat file %v failed", file)
+	}
+	return checkSize(file, fi.Size())
+}
+
+func (d *localDestination) Download(ctx context.Context, file string, dst string) error {
+	src := filepath.Join(d.dir, filepath.Base(file))
+	if err := copyFile(src, dst); err != nil {
+		return errors.Wrapf(err, "copying %v to %v failed", src, dst)
+	}
+	return nil
+}
+
+func fileSize(file string) (int64, error) {
+	fi, err := os.Stat(file)
+	if err != nil {
+		return 0, errors.Wrapf(err, "stat file %v failed", file)
+	}
+	return fi.Size(), nil
+}
@@ -0,0 +1,353 @@
+package backup
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/dustin/go-humanize"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/stefanprodan/mgob/pkg/clock"
+	"github.com/stefanprodan/mgob/pkg/config"
+)
+
+// checkStreaming rejects the plan settings that need the archive on disk.
+func checkStreaming(plan config.Plan) error {
+	if !plan.Streaming {
+		return nil
+	}
+	switch plan.Mode {
+	case "", config.BackupModeSingle, config.BackupModeDatabase:
+	default:
+		return errors.Errorf("'%s' backup mode can't be streamed", plan.Mode)
+	}
+	switch {
+	case plan.Agent != "" || plan.Executor != nil:
+		return errors.New("streaming runs mongodump on this host, it can't be combined with an agent or an executor")
+	case plan.Target.Format == config.DumpFormatDirectory:
+		return errors.Errorf("'%s' format can't be streamed", plan.Target.Format)
+	case plan.Throttle != nil:
+		return errors.New("throttle can't be combined with streaming, a paused dump would stall the uploads")
+	case plan.Scan != nil || plan.Standby != nil:
+		return errors.New("scan and standby need a local copy of the archive, they can't be combined with streaming")
+	}
+	return nil
+}
+
+// streamUpload is the outcome of a destination stream.
+type streamUpload struct {
+	name   string
+	output string
+	err    error
+	// canceled is set when the upload was killed after a dump failure
+	canceled bool
+	took     time.Duration
+}
+
+// countWriter counts the bytes written to w.
+type countWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// runStreaming pipes the mongodump archive through the pipeline stages to all
+// remote destinations at once, only the checksum, metadata and log files are
+// stored locally. A failed upload fails the dump and the other uploads.
+func runStreaming(ctx context.Context, c *dumpConfig) (Result, error) {
+	res := errRes(c)
+
+	routed := routePlan(c.plan, c.database)
+	if routed.Route != "" {
+		log.WithField("plan", c.name).Infof("Database %v routed by %v", c.database, routed.Route)
+	}
+
+	p, err := newPipeline(ctx, c.plan, c.conf)
+	if err != nil {
+		return res, err
+	}
+	if p.sink != nil {
+		return res, errors.New("streaming can't be combined with the split stage")
+	}
+
+	dests := RemoteDestinations(routed.Plan, c.conf, c.ts)
+	if len(dests) == 0 {
+		return res, errors.New("streaming requires a remote destination")
+	}
+	names := make([]string, 0, len(dests))
+	for _, d := range dests {
+		if _, ok := d.(Streamer); !ok {
+			return res, errors.Errorf("%v destination doesn't support streaming", d.Name())
+		}
+		names = append(names, d.Name())
+	}
+
+	name, args, err := streamArgs(ctx, c, p)
+	if err != nil {
+		return res, err
+	}
+	res.Name = name
+	mlog := fmt.Sprintf("%v/%v-%v.log", c.tmpPath, c.name, c.ts.Unix())
+
+	if err := os.MkdirAll(c.planDir, 0755); err != nil {
+		return res, errors.Wrapf(err, "creating dir %v in %v failed", c.name, c.storagePath)
+	}
+
+	log.WithField("plan", c.name).Infof("Streaming %v to %v", res.Name, strings.Join(names, ", "))
+	dctx, cancel := withTimeout(ctx, c.plan.Scheduler.DumpTimeout())
+	defer cancel()
+
+	atomic.AddInt32(&uploading, 1)
+	defer atomic.AddInt32(&uploading, -1)
+
+	uploads := make(chan streamUpload, len(dests))
+	pipes := make([]*io.PipeWriter, 0, len(dests))
+	writers := make([]io.Writer, 0, len(dests))
+	for _, d := range dests {
+		pr, pw := io.Pipe()
+		pipes = append(pipes, pw)
+		writers = append(writers, pw)
+		go func(d Destination, pr *io.PipeReader) {
+			start := clock.Now()
+			output, err := d.(Streamer).Stream(withStage(dctx, UsageUpload), name, pr)
+			canceled := dctx.Err() != nil
+			if err != nil {
+				pr.CloseWithError(err)
+			} else {
+				pr.CloseWithError(errors.Errorf("%v upload ended before the dump", d.Name()))
+			}
+			uploads <- streamUpload{name: d.Name(), output: output, err: err, canceled: canceled, took: clock.Since(start)}
+		}(d, pr)
+	}
+
+	start := clock.Now()
+	n, stderr, err := dumpTo(withStage(dctx, UsageDump), p, args, io.MultiWriter(writers...))
+	recordPhase(ctx, PhaseDump, start)
+	if err != nil {
+		// kill the uploads before their stdin ends so no truncated object is stored
+		cancel()
+	}
+	for _, pw := range pipes {
+		pw.CloseWithError(err)
+	}
+
+	// an upload failure breaks the dump pipe, report it rather than the dump error
+	var uerr error
+	for range dests {
+		u := <-uploads
+		if u.err != nil {
+			recordUpload(ctx, u.name, routed.Route, res.Name, UploadFailed, u.took, u.err)
+			if uerr == nil || !u.canceled {
+				uerr = u.err
+			}
+			if !u.canceled {
+				err = nil
+			}
+			continue
+		}
+		recordUpload(ctx, u.name, routed.Route, res.Name, UploadUploaded, u.took, nil)
+		log.WithField("plan", c.name).Infof("%v upload finished %v", u.name, u.output)
+	}
+	recordPhase(ctx, PhaseUpload, start)
+	if err != nil {
+		return res, err
+	}
+	if uerr != nil {
+		return res, uerr
+	}
+	if c.plan.Target.DbHash {
+		if res.Hashes, err = captureHashes(ctx, c); err != nil {
+			return res, err
+		}
+	}
+	res.Size = n
+	addNet(withStage(ctx, UsageUpload), n*int64(len(dests)))
+	res.Chain = fmt.Sprintf("%v-%v", c.name, c.ts.Unix())
+	res.Uploads = append(res.Uploads, Upload{File: filepath.Join(c.planDir, res.Name), Route: routed.Route, Destinations: names, Size: n})
+
+	pres := pipelineResult{Name: res.Name}
+	sums, err := p.writeSums(&pres, filepath.Join(c.planDir, res.Name))
+	if err != nil {
+		return res, err
+	}
+	res.Checksum = pres.Checksum
+	for _, file := range sums {
+		size, err := fileSize(file)
+		if err != nil {
+			return res, err
+		}
+		res.Size += size
+	}
+	res.Files = sums
+	if err := writeMetadata(c, p, &res, MetadataFile{Name: res.Name, Size: n}); err != nil {
+		return res, err
+	}
+
+	if len(stderr) > 0 {
+		logToFile(mlog, stderr)
+		if err := moveFile(mlog, filepath.Join(c.planDir, filepath.Base(mlog))); err != nil {
+			return res, errors.Wrapf(err, "moving file from %v to %v failed", mlog, c.planDir)
+		}
+	}
+
+	if c.plan.Scheduler.Retention > 0 {
+		if err := retain(ctx, c); err != nil {
+			return res, errors.Wrap(err, "retention job failed")
+		}
+	}
+
+	for _, file := range res.Files {
+		u, err := upload(ctx, c, routed, file)
+		if err != nil {
+			return res, err
+		}
+		res.Uploads = append(res.Uploads, u)
+	}
+
+	res.Status = 200
+	res.Duration = clock.Since(c.ts)
+	log.WithFields(log.Fields{
+		"plan":     c.name,
+		"size":     humanize.Bytes(uint64(res.Size)),
+		"archive":  res.Name,
+		"duration": res.Duration.String(),
+	}).Infof("dump streamed")
+	return res, nil
+}
+
+// streamArgs returns the name of the streamed archive and the mongodump
+// arguments writing it to stdout.
+func streamArgs(ctx context.Context, c *dumpConfig, p *pipeline) (string, []string, error) {
+	excluded, err := expandCollections(ctx, c)
+	if err != nil {
+		return "", nil, err
+	}
+	expanded := *c
+	expanded.plan.Target.ExcludeCollections = excluded
+	archive, _, args := dumpArgs(&expanded, !p.compresses())
+	// without a path mongodump writes the archive to stdout
+	args[0] = "--archive"
+	name := filepath.Base(archive)
+	for _, st := range p.stages {
+		name += st.Ext()
+	}
+	return name, args, nil
+}
+
+// dumpTo runs mongodump with args and pipes the archive through the stages of
+// p into w. It returns the bytes written to w and the mongodump log.
+func dumpTo(ctx context.Context, p *pipeline, args []string, w io.Writer) (int64, []byte, error) {
+	out := &countWriter{w: w}
+	sw, closers, err := p.wrap(ctx, nopCloser{out})
+	if err != nil {
+		return 0, nil, err
+	}
+	log.WithField("plan", p.plan).Debugf("dump cmd: mongodump %v", strings.Join(maskArgs(args), " "))
+	var stderr bytes.Buffer
+	cmd := exec.Command("mongodump", args...)
+	cmd.Stdout = sw
+	cmd.Stderr = &stderr
+	proc, err := startProcess(ctx, cmd)
+	if err == nil {
+		err = proc.Wait()
+	}
+	if cerr := closeAll(closers); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return out.n, stderr.Bytes(), errors.Wrapf(err, "mongodump log %v", strings.Replace(stderr.String(), "\n", " ", -1))
+	}
+	return out.n, stderr.Bytes(), nil
+}
+
+// ToWriter dumps the plan target through its pipeline into w, e.g. stdout,
+// nothing is stored or uploaded. The result holds the archive name, size and checksum.
+func ToWriter(ctx context.Context, plan config.Plan, conf *config.AppConfig, w io.Writer) (Result, error) {
+	c := &dumpConfig{
+		plan:        plan,
+		database:    plan.Target.Database,
+		conf:        conf,
+		tmpPath:     conf.TmpPath,
+		storagePath: conf.StoragePath,
+		ts:          clock.Now(),
+		planDir:     config.PlanDir(conf.StoragePath, plan),
+		name:        plan.Name,
+	}
+	res := errRes(c)
+	ctx = WithEnv(ctx, plan)
+
+	switch {
+	case plan.Mode != "" && plan.Mode != config.BackupModeSingle:
+		return res, errors.Errorf("'%s' backup mode can't be written to a stream", plan.Mode)
+	case plan.Agent != "" || plan.Executor != nil:
+		return res, errors.New("an agent or executor plan can't be written to a stream")
+	case plan.Target.Format == config.DumpFormatDirectory:
+		return res, errors.Errorf("'%s' format can't be written to a stream", plan.Target.Format)
+	}
+	if err := checkTarget(plan.Target); err != nil {
+		return res, err
+	}
+	if err := checkPatterns(plan.Target); err != nil {
+		return res, err
+	}
+	if err := checkQuery(plan); err != nil {
+		return res, err
+	}
+	if err := checkReadPreference(plan); err != nil {
+		return res, err
+	}
+	if err := checkFlavor(plan); err != nil {
+		return res, err
+	}
+	if rp := plan.Target.ReadPreference; rp != nil && plan.Target.Uri != "" {
+		plan.Target.Uri = uriWithReadPreference(plan.Target.Uri, rp)
+		c.plan = plan
+	}
+	if plan.Target.Uri != "" {
+		plan.Target.Uri = UriWithFlavor(plan.Target)
+		c.plan = plan
+	}
+
+	p, err := newPipeline(ctx, plan, conf)
+	if err != nil {
+		return res, err
+	}
+	if p.sink != nil {
+		return res, errors.New("the split stage can't be written to a stream")
+	}
+	name, args, err := streamArgs(ctx, c, p)
+	if err != nil {
+		return res, err
+	}
+	res.Name = name
+
+	dctx, cancel := withTimeout(ctx, plan.Scheduler.DumpTimeout())
+	defer cancel()
+	n, _, err := dumpTo(dctx, p, args, w)
+	if err != nil {
+		return res, err
+	}
+	for _, st := range p.stages {
+		if cs, ok := st.(Checksummer); ok {
+			res.Checksum = cs.Sum()
+		}
+	}
+	res.Size = n
+	res.Status = 200
+	res.Duration = clock.Since(c.ts)
+	return res, nil
+}
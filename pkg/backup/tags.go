@@ -0,0 +1,81 @@
+package backup
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/stefanprodan/mgob/pkg/config"
+)
+
+var userAgent = "mgob"
+
+// SetUserAgent makes the cloud CLIs identify mgob in their requests. The aws,
+// az and gcloud tools append these variables to their own User-Agent, rclone
+// gets it with --user-agent.
+func SetUserAgent(ua string) {
+	userAgent = ua
+	os.Setenv("AWS_EXECUTION_ENV", ua)
+	os.Setenv("AZURE_HTTP_USER_AGENT", ua)
+	os.Setenv("CLOUDSDK_METRICS_ENVIRONMENT", ua)
+}
+
+type tag struct {
+	key   string
+	value string
+}
+
+// planTags returns the plan tags sorted by key including the plan name,
+// nothing is tagged when the plan has no tags so no extra permissions are needed.
+func planTags(plan config.Plan) []tag {
+	if len(plan.Tags) == 0 {
+		return nil
+	}
+	tags := []tag{{key: "plan", value: plan.Name}}
+	for k, v := range plan.Tags {
+		if k != "plan" {
+			tags = append(tags, tag{key: k, value: v})
+		}
+	}
+	sort.Slice(tags, func(i, j int) bool {
+		return tags[i].key < tags[j].key
+	})
+	return tags
+}
+
+// s3Tagging returns the tags in the S3 TagSet shorthand syntax.
+func s3Tagging(plan config.Plan) string {
+	set := make([]string, 0)
+	for _, t := range planTags(plan) {
+		set = append(set, fmt.Sprintf("{Key=%v,Value=%v}", t.key, t.value))
+	}
+	return fmt.Sprintf("TagSet=[%v]", strings.Join(set, ","))
+}
+
+// minioTags returns the tags in the mc --tags query syntax.
+func minioTags(plan config.Plan) string {
+	set := make([]string, 0)
+	for _, t := range planTags(plan) {
+		set = append(set, fmt.Sprintf("%v=%v", t.key, t.value))
+	}
+	return strings.Join(set, "&")
+}
+
+// gCloudHeaders returns the tags as gsutil custom metadata header flags.
+func gCloudHeaders(plan config.Plan) []string {
+	headers := make([]string, 0)
+	for _, t := range planTags(plan) {
+		headers = append(headers, "-h", fmt.Sprintf("x-goog-meta-%v:%v", t.key, t.value))
+	}
+	return headers
+}
+
+// azureMetadata returns the tags as az blob metadata arguments.
+func azureMetadata(plan config.Plan) []string {
+	set := make([]string, 0)
+	for _, t := range planTags(plan) {
+		set = append(set, fmt.Sprintf("%v=%v", t.key, t.value))
+	}
+	return set
+}
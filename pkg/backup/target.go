@@ -0,0 +1,227 @@
+package backup
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/readpref"
+	mtag "go.mongodb.org/mongo-driver/tag"
+	"go.mongodb.org/mongo-driver/x/mongo/driver/connstring"
+
+	"github.com/stefanprodan/mgob/pkg/config"
+)
+
+const srvScheme = "mongodb+srv://"
+
+var uriCredentials = regexp.MustCompile(`//[^@/]*@`)
+
+// redactUri hides the credentials of a connection string.
+func redactUri(uri string) string {
+	return uriCredentials.ReplaceAllString(uri, "//***@")
+}
+
+// checkTarget validates the target connection string the same way the driver
+// does, for SRV strings this resolves the DNS seedlist so lookup failures are
+// reported before mongodump runs.
+func checkTarget(t config.Target) error {
+	if t.Uri == "" {
+		if t.Host == "" {
+			return errors.New("target requires a uri or a host")
+		}
+		return nil
+	}
+
+	if _, err := connstring.ParseAndValidate(t.Uri); err != nil {
+		if strings.HasPrefix(t.Uri, srvScheme) {
+			return errors.Wrapf(err, "resolving SRV seedlist of %v failed", redactUri(t.Uri))
+		}
+		return errors.Wrapf(err, "invalid target uri %v", redactUri(t.Uri))
+	}
+	return nil
+}
+
+// hostArgs returns the mongodump host flags of a host/port target,
+// IPv6 addresses are bracketed and passed along with the port.
+func hostArgs(t config.Target) []string {
+	if strings.Contains(t.Host, ":") && net.ParseIP(t.Host) != nil {
+		return []string{"--host", net.JoinHostPort(t.Host, fmt.Sprint(t.Port))}
+	}
+	return []string{"--host", t.Host, "--port", fmt.Sprint(t.Port)}
+}
+
+// uriForDatabase drops the database of the connection string path when a
+// different one is dumped, mongodump refuses --db otherwise while the driver
+// ignores it. The authentication database the path implied is kept.
+func uriForDatabase(uri string, database string) string {
+	if database == "" {
+		return uri
+	}
+	cs, err := connstring.Parse(uri)
+	if err != nil || cs.Database == "" || cs.Database == database {
+		return uri
+	}
+
+	i := strings.Index(uri, "://")
+	slash := strings.Index(uri[i+3:], "/") + i + 3
+	query := ""
+	if q := strings.Index(uri[slash:], "?"); q >= 0 {
+		query = uri[slash+q+1:]
+	}
+	if cs.AuthSource != "" && !strings.Contains(query, "authSource=") {
+		if query != "" {
+			query += "&"
+		}
+		query += "authSource=" + cs.AuthSource
+	}
+	if query == "" {
+		return uri[:slash] + "/"
+	}
+	return uri[:slash] + "/?" + query
+}
+
+// checkQuery validates the target query, mongodump applies it to a single collection.
+func checkQuery(plan config.Plan) error {
+	if plan.Target.Query == "" {
+		return nil
+	}
+	exported := plan.Mode == config.BackupModeExport && plan.Export != nil && len(plan.Export.Collections) > 0
+	if plan.Target.Collection == "" && !exported {
+		return errors.New("target query requires a collection")
+	}
+	switch plan.Mode {
+	case "", config.BackupModeSingle, config.BackupModeDatabase, config.BackupModeMigrate, config.BackupModeExport:
+	default:
+		return errors.Errorf("target query can't be used with '%s' backup mode", plan.Mode)
+	}
+	var doc bson.D
+	if err := bson.UnmarshalExtJSON([]byte(plan.Target.Query), false, &doc); err != nil {
+		return errors.Wrapf(err, "invalid target query %v", plan.Target.Query)
+	}
+	return nil
+}
+
+// newReadPref builds a driver read preference, it rejects the tags and max
+// staleness of the primary mode and a max staleness under 90 seconds.
+func newReadPref(mode string, tags []map[string]string, maxStaleness time.Duration) (*readpref.ReadPref, error) {
+	m, err := readpref.ModeFromString(mode)
+	if err != nil {
+		return nil, errors.Errorf("unknown read preference mode '%s'", mode)
+	}
+	var opts []readpref.Option
+	if len(tags) > 0 {
+		opts = append(opts, readpref.WithTagSets(mtag.NewTagSetsFromMaps(tags)...))
+	}
+	if maxStaleness > 0 {
+		if maxStaleness < 90*time.Second {
+			return nil, errors.New("read preference maxStalenessSeconds must be at least 90")
+		}
+		opts = append(opts, readpref.WithMaxStaleness(maxStaleness))
+	}
+	return readpref.New(m, opts...)
+}
+
+// checkReadPreference validates the target read preference, it can't be set
+// in the target uri or params as well.
+func checkReadPreference(plan config.Plan) error {
+	rp := plan.Target.ReadPreference
+	if rp == nil {
+		return nil
+	}
+	switch plan.Mode {
+	case config.BackupModeWatch, config.BackupModeExec, config.BackupModeSnapshot, config.BackupModeCSI, config.BackupModeDisk, config.BackupModeAtlas:
+		return errors.Errorf("readPreference can't be used with '%s' backup mode", plan.Mode)
+	}
+	if _, err := newReadPref(rp.Mode, rp.Tags, time.Duration(rp.MaxStalenessSeconds)*time.Second); err != nil {
+		return errors.Wrap(err, "invalid target readPreference")
+	}
+	for _, set := range rp.Tags {
+		for k, v := range set {
+			if strings.ContainsAny(k+v, ",:") {
+				return errors.Errorf("read preference tag %v:%v can't contain ',' or ':'", k, v)
+			}
+		}
+	}
+	if plan.Target.Uri != "" {
+		if cs, err := connstring.Parse(plan.Target.Uri); err == nil && (cs.ReadPreference != "" || len(cs.ReadPreferenceTagSets) > 0 || cs.MaxStalenessSet) {
+			return errors.New("the read preference is set in both target.readPreference and target.uri")
+		}
+	}
+	for _, p := range config.SplitParams(plan.Target.Params) {
+		if strings.HasPrefix(p, "--readPreference") {
+			return errors.New("the read preference is set in both target.readPreference and target.params")
+		}
+	}
+	return nil
+}
+
+// uriWithReadPreference adds the read preference options to the uri query so
+// mongodump and the driver connections select the same member.
+func uriWithReadPreference(uri string, rp *config.ReadPreference) string {
+	q := url.Values{}
+	q.Set("readPreference", rp.Mode)
+	for _, set := range rp.Tags {
+		q.Add("readPreferenceTags", tagSetString(set))
+	}
+	if rp.MaxStalenessSeconds > 0 {
+		q.Set("maxStalenessSeconds", fmt.Sprint(rp.MaxStalenessSeconds))
+	}
+	return uriWithOptions(uri, q)
+}
+
+// uriWithOptions appends the options of q to the uri query.
+func uriWithOptions(uri string, q url.Values) string {
+	if len(q) == 0 {
+		return uri
+	}
+	// the query must follow the path slash
+	i := strings.Index(uri, "://")
+	if i >= 0 && !strings.Contains(uri[i+3:], "/") {
+		if j := strings.Index(uri, "?"); j >= 0 {
+			uri = uri[:j] + "/" + uri[j:]
+		} else {
+			uri += "/"
+		}
+	}
+	sep := "?"
+	if strings.Contains(uri, "?") {
+		sep = "&"
+	}
+	return uri + sep + q.Encode()
+}
+
+// tagSetString formats a tag set as readPreferenceTags expects it, e.g. dc:east,rack:1.
+func tagSetString(set map[string]string) string {
+	keys := make([]string, 0, len(set))
+	for k := range set {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	tags := make([]string, 0, len(keys))
+	for _, k := range keys {
+		tags = append(tags, k+":"+set[k])
+	}
+	return strings.Join(tags, ",")
+}
+
+// readPreferenceArg returns the mongodump --readPreference value of a host/port
+// target, the mode alone or a json document with the tag sets.
+func readPreferenceArg(rp *config.ReadPreference) string {
+	if len(rp.Tags) == 0 && rp.MaxStalenessSeconds == 0 {
+		return rp.Mode
+	}
+	doc := struct {
+		Mode                string              `json:"mode"`
+		TagSets             []map[string]string `json:"tagSets,omitempty"`
+		MaxStalenessSeconds int                 `json:"maxStalenessSeconds,omitempty"`
+	}{rp.Mode, rp.Tags, rp.MaxStalenessSeconds}
+	data, _ := json.Marshal(doc)
+	return string(data)
+}
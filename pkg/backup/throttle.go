@@ -0,0 +1,180 @@
+package backup
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os/exec"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"github.com/stefanprodan/mgob/pkg/config"
+)
+
+// throttler watches the target currentOp during the dump and stops the
+// mongodump process group while client operations are slow.
+type throttler struct {
+	conf   config.Throttle
+	plan   string
+	cmd    *exec.Cmd
+	client *mongo.Client
+	opts   *options.RunCmdOptions
+
+	paused      bool
+	pausedAt    time.Time
+	cooldown    time.Time
+	pauses      int
+	pausedTotal time.Duration
+}
+
+func newThrottler(ctx context.Context, c *dumpConfig, cmd *exec.Cmd) (*throttler, error) {
+	if c.plan.Target.Uri == "" {
+		return nil, errors.New("throttle requires a target uri")
+	}
+	t := &throttler{conf: *c.plan.Throttle, plan: c.name, cmd: cmd}
+	if t.conf.MaxLatency <= 0 {
+		return nil, errors.New("throttle requires maxLatency")
+	}
+	if t.conf.MaxSlowOps <= 0 {
+		t.conf.MaxSlowOps = 1
+	}
+	if t.conf.Interval <= 0 {
+		t.conf.Interval = 10
+	}
+	if t.conf.MaxPause <= 0 {
+		t.conf.MaxPause = 5
+	}
+
+	client, err := mongo.Connect(ctx, options.Client().ApplyURI(c.plan.Target.Uri).SetAppName("mgob-throttle"))
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to connect to MongoDB %s", redactUri(c.plan.Target.Uri))
+	}
+	t.client = client
+	t.opts = options.RunCmd().SetReadPreference(targetReadPref(c.plan.Target.Uri))
+	return t, nil
+}
+
+// run polls currentOp until ctx is done, the dump is always continued on return.
+func (t *throttler) run(ctx context.Context) {
+	defer t.client.Disconnect(context.Background())
+	defer t.resume("dump done")
+
+	ticker := time.NewTicker(time.Duration(t.conf.Interval) * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		if t.paused && time.Since(t.pausedAt) >= time.Duration(t.conf.MaxPause)*time.Minute {
+			// long pauses let the dump cursors time out, give it a slot to progress
+			t.resume("max pause reached")
+			t.cooldown = time.Now().Add(time.Duration(t.conf.MaxPause) * time.Minute)
+			continue
+		}
+
+		slow, err := t.slowOps(ctx)
+		if err != nil {
+			if ctx.Err() == nil {
+				log.WithField("plan", t.plan).Warnf("Throttle currentOp failed %v", err)
+			}
+			continue
+		}
+		switch {
+		case slow >= t.conf.MaxSlowOps && !t.paused && time.Now().After(t.cooldown):
+			if err := pauseProcessGroup(t.cmd, true); err != nil {
+				log.WithField("plan", t.plan).Warnf("Pausing dump failed %v", err)
+				continue
+			}
+			t.paused = true
+			t.pausedAt = time.Now()
+			t.pauses++
+			log.WithField("plan", t.plan).Infof("Dump paused, %v operations over %vms", slow, t.conf.MaxLatency)
+		case slow < t.conf.MaxSlowOps && t.paused:
+			t.resume("target recovered")
+		}
+	}
+}
+
+func (t *throttler) resume(reason string) {
+	if !t.paused {
+		return
+	}
+	if err := pauseProcessGroup(t.cmd, false); err != nil {
+		log.WithField("plan", t.plan).Errorf("Resuming dump failed %v", err)
+		return
+	}
+	t.paused = false
+	t.pausedTotal += time.Since(t.pausedAt)
+	log.WithField("plan", t.plan).Infof("Dump resumed, %v", reason)
+}
+
+// slowOps counts the active client operations running for over MaxLatency,
+// the dump's own operations are excluded.
+func (t *throttler) slowOps(ctx context.Context) (int, error) {
+	cctx, cancel := context.WithTimeout(ctx, time.Duration(t.conf.Interval)*time.Second)
+	defer cancel()
+
+	cmd := bson.D{
+		{Key: "currentOp", Value: 1},
+		{Key: "active", Value: true},
+		{Key: "desc", Value: bson.D{{Key: "$regex", Value: "^conn"}}},
+		{Key: "microsecs_running", Value: bson.D{{Key: "$gte", Value: int64(t.conf.MaxLatency) * 1000}}},
+		{Key: "appName", Value: bson.D{{Key: "$nin", Value: bson.A{"mongodump", "mgob-throttle"}}}},
+		{Key: "op", Value: bson.D{{Key: "$in", Value: bson.A{"query", "insert", "update", "remove", "getmore", "command"}}}},
+		{Key: "command.hello", Value: bson.D{{Key: "$exists", Value: false}}},
+		{Key: "command.isMaster", Value: bson.D{{Key: "$exists", Value: false}}},
+	}
+	var res struct {
+		Inprog []bson.Raw `bson:"inprog"`
+	}
+	if err := t.client.Database("admin").RunCommand(cctx, cmd, t.opts).Decode(&res); err != nil {
+		return 0, err
+	}
+	return len(res.Inprog), nil
+}
+
+// summary describes the pauses of the run for the dump log.
+func (t *throttler) summary() string {
+	if t.pauses == 0 {
+		return "throttle: dump never paused\n"
+	}
+	return fmt.Sprintf("throttle: dump paused %v times for %v\n", t.pauses, t.pausedTotal.Round(time.Second))
+}
+
+// throttledOutput runs the dump cmd like combinedOutput while a throttler watches the target.
+func throttledOutput(ctx context.Context, c *dumpConfig, cmd *exec.Cmd) ([]byte, error) {
+	t, err := newThrottler(ctx, c, cmd)
+	if err != nil {
+		return nil, err
+	}
+
+	var b bytes.Buffer
+	cmd.Stdout = &b
+	cmd.Stderr = &b
+	p, err := startProcess(ctx, cmd)
+	if err != nil {
+		t.client.Disconnect(context.Background())
+		return nil, err
+	}
+
+	tctx, cancel := context.WithCancel(ctx)
+	done := make(chan struct{})
+	go func() {
+		t.run(tctx)
+		close(done)
+	}()
+	err = p.Wait()
+	cancel()
+	<-done
+
+	b.WriteString(t.summary())
+	return b.Bytes(), err
+}
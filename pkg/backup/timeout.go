@@ -0,0 +1,19 @@
+package backup
+
+import (
+	"github.com/pkg/errors"
+
+	"github.com/stefanprodan/mgob/pkg/config"
+)
+
+// checkTimeouts rejects the negative stage timeouts of plan.
+func checkTimeouts(plan config.Plan) error {
+	t := plan.Scheduler.Timeouts
+	if t == nil {
+		return nil
+	}
+	if t.Dump < 0 || t.Encrypt < 0 || t.Upload < 0 || t.Total < 0 {
+		return errors.New("scheduler.timeouts can't be negative")
+	}
+	return nil
+}
@@ -0,0 +1,123 @@
+package backup
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"regexp"
+	"strings"
+
+	"github.com/pkg/errors"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"github.com/stefanprodan/mgob/pkg/config"
+)
+
+type transformRule struct {
+	namespace *regexp.Regexp
+	drop      []string
+	hash      []string
+}
+
+// transformer redacts exported documents according to the plan transform rules.
+type transformer struct {
+	salt  string
+	rules []transformRule
+}
+
+func newTransformer(t *config.Transform) (*transformer, error) {
+	if t == nil {
+		return nil, nil
+	}
+	tr := &transformer{salt: t.Salt}
+	for _, r := range t.Rules {
+		re, err := regexp.Compile(r.Namespace)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid transform namespace %v", r.Namespace)
+		}
+		tr.rules = append(tr.rules, transformRule{namespace: re, drop: r.Drop, hash: r.Hash})
+	}
+	return tr, nil
+}
+
+// forNamespace merges the rules matching ns, nil means the documents are kept as is.
+func (t *transformer) forNamespace(ns string) *transformRule {
+	if t == nil {
+		return nil
+	}
+	var merged *transformRule
+	for _, r := range t.rules {
+		if !r.namespace.MatchString(ns) {
+			continue
+		}
+		if merged == nil {
+			merged = &transformRule{}
+		}
+		merged.drop = append(merged.drop, r.drop...)
+		merged.hash = append(merged.hash, r.hash...)
+	}
+	return merged
+}
+
+// apply returns the document with the rule fields dropped or hashed.
+func (t *transformer) apply(r *transformRule, raw bson.Raw) (bson.Raw, error) {
+	var doc bson.D
+	if err := bson.Unmarshal(raw, &doc); err != nil {
+		return nil, err
+	}
+	for _, path := range r.drop {
+		doc = t.rewrite(doc, strings.Split(path, "."), nil)
+	}
+	for _, path := range r.hash {
+		doc = t.rewrite(doc, strings.Split(path, "."), t.hashValue)
+	}
+	return bson.Marshal(doc)
+}
+
+// rewrite replaces the value at path with fn(value), or removes it when fn is nil.
+// Arrays of documents along the path are rewritten element by element.
+func (t *transformer) rewrite(doc bson.D, path []string, fn func(interface{}) interface{}) bson.D {
+	out := doc[:0]
+	for _, e := range doc {
+		if e.Key != path[0] {
+			out = append(out, e)
+			continue
+		}
+		if len(path) == 1 {
+			if fn != nil {
+				out = append(out, bson.E{Key: e.Key, Value: fn(e.Value)})
+			}
+			continue
+		}
+		e.Value = t.rewriteValue(e.Value, path[1:], fn)
+		out = append(out, e)
+	}
+	return out
+}
+
+func (t *transformer) rewriteValue(v interface{}, path []string, fn func(interface{}) interface{}) interface{} {
+	switch val := v.(type) {
+	case primitive.D:
+		return t.rewrite(val, path, fn)
+	case primitive.A:
+		for i := range val {
+			val[i] = t.rewriteValue(val[i], path, fn)
+		}
+		return val
+	default:
+		return v
+	}
+}
+
+// hashValue keeps equal values equal across collections so joins still work on the redacted data.
+func (t *transformer) hashValue(v interface{}) interface{} {
+	typ, data, err := bson.MarshalValue(v)
+	if err != nil {
+		return nil
+	}
+	h := sha256.New()
+	h.Write([]byte(t.salt))
+	h.Write([]byte{byte(typ)})
+	h.Write(data)
+	return hex.EncodeToString(h.Sum(nil))
+}
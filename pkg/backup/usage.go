@@ -0,0 +1,96 @@
+package backup
+
+import (
+	"context"
+	"os"
+	"sync"
+
+	"github.com/stefanprodan/mgob/pkg/db"
+)
+
+// The run stages whose child processes are accounted.
+const (
+	UsageDump   = "dump"
+	UsageUpload = "upload"
+)
+
+type usageKey struct{}
+
+type stageKey struct{}
+
+// usageRecorder sums the resources used by the child processes of a run by stage.
+type usageRecorder struct {
+	mu     sync.Mutex
+	stages map[string]db.Usage
+}
+
+// withUsage returns a context whose staged child processes are accounted in the returned recorder.
+func withUsage(ctx context.Context) (context.Context, *usageRecorder) {
+	r := &usageRecorder{stages: make(map[string]db.Usage)}
+	return context.WithValue(ctx, usageKey{}, r), r
+}
+
+// withStage accounts the child processes started with ctx to stage.
+func withStage(ctx context.Context, stage string) context.Context {
+	return context.WithValue(ctx, stageKey{}, stage)
+}
+
+func recorderOf(ctx context.Context) (*usageRecorder, string) {
+	r, _ := ctx.Value(usageKey{}).(*usageRecorder)
+	stage, _ := ctx.Value(stageKey{}).(string)
+	if r == nil || stage == "" {
+		return nil, ""
+	}
+	return r, stage
+}
+
+// recordProcess adds the usage of an exited child process to the stage of ctx.
+// The network bytes of a dump are the bytes its processes read, the uploads
+// count the bytes they sent in addNet.
+func recordProcess(ctx context.Context, state *os.ProcessState, io procIO) {
+	r, stage := recorderOf(ctx)
+	if r == nil || state == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	u := r.stages[stage]
+	u.CPU += (state.UserTime() + state.SystemTime()).Seconds()
+	if rss := maxRSS(state); rss > u.MaxRSS {
+		u.MaxRSS = rss
+	}
+	u.ReadBytes += io.readBytes
+	u.WriteBytes += io.writeBytes
+	if stage == UsageDump {
+		u.NetBytes += io.rchar
+	}
+	u.Processes++
+	r.stages[stage] = u
+}
+
+// addNet adds bytes sent or received in process, e.g. by the SDK destinations.
+func addNet(ctx context.Context, n int64) {
+	r, stage := recorderOf(ctx)
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	u := r.stages[stage]
+	u.NetBytes += n
+	r.stages[stage] = u
+}
+
+// usage returns the stages that ran at least a process or moved data.
+func (r *usageRecorder) usage() map[string]db.Usage {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.stages) == 0 {
+		return nil
+	}
+	out := make(map[string]db.Usage, len(r.stages))
+	for stage, u := range r.stages {
+		out[stage] = u
+	}
+	return out
+}
@@ -0,0 +1,61 @@
+package backup
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+// procIO is the /proc/<pid>/io accounting of a process.
+type procIO struct {
+	rchar      int64
+	readBytes  int64
+	writeBytes int64
+}
+
+// exitedIO waits for the process to exit without reaping it, so its io
+// accounting can still be read, then reads it.
+func exitedIO(p *os.Process) procIO {
+	var info [128]byte
+	const wnowait = 0x1000000
+	for {
+		_, _, e := syscall.Syscall6(syscall.SYS_WAITID, 1, uintptr(p.Pid), uintptr(unsafe.Pointer(&info[0])),
+			syscall.WEXITED|wnowait, 0, 0)
+		if e != syscall.EINTR {
+			break
+		}
+	}
+	var io procIO
+	data, err := ioutil.ReadFile(fmt.Sprintf("/proc/%v/io", p.Pid))
+	if err != nil {
+		return io
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		f := strings.Fields(line)
+		if len(f) != 2 {
+			continue
+		}
+		n, _ := strconv.ParseInt(f[1], 10, 64)
+		switch f[0] {
+		case "rchar:":
+			io.rchar = n
+		case "read_bytes:":
+			io.readBytes = n
+		case "write_bytes:":
+			io.writeBytes = n
+		}
+	}
+	return io
+}
+
+// maxRSS returns the peak resident set size in bytes, Linux reports it in KB.
+func maxRSS(state *os.ProcessState) int64 {
+	if ru, ok := state.SysUsage().(*syscall.Rusage); ok {
+		return ru.Maxrss * 1024
+	}
+	return 0
+}
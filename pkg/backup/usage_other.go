@@ -0,0 +1,23 @@
+//go:build !linux
+// +build !linux
+
+package backup
+
+import (
+	"os"
+)
+
+// procIO is only accounted on Linux.
+type procIO struct {
+	rchar      int64
+	readBytes  int64
+	writeBytes int64
+}
+
+func exitedIO(p *os.Process) procIO {
+	return procIO{}
+}
+
+func maxRSS(state *os.ProcessState) int64 {
+	return 0
+}
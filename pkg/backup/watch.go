@@ -0,0 +1,197 @@
+package backup
+
+import (
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/stefanprodan/mgob/pkg/clock"
+)
+
+// ErrNoDumps is returned by watch mode runs that found nothing to archive.
+var ErrNoDumps = errors.New("no new dumps")
+
+type watchedDump struct {
+	path    string
+	modTime time.Time
+}
+
+// runWatch archives every settled dump of the watched dir, oldest first.
+func runWatch(ctx context.Context, c *dumpConfig) (Result, error) {
+	w := c.plan.Watch
+	if w == nil || w.Path == "" {
+		return errRes(c), errors.Errorf("'%s' backup mode requires a watch path", c.plan.Mode)
+	}
+
+	dumps, err := findDumps(c.plan.Watch.Path, w.Pattern, time.Duration(w.Settle)*time.Second)
+	if err != nil {
+		return errRes(c), err
+	}
+	if len(dumps) == 0 {
+		return errRes(c), ErrNoDumps
+	}
+
+	res := errRes(c)
+	last := int64(0)
+	for _, d := range dumps {
+		if err := ctx.Err(); err != nil {
+			return res, err
+		}
+		// the dump time names the backup, kept unique for retention
+		ts := d.modTime.Unix()
+		if ts <= last {
+			ts = last + 1
+		}
+		last = ts
+
+		dc := *c
+		dc.source = d.path
+		dc.ts = time.Unix(ts, 0)
+		log.WithField("plan", c.name).Infof("Archiving %v", d.path)
+		r, err := runDumpAndUpload(ctx, &dc)
+		if err != nil {
+			return res, errors.Wrapf(err, "archiving %v failed", d.path)
+		}
+		if err := os.RemoveAll(d.path); err != nil {
+			log.WithField("plan", c.name).Warnf("Removing %v failed %v", d.path, err)
+		}
+
+		res.Name = r.Name
+		res.Size += r.Size
+		res.Checksum = r.Checksum
+		res.Files = append(res.Files, r.Files...)
+		res.Uploads = append(res.Uploads, r.Uploads...)
+	}
+
+	res.Status = 200
+	res.Duration = clock.Since(c.ts)
+	return res, nil
+}
+
+// findDumps lists the entries of dir matching pattern that haven't changed for settle.
+func findDumps(dir string, pattern string, settle time.Duration) ([]watchedDump, error) {
+	if pattern == "" {
+		pattern = "*"
+	}
+	if settle == 0 {
+		settle = time.Minute
+	}
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, errors.Wrapf(err, "reading %v failed", dir)
+	}
+
+	dumps := make([]watchedDump, 0)
+	for _, e := range entries {
+		// hidden entries are usually in-progress writes
+		if strings.HasPrefix(e.Name(), ".") {
+			continue
+		}
+		if ok, err := filepath.Match(pattern, e.Name()); err != nil {
+			return nil, errors.Wrapf(err, "invalid watch pattern %v", pattern)
+		} else if !ok {
+			continue
+		}
+
+		path := filepath.Join(dir, e.Name())
+		modTime := e.ModTime()
+		if e.IsDir() {
+			// a dump dir is settled when none of its files changed
+			err := filepath.Walk(path, func(p string, fi os.FileInfo, err error) error {
+				if err != nil {
+					return err
+				}
+				if fi.ModTime().After(modTime) {
+					modTime = fi.ModTime()
+				}
+				return nil
+			})
+			if err != nil {
+				return nil, errors.Wrapf(err, "reading %v failed", path)
+			}
+		} else if !e.Mode().IsRegular() {
+			continue
+		}
+		if time.Since(modTime) < settle {
+			continue
+		}
+		dumps = append(dumps, watchedDump{path: path, modTime: modTime})
+	}
+
+	sort.Slice(dumps, func(i, j int) bool { return dumps[i].modTime.Before(dumps[j].modTime) })
+	return dumps, nil
+}
+
+// dumpSource copies the watched dump to the tmp dir, dirs are packed in a tar
+// and files are gzipped unless already compressed or the pipeline does it.
+func dumpSource(ctx context.Context, c *dumpConfig, compress bool) (string, string, error) {
+	fi, err := os.Stat(c.source)
+	if err != nil {
+		return "", "", errors.Wrapf(err, "reading %v failed", c.source)
+	}
+	base := fmt.Sprintf("%v/%v-%v", c.tmpPath, c.name, c.ts.Unix())
+	mlog := base + ".log"
+
+	if fi.IsDir() {
+		archive := base + ".tar"
+		if compress {
+			archive += ".gz"
+		}
+		if err := tarDir(ctx, c.source, archive, compress); err != nil {
+			os.Remove(archive)
+			return "", "", err
+		}
+		logToFile(mlog, []byte(fmt.Sprintf("archived dir %v\n", c.source)))
+		return archive, mlog, nil
+	}
+
+	ext := filepath.Ext(c.source)
+	if ext == "" {
+		ext = ".archive"
+	}
+	archive := base + ext
+	if !compress || ext == ".gz" {
+		err = copyFile(c.source, archive)
+	} else {
+		archive += ".gz"
+		err = gzipFile(ctx, c.source, archive)
+	}
+	if err != nil {
+		os.Remove(archive)
+		return "", "", errors.Wrapf(err, "copying %v failed", c.source)
+	}
+	logToFile(mlog, []byte(fmt.Sprintf("archived file %v\n", c.source)))
+	return archive, mlog, nil
+}
+
+func gzipFile(ctx context.Context, src string, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	gz := gzip.NewWriter(out)
+	if _, err := io.Copy(gz, ctxReader{ctx: ctx, r: in}); err != nil {
+		return err
+	}
+	if err := gz.Close(); err != nil {
+		return err
+	}
+	return out.Close()
+}
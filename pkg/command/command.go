@@ -0,0 +1,61 @@
+// Package command starts the child processes of mgob, mongodump, mongorestore
+// and the destination CLIs, through a Runner the e2e harness can swap.
+package command
+
+import (
+	"bytes"
+	"os/exec"
+	"sync"
+)
+
+// Runner starts cmd, the caller waits for it.
+type Runner interface {
+	Start(cmd *exec.Cmd) error
+}
+
+type osRunner struct{}
+
+func (osRunner) Start(cmd *exec.Cmd) error { return cmd.Start() }
+
+var (
+	mu      sync.RWMutex
+	current Runner = osRunner{}
+)
+
+// Set replaces the runner until restore is called.
+func Set(r Runner) (restore func()) {
+	mu.Lock()
+	defer mu.Unlock()
+	prev := current
+	current = r
+	return func() {
+		mu.Lock()
+		defer mu.Unlock()
+		current = prev
+	}
+}
+
+// Start starts cmd with the runner in use.
+func Start(cmd *exec.Cmd) error {
+	mu.RLock()
+	r := current
+	mu.RUnlock()
+	return r.Start(cmd)
+}
+
+// Run starts cmd and waits for it to exit.
+func Run(cmd *exec.Cmd) error {
+	if err := Start(cmd); err != nil {
+		return err
+	}
+	return cmd.Wait()
+}
+
+// CombinedOutput runs cmd and returns its stdout and stderr.
+func CombinedOutput(cmd *exec.Cmd) ([]byte, error) {
+	var b bytes.Buffer
+	cmd.Stdout = &b
+	cmd.Stderr = &b
+	err := Run(cmd)
+	return b.Bytes(), err
+}
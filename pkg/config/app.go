@@ -1,15 +1,75 @@
 package config
 
+import (
+	"io/ioutil"
+	"os"
+
+	"github.com/pkg/errors"
+)
+
 type AppConfig struct {
-	LogLevel    string `json:"log_level"`
-	JSONLog     bool   `json:"json_log"`
-	Host        string `json:"host"`
-	Port        int    `json:"port"`
-	ConfigPath  string `json:"config_path"`
-	StoragePath string `json:"storage_path"`
-	TmpPath     string `json:"tmp_path"`
-	DataPath    string `json:"data_path"`
-	Version     string `json:"version"`
-	UseAwsCli   bool   `json:"use_aws_cli"`
-	HasGpg      bool   `json:"has_gpg"`
+	LogLevel     string `json:"log_level"`
+	JSONLog      bool   `json:"json_log"`
+	Host         string `json:"host"`
+	Port         int    `json:"port"`
+	Socket       string `json:"socket"`
+	DebugPort    int    `json:"debug_port"`
+	AgentPort    int    `json:"agent_port"`
+	TenantsPath  string `json:"tenants_path"`
+	PricingPath  string `json:"pricing_path"`
+	SetsPath     string `json:"sets_path"`
+	AgentCert    string `json:"agent_cert"`
+	AgentKey     string `json:"-"`
+	AgentCA      string `json:"agent_ca"`
+	Controller   bool   `json:"controller"`
+	ConfigPath   string `json:"config_path"`
+	StoragePath  string `json:"storage_path"`
+	StorageWatch bool   `json:"storage_watch"`
+	TmpPath      string `json:"tmp_path"`
+	DataPath     string `json:"data_path"`
+	HomePath     string `json:"home_path"`
+	Version      string `json:"version"`
+	UserAgent    string `json:"user_agent"`
+	ManifestKey  string `json:"manifest_key"`
+	MaxUploads   int    `json:"max_uploads"`
+	MaxTmp       string `json:"max_tmp"`
+	MaxDelay     int    `json:"max_delay"`
+	// MaxConcurrentBackups is the number of backups running at once, the others wait for a slot, unlimited when 0
+	MaxConcurrentBackups int `json:"max_concurrent_backups"`
+	// CacheSize bounds the archives kept in CachePath after their download for a restore, disabled when empty
+	CacheSize string `json:"cache_size"`
+	CachePath string `json:"cache_path"`
+	// CompactInterval is the hours between two compactions of mgob.db, disabled when 0
+	CompactInterval int `json:"compact_interval"`
+	// ReloadInterval is the seconds between two checks of the plan and key files for changes, disabled when 0
+	ReloadInterval int `json:"reload_interval"`
+	// CatalogMaxAge is the days the catalog records of archives gone from the storage dir are kept
+	CatalogMaxAge int  `json:"catalog_max_age"`
+	UseAwsCli     bool `json:"use_aws_cli"`
+	HasGpg        bool `json:"has_gpg"`
+	// MetricsLabels lists the plan, database and destination labels exported
+	MetricsLabels       string `json:"metrics_labels"`
+	MetricsMaxDatabases int    `json:"metrics_max_databases"`
+	// MongodumpVersion is the first line of mongodump --version
+	MongodumpVersion string `json:"mongodump_version"`
+	// Pricing is loaded from PricingPath, the costs aren't estimated without it
+	Pricing Pricing `json:"-"`
+	// Sets are loaded from SetsPath
+	Sets Sets `json:"-"`
+}
+
+// CheckWritable creates the dirs if missing and fails on the first one a file can't be written to.
+func CheckWritable(dirs ...string) error {
+	for _, dir := range dirs {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return errors.Wrapf(err, "%v is not writable", dir)
+		}
+		f, err := ioutil.TempFile(dir, ".mgob-probe-")
+		if err != nil {
+			return errors.Wrapf(err, "%v is not writable", dir)
+		}
+		f.Close()
+		os.Remove(f.Name())
+	}
+	return nil
 }
@@ -0,0 +1,245 @@
+package config
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v2"
+
+	"github.com/stefanprodan/mgob/pkg/clock"
+)
+
+// BundleVersion is the version of the plan bundle format.
+const BundleVersion = 1
+
+// SecretsMode sets how an export handles the plan secrets.
+type SecretsMode string
+
+const (
+	// SecretsStrip blanks the secrets, the import lists them as missing
+	SecretsStrip SecretsMode = "strip"
+	// SecretsRef replaces the secrets by ${MGOB_SECRET_...} references the import resolves from its env
+	SecretsRef SecretsMode = "ref"
+	// SecretsInclude keeps the secrets, e.g. for a disaster rebuild of mgob itself
+	SecretsInclude SecretsMode = "include"
+)
+
+// Bundle holds plans exported from one mgob instance to be imported into another.
+type Bundle struct {
+	Version  int          `yaml:"version"`
+	Exported time.Time    `yaml:"exported"`
+	Secrets  SecretsMode  `yaml:"secrets"`
+	Plans    []BundlePlan `yaml:"plans"`
+}
+
+type BundlePlan struct {
+	Name string        `yaml:"name"`
+	Spec yaml.MapSlice `yaml:"spec"`
+	// Secrets are the paths of the secrets stripped or referenced, e.g. target.password
+	Secrets []string `yaml:"secrets,omitempty"`
+}
+
+// secretKeys are the plan fields holding credentials.
+var secretKeys = map[string]bool{
+	"password":         true,
+	"passphrase":       true,
+	"privateKey":       true,
+	"private_key":      true,
+	"accessKey":        true,
+	"secretKey":        true,
+	"connectionString": true,
+}
+
+var (
+	secretRef      = regexp.MustCompile(`^\$\{(MGOB_SECRET_[A-Z0-9_]+)\}$`)
+	uriPassword    = regexp.MustCompile(`//[^@/]*:[^@/]*@`)
+	secretEnvChars = regexp.MustCompile(`[^A-Z0-9]+`)
+)
+
+// PlanFiles returns the yaml file of each plan in dir by plan name.
+func PlanFiles(dir string) (map[string]string, error) {
+	files := make(map[string]string)
+	err := filepath.Walk(dir, func(path string, f os.FileInfo, err error) error {
+		if err != nil || f.IsDir() {
+			return err
+		}
+		ext := filepath.Ext(path)
+		if ext != ".yml" && ext != ".yaml" {
+			return nil
+		}
+		name := strings.TrimSuffix(filepath.Base(path), ext)
+		if _, ok := files[name]; !ok {
+			files[name] = path
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, errors.Wrapf(err, "Reading from %v failed", dir)
+	}
+	return files, nil
+}
+
+// ExportPlans bundles the plans of dir, all of them when names is empty.
+func ExportPlans(dir string, names []string, mode SecretsMode) (Bundle, error) {
+	b := Bundle{Version: BundleVersion, Exported: clock.Now().UTC(), Secrets: mode}
+	switch mode {
+	case SecretsStrip, SecretsRef, SecretsInclude:
+	default:
+		return b, errors.Errorf("unknown secrets mode '%s', use strip, ref or include", mode)
+	}
+	files, err := PlanFiles(dir)
+	if err != nil {
+		return b, err
+	}
+	if len(names) == 0 {
+		for name := range files {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+	}
+
+	for _, name := range names {
+		path, ok := files[name]
+		if !ok {
+			return b, errors.Errorf("Plan %v not found", name)
+		}
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return b, errors.Wrapf(err, "Reading %v failed", path)
+		}
+		var spec yaml.MapSlice
+		if err := yaml.Unmarshal(data, &spec); err != nil {
+			return b, errors.Wrapf(err, "Parsing %v failed", path)
+		}
+		p := BundlePlan{Name: name, Spec: spec}
+		if mode != SecretsInclude {
+			p.Secrets = hideSecrets(spec, name, "", mode)
+		}
+		b.Plans = append(b.Plans, p)
+	}
+	return b, nil
+}
+
+// hideSecrets blanks or references the secrets of spec in place and returns their paths.
+func hideSecrets(spec yaml.MapSlice, plan string, prefix string, mode SecretsMode) []string {
+	paths := make([]string, 0)
+	for i, item := range spec {
+		key := fmt.Sprint(item.Key)
+		path := prefix + key
+		switch v := item.Value.(type) {
+		case yaml.MapSlice:
+			paths = append(paths, hideSecrets(v, plan, path+".", mode)...)
+		case []interface{}:
+			for n, e := range v {
+				if m, ok := e.(yaml.MapSlice); ok {
+					paths = append(paths, hideSecrets(m, plan, fmt.Sprintf("%v.%v.", path, n), mode)...)
+				}
+			}
+		case string:
+			if v == "" || !isSecret(path, key, v) {
+				continue
+			}
+			spec[i].Value = ""
+			if mode == SecretsRef {
+				spec[i].Value = "${" + SecretEnv(plan, path) + "}"
+			}
+			paths = append(paths, path)
+		}
+	}
+	return paths
+}
+
+// isSecret is true for the credential fields, the uris holding a password and the Slack webhook.
+func isSecret(path string, key string, value string) bool {
+	switch {
+	case secretKeys[key]:
+		return true
+	case key == "uri" || key == "url":
+		if path == "slack.url" {
+			return true
+		}
+		return uriPassword.MatchString(value)
+	}
+	return false
+}
+
+// SecretEnv returns the env variable an import reads the secret at path of plan from,
+// e.g. MGOB_SECRET_MONGO_DEBUG_TARGET_PASSWORD.
+func SecretEnv(plan string, path string) string {
+	name := strings.ToUpper(plan + "_" + path)
+	name = secretEnvChars.ReplaceAllString(name, "_")
+	return "MGOB_SECRET_" + name
+}
+
+// ImportedPlan is a plan of a bundle ready to be saved.
+type ImportedPlan struct {
+	Plan Plan
+	Data []byte
+	// Missing are the paths of the secrets the bundle stripped
+	Missing []string
+}
+
+// ImportPlans resolves the secret references of the bundle plans from the env
+// and validates the plans, nothing is saved.
+func ImportPlans(b Bundle) ([]ImportedPlan, error) {
+	if b.Version > BundleVersion {
+		return nil, errors.Errorf("bundle version %v, this mgob reads up to %v", b.Version, BundleVersion)
+	}
+	list := make([]ImportedPlan, 0, len(b.Plans))
+	for _, p := range b.Plans {
+		unset := make([]string, 0)
+		resolveSecrets(p.Spec, &unset)
+		if len(unset) > 0 {
+			return nil, errors.Errorf("Plan %v references unset secrets %v", p.Name, strings.Join(unset, ", "))
+		}
+		data, err := yaml.Marshal(p.Spec)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Encoding plan %v failed", p.Name)
+		}
+		plan, err := ParsePlan(p.Name, data)
+		if err != nil {
+			return nil, err
+		}
+		imported := ImportedPlan{Plan: plan, Data: data}
+		if b.Secrets == SecretsStrip {
+			imported.Missing = p.Secrets
+		}
+		list = append(list, imported)
+	}
+	return list, nil
+}
+
+// resolveSecrets replaces the ${MGOB_SECRET_...} references of spec by their
+// env value and collects the unset ones.
+func resolveSecrets(spec yaml.MapSlice, unset *[]string) {
+	for i, item := range spec {
+		switch v := item.Value.(type) {
+		case yaml.MapSlice:
+			resolveSecrets(v, unset)
+		case []interface{}:
+			for _, e := range v {
+				if m, ok := e.(yaml.MapSlice); ok {
+					resolveSecrets(m, unset)
+				}
+			}
+		case string:
+			m := secretRef.FindStringSubmatch(v)
+			if m == nil {
+				continue
+			}
+			value, ok := os.LookupEnv(m[1])
+			if !ok {
+				*unset = append(*unset, m[1])
+				continue
+			}
+			spec[i].Value = value
+		}
+	}
+}
@@ -0,0 +1,78 @@
+package config
+
+import (
+	"encoding/json"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Command is a command of the config, a string is a command line run through
+// sh -c (cmd /C on Windows), a list is the program and its args started
+// directly, without a shell, e.g. on distroless images.
+type Command struct {
+	Line string
+	Args []string
+}
+
+// Empty tells if no command is set.
+func (c Command) Empty() bool {
+	return c.Line == "" && len(c.Args) == 0
+}
+
+func (c Command) String() string {
+	if len(c.Args) > 0 {
+		return strings.Join(c.Args, " ")
+	}
+	return c.Line
+}
+
+func (c *Command) set(line *string, args []string) error {
+	if line != nil {
+		*c = Command{Line: *line}
+		return nil
+	}
+	if len(args) == 0 || args[0] == "" {
+		return errors.New("command list must start with the program")
+	}
+	*c = Command{Args: args}
+	return nil
+}
+
+func (c *Command) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var line string
+	if err := unmarshal(&line); err == nil {
+		return c.set(&line, nil)
+	}
+	var args []string
+	if err := unmarshal(&args); err != nil {
+		return errors.New("command must be a string or a list of strings")
+	}
+	return c.set(nil, args)
+}
+
+func (c Command) MarshalYAML() (interface{}, error) {
+	if len(c.Args) > 0 {
+		return c.Args, nil
+	}
+	return c.Line, nil
+}
+
+func (c *Command) UnmarshalJSON(data []byte) error {
+	var line string
+	if err := json.Unmarshal(data, &line); err == nil {
+		return c.set(&line, nil)
+	}
+	var args []string
+	if err := json.Unmarshal(data, &args); err != nil {
+		return errors.New("command must be a string or a list of strings")
+	}
+	return c.set(nil, args)
+}
+
+func (c Command) MarshalJSON() ([]byte, error) {
+	if len(c.Args) > 0 {
+		return json.Marshal(c.Args)
+	}
+	return json.Marshal(c.Line)
+}
@@ -0,0 +1,54 @@
+package config
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"gopkg.in/yaml.v2"
+)
+
+func TestCommandYAML(t *testing.T) {
+	tests := []struct {
+		yaml string
+		want Command
+		ok   bool
+	}{
+		{`command: "/scripts/export.sh --all"`, Command{Line: "/scripts/export.sh --all"}, true},
+		{`command: ["/scripts/export.sh", "--all"]`, Command{Args: []string{"/scripts/export.sh", "--all"}}, true},
+		{"command:\n  - clamdscan\n  - --no-summary\n", Command{Args: []string{"clamdscan", "--no-summary"}}, true},
+		{`command: []`, Command{}, false},
+		{`command: {program: clamdscan}`, Command{}, false},
+	}
+	for _, tt := range tests {
+		var e Exec
+		err := yaml.UnmarshalStrict([]byte(tt.yaml), &e)
+		if (err == nil) != tt.ok {
+			t.Errorf("parsing %q error %v, want ok %v", tt.yaml, err, tt.ok)
+			continue
+		}
+		if !tt.ok {
+			continue
+		}
+		if !reflect.DeepEqual(e.Command, tt.want) {
+			t.Errorf("parsing %q = %#v, want %#v", tt.yaml, e.Command, tt.want)
+		}
+		// plans are written back to yaml by the bundles and sent as json to the agents
+		data, err := yaml.Marshal(e)
+		var back Exec
+		if err == nil {
+			err = yaml.UnmarshalStrict(data, &back)
+		}
+		if err != nil || !reflect.DeepEqual(back, e) {
+			t.Errorf("yaml round trip of %q = %#v %v", tt.yaml, back, err)
+		}
+		data, err = json.Marshal(e)
+		back = Exec{}
+		if err == nil {
+			err = json.Unmarshal(data, &back)
+		}
+		if err != nil || !reflect.DeepEqual(back, e) {
+			t.Errorf("json round trip of %q = %#v %v", tt.yaml, back, err)
+		}
+	}
+}
@@ -1,9 +1,12 @@
 package config
 
 import (
+	"encoding/json"
+	"fmt"
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"regexp"
 	"strings"
 
 	"github.com/pkg/errors"
@@ -15,26 +18,240 @@ type BackupMode string
 const (
 	BackupModeSingle   BackupMode = "single"
 	BackupModeDatabase BackupMode = "database"
+	BackupModeSample   BackupMode = "sample"
+	BackupModeWatch    BackupMode = "watch"
+	BackupModeExec     BackupMode = "exec"
+	// BackupModeSharded dumps the config server and each shard of a cluster behind mongos
+	BackupModeSharded BackupMode = "sharded"
+	// BackupModePBM delegates the backups to a Percona Backup for MongoDB deployment
+	BackupModePBM BackupMode = "pbm"
+	// BackupModeSnapshot copies the dbPath of a secondary locked with fsyncLock
+	BackupModeSnapshot BackupMode = "snapshot"
+	// BackupModeCSI takes a Kubernetes VolumeSnapshot of the data PVC
+	BackupModeCSI BackupMode = "csi"
+	// BackupModeDisk snapshots the cloud volumes backing the MongoDB nodes
+	BackupModeDisk BackupMode = "disk"
+	// BackupModeAtlas takes on-demand Atlas snapshots through the Atlas Admin API
+	BackupModeAtlas BackupMode = "atlas"
+	// BackupModeMigrate streams mongodump of the target into mongorestore on another cluster
+	BackupModeMigrate BackupMode = "migrate"
+	// BackupModeExport writes JSON or CSV exports of collections with mongoexport
+	BackupModeExport BackupMode = "export"
+	// BackupModeMetadata stores the collection options, the indexes and the users and roles, no documents
+	BackupModeMetadata BackupMode = "metadata"
 )
 
 type Plan struct {
-	Name       string      `yaml:"name"`
-	Target     Target      `yaml:"target"`
-	Mode       BackupMode  `yaml:"mode"`
-	Scheduler  Scheduler   `yaml:"scheduler"`
-	Encryption *Encryption `yaml:"encryption"`
-	S3         *S3         `yaml:"s3"`
-	GCloud     *GCloud     `yaml:"gcloud"`
-	Rclone     *Rclone     `yaml:"rclone"`
-	Azure      *Azure      `yaml:"azure"`
-	SFTP       *SFTP       `yaml:"sftp"`
-	SMTP       *SMTP       `yaml:"smtp"`
-	Slack      *Slack      `yaml:"slack"`
+	Name       string            `yaml:"name"`
+	Tenant     string            `yaml:"tenant"`
+	Target     Target            `yaml:"target"`
+	Mode       BackupMode        `yaml:"mode"`
+	Scheduler  Scheduler         `yaml:"scheduler"`
+	Encryption *Encryption       `yaml:"encryption"`
+	S3         *S3               `yaml:"s3"`
+	GCloud     *GCloud           `yaml:"gcloud"`
+	Rclone     *Rclone           `yaml:"rclone"`
+	Azure      *Azure            `yaml:"azure"`
+	SFTP       *SFTP             `yaml:"sftp"`
+	SMTP       *SMTP             `yaml:"smtp"`
+	Slack      *Slack            `yaml:"slack"`
+	Escalation *Escalation       `yaml:"escalation"`
+	Pipeline   []Stage           `yaml:"pipeline"`
+	Quota      *Quota            `yaml:"quota"`
+	Extract    *Extract          `yaml:"extract"`
+	Standby    *Standby          `yaml:"standby"`
+	Restore    *Restore          `yaml:"restore"`
+	Approval   *Approval         `yaml:"approval"`
+	Reconcile  *Reconcile        `yaml:"reconcile"`
+	Verify     *Verify           `yaml:"verify"`
+	Routes     []Route           `yaml:"routes"`
+	Scan       *Scan             `yaml:"scan"`
+	Tags       map[string]string `yaml:"tags"`
+	Sample     *Sample           `yaml:"sample"`
+	Transform  *Transform        `yaml:"transform"`
+	Agent      string            `yaml:"agent"`
+	Executor   *Executor         `yaml:"executor"`
+	Health     *Health           `yaml:"health"`
+	Throttle   *Throttle         `yaml:"throttle"`
+	Watch      *Watch            `yaml:"watch"`
+	Exec       *Exec             `yaml:"exec"`
+	Debug      bool              `yaml:"debug"`
+	Env        map[string]string `yaml:"env"`
+	PITR       *PITR             `yaml:"pitr"`
+	// Trigger starts backups on the target activity seen on a change stream
+	Trigger *Trigger `yaml:"trigger"`
+	// Streaming pipes the dump through the pipeline straight to the
+	// destinations, without writing the archive to disk
+	Streaming   bool         `yaml:"streaming"`
+	Compression *Compression `yaml:"compression"`
+	Sharded     *Sharded     `yaml:"sharded"`
+	PBM         *PBM         `yaml:"pbm"`
+	Probe       *Probe       `yaml:"probe"`
+	Snapshot    *Snapshot    `yaml:"snapshot"`
+	CSI         *CSI         `yaml:"csi"`
+	Disk        *Disk        `yaml:"disk"`
+	Atlas       *Atlas       `yaml:"atlas"`
+	Migrate     *Migrate     `yaml:"migrate"`
+	Export      *Export      `yaml:"export"`
+	// Budget is the monthly storage cost in $ the plan should stay under
+	Budget float64 `yaml:"budget"`
+	// Naming of the remote objects, name (default) or content
+	Naming Naming `yaml:"naming"`
+}
+
+// Export is the mongoexport of the export mode.
+type Export struct {
+	// Type is json (default) or csv
+	Type string `yaml:"type"`
+	// Collections of target.database to export, target.collection when empty
+	Collections []string `yaml:"collections"`
+	// Fields are the exported fields, required for csv
+	Fields []string `yaml:"fields"`
+	// Sort is a json string, a yaml mapping loses the key order of a compound sort
+	Sort         Query `yaml:"sort"`
+	Limit        int   `yaml:"limit"`
+	JSONArray    bool  `yaml:"jsonArray"`
+	NoHeaderLine bool  `yaml:"noHeaderLine"`
+}
+
+// Migrate is the cluster the target is copied to in migrate mode.
+type Migrate struct {
+	Uri string `yaml:"uri"`
+	// Include and Exclude are mongorestore --nsInclude and --nsExclude patterns
+	Include    []string    `yaml:"include"`
+	Exclude    []string    `yaml:"exclude"`
+	Namespaces []Namespace `yaml:"namespaces"`
+	NoDrop     bool        `yaml:"noDrop"`
+	Params     string      `yaml:"params"`
+}
+
+// Atlas is the cluster snapshotted in atlas mode.
+type Atlas struct {
+	// GroupID is the Atlas project id
+	GroupID string `yaml:"groupId"`
+	Cluster string `yaml:"cluster"`
+	// PublicKey and PrivateKey are the programmatic API key, with the Project Backup Manager role
+	PublicKey  string `yaml:"publicKey"`
+	PrivateKey string `yaml:"privateKey"`
+	// RetentionDays is how long Atlas keeps a snapshot the plan retention didn't delete, defaults to 7
+	RetentionDays int `yaml:"retentionDays"`
+	// ExportBucketID exports each snapshot to this S3 export bucket when set
+	ExportBucketID string `yaml:"exportBucketId"`
+	// Timeout is the minutes to wait for the snapshot and the export, defaults to 120
+	Timeout int `yaml:"timeout"`
+	// URL is the Admin API base url, defaults to https://cloud.mongodb.com/api/atlas/v1.0
+	URL string `yaml:"url"`
+}
+
+// Disk is the cloud volumes snapshotted in disk mode.
+type Disk struct {
+	// Provider is aws, gcloud or azure
+	Provider string `yaml:"provider"`
+	// Volumes are the EBS volume ids, the GCE persistent disk names or the Azure managed disk ids
+	Volumes []string `yaml:"volumes"`
+	// Region is the AWS region, the aws CLI default when blank
+	Region string `yaml:"region"`
+	// Project and Zone of the GCE disks, the gcloud defaults when blank
+	Project string `yaml:"project"`
+	Zone    string `yaml:"zone"`
+	// ResourceGroup receives the Azure snapshots
+	ResourceGroup string `yaml:"resourceGroup"`
+	// Lock locks Member, a secondary of target.uri when blank, with fsyncLock until the snapshots are started
+	Lock   bool   `yaml:"lock"`
+	Member string `yaml:"member"`
+	// Timeout is the minutes to wait for the snapshots to complete, defaults to 60
+	Timeout int `yaml:"timeout"`
+}
+
+// CSI is the data PVC snapshotted in csi mode.
+type CSI struct {
+	Namespace string `yaml:"namespace"`
+	PVC       string `yaml:"pvc"`
+	// SnapshotClass is the VolumeSnapshotClass, the cluster default when blank
+	SnapshotClass string `yaml:"snapshotClass"`
+	// Lock locks Member, a secondary of target.uri when blank, with fsyncLock until the snapshot is cut
+	Lock   bool   `yaml:"lock"`
+	Member string `yaml:"member"`
+	// Timeout is the minutes to wait for the snapshot to be ready, defaults to 10
+	Timeout int `yaml:"timeout"`
+	// Kubectl is the kubectl path, defaults to kubectl
+	Kubectl string `yaml:"kubectl"`
+}
+
+// Snapshot is the member locked in snapshot mode and how its dbPath is copied.
+type Snapshot struct {
+	// Member is the host:port of the secondary to lock, a secondary of target.uri when blank
+	Member string `yaml:"member"`
+	// DbPath is the member dbPath as mounted on this host, archived while the member is locked
+	DbPath string `yaml:"dbPath"`
+	// Command copies or snapshots the dbPath instead, it prints the path of the copy
+	// as the last line of its stdout, the copy is archived after the unlock
+	Command Command `yaml:"command"`
+	// LockTimeout is the minutes the member may stay locked, defaults to 10
+	LockTimeout int `yaml:"lockTimeout"`
+}
+
+// Probe checks the remote destinations of the plan between the runs.
+type Probe struct {
+	// Interval is the minutes between two probes, defaults to 5
+	Interval int `yaml:"interval"`
+	// Breaker skips the uploads to the destinations found down and queues the
+	// files until a probe finds them back up
+	Breaker bool `yaml:"breaker"`
+}
+
+// PBM tunes the backups the pbm mode runs with the pbm CLI.
+type PBM struct {
+	// Type is logical (default), physical or incremental
+	Type        string `yaml:"type"`
+	Compression string `yaml:"compression"`
+	// Binary is the pbm CLI path, defaults to pbm
+	Binary string `yaml:"binary"`
+}
+
+// Sharded tunes the sharded backup mode.
+type Sharded struct {
+	// Parallel is the number of shards dumped at once, defaults to 1
+	Parallel int `yaml:"parallel"`
+	// BalancerTimeout is the seconds to wait for the balancer to stop, defaults to 300
+	BalancerTimeout int `yaml:"balancerTimeout"`
+}
+
+// Compression selects the codec of the archive instead of the mongodump gzip.
+type Compression struct {
+	// Type is gzip, zstd, lz4 or none
+	Type  string `yaml:"type"`
+	Level int    `yaml:"level"`
+	// Threads > 1 compresses gzip in parallel with pigz
+	Threads int `yaml:"threads"`
+}
+
+// PITR tails the target oplog between full backups into incremental segments.
+type PITR struct {
+	// Interval is the length of an oplog slice in minutes, defaults to 10
+	Interval int `yaml:"interval"`
+	// Window is the number of hours point in time restores must cover,
+	// the segments of older chains are removed
+	Window int `yaml:"window"`
+}
+
+// Trigger watches a change stream of the target and starts a backup when a
+// marker collection changes or after enough writes, besides the cron runs.
+type Trigger struct {
+	// Collection is the database.collection of the marker, any change to it starts a backup
+	Collection string `yaml:"collection"`
+	// Writes starts a backup once the dumped databases had that many writes since the last backup
+	Writes int `yaml:"writes"`
+	// MinInterval is the minimum minutes between two triggered backups, defaults to 10
+	MinInterval int `yaml:"minInterval"`
+	// SkipIdle skips the cron runs when the target had no write since the last backup
+	SkipIdle bool `yaml:"skipIdle"`
 }
 
 type Target struct {
 	Database           string   `yaml:"database"`
 	Collection         string   `yaml:"collection"`
+	IncludeDatabases   []string `yaml:"includeDatabases"`
 	ExcludeDatabases   []string `yaml:"excludeDatabases"`
 	ExcludeCollections []string `yaml:"excludeCollections"`
 	Host               string   `yaml:"host"`
@@ -43,12 +260,417 @@ type Target struct {
 	Port               int      `yaml:"port"`
 	Username           string   `yaml:"username"`
 	Params             string   `yaml:"params"`
+	PointInTime        bool     `yaml:"pointInTime"`
+	// Format is the mongodump output, archive (default) or directory
+	Format DumpFormat `yaml:"format"`
+	// PerCollection stores and uploads each file of a directory dump instead of a tar
+	PerCollection bool `yaml:"perCollection"`
+	// Query filters the documents of Collection, a yaml mapping or a json string
+	Query Query `yaml:"query"`
+	// DbHash records the dbHash of the dumped collections in the run manifest
+	DbHash bool `yaml:"dbHash"`
+	// ReadConcern is the read concern level of the dump, local, available or majority
+	ReadConcern string `yaml:"readConcern"`
+	// ForceTableScan makes mongodump read the collections in natural order instead of through the _id index
+	ForceTableScan bool `yaml:"forceTableScan"`
+	// NumParallelCollections is the number of collections mongodump reads at once, defaults to 4
+	NumParallelCollections int `yaml:"numParallelCollections"`
+	// ViewsAsCollections dumps the documents of the views as collections
+	ViewsAsCollections bool `yaml:"viewsAsCollections"`
+	// DumpDbUsersAndRoles dumps the users and roles defined on Database
+	DumpDbUsersAndRoles bool `yaml:"dumpDbUsersAndRoles"`
+	// ExcludeCollectionsWithPrefix leaves out the collections whose name starts with one of them
+	ExcludeCollectionsWithPrefix []string `yaml:"excludeCollectionsWithPrefix"`
+	// ReadPreference selects the member the dump reads from
+	ReadPreference *ReadPreference `yaml:"readPreference"`
+	// Flavor is the service behind the target, mongodb (default), documentdb or cosmosdb
+	Flavor Flavor `yaml:"flavor"`
+	// CAFile is the CA bundle the TLS connection verifies the target with
+	CAFile string `yaml:"caFile"`
+	// FieldEncryption is set for targets using client side field level or queryable encryption
+	FieldEncryption *FieldEncryption `yaml:"fieldEncryption"`
+}
+
+// DefaultKeyVaultNamespace is the key vault of the MongoDB drivers examples.
+const DefaultKeyVaultNamespace = "encryption.__keyVault"
+
+// FieldEncryption is the key vault and KMS providers of a target using client side
+// field level (CSFLE) or queryable encryption. The dumps and restores copy the
+// encrypted fields as is, the data keys stay in the KMS.
+type FieldEncryption struct {
+	// KeyVaultNamespace is the db.collection of the data keys, defaults to encryption.__keyVault
+	KeyVaultNamespace string `yaml:"keyVaultNamespace"`
+	// Providers are the KMS providers the data keys may be wrapped with: local, aws, azure, gcp or kmip
+	Providers []string `yaml:"providers"`
+	// KMIP is the server the kmip data keys are wrapped with
+	KMIP *KMIP `yaml:"kmip"`
+}
+
+// KMIP is a KMIP server, reached over mutual TLS.
+type KMIP struct {
+	// Endpoint is host:port, the port defaults to 5696
+	Endpoint string `yaml:"endpoint"`
+	CAFile   string `yaml:"caFile"`
+	// CertificateKeyFile is the PEM client certificate and key
+	CertificateKeyFile string `yaml:"certificateKeyFile"`
+}
+
+// KeyVault returns the database and collection of the key vault.
+func (e FieldEncryption) KeyVault() (string, string) {
+	ns := e.KeyVaultNamespace
+	if ns == "" {
+		ns = DefaultKeyVaultNamespace
+	}
+	if i := strings.Index(ns, "."); i >= 0 {
+		return ns[:i], ns[i+1:]
+	}
+	return ns, ""
+}
+
+// ReadPreference is a read preference mode with optional tag sets, a plain
+// string sets the mode only.
+type ReadPreference struct {
+	Mode                string              `yaml:"mode"`
+	Tags                []map[string]string `yaml:"tags"`
+	MaxStalenessSeconds int                 `yaml:"maxStalenessSeconds"`
 }
 
+// UnmarshalYAML accepts the mode as a string or the full mapping.
+func (r *ReadPreference) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var mode string
+	if err := unmarshal(&mode); err == nil {
+		*r = ReadPreference{Mode: mode}
+		return nil
+	}
+	type plain ReadPreference
+	return unmarshal((*plain)(r))
+}
+
+// Query is an extended JSON document passed to mongodump --query.
+type Query string
+
+// UnmarshalYAML reads a json string as is and converts a yaml mapping to json.
+func (q *Query) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var s string
+	if err := unmarshal(&s); err == nil {
+		*q = Query(s)
+		return nil
+	}
+	var m interface{}
+	if err := unmarshal(&m); err != nil {
+		return err
+	}
+	data, err := json.Marshal(jsonValue(m))
+	if err != nil {
+		return errors.Wrap(err, "invalid query")
+	}
+	*q = Query(data)
+	return nil
+}
+
+// jsonValue converts the maps yaml decodes to maps json can encode.
+func jsonValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for k, e := range v {
+			m[fmt.Sprint(k)] = jsonValue(e)
+		}
+		return m
+	case []interface{}:
+		for i, e := range v {
+			v[i] = jsonValue(e)
+		}
+		return v
+	}
+	return v
+}
+
+type DumpFormat string
+
+const (
+	DumpFormatArchive DumpFormat = "archive"
+	// DumpFormatDirectory dumps with --out and stores the directory as a tar
+	DumpFormatDirectory DumpFormat = "directory"
+)
+
+// Naming is how the archives are named at the remote destinations.
+type Naming string
+
+const (
+	// NamingName stores the archives under their file name
+	NamingName Naming = "name"
+	// NamingContent stores the archives under their sha256, the per plan
+	// index object maps the file names to them
+	NamingContent Naming = "content"
+)
+
+// Flavor is a MongoDB API compatible service, its unsupported commands and
+// options are left out of the backups.
+type Flavor string
+
+const (
+	FlavorMongoDB Flavor = "mongodb"
+	// FlavorDocumentDB is AWS DocumentDB, TLS with the RDS CA bundle, no oplog
+	FlavorDocumentDB Flavor = "documentdb"
+	// FlavorCosmosDB is the Azure CosmosDB API for MongoDB, TLS, no oplog
+	FlavorCosmosDB Flavor = "cosmosdb"
+)
+
 type Scheduler struct {
 	Cron      string `yaml:"cron"`
 	Retention int    `yaml:"retention"`
 	Timeout   int    `yaml:"timeout"`
+	// Retries of a failed scheduled backup, RetryBackoff is the seconds
+	// before the first one, doubled for each next one, defaults to 60
+	Retries      int `yaml:"retries"`
+	RetryBackoff int `yaml:"retryBackoff"`
+	// Timeouts of the backup stages, they override Timeout
+	Timeouts *Timeouts `yaml:"timeouts"`
+	// Overlap is what a cron run does when the previous run of the plan is still running
+	Overlap OverlapPolicy `yaml:"overlap"`
+}
+
+// OverlapPolicy is what a cron run does when a run of its plan is in progress.
+type OverlapPolicy string
+
+const (
+	// OverlapSkip skips the run (default)
+	OverlapSkip OverlapPolicy = "skip"
+	// OverlapQueue starts the run once the previous one ended, a single run is queued
+	OverlapQueue OverlapPolicy = "queue"
+	// OverlapCancel cancels the runs in progress and starts the new one
+	OverlapCancel OverlapPolicy = "cancel-previous"
+)
+
+// Timeouts are the minutes each stage of a backup may take, 0 means no
+// timeout. Dump and Upload default to the scheduler timeout.
+type Timeouts struct {
+	Dump int `yaml:"dump"`
+	// Encrypt bounds the pipeline compressing, encrypting and checksumming the dump
+	Encrypt int `yaml:"encrypt"`
+	// Upload bounds each upload to each destination
+	Upload int `yaml:"upload"`
+	// Total is the deadline of the whole run, uploads included
+	Total int `yaml:"total"`
+}
+
+// DumpTimeout is the minutes the dump may take.
+func (s Scheduler) DumpTimeout() int {
+	if s.Timeouts != nil && s.Timeouts.Dump > 0 {
+		return s.Timeouts.Dump
+	}
+	return s.Timeout
+}
+
+// EncryptTimeout is the minutes the pipeline may take.
+func (s Scheduler) EncryptTimeout() int {
+	if s.Timeouts != nil {
+		return s.Timeouts.Encrypt
+	}
+	return 0
+}
+
+// UploadTimeout is the minutes each upload may take.
+func (s Scheduler) UploadTimeout() int {
+	if s.Timeouts != nil && s.Timeouts.Upload > 0 {
+		return s.Timeouts.Upload
+	}
+	return s.Timeout
+}
+
+// TotalTimeout is the minutes the whole run may take.
+func (s Scheduler) TotalTimeout() int {
+	if s.Timeouts != nil {
+		return s.Timeouts.Total
+	}
+	return 0
+}
+
+// Quota limits the disk space a plan may use, sizes are in human format e.g. 10GB.
+type Quota struct {
+	Tmp     ByteSize `yaml:"tmp"`
+	Storage ByteSize `yaml:"storage"`
+}
+
+type ExtractRuntime string
+
+const (
+	ExtractRuntimeDocker     ExtractRuntime = "docker"
+	ExtractRuntimeKubernetes ExtractRuntime = "kubernetes"
+)
+
+// Extract configures the ephemeral mongod archives are restored into for
+// read-only data access. TTL is the maximum lifetime in minutes.
+type Extract struct {
+	Runtime   ExtractRuntime `yaml:"runtime"`
+	Image     string         `yaml:"image"`
+	TTL       int            `yaml:"ttl"`
+	Host      string         `yaml:"host"`
+	Network   string         `yaml:"network"`
+	Namespace string         `yaml:"namespace"`
+}
+
+// Scan runs an external scanner on the archive before it leaves the host.
+// The command exits 0 when the archive is clean and 1 when it's rejected,
+// rejected archives are moved to the quarantine dir.
+type Scan struct {
+	Command    Command `yaml:"command"`
+	Quarantine string  `yaml:"quarantine"`
+	Timeout    int     `yaml:"timeout"`
+}
+
+const (
+	HealthSkip  = "skip"
+	HealthDelay = "delay"
+)
+
+// Health lists the target thresholds checked before the dump, on the member the
+// dump reads from. MaxLag is in seconds, zero values disable a check.
+// With the delay action the check is retried every Delay minutes up to Retries times.
+type Health struct {
+	MaxLag         int    `yaml:"maxLag"`
+	Member         string `yaml:"member"`
+	MaxQueue       int64  `yaml:"maxQueue"`
+	MaxConnections int64  `yaml:"maxConnections"`
+	Action         string `yaml:"action"`
+	Delay          int    `yaml:"delay"`
+	Retries        int    `yaml:"retries"`
+}
+
+// Throttle pauses mongodump while MaxSlowOps or more client operations have
+// been running for over MaxLatency milliseconds on the target. Interval is in
+// seconds, MaxPause in minutes bounds a pause so the dump cursors don't time out.
+type Throttle struct {
+	MaxLatency int `yaml:"maxLatency"`
+	MaxSlowOps int `yaml:"maxSlowOps"`
+	Interval   int `yaml:"interval"`
+	MaxPause   int `yaml:"maxPause"`
+}
+
+// Watch is the directory watched in watch mode for dumps made by other tooling,
+// files or mongodump output dirs matching the glob Pattern. A dump is picked up
+// once unchanged for Settle seconds and removed after a successful backup.
+type Watch struct {
+	Path    string `yaml:"path"`
+	Pattern string `yaml:"pattern"`
+	Settle  int    `yaml:"settle"`
+}
+
+// Exec is the command run in exec mode, it prints the path of the artifact
+// it produced, a file or a dir, as the last line of its stdout.
+type Exec struct {
+	Command Command `yaml:"command"`
+}
+
+// Sample limits the documents dumped per collection in sample mode to a
+// percentage of the collection, capped to Limit when set.
+type Sample struct {
+	Percent float64 `yaml:"percent"`
+	Limit   int64   `yaml:"limit"`
+}
+
+// Transform rewrites the exported documents, fields matching a rule are
+// dropped or replaced by their salted sha256. Field paths use dot notation.
+type Transform struct {
+	Salt  string          `yaml:"salt"`
+	Rules []TransformRule `yaml:"rules"`
+}
+
+// TransformRule applies to the collections whose db.collection namespace matches the regex.
+type TransformRule struct {
+	Namespace string   `yaml:"namespace"`
+	Drop      []string `yaml:"drop"`
+	Hash      []string `yaml:"hash"`
+}
+
+// Route sends the databases matching the regex only to the destinations
+// configured in the route, in place of the plan ones.
+type Route struct {
+	Match  string  `yaml:"match"`
+	S3     *S3     `yaml:"s3"`
+	GCloud *GCloud `yaml:"gcloud"`
+	Rclone *Rclone `yaml:"rclone"`
+	Azure  *Azure  `yaml:"azure"`
+	SFTP   *SFTP   `yaml:"sftp"`
+}
+
+// Reconcile schedules the comparison of the catalog with the remote destinations.
+type Reconcile struct {
+	Cron string `yaml:"cron"`
+}
+
+// Verify schedules restores of the latest backup into a disposable target
+// followed by sanity checks of the restored data.
+type Verify struct {
+	Cron string `yaml:"cron"`
+	// Uri of the scratch mongod, its databases are dropped before and after each run
+	Uri     string `yaml:"uri"`
+	KeyFile string `yaml:"keyFile"`
+	Params  string `yaml:"params"`
+	// Timeout in minutes, 0 means no timeout
+	Timeout int `yaml:"timeout"`
+	// MinDocuments fails the verification when fewer documents are restored
+	MinDocuments int64 `yaml:"minDocuments"`
+	// Reports lists the formats of the drill report stored next to the verified archive
+	Reports []string `yaml:"reports"`
+}
+
+// The formats of a restore drill report.
+const (
+	ReportMarkdown = "markdown"
+	ReportHTML     = "html"
+)
+
+// Standby is a cluster every successful backup is restored into.
+type Standby struct {
+	Uri        string      `yaml:"uri"`
+	Namespaces []Namespace `yaml:"namespaces"`
+	NoDrop     bool        `yaml:"noDrop"`
+	KeyFile    string      `yaml:"keyFile"`
+	Params     string      `yaml:"params"`
+}
+
+// Restore is the cluster the restore API loads the plan backups into.
+type Restore struct {
+	Uri        string      `yaml:"uri"`
+	Namespaces []Namespace `yaml:"namespaces"`
+	NoDrop     bool        `yaml:"noDrop"`
+	KeyFile    string      `yaml:"keyFile"`
+	Params     string      `yaml:"params"`
+	// Timeout in minutes, 0 means no timeout
+	Timeout  int             `yaml:"timeout"`
+	Priority RestorePriority `yaml:"priority"`
+	// Bandwidth of the background restores in MB/s, defaults to 10
+	Bandwidth int `yaml:"bandwidth"`
+	// NumParallelCollections is the number of collections mongorestore loads at once, defaults to 4
+	NumParallelCollections int `yaml:"numParallelCollections"`
+	// NumInsertionWorkersPerCollection is the number of insert workers of each collection, defaults to 1
+	NumInsertionWorkersPerCollection int `yaml:"numInsertionWorkersPerCollection"`
+	// BypassDocumentValidation restores the documents the collection validators would reject
+	BypassDocumentValidation bool `yaml:"bypassDocumentValidation"`
+}
+
+// Approval holds the restores of the plan until a second API token approves them.
+type Approval struct {
+	// TTL in minutes of a pending request, defaults to 60
+	TTL int `yaml:"ttl"`
+}
+
+type RestorePriority string
+
+const (
+	RestorePriorityNormal RestorePriority = "normal"
+	// RestorePriorityUrgent holds the scheduled backups until the restore ends
+	RestorePriorityUrgent RestorePriority = "urgent"
+	// RestorePriorityBackground is throttled and paused while backups run
+	RestorePriorityBackground RestorePriority = "background"
+)
+
+// Namespace maps source namespaces to target ones, both accept mongorestore wildcards.
+type Namespace struct {
+	From string `yaml:"from"`
+	To   string `yaml:"to"`
 }
 
 type Encryption struct {
@@ -61,6 +683,26 @@ type Gpg struct {
 	KeyFile    string   `yaml:"keyFile"`
 }
 
+type StageType string
+
+const (
+	StageCompress StageType = "compress"
+	StageEncrypt  StageType = "encrypt"
+	StageChecksum StageType = "checksum"
+	StageSplit    StageType = "split"
+)
+
+// Stage configures one step of the post-dump processing pipeline.
+// Algorithm and Level apply to compress and checksum stages, Size to split.
+type Stage struct {
+	Type      StageType `yaml:"type"`
+	Algorithm string    `yaml:"algorithm"`
+	Level     int       `yaml:"level"`
+	Size      string    `yaml:"size"`
+	// Threads > 1 compresses gzip in parallel with pigz
+	Threads int `yaml:"threads"`
+}
+
 type S3 struct {
 	Bucket        string `yaml:"bucket"`
 	AccessKey     string `yaml:"accessKey"`
@@ -70,7 +712,7 @@ type S3 struct {
 	KmsKeyId      string `yaml:"kmsKeyId"`
 	Prefix        string `yaml:"prefix"`
 	AddDatePrefix bool   `yaml:"addDatePrefix"`
-	StorageClass  string `yaml:"storageClass" validate:"omitempty,oneof=STANDARD REDUCED_REDUNDANCY STANDARD_IA ONE-ZONE_IA INTELLIGENT_TIERING GLACIER DEEP_ARCHIVE`
+	StorageClass  string `yaml:"storageClass" validate:"omitempty,oneof=STANDARD REDUCED_REDUNDANCY STANDARD_IA ONE-ZONE_IA INTELLIGENT_TIERING GLACIER DEEP_ARCHIVE"`
 }
 
 type GCloud struct {
@@ -89,6 +731,26 @@ type Azure struct {
 	ConnectionString string `yaml:"connectionString"`
 }
 
+// Executor runs the dump on another host, the archive is streamed back and
+// stored, uploaded and rotated here.
+type Executor struct {
+	SSH *SSHExecutor `yaml:"ssh"`
+}
+
+// SSHExecutor runs mongodump on Host over ssh, Mongodump is the path of the
+// remote binary and defaults to mongodump. The host key is checked against
+// the KnownHosts file when set.
+type SSHExecutor struct {
+	Host       string `yaml:"host"`
+	Port       int    `yaml:"port"`
+	Username   string `yaml:"username"`
+	Password   string `yaml:"password"`
+	PrivateKey string `yaml:"privateKey"`
+	Passphrase string `yaml:"passphrase"`
+	KnownHosts string `yaml:"knownHosts"`
+	Mongodump  string `yaml:"mongodump"`
+}
+
 type SFTP struct {
 	Dir        string `yaml:"dir"`
 	Host       string `yaml:"host"`
@@ -115,6 +777,32 @@ type Slack struct {
 	WarnOnly bool   `yaml:"warnOnly"`
 }
 
+// Escalation widens the failure notifications of a plan that keeps failing:
+// Slack on every failure, Email from its After-th consecutive failure and
+// Webhook once when no backup succeeded for After hours.
+type Escalation struct {
+	Email   *EscalationEmail   `yaml:"email"`
+	Webhook *EscalationWebhook `yaml:"webhook"`
+}
+
+// EscalationEmail is sent through the smtp server of the plan, After defaults to 3.
+type EscalationEmail struct {
+	After int      `yaml:"after"`
+	To    []string `yaml:"to"`
+}
+
+// EscalationWebhook posts the form Params along with the message to URL,
+// e.g. the Twilio messages or calls API. After defaults to 6 hours.
+type EscalationWebhook struct {
+	After    int               `yaml:"after"`
+	URL      string            `yaml:"url"`
+	Username string            `yaml:"username"`
+	Password string            `yaml:"password"`
+	Params   map[string]string `yaml:"params"`
+	// MessageParam is the form field of the message, defaults to Body
+	MessageParam string `yaml:"messageParam"`
+}
+
 func LoadPlan(dir string, name string) (Plan, error) {
 	plan := Plan{}
 	planPath := ""
@@ -143,10 +831,66 @@ func LoadPlan(dir string, name string) (Plan, error) {
 	}
 	_, filename := filepath.Split(planPath)
 	plan.Name = strings.TrimSuffix(filename, filepath.Ext(filename))
+	if err := scopeTenant(&plan); err != nil {
+		return plan, err
+	}
+	if err := checkTuning(plan); err != nil {
+		return plan, err
+	}
+	if err := checkRetries(plan); err != nil {
+		return plan, err
+	}
 
 	return plan, nil
 }
 
+var planName = regexp.MustCompile(`^[a-zA-Z0-9_-]+$`)
+
+// ParsePlan decodes the yaml of the plan named name, unknown fields are rejected.
+func ParsePlan(name string, data []byte) (Plan, error) {
+	plan := Plan{}
+	if !planName.MatchString(name) {
+		return plan, errors.Errorf("Invalid plan name %v", name)
+	}
+	if err := yaml.UnmarshalStrict(data, &plan); err != nil {
+		return plan, errors.Wrapf(err, "Parsing plan %v failed", name)
+	}
+	plan.Name = name
+	if err := scopeTenant(&plan); err != nil {
+		return plan, err
+	}
+	if err := checkTuning(plan); err != nil {
+		return plan, err
+	}
+	if err := checkRetries(plan); err != nil {
+		return plan, err
+	}
+	return plan, nil
+}
+
+// SavePlan writes the plan yaml to dir, replacing the file of an existing plan.
+func SavePlan(dir string, name string, data []byte) error {
+	if !planName.MatchString(name) {
+		return errors.Errorf("Invalid plan name %v", name)
+	}
+
+	planPath := filepath.Join(dir, name+".yml")
+	if _, err := os.Stat(filepath.Join(dir, name+".yaml")); err == nil {
+		planPath = filepath.Join(dir, name+".yaml")
+	}
+	// write aside and rename so a concurrent load never reads a partial plan
+	tmp := filepath.Join(dir, "."+name+".tmp")
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return errors.Wrapf(err, "Writing %v failed", tmp)
+	}
+	if err := os.Rename(tmp, planPath); err != nil {
+		os.Remove(tmp)
+		return errors.Wrapf(err, "Writing %v failed", planPath)
+	}
+
+	return nil
+}
+
 func LoadPlans(dir string) ([]Plan, error) {
 	files := []string{}
 	err := filepath.Walk(dir, func(path string, f os.FileInfo, err error) error {
@@ -174,6 +918,15 @@ func LoadPlans(dir string) ([]Plan, error) {
 		}
 		_, filename := filepath.Split(path)
 		plan.Name = strings.TrimSuffix(filename, filepath.Ext(filename))
+		if err := scopeTenant(&plan); err != nil {
+			return nil, err
+		}
+		if err := checkTuning(plan); err != nil {
+			return nil, err
+		}
+		if err := checkRetries(plan); err != nil {
+			return nil, err
+		}
 
 		duplicate := false
 		for _, p := range plans {
@@ -195,3 +948,36 @@ func LoadPlans(dir string) ([]Plan, error) {
 
 	return plans, nil
 }
+
+// SplitParams splits the extra tool params of a plan into arguments, single
+// and double quotes group words the way a shell would, without expansions.
+func SplitParams(params string) []string {
+	args := make([]string, 0)
+	var arg strings.Builder
+	inArg := false
+	var quote rune
+	for _, r := range params {
+		switch {
+		case quote != 0 && r == quote:
+			quote = 0
+		case quote != 0:
+			arg.WriteRune(r)
+		case r == '\'' || r == '"':
+			quote = r
+			inArg = true
+		case r == ' ' || r == '\t' || r == '\n':
+			if inArg {
+				args = append(args, arg.String())
+				arg.Reset()
+				inArg = false
+			}
+		default:
+			arg.WriteRune(r)
+			inArg = true
+		}
+	}
+	if inArg {
+		args = append(args, arg.String())
+	}
+	return args
+}
@@ -0,0 +1,53 @@
+package config
+
+import (
+	"io/ioutil"
+	"strings"
+
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v2"
+)
+
+// Pricing is the storage price of the destinations in $ per GB-month, keyed
+// by destination (local, sftp, s3, gcloud, azure, rclone) or by destination
+// and storage class, e.g. s3/GLACIER.
+type Pricing map[string]float64
+
+// LoadPricing reads the pricing file, it must live outside of the config dir
+// where every yaml file is loaded as a plan.
+func LoadPricing(file string) (Pricing, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Reading %v failed", file)
+	}
+	prices := map[string]float64{}
+	if err := yaml.UnmarshalStrict(data, &prices); err != nil {
+		return nil, errors.Wrapf(err, "Parsing %v failed", file)
+	}
+	p := Pricing{}
+	for key, price := range prices {
+		if price < 0 {
+			return nil, errors.Errorf("Negative price of %v in %v", key, file)
+		}
+		// destination names are case insensitive, storage classes are not
+		dest, class := key, ""
+		if i := strings.Index(key, "/"); i >= 0 {
+			dest, class = key[:i], key[i:]
+		}
+		p[strings.ToLower(dest)+class] = price
+	}
+	return p, nil
+}
+
+// Price returns the price of the storage class at destination, or the
+// destination price when the class has none.
+func (p Pricing) Price(destination string, class string) (float64, bool) {
+	destination = strings.ToLower(destination)
+	if class != "" {
+		if price, ok := p[destination+"/"+class]; ok {
+			return price, true
+		}
+	}
+	price, ok := p[destination]
+	return price, ok
+}
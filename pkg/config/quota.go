@@ -0,0 +1,31 @@
+package config
+
+import (
+	"github.com/dustin/go-humanize"
+	"github.com/pkg/errors"
+)
+
+// ByteSize is a size in human format e.g. 10GB, parsed when the plan is loaded.
+type ByteSize uint64
+
+// UnmarshalYAML parses a human size or a number of bytes.
+func (b *ByteSize) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var s string
+	if err := unmarshal(&s); err != nil {
+		return err
+	}
+	if s == "" {
+		*b = 0
+		return nil
+	}
+	n, err := humanize.ParseBytes(s)
+	if err != nil {
+		return errors.Wrapf(err, "invalid size '%s'", s)
+	}
+	*b = ByteSize(n)
+	return nil
+}
+
+func (b ByteSize) String() string {
+	return humanize.Bytes(uint64(b))
+}
@@ -0,0 +1,44 @@
+package config
+
+import (
+	"testing"
+
+	"gopkg.in/yaml.v2"
+)
+
+func TestParsePlanQuota(t *testing.T) {
+	tests := []struct {
+		yaml    string
+		tmp     ByteSize
+		storage ByteSize
+		ok      bool
+	}{
+		{"quota:\n  tmp: 20GB\n  storage: 200GB\n", 20e9, 200e9, true},
+		{"quota:\n  storage: 1.5 GiB\n", 0, 1536 << 20, true},
+		{"quota:\n  tmp: 1048576\n", 1 << 20, 0, true},
+		{"quota:\n  tmp: 20GiBs\n", 0, 0, false},
+		{"quota:\n  storage: lots\n", 0, 0, false},
+	}
+	for _, tt := range tests {
+		plan, err := ParsePlan("quota", []byte(tt.yaml))
+		if (err == nil) != tt.ok {
+			t.Errorf("ParsePlan(%q) error %v, want ok %v", tt.yaml, err, tt.ok)
+			continue
+		}
+		if !tt.ok {
+			continue
+		}
+		if plan.Quota.Tmp != tt.tmp || plan.Quota.Storage != tt.storage {
+			t.Errorf("ParsePlan(%q) quota = %v, %v, want %v, %v", tt.yaml, plan.Quota.Tmp, plan.Quota.Storage, tt.tmp, tt.storage)
+		}
+		// the bundles write the parsed plans back to yaml
+		data, err := yaml.Marshal(plan.Quota)
+		var back Quota
+		if err == nil {
+			err = yaml.UnmarshalStrict(data, &back)
+		}
+		if err != nil || back != *plan.Quota {
+			t.Errorf("yaml round trip of %q = %v %v", tt.yaml, back, err)
+		}
+	}
+}
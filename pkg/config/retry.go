@@ -0,0 +1,20 @@
+package config
+
+import (
+	"github.com/pkg/errors"
+)
+
+// MaxRetries bounds scheduler.retries.
+const MaxRetries = 10
+
+// checkRetries rejects the negative or absurd retry settings of plan.
+func checkRetries(plan Plan) error {
+	s := plan.Scheduler
+	if s.Retries < 0 || s.Retries > MaxRetries {
+		return errors.Errorf("invalid retries %v for plan %v, use 0 to %v", s.Retries, plan.Name, MaxRetries)
+	}
+	if s.RetryBackoff < 0 {
+		return errors.Errorf("invalid retryBackoff %v for plan %v, it can't be negative", s.RetryBackoff, plan.Name)
+	}
+	return nil
+}
@@ -0,0 +1,24 @@
+package config
+
+import (
+	"testing"
+)
+
+func TestParsePlanRetries(t *testing.T) {
+	tests := []struct {
+		yaml string
+		ok   bool
+	}{
+		{"scheduler:\n  cron: '0 * * * *'\n  retries: 3\n  retryBackoff: 30\n", true},
+		{"scheduler:\n  cron: '0 * * * *'\n  retries: 10\n", true},
+		{"scheduler:\n  cron: '0 * * * *'\n  retries: 1000\n", false},
+		{"scheduler:\n  cron: '0 * * * *'\n  retries: -1\n", false},
+		{"scheduler:\n  cron: '0 * * * *'\n  retries: 2\n  retryBackoff: -5\n", false},
+	}
+	for _, tt := range tests {
+		_, err := ParsePlan("retries", []byte(tt.yaml))
+		if (err == nil) != tt.ok {
+			t.Errorf("ParsePlan(%q) error %v, want ok %v", tt.yaml, err, tt.ok)
+		}
+	}
+}
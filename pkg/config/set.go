@@ -0,0 +1,58 @@
+package config
+
+import (
+	"io/ioutil"
+
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v2"
+)
+
+// BackupSet triggers its plans together, between the Pre and Post hooks,
+// and records their runs under one set run.
+type BackupSet struct {
+	Plans []string `yaml:"plans"`
+	// Cron schedules the set (optional), the plans keep their own schedule
+	Cron string `yaml:"cron"`
+	// Pre quiesces the application before the plans start, the set fails when it fails
+	Pre Command `yaml:"pre"`
+	// Post runs once the plans returned, also after a failure
+	Post Command `yaml:"post"`
+	// Timeout of each hook in minutes, defaults to 10
+	Timeout int `yaml:"timeout"`
+}
+
+// Sets are the backup sets by name.
+type Sets map[string]BackupSet
+
+// LoadSets reads the backup sets file, it must live outside of the config dir
+// where every yaml file is loaded as a plan. A set can't have more plans than
+// maxConcurrent backups run at once, its plans start together.
+func LoadSets(file string, maxConcurrent int) (Sets, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Reading %v failed", file)
+	}
+	sets := Sets{}
+	if err := yaml.UnmarshalStrict(data, &sets); err != nil {
+		return nil, errors.Wrapf(err, "Parsing %v failed", file)
+	}
+	for name, set := range sets {
+		if !planName.MatchString(name) {
+			return nil, errors.Errorf("Invalid backup set name %v", name)
+		}
+		if len(set.Plans) == 0 {
+			return nil, errors.Errorf("Backup set %v has no plans", name)
+		}
+		if maxConcurrent > 0 && len(set.Plans) > maxConcurrent {
+			return nil, errors.Errorf("Backup set %v has %v plans, over the %v concurrent backups", name, len(set.Plans), maxConcurrent)
+		}
+		seen := map[string]bool{}
+		for _, plan := range set.Plans {
+			if seen[plan] {
+				return nil, errors.Errorf("Backup set %v lists plan %v twice", name, plan)
+			}
+			seen[plan] = true
+		}
+	}
+	return sets, nil
+}
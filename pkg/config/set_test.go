@@ -0,0 +1,35 @@
+package config
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLoadSetsMaxConcurrent(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mgob-sets-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "sets.yml")
+	if err := ioutil.WriteFile(file, []byte("app:\n  plans: [users, orders, billing]\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		max int
+		ok  bool
+	}{
+		{0, true},
+		{3, true},
+		{2, false},
+	}
+	for _, tt := range tests {
+		_, err := LoadSets(file, tt.max)
+		if (err == nil) != tt.ok {
+			t.Errorf("LoadSets with %v concurrent backups error %v, want ok %v", tt.max, err, tt.ok)
+		}
+	}
+}
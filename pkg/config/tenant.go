@@ -0,0 +1,105 @@
+package config
+
+import (
+	"crypto/subtle"
+	"io/ioutil"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v2"
+)
+
+var tenantName = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]*$`)
+
+// Tenants holds the API tokens, admin tokens see and manage every plan, a
+// tenant token only the plans of its tenant.
+type Tenants struct {
+	Admin   []string            `yaml:"admin"`
+	Tenants map[string][]string `yaml:"tenants"`
+}
+
+// LoadTenants reads the tenants file, it must live outside of the config dir
+// where every yaml file is loaded as a plan.
+func LoadTenants(file string) (*Tenants, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Reading %v failed", file)
+	}
+	t := &Tenants{}
+	if err := yaml.UnmarshalStrict(data, t); err != nil {
+		return nil, errors.Wrapf(err, "Parsing %v failed", file)
+	}
+	if len(t.Admin) == 0 {
+		return nil, errors.Errorf("%v has no admin token", file)
+	}
+	for name, tokens := range t.Tenants {
+		if !tenantName.MatchString(name) {
+			return nil, errors.Errorf("Invalid tenant name %v in %v", name, file)
+		}
+		if len(tokens) == 0 {
+			return nil, errors.Errorf("Tenant %v has no token in %v", name, file)
+		}
+	}
+	return t, nil
+}
+
+// Authenticate returns the tenant of token, blank with admin true for an admin token.
+// Every token is compared in constant time.
+func (t *Tenants) Authenticate(token string) (tenant string, admin bool, ok bool) {
+	if token == "" {
+		return "", false, false
+	}
+	for _, a := range t.Admin {
+		if subtle.ConstantTimeCompare([]byte(a), []byte(token)) == 1 {
+			admin, ok = true, true
+		}
+	}
+	for name, tokens := range t.Tenants {
+		for _, tk := range tokens {
+			if subtle.ConstantTimeCompare([]byte(tk), []byte(token)) == 1 && !ok {
+				tenant, ok = name, true
+			}
+		}
+	}
+	return tenant, admin, ok
+}
+
+// PlanDir is the local dir of the plan archives, in the tenant dir when the plan has one.
+func PlanDir(storagePath string, plan Plan) string {
+	return filepath.Join(storagePath, plan.Tenant, plan.Name)
+}
+
+// scopeTenant moves the remote destinations of a tenant plan under the
+// tenant prefix, the local storage is scoped by PlanDir. The Azure blob
+// names already hold the local path.
+func scopeTenant(plan *Plan) error {
+	if plan.Tenant == "" {
+		return nil
+	}
+	if !tenantName.MatchString(plan.Tenant) {
+		return errors.Errorf("Invalid tenant name %v in plan %v", plan.Tenant, plan.Name)
+	}
+	scope := func(s3 *S3, gcloud *GCloud, rclone *Rclone, sftp *SFTP) {
+		if s3 != nil {
+			s3.Prefix = plan.Tenant + "/" + s3.Prefix
+		}
+		if gcloud != nil {
+			gcloud.Bucket = strings.TrimSuffix(gcloud.Bucket, "/") + "/" + plan.Tenant
+		}
+		if rclone != nil {
+			rclone.Bucket = strings.TrimSuffix(rclone.Bucket, "/") + "/" + plan.Tenant
+		}
+		if sftp != nil {
+			sftp.Dir = path.Join(sftp.Dir, plan.Tenant)
+		}
+	}
+	scope(plan.S3, plan.GCloud, plan.Rclone, plan.SFTP)
+	for i := range plan.Routes {
+		r := &plan.Routes[i]
+		scope(r.S3, r.GCloud, r.Rclone, r.SFTP)
+	}
+	return nil
+}
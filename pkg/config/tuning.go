@@ -0,0 +1,113 @@
+package config
+
+import (
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// dumpFlags are the mongodump flags set by the typed target fields, by field.
+var dumpFlags = []struct {
+	field string
+	flags []string
+	set   func(t Target) bool
+}{
+	{"readConcern", []string{"--readConcern"}, func(t Target) bool { return t.ReadConcern != "" }},
+	{"forceTableScan", []string{"--forceTableScan"}, func(t Target) bool { return t.ForceTableScan }},
+	{"numParallelCollections", []string{"--numParallelCollections", "-j"}, func(t Target) bool { return t.NumParallelCollections != 0 }},
+	{"viewsAsCollections", []string{"--viewsAsCollections"}, func(t Target) bool { return t.ViewsAsCollections }},
+	{"dumpDbUsersAndRoles", []string{"--dumpDbUsersAndRoles"}, func(t Target) bool { return t.DumpDbUsersAndRoles }},
+	{"excludeCollectionsWithPrefix", []string{"--excludeCollectionsWithPrefix"}, func(t Target) bool { return len(t.ExcludeCollectionsWithPrefix) > 0 }},
+}
+
+// restoreFlags are the mongorestore flags set by the typed restore fields.
+var restoreFlags = []struct {
+	field string
+	flags []string
+	set   func(r Restore) bool
+}{
+	{"numParallelCollections", []string{"--numParallelCollections", "-j"}, func(r Restore) bool { return r.NumParallelCollections != 0 }},
+	{"numInsertionWorkersPerCollection", []string{"--numInsertionWorkersPerCollection"}, func(r Restore) bool { return r.NumInsertionWorkersPerCollection != 0 }},
+	{"bypassDocumentValidation", []string{"--bypassDocumentValidation"}, func(r Restore) bool { return r.BypassDocumentValidation }},
+}
+
+// hasFlag tells if params set one of flags, as --flag, --flag=value or -j4.
+func hasFlag(params []string, flags []string) bool {
+	for _, p := range params {
+		for _, f := range flags {
+			if p == f || strings.HasPrefix(p, f+"=") || (len(f) == 2 && strings.HasPrefix(p, f)) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// checkTuning validates the typed mongodump and mongorestore options of plan,
+// they can't be set in params as well.
+func checkTuning(plan Plan) error {
+	t := plan.Target
+	if t.NumParallelCollections < 0 {
+		return errors.Errorf("Invalid target.numParallelCollections %v in plan %v", t.NumParallelCollections, plan.Name)
+	}
+	if t.DumpDbUsersAndRoles && t.Database == "" && plan.Mode != BackupModeDatabase {
+		return errors.Errorf("target.dumpDbUsersAndRoles requires target.database or '%s' backup mode in plan %v", BackupModeDatabase, plan.Name)
+	}
+	if err := checkReadConcern(plan); err != nil {
+		return errors.Wrapf(err, "Invalid target of plan %v", plan.Name)
+	}
+	tuned := t.NumParallelCollections != 0 || t.ViewsAsCollections || t.DumpDbUsersAndRoles || len(t.ExcludeCollectionsWithPrefix) > 0
+	switch plan.Mode {
+	case "", BackupModeSingle, BackupModeDatabase, BackupModeSharded, BackupModeMigrate:
+	default:
+		if tuned {
+			return errors.Errorf("the mongodump options of plan %v can't be used with '%s' backup mode", plan.Name, plan.Mode)
+		}
+	}
+	params := SplitParams(t.Params)
+	for _, f := range dumpFlags {
+		if f.set(t) && hasFlag(params, f.flags) {
+			return errors.Errorf("%v is set in both target.%v and target.params of plan %v", f.flags[0], f.field, plan.Name)
+		}
+	}
+
+	if r := plan.Restore; r != nil {
+		if r.NumParallelCollections < 0 || r.NumInsertionWorkersPerCollection < 0 {
+			return errors.Errorf("Invalid restore workers in plan %v", plan.Name)
+		}
+		params := SplitParams(r.Params)
+		for _, f := range restoreFlags {
+			if f.set(*r) && hasFlag(params, f.flags) {
+				return errors.Errorf("%v is set in both restore.%v and restore.params of plan %v", f.flags[0], f.field, plan.Name)
+			}
+		}
+	}
+	return nil
+}
+
+// checkReadConcern validates the read concern and table scan options against
+// the backup mode.
+func checkReadConcern(plan Plan) error {
+	t := plan.Target
+	if t.ReadConcern == "" && !t.ForceTableScan {
+		return nil
+	}
+	switch t.ReadConcern {
+	case "", "local", "available", "majority":
+	default:
+		return errors.Errorf("unsupported read concern '%s', use local, available or majority", t.ReadConcern)
+	}
+	switch plan.Mode {
+	case "", BackupModeSingle, BackupModeDatabase, BackupModeSharded, BackupModeMigrate:
+	case BackupModeSample, BackupModeMetadata, BackupModeExport:
+		if t.ReadConcern != "" && plan.Mode == BackupModeExport {
+			return errors.New("mongoexport has no readConcern option")
+		}
+		if t.ForceTableScan && plan.Mode != BackupModeExport {
+			return errors.Errorf("forceTableScan can't be used with '%s' backup mode", plan.Mode)
+		}
+	default:
+		return errors.Errorf("readConcern and forceTableScan can't be used with '%s' backup mode", plan.Mode)
+	}
+	return nil
+}
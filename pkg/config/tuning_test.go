@@ -0,0 +1,25 @@
+package config
+
+import (
+	"testing"
+)
+
+func TestParsePlanReadConcern(t *testing.T) {
+	tests := []struct {
+		yaml string
+		ok   bool
+	}{
+		{"target:\n  readConcern: majority\n", true},
+		{"target:\n  readConcern: snapshot\n", false},
+		{"target:\n  forceTableScan: true\n", true},
+		{"mode: sample\ntarget:\n  readConcern: local\n", true},
+		{"mode: sample\ntarget:\n  forceTableScan: true\n", false},
+		{"mode: export\ntarget:\n  readConcern: majority\n", false},
+	}
+	for _, tt := range tests {
+		_, err := ParsePlan("read-concern", []byte("scheduler:\n  cron: '0 * * * *'\n"+tt.yaml))
+		if (err == nil) != tt.ok {
+			t.Errorf("ParsePlan(%q) error %v, want ok %v", tt.yaml, err, tt.ok)
+		}
+	}
+}
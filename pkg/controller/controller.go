@@ -0,0 +1,271 @@
+package controller
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/stefanprodan/mgob/pkg/clock"
+	"github.com/stefanprodan/mgob/pkg/db"
+)
+
+// requestTimeout bounds each call to a remote instance.
+var requestTimeout = 10 * time.Second
+
+// InstanceStatus is the scheduler status reported by a remote instance.
+type InstanceStatus struct {
+	Instance string       `json:"instance"`
+	URL      string       `json:"url"`
+	Up       bool         `json:"up"`
+	Error    string       `json:"error,omitempty"`
+	Plans    []*db.Status `json:"plans"`
+}
+
+// Controller keeps the registry of remote mgob instances, distributes plans
+// to them and aggregates their status and metrics.
+type Controller struct {
+	store  *db.InstanceStore
+	client *http.Client
+}
+
+func New(store *db.InstanceStore) *Controller {
+	return &Controller{store: store, client: &http.Client{Timeout: requestTimeout}}
+}
+
+// Register adds or updates the instance served at rawurl, token is sent as
+// bearer on every request to it and an empty token keeps the registered one.
+func (c *Controller) Register(name string, rawurl string, token string) (*db.Instance, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, errors.Errorf("Invalid instance url %v", rawurl)
+	}
+	i, err := c.store.Get(name)
+	if err != nil {
+		return nil, err
+	}
+	if i == nil {
+		i = &db.Instance{Name: name, Plans: make([]string, 0), Registered: clock.Now().UTC()}
+	}
+	i.URL = strings.TrimSuffix(u.String(), "/")
+	if token != "" {
+		i.Token = token
+	}
+	return i, c.store.Put(i)
+}
+
+// Remove unregisters an instance, its plans keep running on it.
+func (c *Controller) Remove(name string) (bool, error) {
+	i, err := c.store.Get(name)
+	if err != nil || i == nil {
+		return false, err
+	}
+	return true, c.store.Delete(name)
+}
+
+func (c *Controller) Instances() ([]*db.Instance, error) {
+	return c.store.GetAll()
+}
+
+// Distribute sends the plan yaml to the instance, which saves and schedules it.
+func (c *Controller) Distribute(ctx context.Context, name string, plan string, data []byte) error {
+	i, err := c.store.Get(name)
+	if err != nil {
+		return err
+	}
+	if i == nil {
+		return errors.Errorf("Instance %v not found", name)
+	}
+
+	req, err := newRequest(ctx, "PUT", i, "/plans/"+url.PathEscape(plan), bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-yaml")
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return errors.Wrapf(err, "Sending plan %v to %v failed", plan, name)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		var body struct {
+			Error string `json:"error"`
+		}
+		json.NewDecoder(resp.Body).Decode(&body)
+		return errors.Errorf("Instance %v rejected plan %v: %v %v", name, plan, resp.Status, body.Error)
+	}
+
+	for _, p := range i.Plans {
+		if p == plan {
+			return nil
+		}
+	}
+	i.Plans = append(i.Plans, plan)
+	sort.Strings(i.Plans)
+	return c.store.Put(i)
+}
+
+// Status queries all instances concurrently, unreachable ones are reported down.
+func (c *Controller) Status(ctx context.Context) ([]InstanceStatus, error) {
+	instances, err := c.store.GetAll()
+	if err != nil {
+		return nil, err
+	}
+
+	list := make([]InstanceStatus, len(instances))
+	var wg sync.WaitGroup
+	for n, i := range instances {
+		wg.Add(1)
+		go func(n int, i *db.Instance) {
+			defer wg.Done()
+			s := InstanceStatus{Instance: i.Name, URL: i.URL, Plans: make([]*db.Status, 0)}
+			body, err := c.get(ctx, i, "/status")
+			if err == nil {
+				err = json.Unmarshal(body, &s.Plans)
+			}
+			if err != nil {
+				s.Error = err.Error()
+			} else {
+				s.Up = true
+			}
+			list[n] = s
+		}(n, i)
+	}
+	wg.Wait()
+
+	return list, nil
+}
+
+// Metrics writes the Prometheus metrics of all instances to w, every sample
+// gets a mgob_instance label and each family is written once.
+func (c *Controller) Metrics(ctx context.Context, w io.Writer) error {
+	instances, err := c.store.GetAll()
+	if err != nil {
+		return err
+	}
+
+	bodies := make([][]byte, len(instances))
+	var wg sync.WaitGroup
+	for n, i := range instances {
+		wg.Add(1)
+		go func(n int, i *db.Instance) {
+			defer wg.Done()
+			bodies[n], _ = c.get(ctx, i, "/metrics")
+		}(n, i)
+	}
+	wg.Wait()
+
+	// samples are grouped by family as the exposition format requires
+	families := make([]string, 0)
+	headers := make(map[string][]string)
+	samples := make(map[string][]string)
+	for n, body := range bodies {
+		up := 0
+		if body != nil {
+			up = 1
+		}
+		fmt.Fprintf(w, "mgob_instance_up{mgob_instance=%q} %v\n", instances[n].Name, up)
+
+		family := ""
+		s := bufio.NewScanner(bytes.NewReader(body))
+		for s.Scan() {
+			line := s.Text()
+			if line == "" {
+				continue
+			}
+			if strings.HasPrefix(line, "# HELP ") || strings.HasPrefix(line, "# TYPE ") {
+				family = strings.Fields(line)[2]
+				if _, ok := headers[family]; !ok {
+					families = append(families, family)
+					headers[family] = make([]string, 0, 2)
+				}
+				if len(headers[family]) < 2 && !contains(headers[family], line) {
+					headers[family] = append(headers[family], line)
+				}
+				continue
+			}
+			if strings.HasPrefix(line, "#") {
+				continue
+			}
+			if _, ok := headers[family]; !ok {
+				families = append(families, family)
+				headers[family] = make([]string, 0)
+			}
+			samples[family] = append(samples[family], withInstance(line, instances[n].Name))
+		}
+	}
+
+	for _, f := range families {
+		for _, line := range headers[f] {
+			fmt.Fprintln(w, line)
+		}
+		for _, line := range samples[f] {
+			fmt.Fprintln(w, line)
+		}
+	}
+	return nil
+}
+
+// withInstance adds the mgob_instance label to a sample line.
+func withInstance(line string, instance string) string {
+	label := fmt.Sprintf("mgob_instance=%q", instance)
+	if i := strings.Index(line, "{"); i >= 0 && i < strings.Index(line, " ") {
+		if strings.HasPrefix(line[i:], "{}") {
+			return line[:i+1] + label + line[i+1:]
+		}
+		return line[:i+1] + label + "," + line[i+1:]
+	}
+	i := strings.Index(line, " ")
+	if i < 0 {
+		return line
+	}
+	return line[:i] + "{" + label + "}" + line[i:]
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// newRequest builds a request to the instance with its bearer token.
+func newRequest(ctx context.Context, method string, i *db.Instance, path string, body io.Reader) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, method, i.URL+path, body)
+	if err != nil {
+		return nil, err
+	}
+	if i.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+i.Token)
+	}
+	return req, nil
+}
+
+func (c *Controller) get(ctx context.Context, i *db.Instance, path string) ([]byte, error) {
+	req, err := newRequest(ctx, "GET", i, path, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.Errorf("%v responded %v", i.URL+path, resp.Status)
+	}
+	return ioutil.ReadAll(resp.Body)
+}
@@ -0,0 +1,85 @@
+package controller
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stefanprodan/mgob/pkg/db"
+)
+
+func newTestController(t *testing.T) *Controller {
+	dir, err := ioutil.TempDir("", "mgob-controller-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	store, err := db.Open(filepath.Join(dir, "mgob.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { store.Close() })
+	instances, err := db.NewInstanceStore(store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return New(instances)
+}
+
+func TestInstanceToken(t *testing.T) {
+	var mu sync.Mutex
+	seen := make(map[string]string)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		seen[r.Method+" "+r.URL.Path] = r.Header.Get("Authorization")
+		mu.Unlock()
+		if r.Header.Get("Authorization") != "Bearer secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if r.URL.Path == "/status" {
+			w.Write([]byte("[]"))
+		}
+	}))
+	defer srv.Close()
+
+	c := newTestController(t)
+	if _, err := c.Register("eu", srv.URL, "secret"); err != nil {
+		t.Fatal(err)
+	}
+	// registering again without a token keeps the stored one
+	if _, err := c.Register("eu", srv.URL+"/", ""); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	if err := c.Distribute(ctx, "eu", "mongo-eu", []byte("target: {}")); err != nil {
+		t.Fatal(err)
+	}
+	list, err := c.Status(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 1 || !list[0].Up {
+		t.Fatalf("status %+v, want eu up", list)
+	}
+	var buf strings.Builder
+	if err := c.Metrics(ctx, &buf); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(buf.String(), `mgob_instance_up{mgob_instance="eu"} 1`) {
+		t.Errorf("metrics %q, want eu up", buf.String())
+	}
+
+	for _, req := range []string{"PUT /plans/mongo-eu", "GET /status", "GET /metrics"} {
+		if seen[req] != "Bearer secret" {
+			t.Errorf("%v sent Authorization %q", req, seen[req])
+		}
+	}
+}
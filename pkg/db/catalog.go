@@ -0,0 +1,187 @@
+package db
+
+import (
+	"bytes"
+	"encoding/json"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/pkg/errors"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Artifact is a backup file recorded in the catalog.
+type Artifact struct {
+	Plan         string    `json:"plan"`
+	Name         string    `json:"name"`
+	Size         int64     `json:"size"`
+	Checksum     string    `json:"checksum,omitempty"`
+	Timestamp    time.Time `json:"timestamp"`
+	Route        string    `json:"route,omitempty"`
+	Chain        string    `json:"chain,omitempty"`
+	Seq          int       `json:"seq,omitempty"`
+	Destinations []string  `json:"destinations"`
+	// Oplog is set on the oplog segments of a chain
+	Oplog *OplogRange `json:"oplog,omitempty"`
+	// Completed is when the run of a full backup ended, an oplog dump is only consistent as of then
+	Completed *time.Time `json:"completed,omitempty"`
+	// Recipients is set once the archive was re-encrypted for these gpg recipients
+	Recipients []string `json:"recipients,omitempty"`
+	// Pending are the destinations the archive is queued for until a probe finds them up
+	Pending []string `json:"pending,omitempty"`
+	// Usage is the resources the run that produced the archive used, by stage
+	Usage map[string]Usage `json:"usage,omitempty"`
+	// VolumeSnapshot is set on the records of the csi mode
+	VolumeSnapshot *VolumeSnapshot `json:"volumeSnapshot,omitempty"`
+	// DiskSnapshots are set on the records of the disk mode
+	DiskSnapshots []DiskSnapshot `json:"diskSnapshots,omitempty"`
+	// AtlasSnapshot is set on the records of the atlas mode
+	AtlasSnapshot *AtlasSnapshot `json:"atlasSnapshot,omitempty"`
+}
+
+// AtlasSnapshot is an on-demand Atlas snapshot and its export.
+type AtlasSnapshot struct {
+	GroupID string `json:"groupId"`
+	Cluster string `json:"cluster"`
+	ID      string `json:"id"`
+	// ExportID and ExportPrefix are set when the snapshot was exported to an S3 bucket
+	ExportID     string `json:"exportId,omitempty"`
+	ExportPrefix string `json:"exportPrefix,omitempty"`
+}
+
+// DiskSnapshot is a snapshot of a cloud volume.
+type DiskSnapshot struct {
+	Provider string `json:"provider"`
+	Volume   string `json:"volume"`
+	// ID is the snapshot id of the provider, the snapshot name on gcloud
+	ID string `json:"id"`
+}
+
+// VolumeSnapshot is a Kubernetes VolumeSnapshot and the storage snapshot it's bound to.
+type VolumeSnapshot struct {
+	Namespace string `json:"namespace"`
+	Name      string `json:"name"`
+	PVC       string `json:"pvc"`
+	Content   string `json:"content"`
+	// Handle is the snapshot id of the storage provider
+	Handle      string `json:"handle"`
+	RestoreSize string `json:"restoreSize,omitempty"`
+}
+
+// Usage is the resources used by the child processes of a run stage.
+type Usage struct {
+	// CPU is the user and system time in seconds
+	CPU float64 `json:"cpu"`
+	// MaxRSS is the peak resident set size of the largest process in bytes
+	MaxRSS     int64 `json:"maxRss"`
+	ReadBytes  int64 `json:"readBytes"`
+	WriteBytes int64 `json:"writeBytes"`
+	// NetBytes are the bytes the dump received or the uploads sent
+	NetBytes  int64 `json:"netBytes"`
+	Processes int   `json:"processes"`
+}
+
+// OplogRange is the oplog interval an incremental segment holds, From excluded.
+type OplogRange struct {
+	From primitive.Timestamp `json:"from"`
+	To   primitive.Timestamp `json:"to"`
+}
+
+type CatalogStore struct {
+	*Store
+	bucket []byte
+}
+
+// NewCatalogStore creates bucket if not found
+func NewCatalogStore(store *Store) (*CatalogStore, error) {
+	bucket := []byte("catalog")
+
+	err := store.NewBucket(bucket)
+	if err != nil {
+		return nil, errors.Wrap(err, "Catalog store bucket init failed")
+	}
+
+	return &CatalogStore{store, bucket}, nil
+}
+
+func artifactKey(plan string, name string) []byte {
+	return []byte(plan + "/" + name)
+}
+
+// Put upserts an artifact
+func (db *CatalogStore) Put(a *Artifact) error {
+	buf, err := json.Marshal(a)
+	if err != nil {
+		return errors.Wrap(err, "Catalog store json marshal failed")
+	}
+
+	return db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(db.bucket).Put(artifactKey(a.Plan, a.Name), buf)
+	})
+}
+
+// Delete removes an artifact
+func (db *CatalogStore) Delete(plan string, name string) error {
+	return db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(db.bucket).Delete(artifactKey(plan, name))
+	})
+}
+
+// List loads the artifacts of a plan ordered by name
+func (db *CatalogStore) List(plan string) ([]*Artifact, error) {
+	artifacts := make([]*Artifact, 0)
+	prefix := []byte(plan + "/")
+
+	err := db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(db.bucket).Cursor()
+		for k, v := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = c.Next() {
+			var a Artifact
+			if err := json.Unmarshal(v, &a); err != nil {
+				return errors.Wrap(err, "Catalog store json unmarshal failed")
+			}
+			artifacts = append(artifacts, &a)
+		}
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return artifacts, nil
+}
+
+// Prune removes the artifacts taken before t, except the ones keep returns
+// true for, it returns the number of removed artifacts.
+func (db *CatalogStore) Prune(t time.Time, keep func(a *Artifact) bool) (int, error) {
+	stale := make([][]byte, 0)
+	err := db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(db.bucket).ForEach(func(k, v []byte) error {
+			var a Artifact
+			if err := json.Unmarshal(v, &a); err != nil {
+				return errors.Wrap(err, "Catalog store json unmarshal failed")
+			}
+			if a.Timestamp.Before(t) && !keep(&a) {
+				stale = append(stale, append([]byte(nil), k...))
+			}
+			return nil
+		})
+	})
+	if err != nil || len(stale) == 0 {
+		return 0, err
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(db.bucket)
+		for _, k := range stale {
+			if err := b.Delete(k); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, errors.Wrap(err, "Catalog store prune failed")
+	}
+	return len(stale), nil
+}
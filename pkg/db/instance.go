@@ -0,0 +1,90 @@
+package db
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/pkg/errors"
+)
+
+// Instance is a remote mgob registered with the controller.
+type Instance struct {
+	Name       string    `json:"name"`
+	URL        string    `json:"url"`
+	Token      string    `json:"token,omitempty"`
+	Plans      []string  `json:"plans"`
+	Registered time.Time `json:"registered"`
+}
+
+type InstanceStore struct {
+	*Store
+	bucket []byte
+}
+
+// NewInstanceStore creates bucket if not found
+func NewInstanceStore(store *Store) (*InstanceStore, error) {
+	bucket := []byte("instances")
+
+	err := store.NewBucket(bucket)
+	if err != nil {
+		return nil, errors.Wrap(err, "Instance store bucket init failed")
+	}
+
+	return &InstanceStore{store, bucket}, nil
+}
+
+// Put upserts an instance
+func (db *InstanceStore) Put(i *Instance) error {
+	buf, err := json.Marshal(i)
+	if err != nil {
+		return errors.Wrap(err, "Instance store json marshal failed")
+	}
+
+	return db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(db.bucket).Put([]byte(i.Name), buf)
+	})
+}
+
+// Get loads an instance, nil when not registered
+func (db *InstanceStore) Get(name string) (*Instance, error) {
+	var i *Instance
+	err := db.View(func(tx *bolt.Tx) error {
+		v := tx.Bucket(db.bucket).Get([]byte(name))
+		if v == nil {
+			return nil
+		}
+		i = &Instance{}
+		return json.Unmarshal(v, i)
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "Instance store json unmarshal failed")
+	}
+	return i, nil
+}
+
+// Delete removes an instance
+func (db *InstanceStore) Delete(name string) error {
+	return db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(db.bucket).Delete([]byte(name))
+	})
+}
+
+// GetAll loads all instances ordered by name
+func (db *InstanceStore) GetAll() ([]*Instance, error) {
+	list := make([]*Instance, 0)
+	err := db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(db.bucket).ForEach(func(k, v []byte) error {
+			var i Instance
+			if err := json.Unmarshal(v, &i); err != nil {
+				return errors.Wrap(err, "Instance store json unmarshal failed")
+			}
+			list = append(list, &i)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return list, nil
+}
@@ -0,0 +1,234 @@
+package db
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/pkg/errors"
+)
+
+// Manifest is the signed record of a backup run. Each manifest holds the hash
+// of the previous one so a removed or rewritten record breaks the chain.
+type Manifest struct {
+	Seq       uint64           `json:"seq"`
+	Plan      string           `json:"plan"`
+	Timestamp time.Time        `json:"timestamp"`
+	Status    string           `json:"status"`
+	Error     string           `json:"error,omitempty"`
+	Name      string           `json:"name,omitempty"`
+	Size      int64            `json:"size"`
+	Checksum  string           `json:"checksum,omitempty"`
+	Uploads   []ManifestUpload `json:"uploads,omitempty"`
+	Prev      string           `json:"prev"`
+	Signature []byte           `json:"signature,omitempty"`
+	// Hashes are the dbHash md5 of the dumped collections by database
+	Hashes map[string]map[string]string `json:"hashes,omitempty"`
+}
+
+// ManifestUpload lists the remote destinations a file of the run was copied to.
+type ManifestUpload struct {
+	File         string   `json:"file"`
+	Route        string   `json:"route,omitempty"`
+	Destinations []string `json:"destinations"`
+}
+
+// ManifestStore is an append-only log of signed manifests, it has no update or delete.
+type ManifestStore struct {
+	*Store
+	bucket []byte
+	key    ed25519.PrivateKey
+}
+
+// NewManifestStore creates bucket if not found
+func NewManifestStore(store *Store, key ed25519.PrivateKey) (*ManifestStore, error) {
+	bucket := []byte("manifests")
+
+	err := store.NewBucket(bucket)
+	if err != nil {
+		return nil, errors.Wrap(err, "Manifest store bucket init failed")
+	}
+
+	return &ManifestStore{store, bucket, key}, nil
+}
+
+// PublicKey returns the PEM encoded key manifests are verified with.
+func (db *ManifestStore) PublicKey() ([]byte, error) {
+	der, err := x509.MarshalPKIXPublicKey(db.key.Public())
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), nil
+}
+
+// Append links m to the last manifest, signs and stores it.
+func (db *ManifestStore) Append(m *Manifest) error {
+	return db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(db.bucket)
+
+		m.Prev = ""
+		if _, last := b.Cursor().Last(); last != nil {
+			m.Prev = manifestHash(last)
+		}
+		seq, err := b.NextSequence()
+		if err != nil {
+			return errors.Wrap(err, "Manifest store sequence failed")
+		}
+		m.Seq = seq
+		m.Signature = nil
+
+		payload, err := json.Marshal(m)
+		if err != nil {
+			return errors.Wrap(err, "Manifest store json marshal failed")
+		}
+		m.Signature = ed25519.Sign(db.key, payload)
+
+		buf, err := json.Marshal(m)
+		if err != nil {
+			return errors.Wrap(err, "Manifest store json marshal failed")
+		}
+		return b.Put(manifestKey(seq), buf)
+	})
+}
+
+// List loads the manifests of a plan, all plans when empty, oldest first
+func (db *ManifestStore) List(plan string) ([]*Manifest, error) {
+	list := make([]*Manifest, 0)
+
+	err := db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(db.bucket).ForEach(func(k, v []byte) error {
+			var m Manifest
+			if err := json.Unmarshal(v, &m); err != nil {
+				return errors.Wrap(err, "Manifest store json unmarshal failed")
+			}
+			if plan == "" || m.Plan == plan {
+				list = append(list, &m)
+			}
+			return nil
+		})
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return list, nil
+}
+
+// Verify checks the signature of every manifest and the hash chain between
+// them, it returns one message per broken record.
+func (db *ManifestStore) Verify() ([]string, error) {
+	problems := make([]string, 0)
+	pub := db.key.Public().(ed25519.PublicKey)
+
+	err := db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(db.bucket)
+		prev := ""
+		expected := uint64(1)
+		err := b.ForEach(func(k, v []byte) error {
+			seq := binary.BigEndian.Uint64(k)
+			if seq != expected {
+				problems = append(problems, missingManifests(expected, seq-1))
+			}
+			expected = seq + 1
+
+			var m Manifest
+			if err := json.Unmarshal(v, &m); err != nil {
+				problems = append(problems, fmt.Sprintf("manifest %v is not valid json", seq))
+				prev = manifestHash(v)
+				return nil
+			}
+			sig := m.Signature
+			m.Signature = nil
+			payload, err := json.Marshal(&m)
+			if err != nil {
+				return err
+			}
+			if m.Seq != seq || !ed25519.Verify(pub, payload, sig) {
+				problems = append(problems, fmt.Sprintf("manifest %v signature is not valid", seq))
+			}
+			if m.Prev != prev {
+				problems = append(problems, fmt.Sprintf("manifest %v doesn't follow the previous one", seq))
+			}
+			prev = manifestHash(v)
+			return nil
+		})
+		// the bucket sequence reveals records removed from the end of the log
+		if err == nil && b.Sequence() >= expected {
+			problems = append(problems, missingManifests(expected, b.Sequence()))
+		}
+		return err
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return problems, nil
+}
+
+func missingManifests(from uint64, to uint64) string {
+	if from == to {
+		return fmt.Sprintf("manifest %v is missing", from)
+	}
+	return fmt.Sprintf("manifests %v to %v are missing", from, to)
+}
+
+func manifestKey(seq uint64) []byte {
+	k := make([]byte, 8)
+	binary.BigEndian.PutUint64(k, seq)
+	return k
+}
+
+func manifestHash(v []byte) string {
+	sum := sha256.Sum256(v)
+	return hex.EncodeToString(sum[:])
+}
+
+// LoadSigningKey reads the PEM encoded ed25519 key at path, a new key is
+// generated and saved when the file doesn't exist.
+func LoadSigningKey(path string) (ed25519.PrivateKey, error) {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		_, key, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, errors.Wrap(err, "Generating signing key failed")
+		}
+		der, err := x509.MarshalPKCS8PrivateKey(key)
+		if err != nil {
+			return nil, errors.Wrap(err, "Encoding signing key failed")
+		}
+		data = pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+		if err := ioutil.WriteFile(path, data, 0600); err != nil {
+			return nil, errors.Wrapf(err, "Saving signing key %s failed", path)
+		}
+		return key, nil
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "Reading signing key %s failed", path)
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.Errorf("Signing key %s is not PEM encoded", path)
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Parsing signing key %s failed", path)
+	}
+	key, ok := parsed.(ed25519.PrivateKey)
+	if !ok {
+		return nil, errors.Errorf("Signing key %s is not an ed25519 key", path)
+	}
+	return key, nil
+}
@@ -0,0 +1,107 @@
+package db
+
+import (
+	"encoding/json"
+	"sort"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/pkg/errors"
+)
+
+// SetRun is a run of a backup set, Status is running until its plans and
+// hooks return then ok or failed.
+type SetRun struct {
+	ID       string       `json:"id"`
+	Set      string       `json:"set"`
+	Status   string       `json:"status"`
+	Started  time.Time    `json:"started"`
+	Finished *time.Time   `json:"finished,omitempty"`
+	Error    string       `json:"error,omitempty"`
+	Plans    []SetPlanRun `json:"plans"`
+}
+
+// SetPlanRun is the backup of a plan taken by a set run.
+type SetPlanRun struct {
+	Plan    string `json:"plan"`
+	RunID   string `json:"runId,omitempty"`
+	Status  string `json:"status"`
+	Archive string `json:"archive,omitempty"`
+	Size    int64  `json:"size,omitempty"`
+	Error   string `json:"error,omitempty"`
+}
+
+type SetStore struct {
+	*Store
+	bucket []byte
+}
+
+// NewSetStore creates bucket if not found
+func NewSetStore(store *Store) (*SetStore, error) {
+	bucket := []byte("sets")
+
+	err := store.NewBucket(bucket)
+	if err != nil {
+		return nil, errors.Wrap(err, "Set store bucket init failed")
+	}
+
+	return &SetStore{store, bucket}, nil
+}
+
+// Put upserts a set run
+func (db *SetStore) Put(r *SetRun) error {
+	buf, err := json.Marshal(r)
+	if err != nil {
+		return errors.Wrap(err, "Set store json marshal failed")
+	}
+
+	return db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(db.bucket).Put([]byte(r.ID), buf)
+	})
+}
+
+// Get loads a set run, nil when not found
+func (db *SetStore) Get(id string) (*SetRun, error) {
+	var r *SetRun
+	err := db.View(func(tx *bolt.Tx) error {
+		v := tx.Bucket(db.bucket).Get([]byte(id))
+		if v == nil {
+			return nil
+		}
+		r = &SetRun{}
+		return json.Unmarshal(v, r)
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "Set store json unmarshal failed")
+	}
+	return r, nil
+}
+
+// Delete removes a set run
+func (db *SetStore) Delete(id string) error {
+	return db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(db.bucket).Delete([]byte(id))
+	})
+}
+
+// List loads the runs of set, or of all sets when empty, newest first
+func (db *SetStore) List(set string) ([]*SetRun, error) {
+	list := make([]*SetRun, 0)
+	err := db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(db.bucket).ForEach(func(k, v []byte) error {
+			var r SetRun
+			if err := json.Unmarshal(v, &r); err != nil {
+				return errors.Wrap(err, "Set store json unmarshal failed")
+			}
+			if set == "" || r.Set == set {
+				list = append(list, &r)
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Started.After(list[j].Started) })
+	return list, nil
+}
@@ -15,6 +15,30 @@ type Status struct {
 	LastRun       *time.Time `json:"last_run,omitempty"`
 	LastRunStatus string     `json:"last_run_status,omitempty"`
 	LastRunLog    string     `json:"last_run_log,omitempty"`
+	Retries       int        `json:"retries,omitempty"`
+	Paused        bool       `json:"paused,omitempty"`
+	// Failures counts the consecutive failed runs since FailingSince
+	Failures     int        `json:"failures,omitempty"`
+	FailingSince *time.Time `json:"failing_since,omitempty"`
+	LastSuccess  *time.Time `json:"last_success,omitempty"`
+	// Escalated is set once the failures reached the escalation webhook
+	Escalated bool `json:"escalated,omitempty"`
+	// LastRunPhases are the durations of the phases of the last run
+	LastRunPhases   map[string]time.Duration `json:"last_run_phases,omitempty"`
+	LastRunUploads  []UploadOutcome          `json:"last_run_uploads,omitempty"`
+	LastRunArchive  string                   `json:"last_run_archive,omitempty"`
+	LastRunChecksum string                   `json:"last_run_checksum,omitempty"`
+}
+
+// UploadOutcome is the upload of a file of a run to a destination.
+type UploadOutcome struct {
+	Destination string `json:"destination"`
+	File        string `json:"file"`
+	Route       string `json:"route,omitempty"`
+	// Status is uploaded, failed, or pending when the probe breaker queued the file
+	Status   string        `json:"status"`
+	Duration time.Duration `json:"duration"`
+	Error    string        `json:"error,omitempty"`
 }
 
 type StatusStore struct {
@@ -127,6 +151,30 @@ func (db *StatusStore) Sync(stats []*Status) error {
 	})
 }
 
+// Get loads a job status, returns nil if the plan is not in the store
+func (db *StatusStore) Get(plan string) (*Status, error) {
+	var status *Status
+
+	err := db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(db.bucket)
+		v := b.Get([]byte(plan))
+		if v == nil {
+			return nil
+		}
+		status = &Status{}
+		if err := json.Unmarshal(v, status); err != nil {
+			return errors.Wrap(err, "Status store json unmarshal failed")
+		}
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return status, nil
+}
+
 // GetAll loads all jobs stats from db
 func (db *StatusStore) GetAll() ([]*Status, error) {
 	stats := make([]*Status, 0)
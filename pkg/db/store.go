@@ -1,6 +1,8 @@
 package db
 
 import (
+	"os"
+	"sync"
 	"time"
 
 	"github.com/boltdb/bolt"
@@ -9,6 +11,8 @@ import (
 
 type Store struct {
 	*bolt.DB
+	// mu is held for writing while Compact swaps the db file
+	mu sync.RWMutex
 }
 
 // Open creates or opens a bolt db at the specified path.
@@ -19,7 +23,21 @@ func Open(path string) (*Store, error) {
 		return nil, errors.Wrapf(err, "Opening store %s failed", path)
 	}
 
-	return &Store{d}, nil
+	return &Store{DB: d}, nil
+}
+
+// View runs fn in a read-only transaction.
+func (db *Store) View(fn func(*bolt.Tx) error) error {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	return db.DB.View(fn)
+}
+
+// Update runs fn in a read-write transaction.
+func (db *Store) Update(fn func(*bolt.Tx) error) error {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	return db.DB.Update(fn)
 }
 
 func (db *Store) NewBucket(name []byte) error {
@@ -37,3 +55,102 @@ func (db *Store) DeleteBucket(name []byte) error {
 		return tx.DeleteBucket(name)
 	})
 }
+
+// Size returns the size of the db file.
+func (db *Store) Size() (int64, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	fi, err := os.Stat(db.Path())
+	if err != nil {
+		return 0, errors.Wrapf(err, "Reading store %s size failed", db.Path())
+	}
+	return fi.Size(), nil
+}
+
+// Records returns the number of keys of each bucket.
+func (db *Store) Records() (map[string]int, error) {
+	records := make(map[string]int)
+	err := db.View(func(tx *bolt.Tx) error {
+		return tx.ForEach(func(name []byte, b *bolt.Bucket) error {
+			records[string(name)] = b.Stats().KeyN
+			return nil
+		})
+	})
+	return records, err
+}
+
+// Compact copies the db into a new file without the free pages bolt never
+// gives back to the filesystem, then swaps it in. Transactions wait until it's done.
+func (db *Store) Compact() (before int64, after int64, err error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	path := db.Path()
+	tmp := path + ".compact"
+	fi, err := os.Stat(path)
+	if err != nil {
+		return 0, 0, errors.Wrapf(err, "Reading store %s size failed", path)
+	}
+	before = fi.Size()
+
+	os.Remove(tmp)
+	dst, err := bolt.Open(tmp, 0600, &bolt.Options{Timeout: 1 * time.Second})
+	if err != nil {
+		return before, 0, errors.Wrapf(err, "Opening store %s failed", tmp)
+	}
+	err = db.DB.View(func(src *bolt.Tx) error {
+		return dst.Update(func(tx *bolt.Tx) error {
+			return src.ForEach(func(name []byte, b *bolt.Bucket) error {
+				nb, err := tx.CreateBucket(name)
+				if err != nil {
+					return err
+				}
+				return copyBucket(b, nb)
+			})
+		})
+	})
+	if cerr := dst.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return before, 0, errors.Wrapf(err, "Compacting store %s failed", path)
+	}
+
+	if err := db.DB.Close(); err != nil {
+		os.Remove(tmp)
+		return before, 0, errors.Wrapf(err, "Closing store %s failed", path)
+	}
+	renameErr := os.Rename(tmp, path)
+	// the old file is reopened when the rename failed
+	d, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 1 * time.Second})
+	if err != nil {
+		return before, 0, errors.Wrapf(err, "Reopening store %s failed", path)
+	}
+	db.DB = d
+	if renameErr != nil {
+		os.Remove(tmp)
+		return before, before, errors.Wrapf(renameErr, "Replacing store %s failed", path)
+	}
+	if fi, err := os.Stat(path); err == nil {
+		after = fi.Size()
+	}
+	return before, after, nil
+}
+
+// copyBucket copies the keys, nested buckets and sequence of src into dst.
+func copyBucket(src *bolt.Bucket, dst *bolt.Bucket) error {
+	if err := dst.SetSequence(src.Sequence()); err != nil {
+		return err
+	}
+	return src.ForEach(func(k, v []byte) error {
+		if v == nil {
+			nested, err := dst.CreateBucket(k)
+			if err != nil {
+				return err
+			}
+			return copyBucket(src.Bucket(k), nested)
+		}
+		return dst.Put(k, v)
+	})
+}
@@ -0,0 +1,239 @@
+package extract
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"github.com/stefanprodan/mgob/pkg/clock"
+	"github.com/stefanprodan/mgob/pkg/config"
+	"github.com/stefanprodan/mgob/pkg/restore"
+)
+
+const (
+	defaultTTL   = 60
+	readyTimeout = 2 * time.Minute
+	stopTimeout  = time.Minute
+)
+
+// Instance is an ephemeral mongod holding a restored archive.
+type Instance struct {
+	ID        string    `json:"id"`
+	Plan      string    `json:"plan"`
+	Archive   string    `json:"archive"`
+	Uri       string    `json:"uri"`
+	Created   time.Time `json:"created"`
+	ExpiresAt time.Time `json:"expires_at"`
+
+	runtime runtime
+	timer   *time.Timer
+}
+
+// Manager keeps track of the running instances and removes them when their TTL expires.
+type Manager struct {
+	conf      *config.AppConfig
+	mu        sync.Mutex
+	instances map[string]*Instance
+}
+
+func NewManager(conf *config.AppConfig) *Manager {
+	return &Manager{
+		conf:      conf,
+		instances: make(map[string]*Instance),
+	}
+}
+
+// Prune removes the instances a previous mgob process didn't tear down.
+func (m *Manager) Prune(plans []config.Plan) {
+	for _, plan := range plans {
+		if plan.Extract == nil {
+			continue
+		}
+		rt, err := newRuntime(plan)
+		if err == nil {
+			ctx, cancel := context.WithTimeout(context.Background(), stopTimeout)
+			err = rt.Prune(ctx)
+			cancel()
+		}
+		if err != nil {
+			log.WithField("plan", plan.Name).Warnf("Extract cleanup failed %v", err)
+		}
+	}
+}
+
+// Start runs a mongod, restores the archive into it and schedules its removal
+// after ttl minutes, 0 means the plan TTL.
+func (m *Manager) Start(ctx context.Context, plan config.Plan, archive string, ttl int) (*Instance, error) {
+	rt, err := newRuntime(plan)
+	if err != nil {
+		return nil, err
+	}
+
+	maxTTL := plan.Extract.TTL
+	if maxTTL < 1 {
+		maxTTL = defaultTTL
+	}
+	if ttl < 1 {
+		ttl = maxTTL
+	}
+	if ttl > maxTTL {
+		return nil, errors.Errorf("TTL %v exceeds the plan limit of %v minutes", ttl, maxTTL)
+	}
+
+	if archive != filepath.Base(archive) {
+		return nil, errors.Errorf("Invalid archive name %v", archive)
+	}
+	file := filepath.Join(config.PlanDir(m.conf.StoragePath, plan), archive)
+	if _, err := os.Stat(file); err != nil {
+		return nil, errors.Wrapf(err, "Archive %v not found", archive)
+	}
+
+	id := randomHex(4)
+	password := randomHex(16)
+	name := "mgob-extract-" + id
+	user := "mgob"
+
+	log.WithField("plan", plan.Name).Infof("Starting extract %v for %v", name, archive)
+	internal, external, err := rt.Start(ctx, name, user, password)
+	if err != nil {
+		m.remove(rt, name)
+		return nil, err
+	}
+
+	restoreUri := mongoUri(user, password, internal)
+	if err := waitReady(ctx, restoreUri); err != nil {
+		m.remove(rt, name)
+		return nil, errors.Wrapf(err, "Extract %v is not ready", name)
+	}
+
+	// skip the admin system collections so the archive can't replace the instance users
+	args := []string{"--nsExclude", "admin.system.*"}
+	if plan.Target.PointInTime {
+		args = append(args, "--oplogReplay")
+	}
+	output, err := restore.FromFile(ctx, file, restoreUri, args...)
+	if err != nil {
+		m.remove(rt, name)
+		return nil, errors.Wrapf(err, "Restoring %v into %v failed", archive, name)
+	}
+	log.WithField("plan", plan.Name).Debugf("Restore output: %v", output)
+
+	now := clock.Now()
+	inst := &Instance{
+		ID:        id,
+		Plan:      plan.Name,
+		Archive:   archive,
+		Uri:       mongoUri(user, password, external),
+		Created:   now,
+		ExpiresAt: now.Add(time.Duration(ttl) * time.Minute),
+		runtime:   rt,
+	}
+
+	m.mu.Lock()
+	m.instances[id] = inst
+	inst.timer = time.AfterFunc(time.Duration(ttl)*time.Minute, func() {
+		log.WithField("plan", plan.Name).Infof("Extract %v expired", name)
+		m.Stop(id)
+	})
+	m.mu.Unlock()
+
+	log.WithField("plan", plan.Name).Infof("Extract %v ready, expires at %v", name, inst.ExpiresAt)
+	return inst, nil
+}
+
+// List returns the running instances ordered by creation time.
+func (m *Manager) List() []*Instance {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	list := make([]*Instance, 0, len(m.instances))
+	for _, inst := range m.instances {
+		list = append(list, inst)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Created.Before(list[j].Created)
+	})
+	return list
+}
+
+// Stop tears down the instance, it returns false if the instance doesn't exist.
+func (m *Manager) Stop(id string) bool {
+	m.mu.Lock()
+	inst, ok := m.instances[id]
+	if ok {
+		delete(m.instances, id)
+		inst.timer.Stop()
+	}
+	m.mu.Unlock()
+
+	if !ok {
+		return false
+	}
+	m.remove(inst.runtime, "mgob-extract-"+id)
+	log.WithField("plan", inst.Plan).Infof("Extract mgob-extract-%v removed", id)
+	return true
+}
+
+// Close tears down all running instances.
+func (m *Manager) Close() {
+	for _, inst := range m.List() {
+		m.Stop(inst.ID)
+	}
+}
+
+func (m *Manager) remove(rt runtime, name string) {
+	ctx, cancel := context.WithTimeout(context.Background(), stopTimeout)
+	defer cancel()
+	if err := rt.Stop(ctx, name); err != nil {
+		log.Errorf("Extract teardown failed %v", err)
+	}
+}
+
+// waitReady pings the mongod until it accepts authenticated connections.
+func waitReady(ctx context.Context, uri string) error {
+	ctx, cancel := context.WithTimeout(ctx, readyTimeout)
+	defer cancel()
+
+	client, err := mongo.Connect(ctx, options.Client().ApplyURI(uri))
+	if err != nil {
+		return err
+	}
+	defer client.Disconnect(context.Background())
+
+	for {
+		err = client.Ping(ctx, nil)
+		if err == nil {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(time.Second):
+		}
+	}
+}
+
+func mongoUri(user string, password string, addr string) string {
+	return fmt.Sprintf("mongodb://%v:%v@%v/?authSource=admin",
+		url.QueryEscape(user), url.QueryEscape(password), addr)
+}
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,195 @@
+package extract
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"regexp"
+	"strings"
+
+	"github.com/pkg/errors"
+
+	"github.com/stefanprodan/mgob/pkg/command"
+	"github.com/stefanprodan/mgob/pkg/config"
+)
+
+const mongoPort = "27017"
+
+// runtime starts and removes the ephemeral mongod containers.
+type runtime interface {
+	// Start runs mongod with a root user and returns the address mgob
+	// restores into and the address handed out to clients.
+	Start(ctx context.Context, name string, user string, password string) (internal string, external string, err error)
+	Stop(ctx context.Context, name string) error
+	// Prune removes instances of the plan left over by a previous mgob process.
+	Prune(ctx context.Context) error
+}
+
+func newRuntime(plan config.Plan) (runtime, error) {
+	if plan.Extract == nil {
+		return nil, errors.Errorf("Plan %v has no extract config", plan.Name)
+	}
+
+	image := plan.Extract.Image
+	if image == "" {
+		image = "mongo"
+	}
+
+	switch plan.Extract.Runtime {
+	case "", config.ExtractRuntimeDocker:
+		host := plan.Extract.Host
+		if host == "" {
+			host = "localhost"
+		}
+		return &dockerRuntime{plan: plan.Name, image: image, host: host, network: plan.Extract.Network}, nil
+	case config.ExtractRuntimeKubernetes:
+		namespace := plan.Extract.Namespace
+		if namespace == "" {
+			namespace = "default"
+		}
+		return &kubeRuntime{plan: labelValue(plan.Name), image: image, namespace: namespace}, nil
+	default:
+		return nil, errors.Errorf("Unsupported extract runtime %v", plan.Extract.Runtime)
+	}
+}
+
+type dockerRuntime struct {
+	plan    string
+	image   string
+	host    string
+	network string
+}
+
+func (d *dockerRuntime) Start(ctx context.Context, name string, user string, password string) (string, string, error) {
+	args := []string{"run", "-d", "--rm", "--name", name,
+		"--label", "mgob.extract=" + d.plan,
+		"-e", "MONGO_INITDB_ROOT_USERNAME",
+		"-e", "MONGO_INITDB_ROOT_PASSWORD",
+		"-p", mongoPort}
+	if d.network != "" {
+		args = append(args, "--network", d.network)
+	}
+	args = append(args, d.image)
+
+	cmd := exec.CommandContext(ctx, "docker", args...)
+	// pass the credentials through the environment so they don't show up in ps
+	cmd.Env = append(os.Environ(),
+		"MONGO_INITDB_ROOT_USERNAME="+user,
+		"MONGO_INITDB_ROOT_PASSWORD="+password)
+	if _, err := run(cmd); err != nil {
+		return "", "", errors.Wrapf(err, "Starting container %v failed", name)
+	}
+
+	output, err := run(exec.CommandContext(ctx, "docker", "port", name, mongoPort+"/tcp"))
+	if err != nil {
+		return "", "", errors.Wrapf(err, "Reading published port of %v failed", name)
+	}
+	// 0.0.0.0:49153
+	// [::]:49153
+	line := strings.SplitN(strings.TrimSpace(output), "\n", 2)[0]
+	port := line[strings.LastIndex(line, ":")+1:]
+	if port == "" {
+		return "", "", errors.Errorf("Unexpected docker port output %v", output)
+	}
+
+	external := fmt.Sprintf("%v:%v", d.host, port)
+	internal := "127.0.0.1:" + port
+	if d.network != "" {
+		internal = name + ":" + mongoPort
+	}
+	return internal, external, nil
+}
+
+func (d *dockerRuntime) Stop(ctx context.Context, name string) error {
+	if _, err := run(exec.CommandContext(ctx, "docker", "rm", "-f", name)); err != nil {
+		return errors.Wrapf(err, "Removing container %v failed", name)
+	}
+	return nil
+}
+
+func (d *dockerRuntime) Prune(ctx context.Context) error {
+	output, err := run(exec.CommandContext(ctx, "docker", "ps", "-aq", "--filter", "label=mgob.extract="+d.plan))
+	if err != nil {
+		return errors.Wrap(err, "Listing extract containers failed")
+	}
+	for _, id := range strings.Fields(output) {
+		if err := d.Stop(ctx, id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type kubeRuntime struct {
+	plan      string
+	image     string
+	namespace string
+}
+
+func (k *kubeRuntime) Start(ctx context.Context, name string, user string, password string) (string, string, error) {
+	_, err := run(exec.CommandContext(ctx, "kubectl", "run", name,
+		"-n", k.namespace,
+		"--image", k.image,
+		"--restart", "Never",
+		"--port", mongoPort,
+		"--labels", fmt.Sprintf("mgob.extract=%v,mgob.plan=%v", name, k.plan),
+		"--env", "MONGO_INITDB_ROOT_USERNAME="+user,
+		"--env", "MONGO_INITDB_ROOT_PASSWORD="+password))
+	if err != nil {
+		return "", "", errors.Wrapf(err, "Starting pod %v failed", name)
+	}
+
+	_, err = run(exec.CommandContext(ctx, "kubectl", "expose", "pod", name,
+		"-n", k.namespace, "--port", mongoPort))
+	if err != nil {
+		return "", "", errors.Wrapf(err, "Exposing pod %v failed", name)
+	}
+
+	_, err = run(exec.CommandContext(ctx, "kubectl", "wait", "pod/"+name,
+		"-n", k.namespace, "--for", "condition=Ready", "--timeout", "5m"))
+	if err != nil {
+		return "", "", errors.Wrapf(err, "Waiting for pod %v failed", name)
+	}
+
+	addr := fmt.Sprintf("%v.%v.svc:%v", name, k.namespace, mongoPort)
+	return addr, addr, nil
+}
+
+func (k *kubeRuntime) Stop(ctx context.Context, name string) error {
+	_, err := run(exec.CommandContext(ctx, "kubectl", "delete", "pod,service", name,
+		"-n", k.namespace, "--ignore-not-found", "--wait=false"))
+	if err != nil {
+		return errors.Wrapf(err, "Removing pod %v failed", name)
+	}
+	return nil
+}
+
+func (k *kubeRuntime) Prune(ctx context.Context) error {
+	_, err := run(exec.CommandContext(ctx, "kubectl", "delete", "pod,service",
+		"-n", k.namespace, "-l", "mgob.extract,mgob.plan="+k.plan,
+		"--ignore-not-found", "--wait=false"))
+	if err != nil {
+		return errors.Wrap(err, "Removing extract pods failed")
+	}
+	return nil
+}
+
+var invalidLabelChars = regexp.MustCompile(`[^A-Za-z0-9_.-]`)
+
+// labelValue makes the plan name usable as a Kubernetes label value.
+func labelValue(s string) string {
+	s = invalidLabelChars.ReplaceAllString(s, "-")
+	if len(s) > 63 {
+		s = s[:63]
+	}
+	return strings.Trim(s, "-_.")
+}
+
+func run(cmd *exec.Cmd) (string, error) {
+	output, err := command.CombinedOutput(cmd)
+	if err != nil {
+		return "", errors.Wrapf(err, "%v", strings.Replace(string(output), "\n", " ", -1))
+	}
+	return string(output), nil
+}
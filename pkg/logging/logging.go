@@ -0,0 +1,101 @@
+package logging
+
+import (
+	"sort"
+	"strings"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// filter drops the entries below the base level, except the debug entries
+// of the plans with debug logging enabled.
+type filter struct {
+	log.Formatter
+	mu    sync.RWMutex
+	base  log.Level
+	plans map[string]bool
+}
+
+var levels = &filter{base: log.InfoLevel, plans: make(map[string]bool)}
+
+// Setup wraps the standard logger formatter, it must be called after the
+// formatter is set and before logging starts.
+func Setup(level log.Level) {
+	levels.Formatter = log.StandardLogger().Formatter
+	levels.base = level
+	log.SetFormatter(levels)
+	levels.apply()
+}
+
+func (f *filter) Format(e *log.Entry) ([]byte, error) {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	if e.Level > f.base && !f.matches(e) {
+		return nil, nil
+	}
+	return f.Formatter.Format(e)
+}
+
+// matches reports whether the entry belongs to a plan with debug enabled,
+// database mode runs log as <plan>-<database>.
+func (f *filter) matches(e *log.Entry) bool {
+	plan, ok := e.Data["plan"].(string)
+	if !ok || len(f.plans) == 0 {
+		return false
+	}
+	for p := range f.plans {
+		if plan == p || strings.HasPrefix(plan, p+"-") {
+			return true
+		}
+	}
+	return false
+}
+
+// apply lowers the logger level to debug while any plan needs it.
+func (f *filter) apply() {
+	level := f.base
+	if len(f.plans) > 0 && level < log.DebugLevel {
+		level = log.DebugLevel
+	}
+	log.SetLevel(level)
+}
+
+// SetLevel changes the level of all plans.
+func SetLevel(level log.Level) {
+	levels.mu.Lock()
+	defer levels.mu.Unlock()
+	levels.base = level
+	levels.apply()
+}
+
+// Level returns the level of all plans.
+func Level() log.Level {
+	levels.mu.RLock()
+	defer levels.mu.RUnlock()
+	return levels.base
+}
+
+// SetPlanDebug enables or disables debug logging of a single plan.
+func SetPlanDebug(plan string, debug bool) {
+	levels.mu.Lock()
+	defer levels.mu.Unlock()
+	if debug {
+		levels.plans[plan] = true
+	} else {
+		delete(levels.plans, plan)
+	}
+	levels.apply()
+}
+
+// DebugPlans lists the plans with debug logging enabled.
+func DebugPlans() []string {
+	levels.mu.RLock()
+	defer levels.mu.RUnlock()
+	list := make([]string, 0, len(levels.plans))
+	for p := range levels.plans {
+		list = append(list, p)
+	}
+	sort.Strings(list)
+	return list
+}
@@ -0,0 +1,110 @@
+package metrics
+
+import (
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// OtherDatabases is the database label the databases above the limit are summed under.
+const OtherDatabases = "_other"
+
+// Labels selects the optional labels, a dropped label is exported with an empty
+// value so its series collapse into one. MaxDatabases caps the database series
+// of a plan, 0 means no cap.
+type Labels struct {
+	Plan         bool
+	Database     bool
+	Destination  bool
+	MaxDatabases int
+}
+
+// ParseLabels reads a comma separated list of plan, database and destination,
+// an empty list enables all of them.
+func ParseLabels(list string, maxDatabases int) (Labels, error) {
+	if strings.TrimSpace(list) == "" {
+		return Labels{Plan: true, Database: true, Destination: true, MaxDatabases: maxDatabases}, nil
+	}
+	l := Labels{MaxDatabases: maxDatabases}
+	for _, name := range strings.Split(list, ",") {
+		switch strings.TrimSpace(name) {
+		case "plan":
+			l.Plan = true
+		case "database":
+			l.Database = true
+		case "destination":
+			l.Destination = true
+		case "":
+		default:
+			return l, errors.Errorf("unknown metrics label '%s'", name)
+		}
+	}
+	return l, nil
+}
+
+// databaseSeries remembers the database series set per plan to remove the stale ones.
+type databaseSeries struct {
+	mu     sync.Mutex
+	byPlan map[string][]string
+}
+
+// Plan returns the plan label value.
+func (m *BackupMetrics) Plan(name string) string {
+	if !m.labels.Plan {
+		return ""
+	}
+	return name
+}
+
+// Destination returns the destination label value.
+func (m *BackupMetrics) Destination(name string) string {
+	if !m.labels.Destination {
+		return ""
+	}
+	return name
+}
+
+// SetDatabaseSizes exports the archive size of each database of a database mode
+// backup. Above MaxDatabases the smallest ones are summed under OtherDatabases.
+func (m *BackupMetrics) SetDatabaseSizes(plan string, sizes map[string]int64) {
+	if !m.labels.Database || len(sizes) == 0 {
+		return
+	}
+	names := make([]string, 0, len(sizes))
+	for name := range sizes {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		if sizes[names[i]] != sizes[names[j]] {
+			return sizes[names[i]] > sizes[names[j]]
+		}
+		return names[i] < names[j]
+	})
+
+	values := make(map[string]int64)
+	for i, name := range names {
+		// one series is left for the sum of the others
+		if m.labels.MaxDatabases > 0 && len(names) > m.labels.MaxDatabases && i >= m.labels.MaxDatabases-1 {
+			values[OtherDatabases] += sizes[name]
+			continue
+		}
+		values[name] = sizes[name]
+	}
+
+	label := m.Plan(plan)
+	m.series.mu.Lock()
+	defer m.series.mu.Unlock()
+	for _, name := range m.series.byPlan[label] {
+		if _, ok := values[name]; !ok {
+			m.DatabaseSize.DeleteLabelValues(label, name)
+		}
+	}
+	set := make([]string, 0, len(values))
+	for name, size := range values {
+		m.DatabaseSize.WithLabelValues(label, name).Set(float64(size))
+		set = append(set, name)
+	}
+	m.series.byPlan[label] = set
+}
@@ -6,10 +6,46 @@ type BackupMetrics struct {
 	Total   *prometheus.CounterVec
 	Size    *prometheus.GaugeVec
 	Latency *prometheus.SummaryVec
+	Drift   *prometheus.GaugeVec
+
+	RestoreTotal   *prometheus.CounterVec
+	RestoreLatency *prometheus.SummaryVec
+	VerifyTotal    *prometheus.CounterVec
+
+	Delayed    *prometheus.GaugeVec
+	DelayTotal *prometheus.CounterVec
+	RetryTotal *prometheus.CounterVec
+
+	TriggerTotal *prometheus.CounterVec
+	OverlapTotal *prometheus.CounterVec
+	Waiting      *prometheus.GaugeVec
+
+	DatabaseSize  *prometheus.GaugeVec
+	EstimatedSize *prometheus.GaugeVec
+
+	DestinationUp *prometheus.GaugeVec
+	UploadQueued  *prometheus.GaugeVec
+	StorageCost   *prometheus.GaugeVec
+
+	CPUSeconds *prometheus.CounterVec
+	MaxRSS     *prometheus.GaugeVec
+	IOBytes    *prometheus.CounterVec
+	NetBytes   *prometheus.CounterVec
+
+	PhaseSeconds  *prometheus.GaugeVec
+	UploadSeconds *prometheus.GaugeVec
+	UploadTotal   *prometheus.CounterVec
+
+	DBSize        prometheus.Gauge
+	DBRecords     *prometheus.GaugeVec
+	CatalogPruned prometheus.Counter
+
+	labels Labels
+	series databaseSeries
 }
 
-func New(namespace string, subsystem string) *BackupMetrics {
-	prom := &BackupMetrics{}
+func New(namespace string, subsystem string, labels Labels) *BackupMetrics {
+	prom := &BackupMetrics{labels: labels, series: databaseSeries{byPlan: make(map[string][]string)}}
 
 	prom.Total = prometheus.NewCounterVec(
 		prometheus.CounterOpts{
@@ -41,9 +77,282 @@ func New(namespace string, subsystem string) *BackupMetrics {
 		[]string{"plan", "status"},
 	)
 
+	prom.Drift = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "reconcile_drift",
+			Help:      "The number of objects that differ from the catalog.",
+		},
+		[]string{"plan", "destination", "route", "kind"},
+	)
+
+	prom.RestoreTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "restore_total",
+			Help:      "The total number of restores.",
+		},
+		[]string{"plan", "status"},
+	)
+
+	prom.RestoreLatency = prometheus.NewSummaryVec(
+		prometheus.SummaryOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "restore_latency",
+			Help:      "Restore duration in seconds.",
+		},
+		[]string{"plan", "status"},
+	)
+
+	prom.VerifyTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "verify_total",
+			Help:      "The total number of restore verifications.",
+		},
+		[]string{"plan", "status"},
+	)
+
+	prom.Delayed = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "backup_delayed",
+			Help:      "Set while a scheduled backup waits for the uploads or the tmp dir to drain.",
+		},
+		[]string{"plan"},
+	)
+
+	prom.DelayTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "backup_delay_total",
+			Help:      "The total number of delayed scheduled backups.",
+		},
+		[]string{"plan", "reason"},
+	)
+
+	prom.RetryTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "backup_retry_total",
+			Help:      "The total number of retries of failed scheduled backups.",
+		},
+		[]string{"plan"},
+	)
+
+	prom.TriggerTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "backup_trigger_total",
+			Help:      "The backups started by a change stream trigger, by reason.",
+		},
+		[]string{"plan", "reason"},
+	)
+
+	prom.OverlapTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "backup_overlap_total",
+			Help:      "The cron runs that found the previous run still running, by overlap policy.",
+		},
+		[]string{"plan", "policy"},
+	)
+
+	prom.Waiting = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "backup_waiting",
+			Help:      "Set while a backup waits for a slot under the max concurrent backups.",
+		},
+		[]string{"plan"},
+	)
+
+	prom.DatabaseSize = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "backup_database_size",
+			Help:      "The archive size of each database of a database mode backup.",
+		},
+		[]string{"plan", "database"},
+	)
+
+	prom.EstimatedSize = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "backup_estimated_size",
+			Help:      "The uncompressed size of the dumped data the target reported before the last backup.",
+		},
+		[]string{"plan"},
+	)
+
+	prom.DestinationUp = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "destination_up",
+			Help:      "Set when the last probe of a remote destination succeeded.",
+		},
+		[]string{"plan", "destination", "route"},
+	)
+
+	prom.UploadQueued = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "upload_queued",
+			Help:      "The number of files queued for a destination found down.",
+		},
+		[]string{"plan", "destination", "route"},
+	)
+
+	prom.StorageCost = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "storage_cost",
+			Help:      "The projected monthly storage cost in $ under the plan retention.",
+		},
+		[]string{"plan", "destination", "route"},
+	)
+
+	prom.CPUSeconds = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "backup_cpu_seconds_total",
+			Help:      "The CPU time of the dump and upload processes.",
+		},
+		[]string{"plan", "stage"},
+	)
+
+	prom.MaxRSS = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "backup_max_rss_bytes",
+			Help:      "The peak resident set size of the dump and upload processes of the last backup.",
+		},
+		[]string{"plan", "stage"},
+	)
+
+	prom.IOBytes = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "backup_io_bytes_total",
+			Help:      "The bytes the dump and upload processes read from and wrote to disk.",
+		},
+		[]string{"plan", "stage", "direction"},
+	)
+
+	prom.NetBytes = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "backup_network_bytes_total",
+			Help:      "The bytes the dumps received and the uploads sent.",
+		},
+		[]string{"plan", "stage"},
+	)
+
+	prom.PhaseSeconds = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "backup_phase_seconds",
+			Help:      "The duration of each phase of the last backup run in seconds.",
+		},
+		[]string{"plan", "phase"},
+	)
+
+	prom.UploadSeconds = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "backup_upload_seconds",
+			Help:      "The duration of the uploads of the last backup run to each destination in seconds.",
+		},
+		[]string{"plan", "destination"},
+	)
+
+	prom.UploadTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "backup_upload_total",
+			Help:      "The uploads of the backup files by destination and outcome.",
+		},
+		[]string{"plan", "destination", "status"},
+	)
+
+	prom.DBSize = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "db_size_bytes",
+			Help:      "The size of the mgob.db file.",
+		},
+	)
+
+	prom.DBRecords = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "db_records",
+			Help:      "The number of records of each mgob.db bucket.",
+		},
+		[]string{"bucket"},
+	)
+
+	prom.CatalogPruned = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "catalog_pruned_total",
+			Help:      "The catalog records removed for being older than the max age.",
+		},
+	)
+
 	prometheus.MustRegister(prom.Total)
 	prometheus.MustRegister(prom.Size)
 	prometheus.MustRegister(prom.Latency)
+	prometheus.MustRegister(prom.Drift)
+	prometheus.MustRegister(prom.RestoreTotal)
+	prometheus.MustRegister(prom.RestoreLatency)
+	prometheus.MustRegister(prom.VerifyTotal)
+	prometheus.MustRegister(prom.Delayed)
+	prometheus.MustRegister(prom.DelayTotal)
+	prometheus.MustRegister(prom.RetryTotal)
+	prometheus.MustRegister(prom.TriggerTotal)
+	prometheus.MustRegister(prom.OverlapTotal)
+	prometheus.MustRegister(prom.Waiting)
+	prometheus.MustRegister(prom.DatabaseSize)
+	prometheus.MustRegister(prom.EstimatedSize)
+	prometheus.MustRegister(prom.DestinationUp)
+	prometheus.MustRegister(prom.UploadQueued)
+	prometheus.MustRegister(prom.StorageCost)
+	prometheus.MustRegister(prom.CPUSeconds)
+	prometheus.MustRegister(prom.MaxRSS)
+	prometheus.MustRegister(prom.IOBytes)
+	prometheus.MustRegister(prom.NetBytes)
+	prometheus.MustRegister(prom.PhaseSeconds)
+	prometheus.MustRegister(prom.UploadSeconds)
+	prometheus.MustRegister(prom.UploadTotal)
+	prometheus.MustRegister(prom.DBSize)
+	prometheus.MustRegister(prom.DBRecords)
+	prometheus.MustRegister(prom.CatalogPruned)
 
 	return prom
 }
@@ -0,0 +1,70 @@
+package notifier
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/pkg/errors"
+
+	"github.com/stefanprodan/mgob/pkg/config"
+)
+
+// maxWebhookMessage keeps the message within an SMS provider limit, Twilio takes 1600 chars.
+const maxWebhookMessage = 1600
+
+// SendSlackNotification notifies the plan Slack channel only.
+func SendSlackNotification(subject string, body string, warn bool, plan config.Plan) error {
+	if plan.Slack == nil {
+		return nil
+	}
+	return sendSlackNotification(subject, body, warn, plan.Slack)
+}
+
+// SendEmailEscalation emails the escalation list through the plan smtp server.
+func SendEmailEscalation(subject string, body string, plan config.Plan) error {
+	if plan.SMTP == nil {
+		return errors.New("escalation email requires the plan smtp config")
+	}
+	cfg := *plan.SMTP
+	cfg.To = plan.Escalation.Email.To
+	return sendEmailNotification(subject, body, &cfg)
+}
+
+// SendWebhookEscalation posts the escalation webhook form with the message.
+func SendWebhookEscalation(subject string, body string, plan config.Plan) error {
+	cfg := plan.Escalation.Webhook
+	form := url.Values{}
+	for k, v := range cfg.Params {
+		form.Set(k, v)
+	}
+	param := cfg.MessageParam
+	if param == "" {
+		param = "Body"
+	}
+	msg := subject + ": " + body
+	if len(msg) > maxWebhookMessage {
+		msg = msg[:maxWebhookMessage]
+	}
+	form.Set(param, msg)
+
+	req, err := http.NewRequest("POST", cfg.URL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return errors.Wrapf(err, "Escalation webhook request failed")
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if cfg.Username != "" {
+		req.SetBasicAuth(cfg.Username, cfg.Password)
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return errors.Wrapf(err, "Sending escalation webhook failed")
+	}
+	defer res.Body.Close()
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		data, _ := ioutil.ReadAll(res.Body)
+		return errors.Errorf("Sending escalation webhook failed %v %v", res.StatusCode, string(data))
+	}
+	return nil
+}
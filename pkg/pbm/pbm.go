@@ -0,0 +1,205 @@
+package pbm
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/stefanprodan/mgob/pkg/command"
+	"github.com/stefanprodan/mgob/pkg/config"
+)
+
+// RecordExt is the extension of the file recording a PBM backup in the plan dir.
+const RecordExt = ".pbm.json"
+
+// PollInterval is the delay between two status checks of a running backup or restore.
+var PollInterval = 10 * time.Second
+
+// Client runs the pbm CLI against the PBM deployment of a cluster.
+type Client struct {
+	// Binary is the pbm CLI path, defaults to pbm
+	Binary string
+	Uri    string
+	Env    map[string]string
+}
+
+// NewClient returns the client of the PBM deployment of uri, with the pbm
+// binary and env of plan.
+func NewClient(plan config.Plan, uri string) Client {
+	c := Client{Uri: uri, Env: plan.Env}
+	if plan.PBM != nil {
+		c.Binary = plan.PBM.Binary
+	}
+	return c
+}
+
+// Backup is the pbm describe-backup output.
+type Backup struct {
+	Name   string `json:"name"`
+	Type   string `json:"type"`
+	Status string `json:"status"`
+	Size   int64  `json:"size"`
+	Error  string `json:"error,omitempty"`
+}
+
+// Record is stored in the plan dir for each backup, the retention of the
+// records deletes the PBM backups.
+type Record struct {
+	Backup
+	Plan      string    `json:"plan"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+type Restore struct {
+	Name   string `json:"name"`
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+func (c Client) run(ctx context.Context, out interface{}, args ...string) error {
+	bin := c.Binary
+	if bin == "" {
+		bin = "pbm"
+	}
+	args = append(args, "--mongodb-uri", c.Uri)
+	if out != nil {
+		args = append(args, "--out", "json")
+	}
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, bin, args...)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if len(c.Env) > 0 {
+		keys := make([]string, 0, len(c.Env))
+		for k := range c.Env {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		cmd.Env = os.Environ()
+		for _, k := range keys {
+			cmd.Env = append(cmd.Env, fmt.Sprintf("%v=%v", k, c.Env[k]))
+		}
+	}
+	if err := command.Run(cmd); err != nil {
+		msg := strings.TrimSpace(stderr.String())
+		if msg == "" {
+			msg = strings.TrimSpace(stdout.String())
+		}
+		return errors.Wrapf(err, "pbm %v failed %v", args[0], strings.Replace(msg, "\n", " ", -1))
+	}
+	if out == nil {
+		return nil
+	}
+	if err := json.Unmarshal(stdout.Bytes(), out); err != nil {
+		return errors.Wrapf(err, "parsing pbm %v output failed", args[0])
+	}
+	return nil
+}
+
+// StartBackup starts a backup of type, logical when blank, and returns its name.
+func (c Client) StartBackup(ctx context.Context, typ string, compression string) (string, error) {
+	args := []string{"backup"}
+	if typ != "" {
+		args = append(args, "--type", typ)
+	}
+	if compression != "" {
+		args = append(args, "--compression", compression)
+	}
+	var out struct {
+		Name string `json:"name"`
+	}
+	if err := c.run(ctx, &out, args...); err != nil {
+		return "", err
+	}
+	if out.Name == "" {
+		return "", errors.New("pbm backup returned no backup name")
+	}
+	return out.Name, nil
+}
+
+// Describe returns the status of the backup name.
+func (c Client) Describe(ctx context.Context, name string) (Backup, error) {
+	var b Backup
+	err := c.run(ctx, &b, "describe-backup", name)
+	return b, err
+}
+
+// WaitBackup polls the backup name until it's done or failed.
+func (c Client) WaitBackup(ctx context.Context, name string) (Backup, error) {
+	for {
+		b, err := c.Describe(ctx, name)
+		if err != nil {
+			return b, err
+		}
+		switch b.Status {
+		case "done":
+			return b, nil
+		case "error", "cancelled", "canceled":
+			return b, errors.Errorf("pbm backup %v %v %v", name, b.Status, b.Error)
+		}
+		select {
+		case <-time.After(PollInterval):
+		case <-ctx.Done():
+			return b, errors.Wrapf(ctx.Err(), "waiting for pbm backup %v", name)
+		}
+	}
+}
+
+// Delete removes the backup name from the PBM storage.
+func (c Client) Delete(ctx context.Context, name string) error {
+	return c.run(ctx, nil, "delete-backup", name, "--yes")
+}
+
+// StartRestore starts the restore of the backup name and returns the restore name.
+func (c Client) StartRestore(ctx context.Context, name string) (string, error) {
+	var out struct {
+		Name string `json:"name"`
+	}
+	if err := c.run(ctx, &out, "restore", name); err != nil {
+		return "", err
+	}
+	return out.Name, nil
+}
+
+// WaitRestore polls the restore name until it's done or failed.
+func (c Client) WaitRestore(ctx context.Context, name string) (Restore, error) {
+	for {
+		var r Restore
+		if err := c.run(ctx, &r, "describe-restore", name); err != nil {
+			return r, err
+		}
+		switch r.Status {
+		case "done":
+			return r, nil
+		case "error", "cancelled", "canceled":
+			return r, errors.Errorf("pbm restore %v %v %v", name, r.Status, r.Error)
+		}
+		select {
+		case <-time.After(PollInterval):
+		case <-ctx.Done():
+			return r, errors.Wrapf(ctx.Err(), "waiting for pbm restore %v", name)
+		}
+	}
+}
+
+// ReadRecord loads the record file of a PBM backup.
+func ReadRecord(file string) (Record, error) {
+	var r Record
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return r, errors.Wrapf(err, "reading %v failed", file)
+	}
+	if err := json.Unmarshal(data, &r); err != nil {
+		return r, errors.Wrapf(err, "parsing %v failed", file)
+	}
+	return r, nil
+}
@@ -0,0 +1,310 @@
+package restore
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/pkg/errors"
+
+	"github.com/stefanprodan/mgob/pkg/command"
+)
+
+// ArchiveReader streams the plain mongodump archive out of a stored backup,
+// joining split parts, decrypting and decompressing as needed.
+type ArchiveReader struct {
+	io.Reader
+	// Tar is set for sample and directory format backups, a tar of a mongodump
+	// directory instead of an archive.
+	Tar     bool
+	closers []func() error
+}
+
+func (a *ArchiveReader) Close() error {
+	var first error
+	// close from the outermost reader inwards
+	for i := len(a.closers) - 1; i >= 0; i-- {
+		if err := a.closers[i](); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+// The extensions of the codecs a stored archive is wrapped in.
+const (
+	codecEncrypted = ".encrypted"
+	codecGzip      = ".gz"
+	codecZstd      = ".zst"
+	codecLz4       = ".lz4"
+)
+
+// archiveCodecs returns the codecs to undo to read the archive stored in
+// name, outermost first, and whether it holds a tar of a dump directory.
+func archiveCodecs(name string) ([]string, bool) {
+	codecs := make([]string, 0, 2)
+	for _, codec := range []string{codecEncrypted, codecGzip, codecZstd, codecLz4} {
+		if strings.HasSuffix(name, codec) {
+			name = strings.TrimSuffix(name, codec)
+			codecs = append(codecs, codec)
+		}
+	}
+	return codecs, strings.HasSuffix(name, ".tar")
+}
+
+// OpenArchive returns a reader over the mongodump archive stored in file.
+func OpenArchive(ctx context.Context, file string) (*ArchiveReader, error) {
+	return openArchive(ctx, file, nil)
+}
+
+// openArchive counts the stored bytes read in p.
+func openArchive(ctx context.Context, file string, p *Progress) (*ArchiveReader, error) {
+	a := &ArchiveReader{}
+
+	name := file
+	if strings.HasSuffix(file, ".part000") {
+		name = strings.TrimSuffix(file, ".part000")
+		readers := make([]io.Reader, 0)
+		for i := 0; ; i++ {
+			f, err := os.Open(fmt.Sprintf("%v.part%03d", name, i))
+			if os.IsNotExist(err) && i > 0 {
+				break
+			}
+			if err != nil {
+				a.Close()
+				return nil, errors.Wrapf(err, "Opening part %v of %v failed", i, name)
+			}
+			readers = append(readers, f)
+			a.closers = append(a.closers, f.Close)
+		}
+		a.Reader = io.MultiReader(readers...)
+	} else {
+		f, err := os.Open(file)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Opening %v failed", file)
+		}
+		a.Reader = f
+		a.closers = append(a.closers, f.Close)
+	}
+	if p != nil {
+		a.Reader = &countingReader{r: a.Reader, p: p}
+	}
+	if t, ok := ctx.Value(throttleKey{}).(*Throttle); ok && t != nil {
+		a.Reader = &throttledReader{ctx: ctx, r: a.Reader, t: t, start: time.Now()}
+	}
+
+	codecs, isTar := archiveCodecs(name)
+	for _, codec := range codecs {
+		switch codec {
+		case codecEncrypted:
+			var stderr bytes.Buffer
+			cmd := exec.CommandContext(ctx, "gpg", "--batch", "--yes", "--decrypt")
+			cmd.Stdin = a.Reader
+			cmd.Stderr = &stderr
+			out, err := cmd.StdoutPipe()
+			if err == nil {
+				err = command.Start(cmd)
+			}
+			if err != nil {
+				a.Close()
+				return nil, errors.Wrapf(err, "Decrypting %v failed", file)
+			}
+			a.Reader = out
+			a.closers = append(a.closers, func() error {
+				// unblock gpg if the reader stopped before the end
+				out.Close()
+				if err := cmd.Wait(); err != nil {
+					return errors.Wrapf(err, "Decrypting %v failed %v", file,
+						strings.Replace(stderr.String(), "\n", " ", -1))
+				}
+				return nil
+			})
+		case codecGzip:
+			gz, err := gzip.NewReader(a.Reader)
+			if err != nil {
+				a.Close()
+				return nil, errors.Wrapf(err, "Decompressing %v failed", file)
+			}
+			a.Reader = gz
+			a.closers = append(a.closers, gz.Close)
+		case codecZstd:
+			zr, err := zstd.NewReader(a.Reader)
+			if err != nil {
+				a.Close()
+				return nil, errors.Wrapf(err, "Decompressing %v failed", file)
+			}
+			a.Reader = zr
+			a.closers = append(a.closers, func() error {
+				zr.Close()
+				return nil
+			})
+		case codecLz4:
+			var stderr bytes.Buffer
+			cmd := exec.CommandContext(ctx, "lz4", "-d", "-c")
+			cmd.Stdin = a.Reader
+			cmd.Stderr = &stderr
+			out, err := cmd.StdoutPipe()
+			if err == nil {
+				err = command.Start(cmd)
+			}
+			if err != nil {
+				a.Close()
+				return nil, errors.Wrapf(err, "Decompressing %v failed", file)
+			}
+			a.Reader = out
+			a.closers = append(a.closers, func() error {
+				out.Close()
+				if err := cmd.Wait(); err != nil {
+					return errors.Wrapf(err, "Decompressing %v failed %v", file,
+						strings.Replace(stderr.String(), "\n", " ", -1))
+				}
+				return nil
+			})
+		}
+	}
+	a.Tar = isTar
+
+	return a, nil
+}
+
+// FromFile loads the archive stored in file into the mongod at uri,
+// args are passed to mongorestore as is.
+func FromFile(ctx context.Context, file string, uri string, args ...string) (string, error) {
+	return fromFile(ctx, file, uri, nil, args)
+}
+
+// fromFile reports the unpack and restore phases to p.
+func fromFile(ctx context.Context, file string, uri string, p *Progress, args []string) (string, error) {
+	if strings.HasSuffix(file, CollectionsExt) {
+		return fromCollections(ctx, file, uri, p, args)
+	}
+	if p != nil {
+		phase := PhaseRestore
+		if strings.Contains(filepath.Base(file), ".tar") {
+			phase = PhaseUnpack
+		}
+		p.Phase(phase, archiveSize(file))
+	}
+	archive, err := openArchive(ctx, file, p)
+	if err != nil {
+		return "", err
+	}
+
+	cmd := exec.CommandContext(ctx, "mongorestore", append([]string{"--archive", "--uri", uri}, args...)...)
+	cmd.Stdin = archive
+	if archive.Tar {
+		dir, err := ioutil.TempDir("", "mgob-restore-")
+		if err == nil {
+			defer os.RemoveAll(dir)
+			err = untar(archive, dir)
+		}
+		if err != nil {
+			archive.Close()
+			return "", errors.Wrapf(err, "Unpacking %v failed", file)
+		}
+		p.restoreUnpacked(dirSize(dir))
+		cmd = exec.CommandContext(ctx, "mongorestore", append(append([]string{"--uri", uri}, args...), "--dir", dir)...)
+	}
+	output, err := runRestore(cmd, p)
+	if cerr := archive.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return "", errors.Wrapf(err, "mongorestore log %v", strings.Replace(output, "\n", " ", -1))
+	}
+	return output, nil
+}
+
+// FromReader loads the archive read from r into the mongod at uri, e.g. the
+// stdout of mongodump, and reports the restore phase to p.
+func FromReader(ctx context.Context, r io.Reader, uri string, p *Progress, args []string) (string, error) {
+	p.Phase(PhaseRestore, 0)
+	cmd := exec.CommandContext(ctx, "mongorestore", append([]string{"--archive", "--uri", uri}, args...)...)
+	cmd.Stdin = r
+	output, err := runRestore(cmd, p)
+	if err != nil {
+		return output, errors.Wrapf(err, "mongorestore log %v", strings.Replace(output, "\n", " ", -1))
+	}
+	return output, nil
+}
+
+// runRestore runs the mongorestore cmd and returns its log, parsed by p as it's written.
+func runRestore(cmd *exec.Cmd, p *Progress) (string, error) {
+	var output bytes.Buffer
+	var log io.Writer = &output
+	if p != nil {
+		pr, pw := io.Pipe()
+		parsed := make(chan struct{})
+		go func() {
+			p.parse(pr)
+			close(parsed)
+		}()
+		defer func() {
+			pw.Close()
+			<-parsed
+		}()
+		log = io.MultiWriter(&output, pw)
+	}
+	cmd.Stdout = log
+	cmd.Stderr = log
+	err := command.Run(cmd)
+	return output.String(), err
+}
+
+// untar extracts the tar stream r into dir, entries escaping dir are rejected.
+func untar(r io.Reader, dir string) error {
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		path := filepath.Join(dir, filepath.FromSlash(hdr.Name))
+		if !strings.HasPrefix(path, filepath.Clean(dir)+string(os.PathSeparator)) {
+			return errors.Errorf("invalid entry %v", hdr.Name)
+		}
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(path, 0755); err != nil {
+				return err
+			}
+		case tar.TypeReg:
+			if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+				return err
+			}
+			f, err := os.Create(path)
+			if err != nil {
+				return err
+			}
+			_, err = io.Copy(f, tr)
+			if cerr := f.Close(); err == nil {
+				err = cerr
+			}
+			if err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// ImportKey adds the private key in file to the gpg keyring so encrypted archives can be opened.
+func ImportKey(ctx context.Context, file string) error {
+	output, err := command.CombinedOutput(exec.CommandContext(ctx, "gpg", "--batch", "--import", file))
+	if err != nil {
+		return errors.Wrapf(err, "Importing key %v failed %v", file, strings.Replace(string(output), "\n", " ", -1))
+	}
+	return nil
+}
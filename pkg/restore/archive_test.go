@@ -0,0 +1,115 @@
+package restore
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+func TestArchiveCodecs(t *testing.T) {
+	tests := []struct {
+		name   string
+		codecs []string
+		tar    bool
+	}{
+		{"mongo-test-1494256295.tar.gz", []string{codecGzip}, true},
+		{"mongo-test-1494256295.tar.zst", []string{codecZstd}, true},
+		{"mongo-test-1494256295.tar.lz4", []string{codecLz4}, true},
+		{"mongo-test-1494256295.tar.gz.encrypted", []string{codecEncrypted, codecGzip}, true},
+		{"mongo-test-1494256295.tar", []string{}, true},
+		{"mongo-test-1494256295.gz", []string{codecGzip}, false},
+		{"mongo-test-1494256295.gz.encrypted", []string{codecEncrypted, codecGzip}, false},
+		{"mongo-test-1494256295.zst.encrypted", []string{codecEncrypted, codecZstd}, false},
+		{"mongo-test-1494256295.archive", []string{}, false},
+	}
+	for _, tt := range tests {
+		codecs, isTar := archiveCodecs(tt.name)
+		if !reflect.DeepEqual(codecs, tt.codecs) || isTar != tt.tar {
+			t.Errorf("archiveCodecs(%q) = %v, %v, want %v, %v", tt.name, codecs, isTar, tt.codecs, tt.tar)
+		}
+	}
+}
+
+func TestOpenArchive(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mgob-archive-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var tarball bytes.Buffer
+	tw := tar.NewWriter(&tarball)
+	content := []byte("dump")
+	if err := tw.WriteHeader(&tar.Header{Name: "db/coll.bson", Mode: 0644, Size: int64(len(content)), Typeflag: tar.TypeReg}); err != nil {
+		t.Fatal(err)
+	}
+	tw.Write(content)
+	tw.Close()
+
+	var gz bytes.Buffer
+	gw := gzip.NewWriter(&gz)
+	gw.Write(tarball.Bytes())
+	gw.Close()
+	var zs bytes.Buffer
+	zw, err := zstd.NewWriter(&zs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	zw.Write(tarball.Bytes())
+	zw.Close()
+
+	files := map[string][]byte{
+		"plan-1.tar.gz":  gz.Bytes(),
+		"plan-2.tar.zst": zs.Bytes(),
+		"plan-3.tar":     tarball.Bytes(),
+		"plan-4.gz":      gz.Bytes(),
+		// a split archive is read from its first part
+		"plan-5.tar.gz.part000": gz.Bytes()[:10],
+		"plan-5.tar.gz.part001": gz.Bytes()[10:],
+	}
+	for name, data := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		file string
+		tar  bool
+		want []byte
+	}{
+		{"plan-1.tar.gz", true, tarball.Bytes()},
+		{"plan-2.tar.zst", true, tarball.Bytes()},
+		{"plan-3.tar", true, tarball.Bytes()},
+		{"plan-4.gz", false, tarball.Bytes()},
+		{"plan-5.tar.gz.part000", true, tarball.Bytes()},
+	}
+	for _, tt := range tests {
+		a, err := OpenArchive(context.Background(), filepath.Join(dir, tt.file))
+		if err != nil {
+			t.Fatalf("OpenArchive(%v) failed %v", tt.file, err)
+		}
+		got, err := ioutil.ReadAll(a)
+		if cerr := a.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil && err != io.EOF {
+			t.Fatalf("reading %v failed %v", tt.file, err)
+		}
+		if a.Tar != tt.tar {
+			t.Errorf("OpenArchive(%v).Tar = %v, want %v", tt.file, a.Tar, tt.tar)
+		}
+		if !bytes.Equal(got, tt.want) {
+			t.Errorf("OpenArchive(%v) read %v bytes, want the %v bytes of the tar", tt.file, len(got), len(tt.want))
+		}
+	}
+}
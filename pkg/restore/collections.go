@@ -0,0 +1,107 @@
+package restore
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// CollectionsExt is the extension of the index of a per collection backup.
+const CollectionsExt = ".collections.json"
+
+// Collections is the index of a per collection backup, the files of the
+// mongodump directory are stored and uploaded one by one next to it.
+type Collections struct {
+	Files []CollectionFile `json:"files"`
+}
+
+// CollectionFile maps a file of the mongodump directory to its stored copy,
+// the first part when it's split.
+type CollectionFile struct {
+	Path string `json:"path"`
+	File string `json:"file"`
+	Size int64  `json:"size"`
+}
+
+// ReadCollections decodes the per collection backup index in file.
+func ReadCollections(file string) (*Collections, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Reading %v failed", file)
+	}
+	c := &Collections{}
+	if err := json.Unmarshal(data, c); err != nil {
+		return nil, errors.Wrapf(err, "Parsing %v failed", file)
+	}
+	return c, nil
+}
+
+// fromCollections unpacks the files listed in the index into a mongodump
+// directory, decrypting and decompressing them, and restores it with
+// mongorestore --dir. The stored files are read next to the index.
+func fromCollections(ctx context.Context, index string, uri string, p *Progress, args []string) (string, error) {
+	idx, err := ReadCollections(index)
+	if err != nil {
+		return "", err
+	}
+	var total int64
+	for _, f := range idx.Files {
+		total += f.Size
+	}
+	p.Phase(PhaseUnpack, total)
+
+	dir, err := ioutil.TempDir("", "mgob-restore-")
+	if err != nil {
+		return "", errors.Wrap(err, "Creating the restore dir failed")
+	}
+	defer os.RemoveAll(dir)
+	for _, f := range idx.Files {
+		// the stored copies are decompressed, mongorestore runs without --gzip
+		path := filepath.Join(dir, filepath.FromSlash(strings.TrimSuffix(f.Path, ".gz")))
+		if !strings.HasPrefix(path, filepath.Clean(dir)+string(os.PathSeparator)) {
+			return "", errors.Errorf("Invalid path %v in %v", f.Path, index)
+		}
+		if err := unpackFile(ctx, filepath.Join(filepath.Dir(index), f.File), path, p); err != nil {
+			return "", errors.Wrapf(err, "Unpacking %v failed", f.File)
+		}
+	}
+	p.restoreUnpacked(dirSize(dir))
+
+	cmd := exec.CommandContext(ctx, "mongorestore", append(append([]string{"--uri", uri}, args...), "--dir", dir)...)
+	output, err := runRestore(cmd, p)
+	if err != nil {
+		return "", errors.Wrapf(err, "mongorestore log %v", strings.Replace(output, "\n", " ", -1))
+	}
+	return output, nil
+}
+
+func unpackFile(ctx context.Context, src string, dst string, p *Progress) error {
+	archive, err := openArchive(ctx, src, p)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		archive.Close()
+		return err
+	}
+	out, err := os.Create(dst)
+	if err != nil {
+		archive.Close()
+		return err
+	}
+	_, err = io.Copy(out, archive)
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if cerr := archive.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
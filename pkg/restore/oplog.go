@@ -0,0 +1,69 @@
+package restore
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"github.com/stefanprodan/mgob/pkg/command"
+)
+
+// Oplog replays the oplog segment stored in file on the mongod at uri,
+// the entries at or after limit are skipped.
+func Oplog(ctx context.Context, file string, uri string, limit primitive.Timestamp) (string, error) {
+	dir, err := ioutil.TempDir("", "mgob-oplog-")
+	if err != nil {
+		return "", errors.Wrapf(err, "Replaying %v failed", file)
+	}
+	defer os.RemoveAll(dir)
+
+	// mongorestore reads --oplogFile as plain bson and wants a dump dir, left empty
+	oplogFile := filepath.Join(dir, "oplog.bson")
+	if err := extract(ctx, file, oplogFile); err != nil {
+		return "", err
+	}
+	dumpDir := filepath.Join(dir, "dump")
+	if err := os.Mkdir(dumpDir, 0755); err != nil {
+		return "", errors.Wrapf(err, "Replaying %v failed", file)
+	}
+
+	output, err := command.CombinedOutput(exec.CommandContext(ctx, "mongorestore", "--uri", uri, "--oplogReplay",
+		"--oplogFile", oplogFile, "--oplogLimit", fmt.Sprintf("%d:%d", limit.T, limit.I), dumpDir))
+	if err != nil {
+		return string(output), errors.Wrapf(err, "Replaying %v failed %v", file,
+			strings.Replace(string(output), "\n", " ", -1))
+	}
+	return string(output), nil
+}
+
+// extract writes the decrypted and decompressed content of the stored file to dst.
+func extract(ctx context.Context, file string, dst string) error {
+	archive, err := OpenArchive(ctx, file)
+	if err != nil {
+		return err
+	}
+	f, err := os.Create(dst)
+	if err != nil {
+		archive.Close()
+		return errors.Wrapf(err, "Creating %v failed", dst)
+	}
+	_, err = io.Copy(f, archive)
+	if cerr := archive.Close(); err == nil {
+		err = cerr
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return errors.Wrapf(err, "Extracting %v failed", file)
+	}
+	return nil
+}
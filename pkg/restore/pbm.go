@@ -0,0 +1,62 @@
+package restore
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/stefanprodan/mgob/pkg/config"
+	"github.com/stefanprodan/mgob/pkg/pbm"
+)
+
+// runPBM restores the PBM backup of the record file with the pbm CLI of the
+// restore target, its PBM agents must use the storage the backup is in.
+// A dry run only checks the backup is visible from the restore target.
+func runPBM(ctx context.Context, plan config.Plan, file string, dryRun bool, p *Progress, res *Result) error {
+	rec, err := pbm.ReadRecord(file)
+	if err != nil {
+		return err
+	}
+	client := pbm.NewClient(plan, plan.Restore.Uri)
+	if plan.Restore.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(plan.Restore.Timeout)*time.Minute)
+		defer cancel()
+	}
+
+	p.Phase(PhaseRestore, 0)
+	if dryRun {
+		b, err := client.Describe(ctx, rec.Name)
+		if err != nil {
+			return err
+		}
+		if b.Status != "done" {
+			return errors.Errorf("pbm backup %v is %v", b.Name, b.Status)
+		}
+		res.Output = fmt.Sprintf("pbm backup %v (%v) is restorable", b.Name, b.Type)
+		return nil
+	}
+
+	name, err := client.StartRestore(ctx, rec.Name)
+	if err != nil {
+		return err
+	}
+	log.WithField("plan", plan.Name).Infof("PBM restore %v of %v started", name, rec.Name)
+	if rec.Type == "physical" {
+		// the mongod nodes restart, PBM reports the outcome once the cluster is back
+		res.Output = fmt.Sprintf("pbm physical restore %v started, check it with pbm describe-restore", name)
+		return nil
+	}
+	r, err := client.WaitRestore(ctx, name)
+	if err != nil && ctx.Err() == context.DeadlineExceeded {
+		return errors.Errorf("Restore timed out after %v minutes", plan.Restore.Timeout)
+	}
+	if err != nil {
+		return err
+	}
+	res.Output = fmt.Sprintf("pbm restore %v %v", r.Name, r.Status)
+	return nil
+}
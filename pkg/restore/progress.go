@@ -0,0 +1,229 @@
+package restore
+
+import (
+	"bufio"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/dustin/go-humanize"
+)
+
+// Restore phases, decryption streams along the restore phase, the decrypt
+// phase is the import of the private key.
+const (
+	PhaseDownload = "download"
+	PhaseDecrypt  = "decrypt"
+	PhaseUnpack   = "unpack"
+	PhaseRestore  = "restore"
+	PhaseDone     = "done"
+)
+
+var (
+	// [########................]  db.coll  12.3MB/45.6MB  (27.0%)
+	progressLine = regexp.MustCompile(`\]\s+(\S+)\s+([\d.]+\s?[A-Za-z]*)/([\d.]+\s?[A-Za-z]*)\s+\(([\d.]+)%\)`)
+	// finished restoring db.coll (1000 documents, 0 failures)
+	finishedLine = regexp.MustCompile(`finished restoring (\S+) \((\d+) documents?, (\d+) failures?\)`)
+)
+
+// ProgressStatus is a snapshot of a restore progress. Bytes and Total are the
+// archive bytes of the phase, Percent is parsed from the mongorestore
+// progress bars when the archive was unpacked first.
+type ProgressStatus struct {
+	Phase     string  `json:"phase"`
+	Bytes     int64   `json:"bytes"`
+	Total     int64   `json:"total,omitempty"`
+	Percent   float64 `json:"percent"`
+	Namespace string  `json:"namespace,omitempty"`
+	Documents int64   `json:"documents"`
+	Failures  int64   `json:"failures"`
+}
+
+// Progress tracks a running restore, it's safe for concurrent use
+// and a nil Progress ignores the updates.
+type Progress struct {
+	mu     sync.Mutex
+	status ProgressStatus
+	// unpacked is set when Total is the size of the unpacked collections
+	unpacked bool
+	done     map[string]int64
+	sizes    map[string]int64
+}
+
+// NewProgress returns a progress in the download phase.
+func NewProgress() *Progress {
+	return &Progress{status: ProgressStatus{Phase: PhaseDownload}}
+}
+
+// Status returns a snapshot of the progress.
+func (p *Progress) Status() ProgressStatus {
+	if p == nil {
+		return ProgressStatus{}
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.status
+}
+
+// Phase starts phase, total is the number of bytes it processes or 0 when unknown.
+func (p *Progress) Phase(phase string, total int64) {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.status.Phase, p.status.Bytes, p.status.Total, p.status.Percent = phase, 0, total, 0
+	if phase == PhaseDone {
+		p.status.Percent = 100
+	}
+}
+
+// Set updates the bytes processed by the current phase.
+func (p *Progress) Set(bytes int64) {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.setBytes(bytes)
+}
+
+// Add adds n bytes to the bytes processed by the current phase.
+func (p *Progress) Add(n int64) {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.setBytes(p.status.Bytes + n)
+}
+
+func (p *Progress) setBytes(bytes int64) {
+	p.status.Bytes = bytes
+	if p.status.Total > 0 && !p.unpacked {
+		p.status.Percent = percent(bytes, p.status.Total)
+	}
+}
+
+// restoreUnpacked starts the restore of an unpacked archive, its progress
+// comes from the mongorestore output.
+func (p *Progress) restoreUnpacked(total int64) {
+	if p == nil {
+		return
+	}
+	p.Phase(PhaseRestore, total)
+	p.mu.Lock()
+	p.unpacked = true
+	p.done, p.sizes = make(map[string]int64), make(map[string]int64)
+	p.mu.Unlock()
+}
+
+// parse reads the mongorestore log lines of r until EOF.
+func (p *Progress) parse(r io.Reader) {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		p.line(scanner.Text())
+	}
+	io.Copy(ioutil.Discard, r)
+}
+
+func (p *Progress) line(line string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if m := finishedLine.FindStringSubmatch(line); m != nil {
+		docs, _ := strconv.ParseInt(m[2], 10, 64)
+		failures, _ := strconv.ParseInt(m[3], 10, 64)
+		p.status.Documents += docs
+		p.status.Failures += failures
+		if p.unpacked {
+			p.done[m[1]] = p.sizes[m[1]]
+			p.sumUnpacked()
+		}
+		return
+	}
+	if m := progressLine.FindStringSubmatch(line); m != nil {
+		p.status.Namespace = m[1]
+		if !p.unpacked {
+			return
+		}
+		p.done[m[1]], p.sizes[m[1]] = parseAmount(m[2]), parseAmount(m[3])
+		p.sumUnpacked()
+	}
+}
+
+func (p *Progress) sumUnpacked() {
+	var done int64
+	for _, n := range p.done {
+		done += n
+	}
+	p.status.Bytes = done
+	if p.status.Total > 0 {
+		p.status.Percent = percent(done, p.status.Total)
+	}
+}
+
+// parseAmount reads a mongorestore byte amount, its KB and MB are 1024 based.
+func parseAmount(v string) int64 {
+	v = strings.Replace(v, " ", "", -1)
+	if strings.HasSuffix(v, "B") && len(v) > 2 && v[len(v)-2] >= 'A' && v[len(v)-2] <= 'Z' {
+		v = v[:len(v)-1] + "iB"
+	}
+	n, _ := humanize.ParseBytes(v)
+	return int64(n)
+}
+
+func percent(n int64, total int64) float64 {
+	v := float64(n) * 100 / float64(total)
+	if v > 100 {
+		v = 100
+	}
+	// one decimal is enough for a progress report
+	return float64(int64(v*10)) / 10
+}
+
+// countingReader reports the bytes read through it to a progress.
+type countingReader struct {
+	r io.Reader
+	p *Progress
+}
+
+func (c *countingReader) Read(b []byte) (int, error) {
+	n, err := c.r.Read(b)
+	c.p.Add(int64(n))
+	return n, err
+}
+
+// archiveSize is the size of the archive stored in file, all its parts when split.
+func archiveSize(file string) int64 {
+	if !strings.HasSuffix(file, ".part000") {
+		if fi, err := os.Stat(file); err == nil {
+			return fi.Size()
+		}
+		return 0
+	}
+	var size int64
+	parts, _ := filepath.Glob(strings.TrimSuffix(file, "000") + "[0-9][0-9][0-9]")
+	for _, part := range parts {
+		if fi, err := os.Stat(part); err == nil {
+			size += fi.Size()
+		}
+	}
+	return size
+}
+
+// dirSize is the size of the collection files of an unpacked dump.
+func dirSize(dir string) int64 {
+	var size int64
+	filepath.Walk(dir, func(path string, fi os.FileInfo, err error) error {
+		if err == nil && !fi.IsDir() && strings.HasSuffix(path, ".bson") {
+			size += fi.Size()
+		}
+		return nil
+	})
+	return size
+}
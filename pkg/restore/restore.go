@@ -0,0 +1,130 @@
+package restore
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/stefanprodan/mgob/pkg/clock"
+	"github.com/stefanprodan/mgob/pkg/config"
+)
+
+// Result is the outcome of a restore, Output holds the mongorestore log.
+type Result struct {
+	Plan    string `json:"plan"`
+	Archive string `json:"archive"`
+	// Source is Local or the destination the archive was downloaded from
+	Source    string        `json:"source"`
+	Timestamp time.Time     `json:"timestamp"`
+	Duration  time.Duration `json:"duration"`
+	Status    string        `json:"status"`
+	DryRun    bool          `json:"dryRun,omitempty"`
+	Error     string        `json:"error,omitempty"`
+	Output    string        `json:"output,omitempty"`
+}
+
+// Run loads the archive stored in file into the plan restore target, with dryRun
+// mongorestore reads the archive and reports what it would do without writing.
+// The phases and bytes restored are reported to p when not nil.
+func Run(ctx context.Context, plan config.Plan, file string, dryRun bool, p *Progress) (Result, error) {
+	archive := filepath.Base(file)
+	res := Result{Plan: plan.Name, Archive: archive, Timestamp: clock.Now().UTC(), Status: "failed", DryRun: dryRun}
+	if plan.Restore == nil || plan.Restore.Uri == "" {
+		return res, errors.Errorf("Plan %v has no restore target", plan.Name)
+	}
+
+	if plan.Mode == config.BackupModeSnapshot {
+		return res, errors.Errorf("%v is a dbPath copy, extract it into the dbPath of a stopped mongod to restore it", archive)
+	}
+	if plan.Mode == config.BackupModeCSI {
+		return res, errors.Errorf("%v records a VolumeSnapshot, restore it by creating a PVC from the snapshot", archive)
+	}
+	if plan.Mode == config.BackupModeDisk {
+		return res, errors.Errorf("%v records cloud disk snapshots, restore them by creating volumes from the snapshots", archive)
+	}
+	if plan.Mode == config.BackupModeAtlas {
+		return res, errors.Errorf("%v records an Atlas snapshot, restore it from Atlas", archive)
+	}
+	if plan.Mode == config.BackupModeMigrate {
+		return res, errors.Errorf("%v records a migration, the data is in the migrate uri", archive)
+	}
+	if plan.Mode == config.BackupModeExport {
+		return res, errors.Errorf("%v is a mongoexport, load it with mongoimport", archive)
+	}
+
+	t1 := clock.Now()
+	log.WithField("plan", plan.Name).Infof("Restore of %v started, dry run %v", archive, dryRun)
+	var err error
+	if plan.Mode == config.BackupModePBM {
+		err = runPBM(ctx, plan, file, dryRun, p, &res)
+	} else {
+		err = run(ctx, plan, plan.Restore, file, dryRun, p, &res)
+	}
+	res.Duration = clock.Since(t1)
+	if err != nil {
+		res.Error = err.Error()
+		log.WithField("plan", plan.Name).Errorf("Restore of %v failed %v", archive, err)
+		return res, err
+	}
+	res.Status = "ok"
+	log.WithField("plan", plan.Name).Infof("Restore of %v finished in %v", archive, res.Duration)
+	return res, nil
+}
+
+func run(ctx context.Context, plan config.Plan, target *config.Restore, file string, dryRun bool, p *Progress, res *Result) error {
+	if target.KeyFile != "" {
+		p.Phase(PhaseDecrypt, 0)
+		if err := ImportKey(ctx, target.KeyFile); err != nil {
+			return err
+		}
+	}
+
+	args := make([]string, 0)
+	if dryRun {
+		// verbose lists the namespaces the archive maps to
+		args = append(args, "--dryRun", "--verbose")
+	}
+	if plan.Target.PointInTime {
+		args = append(args, "--oplogReplay")
+	}
+	if !target.NoDrop {
+		args = append(args, "--drop")
+	}
+	for _, ns := range target.Namespaces {
+		args = append(args, "--nsFrom", ns.From, "--nsTo", ns.To)
+	}
+	if target.NumParallelCollections > 0 {
+		args = append(args, fmt.Sprintf("--numParallelCollections=%v", target.NumParallelCollections))
+	}
+	if target.NumInsertionWorkersPerCollection > 0 {
+		args = append(args, fmt.Sprintf("--numInsertionWorkersPerCollection=%v", target.NumInsertionWorkersPerCollection))
+	}
+	if target.BypassDocumentValidation {
+		args = append(args, "--bypassDocumentValidation")
+	}
+	args = append(args, config.SplitParams(target.Params)...)
+	if plan.Target.FieldEncryption != nil {
+		for _, arg := range args {
+			if arg == "--noOptionsRestore" {
+				return errors.New("--noOptionsRestore drops the encryptedFields of the queryable encryption collections")
+			}
+		}
+	}
+
+	if target.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(target.Timeout)*time.Minute)
+		defer cancel()
+	}
+	output, err := fromFile(ctx, file, target.Uri, p, args)
+	res.Output = output
+	log.WithField("plan", plan.Name).Debugf("Restore output: %v", output)
+	if err != nil && ctx.Err() == context.DeadlineExceeded {
+		return errors.Errorf("Restore timed out after %v minutes", target.Timeout)
+	}
+	return err
+}
@@ -0,0 +1,72 @@
+package restore
+
+import (
+	"context"
+	"io"
+	"time"
+)
+
+// holdInterval is how often a held restore checks if it can go on.
+const holdInterval = time.Second
+
+// Throttle limits the archive stream of a restore, mongorestore stalls on
+// its input meanwhile. The unpacked directory format backups are throttled
+// while they're unpacked only.
+type Throttle struct {
+	// Rate in bytes per second, 0 means no limit
+	Rate int64
+	// Hold tells if the stream must stop, it's polled until it returns false
+	Hold func() bool
+}
+
+type throttleKey struct{}
+
+// WithThrottle returns a context whose restores are limited by t.
+func WithThrottle(ctx context.Context, t *Throttle) context.Context {
+	return context.WithValue(ctx, throttleKey{}, t)
+}
+
+type throttledReader struct {
+	ctx   context.Context
+	r     io.Reader
+	t     *Throttle
+	start time.Time
+	n     int64
+}
+
+func (r *throttledReader) Read(b []byte) (int, error) {
+	if r.t.Hold != nil && r.t.Hold() {
+		for r.t.Hold() {
+			if err := r.wait(holdInterval); err != nil {
+				return 0, err
+			}
+		}
+		// the rate restarts after a hold instead of catching up
+		r.start, r.n = time.Now(), 0
+	}
+	if r.t.Rate > 0 && int64(len(b)) > r.t.Rate {
+		b = b[:r.t.Rate]
+	}
+	n, err := r.r.Read(b)
+	if r.t.Rate > 0 && n > 0 {
+		r.n += int64(n)
+		due := time.Duration(float64(r.n) / float64(r.t.Rate) * float64(time.Second))
+		if ahead := due - time.Since(r.start); ahead > 0 {
+			if werr := r.wait(ahead); werr != nil {
+				return n, werr
+			}
+		}
+	}
+	return n, err
+}
+
+func (r *throttledReader) wait(d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-r.ctx.Done():
+		return r.ctx.Err()
+	case <-t.C:
+		return nil
+	}
+}
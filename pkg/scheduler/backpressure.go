@@ -0,0 +1,64 @@
+package scheduler
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/stefanprodan/mgob/pkg/backup"
+	"github.com/stefanprodan/mgob/pkg/clock"
+	"github.com/stefanprodan/mgob/pkg/config"
+	"github.com/stefanprodan/mgob/pkg/notifier"
+)
+
+// pressureInterval is how often a delayed backup checks the thresholds again.
+const pressureInterval = 15 * time.Second
+
+// waitPressure delays the scheduled backup of plan while the uploads or the tmp
+// dir are above the thresholds. It returns false when the backup must be skipped,
+// the wait exceeded the max delay or ctx is done.
+func (s *Scheduler) waitPressure(ctx context.Context, plan config.Plan) bool {
+	reason, msg, err := backup.Pressure(s.Config)
+	if err != nil {
+		log.WithField("plan", plan.Name).Errorf("Backpressure check failed %v", err)
+		return true
+	}
+	if reason == "" {
+		return true
+	}
+
+	log.WithField("plan", plan.Name).Warnf("Backup delayed, %v", msg)
+	s.metrics.Delayed.WithLabelValues(s.metrics.Plan(plan.Name)).Set(1)
+	s.metrics.DelayTotal.WithLabelValues(s.metrics.Plan(plan.Name), reason).Inc()
+	defer s.metrics.Delayed.WithLabelValues(s.metrics.Plan(plan.Name)).Set(0)
+	if err := notifier.SendNotification(fmt.Sprintf("%v backup delayed", plan.Name),
+		msg, true, plan); err != nil {
+		log.WithField("plan", plan.Name).Errorf("Notifier failed %v", err)
+	}
+
+	t1 := clock.Now()
+	deadline := time.NewTimer(time.Duration(s.Config.MaxDelay) * time.Minute)
+	defer deadline.Stop()
+	ticker := time.NewTicker(pressureInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return false
+		case <-deadline.C:
+			log.WithField("plan", plan.Name).Errorf("Backup skipped after a %v delay, %v", clock.Since(t1), msg)
+			if err := notifier.SendNotification(fmt.Sprintf("%v backup skipped", plan.Name),
+				fmt.Sprintf("Delayed for %v, %v", clock.Since(t1), msg), true, plan); err != nil {
+				log.WithField("plan", plan.Name).Errorf("Notifier failed %v", err)
+			}
+			return false
+		case <-ticker.C:
+			if reason, msg, err = backup.Pressure(s.Config); err != nil || reason == "" {
+				log.WithField("plan", plan.Name).Infof("Backup resumed after a %v delay", clock.Since(t1))
+				return true
+			}
+		}
+	}
+}
@@ -0,0 +1,295 @@
+package scheduler
+
+import (
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/dustin/go-humanize"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/stefanprodan/mgob/pkg/clock"
+)
+
+// cacheIndex lists the cached archives, it's kept in the cache dir.
+const cacheIndex = "index.json"
+
+// CachedArchive is a downloaded archive kept for the next restores of it.
+type CachedArchive struct {
+	Plan    string       `json:"plan"`
+	Archive string       `json:"archive"`
+	Files   []CachedFile `json:"files"`
+	Size    int64        `json:"size"`
+	Cached  time.Time    `json:"cached"`
+	Used    time.Time    `json:"used"`
+	Hits    int          `json:"hits"`
+}
+
+// CachedFile is a downloaded file, the archive or one of its parts, and its
+// sha256 checked before each use.
+type CachedFile struct {
+	Name   string `json:"name"`
+	Sha256 string `json:"sha256"`
+}
+
+// downloadCache keeps the archives downloaded for restores in dir, the least
+// recently used ones are evicted when they take more than limit bytes. A nil
+// cache caches nothing.
+type downloadCache struct {
+	mu      sync.Mutex
+	dir     string
+	limit   int64
+	entries map[string]*CachedArchive
+}
+
+// newDownloadCache loads the index of dir, dropping the entries whose files are gone.
+func newDownloadCache(dir string, limit int64) *downloadCache {
+	c := &downloadCache{dir: dir, limit: limit, entries: make(map[string]*CachedArchive)}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		log.Warnf("Creating the download cache dir %v failed %v", dir, err)
+	}
+	if data, err := ioutil.ReadFile(filepath.Join(dir, cacheIndex)); err == nil {
+		list := make([]*CachedArchive, 0)
+		if err := json.Unmarshal(data, &list); err != nil {
+			log.Warnf("Download cache index %v is invalid %v", filepath.Join(dir, cacheIndex), err)
+		}
+		for _, e := range list {
+			if c.present(e) {
+				c.entries[cacheKey(e.Plan, e.Archive)] = e
+			}
+		}
+	}
+	return c
+}
+
+func cacheKey(plan string, archive string) string {
+	return plan + "/" + archive
+}
+
+func (c *downloadCache) present(e *CachedArchive) bool {
+	for _, f := range e.Files {
+		if _, err := os.Stat(filepath.Join(c.dir, e.Plan, f.Name)); err != nil {
+			return false
+		}
+	}
+	return true
+}
+
+// get links the cached files of archive into the tmp dir, like a download
+// would write them, once their checksums match. ok is false on a miss, a
+// corrupted copy is evicted.
+func (c *downloadCache) get(plan string, archive string, tmp string) ([]string, bool) {
+	if c == nil {
+		return nil, false
+	}
+	c.mu.Lock()
+	e, ok := c.entries[cacheKey(plan, archive)]
+	var entry CachedArchive
+	if ok {
+		e.Used = clock.Now().UTC()
+		e.Hits++
+		entry = *e
+	}
+	c.mu.Unlock()
+	if !ok {
+		return nil, false
+	}
+
+	files := make([]string, 0, len(entry.Files))
+	for _, f := range entry.Files {
+		dst := filepath.Join(tmp, f.Name)
+		files = append(files, dst)
+		sum, err := linkFile(filepath.Join(c.dir, plan, f.Name), dst)
+		if err == nil && sum != f.Sha256 {
+			err = errors.Errorf("sha256 %v doesn't match %v", sum, f.Sha256)
+		}
+		if err != nil {
+			log.WithField("plan", plan).Warnf("Cached copy of %v evicted, %v %v", archive, f.Name, err)
+			for _, f := range files {
+				os.Remove(f)
+			}
+			c.drop(plan, archive)
+			return nil, false
+		}
+	}
+	c.save()
+	return files, true
+}
+
+// put copies the downloaded files of archive into the cache and evicts the
+// least recently used archives over the limit. Archives over the limit
+// aren't cached.
+func (c *downloadCache) put(plan string, archive string, files []string) {
+	if c == nil {
+		return
+	}
+	var size int64
+	for _, f := range files {
+		if fi, err := os.Stat(f); err == nil {
+			size += fi.Size()
+		}
+	}
+	if size > c.limit {
+		log.WithField("plan", plan).Infof("%v not cached, %v is over the cache size", archive, humanize.Bytes(uint64(size)))
+		return
+	}
+	if err := os.MkdirAll(filepath.Join(c.dir, plan), 0755); err != nil {
+		log.WithField("plan", plan).Warnf("Caching %v failed %v", archive, err)
+		return
+	}
+	now := clock.Now().UTC()
+	e := &CachedArchive{Plan: plan, Archive: archive, Files: make([]CachedFile, 0, len(files)), Size: size, Cached: now, Used: now}
+	for _, f := range files {
+		name := filepath.Base(f)
+		sum, err := linkFile(f, filepath.Join(c.dir, plan, name))
+		if err != nil {
+			log.WithField("plan", plan).Warnf("Caching %v failed %v", archive, err)
+			for _, cf := range e.Files {
+				os.Remove(filepath.Join(c.dir, plan, cf.Name))
+			}
+			os.Remove(filepath.Join(c.dir, plan, name))
+			return
+		}
+		e.Files = append(e.Files, CachedFile{Name: name, Sha256: sum})
+	}
+
+	c.mu.Lock()
+	c.entries[cacheKey(plan, archive)] = e
+	list := c.list()
+	var total int64
+	for _, cached := range list {
+		total += cached.Size
+	}
+	// the list is most recently used first
+	for i := len(list) - 1; i >= 0 && total > c.limit; i-- {
+		if list[i].Plan == plan && list[i].Archive == archive {
+			continue
+		}
+		log.WithField("plan", list[i].Plan).Infof("Cached copy of %v evicted", list[i].Archive)
+		c.remove(list[i])
+		total -= list[i].Size
+	}
+	c.mu.Unlock()
+	c.save()
+	log.WithField("plan", plan).Infof("Cached %v size %v", archive, humanize.Bytes(uint64(size)))
+}
+
+// drop evicts archive, once its remote copies changed.
+func (c *downloadCache) drop(plan string, archive string) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	if e, ok := c.entries[cacheKey(plan, archive)]; ok {
+		c.remove(e)
+	}
+	c.mu.Unlock()
+	c.save()
+}
+
+// purge evicts every cached archive of plan, of all plans when empty.
+func (c *downloadCache) purge(plan string) int {
+	if c == nil {
+		return 0
+	}
+	c.mu.Lock()
+	n := 0
+	for _, e := range c.list() {
+		if plan == "" || e.Plan == plan {
+			c.remove(e)
+			n++
+		}
+	}
+	c.mu.Unlock()
+	c.save()
+	return n
+}
+
+// remove deletes the files of e, the caller must hold c.mu.
+func (c *downloadCache) remove(e *CachedArchive) {
+	for _, f := range e.Files {
+		os.Remove(filepath.Join(c.dir, e.Plan, f.Name))
+	}
+	delete(c.entries, cacheKey(e.Plan, e.Archive))
+}
+
+// list returns the entries most recently used first, the caller must hold c.mu.
+func (c *downloadCache) list() []*CachedArchive {
+	list := make([]*CachedArchive, 0, len(c.entries))
+	for _, e := range c.entries {
+		list = append(list, e)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Used.After(list[j].Used) })
+	return list
+}
+
+func (c *downloadCache) save() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	data, err := json.MarshalIndent(c.list(), "", "  ")
+	if err == nil {
+		index := filepath.Join(c.dir, cacheIndex)
+		if err = ioutil.WriteFile(index+".tmp", data, 0644); err == nil {
+			err = os.Rename(index+".tmp", index)
+		}
+	}
+	if err != nil {
+		log.Warnf("Saving the download cache index failed %v", err)
+	}
+}
+
+// linkFile hard links src to dst, copying it across filesystems, and
+// returns the sha256 of the content.
+func linkFile(src string, dst string) (string, error) {
+	os.Remove(dst)
+	if err := os.Link(src, dst); err != nil {
+		if err := copyFile(src, dst); err != nil {
+			os.Remove(dst)
+			return "", err
+		}
+	}
+	return fileChecksum(dst)
+}
+
+func copyFile(src string, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// CachedArchives lists the archives of the download cache, most recently used first.
+func (s *Scheduler) CachedArchives() []CachedArchive {
+	list := make([]CachedArchive, 0)
+	if s.cache == nil {
+		return list
+	}
+	s.cache.mu.Lock()
+	defer s.cache.mu.Unlock()
+	for _, e := range s.cache.list() {
+		list = append(list, *e)
+	}
+	return list
+}
+
+// PurgeCache evicts the cached archives of plan, of all plans when empty,
+// and returns how many were evicted.
+func (s *Scheduler) PurgeCache(plan string) int {
+	return s.cache.purge(plan)
+}
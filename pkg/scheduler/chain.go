@@ -0,0 +1,148 @@
+package scheduler
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/stefanprodan/mgob/pkg/backup"
+	"github.com/stefanprodan/mgob/pkg/clock"
+	"github.com/stefanprodan/mgob/pkg/config"
+	"github.com/stefanprodan/mgob/pkg/db"
+)
+
+// ChainReport is the outcome of checking a full backup and its incremental segments.
+type ChainReport struct {
+	Plan      string    `json:"plan"`
+	Chain     string    `json:"chain"`
+	Timestamp time.Time `json:"timestamp"`
+	Full      string    `json:"full,omitempty"`
+	Segments  int       `json:"segments"`
+	Valid     bool      `json:"valid"`
+	Problems  []string  `json:"problems,omitempty"`
+}
+
+// Chains returns the chains recorded in the catalog for plan, oldest first.
+func (s *Scheduler) Chains(plan string) ([]string, error) {
+	artifacts, err := s.Catalog.List(plan)
+	if err != nil {
+		return nil, err
+	}
+	seen := make(map[string]bool)
+	chains := make([]string, 0)
+	for _, a := range artifacts {
+		if a.Chain != "" && !seen[a.Chain] {
+			seen[a.Chain] = true
+			chains = append(chains, a.Chain)
+		}
+	}
+	sort.Strings(chains)
+	return chains, nil
+}
+
+// VerifyChain checks the chain has its full, no segment is missing from the
+// sequence and every member is still stored where the catalog says it is.
+func (s *Scheduler) VerifyChain(ctx context.Context, plan config.Plan, chain string) (*ChainReport, error) {
+	artifacts, err := s.Catalog.List(plan.Name)
+	if err != nil {
+		return nil, err
+	}
+	report := &ChainReport{Plan: plan.Name, Chain: chain, Timestamp: clock.Now().UTC()}
+	members := make([]*db.Artifact, 0)
+	for _, a := range artifacts {
+		if a.Chain == chain {
+			members = append(members, a)
+		}
+	}
+	sort.Slice(members, func(i, j int) bool { return members[i].Seq < members[j].Seq })
+
+	next := 0
+	for _, a := range members {
+		if a.Seq == 0 {
+			report.Full = a.Name
+		} else {
+			report.Segments++
+		}
+		for ; next < a.Seq; next++ {
+			if next == 0 {
+				report.Problems = append(report.Problems, "full backup is missing from the catalog")
+			} else {
+				report.Problems = append(report.Problems, fmt.Sprintf("segment %v is missing from the catalog", next))
+			}
+		}
+		if a.Seq == next {
+			next++
+		}
+	}
+	if len(members) == 0 {
+		report.Problems = append(report.Problems, "chain not found in the catalog")
+	}
+
+	report.Problems = append(report.Problems, s.checkStored(ctx, plan, members)...)
+	report.Valid = len(report.Problems) == 0
+	return report, nil
+}
+
+// checkStored reports the chain members no longer present at the destinations they were uploaded to.
+func (s *Scheduler) checkStored(ctx context.Context, plan config.Plan, members []*db.Artifact) []string {
+	problems := make([]string, 0)
+	listings := make(map[string]map[string]int64)
+	for _, routed := range backup.RoutedPlans(plan) {
+		rctx := backup.WithEnv(ctx, routed.Plan)
+		for _, d := range backup.RemoteDestinations(routed.Plan, s.Config, clock.Now()) {
+			key := routed.Route + "/" + d.Name()
+			if !chainUses(members, routed.Route, d.Name()) {
+				continue
+			}
+			objects, err := d.List(rctx)
+			if err != nil {
+				problems = append(problems, err.Error())
+				continue
+			}
+			listings[key] = make(map[string]int64)
+			for _, obj := range objects {
+				listings[key][path.Base(obj.Name)] = obj.Size
+			}
+		}
+	}
+
+	for _, a := range members {
+		for _, dst := range a.Destinations {
+			if dst == "Local" {
+				fi, err := os.Stat(filepath.Join(config.PlanDir(s.Config.StoragePath, plan), a.Name))
+				problems = appendStored(problems, a, dst, err == nil, err == nil && fi.Size() == a.Size)
+				continue
+			}
+			listing, ok := listings[a.Route+"/"+dst]
+			if !ok {
+				continue
+			}
+			size, ok := listing[a.Name]
+			problems = appendStored(problems, a, dst, ok, size == a.Size)
+		}
+	}
+	return problems
+}
+
+func appendStored(problems []string, a *db.Artifact, destination string, found bool, sameSize bool) []string {
+	switch {
+	case !found:
+		return append(problems, fmt.Sprintf("%v is missing from %v", a.Name, destination))
+	case !sameSize:
+		return append(problems, fmt.Sprintf("%v size differs at %v", a.Name, destination))
+	}
+	return problems
+}
+
+func chainUses(members []*db.Artifact, route string, destination string) bool {
+	for _, a := range members {
+		if a.Route == route && contains(a.Destinations, destination) {
+			return true
+		}
+	}
+	return false
+}
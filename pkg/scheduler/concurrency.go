@@ -0,0 +1,74 @@
+package scheduler
+
+import (
+	"context"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/stefanprodan/mgob/pkg/clock"
+	"github.com/stefanprodan/mgob/pkg/config"
+)
+
+// errStopped is returned by the runs the scheduler stopped while they waited for a slot.
+var errStopped = errors.New("Scheduler stopped while the backup waited for a slot")
+
+// acquireSlot holds the backup of plan while MaxConcurrentBackups backups
+// run, the waiting ones get the freed slots in the order they came. It
+// returns false when ctx is done meanwhile, otherwise the func that frees
+// the slot when the backup is done.
+func (s *Scheduler) acquireSlot(ctx context.Context, plan config.Plan) (func(), bool) {
+	if s.slots == nil {
+		return func() {}, true
+	}
+	free := func() { <-s.slots }
+	select {
+	case s.slots <- struct{}{}:
+		return free, true
+	default:
+	}
+
+	log.WithField("plan", plan.Name).Infof("Backup queued, %v backups are running", cap(s.slots))
+	s.metrics.Waiting.WithLabelValues(s.metrics.Plan(plan.Name)).Set(1)
+	defer s.metrics.Waiting.WithLabelValues(s.metrics.Plan(plan.Name)).Set(0)
+	t1 := clock.Now()
+	select {
+	case s.slots <- struct{}{}:
+		log.WithField("plan", plan.Name).Infof("Backup resumed after a %v wait for a slot", clock.Since(t1))
+		return free, true
+	case <-ctx.Done():
+		return nil, false
+	}
+}
+
+// reserveSlots holds the slots of the n plans of the backup set together, so
+// that the plans start at once after the pre hook, the sets with more plans
+// than MaxConcurrentBackups are rejected when loaded. The sets reserve one at a time, two of them
+// can't each hold part of the slots. It returns false when ctx is done
+// meanwhile, otherwise the func that frees the slots.
+func (s *Scheduler) reserveSlots(ctx context.Context, set string, n int) (func(), bool) {
+	if s.slots == nil {
+		return func() {}, true
+	}
+	s.slotsMu.Lock()
+	defer s.slotsMu.Unlock()
+	held := 0
+	free := func() {
+		for i := 0; i < held; i++ {
+			<-s.slots
+		}
+	}
+	if len(s.slots)+n > cap(s.slots) {
+		log.Infof("Backup set %v queued, waiting for %v backup slots", set, n)
+	}
+	for held < n {
+		select {
+		case s.slots <- struct{}{}:
+			held++
+		case <-ctx.Done():
+			free()
+			return nil, false
+		}
+	}
+	return free, true
+}
@@ -0,0 +1,152 @@
+package scheduler
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stefanprodan/mgob/pkg/config"
+)
+
+// expired returns a context done after d.
+func expired(t *testing.T, d time.Duration) context.Context {
+	ctx, cancel := context.WithTimeout(context.Background(), d)
+	t.Cleanup(cancel)
+	return ctx
+}
+
+func TestAcquireSlot(t *testing.T) {
+	unlimited := newTestScheduler(0)
+	for i := 0; i < 3; i++ {
+		if _, ok := unlimited.acquireSlot(expired(t, time.Millisecond), config.Plan{Name: "a"}); !ok {
+			t.Fatal("a scheduler without limit made a backup wait")
+		}
+	}
+
+	s := newTestScheduler(1)
+	free, ok := s.acquireSlot(s.ctx, config.Plan{Name: "a"})
+	if !ok {
+		t.Fatal("the first backup didn't get the free slot")
+	}
+	if _, ok := s.acquireSlot(expired(t, 20*time.Millisecond), config.Plan{Name: "b"}); ok {
+		t.Fatal("a second backup got a slot over the limit")
+	}
+
+	got := make(chan string, 2)
+	for _, name := range []string{"b", "c"} {
+		name := name
+		go func() {
+			free, ok := s.acquireSlot(s.ctx, config.Plan{Name: name})
+			if ok {
+				got <- name
+				free()
+			}
+		}()
+		// b queues before c
+		time.Sleep(20 * time.Millisecond)
+	}
+	select {
+	case name := <-got:
+		t.Fatalf("%v got a slot while a is running", name)
+	case <-time.After(20 * time.Millisecond):
+	}
+	free()
+	for _, want := range []string{"b", "c"} {
+		select {
+		case name := <-got:
+			if name != want {
+				t.Fatalf("%v got the slot before %v", name, want)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("%v didn't get a freed slot", want)
+		}
+	}
+}
+
+func TestReserveSlots(t *testing.T) {
+	s := newTestScheduler(2)
+	free, _ := s.acquireSlot(s.ctx, config.Plan{Name: "a"})
+	if _, ok := s.reserveSlots(expired(t, 20*time.Millisecond), "set", 2); ok {
+		t.Fatal("the set reserved 2 slots while 1 was free")
+	}
+	if len(s.slots) != 1 {
+		t.Fatalf("the canceled reservation kept %v slots", len(s.slots)-1)
+	}
+
+	reserved := make(chan func())
+	go func() {
+		free, ok := s.reserveSlots(s.ctx, "set", 2)
+		if ok {
+			reserved <- free
+		}
+	}()
+	time.Sleep(20 * time.Millisecond)
+	free()
+	var release func()
+	select {
+	case release = <-reserved:
+	case <-time.After(time.Second):
+		t.Fatal("the set didn't reserve the freed slots")
+	}
+	if _, ok := s.acquireSlot(expired(t, 20*time.Millisecond), config.Plan{Name: "b"}); ok {
+		t.Fatal("a backup got a slot reserved by the set")
+	}
+	release()
+	if len(s.slots) != 0 {
+		t.Fatalf("the set kept %v slots", len(s.slots))
+	}
+}
+
+func TestRunWithRetriesFreesSlot(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mgob-retry-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	conf := &config.AppConfig{TmpPath: dir, StoragePath: dir, DataPath: dir}
+
+	s := newTestScheduler(1)
+	plan := config.Plan{
+		Name:      "failing",
+		Mode:      config.BackupModeExec,
+		Exec:      &config.Exec{Command: config.Command{Line: "exit 1"}},
+		Scheduler: config.Scheduler{Cron: "0 * * * *", Retries: 1, RetryBackoff: 1},
+	}
+	done := make(chan int)
+	go func() {
+		_, retries, _ := s.runWithRetries(s.ctx, plan, conf, &config.ModuleConfig{})
+		done <- retries
+	}()
+
+	// the backoff of the retry lasts a second, another backup runs meanwhile
+	time.Sleep(300 * time.Millisecond)
+	free, ok := s.acquireSlot(expired(t, 500*time.Millisecond), config.Plan{Name: "other"})
+	if !ok {
+		t.Fatal("the slot is held during the retry backoff")
+	}
+	free()
+	select {
+	case retries := <-done:
+		if retries != 1 {
+			t.Fatalf("retried %v times instead of 1", retries)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("the retry didn't run")
+	}
+	if len(s.slots) != 0 {
+		t.Fatalf("the retried backup kept %v slots", len(s.slots))
+	}
+}
+
+func TestRunWithRetriesStopped(t *testing.T) {
+	s := newTestScheduler(1)
+	ctx, cancel := context.WithCancel(context.Background())
+	s.ctx = ctx
+	s.slots <- struct{}{}
+	cancel()
+	if _, _, err := s.runWithRetries(ctx, config.Plan{Name: "a"}, &config.AppConfig{}, &config.ModuleConfig{}); err != errStopped {
+		t.Fatalf("runWithRetries returned %v instead of errStopped", err)
+	}
+}
@@ -0,0 +1,65 @@
+package scheduler
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/stefanprodan/mgob/pkg/backup"
+	"github.com/stefanprodan/mgob/pkg/config"
+	"github.com/stefanprodan/mgob/pkg/notifier"
+)
+
+// observeCost exports the projected monthly storage cost of plan, the plan
+// notifications are sent when it goes over the plan budget.
+func (s *Scheduler) observeCost(plan config.Plan) {
+	if s.Config.Pricing == nil {
+		return
+	}
+	est, err := backup.EstimateCost(plan, s.Config)
+	if err != nil {
+		log.WithField("plan", plan.Name).Warnf("Cost estimate failed %v", err)
+		return
+	}
+	planLabel := s.metrics.Plan(plan.Name)
+	for _, d := range est.Destinations {
+		s.metrics.StorageCost.WithLabelValues(planLabel, s.metrics.Destination(d.Destination), d.Route).Set(d.Monthly)
+	}
+
+	s.mu.Lock()
+	was := s.overBudget[plan.Name]
+	s.overBudget[plan.Name] = est.OverBudget
+	s.mu.Unlock()
+	if !est.OverBudget || was {
+		return
+	}
+	msg := budgetWarning(est)
+	log.WithField("plan", plan.Name).Warn(msg)
+	if err := notifier.SendNotification(fmt.Sprintf("%v over budget", plan.Name), msg, true, plan); err != nil {
+		log.WithField("plan", plan.Name).Errorf("Notifier failed %v", err)
+	}
+}
+
+// Costs returns the projected storage cost of the scheduled plans.
+func (s *Scheduler) Costs() ([]*backup.CostEstimate, error) {
+	if s.Config.Pricing == nil {
+		return nil, errors.New("no pricing configured, start mgob with --PricingPath")
+	}
+	list := make([]*backup.CostEstimate, 0)
+	for _, plan := range s.plans() {
+		est, err := backup.EstimateCost(plan, s.Config)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, est)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Plan < list[j].Plan })
+	return list, nil
+}
+
+func budgetWarning(est *backup.CostEstimate) string {
+	return fmt.Sprintf("projected storage cost of $%.2f/month with retention %v is over the $%.2f budget",
+		est.Monthly, est.Retention, est.Budget)
+}
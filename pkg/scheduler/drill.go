@@ -0,0 +1,162 @@
+package scheduler
+
+import (
+	"bytes"
+	"fmt"
+	htmltemplate "html/template"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/dustin/go-humanize"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/stefanprodan/mgob/pkg/config"
+)
+
+// drillReport matches the reports of the restore drills of an archive, they
+// are named after it and removed with it by the retention.
+var drillReport = regexp.MustCompile(`\.drill-\d+\.(md|html)$`)
+
+var drillExt = map[string]string{config.ReportMarkdown: ".md", config.ReportHTML: ".html"}
+
+var drillFuncs = map[string]interface{}{
+	"duration": func(d time.Duration) string { return d.Round(time.Millisecond).String() },
+	"bytes":    func(n int64) string { return humanize.Bytes(uint64(n)) },
+	"time":     func(t time.Time) string { return t.UTC().Format("2006-01-02 15:04:05 MST") },
+	"join":     strings.Join,
+}
+
+var markdownDrill = template.Must(template.New("drill").Funcs(drillFuncs).Parse(`# Restore drill of {{.Plan}}
+
+| | |
+|---|---|
+| Status | {{.Status}} |
+| Backup taken | {{time .Timestamp}} |
+| Drill started | {{time .Started}} |
+| Duration | {{duration .Duration}} |
+| Archives | {{join .Archives ", "}} |
+| Size | {{bytes .Size}} |
+| Databases | {{.Databases}} |
+| Collections | {{.Collections}} |
+| Documents | {{.Documents}} |
+{{- if .Hashes}}
+| dbHash checked | {{.Hashes}} collections |
+{{- end}}
+
+## Checks
+
+{{if .Problems}}{{range .Problems}}- {{.}}
+{{end}}{{else}}All the sanity checks passed.
+{{end}}
+## Restored documents
+
+| Database | Collection | Documents |
+|---|---|---:|
+{{range .Counts}}| {{.Database}} | {{.Collection}} | {{.Documents}} |
+{{end}}`))
+
+var htmlDrill = htmltemplate.Must(htmltemplate.New("drill").Funcs(drillFuncs).Parse(`<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>Restore drill of {{.Plan}}</title>
+<style>body{font-family:sans-serif}table{border-collapse:collapse}td,th{border:1px solid #ccc;padding:4px 8px;text-align:left}.num{text-align:right}.failed{color:#c00}</style>
+</head>
+<body>
+<h1>Restore drill of {{.Plan}}</h1>
+<table>
+<tr><th>Status</th><td{{if ne .Status "ok"}} class="failed"{{end}}>{{.Status}}</td></tr>
+<tr><th>Backup taken</th><td>{{time .Timestamp}}</td></tr>
+<tr><th>Drill started</th><td>{{time .Started}}</td></tr>
+<tr><th>Duration</th><td>{{duration .Duration}}</td></tr>
+<tr><th>Archives</th><td>{{join .Archives ", "}}</td></tr>
+<tr><th>Size</th><td>{{bytes .Size}}</td></tr>
+<tr><th>Databases</th><td>{{.Databases}}</td></tr>
+<tr><th>Collections</th><td>{{.Collections}}</td></tr>
+<tr><th>Documents</th><td>{{.Documents}}</td></tr>
+{{if .Hashes}}<tr><th>dbHash checked</th><td>{{.Hashes}} collections</td></tr>
+{{end}}</table>
+<h2>Checks</h2>
+{{if .Problems}}<ul class="failed">
+{{range .Problems}}<li>{{.}}</li>
+{{end}}</ul>{{else}}<p>All the sanity checks passed.</p>{{end}}
+<h2>Restored documents</h2>
+<table>
+<tr><th>Database</th><th>Collection</th><th>Documents</th></tr>
+{{range .Counts}}<tr><td>{{.Database}}</td><td>{{.Collection}}</td><td class="num">{{.Documents}}</td></tr>
+{{end}}</table>
+</body>
+</html>
+`))
+
+// writeDrillReports writes the report of a restore drill of plan in the
+// formats of its verify config, next to the first restored archive, and
+// returns their paths under /storage. A drill that found no archive has none.
+func (s *Scheduler) writeDrillReports(plan config.Plan, report *VerifyReport) []string {
+	if plan.Verify == nil || len(plan.Verify.Reports) == 0 || len(report.Archives) == 0 {
+		return nil
+	}
+	dir := s.planDir(plan.Name)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		log.WithField("plan", plan.Name).Warnf("Writing the drill reports failed %v", err)
+		return nil
+	}
+	paths := make([]string, 0, len(plan.Verify.Reports))
+	for _, format := range plan.Verify.Reports {
+		var buf bytes.Buffer
+		var err error
+		switch format {
+		case config.ReportMarkdown:
+			err = markdownDrill.Execute(&buf, report)
+		case config.ReportHTML:
+			err = htmlDrill.Execute(&buf, report)
+		default:
+			continue
+		}
+		name := fmt.Sprintf("%v.drill-%v%v", report.Archives[0], report.Started.Unix(), drillExt[format])
+		file := filepath.Join(dir, name)
+		if err == nil {
+			err = ioutil.WriteFile(file, buf.Bytes(), 0644)
+		}
+		if err != nil {
+			log.WithField("plan", plan.Name).Warnf("Writing the drill report %v failed %v", name, err)
+			continue
+		}
+		rel, err := filepath.Rel(s.Config.StoragePath, file)
+		if err != nil {
+			rel = filepath.Join(plan.Name, name)
+		}
+		paths = append(paths, "/storage/"+filepath.ToSlash(rel))
+	}
+	return paths
+}
+
+// archivesSize sums the catalog sizes of the archives of res, with all the
+// parts of a split archive.
+func (s *Scheduler) archivesSize(plan string, res *Resolution) int64 {
+	artifacts, err := s.Catalog.List(plan)
+	if err != nil {
+		return 0
+	}
+	var size int64
+	for _, a := range artifacts {
+		for _, c := range res.Archives {
+			if a.Name == c.Name || strings.HasSuffix(c.Name, ".part000") && strings.HasPrefix(a.Name, strings.TrimSuffix(c.Name, "000")) {
+				size += a.Size
+				break
+			}
+		}
+	}
+	return size
+}
+
+// reportLinks adds the drill reports of report to a notification body.
+func reportLinks(body string, report *VerifyReport) string {
+	if len(report.Reports) == 0 {
+		return body
+	}
+	return fmt.Sprintf("%v\nDrill report %v", body, strings.Join(report.Reports, ", "))
+}
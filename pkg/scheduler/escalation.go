@@ -0,0 +1,87 @@
+package scheduler
+
+import (
+	"fmt"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/stefanprodan/mgob/pkg/clock"
+	"github.com/stefanprodan/mgob/pkg/config"
+	"github.com/stefanprodan/mgob/pkg/db"
+	"github.com/stefanprodan/mgob/pkg/notifier"
+)
+
+const (
+	defaultEscalationFailures = 3
+	defaultEscalationHours    = 6
+)
+
+// track carries the failure streak of the previous status over to status, a
+// 200 run ends it, a 500 one extends it and the skipped runs leave it as is.
+func track(prev *db.Status, status *db.Status) {
+	if prev != nil {
+		status.Failures, status.FailingSince = prev.Failures, prev.FailingSince
+		status.LastSuccess, status.Escalated = prev.LastSuccess, prev.Escalated
+	}
+	switch status.LastRunStatus {
+	case "200":
+		status.Failures, status.FailingSince, status.Escalated = 0, nil, false
+		status.LastSuccess = status.LastRun
+	case "500":
+		status.Failures++
+		if status.FailingSince == nil {
+			status.FailingSince = status.LastRun
+		}
+	}
+}
+
+// notifyFailure sends the failure of a run to the channels the escalation of
+// plan reached, or to all of them when the plan has no escalation. It can set
+// status.Escalated.
+func notifyFailure(plan config.Plan, status *db.Status, subject string, body string) {
+	esc := plan.Escalation
+	if esc == nil {
+		if err := notifier.SendNotification(subject, body, true, plan); err != nil {
+			log.WithField("plan", plan.Name).Errorf("Notifier failed %v", err)
+		}
+		return
+	}
+
+	if err := notifier.SendSlackNotification(subject, body, true, plan); err != nil {
+		log.WithField("plan", plan.Name).Errorf("Notifier failed %v", err)
+	}
+	if esc.Email != nil {
+		after := esc.Email.After
+		if after <= 0 {
+			after = defaultEscalationFailures
+		}
+		if status.Failures >= after {
+			log.WithField("plan", plan.Name).Warnf("Failure escalated by email after %v consecutive failures", status.Failures)
+			if err := notifier.SendEmailEscalation(fmt.Sprintf("%v (%v consecutive failures)", subject, status.Failures),
+				body, plan); err != nil {
+				log.WithField("plan", plan.Name).Errorf("Escalation email failed %v", err)
+			}
+		}
+	}
+	if esc.Webhook != nil && !status.Escalated {
+		after := esc.Webhook.After
+		if after <= 0 {
+			after = defaultEscalationHours
+		}
+		since := status.LastSuccess
+		if since == nil {
+			since = status.FailingSince
+		}
+		if since != nil && clock.Since(*since) >= time.Duration(after)*time.Hour {
+			log.WithField("plan", plan.Name).Warnf("Failure escalated by webhook, no successful backup since %v", since)
+			err := notifier.SendWebhookEscalation(fmt.Sprintf("%v no successful backup since %v", plan.Name,
+				since.UTC().Format(time.RFC3339)), body, plan)
+			if err != nil {
+				log.WithField("plan", plan.Name).Errorf("Escalation webhook failed %v", err)
+			} else {
+				status.Escalated = true
+			}
+		}
+	}
+}
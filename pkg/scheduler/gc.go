@@ -0,0 +1,59 @@
+package scheduler
+
+import (
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/dustin/go-humanize"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/stefanprodan/mgob/pkg/clock"
+	"github.com/stefanprodan/mgob/pkg/db"
+)
+
+// gcJob prunes the catalog records older than the catalog max age whose
+// archive left the storage dir, then compacts mgob.db. The signed manifests
+// are an append-only log and are never pruned.
+func (s *Scheduler) gcJob() {
+	if s.Config.CatalogMaxAge > 0 {
+		t := clock.Now().AddDate(0, 0, -s.Config.CatalogMaxAge)
+		n, err := s.Catalog.Prune(t, func(a *db.Artifact) bool {
+			if len(a.Pending) > 0 {
+				return true
+			}
+			_, err := os.Stat(filepath.Join(s.planDir(a.Plan), a.Name))
+			return err == nil
+		})
+		if err != nil {
+			log.Errorf("Catalog prune failed %v", err)
+		} else if n > 0 {
+			s.metrics.CatalogPruned.Add(float64(n))
+			log.Infof("Catalog pruned %v records taken before %v", n, t.UTC().Format(time.RFC3339))
+		}
+	}
+
+	t1 := clock.Now()
+	before, after, err := s.Catalog.Compact()
+	if err != nil {
+		log.Errorf("Store compaction failed %v", err)
+	} else {
+		log.Infof("Store compacted from %v to %v in %v", humanize.Bytes(uint64(before)), humanize.Bytes(uint64(after)), clock.Since(t1))
+	}
+	s.observeStore()
+}
+
+// observeStore exports the size and the record counts of mgob.db.
+func (s *Scheduler) observeStore() {
+	if size, err := s.Catalog.Size(); err == nil {
+		s.metrics.DBSize.Set(float64(size))
+	}
+	records, err := s.Catalog.Records()
+	if err != nil {
+		log.Errorf("Store stats failed %v", err)
+		return
+	}
+	for bucket, n := range records {
+		s.metrics.DBRecords.WithLabelValues(bucket).Set(float64(n))
+	}
+}
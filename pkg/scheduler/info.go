@@ -0,0 +1,111 @@
+package scheduler
+
+import (
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/stefanprodan/mgob/pkg/clock"
+	"github.com/stefanprodan/mgob/pkg/db"
+)
+
+// PlanSchedule describes what the scheduler will do next for a plan.
+type PlanSchedule struct {
+	Plan          string      `json:"plan"`
+	Cron          string      `json:"cron"`
+	Next          []time.Time `json:"next"`
+	Paused        bool        `json:"paused"`
+	Running       bool        `json:"running"`
+	LastRun       *time.Time  `json:"last_run,omitempty"`
+	LastRunStatus string      `json:"last_run_status,omitempty"`
+	LastRunLog    string      `json:"last_run_log,omitempty"`
+}
+
+// Info lists the schedule of every plan with its next n fire times.
+func (s *Scheduler) Info(n int) ([]PlanSchedule, error) {
+	plans := s.plans()
+	list := make([]PlanSchedule, 0, len(plans))
+	for _, plan := range plans {
+		info := PlanSchedule{
+			Plan:   plan.Name,
+			Cron:   plan.Scheduler.Cron,
+			Next:   make([]time.Time, 0, n),
+			Paused: s.IsPaused(plan.Name),
+		}
+
+		s.mu.Lock()
+		_, info.Running = s.running[plan.Name]
+		id, ok := s.entries[plan.Name]
+		s.mu.Unlock()
+
+		if ok {
+			schedule := s.Cron.Entry(id).Schedule
+			t := clock.Now()
+			for i := 0; i < n && schedule != nil; i++ {
+				t = schedule.Next(t)
+				info.Next = append(info.Next, t)
+			}
+		}
+
+		status, err := s.Stats.Get(plan.Name)
+		if err != nil {
+			return nil, err
+		}
+		if status != nil {
+			info.LastRun = status.LastRun
+			info.LastRunStatus = status.LastRunStatus
+			info.LastRunLog = status.LastRunLog
+		}
+
+		list = append(list, info)
+	}
+
+	return list, nil
+}
+
+// IsPaused reports whether scheduled runs of plan are skipped.
+func (s *Scheduler) IsPaused(plan string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.paused[plan]
+}
+
+// Pause skips the scheduled runs of plan until Resume is called.
+func (s *Scheduler) Pause(plan string) error {
+	return s.setPaused(plan, true)
+}
+
+// Resume re-enables the scheduled runs of plan.
+func (s *Scheduler) Resume(plan string) error {
+	return s.setPaused(plan, false)
+}
+
+func (s *Scheduler) setPaused(plan string, paused bool) error {
+	s.mu.Lock()
+	if _, ok := s.entries[plan]; !ok {
+		s.mu.Unlock()
+		return errors.Errorf("Plan %v not found", plan)
+	}
+	if paused {
+		s.paused[plan] = true
+	} else {
+		delete(s.paused, plan)
+	}
+	s.mu.Unlock()
+
+	status, err := s.Stats.Get(plan)
+	if err != nil {
+		return err
+	}
+	if status == nil {
+		status = &db.Status{Plan: plan}
+	}
+	status.Paused = paused
+	if err := s.Stats.Put(status); err != nil {
+		return errors.Wrapf(err, "Saving paused state of %v failed", plan)
+	}
+
+	log.WithField("plan", plan).Infof("Plan paused: %v", paused)
+	return nil
+}
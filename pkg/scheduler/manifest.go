@@ -0,0 +1,40 @@
+package scheduler
+
+import (
+	log "github.com/sirupsen/logrus"
+
+	"github.com/stefanprodan/mgob/pkg/backup"
+	"github.com/stefanprodan/mgob/pkg/clock"
+	"github.com/stefanprodan/mgob/pkg/config"
+	"github.com/stefanprodan/mgob/pkg/db"
+)
+
+// Sign appends the signed manifest of a backup run to the manifest log.
+func (s *Scheduler) Sign(plan config.Plan, res backup.Result, err error) {
+	m := &db.Manifest{
+		Plan:      plan.Name,
+		Timestamp: res.Timestamp,
+		Status:    "ok",
+		Name:      res.Name,
+		Size:      res.Size,
+		Checksum:  res.Checksum,
+		Hashes:    res.Hashes,
+	}
+	if m.Timestamp.IsZero() {
+		m.Timestamp = clock.Now().UTC()
+	}
+	if err != nil {
+		m.Status = "failed"
+		if backup.IsUnhealthy(err) {
+			m.Status = "skipped"
+		}
+		m.Error = err.Error()
+	}
+	for _, u := range res.Uploads {
+		m.Uploads = append(m.Uploads, db.ManifestUpload{File: u.File, Route: u.Route, Destinations: u.Destinations})
+	}
+
+	if err := s.Manifests.Append(m); err != nil {
+		log.WithField("plan", plan.Name).Errorf("Manifest store failed %v", err)
+	}
+}
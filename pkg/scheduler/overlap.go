@@ -0,0 +1,88 @@
+package scheduler
+
+import (
+	"context"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/stefanprodan/mgob/pkg/config"
+)
+
+// overlapPoll is the delay between two checks of a queued run.
+var overlapPoll = time.Second
+
+// busy tells if a run of plan is in progress, the caller must hold s.mu.
+func (s *Scheduler) busy(plan string) bool {
+	return s.claimed[plan] != nil || len(s.running[plan]) > 0
+}
+
+// claim applies the overlap policy of plan when a run of it, scheduled,
+// triggered or on demand, is in progress. It reports whether the scheduled
+// run goes ahead, with the context of the run that Cancel and the next
+// cancel-previous run cancel while it waits or runs, release must then be
+// called when it's done.
+func (s *Scheduler) claim(plan config.Plan) (context.Context, func(), bool) {
+	ctx, cancel := context.WithCancel(s.ctx)
+	release := func() {
+		s.mu.Lock()
+		delete(s.claimed, plan.Name)
+		s.mu.Unlock()
+		cancel()
+	}
+	policy := plan.Scheduler.Overlap
+	if policy == "" {
+		policy = config.OverlapSkip
+	}
+
+	s.mu.Lock()
+	if !s.busy(plan.Name) {
+		s.claimed[plan.Name] = cancel
+		s.mu.Unlock()
+		return ctx, release, true
+	}
+	if policy == config.OverlapQueue && s.queued[plan.Name] {
+		s.mu.Unlock()
+		cancel()
+		log.WithField("plan", plan.Name).Info("Backup skipped, a run is already queued")
+		return nil, nil, false
+	}
+	s.metrics.OverlapTotal.WithLabelValues(s.metrics.Plan(plan.Name), string(policy)).Inc()
+	switch policy {
+	case config.OverlapQueue:
+		s.queued[plan.Name] = true
+		log.WithField("plan", plan.Name).Info("Backup queued, the previous run is still running")
+	case config.OverlapCancel:
+		if prev := s.claimed[plan.Name]; prev != nil {
+			prev()
+		}
+		for _, prev := range s.running[plan.Name] {
+			prev()
+		}
+		log.WithField("plan", plan.Name).Warn("Previous run canceled, a new run is starting")
+	default:
+		s.mu.Unlock()
+		cancel()
+		log.WithField("plan", plan.Name).Info("Backup skipped, the previous run is still running")
+		return nil, nil, false
+	}
+	s.mu.Unlock()
+
+	for {
+		if !sleepCtx(ctx, overlapPoll) {
+			s.mu.Lock()
+			delete(s.queued, plan.Name)
+			s.mu.Unlock()
+			cancel()
+			return nil, nil, false
+		}
+		s.mu.Lock()
+		if !s.busy(plan.Name) {
+			s.claimed[plan.Name] = cancel
+			delete(s.queued, plan.Name)
+			s.mu.Unlock()
+			return ctx, release, true
+		}
+		s.mu.Unlock()
+	}
+}
@@ -0,0 +1,161 @@
+package scheduler
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stefanprodan/mgob/pkg/config"
+	"github.com/stefanprodan/mgob/pkg/metrics"
+)
+
+var testMetrics = metrics.New("mgob", "test", metrics.Labels{})
+
+// newTestScheduler returns a scheduler without plans, slots limits the
+// backups running at once when it's positive.
+func newTestScheduler(slots int) *Scheduler {
+	s := &Scheduler{
+		ctx:     context.Background(),
+		running: make(map[string]map[int]context.CancelFunc),
+		paused:  make(map[string]bool),
+		claimed: make(map[string]context.CancelFunc),
+		queued:  make(map[string]bool),
+		metrics: testMetrics,
+	}
+	if slots > 0 {
+		s.slots = make(chan struct{}, slots)
+	}
+	return s
+}
+
+func overlapPlan(policy config.OverlapPolicy) config.Plan {
+	return config.Plan{Name: "overlap", Scheduler: config.Scheduler{Cron: "* * * * *", Overlap: policy}}
+}
+
+// claimAsync claims plan in the background, the result is sent once claim returns.
+func claimAsync(s *Scheduler, plan config.Plan) chan func() {
+	c := make(chan func(), 1)
+	go func() {
+		_, release, ok := s.claim(plan)
+		if !ok {
+			release = nil
+		}
+		c <- release
+	}()
+	return c
+}
+
+func TestClaimSkip(t *testing.T) {
+	for _, policy := range []config.OverlapPolicy{"", config.OverlapSkip} {
+		s := newTestScheduler(0)
+		plan := overlapPlan(policy)
+		_, release, ok := s.claim(plan)
+		if !ok {
+			t.Fatalf("%q: the first run wasn't claimed", policy)
+		}
+		if _, _, ok := s.claim(plan); ok {
+			t.Fatalf("%q: the overlapping run wasn't skipped", policy)
+		}
+		release()
+		if _, _, ok := s.claim(plan); !ok {
+			t.Fatalf("%q: the run after the release was skipped", policy)
+		}
+	}
+}
+
+func TestClaimQueue(t *testing.T) {
+	defer func(d time.Duration) { overlapPoll = d }(overlapPoll)
+	overlapPoll = 5 * time.Millisecond
+
+	s := newTestScheduler(0)
+	plan := overlapPlan(config.OverlapQueue)
+	_, release, _ := s.claim(plan)
+	queued := claimAsync(s, plan)
+	time.Sleep(20 * time.Millisecond)
+	// a single run waits, the next ones are skipped
+	if _, _, ok := s.claim(plan); ok {
+		t.Fatal("a second run was queued")
+	}
+	select {
+	case <-queued:
+		t.Fatal("the queued run started while the previous one runs")
+	default:
+	}
+	release()
+	select {
+	case release := <-queued:
+		if release == nil {
+			t.Fatal("the queued run was skipped")
+		}
+		release()
+	case <-time.After(time.Second):
+		t.Fatal("the queued run didn't start after the previous one")
+	}
+}
+
+func TestClaimCancelPrevious(t *testing.T) {
+	defer func(d time.Duration) { overlapPoll = d }(overlapPoll)
+	overlapPoll = 5 * time.Millisecond
+
+	s := newTestScheduler(0)
+	plan := overlapPlan(config.OverlapCancel)
+	ctx, done := s.Track(plan.Name)
+	claimed := claimAsync(s, plan)
+	select {
+	case <-ctx.Done():
+	case <-time.After(time.Second):
+		t.Fatal("the previous run wasn't canceled")
+	}
+	select {
+	case <-claimed:
+		t.Fatal("the new run started before the canceled one returned")
+	case <-time.After(20 * time.Millisecond):
+	}
+	done()
+	select {
+	case release := <-claimed:
+		if release == nil {
+			t.Fatal("the new run was skipped")
+		}
+		release()
+	case <-time.After(time.Second):
+		t.Fatal("the new run didn't start after the canceled one returned")
+	}
+}
+
+func TestClaimCancelPreviousWaiting(t *testing.T) {
+	defer func(d time.Duration) { overlapPoll = d }(overlapPoll)
+	overlapPoll = 5 * time.Millisecond
+
+	s := newTestScheduler(1)
+	plan := overlapPlan(config.OverlapCancel)
+	// the previous run waits for the slot held by another backup
+	s.slots <- struct{}{}
+	ctx, release, _ := s.claim(plan)
+	returned := make(chan error, 1)
+	go func() {
+		_, _, err := s.runWithRetries(ctx, plan, &config.AppConfig{}, &config.ModuleConfig{})
+		release()
+		returned <- err
+	}()
+	time.Sleep(20 * time.Millisecond)
+
+	claimed := claimAsync(s, plan)
+	select {
+	case err := <-returned:
+		if err != errStopped {
+			t.Fatalf("the waiting run returned %v instead of errStopped", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("the previous run waiting for a slot wasn't canceled")
+	}
+	select {
+	case release := <-claimed:
+		if release == nil {
+			t.Fatal("the new run was skipped")
+		}
+		release()
+	case <-time.After(time.Second):
+		t.Fatal("the new run didn't start after the canceled one returned")
+	}
+}
@@ -0,0 +1,194 @@
+package scheduler
+
+import (
+	"context"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"github.com/stefanprodan/mgob/pkg/backup"
+	"github.com/stefanprodan/mgob/pkg/clock"
+	"github.com/stefanprodan/mgob/pkg/config"
+	"github.com/stefanprodan/mgob/pkg/db"
+)
+
+// startTailer replaces the oplog tailer of plan, the caller must hold s.mu.
+func (s *Scheduler) startTailer(plan config.Plan) {
+	if cancel, ok := s.tailers[plan.Name]; ok {
+		cancel()
+		delete(s.tailers, plan.Name)
+	}
+	if plan.PITR == nil {
+		return
+	}
+	ctx, cancel := context.WithCancel(s.ctx)
+	s.tailers[plan.Name] = cancel
+	go s.tail(ctx, plan)
+}
+
+// tail stores the oplog as segments of the newest chain of plan until ctx is done.
+func (s *Scheduler) tail(ctx context.Context, plan config.Plan) {
+	if plan.Agent != "" {
+		log.WithField("plan", plan.Name).Error("PITR can't run on an agent")
+		return
+	}
+	if err := backup.CheckPointInTime(ctx, plan); err != nil {
+		log.WithField("plan", plan.Name).Errorf("PITR disabled %v", err)
+		return
+	}
+	log.WithField("plan", plan.Name).Infof("PITR oplog tailer started, slices of %v", backup.PITRInterval(plan))
+
+	for ctx.Err() == nil {
+		chain, seq, from, ok := s.pitrPosition(plan.Name)
+		if !ok {
+			// segments need a full backup to be replayed on
+			log.WithField("plan", plan.Name).Debug("PITR waiting for a full backup")
+			if !sleepCtx(ctx, backup.PITRInterval(plan)) {
+				return
+			}
+			continue
+		}
+
+		res, err := backup.OplogSlice(ctx, plan, s.Config, chain, seq, from)
+		switch {
+		case err == backup.ErrNoOplog:
+			continue
+		case err != nil:
+			if ctx.Err() != nil {
+				return
+			}
+			log.WithField("plan", plan.Name).Errorf("PITR oplog slice failed %v", err)
+			if !sleepCtx(ctx, time.Minute) {
+				return
+			}
+			continue
+		}
+		s.Record(plan, res)
+		s.prunePITR(ctx, plan)
+	}
+}
+
+// pitrPosition returns the newest chain of plan with the number and the
+// oplog start of its next segment, ok is false until a full backup exists.
+func (s *Scheduler) pitrPosition(plan string) (string, int, primitive.Timestamp, bool) {
+	artifacts, err := s.Catalog.List(plan)
+	if err != nil {
+		log.WithField("plan", plan).Errorf("Catalog list failed %v", err)
+		return "", 0, primitive.Timestamp{}, false
+	}
+
+	var full *db.Artifact
+	for _, a := range artifacts {
+		if a.Chain != "" && a.Seq == 0 && (full == nil || a.Timestamp.After(full.Timestamp)) {
+			full = a
+		}
+	}
+	if full == nil {
+		return "", 0, primitive.Timestamp{}, false
+	}
+
+	// the full dump started reading before its timestamp ended, replaying
+	// entries it already holds is idempotent
+	seq, from := 1, primitive.Timestamp{T: uint32(full.Timestamp.Unix())}
+	for _, a := range artifacts {
+		if a.Chain == full.Chain && a.Seq >= seq && a.Oplog != nil {
+			seq, from = a.Seq+1, a.Oplog.To
+		}
+	}
+	return full.Chain, seq, from, true
+}
+
+// prunePITR removes the segments of the chains no longer needed to restore
+// any point of the plan window, their full backups are left to the retention.
+func (s *Scheduler) prunePITR(ctx context.Context, plan config.Plan) {
+	if plan.PITR.Window < 1 {
+		return
+	}
+	artifacts, err := s.Catalog.List(plan.Name)
+	if err != nil {
+		log.WithField("plan", plan.Name).Errorf("Catalog list failed %v", err)
+		return
+	}
+
+	// the newest full taken before the window start covers the whole window
+	start := clock.Now().Add(-time.Duration(plan.PITR.Window) * time.Hour)
+	fulls := make(map[string]time.Time)
+	for _, a := range artifacts {
+		if a.Chain != "" && a.Seq == 0 {
+			fulls[a.Chain] = a.Timestamp
+		}
+	}
+	var base time.Time
+	for _, ts := range fulls {
+		if ts.Before(start) && ts.After(base) {
+			base = ts
+		}
+	}
+
+	expired := make([]*db.Artifact, 0)
+	for _, a := range artifacts {
+		chain, _, ok := backup.ParseSegment(a.Name)
+		if ts, full := fulls[chain]; ok && full && ts.Before(base) {
+			expired = append(expired, a)
+		}
+	}
+	if len(expired) == 0 {
+		return
+	}
+	sort.Slice(expired, func(i, j int) bool { return expired[i].Name < expired[j].Name })
+
+	s.deleteRemote(backup.WithEnv(ctx, plan), plan, expired)
+	for _, a := range expired {
+		file := filepath.Join(config.PlanDir(s.Config.StoragePath, plan), a.Name)
+		if err := os.Remove(file); err != nil && !os.IsNotExist(err) {
+			log.WithField("plan", plan.Name).Warnf("Removing %v failed %v", file, err)
+			continue
+		}
+		if err := s.Catalog.Delete(plan.Name, a.Name); err != nil {
+			log.WithField("plan", plan.Name).Errorf("Catalog delete failed %v", err)
+		}
+	}
+	log.WithField("plan", plan.Name).Infof("PITR removed %v segments older than the %vh window", len(expired), plan.PITR.Window)
+}
+
+// deleteRemote removes the artifacts from the remote destinations they were uploaded to.
+func (s *Scheduler) deleteRemote(ctx context.Context, plan config.Plan, artifacts []*db.Artifact) {
+	for _, d := range backup.RemoteDestinations(plan, s.Config, clock.Now()) {
+		names := make(map[string]bool)
+		for _, a := range artifacts {
+			if contains(a.Destinations, d.Name()) {
+				names[a.Name] = true
+			}
+		}
+		if len(names) == 0 {
+			continue
+		}
+		objects, err := d.List(ctx)
+		if err != nil {
+			log.WithField("plan", plan.Name).Errorf("%v listing failed %v", d.Name(), err)
+			continue
+		}
+		for _, obj := range objects {
+			if !names[path.Base(obj.Name)] {
+				continue
+			}
+			if err := d.Delete(ctx, obj.Name); err != nil {
+				log.WithField("plan", plan.Name).Errorf("%v delete failed %v", d.Name(), err)
+			}
+		}
+	}
+}
+
+func sleepCtx(ctx context.Context, d time.Duration) bool {
+	select {
+	case <-time.After(d):
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
@@ -0,0 +1,105 @@
+package scheduler
+
+import (
+	"context"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/stefanprodan/mgob/pkg/clock"
+	"github.com/stefanprodan/mgob/pkg/config"
+	"github.com/stefanprodan/mgob/pkg/restore"
+)
+
+// defaultRestoreBandwidth is the rate of background restores in MB/s.
+const defaultRestoreBandwidth = 10
+
+// WithPriority returns plan with its restore priority set to priority,
+// the plan default is kept when it's empty.
+func WithPriority(plan config.Plan, priority string) (config.Plan, error) {
+	if plan.Restore == nil || priority == "" {
+		return plan, nil
+	}
+	switch config.RestorePriority(priority) {
+	case config.RestorePriorityNormal, config.RestorePriorityUrgent, config.RestorePriorityBackground:
+	default:
+		return plan, errors.Errorf("Invalid restore priority %v", priority)
+	}
+	target := *plan.Restore
+	target.Priority = config.RestorePriority(priority)
+	plan.Restore = &target
+	return plan, nil
+}
+
+// prioritize applies the restore priority of plan to ctx, the returned func
+// must be called when the restore ends.
+func (s *Scheduler) prioritize(ctx context.Context, plan config.Plan) (context.Context, func()) {
+	if plan.Restore == nil {
+		return ctx, func() {}
+	}
+	switch plan.Restore.Priority {
+	case config.RestorePriorityBackground:
+		bandwidth := plan.Restore.Bandwidth
+		if bandwidth <= 0 {
+			bandwidth = defaultRestoreBandwidth
+		}
+		held := false
+		return restore.WithThrottle(ctx, &restore.Throttle{
+			Rate: int64(bandwidth) << 20,
+			Hold: func() bool {
+				running := s.backupsRunning()
+				if running != held {
+					held = running
+					log.WithField("plan", plan.Name).Infof("Background restore held %v", held)
+				}
+				return running
+			},
+		}), func() {}
+	case config.RestorePriorityUrgent:
+		s.mu.Lock()
+		s.urgent++
+		s.mu.Unlock()
+		return ctx, func() {
+			s.mu.Lock()
+			s.urgent--
+			s.mu.Unlock()
+		}
+	}
+	return ctx, func() {}
+}
+
+func (s *Scheduler) backupsRunning() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.running) > 0
+}
+
+func (s *Scheduler) urgentRestores() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.urgent
+}
+
+// waitUrgent holds the scheduled backup of plan while urgent restores run.
+// It returns false when ctx is done meanwhile.
+func (s *Scheduler) waitUrgent(ctx context.Context, plan config.Plan) bool {
+	if s.urgentRestores() == 0 {
+		return true
+	}
+	log.WithField("plan", plan.Name).Info("Backup queued behind an urgent restore")
+	t1 := clock.Now()
+	ticker := time.NewTicker(pressureInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return false
+		case <-ticker.C:
+			if s.urgentRestores() == 0 {
+				log.WithField("plan", plan.Name).Infof("Backup resumed after a %v wait for an urgent restore", clock.Since(t1))
+				return true
+			}
+		}
+	}
+}
@@ -0,0 +1,110 @@
+package scheduler
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/stefanprodan/mgob/pkg/backup"
+	"github.com/stefanprodan/mgob/pkg/clock"
+	"github.com/stefanprodan/mgob/pkg/config"
+	"github.com/stefanprodan/mgob/pkg/db"
+)
+
+const defaultProbeInterval = 5 * time.Minute
+
+func probeInterval(p *config.Probe) time.Duration {
+	if p.Interval <= 0 {
+		return defaultProbeInterval
+	}
+	return time.Duration(p.Interval) * time.Minute
+}
+
+// probeJob lists each remote destination of plan to export its availability,
+// then uploads the files queued for the destinations that are up.
+func (s *Scheduler) probeJob(plan config.Plan) {
+	ctx, cancel := context.WithTimeout(s.ctx, probeInterval(plan.Probe))
+	defer cancel()
+
+	artifacts, err := s.Catalog.List(plan.Name)
+	if err != nil {
+		log.WithField("plan", plan.Name).Errorf("Probe catalog list failed %v", err)
+	}
+	for _, routed := range backup.RoutedPlans(plan) {
+		rctx := backup.WithEnv(ctx, routed.Plan)
+		for _, d := range backup.RemoteDestinations(routed.Plan, s.Config, clock.Now()) {
+			_, err := d.List(rctx)
+			up := err == nil
+			if was := backup.DestinationUp(plan.Name, routed.Route, d.Name()); was != up {
+				if up {
+					log.WithField("plan", plan.Name).Infof("%v%v is back up", d.Name(), routeSuffix(routed.Route))
+				} else {
+					log.WithField("plan", plan.Name).Warnf("%v%v is down %v", d.Name(), routeSuffix(routed.Route), err)
+				}
+			}
+			backup.SetDestinationUp(plan.Name, routed.Route, d.Name(), up)
+			value := 0.0
+			if up {
+				value = 1
+			}
+			s.metrics.DestinationUp.WithLabelValues(s.metrics.Plan(plan.Name), s.metrics.Destination(d.Name()), routed.Route).Set(value)
+
+			queued := 0
+			for _, a := range artifacts {
+				if a.Route != routed.Route || !contains(a.Pending, d.Name()) {
+					continue
+				}
+				if up && s.flush(rctx, routed, a, d.Name()) {
+					continue
+				}
+				queued++
+			}
+			s.metrics.UploadQueued.WithLabelValues(s.metrics.Plan(plan.Name), s.metrics.Destination(d.Name()), routed.Route).Set(float64(queued))
+		}
+	}
+}
+
+// flush uploads the queued artifact to the named destination and records it,
+// it returns false when the artifact stays queued.
+func (s *Scheduler) flush(ctx context.Context, routed backup.RoutedPlan, a *db.Artifact, name string) bool {
+	file := filepath.Join(s.planDir(a.Plan), a.Name)
+	if _, err := os.Stat(file); err != nil {
+		log.WithField("plan", a.Plan).Warnf("%v queued for %v is gone, dropped from the queue %v", a.Name, name, err)
+		a.Pending = without(a.Pending, name)
+		if err := s.Catalog.Put(a); err != nil {
+			log.WithField("plan", a.Plan).Errorf("Catalog store failed %v", err)
+		}
+		return true
+	}
+	for _, d := range backup.RemoteDestinations(routed.Plan, s.Config, a.Timestamp) {
+		if d.Name() != name {
+			continue
+		}
+		output, err := d.Upload(ctx, file)
+		if err != nil {
+			log.WithField("plan", a.Plan).Warnf("%v queued upload of %v failed %v", name, a.Name, err)
+			return false
+		}
+		log.WithField("plan", a.Plan).Infof("%v queued upload of %v finished %v", name, a.Name, output)
+		a.Pending = without(a.Pending, name)
+		a.Destinations = append(a.Destinations, name)
+		if err := s.Catalog.Put(a); err != nil {
+			log.WithField("plan", a.Plan).Errorf("Catalog store failed %v", err)
+		}
+		return true
+	}
+	return false
+}
+
+func without(list []string, s string) []string {
+	out := make([]string, 0, len(list))
+	for _, item := range list {
+		if item != s {
+			out = append(out, item)
+		}
+	}
+	return out
+}
@@ -0,0 +1,198 @@
+package scheduler
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/stefanprodan/mgob/pkg/backup"
+	"github.com/stefanprodan/mgob/pkg/clock"
+	"github.com/stefanprodan/mgob/pkg/config"
+	"github.com/stefanprodan/mgob/pkg/db"
+	"github.com/stefanprodan/mgob/pkg/notifier"
+)
+
+const (
+	DriftMissing      = "missing"
+	DriftExtra        = "extra"
+	DriftSizeMismatch = "size_mismatch"
+)
+
+// Drift is an object that doesn't match the catalog.
+type Drift struct {
+	Destination string `json:"destination"`
+	Route       string `json:"route,omitempty"`
+	Kind        string `json:"kind"`
+	Name        string `json:"name"`
+	Expected    int64  `json:"expected,omitempty"`
+	Actual      int64  `json:"actual,omitempty"`
+}
+
+// ReconcileReport is the outcome of comparing the catalog with the remote destinations.
+type ReconcileReport struct {
+	Plan      string    `json:"plan"`
+	Timestamp time.Time `json:"timestamp"`
+	Drift     []Drift   `json:"drift"`
+	Errors    []string  `json:"errors,omitempty"`
+}
+
+// Record adds the files of a successful backup to the catalog.
+func (s *Scheduler) Record(plan config.Plan, res backup.Result) {
+	for _, u := range res.Uploads {
+		size := u.Size
+		if size == 0 {
+			fi, err := os.Stat(u.File)
+			if err != nil {
+				log.WithField("plan", plan.Name).Warnf("Catalog record of %v failed %v", u.File, err)
+				continue
+			}
+			size = fi.Size()
+		}
+		a := &db.Artifact{
+			Plan:         plan.Name,
+			Name:         filepath.Base(u.File),
+			Size:         size,
+			Timestamp:    res.Timestamp,
+			Route:        u.Route,
+			Destinations: u.Destinations,
+			Pending:      u.Pending,
+		}
+		if a.Name == res.Name {
+			a.Checksum = res.Checksum
+			a.Chain = res.Chain
+			a.Seq = res.Seq
+			a.Oplog = res.Oplog
+			a.Usage = res.Usage
+			a.VolumeSnapshot = res.VolumeSnapshot
+			a.DiskSnapshots = res.DiskSnapshots
+			a.AtlasSnapshot = res.AtlasSnapshot
+			if res.Chain != "" && res.Seq == 0 {
+				completed := res.Timestamp.Add(res.Duration)
+				a.Completed = &completed
+			}
+		}
+		if err := s.Catalog.Put(a); err != nil {
+			log.WithField("plan", plan.Name).Errorf("Catalog store failed %v", err)
+		}
+	}
+}
+
+// Reconcile lists the remote destinations of plan and reports the objects
+// that are missing, unknown to the catalog or have a different size.
+func (s *Scheduler) Reconcile(ctx context.Context, plan config.Plan) *ReconcileReport {
+	report := &ReconcileReport{Plan: plan.Name, Timestamp: clock.Now().UTC(), Drift: make([]Drift, 0)}
+
+	artifacts, err := s.Catalog.List(plan.Name)
+	if err != nil {
+		report.Errors = append(report.Errors, err.Error())
+		return report
+	}
+
+	// objects of other plans sharing the bucket are ignored
+	owned := regexp.MustCompile(fmt.Sprintf(`^%v-(.+-)?\d+\.`, regexp.QuoteMeta(plan.Name)))
+
+	for _, routed := range backup.RoutedPlans(plan) {
+		s.reconcileRoute(ctx, report, routed, artifacts, owned)
+	}
+
+	return report
+}
+
+func (s *Scheduler) reconcileRoute(ctx context.Context, report *ReconcileReport, routed backup.RoutedPlan,
+	artifacts []*db.Artifact, owned *regexp.Regexp) {
+	ctx = backup.WithEnv(ctx, routed.Plan)
+	for _, d := range backup.RemoteDestinations(routed.Plan, s.Config, clock.Now()) {
+		objects, err := d.List(ctx)
+		if err != nil {
+			report.Errors = append(report.Errors, err.Error())
+			continue
+		}
+
+		// object names may carry a prefix, artifacts are matched by file name
+		stored := make(map[string]backup.Object)
+		for _, obj := range objects {
+			stored[path.Base(obj.Name)] = obj
+		}
+
+		counts := map[string]int{DriftMissing: 0, DriftExtra: 0, DriftSizeMismatch: 0}
+		known := make(map[string]bool)
+		for _, a := range artifacts {
+			if a.Route != routed.Route || !contains(a.Destinations, d.Name()) {
+				continue
+			}
+			known[a.Name] = true
+			obj, ok := stored[a.Name]
+			switch {
+			case !ok:
+				report.Drift = append(report.Drift, Drift{Destination: d.Name(), Route: routed.Route, Kind: DriftMissing,
+					Name: a.Name, Expected: a.Size})
+				counts[DriftMissing]++
+			case obj.Size != a.Size:
+				report.Drift = append(report.Drift, Drift{Destination: d.Name(), Route: routed.Route, Kind: DriftSizeMismatch,
+					Name: obj.Name, Expected: a.Size, Actual: obj.Size})
+				counts[DriftSizeMismatch]++
+			}
+		}
+		for name, obj := range stored {
+			if !known[name] && owned.MatchString(name) {
+				report.Drift = append(report.Drift, Drift{Destination: d.Name(), Route: routed.Route, Kind: DriftExtra,
+					Name: obj.Name, Actual: obj.Size})
+				counts[DriftExtra]++
+			}
+		}
+
+		for kind, n := range counts {
+			s.metrics.Drift.WithLabelValues(s.metrics.Plan(report.Plan), s.metrics.Destination(d.Name()), routed.Route, kind).Set(float64(n))
+		}
+	}
+}
+
+func (s *Scheduler) reconcileJob(plan config.Plan) {
+	log.WithField("plan", plan.Name).Info("Reconciliation started")
+	ctx, cancel := context.WithCancel(s.ctx)
+	defer cancel()
+
+	report := s.Reconcile(ctx, plan)
+	if len(report.Drift) == 0 && len(report.Errors) == 0 {
+		log.WithField("plan", plan.Name).Info("Reconciliation finished, no drift found")
+		return
+	}
+
+	lines := make([]string, 0)
+	for _, e := range report.Errors {
+		lines = append(lines, "error: "+e)
+	}
+	for _, d := range report.Drift {
+		lines = append(lines, fmt.Sprintf("%v%v %v %v expected %v actual %v",
+			d.Destination, routeSuffix(d.Route), d.Kind, d.Name, d.Expected, d.Actual))
+	}
+	body := strings.Join(lines, "\n")
+	log.WithField("plan", plan.Name).Warnf("Reconciliation found %v drifted objects %v", len(report.Drift), body)
+
+	if err := notifier.SendNotification(fmt.Sprintf("%v inventory drift", plan.Name), body, true, plan); err != nil {
+		log.WithField("plan", plan.Name).Errorf("Notifier failed %v", err)
+	}
+}
+
+func routeSuffix(route string) string {
+	if route == "" {
+		return ""
+	}
+	return fmt.Sprintf(" (route %v)", route)
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
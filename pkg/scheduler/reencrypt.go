@@ -0,0 +1,170 @@
+package scheduler
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/stefanprodan/mgob/pkg/backup"
+	"github.com/stefanprodan/mgob/pkg/clock"
+	"github.com/stefanprodan/mgob/pkg/config"
+	"github.com/stefanprodan/mgob/pkg/db"
+)
+
+// ReencryptReport is the outcome of re-encrypting the archives of a plan.
+type ReencryptReport struct {
+	Plan        string   `json:"plan"`
+	Recipients  []string `json:"recipients"`
+	Reencrypted []string `json:"reencrypted"`
+	// Skipped counts the archives already encrypted for the recipients
+	Skipped  int      `json:"skipped"`
+	Problems []string `json:"problems,omitempty"`
+}
+
+// Reencrypt encrypts the archives of plan for the recipients of its current
+// encryption config, locally and at the destinations they were uploaded to.
+// The old private key must be in the gpg keyring. Every archive done is marked
+// in the catalog so an interrupted run resumes where it stopped.
+func (s *Scheduler) Reencrypt(ctx context.Context, plan config.Plan) *ReencryptReport {
+	report := &ReencryptReport{Plan: plan.Name, Reencrypted: make([]string, 0)}
+	recipients, err := backup.Recipients(ctx, plan)
+	if err != nil {
+		report.Problems = append(report.Problems, err.Error())
+		return report
+	}
+	report.Recipients = recipients
+
+	artifacts, err := s.Catalog.List(plan.Name)
+	if err != nil {
+		report.Problems = append(report.Problems, err.Error())
+		return report
+	}
+	for _, a := range artifacts {
+		if ctx.Err() != nil {
+			report.Problems = append(report.Problems, ctx.Err().Error())
+			break
+		}
+		switch {
+		case strings.Contains(a.Name, ".encrypted.part"):
+			report.Problems = append(report.Problems, fmt.Sprintf("%v: split archives are not supported", a.Name))
+			continue
+		case !strings.HasSuffix(a.Name, ".encrypted"):
+			continue
+		case equalStrings(a.Recipients, recipients):
+			report.Skipped++
+			continue
+		}
+
+		t1 := clock.Now()
+		if err := s.reencrypt(ctx, plan, a); err != nil {
+			log.WithField("plan", plan.Name).Errorf("Re-encrypting %v failed %v", a.Name, err)
+			report.Problems = append(report.Problems, fmt.Sprintf("%v: %v", a.Name, err))
+			continue
+		}
+		a.Recipients = recipients
+		if err := s.Catalog.Put(a); err != nil {
+			report.Problems = append(report.Problems, fmt.Sprintf("%v: %v", a.Name, err))
+			continue
+		}
+		report.Reencrypted = append(report.Reencrypted, a.Name)
+		log.WithField("plan", plan.Name).Infof("Re-encrypted %v in %v", a.Name, clock.Since(t1))
+	}
+	return report
+}
+
+// reencrypt replaces the copies of a, the new archive is uploaded over the
+// remote ones first so the local copy stays decryptable until the end.
+func (s *Scheduler) reencrypt(ctx context.Context, plan config.Plan, a *db.Artifact) error {
+	routed, ts, _ := s.Locate(plan, a.Name)
+	local := filepath.Join(config.PlanDir(s.Config.StoragePath, plan), a.Name)
+
+	// the new archive is written next to the copy it replaces, renames
+	// don't cross volumes, and keeps the name the destinations store it under
+	src, work := local, filepath.Join(config.PlanDir(s.Config.StoragePath, plan), ".reencrypt")
+	if _, err := os.Stat(local); err != nil {
+		files, _, err := s.fetch(ctx, plan, a.Name)
+		defer func() {
+			for _, f := range files {
+				os.Remove(f)
+			}
+		}()
+		if err != nil {
+			return err
+		}
+		src, work = files[0], filepath.Join(s.Config.TmpPath, "reencrypt")
+	}
+	if err := os.MkdirAll(work, 0755); err != nil {
+		return err
+	}
+	dst := filepath.Join(work, a.Name)
+	defer os.Remove(dst)
+
+	oldSum, err := fileChecksum(src)
+	if err != nil {
+		return err
+	}
+	if err := backup.Reencrypt(ctx, routed, s.Config, src, dst); err != nil {
+		return err
+	}
+	fi, err := os.Stat(dst)
+	if err != nil {
+		return err
+	}
+	files := []string{dst}
+	// a checksum taken after the encryption stage no longer matches
+	if a.Checksum == oldSum {
+		if a.Checksum, err = fileChecksum(dst); err != nil {
+			return err
+		}
+		sumFile := dst + ".sha256"
+		if err := ioutil.WriteFile(sumFile, []byte(fmt.Sprintf("%v  %v\n", a.Checksum, a.Name)), 0644); err != nil {
+			return err
+		}
+		defer os.Remove(sumFile)
+		files = append(files, sumFile)
+	}
+	a.Size = fi.Size()
+
+	// the cached copy no longer matches the remote ones
+	s.cache.drop(plan.Name, a.Name)
+	rctx := backup.WithEnv(ctx, routed)
+	for _, d := range backup.RemoteDestinations(routed, s.Config, ts) {
+		if !contains(a.Destinations, d.Name()) {
+			continue
+		}
+		for _, f := range files {
+			if _, err := d.Upload(rctx, f); err != nil {
+				return err
+			}
+		}
+		if err := d.Verify(rctx, dst); err != nil {
+			return err
+		}
+	}
+
+	if src == local {
+		for _, f := range files {
+			if err := os.Rename(f, filepath.Join(filepath.Dir(local), filepath.Base(f))); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func equalStrings(a []string, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,142 @@
+package scheduler
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/stefanprodan/mgob/pkg/config"
+	"github.com/stefanprodan/mgob/pkg/logging"
+)
+
+// Reload reads the plans from the config dir again and applies the ones that
+// changed, so rotated credentials, notifier tokens and key file paths are used
+// from the next run on. The key files are read by every run, they're only
+// checked here. Plans removed from the config dir stay scheduled until restart.
+func (s *Scheduler) Reload() ([]string, error) {
+	s.reloadMu.Lock()
+	defer s.reloadMu.Unlock()
+	// a failed reload is retried once the files change again
+	s.reloadSum = s.configSum()
+
+	plans, err := config.LoadPlans(s.Config.ConfigPath)
+	if err != nil {
+		return nil, errors.Wrap(err, "Reloading plans failed")
+	}
+	applied := make([]string, 0)
+	for _, plan := range plans {
+		for _, file := range secretFiles(plan) {
+			if _, err := os.Stat(file); err != nil {
+				log.WithField("plan", plan.Name).Warnf("Key file %v can't be read %v", file, err)
+			}
+		}
+		if current, ok := s.Lookup(plan.Name); ok && reflect.DeepEqual(current, plan) {
+			continue
+		}
+		if err := s.Apply(plan); err != nil {
+			return applied, errors.Wrapf(err, "Applying plan %v failed", plan.Name)
+		}
+		logging.SetPlanDebug(plan.Name, plan.Debug)
+		applied = append(applied, plan.Name)
+	}
+	// the applied plans can reference other key files
+	s.reloadSum = s.configSum()
+	return applied, nil
+}
+
+// reloadJob reloads the plans when a plan or key file changed since the last reload.
+func (s *Scheduler) reloadJob() {
+	s.reloadMu.Lock()
+	changed := s.configSum() != s.reloadSum
+	s.reloadMu.Unlock()
+	if !changed {
+		return
+	}
+	applied, err := s.Reload()
+	if err != nil {
+		log.Errorf("Config reload failed %v", err)
+		return
+	}
+	if len(applied) > 0 {
+		log.Infof("Config changed, reloaded plans %v", strings.Join(applied, ", "))
+	}
+}
+
+// configSum fingerprints the size and modification time of the plan files
+// and of the key files the scheduled plans reference.
+func (s *Scheduler) configSum() string {
+	files := make([]string, 0)
+	filepath.Walk(s.Config.ConfigPath, func(path string, f os.FileInfo, err error) error {
+		if err == nil && !f.IsDir() && (strings.HasSuffix(path, ".yml") || strings.HasSuffix(path, ".yaml")) {
+			files = append(files, path)
+		}
+		return nil
+	})
+	for _, plan := range s.plans() {
+		files = append(files, secretFiles(plan)...)
+	}
+	sort.Strings(files)
+
+	h := sha256.New()
+	for _, file := range files {
+		if fi, err := os.Stat(file); err == nil {
+			fmt.Fprintf(h, "%v %v %v\n", file, fi.Size(), fi.ModTime().UnixNano())
+		} else {
+			fmt.Fprintf(h, "%v missing\n", file)
+		}
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// secretFiles returns the key and credential files referenced by plan.
+func secretFiles(plan config.Plan) []string {
+	files := []string{plan.Target.CAFile}
+	if plan.Encryption != nil && plan.Encryption.Gpg != nil {
+		files = append(files, plan.Encryption.Gpg.KeyFile)
+	}
+	files = append(files, destinationFiles(plan.GCloud, plan.Rclone, plan.SFTP)...)
+	for _, r := range plan.Routes {
+		files = append(files, destinationFiles(r.GCloud, r.Rclone, r.SFTP)...)
+	}
+	if plan.Executor != nil && plan.Executor.SSH != nil {
+		files = append(files, plan.Executor.SSH.PrivateKey, plan.Executor.SSH.KnownHosts)
+	}
+	if plan.Restore != nil {
+		files = append(files, plan.Restore.KeyFile)
+	}
+	if plan.Standby != nil {
+		files = append(files, plan.Standby.KeyFile)
+	}
+	if plan.Verify != nil {
+		files = append(files, plan.Verify.KeyFile)
+	}
+	set := make([]string, 0, len(files))
+	for _, file := range files {
+		if file != "" {
+			set = append(set, file)
+		}
+	}
+	return set
+}
+
+func destinationFiles(gcloud *config.GCloud, rclone *config.Rclone, sftp *config.SFTP) []string {
+	files := make([]string, 0)
+	if gcloud != nil {
+		files = append(files, gcloud.KeyFilePath)
+	}
+	if rclone != nil {
+		files = append(files, rclone.ConfigFilePath)
+	}
+	if sftp != nil {
+		files = append(files, sftp.PrivateKey)
+	}
+	return files
+}
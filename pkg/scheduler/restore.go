@@ -0,0 +1,427 @@
+package scheduler
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"github.com/stefanprodan/mgob/pkg/backup"
+	"github.com/stefanprodan/mgob/pkg/clock"
+	"github.com/stefanprodan/mgob/pkg/config"
+	"github.com/stefanprodan/mgob/pkg/db"
+	"github.com/stefanprodan/mgob/pkg/restore"
+)
+
+// ErrRestoreRunning is returned when a restore of the plan is already in progress.
+var ErrRestoreRunning = errors.New("a restore of this plan is already running")
+
+// ErrNotStored is returned when the archive is neither local nor at a remote destination of the plan.
+var ErrNotStored = errors.New("archive not found locally or at the plan destinations")
+
+var archiveTimestamp = regexp.MustCompile(`-(\d+)\.`)
+
+// Locate returns the plan of the route archive was uploaded with and its run
+// timestamp, from the catalog or for older archives from the name. ok is false
+// when archive isn't named like a backup of plan.
+func (s *Scheduler) Locate(plan config.Plan, archive string) (config.Plan, time.Time, bool) {
+	m := archiveTimestamp.FindStringSubmatch(archive)
+	if !strings.HasPrefix(archive, plan.Name+"-") || filepath.Base(archive) != archive || m == nil {
+		return plan, time.Time{}, false
+	}
+	unix, _ := strconv.ParseInt(m[1], 10, 64)
+	ts := time.Unix(unix, 0).UTC()
+	route := ""
+	if artifacts, err := s.Catalog.List(plan.Name); err == nil {
+		for _, a := range artifacts {
+			if a.Name == archive {
+				ts, route = a.Timestamp, a.Route
+			}
+		}
+	}
+	for _, routed := range backup.RoutedPlans(plan) {
+		if routed.Route == route {
+			plan = routed.Plan
+		}
+	}
+	return plan, ts, true
+}
+
+// Restore loads the archive into the plan restore target, downloading it to the
+// tmp dir when it's no longer stored locally, and records the outcome in the metrics.
+// A dry run only validates the archive against the target.
+func (s *Scheduler) Restore(ctx context.Context, plan config.Plan, archive string, dryRun bool) (restore.Result, error) {
+	if !s.lockRestore(plan.Name) {
+		return restore.Result{Plan: plan.Name, Archive: archive}, ErrRestoreRunning
+	}
+	defer s.unlockRestore(plan.Name)
+	return s.restore(ctx, plan, archive, dryRun, nil)
+}
+
+// lockRestore marks a restore of plan as running, false when one already is.
+func (s *Scheduler) lockRestore(plan string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.restoring[plan] {
+		return false
+	}
+	s.restoring[plan] = true
+	return true
+}
+
+func (s *Scheduler) unlockRestore(plan string) {
+	s.mu.Lock()
+	delete(s.restoring, plan)
+	s.mu.Unlock()
+}
+
+func (s *Scheduler) restore(ctx context.Context, plan config.Plan, archive string, dryRun bool, p *restore.Progress) (restore.Result, error) {
+	file, source := filepath.Join(config.PlanDir(s.Config.StoragePath, plan), archive), "Local"
+	if _, err := os.Stat(file); err != nil {
+		stop := s.watchDownload(plan.Name, archive, p)
+		files, dst, err := s.fetch(ctx, plan, archive)
+		stop()
+		defer func() {
+			for _, f := range files {
+				os.Remove(f)
+			}
+		}()
+		if err != nil {
+			return restore.Result{Plan: plan.Name, Archive: archive, Status: "failed", Error: err.Error()}, err
+		}
+		file, source = files[0], dst
+	} else if _, err := os.Stat(file + backup.MetadataExt); err == nil {
+		// refuse archives written in a format this version doesn't know
+		if _, err := backup.ReadMetadata(file + backup.MetadataExt); err != nil {
+			return restore.Result{Plan: plan.Name, Archive: archive, Status: "failed", Error: err.Error()}, err
+		}
+	}
+
+	ctx, done := s.prioritize(ctx, plan)
+	res, err := restore.Run(ctx, plan, file, dryRun, p)
+	done()
+	res.Source = source
+	if dryRun {
+		return res, err
+	}
+	s.metrics.RestoreTotal.WithLabelValues(s.metrics.Plan(plan.Name), res.Status).Inc()
+	s.metrics.RestoreLatency.WithLabelValues(s.metrics.Plan(plan.Name), res.Status).Observe(res.Duration.Seconds())
+	return res, err
+}
+
+// fetch downloads archive, all its parts when split, from the first remote
+// destination of plan that has it into the tmp dir, or links its cached copy
+// there. It returns the downloaded files, to be removed by the caller, and the
+// destination name.
+func (s *Scheduler) fetch(ctx context.Context, plan config.Plan, archive string) ([]string, string, error) {
+	if files, ok := s.cache.get(plan.Name, archive, s.Config.TmpPath); ok {
+		log.WithField("plan", plan.Name).Infof("Using the cached copy of %v for restore", archive)
+		return files, "Cache", nil
+	}
+	routed, ts, _ := s.Locate(plan, archive)
+	ctx = backup.WithEnv(ctx, routed)
+	local := filepath.Join(config.PlanDir(s.Config.StoragePath, plan), archive)
+
+	dests := backup.RemoteDestinations(routed, s.Config, ts)
+	if len(dests) == 0 {
+		return nil, "", ErrNotStored
+	}
+	failed := make([]string, 0)
+	for _, d := range dests {
+		files, err := download(ctx, d, local, filepath.Join(s.Config.TmpPath, archive))
+		if err == nil {
+			log.WithField("plan", plan.Name).Infof("Downloaded %v from %v for restore", archive, d.Name())
+			s.cache.put(plan.Name, archive, files)
+			return files, d.Name(), nil
+		}
+		for _, f := range files {
+			os.Remove(f)
+		}
+		failed = append(failed, err.Error())
+	}
+	return nil, "", errors.Errorf("Downloading %v failed %v", archive, strings.Join(failed, ", "))
+}
+
+// download fetches the remote copy of file into dst, split archives
+// part by part until the destination has no next part, per collection
+// backups with the files their index lists.
+func download(ctx context.Context, d backup.Destination, file string, dst string) ([]string, error) {
+	if strings.HasSuffix(file, restore.CollectionsExt) {
+		return downloadCollections(ctx, d, file, dst)
+	}
+	if !strings.HasSuffix(file, ".part000") {
+		return []string{dst}, d.Download(ctx, file, dst)
+	}
+	base, dstBase := strings.TrimSuffix(file, ".part000"), strings.TrimSuffix(dst, ".part000")
+	files := make([]string, 0)
+	for i := 0; ; i++ {
+		part := fmt.Sprintf("%v.part%03d", dstBase, i)
+		files = append(files, part)
+		if err := d.Download(ctx, fmt.Sprintf("%v.part%03d", base, i), part); err != nil {
+			if i > 0 {
+				os.Remove(part)
+				return files[:i], nil
+			}
+			return files, err
+		}
+	}
+}
+
+// downloadCollections fetches the index into dst then the files it lists
+// next to it.
+func downloadCollections(ctx context.Context, d backup.Destination, file string, dst string) ([]string, error) {
+	files := []string{dst}
+	if err := d.Download(ctx, file, dst); err != nil {
+		return files, err
+	}
+	idx, err := restore.ReadCollections(dst)
+	if err != nil {
+		return files, err
+	}
+	for _, f := range idx.Files {
+		fetched, err := download(ctx, d, filepath.Join(filepath.Dir(file), f.File), filepath.Join(filepath.Dir(dst), f.File))
+		files = append(files, fetched...)
+		if err != nil {
+			return files, err
+		}
+	}
+	return files, nil
+}
+
+// PointInTime lists the archives a point in time restore replays, the full
+// backup first then the oplog segments of its chain in order.
+type PointInTime struct {
+	Plan     string        `json:"plan"`
+	Time     time.Time     `json:"time"`
+	Chain    string        `json:"chain"`
+	Full     string        `json:"full"`
+	Segments []string      `json:"segments"`
+	Duration time.Duration `json:"duration,omitempty"`
+}
+
+// ResolvePointInTime picks the newest chain of plan whose full backup was
+// completed before t and whose contiguous oplog segments reach t.
+func (s *Scheduler) ResolvePointInTime(plan string, t time.Time) (*PointInTime, error) {
+	artifacts, err := s.Catalog.List(plan)
+	if err != nil {
+		return nil, err
+	}
+
+	fulls := make([]*db.Artifact, 0)
+	var dumping *db.Artifact
+	for _, a := range artifacts {
+		if a.Chain == "" || a.Seq != 0 || a.Timestamp.After(t) {
+			continue
+		}
+		// the full is restored as of its end, a time inside its dump can't be reached from it
+		if fullCompleted(a).After(t) {
+			dumping = a
+			continue
+		}
+		fulls = append(fulls, a)
+	}
+	inDump := func() error {
+		return errors.Errorf("Plan %v can't be restored to %v, the full backup %v was dumping until %v and no older chain reaches it",
+			plan, t.UTC(), dumping.Name, fullCompleted(dumping).UTC())
+	}
+	if len(fulls) == 0 {
+		if dumping != nil {
+			return nil, inDump()
+		}
+		return nil, errors.Errorf("Plan %v has no full backup taken before %v", plan, t.UTC())
+	}
+	sort.Slice(fulls, func(i, j int) bool { return fulls[i].Timestamp.After(fulls[j].Timestamp) })
+
+	var latest time.Time
+	for _, full := range fulls {
+		p := &PointInTime{Plan: plan, Time: t.UTC(), Chain: full.Chain, Full: full.Name, Segments: make([]string, 0)}
+		if !fullCompleted(full).Before(t) {
+			return p, nil
+		}
+		covered := fullCompleted(full)
+		for _, seg := range chainSegments(artifacts, full.Chain) {
+			// a missing segment ends what the chain can restore
+			if seg.Seq != len(p.Segments)+1 {
+				break
+			}
+			p.Segments = append(p.Segments, seg.Name)
+			covered = time.Unix(int64(seg.Oplog.To.T), 0)
+			if !covered.Before(t) {
+				return p, nil
+			}
+		}
+		if covered.After(latest) {
+			latest = covered
+		}
+	}
+	if dumping != nil {
+		return nil, inDump()
+	}
+	return nil, errors.Errorf("Plan %v can't be restored to %v, the oplog reaches %v at most",
+		plan, t.UTC(), latest.UTC())
+}
+
+// fullCompleted is when the run of a full backup ended, its start for the
+// records made before the end was recorded.
+func fullCompleted(a *db.Artifact) time.Time {
+	if a.Completed != nil {
+		return *a.Completed
+	}
+	return a.Timestamp
+}
+
+// chainSegments returns the oplog segments of chain ordered by seq.
+func chainSegments(artifacts []*db.Artifact, chain string) []*db.Artifact {
+	segments := make([]*db.Artifact, 0)
+	for _, a := range artifacts {
+		if a.Chain == chain && a.Seq > 0 && a.Oplog != nil {
+			segments = append(segments, a)
+		}
+	}
+	sort.Slice(segments, func(i, j int) bool { return segments[i].Seq < segments[j].Seq })
+	return segments
+}
+
+// RestorePointInTime loads the full backup into the mongod at uri, dropping the
+// existing collections, then replays the oplog segments up to and including p.Time.
+func (s *Scheduler) RestorePointInTime(ctx context.Context, plan config.Plan, p *PointInTime, uri string) error {
+	t1 := clock.Now()
+	dir := config.PlanDir(s.Config.StoragePath, plan)
+	for _, name := range append([]string{p.Full}, p.Segments...) {
+		if _, err := os.Stat(filepath.Join(dir, name)); err != nil {
+			return errors.Wrapf(err, "%v is not stored locally", name)
+		}
+	}
+
+	args := []string{"--drop"}
+	if plan.Target.PointInTime {
+		args = append(args, "--oplogReplay")
+	}
+	output, err := restore.FromFile(ctx, filepath.Join(dir, p.Full), uri, args...)
+	if err != nil {
+		return errors.Wrapf(err, "Restoring %v failed", p.Full)
+	}
+	log.WithField("plan", plan.Name).Debugf("Restore output: %v", output)
+
+	// the oplog limit is exclusive, keep the entries of the requested second
+	limit := primitive.Timestamp{T: uint32(p.Time.Unix()) + 1}
+	for _, seg := range p.Segments {
+		output, err := restore.Oplog(ctx, filepath.Join(dir, seg), uri, limit)
+		if err != nil {
+			return err
+		}
+		log.WithField("plan", plan.Name).Debugf("Oplog replay output: %v", output)
+	}
+
+	p.Duration = clock.Since(t1)
+	log.WithField("plan", plan.Name).Infof("Restored to %v from %v and %v oplog segments in %v",
+		p.Time, p.Full, len(p.Segments), p.Duration)
+	return nil
+}
+
+// Resolution is what restores a plan to Time: the archives of the newest backup
+// taken before it and, when the oplog covers Time, the segments to replay.
+type Resolution struct {
+	Plan string    `json:"plan"`
+	Time time.Time `json:"time"`
+	// Timestamp is the run time of the backup
+	Timestamp time.Time       `json:"timestamp"`
+	Archives  []ArchiveCopies `json:"archives"`
+	Chain     string          `json:"chain,omitempty"`
+	Segments  []ArchiveCopies `json:"segments,omitempty"`
+	// Exact is set when the segments replay the oplog up to Time, otherwise
+	// the restore goes back to the state of the backup.
+	Exact bool `json:"exact"`
+	// Restore is the API call that performs the restore
+	Restore string `json:"restore"`
+}
+
+// ArchiveCopies tells where an archive is stored.
+type ArchiveCopies struct {
+	Name         string   `json:"name"`
+	Local        bool     `json:"local"`
+	Destinations []string `json:"destinations"`
+}
+
+// Resolve finds what restores plan to t, preferring a point in time restore
+// over the newest backup taken before t.
+func (s *Scheduler) Resolve(plan string, t time.Time) (*Resolution, error) {
+	artifacts, err := s.Catalog.List(plan)
+	if err != nil {
+		return nil, err
+	}
+	byName := make(map[string]*db.Artifact)
+	for _, a := range artifacts {
+		byName[a.Name] = a
+	}
+	res := &Resolution{Plan: plan, Time: t.UTC(), Archives: make([]ArchiveCopies, 0)}
+
+	if p, err := s.ResolvePointInTime(plan, t); err == nil {
+		full := byName[p.Full]
+		res.Timestamp, res.Chain, res.Exact = full.Timestamp, p.Chain, true
+		res.Archives = append(res.Archives, s.copies(full))
+		for _, seg := range p.Segments {
+			res.Segments = append(res.Segments, s.copies(byName[seg]))
+		}
+		res.Restore = fmt.Sprintf("POST /restore/%v?time=%v", plan, t.Unix())
+		return res, nil
+	}
+
+	// the newest run before t, all its archives when it dumped databases apart
+	for _, a := range artifacts {
+		if restorable(a) && !a.Timestamp.After(t) && a.Timestamp.After(res.Timestamp) {
+			res.Timestamp = a.Timestamp
+		}
+	}
+	if res.Timestamp.IsZero() {
+		return nil, errors.Errorf("Plan %v has no backup taken before %v", plan, t.UTC())
+	}
+	for _, a := range artifacts {
+		if restorable(a) && a.Timestamp.Equal(res.Timestamp) {
+			res.Archives = append(res.Archives, s.copies(a))
+		}
+	}
+	sort.Slice(res.Archives, func(i, j int) bool { return res.Archives[i].Name < res.Archives[j].Name })
+	res.Restore = fmt.Sprintf("POST /restore/%v/%v", plan, res.Archives[0].Name)
+	return res, nil
+}
+
+// restorable is false for oplog segments, checksum files, logs, metadata, cluster
+// manifests, drill reports and the parts of a split archive after the first.
+func restorable(a *db.Artifact) bool {
+	if a.Oplog != nil || a.Seq > 0 || drillReport.MatchString(a.Name) {
+		return false
+	}
+	for _, ext := range []string{".log", ".sha256", ".md5", backup.MetadataExt, backup.ClusterManifestExt, backup.CSIRecordExt, backup.DiskRecordExt, backup.AtlasRecordExt, backup.MigrateRecordExt} {
+		if strings.HasSuffix(a.Name, ext) {
+			return false
+		}
+	}
+	// the files of a per collection backup are restored through its index
+	if strings.Contains(a.Name, ".collections.") && !strings.HasSuffix(a.Name, restore.CollectionsExt) {
+		return false
+	}
+	return !strings.Contains(a.Name, ".part") || strings.HasSuffix(a.Name, ".part000")
+}
+
+func (s *Scheduler) copies(a *db.Artifact) ArchiveCopies {
+	c := ArchiveCopies{Name: a.Name, Destinations: make([]string, 0)}
+	if _, err := os.Stat(filepath.Join(s.planDir(a.Plan), a.Name)); err == nil {
+		c.Local = true
+	}
+	for _, d := range a.Destinations {
+		if d != "Local" {
+			c.Destinations = append(c.Destinations, d)
+		}
+	}
+	return c
+}
@@ -0,0 +1,68 @@
+package scheduler
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"github.com/stefanprodan/mgob/pkg/backup"
+	"github.com/stefanprodan/mgob/pkg/db"
+)
+
+func TestResolvePointInTime(t *testing.T) {
+	at := func(min int) time.Time { return time.Date(2024, 1, 1, 0, min, 0, 0, time.UTC) }
+	completed := func(min int) *time.Time { t := at(min); return &t }
+	name := func(chain string, seq int) string { return backup.SegmentName(chain, seq, ".oplog.bson.gz") }
+	segment := func(chain string, seq int, from, to int) *db.Artifact {
+		return &db.Artifact{
+			Plan:  "p",
+			Name:  backup.SegmentName(chain, seq, ".oplog.bson.gz"),
+			Chain: chain,
+			Seq:   seq,
+			Oplog: &db.OplogRange{From: primitive.Timestamp{T: uint32(at(from).Unix())}, To: primitive.Timestamp{T: uint32(at(to).Unix())}},
+		}
+	}
+
+	s := newTestScheduler(0)
+	s.Catalog = newTestCatalog(t,
+		// legacy full, no end recorded
+		&db.Artifact{Plan: "p", Name: "p-0.gz", Chain: "p-0", Timestamp: at(0)},
+		segment("p-0", 1, 0, 10),
+		segment("p-0", 2, 10, 20),
+		// the second full dumps from 20 to 30
+		&db.Artifact{Plan: "p", Name: "p-20.gz", Chain: "p-20", Timestamp: at(20), Completed: completed(30)},
+		segment("p-20", 1, 20, 40),
+	)
+
+	tests := []struct {
+		min      int
+		full     string
+		segments []string
+	}{
+		{5, "p-0.gz", []string{name("p-0", 1)}},
+		// inside the dump of the second full, the first chain reaches it
+		{20, "p-0.gz", []string{name("p-0", 1), name("p-0", 2)}},
+		{30, "p-20.gz", []string{}},
+		{35, "p-20.gz", []string{name("p-20", 1)}},
+	}
+	for _, tt := range tests {
+		p, err := s.ResolvePointInTime("p", at(tt.min))
+		if err != nil {
+			t.Errorf("ResolvePointInTime(%v) failed %v", tt.min, err)
+			continue
+		}
+		if p.Full != tt.full || !reflect.DeepEqual(p.Segments, tt.segments) {
+			t.Errorf("ResolvePointInTime(%v) = %v %v, want %v %v", tt.min, p.Full, p.Segments, tt.full, tt.segments)
+		}
+	}
+
+	// no other chain covers a time inside the dump
+	if _, err := s.ResolvePointInTime("p", at(25)); err == nil {
+		t.Error("a time inside the full dump was resolved")
+	}
+	if _, err := s.ResolvePointInTime("p", at(45)); err == nil {
+		t.Error("a time after the oplog end was resolved")
+	}
+}
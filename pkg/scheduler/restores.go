@@ -0,0 +1,187 @@
+package scheduler
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/stefanprodan/mgob/pkg/clock"
+	"github.com/stefanprodan/mgob/pkg/config"
+	"github.com/stefanprodan/mgob/pkg/restore"
+)
+
+// RestoreJob is a restore running in the background, Status is running
+// until it returns then ok or failed.
+type RestoreJob struct {
+	ID       string                 `json:"id"`
+	Plan     string                 `json:"plan"`
+	Archive  string                 `json:"archive"`
+	DryRun   bool                   `json:"dryRun,omitempty"`
+	Priority string                 `json:"priority,omitempty"`
+	Status   string                 `json:"status"`
+	Started  time.Time              `json:"started"`
+	Finished *time.Time             `json:"finished,omitempty"`
+	Progress restore.ProgressStatus `json:"progress"`
+	Result   *restore.Result        `json:"result,omitempty"`
+	// Err is the error the restore returned
+	Err      error `json:"-"`
+	progress *restore.Progress
+	done     chan struct{}
+}
+
+// StartRestore restores archive in the background and returns the job as started.
+func (s *Scheduler) StartRestore(plan config.Plan, archive string, dryRun bool) (RestoreJob, error) {
+	if !s.lockRestore(plan.Name) {
+		return RestoreJob{}, ErrRestoreRunning
+	}
+	id := make([]byte, 8)
+	rand.Read(id)
+	job := &RestoreJob{
+		ID:       hex.EncodeToString(id),
+		Plan:     plan.Name,
+		Archive:  archive,
+		DryRun:   dryRun,
+		Priority: string(plan.Restore.Priority),
+		Status:   "running",
+		Started:  clock.Now().UTC(),
+		progress: restore.NewProgress(),
+		done:     make(chan struct{}),
+	}
+
+	s.mu.Lock()
+	s.restores = append(s.restores, job)
+	if len(s.restores) > maxRuns {
+		for i, j := range s.restores {
+			if j.Status != "running" {
+				s.restores = append(s.restores[:i], s.restores[i+1:]...)
+				break
+			}
+		}
+	}
+	started := job.snapshot()
+	s.mu.Unlock()
+
+	go func() {
+		log.WithField("plan", plan.Name).Infof("Restore job %v of %v started", job.ID, archive)
+		res, err := s.restore(s.ctx, plan, archive, dryRun, job.progress)
+
+		finished := clock.Now().UTC()
+		s.mu.Lock()
+		job.Status, job.Result, job.Finished, job.Err = res.Status, &res, &finished, err
+		if err != nil {
+			job.Status = "failed"
+		} else {
+			job.progress.Phase(restore.PhaseDone, 0)
+		}
+		s.mu.Unlock()
+		s.unlockRestore(plan.Name)
+		close(job.done)
+	}()
+	return started, nil
+}
+
+// GetRestore returns the restore job with id, ok is false when it's unknown or was dropped.
+func (s *Scheduler) GetRestore(id string) (RestoreJob, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, j := range s.restores {
+		if j.ID == id {
+			return j.snapshot(), true
+		}
+	}
+	return RestoreJob{}, false
+}
+
+// Restores returns the restore jobs of plan, or of all plans when empty, oldest first.
+func (s *Scheduler) Restores(plan string) []RestoreJob {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	list := make([]RestoreJob, 0)
+	for _, j := range s.restores {
+		if plan == "" || j.Plan == plan {
+			list = append(list, j.snapshot())
+		}
+	}
+	return list
+}
+
+// WaitRestore blocks until the restore job with id returns or ctx is done.
+func (s *Scheduler) WaitRestore(ctx context.Context, id string) (RestoreJob, error) {
+	s.mu.Lock()
+	var job *RestoreJob
+	for _, j := range s.restores {
+		if j.ID == id {
+			job = j
+		}
+	}
+	s.mu.Unlock()
+	if job == nil {
+		return RestoreJob{}, errors.Errorf("Restore job %v not found", id)
+	}
+	select {
+	case <-job.done:
+	case <-ctx.Done():
+		return s.snapshot(job), ctx.Err()
+	}
+	return s.snapshot(job), nil
+}
+
+func (s *Scheduler) snapshot(job *RestoreJob) RestoreJob {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return job.snapshot()
+}
+
+// snapshot copies the job with its current progress, the caller must hold s.mu.
+func (j *RestoreJob) snapshot() RestoreJob {
+	c := *j
+	c.Progress = j.progress.Status()
+	return c
+}
+
+// watchDownload reports the size of the archive downloaded into the tmp dir
+// to p every second until the returned func is called.
+func (s *Scheduler) watchDownload(plan string, archive string, p *restore.Progress) func() {
+	if p == nil {
+		return func() {}
+	}
+	base := strings.TrimSuffix(archive, ".part000")
+	var total int64
+	if artifacts, err := s.Catalog.List(plan); err == nil {
+		for _, a := range artifacts {
+			if a.Name == archive || (base != archive && strings.HasPrefix(a.Name, base+".part")) {
+				total += a.Size
+			}
+		}
+	}
+	p.Phase(restore.PhaseDownload, total)
+
+	stop := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(time.Second)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				files, _ := filepath.Glob(filepath.Join(s.Config.TmpPath, base) + "*")
+				var size int64
+				for _, f := range files {
+					if fi, err := os.Stat(f); err == nil {
+						size += fi.Size()
+					}
+				}
+				p.Set(size)
+			}
+		}
+	}()
+	return func() { close(stop) }
+}
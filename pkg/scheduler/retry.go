@@ -0,0 +1,96 @@
+package scheduler
+
+import (
+	"context"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/stefanprodan/mgob/pkg/backup"
+	"github.com/stefanprodan/mgob/pkg/clock"
+	"github.com/stefanprodan/mgob/pkg/config"
+)
+
+// defaultRetryBackoff is the seconds before the first retry of a failed backup.
+const defaultRetryBackoff = 60
+
+// maxRetryDelay caps the wait before a retry.
+const maxRetryDelay = time.Hour
+
+// retryDelay is the wait before the retry n of plan, the backoff doubles for
+// each retry up to maxRetryDelay.
+func retryDelay(plan config.Plan, n int) time.Duration {
+	backoff := plan.Scheduler.RetryBackoff
+	if backoff <= 0 {
+		backoff = defaultRetryBackoff
+	}
+	if backoff >= int(maxRetryDelay/time.Second) {
+		return maxRetryDelay
+	}
+	delay := time.Duration(backoff) * time.Second
+	for i := 1; i < n && delay < maxRetryDelay; i++ {
+		delay *= 2
+	}
+	if delay > maxRetryDelay {
+		delay = maxRetryDelay
+	}
+	return delay
+}
+
+// runWithRetries runs the scheduled backup of plan and retries it up to
+// scheduler.retries times when it fails, unless it was canceled or skipped or
+// the retry would start after the next scheduled run.
+// A retry of a database mode run only dumps the databases that failed. Each
+// attempt holds a backup slot, freed during the backoff. It returns the
+// result of the last run and the number of retries, errStopped when the
+// scheduler stopped, or ctx was canceled, before the first attempt got a slot.
+func (s *Scheduler) runWithRetries(runCtx context.Context, plan config.Plan, conf *config.AppConfig, modules *config.ModuleConfig) (backup.Result, int, error) {
+	retries := 0
+	resume := false
+	var res backup.Result
+	var err error
+	for {
+		free, ok := s.acquireSlot(runCtx, plan)
+		if !ok {
+			if retries == 0 {
+				err = errStopped
+			}
+			return res, retries, err
+		}
+		ctx, done := s.track(runCtx, plan.Name)
+		if resume {
+			ctx = backup.WithResume(ctx)
+		}
+		res, err = backup.Run(ctx, plan, conf, modules)
+		canceled := ctx.Err() != nil
+		done()
+		free()
+		if err == nil || err == backup.ErrNoDumps || backup.IsUnhealthy(err) || canceled || retries >= plan.Scheduler.Retries {
+			return res, retries, err
+		}
+
+		delay := retryDelay(plan, retries+1)
+		if next := s.next(plan.Name); !next.IsZero() && clock.Now().Add(delay).After(next) {
+			log.WithField("plan", plan.Name).Warnf("Backup failed %v, not retried, the next run at %v comes first", err, next)
+			return res, retries, err
+		}
+		retries++
+		log.WithField("plan", plan.Name).Warnf("Backup failed %v, retry %v of %v in %v", err, retries, plan.Scheduler.Retries, delay)
+		s.metrics.RetryTotal.WithLabelValues(s.metrics.Plan(plan.Name)).Inc()
+		if !sleepCtx(runCtx, delay) {
+			return res, retries, err
+		}
+		if s.IsPaused(plan.Name) {
+			log.WithField("plan", plan.Name).Info("Backup retry skipped, plan is paused")
+			return res, retries, err
+		}
+		resume = false
+		if plan.Mode == config.BackupModeDatabase {
+			rec, rerr := backup.ReadResume(conf, plan.Name)
+			if rerr != nil {
+				log.WithField("plan", plan.Name).Warn(rerr)
+			}
+			resume = rec != nil
+		}
+	}
+}
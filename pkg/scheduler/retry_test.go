@@ -0,0 +1,34 @@
+package scheduler
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stefanprodan/mgob/pkg/config"
+)
+
+func TestRetryDelay(t *testing.T) {
+	tests := []struct {
+		backoff int
+		n       int
+		want    time.Duration
+	}{
+		{0, 1, time.Minute},
+		{0, 2, 2 * time.Minute},
+		{0, 3, 4 * time.Minute},
+		{10, 1, 10 * time.Second},
+		{10, 4, 80 * time.Second},
+		// 60s << 6 is over the cap
+		{60, 7, maxRetryDelay},
+		// large shifts don't overflow into negative or zero delays
+		{60, 64, maxRetryDelay},
+		{1, 1000, maxRetryDelay},
+		{1 << 40, 1, maxRetryDelay},
+	}
+	for _, tt := range tests {
+		plan := config.Plan{Scheduler: config.Scheduler{RetryBackoff: tt.backoff}}
+		if got := retryDelay(plan, tt.n); got != tt.want {
+			t.Errorf("retryDelay(backoff %v, retry %v) = %v, want %v", tt.backoff, tt.n, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,210 @@
+package scheduler
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"time"
+
+	"github.com/dustin/go-humanize"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/stefanprodan/mgob/pkg/backup"
+	"github.com/stefanprodan/mgob/pkg/clock"
+	"github.com/stefanprodan/mgob/pkg/config"
+	"github.com/stefanprodan/mgob/pkg/db"
+	"github.com/stefanprodan/mgob/pkg/notifier"
+)
+
+// maxRuns is the number of on demand runs kept in memory.
+const maxRuns = 100
+
+// Run is an on demand backup, Status is running until it returns
+// then one of ok, failed or skipped.
+type Run struct {
+	ID       string     `json:"id"`
+	Plan     string     `json:"plan"`
+	Status   string     `json:"status"`
+	Started  time.Time  `json:"started"`
+	Finished *time.Time `json:"finished,omitempty"`
+	File     string     `json:"file,omitempty"`
+	Size     int64      `json:"size,omitempty"`
+	Error    string     `json:"error,omitempty"`
+	// Resumed is set when the run resumed the last failed database mode run
+	Resumed bool `json:"resumed,omitempty"`
+	// Phases, Uploads, Archive and Checksum are the ones of the backup result
+	Phases   map[string]time.Duration `json:"phases,omitempty"`
+	Uploads  []db.UploadOutcome       `json:"uploads,omitempty"`
+	Archive  string                   `json:"archive,omitempty"`
+	Checksum string                   `json:"checksum,omitempty"`
+	// Unhealthy is set when the run was skipped by the target health gate
+	Unhealthy bool `json:"-"`
+	done      chan struct{}
+}
+
+// StartRun runs a backup of plan in the background and returns it as started.
+func (s *Scheduler) StartRun(plan config.Plan) Run {
+	return s.startRun(plan, false, false)
+}
+
+// ResumeRun runs in the background the databases the last run of the
+// database mode plan failed to back up and returns the run as started.
+func (s *Scheduler) ResumeRun(plan config.Plan) (Run, error) {
+	if plan.Mode != config.BackupModeDatabase {
+		return Run{}, errors.Errorf("only '%s' backup mode runs can be resumed", config.BackupModeDatabase)
+	}
+	rec, err := backup.ReadResume(s.Config, plan.Name)
+	if err != nil {
+		return Run{}, err
+	}
+	if rec == nil {
+		return Run{}, backup.ErrNothingToResume
+	}
+	return s.startRun(plan, true, false), nil
+}
+
+func (s *Scheduler) startRun(plan config.Plan, resume bool, reserved bool) Run {
+	id := make([]byte, 8)
+	rand.Read(id)
+	run := &Run{
+		ID:      hex.EncodeToString(id),
+		Plan:    plan.Name,
+		Status:  "running",
+		Started: clock.Now().UTC(),
+		Resumed: resume,
+		done:    make(chan struct{}),
+	}
+
+	s.mu.Lock()
+	s.runs = append(s.runs, run)
+	if len(s.runs) > maxRuns {
+		// drop the oldest finished run, running ones stay trackable
+		for i, r := range s.runs {
+			if r.Status != "running" {
+				s.runs = append(s.runs[:i], s.runs[i+1:]...)
+				break
+			}
+		}
+	}
+	started := *run
+	s.mu.Unlock()
+
+	go s.onDemand(plan, run, reserved)
+	return started
+}
+
+// GetRun returns the run with id, ok is false when it's unknown or was dropped.
+func (s *Scheduler) GetRun(id string) (Run, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, r := range s.runs {
+		if r.ID == id {
+			return *r, true
+		}
+	}
+	return Run{}, false
+}
+
+// Runs returns the on demand runs of plan, or of all plans when empty, oldest first.
+func (s *Scheduler) Runs(plan string) []Run {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	list := make([]Run, 0)
+	for _, r := range s.runs {
+		if plan == "" || r.Plan == plan {
+			list = append(list, *r)
+		}
+	}
+	return list
+}
+
+// WaitRun blocks until the run with id returns or ctx is done.
+func (s *Scheduler) WaitRun(ctx context.Context, id string) (Run, error) {
+	run, ok := s.GetRun(id)
+	if !ok {
+		return run, errors.Errorf("Run %v not found", id)
+	}
+	select {
+	case <-run.done:
+	case <-ctx.Done():
+		return run, ctx.Err()
+	}
+	run, _ = s.GetRun(id)
+	return run, nil
+}
+
+// onDemand runs the backup of plan, in a backup slot unless the slot was
+// reserved by its backup set.
+func (s *Scheduler) onDemand(plan config.Plan, run *Run, reserved bool) {
+	log.WithField("plan", plan.Name).Infof("On demand backup %v started", run.ID)
+
+	var res backup.Result
+	err := errStopped
+	free, ok := func() {}, true
+	if !reserved {
+		free, ok = s.acquireSlot(s.ctx, plan)
+	}
+	if ok {
+		mark := s.markTrigger(plan.Name)
+		ctx, done := s.Track(plan.Name)
+		if run.Resumed {
+			ctx = backup.WithResume(ctx)
+		}
+		res, err = backup.Run(ctx, plan, s.Config, s.Modules)
+		done()
+		free()
+		if err == nil {
+			mark()
+		}
+	}
+
+	status := "ok"
+	switch {
+	case err == backup.ErrNoDumps:
+		status = "skipped"
+		log.WithField("plan", plan.Name).Info("On demand backup skipped, no new dumps")
+	case err != nil:
+		status = "failed"
+		if backup.IsUnhealthy(err) {
+			status = "skipped"
+		}
+		s.Sign(plan, res, err)
+		log.WithField("plan", plan.Name).Errorf("On demand backup failed %v", err)
+		if err := notifier.SendNotification(fmt.Sprintf("%v on demand backup failed", plan.Name),
+			phaseNote(err.Error(), res), true, plan); err != nil {
+			log.WithField("plan", plan.Name).Errorf("Notifier failed for on demand backup %v", err)
+		}
+	default:
+		s.Sign(plan, res, err)
+		s.Record(plan, res)
+		log.WithField("plan", plan.Name).Infof("On demand backup finished in %v archive %v size %v",
+			res.Duration, res.Name, humanize.Bytes(uint64(res.Size)))
+		if err := notifier.SendNotification(fmt.Sprintf("%v on demand backup finished", plan.Name),
+			phaseNote(fmt.Sprintf("%v backup finished in %v archive size %v",
+				res.Name, res.Duration, humanize.Bytes(uint64(res.Size))), res),
+			false, plan); err != nil {
+			log.WithField("plan", plan.Name).Errorf("Notifier failed for on demand backup %v", err)
+		}
+	}
+
+	s.observeUsage(plan, res)
+	s.observePhases(plan, res)
+	finished := clock.Now().UTC()
+	s.mu.Lock()
+	run.Status = status
+	if err != nil {
+		run.Error = err.Error()
+	}
+	run.Unhealthy = backup.IsUnhealthy(err)
+	run.Finished = &finished
+	run.File = res.Name
+	run.Size = res.Size
+	run.Phases = res.Phases
+	run.Uploads = res.Outcomes
+	run.Archive = res.Archive
+	run.Checksum = res.Checksum
+	s.mu.Unlock()
+	close(run.done)
+}
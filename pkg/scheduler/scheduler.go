@@ -1,7 +1,9 @@
 package scheduler
 
 import (
+	"context"
 	"fmt"
+	"sync"
 	"time"
 
 	"github.com/dustin/go-humanize"
@@ -10,6 +12,7 @@ import (
 	log "github.com/sirupsen/logrus"
 
 	"github.com/stefanprodan/mgob/pkg/backup"
+	"github.com/stefanprodan/mgob/pkg/clock"
 	"github.com/stefanprodan/mgob/pkg/config"
 	"github.com/stefanprodan/mgob/pkg/db"
 	"github.com/stefanprodan/mgob/pkg/metrics"
@@ -22,59 +25,348 @@ type Scheduler struct {
 	Config  *config.AppConfig
 	Modules *config.ModuleConfig
 	Stats   *db.StatusStore
-	metrics *metrics.BackupMetrics
+	Catalog *db.CatalogStore
+	SetRuns *db.SetStore
+	// Manifests is the signed log of the backup runs
+	Manifests *db.ManifestStore
+	metrics   *metrics.BackupMetrics
+	ctx       context.Context
+	cancel    context.CancelFunc
+	mu        sync.Mutex
+	running   map[string]map[int]context.CancelFunc
+	lastID    int
+	entries   map[string]cron.EntryID
+	// reconciles holds the reconcile cron entries of the plans that have one
+	reconciles map[string]cron.EntryID
+	paused     map[string]bool
+	// verifies holds the restore verification cron entries
+	verifies map[string]cron.EntryID
+	// probes holds the destination probe cron entries
+	probes map[string]cron.EntryID
+	// tailers cancels the PITR oplog tailers
+	tailers map[string]context.CancelFunc
+	// triggers are the change stream triggers
+	triggers map[string]*trigger
+	// claimed cancels the scheduled run of each plan, queued holds the ones with a run waiting for it
+	claimed map[string]context.CancelFunc
+	queued  map[string]bool
+	// slots bounds the backups running at once, nil when unlimited,
+	// slotsMu is held by the backup set reserving its slots
+	slots   chan struct{}
+	slotsMu sync.Mutex
+	// runs are the on demand backups, newest last
+	runs      []*Run
+	restoring map[string]bool
+	// restores are the background restore jobs, newest last
+	restores []*RestoreJob
+	// urgent counts the urgent restores running, scheduled backups wait for them
+	urgent int
+	// overBudget holds the plans whose projected storage cost is over their budget
+	overBudget map[string]bool
+	// reloadSum fingerprints the plan and key files at the last reload
+	reloadSum string
+	reloadMu  sync.Mutex
+	// sets holds the backup sets with a run in progress
+	sets map[string]bool
+	// cache keeps the archives downloaded for restores, nil without a cache size
+	cache *downloadCache
 }
 
-func New(plans []config.Plan, conf *config.AppConfig, modules *config.ModuleConfig, stats *db.StatusStore) *Scheduler {
+func New(plans []config.Plan, conf *config.AppConfig, modules *config.ModuleConfig, stats *db.StatusStore, catalog *db.CatalogStore, manifests *db.ManifestStore, sets *db.SetStore) *Scheduler {
+	// the labels are validated when the config is loaded
+	labels, _ := metrics.ParseLabels(conf.MetricsLabels, conf.MetricsMaxDatabases)
 	s := &Scheduler{
-		Cron:    cron.New(),
-		Plans:   plans,
-		Config:  conf,
-		Modules: modules,
-		Stats:   stats,
-		metrics: metrics.New("mgob", "scheduler"),
+		Cron:       cron.New(),
+		Plans:      plans,
+		Config:     conf,
+		Modules:    modules,
+		Stats:      stats,
+		Catalog:    catalog,
+		Manifests:  manifests,
+		SetRuns:    sets,
+		metrics:    metrics.New("mgob", "scheduler", labels),
+		running:    make(map[string]map[int]context.CancelFunc),
+		entries:    make(map[string]cron.EntryID),
+		reconciles: make(map[string]cron.EntryID),
+		verifies:   make(map[string]cron.EntryID),
+		probes:     make(map[string]cron.EntryID),
+		paused:     make(map[string]bool),
+		tailers:    make(map[string]context.CancelFunc),
+		triggers:   make(map[string]*trigger),
+		claimed:    make(map[string]context.CancelFunc),
+		queued:     make(map[string]bool),
+		restoring:  make(map[string]bool),
+		overBudget: make(map[string]bool),
+		sets:       make(map[string]bool),
+	}
+	// the cache size is validated when the config is loaded
+	if limit, err := humanize.ParseBytes(conf.CacheSize); err == nil && limit > 0 {
+		s.cache = newDownloadCache(conf.CachePath, int64(limit))
 	}
+	if conf.MaxConcurrentBackups > 0 {
+		s.slots = make(chan struct{}, conf.MaxConcurrentBackups)
+	}
+	s.ctx, s.cancel = context.WithCancel(context.Background())
 
 	return s
 }
 
+// Track returns a context for a run of plan that is cancelled by Cancel or Stop,
+// the returned func must be called when the run is done.
+func (s *Scheduler) Track(plan string) (context.Context, func()) {
+	return s.track(s.ctx, plan)
+}
+
+// track is Track for a run in the parent context, its cancellation cancels the run.
+func (s *Scheduler) track(parent context.Context, plan string) (context.Context, func()) {
+	ctx, cancel := context.WithCancel(parent)
+
+	s.mu.Lock()
+	s.lastID++
+	id := s.lastID
+	if s.running[plan] == nil {
+		s.running[plan] = make(map[int]context.CancelFunc)
+	}
+	s.running[plan][id] = cancel
+	s.mu.Unlock()
+
+	return ctx, func() {
+		s.mu.Lock()
+		delete(s.running[plan], id)
+		if len(s.running[plan]) == 0 {
+			delete(s.running, plan)
+		}
+		s.mu.Unlock()
+		cancel()
+	}
+}
+
+// Cancel stops all in-flight runs of plan, the scheduled one as well while it
+// waits for a slot or a retry, and reports whether any was found.
+func (s *Scheduler) Cancel(plan string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	runs, ok := s.running[plan]
+	for _, cancel := range runs {
+		cancel()
+	}
+	if cancel := s.claimed[plan]; cancel != nil {
+		cancel()
+		ok = true
+	}
+	return ok
+}
+
+// Stop prevents new runs, cancels the in-flight ones and waits for them to return.
+func (s *Scheduler) Stop(timeout time.Duration) {
+	done := s.Cron.Stop()
+	s.cancel()
+	select {
+	case <-done.Done():
+	case <-time.After(timeout):
+		log.Warnf("Scheduler stop timed out after %v", timeout)
+	}
+}
+
+// parseSchedules parses the backup, reconcile and verify crons of plan,
+// the last two are nil when the plan doesn't set them.
+func parseSchedules(plan config.Plan) (cron.Schedule, cron.Schedule, cron.Schedule, error) {
+	schedule, err := cron.ParseStandard(plan.Scheduler.Cron)
+	if err != nil {
+		return nil, nil, nil, errors.Wrapf(err, "Invalid cron %v for plan %v", plan.Scheduler.Cron, plan.Name)
+	}
+	switch plan.Scheduler.Overlap {
+	case "", config.OverlapSkip, config.OverlapQueue, config.OverlapCancel:
+	default:
+		return nil, nil, nil, errors.Errorf("Invalid overlap %v for plan %v, use skip, queue or cancel-previous", plan.Scheduler.Overlap, plan.Name)
+	}
+	var reconcile cron.Schedule
+	if plan.Reconcile != nil {
+		reconcile, err = cron.ParseStandard(plan.Reconcile.Cron)
+		if err != nil {
+			return nil, nil, nil, errors.Wrapf(err, "Invalid reconcile cron %v for plan %v", plan.Reconcile.Cron, plan.Name)
+		}
+	}
+	var verify cron.Schedule
+	if plan.Verify != nil {
+		verify, err = cron.ParseStandard(plan.Verify.Cron)
+		if err != nil {
+			return nil, nil, nil, errors.Wrapf(err, "Invalid verify cron %v for plan %v", plan.Verify.Cron, plan.Name)
+		}
+		for _, format := range plan.Verify.Reports {
+			if format != config.ReportMarkdown && format != config.ReportHTML {
+				return nil, nil, nil, errors.Errorf("Invalid verify report %v for plan %v, use markdown or html", format, plan.Name)
+			}
+		}
+	}
+	return schedule, reconcile, verify, nil
+}
+
+// schedule replaces the cron entries of plan, the caller must hold s.mu.
+func (s *Scheduler) schedule(plan config.Plan) error {
+	schedule, reconcile, verify, err := parseSchedules(plan)
+	if err != nil {
+		return err
+	}
+
+	if id, ok := s.entries[plan.Name]; ok {
+		s.Cron.Remove(id)
+	}
+	if id, ok := s.reconciles[plan.Name]; ok {
+		s.Cron.Remove(id)
+		delete(s.reconciles, plan.Name)
+	}
+	if id, ok := s.verifies[plan.Name]; ok {
+		s.Cron.Remove(id)
+		delete(s.verifies, plan.Name)
+	}
+	if id, ok := s.probes[plan.Name]; ok {
+		s.Cron.Remove(id)
+		delete(s.probes, plan.Name)
+	}
+
+	// the overlap policy of the plan applies to the runs still running
+	s.entries[plan.Name] = s.Cron.Schedule(schedule, &backupJob{plan.Name, plan, s.Config, s.Modules, s.Stats, s.metrics, s.Cron, s})
+	if reconcile != nil {
+		s.reconciles[plan.Name] = s.Cron.Schedule(reconcile, cron.FuncJob(func() {
+			s.reconcileJob(plan)
+		}))
+	}
+	if verify != nil {
+		s.verifies[plan.Name] = s.Cron.Schedule(verify, cron.NewChain(cron.SkipIfStillRunning(cron.DefaultLogger)).
+			Then(cron.FuncJob(func() {
+				s.verifyJob(plan)
+			})))
+	}
+	if plan.Probe != nil {
+		s.probes[plan.Name] = s.Cron.Schedule(cron.Every(probeInterval(plan.Probe)), cron.NewChain(cron.SkipIfStillRunning(cron.DefaultLogger)).
+			Then(cron.FuncJob(func() {
+				s.probeJob(plan)
+			})))
+	}
+	s.startTailer(plan)
+	s.startTrigger(plan)
+	return nil
+}
+
+// Apply schedules a new plan or replaces the schedule of an existing one.
+func (s *Scheduler) Apply(plan config.Plan) error {
+	s.mu.Lock()
+	if err := s.schedule(plan); err != nil {
+		s.mu.Unlock()
+		return err
+	}
+	plans := make([]config.Plan, 0, len(s.Plans)+1)
+	for _, p := range s.Plans {
+		if p.Name != plan.Name {
+			plans = append(plans, p)
+		}
+	}
+	s.Plans = append(plans, plan)
+	s.mu.Unlock()
+
+	status, err := s.Stats.Get(plan.Name)
+	if err != nil {
+		return err
+	}
+	if status == nil {
+		status = &db.Status{Plan: plan.Name}
+	}
+	status.NextRun = s.next(plan.Name)
+	if err := s.Stats.Put(status); err != nil {
+		return err
+	}
+	s.observeCost(plan)
+	return nil
+}
+
+// Lookup returns the scheduled plan named name.
+func (s *Scheduler) Lookup(name string) (config.Plan, bool) {
+	for _, plan := range s.plans() {
+		if plan.Name == name {
+			return plan, true
+		}
+	}
+	return config.Plan{}, false
+}
+
+func (s *Scheduler) plans() []config.Plan {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.Plans
+}
+
 func (s *Scheduler) Start() error {
+	backup.OnRetention(s.forgetLocal)
 	for _, plan := range s.Plans {
-		schedule, err := cron.ParseStandard(plan.Scheduler.Cron)
-		if err != nil {
-			return errors.Wrapf(err, "Invalid cron %v for plan %v", plan.Scheduler.Cron, plan.Name)
+		if err := s.schedule(plan); err != nil {
+			return err
 		}
-		wrappedJob := cron.NewChain(cron.SkipIfStillRunning(cron.DefaultLogger)).
-			Then(&backupJob{plan.Name, plan, s.Config, s.Modules, s.Stats, s.metrics, s.Cron})
-		s.Cron.Schedule(schedule, wrappedJob)
+		s.observeCost(plan)
+	}
+	if err := s.scheduleSets(); err != nil {
+		return err
 	}
 
 	s.Cron.AddFunc("0 0 */1 * *", func() {
 		backup.TmpCleanup(s.Config.TmpPath)
 	})
+	if s.Config.CompactInterval > 0 {
+		s.Cron.Schedule(cron.Every(time.Duration(s.Config.CompactInterval)*time.Hour),
+			cron.NewChain(cron.SkipIfStillRunning(cron.DefaultLogger)).Then(cron.FuncJob(s.gcJob)))
+	}
+	if s.Config.ReloadInterval > 0 {
+		s.reloadSum = s.configSum()
+		s.Cron.Schedule(cron.Every(time.Duration(s.Config.ReloadInterval)*time.Second),
+			cron.NewChain(cron.SkipIfStillRunning(cron.DefaultLogger)).Then(cron.FuncJob(s.reloadJob)))
+	}
+	s.observeStore()
 
 	s.Cron.Start()
+	if s.Config.StorageWatch {
+		go s.watchStorage()
+	}
+
 	stats := make([]*db.Status, 0)
-	for _, e := range s.Cron.Entries() {
-		switch e.Job.(type) {
-		case backupJob:
-			status := &db.Status{
-				Plan:    e.Job.(backupJob).name,
-				NextRun: e.Next,
-			}
-			stats = append(stats, status)
-		default:
-			log.Infof("Next tmp cleanup run at %v", e.Next)
+	for _, plan := range s.Plans {
+		status := &db.Status{
+			Plan:    plan.Name,
+			NextRun: s.next(plan.Name),
 		}
+		stats = append(stats, status)
 	}
 
 	if err := s.Stats.Sync(stats); err != nil {
 		log.Errorf("Status store sync failed %v", err)
 	}
 
+	// restore the paused plans
+	if all, err := s.Stats.GetAll(); err == nil {
+		s.mu.Lock()
+		for _, status := range all {
+			if status.Paused {
+				s.paused[status.Plan] = true
+				log.WithField("plan", status.Plan).Info("Plan is paused")
+			}
+		}
+		s.mu.Unlock()
+	}
+
 	return nil
 }
 
+// next returns the next scheduled run of plan.
+func (s *Scheduler) next(plan string) time.Time {
+	s.mu.Lock()
+	id, ok := s.entries[plan]
+	s.mu.Unlock()
+	if ok {
+		return s.Cron.Entry(id).Next
+	}
+	return time.Time{}
+}
+
 type backupJob struct {
 	name    string
 	plan    config.Plan
@@ -83,57 +375,116 @@ type backupJob struct {
 	stats   *db.StatusStore
 	metrics *metrics.BackupMetrics
 	cron    *cron.Cron
+	sch     *Scheduler
 }
 
 func (b backupJob) Run() {
+	if b.sch.IsPaused(b.plan.Name) {
+		log.WithField("plan", b.plan.Name).Info("Backup skipped, plan is paused")
+		return
+	}
+	ctx, release, ok := b.sch.claim(b.plan)
+	if !ok {
+		return
+	}
+	defer release()
+	if !b.sch.waitUrgent(ctx, b.plan) {
+		return
+	}
+	if !b.sch.waitPressure(ctx, b.plan) {
+		return
+	}
+	if t := b.plan.Trigger; t != nil && t.SkipIdle && b.sch.idle(b.plan.Name) {
+		log.WithField("plan", b.plan.Name).Info("Backup skipped, no write since the last backup")
+		return
+	}
+	mark := b.sch.markTrigger(b.plan.Name)
+
 	log.WithField("plan", b.plan.Name).Info("Backup started")
 	status := "200"
 	var backupLog string
-	t1 := time.Now()
+	t1 := clock.Now()
 
-	res, err := backup.Run(b.plan, b.conf, b.modules)
-	if err != nil {
-		status = "500"
-		backupLog = fmt.Sprintf("Backup failed %v", err)
-		log.WithField("plan", b.plan.Name).Error(backupLog)
+	res, retries, err := b.sch.runWithRetries(ctx, b.plan, b.conf, b.modules)
+	if err == errStopped {
+		return
+	}
+	if err == backup.ErrNoDumps {
+		log.WithField("plan", b.plan.Name).Info("Backup skipped, no new dumps")
+		return
+	}
+	if backup.IsUnhealthy(err) {
+		status = "503"
+		backupLog = fmt.Sprintf("Backup skipped %v", err)
+		log.WithField("plan", b.plan.Name).Warn(backupLog)
 
-		if err := notifier.SendNotification(fmt.Sprintf("%v backup failed", b.plan.Name),
+		if err := notifier.SendNotification(fmt.Sprintf("%v backup skipped", b.plan.Name),
 			err.Error(), true, b.plan); err != nil {
 			log.WithField("plan", b.plan.Name).Errorf("Notifier failed %v", err)
 		}
+	} else if err != nil {
+		status = "500"
+		backupLog = fmt.Sprintf("Backup failed %v", err)
+		if retries > 0 {
+			backupLog = fmt.Sprintf("Backup failed after %v retries %v", retries, err)
+		}
+		log.WithField("plan", b.plan.Name).Error(backupLog)
 	} else {
 		backupLog = fmt.Sprintf("Backup finished in %v archive %v size %v",
 			res.Duration, res.Name, humanize.Bytes(uint64(res.Size)))
+		if retries > 0 {
+			backupLog += fmt.Sprintf(" after %v retries", retries)
+		}
 
 		log.WithField("plan", b.plan.Name).Info(backupLog)
+		mark()
+		b.sch.Record(b.plan, res)
 		if err := notifier.SendNotification(fmt.Sprintf("%v backup finished", b.plan.Name),
-			fmt.Sprintf("%v backup finished in %v archive size %v",
-				res.Name, res.Duration, humanize.Bytes(uint64(res.Size))),
+			phaseNote(fmt.Sprintf("%v backup finished in %v archive size %v",
+				res.Name, res.Duration, humanize.Bytes(uint64(res.Size))), res),
 			false, b.plan); err != nil {
 			log.WithField("plan", b.plan.Name).Errorf("Notifier failed %v", err)
 		}
 	}
 
-	t2 := time.Now()
-	b.metrics.Total.WithLabelValues(b.plan.Name, status).Inc()
-	b.metrics.Size.WithLabelValues(b.plan.Name, status).Set(float64(res.Size))
-	b.metrics.Latency.WithLabelValues(b.plan.Name, status).Observe(t2.Sub(t1).Seconds())
+	t2 := clock.Now()
+	b.sch.Sign(b.plan, res, err)
+	planLabel := b.metrics.Plan(b.plan.Name)
+	b.metrics.Total.WithLabelValues(planLabel, status).Inc()
+	b.metrics.Size.WithLabelValues(planLabel, status).Set(float64(res.Size))
+	b.metrics.Latency.WithLabelValues(planLabel, status).Observe(t2.Sub(t1).Seconds())
+	if err == nil {
+		b.metrics.SetDatabaseSizes(b.plan.Name, res.Databases)
+	}
+	if res.Estimate > 0 {
+		b.metrics.EstimatedSize.WithLabelValues(planLabel).Set(float64(res.Estimate))
+	}
+	b.sch.observeUsage(b.plan, res)
+	b.sch.observePhases(b.plan, res)
+	if err == nil {
+		b.sch.observeCost(b.plan)
+	}
 
 	s := &db.Status{
-		LastRun:       &res.Timestamp,
-		LastRunStatus: status,
-		Plan:          b.plan.Name,
-		LastRunLog:    backupLog,
-	}
-
-	for _, e := range b.cron.Entries() {
-		switch e.Job.(type) {
-		case backupJob:
-			if e.Job.(backupJob).name == b.plan.Name {
-				s.NextRun = e.Next
-				break
-			}
-		}
+		LastRun:         &res.Timestamp,
+		LastRunStatus:   status,
+		Plan:            b.plan.Name,
+		LastRunLog:      backupLog,
+		Retries:         retries,
+		NextRun:         b.sch.next(b.plan.Name),
+		Paused:          b.sch.IsPaused(b.plan.Name),
+		LastRunPhases:   res.Phases,
+		LastRunUploads:  res.Outcomes,
+		LastRunArchive:  res.Archive,
+		LastRunChecksum: res.Checksum,
+	}
+	prev, perr := b.stats.Get(b.plan.Name)
+	if perr != nil {
+		log.WithField("plan", b.plan.Name).Errorf("Status store failed %v", perr)
+	}
+	track(prev, s)
+	if status == "500" {
+		notifyFailure(b.plan, s, fmt.Sprintf("%v backup failed", b.plan.Name), phaseNote(err.Error(), res))
 	}
 
 	log.WithField("plan", b.plan.Name).Infof("Next run at %v", s.NextRun)
@@ -0,0 +1,268 @@
+package scheduler
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/robfig/cron/v3"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/stefanprodan/mgob/pkg/backup"
+	"github.com/stefanprodan/mgob/pkg/clock"
+	"github.com/stefanprodan/mgob/pkg/config"
+	"github.com/stefanprodan/mgob/pkg/db"
+)
+
+// ErrSetRunning is returned when a run of the backup set is already in progress.
+var ErrSetRunning = errors.New("a run of this backup set is already running")
+
+// defaultHookTimeout is the timeout of the set hooks in minutes.
+const defaultHookTimeout = 10
+
+// scheduleSets checks that the plans of the backup sets are scheduled and
+// schedules the sets that have a cron.
+func (s *Scheduler) scheduleSets() error {
+	for name, set := range s.Config.Sets {
+		if _, err := s.setPlans(name); err != nil {
+			return err
+		}
+		if set.Cron == "" {
+			continue
+		}
+		schedule, err := cron.ParseStandard(set.Cron)
+		if err != nil {
+			return errors.Wrapf(err, "Invalid cron %v for backup set %v", set.Cron, name)
+		}
+		name := name
+		s.Cron.Schedule(schedule, cron.FuncJob(func() {
+			s.setJob(name)
+		}))
+	}
+	return nil
+}
+
+// setJob runs a scheduled backup set, unless one of its plans is paused.
+func (s *Scheduler) setJob(name string) {
+	plans, err := s.setPlans(name)
+	if err == nil {
+		s.mu.Lock()
+		for _, plan := range plans {
+			if s.paused[plan.Name] {
+				err = errors.Errorf("plan %v is paused", plan.Name)
+			}
+		}
+		s.mu.Unlock()
+	}
+	if err == nil {
+		_, err = s.StartSet(name)
+	}
+	if err != nil {
+		log.Warnf("Scheduled run of backup set %v skipped %v", name, err)
+	}
+}
+
+// setPlans returns the scheduled plans of the backup set name.
+func (s *Scheduler) setPlans(name string) ([]config.Plan, error) {
+	set, ok := s.Config.Sets[name]
+	if !ok {
+		return nil, errors.Errorf("Backup set %v not found", name)
+	}
+	plans := make([]config.Plan, 0, len(set.Plans))
+	for _, p := range set.Plans {
+		plan, ok := s.Lookup(p)
+		if !ok {
+			return nil, errors.Errorf("Plan %v of backup set %v not found", p, name)
+		}
+		plans = append(plans, plan)
+	}
+	return plans, nil
+}
+
+// StartSet runs the backup set name in the background and returns the run
+// as started. The plans are backed up concurrently once the pre hook
+// quiesced the application, the post hook runs when they all returned.
+func (s *Scheduler) StartSet(name string) (db.SetRun, error) {
+	plans, err := s.setPlans(name)
+	if err != nil {
+		return db.SetRun{}, err
+	}
+	s.mu.Lock()
+	if s.sets[name] {
+		s.mu.Unlock()
+		return db.SetRun{}, ErrSetRunning
+	}
+	s.sets[name] = true
+	s.mu.Unlock()
+
+	started := clock.Now().UTC()
+	run := &db.SetRun{
+		ID:      fmt.Sprintf("%v-%v", name, started.Unix()),
+		Set:     name,
+		Status:  "running",
+		Started: started,
+		Plans:   make([]db.SetPlanRun, 0, len(plans)),
+	}
+	for _, plan := range plans {
+		run.Plans = append(run.Plans, db.SetPlanRun{Plan: plan.Name, Status: "pending"})
+	}
+	if err := s.SetRuns.Put(run); err != nil {
+		s.mu.Lock()
+		delete(s.sets, name)
+		s.mu.Unlock()
+		return db.SetRun{}, err
+	}
+	state := *run
+	state.Plans = append([]db.SetPlanRun(nil), run.Plans...)
+	go s.runSet(s.Config.Sets[name], run, plans)
+	return state, nil
+}
+
+func (s *Scheduler) runSet(set config.BackupSet, run *db.SetRun, plans []config.Plan) {
+	defer func() {
+		s.mu.Lock()
+		delete(s.sets, run.Set)
+		s.mu.Unlock()
+	}()
+	timeout := set.Timeout
+	if timeout <= 0 {
+		timeout = defaultHookTimeout
+	}
+	log.Infof("Backup set %v run %v started", run.Set, run.ID)
+
+	failed := make([]string, 0)
+	// the slots are reserved before the application is quiesced, the plans
+	// don't queue behind other backups while it waits
+	free, ok := s.reserveSlots(s.ctx, run.Set, len(plans))
+	if !ok {
+		free = func() {}
+		failed = append(failed, errStopped.Error())
+	}
+	if len(failed) == 0 && !set.Pre.Empty() {
+		if out, err := backup.RunHook(s.ctx, set.Pre, timeout); err != nil {
+			failed = append(failed, "pre "+err.Error())
+		} else {
+			log.Infof("Backup set %v pre hook finished %v", run.Set, out)
+		}
+	}
+	if len(failed) == 0 {
+		// every plan starts before any is waited for, they dump the same point in time
+		for i, plan := range plans {
+			r := s.startRun(plan, false, true)
+			run.Plans[i].RunID = r.ID
+			run.Plans[i].Status = r.Status
+		}
+		if err := s.SetRuns.Put(run); err != nil {
+			log.Errorf("Backup set %v run %v store failed %v", run.Set, run.ID, err)
+		}
+		for i := range run.Plans {
+			r, err := s.WaitRun(context.Background(), run.Plans[i].RunID)
+			if err != nil {
+				r.Status, r.Error = "failed", err.Error()
+			}
+			run.Plans[i].Status = r.Status
+			run.Plans[i].Archive = r.File
+			run.Plans[i].Size = r.Size
+			run.Plans[i].Error = r.Error
+			if r.Status != "ok" {
+				failed = append(failed, fmt.Sprintf("%v %v %v", r.Plan, r.Status, r.Error))
+			}
+		}
+	}
+	free()
+	// the post hook resumes the application even when the pre hook failed half way
+	if !set.Post.Empty() {
+		if out, err := backup.RunHook(context.Background(), set.Post, timeout); err != nil {
+			failed = append(failed, "post "+err.Error())
+		} else {
+			log.Infof("Backup set %v post hook finished %v", run.Set, out)
+		}
+	}
+
+	finished := clock.Now().UTC()
+	run.Finished = &finished
+	run.Status = "ok"
+	if len(failed) > 0 {
+		run.Status = "failed"
+		run.Error = strings.Join(failed, ", ")
+		log.Errorf("Backup set %v run %v failed %v", run.Set, run.ID, run.Error)
+	} else {
+		log.Infof("Backup set %v run %v finished in %v", run.Set, run.ID, finished.Sub(run.Started))
+	}
+	if err := s.SetRuns.Put(run); err != nil {
+		log.Errorf("Backup set %v run %v store failed %v", run.Set, run.ID, err)
+	}
+	s.pruneSetRuns(run.Set)
+}
+
+// pruneSetRuns drops the oldest finished runs of set over maxRuns.
+func (s *Scheduler) pruneSetRuns(set string) {
+	runs, err := s.SetRuns.List(set)
+	if err != nil {
+		log.Errorf("Backup set %v runs list failed %v", set, err)
+		return
+	}
+	for i := maxRuns; i < len(runs); i++ {
+		if runs[i].Status != "running" {
+			s.SetRuns.Delete(runs[i].ID)
+		}
+	}
+}
+
+// RestoreSet restores the archives of the set run id together, each into
+// the restore target of its plan, and returns the started restore jobs.
+// Only runs where every plan backed up can be restored, and none of the
+// plans may be restoring already.
+func (s *Scheduler) RestoreSet(id string, dryRun bool) ([]RestoreJob, error) {
+	run, err := s.SetRuns.Get(id)
+	if err != nil {
+		return nil, err
+	}
+	if run == nil {
+		return nil, errors.Errorf("Backup set run %v not found", id)
+	}
+	if run.Status != "ok" {
+		return nil, errors.Errorf("Backup set run %v is %v, only complete runs can be restored", id, run.Status)
+	}
+	plans := make([]config.Plan, 0, len(run.Plans))
+	for _, p := range run.Plans {
+		plan, ok := s.Lookup(p.Plan)
+		switch {
+		case !ok:
+			return nil, errors.Errorf("Plan %v not found", p.Plan)
+		case plan.Restore == nil || plan.Restore.Uri == "":
+			return nil, errors.Errorf("Plan %v has no restore target", p.Plan)
+		case plan.Approval != nil && !dryRun:
+			return nil, errors.Errorf("Plan %v requires approvals, restore its archive on its own", p.Plan)
+		case !restorable(&db.Artifact{Name: p.Archive}):
+			return nil, errors.Errorf("Archive %v of plan %v can't be restored", p.Archive, p.Plan)
+		}
+		plans = append(plans, plan)
+	}
+
+	s.mu.Lock()
+	restoring := make([]string, 0)
+	for _, plan := range plans {
+		if s.restoring[plan.Name] {
+			restoring = append(restoring, plan.Name)
+		}
+	}
+	s.mu.Unlock()
+	if len(restoring) > 0 {
+		sort.Strings(restoring)
+		return nil, errors.Wrapf(ErrRestoreRunning, "%v", strings.Join(restoring, ", "))
+	}
+
+	jobs := make([]RestoreJob, 0, len(plans))
+	for i, plan := range plans {
+		job, err := s.StartRestore(plan, run.Plans[i].Archive, dryRun)
+		if err != nil {
+			return jobs, errors.Wrapf(err, "Restoring %v of plan %v failed", run.Plans[i].Archive, plan.Name)
+		}
+		jobs = append(jobs, job)
+	}
+	log.Infof("Backup set run %v restore started", id)
+	return jobs, nil
+}
@@ -0,0 +1,118 @@
+package scheduler
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/robfig/cron/v3"
+
+	"github.com/stefanprodan/mgob/pkg/backup"
+	"github.com/stefanprodan/mgob/pkg/clock"
+	"github.com/stefanprodan/mgob/pkg/config"
+)
+
+// Simulation is what the scheduler would do with a plan, nothing is run.
+type Simulation struct {
+	Plan      string      `json:"plan"`
+	Mode      string      `json:"mode"`
+	Next      []time.Time `json:"next"`
+	Reconcile []time.Time `json:"reconcile,omitempty"`
+	Verify    []time.Time `json:"verify,omitempty"`
+	// Command is the dump command with the credentials masked
+	Command      []string         `json:"command,omitempty"`
+	Executor     string           `json:"executor"`
+	Destinations []SimulatedRoute `json:"destinations"`
+	Retention    int              `json:"retention"`
+	Expired      []string         `json:"expired"`
+	Replaces     bool             `json:"replaces"`
+	// Cost is the projected storage cost, set when a pricing is configured
+	Cost     *backup.CostEstimate `json:"cost,omitempty"`
+	Warnings []string             `json:"warnings,omitempty"`
+}
+
+// SimulatedRoute lists the destinations of a route, Route is empty for the
+// plan own destinations.
+type SimulatedRoute struct {
+	Route        string   `json:"route,omitempty"`
+	Destinations []string `json:"destinations"`
+}
+
+// Simulate returns the next n fire times of plan, its dump command, the
+// destinations of each route and the stored files the retention of the
+// next run removes. Replaces tells if a plan with this name is scheduled.
+func (s *Scheduler) Simulate(plan config.Plan, n int) (*Simulation, error) {
+	schedule, reconcile, verify, err := parseSchedules(plan)
+	if err != nil {
+		return nil, err
+	}
+	now := clock.Now()
+	sim := &Simulation{
+		Plan:         plan.Name,
+		Mode:         string(plan.Mode),
+		Next:         fireTimes(schedule, now, n),
+		Reconcile:    fireTimes(reconcile, now, n),
+		Verify:       fireTimes(verify, now, n),
+		Command:      backup.DumpCommand(plan, s.Config, now),
+		Executor:     backup.ExecutorFor(plan, s.Config).Name(),
+		Destinations: make([]SimulatedRoute, 0),
+		Retention:    plan.Scheduler.Retention,
+	}
+	if sim.Mode == "" {
+		sim.Mode = string(config.BackupModeSingle)
+	}
+	current, replaces := s.Lookup(plan.Name)
+	sim.Replaces = replaces
+
+	for _, routed := range backup.RoutedPlans(plan) {
+		route := SimulatedRoute{Route: routed.Route, Destinations: make([]string, 0)}
+		for _, d := range backup.Destinations(routed.Plan, s.Config, now) {
+			route.Destinations = append(route.Destinations, d.Name())
+		}
+		sim.Destinations = append(sim.Destinations, route)
+	}
+
+	if sim.Expired, err = backup.ExpiredFiles(plan, s.Config); err != nil {
+		return nil, err
+	}
+	if s.Config.Pricing != nil {
+		if sim.Cost, err = backup.EstimateCost(plan, s.Config); err != nil {
+			return nil, err
+		}
+		sim.Warnings = costWarnings(sim.Cost, current, replaces, s.Config)
+	}
+	return sim, nil
+}
+
+// costWarnings warns when the simulated plan goes over its budget, along with
+// the cost of the plan it replaces.
+func costWarnings(est *backup.CostEstimate, current config.Plan, replaces bool, conf *config.AppConfig) []string {
+	if est.Budget <= 0 {
+		return nil
+	}
+	warnings := make([]string, 0)
+	if est.OverBudget {
+		msg := budgetWarning(est)
+		if replaces {
+			if prev, err := backup.EstimateCost(current, conf); err == nil {
+				msg += fmt.Sprintf(", up from $%.2f/month with retention %v", prev.Monthly, prev.Retention)
+			}
+		}
+		warnings = append(warnings, msg)
+	}
+	if est.Unbounded {
+		warnings = append(warnings, "the plan has no retention, its storage cost grows with every run")
+	}
+	return warnings
+}
+
+func fireTimes(schedule cron.Schedule, t time.Time, n int) []time.Time {
+	if schedule == nil {
+		return nil
+	}
+	list := make([]time.Time, 0, n)
+	for i := 0; i < n; i++ {
+		t = schedule.Next(t)
+		list = append(list, t)
+	}
+	return list
+}
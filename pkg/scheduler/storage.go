@@ -0,0 +1,202 @@
+package scheduler
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/stefanprodan/mgob/pkg/backup"
+	"github.com/stefanprodan/mgob/pkg/config"
+	"github.com/stefanprodan/mgob/pkg/db"
+)
+
+// storageSettle is how long a plan dir has to be quiet before it's scanned,
+// so that files still being copied are not hashed halfway.
+const storageSettle = 5 * time.Second
+
+// Register adds the archives found in the storage dir of plan that are
+// missing from the catalog, it returns the number of registered archives.
+func (s *Scheduler) Register(plan string) (int, error) {
+	if _, ok := s.Lookup(plan); !ok {
+		return 0, errors.Errorf("Plan %v not found", plan)
+	}
+	if s.isRunning(plan) {
+		// the run records its own archives when it's done
+		return 0, nil
+	}
+
+	dir := s.planDir(plan)
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return 0, nil
+		}
+		return 0, errors.Wrapf(err, "Reading storage dir %v failed", dir)
+	}
+	artifacts, err := s.Catalog.List(plan)
+	if err != nil {
+		return 0, err
+	}
+	known := make(map[string]bool)
+	for _, a := range artifacts {
+		known[a.Name] = true
+	}
+
+	archive := regexp.MustCompile(fmt.Sprintf(`^%v-(.+-)?(\d+)\.`, regexp.QuoteMeta(plan)))
+	count := 0
+	for _, fi := range files {
+		m := archive.FindStringSubmatch(fi.Name())
+		if fi.IsDir() || m == nil || known[fi.Name()] || strings.HasSuffix(fi.Name(), ".log") || drillReport.MatchString(fi.Name()) {
+			continue
+		}
+		sum, err := fileChecksum(filepath.Join(dir, fi.Name()))
+		if err != nil {
+			log.WithField("plan", plan).Warnf("Registering %v failed %v", fi.Name(), err)
+			continue
+		}
+		ts := fi.ModTime().UTC()
+		if unix, err := strconv.ParseInt(m[2], 10, 64); err == nil {
+			ts = time.Unix(unix, 0).UTC()
+		}
+		a := &db.Artifact{
+			Plan:         plan,
+			Name:         fi.Name(),
+			Size:         fi.Size(),
+			Checksum:     sum,
+			Timestamp:    ts,
+			Destinations: []string{"Local"},
+		}
+		if chain, seq, ok := backup.ParseSegment(fi.Name()); ok {
+			a.Chain, a.Seq = chain, seq
+		}
+		if err := s.Catalog.Put(a); err != nil {
+			return count, err
+		}
+		log.WithField("plan", plan).Infof("Registered %v in the catalog", fi.Name())
+		count++
+	}
+	return count, nil
+}
+
+// forgetLocal drops the Local destination of the archives the retention
+// removed from the storage dir of plan, an archive stored nowhere else is
+// removed from the catalog.
+func (s *Scheduler) forgetLocal(plan string, files []string) {
+	removed := make(map[string]bool)
+	for _, f := range files {
+		removed[f] = true
+	}
+	artifacts, err := s.Catalog.List(plan)
+	if err != nil {
+		log.WithField("plan", plan).Errorf("Catalog list failed %v", err)
+		return
+	}
+	for _, a := range artifacts {
+		if !removed[a.Name] || !contains(a.Destinations, "Local") {
+			continue
+		}
+		a.Destinations = without(a.Destinations, "Local")
+		if len(a.Destinations) == 0 && len(a.Pending) == 0 {
+			err = s.Catalog.Delete(plan, a.Name)
+		} else {
+			err = s.Catalog.Put(a)
+		}
+		if err != nil {
+			log.WithField("plan", plan).Errorf("Catalog update of %v failed %v", a.Name, err)
+		}
+	}
+}
+
+func (s *Scheduler) isRunning(plan string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.running[plan]) > 0
+}
+
+// planDir is the storage dir of the named plan.
+func (s *Scheduler) planDir(name string) string {
+	plan, ok := s.Lookup(name)
+	if !ok {
+		plan = config.Plan{Name: name}
+	}
+	return config.PlanDir(s.Config.StoragePath, plan)
+}
+
+// watchStorage registers the archives copied into the plan storage dirs
+// until the scheduler is stopped.
+func (s *Scheduler) watchStorage() {
+	for _, plan := range s.plans() {
+		if _, err := s.Register(plan.Name); err != nil {
+			log.WithField("plan", plan.Name).Errorf("Storage registration failed %v", err)
+		}
+	}
+
+	// the plan dirs of a tenant are in the tenant dir
+	roots := []string{s.Config.StoragePath}
+	seen := make(map[string]bool)
+	for _, plan := range s.plans() {
+		if plan.Tenant == "" || seen[plan.Tenant] {
+			continue
+		}
+		seen[plan.Tenant] = true
+		dir := filepath.Join(s.Config.StoragePath, plan.Tenant)
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			log.Errorf("Creating tenant dir %v failed %v", dir, err)
+			continue
+		}
+		roots = append(roots, dir)
+	}
+	events, err := storageEvents(s.ctx, roots)
+	if err != nil {
+		log.Errorf("Storage watcher failed %v", err)
+		return
+	}
+
+	dirty := make(map[string]bool)
+	timer := time.NewTimer(storageSettle)
+	timer.Stop()
+	for {
+		select {
+		case plan, ok := <-events:
+			if !ok {
+				return
+			}
+			dirty[plan] = true
+			timer.Reset(storageSettle)
+		case <-timer.C:
+			for plan := range dirty {
+				if _, ok := s.Lookup(plan); !ok {
+					continue
+				}
+				if _, err := s.Register(plan); err != nil {
+					log.WithField("plan", plan).Errorf("Storage registration failed %v", err)
+				}
+			}
+			dirty = make(map[string]bool)
+		}
+	}
+}
+
+func fileChecksum(file string) (string, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
@@ -0,0 +1,92 @@
+package scheduler
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// storageEvents sends the name of a plan dir every time a file is written
+// or moved into it, watching the storage roots and their plan dirs.
+func storageEvents(ctx context.Context, roots []string) (<-chan string, error) {
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, errors.Wrap(err, "storage watcher init failed")
+	}
+
+	isRoot := make(map[string]bool)
+	for _, root := range roots {
+		root = filepath.Clean(root)
+		if err := w.Add(root); err != nil {
+			w.Close()
+			return nil, errors.Wrapf(err, "watching %v failed", root)
+		}
+		isRoot[root] = true
+	}
+	watch := func(dir string) {
+		// a tenant dir keeps its root watch
+		if isRoot[dir] {
+			return
+		}
+		if err := w.Add(dir); err != nil {
+			log.Warnf("Watching storage dir %v failed %v", filepath.Base(dir), err)
+		}
+	}
+	for root := range isRoot {
+		if list, err := ioutil.ReadDir(root); err == nil {
+			for _, fi := range list {
+				if fi.IsDir() {
+					watch(filepath.Join(root, fi.Name()))
+				}
+			}
+		}
+	}
+
+	events := make(chan string)
+	go func() {
+		defer close(events)
+		defer w.Close()
+		for {
+			var plan string
+			select {
+			case <-ctx.Done():
+				return
+			case err, ok := <-w.Errors:
+				if !ok {
+					return
+				}
+				log.Errorf("Storage watcher failed %v", err)
+				continue
+			case ev, ok := <-w.Events:
+				if !ok {
+					return
+				}
+				if ev.Op&(fsnotify.Create|fsnotify.Write) == 0 {
+					continue
+				}
+				dir := filepath.Dir(ev.Name)
+				if isRoot[dir] {
+					if fi, err := os.Stat(ev.Name); err != nil || !fi.IsDir() {
+						continue
+					}
+					watch(ev.Name)
+					// files may have landed before the watch was added
+					plan = filepath.Base(ev.Name)
+				} else {
+					plan = filepath.Base(dir)
+				}
+			}
+			select {
+			case events <- plan:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return events, nil
+}
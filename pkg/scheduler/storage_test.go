@@ -0,0 +1,116 @@
+package scheduler
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/stefanprodan/mgob/pkg/db"
+)
+
+// newTestCatalog returns a catalog in a temporary store holding artifacts.
+func newTestCatalog(t *testing.T, artifacts ...*db.Artifact) *db.CatalogStore {
+	dir, err := ioutil.TempDir("", "mgob-catalog-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	store, err := db.Open(filepath.Join(dir, "mgob.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { store.Close() })
+	catalog, err := db.NewCatalogStore(store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, a := range artifacts {
+		if err := catalog.Put(a); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return catalog
+}
+
+func TestForgetLocal(t *testing.T) {
+	s := newTestScheduler(0)
+	catalog := newTestCatalog(t,
+		&db.Artifact{Plan: "p", Name: "p-1.gz", Destinations: []string{"Local"}},
+		&db.Artifact{Plan: "p", Name: "p-2.gz", Destinations: []string{"Local", "S3"}},
+		&db.Artifact{Plan: "p", Name: "p-3.gz", Destinations: []string{"Local"}},
+	)
+	s.Catalog = catalog
+
+	s.forgetLocal("p", []string{"p-1.gz", "p-1.log", "p-2.gz"})
+	artifacts, err := catalog.List("p")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := make(map[string][]string)
+	for _, a := range artifacts {
+		got[a.Name] = a.Destinations
+	}
+	want := map[string][]string{"p-2.gz": {"S3"}, "p-3.gz": {"Local"}}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("catalog after the retention %v, want %v", got, want)
+	}
+}
+
+func TestStorageEvents(t *testing.T) {
+	root, err := ioutil.TempDir("", "mgob-storage-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	if err := os.Mkdir(filepath.Join(root, "existing"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	events, err := storageEvents(ctx, []string{root})
+	if err != nil {
+		t.Fatal(err)
+	}
+	next := func(want string) {
+		t.Helper()
+		select {
+		case plan := <-events:
+			if plan != want {
+				t.Fatalf("event of %v, want %v", plan, want)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("no event of %v", want)
+		}
+	}
+
+	if err := ioutil.WriteFile(filepath.Join(root, "existing", "existing-1.gz"), []byte("a"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	next("existing")
+	// drain the write events of the same file
+	for drained := false; !drained; {
+		select {
+		case <-events:
+		case <-time.After(100 * time.Millisecond):
+			drained = true
+		}
+	}
+
+	if err := os.Mkdir(filepath.Join(root, "created"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	next("created")
+	// the files copied into a new plan dir are seen too
+	if err := ioutil.WriteFile(filepath.Join(root, "created", "created-1.gz"), []byte("a"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	next("created")
+
+	cancel()
+	for range events {
+	}
+}
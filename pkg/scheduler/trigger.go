@@ -0,0 +1,164 @@
+package scheduler
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson"
+
+	"github.com/stefanprodan/mgob/pkg/backup"
+	"github.com/stefanprodan/mgob/pkg/clock"
+	"github.com/stefanprodan/mgob/pkg/config"
+)
+
+// defaultTriggerInterval is the minimum minutes between two triggered backups.
+const defaultTriggerInterval = 10
+
+// trigger counts the writes a change stream saw on the target of a plan.
+// Writes is a running count, the backups that succeed move base to the
+// count they started at, the writes made during a dump count for the next.
+type trigger struct {
+	cancel context.CancelFunc
+	mu     sync.Mutex
+	writes int64
+	base   int64
+	// opened is set when the stream opened without resuming, the writes
+	// before it weren't seen
+	opened time.Time
+	// marked is the start of the last backup that succeeded
+	marked    time.Time
+	watching  bool
+	triggered time.Time
+}
+
+// startTrigger replaces the change stream trigger of plan, the caller must hold s.mu.
+func (s *Scheduler) startTrigger(plan config.Plan) {
+	if t, ok := s.triggers[plan.Name]; ok {
+		t.cancel()
+		delete(s.triggers, plan.Name)
+	}
+	if plan.Trigger == nil {
+		return
+	}
+	if err := backup.CheckTrigger(plan); err != nil {
+		log.WithField("plan", plan.Name).Errorf("Trigger disabled %v", err)
+		return
+	}
+	ctx, cancel := context.WithCancel(s.ctx)
+	t := &trigger{cancel: cancel}
+	s.triggers[plan.Name] = t
+	go s.watchTrigger(ctx, plan, t)
+}
+
+// watchTrigger follows the change stream of plan until ctx is done, it's
+// reopened after the last change seen when it fails.
+func (s *Scheduler) watchTrigger(ctx context.Context, plan config.Plan, t *trigger) {
+	log.WithField("plan", plan.Name).Info("Change stream trigger started")
+	var token bson.Raw
+	for ctx.Err() == nil {
+		resumed := token != nil
+		opened := false
+		var err error
+		token, err = backup.WatchChanges(ctx, plan, token, func() {
+			opened = true
+			t.mu.Lock()
+			t.watching = true
+			if !resumed {
+				t.opened = clock.Now()
+			}
+			t.mu.Unlock()
+		}, func(marker bool) {
+			s.onChange(plan, t, marker)
+		})
+		t.mu.Lock()
+		t.watching = false
+		t.mu.Unlock()
+		if ctx.Err() != nil {
+			return
+		}
+		if !opened && resumed {
+			// the change is out of the oplog, the writes since then are lost
+			token = nil
+		}
+		log.WithField("plan", plan.Name).Errorf("Change stream trigger failed %v", err)
+		if !sleepCtx(ctx, time.Minute) {
+			return
+		}
+	}
+}
+
+// onChange counts a write and starts a backup when the marker changed or the
+// writes since the last backup reached the threshold.
+func (s *Scheduler) onChange(plan config.Plan, t *trigger, marker bool) {
+	t.mu.Lock()
+	t.writes++
+	reason := ""
+	switch {
+	case marker && plan.Trigger.Collection != "":
+		reason = "marker"
+	case plan.Trigger.Writes > 0 && t.writes-t.base >= int64(plan.Trigger.Writes):
+		reason = "writes"
+	}
+	interval := time.Duration(plan.Trigger.MinInterval) * time.Minute
+	if plan.Trigger.MinInterval == 0 {
+		interval = defaultTriggerInterval * time.Minute
+	}
+	if reason == "" || clock.Since(t.triggered) < interval {
+		t.mu.Unlock()
+		return
+	}
+	writes := t.writes - t.base
+	t.mu.Unlock()
+
+	if s.IsPaused(plan.Name) || s.isRunning(plan.Name) {
+		return
+	}
+	t.mu.Lock()
+	t.triggered = clock.Now()
+	t.mu.Unlock()
+	log.WithField("plan", plan.Name).Infof("Backup triggered by the %v, %v writes since the last backup", reason, writes)
+	s.metrics.TriggerTotal.WithLabelValues(s.metrics.Plan(plan.Name), reason).Inc()
+	current, ok := s.Lookup(plan.Name)
+	if !ok {
+		return
+	}
+	go backupJob{current.Name, current, s.Config, s.Modules, s.Stats, s.metrics, s.Cron, s}.Run()
+}
+
+// markTrigger returns the func a backup of plan calls once it succeeded, the
+// writes seen before it started are then backed up.
+func (s *Scheduler) markTrigger(plan string) func() {
+	s.mu.Lock()
+	t, ok := s.triggers[plan]
+	s.mu.Unlock()
+	if !ok {
+		return func() {}
+	}
+	t.mu.Lock()
+	writes, started := t.writes, clock.Now()
+	t.mu.Unlock()
+	return func() {
+		t.mu.Lock()
+		if writes > t.base {
+			t.base = writes
+		}
+		t.marked = started
+		t.mu.Unlock()
+	}
+}
+
+// idle tells if the change stream of plan saw no write since the last
+// backup, false when it wasn't watching all along.
+func (s *Scheduler) idle(plan string) bool {
+	s.mu.Lock()
+	t, ok := s.triggers[plan]
+	s.mu.Unlock()
+	if !ok {
+		return false
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.watching && !t.opened.IsZero() && t.marked.After(t.opened) && t.writes == t.base
+}
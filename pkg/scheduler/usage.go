@@ -0,0 +1,42 @@
+package scheduler
+
+import (
+	"github.com/stefanprodan/mgob/pkg/backup"
+	"github.com/stefanprodan/mgob/pkg/config"
+)
+
+// observeUsage exports the resources the processes of a backup run used,
+// failed runs included.
+func (s *Scheduler) observeUsage(plan config.Plan, res backup.Result) {
+	planLabel := s.metrics.Plan(plan.Name)
+	for stage, u := range res.Usage {
+		s.metrics.CPUSeconds.WithLabelValues(planLabel, stage).Add(u.CPU)
+		s.metrics.MaxRSS.WithLabelValues(planLabel, stage).Set(float64(u.MaxRSS))
+		s.metrics.IOBytes.WithLabelValues(planLabel, stage, "read").Add(float64(u.ReadBytes))
+		s.metrics.IOBytes.WithLabelValues(planLabel, stage, "write").Add(float64(u.WriteBytes))
+		s.metrics.NetBytes.WithLabelValues(planLabel, stage).Add(float64(u.NetBytes))
+	}
+}
+
+// observePhases exports the phase and upload durations of a backup run and
+// counts the outcomes of its uploads, failed runs included.
+func (s *Scheduler) observePhases(plan config.Plan, res backup.Result) {
+	planLabel := s.metrics.Plan(plan.Name)
+	for phase, d := range res.Phases {
+		s.metrics.PhaseSeconds.WithLabelValues(planLabel, phase).Set(d.Seconds())
+	}
+	for dest, d := range res.UploadDurations() {
+		s.metrics.UploadSeconds.WithLabelValues(planLabel, dest).Set(d.Seconds())
+	}
+	for _, o := range res.Outcomes {
+		s.metrics.UploadTotal.WithLabelValues(planLabel, o.Destination, o.Status).Inc()
+	}
+}
+
+// phaseNote appends the phases of res to a notification body.
+func phaseNote(body string, res backup.Result) string {
+	if summary := res.PhaseSummary(); summary != "" {
+		return body + "\n" + summary
+	}
+	return body
+}
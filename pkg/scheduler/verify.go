@@ -0,0 +1,266 @@
+package scheduler
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"github.com/stefanprodan/mgob/pkg/backup"
+	"github.com/stefanprodan/mgob/pkg/clock"
+	"github.com/stefanprodan/mgob/pkg/config"
+	"github.com/stefanprodan/mgob/pkg/notifier"
+)
+
+// restoredDocs matches the summary line mongorestore prints when it finishes.
+var restoredDocs = regexp.MustCompile(`(\d+) document\(s\) restored successfully\. (\d+) document\(s\) failed to restore`)
+
+// VerifyReport is the outcome of restoring the latest backup of a plan into its
+// verify target, Status is ok when all the sanity checks passed.
+type VerifyReport struct {
+	Plan     string   `json:"plan"`
+	Archives []string `json:"archives"`
+	// Timestamp is the run time of the verified backup
+	Timestamp   time.Time     `json:"timestamp"`
+	Started     time.Time     `json:"started"`
+	Duration    time.Duration `json:"duration"`
+	Status      string        `json:"status"`
+	Databases   int           `json:"databases"`
+	Collections int           `json:"collections"`
+	Documents   int64         `json:"documents"`
+	Problems    []string      `json:"problems,omitempty"`
+	// Hashes is the number of collections checked against the dbHash of the run manifest
+	Hashes int `json:"hashes,omitempty"`
+	// Size is the catalog size of the restored archives
+	Size   int64             `json:"size"`
+	Counts []CollectionCount `json:"counts,omitempty"`
+	// Reports are the drill reports written next to the archive, under /storage
+	Reports []string `json:"reports,omitempty"`
+}
+
+// CollectionCount is the number of documents restored in a collection.
+type CollectionCount struct {
+	Database   string `json:"database"`
+	Collection string `json:"collection"`
+	Documents  int64  `json:"documents"`
+}
+
+func (r *VerifyReport) fail(format string, args ...interface{}) {
+	r.Problems = append(r.Problems, fmt.Sprintf(format, args...))
+}
+
+// Verify restores the newest backup of plan into the scratch target of its
+// verify config and checks the restored databases, collections and documents.
+func (s *Scheduler) Verify(ctx context.Context, plan config.Plan) *VerifyReport {
+	report := &VerifyReport{Plan: plan.Name, Archives: make([]string, 0), Started: clock.Now().UTC(), Status: "failed"}
+	defer func() {
+		report.Duration = clock.Since(report.Started)
+		if len(report.Problems) == 0 {
+			report.Status = "ok"
+		}
+		s.metrics.VerifyTotal.WithLabelValues(s.metrics.Plan(plan.Name), report.Status).Inc()
+		report.Reports = s.writeDrillReports(plan, report)
+	}()
+	if plan.Verify == nil || plan.Verify.Uri == "" {
+		report.fail("Plan %v has no verify target", plan.Name)
+		return report
+	}
+
+	res, err := s.Resolve(plan.Name, clock.Now())
+	if err != nil {
+		report.fail("%v", err)
+		return report
+	}
+	report.Timestamp = res.Timestamp
+	report.Size = s.archivesSize(plan.Name, res)
+
+	client, err := mongo.Connect(ctx, options.Client().ApplyURI(plan.Verify.Uri).SetAppName("mgob-verify"))
+	if err != nil {
+		report.fail("Connecting to the verify target failed %v", err)
+		return report
+	}
+	defer client.Disconnect(context.Background())
+	if err := dropUserDatabases(ctx, client); err != nil {
+		report.fail("Cleaning the verify target failed %v", err)
+		return report
+	}
+	defer func() {
+		if err := dropUserDatabases(context.Background(), client); err != nil {
+			log.WithField("plan", plan.Name).Warnf("Cleaning the verify target failed %v", err)
+		}
+	}()
+
+	// the archives are restored through the restore path, into the verify target
+	target := plan
+	target.Restore = &config.Restore{
+		Uri:     plan.Verify.Uri,
+		KeyFile: plan.Verify.KeyFile,
+		Params:  plan.Verify.Params,
+		Timeout: plan.Verify.Timeout,
+	}
+	var restored, failed int64
+	counted := false
+	for _, a := range res.Archives {
+		report.Archives = append(report.Archives, a.Name)
+		out, err := s.Restore(ctx, target, a.Name, false)
+		if err != nil {
+			report.fail("Restoring %v failed %v", a.Name, err)
+			return report
+		}
+		for _, m := range restoredDocs.FindAllStringSubmatch(out.Output, -1) {
+			ok, _ := strconv.ParseInt(m[1], 10, 64)
+			ko, _ := strconv.ParseInt(m[2], 10, 64)
+			restored, failed, counted = restored+ok, failed+ko, true
+		}
+	}
+
+	if err := report.count(ctx, client); err != nil {
+		report.fail("Counting the restored data failed %v", err)
+		return report
+	}
+	switch {
+	case report.Databases == 0:
+		report.fail("No database was restored")
+	case report.Collections == 0:
+		report.fail("No collection was restored")
+	}
+	if report.Documents < plan.Verify.MinDocuments {
+		report.fail("%v documents restored, expected at least %v", report.Documents, plan.Verify.MinDocuments)
+	}
+	if failed > 0 {
+		report.fail("mongorestore failed to restore %v documents", failed)
+	}
+	if hashes := s.manifestHashes(plan.Name, res.Timestamp); len(hashes) > 0 {
+		if err := report.compareHashes(ctx, client, hashes); err != nil {
+			report.fail("Hashing the restored data failed %v", err)
+		}
+	}
+	// oplog replay can add or remove documents after the dump was loaded
+	if counted && !plan.Target.PointInTime && restored != report.Documents {
+		report.fail("mongorestore restored %v documents, the target holds %v", restored, report.Documents)
+	}
+	return report
+}
+
+// count sums the collections and documents of the user databases.
+func (r *VerifyReport) count(ctx context.Context, client *mongo.Client) error {
+	names, err := backup.UserDatabases(ctx, client)
+	if err != nil {
+		return err
+	}
+	r.Databases = len(names)
+	for _, name := range names {
+		database := client.Database(name)
+		colls, err := database.ListCollectionNames(ctx, bson.D{{Key: "type", Value: "collection"}})
+		if err != nil {
+			return errors.Wrapf(err, "listing the collections of %v failed", name)
+		}
+		for _, c := range colls {
+			if strings.HasPrefix(c, "system.") {
+				continue
+			}
+			n, err := database.Collection(c).CountDocuments(ctx, bson.D{})
+			if err != nil {
+				return errors.Wrapf(err, "counting %v.%v failed", name, c)
+			}
+			r.Collections++
+			r.Documents += n
+			r.Counts = append(r.Counts, CollectionCount{Database: name, Collection: c, Documents: n})
+		}
+	}
+	return nil
+}
+
+// compareHashes runs dbHash on the restored collections and reports the ones
+// that differ from the hashes captured at dump time.
+func (r *VerifyReport) compareHashes(ctx context.Context, client *mongo.Client, hashes map[string]map[string]string) error {
+	databases := make([]string, 0, len(hashes))
+	for database := range hashes {
+		databases = append(databases, database)
+	}
+	sort.Strings(databases)
+	for _, database := range databases {
+		colls := make([]string, 0, len(hashes[database]))
+		for c := range hashes[database] {
+			colls = append(colls, c)
+		}
+		sort.Strings(colls)
+		sums, err := backup.DbHash(ctx, client, database, colls)
+		if err != nil {
+			return err
+		}
+		for _, c := range colls {
+			r.Hashes++
+			if sums[c] != hashes[database][c] {
+				r.fail("%v.%v dbHash %v differs from %v at dump time", database, c, sums[c], hashes[database][c])
+			}
+		}
+	}
+	return nil
+}
+
+// manifestHashes returns the collection hashes signed by the run of plan at ts.
+func (s *Scheduler) manifestHashes(plan string, ts time.Time) map[string]map[string]string {
+	if s.Manifests == nil {
+		return nil
+	}
+	list, err := s.Manifests.List(plan)
+	if err != nil {
+		log.WithField("plan", plan).Warnf("Loading the manifests failed %v", err)
+		return nil
+	}
+	// artifacts registered from the storage dir have a timestamp in seconds
+	for i := len(list) - 1; i >= 0; i-- {
+		if list[i].Status == "ok" && list[i].Timestamp.Unix() == ts.Unix() {
+			return list[i].Hashes
+		}
+	}
+	return nil
+}
+
+func dropUserDatabases(ctx context.Context, client *mongo.Client) error {
+	names, err := backup.UserDatabases(ctx, client)
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		if err := client.Database(name).Drop(ctx); err != nil {
+			return errors.Wrapf(err, "dropping %v failed", name)
+		}
+	}
+	return nil
+}
+
+func (s *Scheduler) verifyJob(plan config.Plan) {
+	log.WithField("plan", plan.Name).Info("Restore verification started")
+	ctx, cancel := context.WithCancel(s.ctx)
+	defer cancel()
+
+	report := s.Verify(ctx, plan)
+	summary := fmt.Sprintf("%v restored in %v, %v databases %v collections %v documents",
+		strings.Join(report.Archives, ", "), report.Duration, report.Databases, report.Collections, report.Documents)
+	if report.Status == "ok" {
+		log.WithField("plan", plan.Name).Infof("Restore verification finished %v", summary)
+		if err := notifier.SendNotification(fmt.Sprintf("%v restore verification passed", plan.Name),
+			reportLinks(summary, report), false, plan); err != nil {
+			log.WithField("plan", plan.Name).Errorf("Notifier failed %v", err)
+		}
+		return
+	}
+
+	body := strings.Join(report.Problems, "\n")
+	log.WithField("plan", plan.Name).Errorf("Restore verification failed %v", body)
+	if err := notifier.SendNotification(fmt.Sprintf("%v restore verification failed", plan.Name),
+		reportLinks(body, report), true, plan); err != nil {
+		log.WithField("plan", plan.Name).Errorf("Notifier failed %v", err)
+	}
+}
@@ -0,0 +1,338 @@
+package selftest
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"github.com/stefanprodan/mgob/pkg/backup"
+	"github.com/stefanprodan/mgob/pkg/clock"
+	"github.com/stefanprodan/mgob/pkg/config"
+	"github.com/stefanprodan/mgob/pkg/restore"
+)
+
+const (
+	seedDocuments = 1000
+	planSuffix    = "-selftest"
+)
+
+var seedCollections = []string{"orders", "customers"}
+
+// Step is the outcome of one self-test step.
+type Step struct {
+	Name     string        `json:"name"`
+	Passed   bool          `json:"passed"`
+	Duration time.Duration `json:"duration"`
+	Error    string        `json:"error,omitempty"`
+}
+
+// Report is the outcome of a self-test run.
+type Report struct {
+	Plan   string `json:"plan"`
+	Passed bool   `json:"passed"`
+	Steps  []Step `json:"steps"`
+}
+
+func (r *Report) run(name string, fn func() error) bool {
+	t1 := clock.Now()
+	err := fn()
+	step := Step{Name: name, Passed: err == nil, Duration: clock.Since(t1)}
+	if err != nil {
+		step.Error = err.Error()
+		r.Passed = false
+		log.WithField("plan", r.Plan).Errorf("Self-test %v failed %v", name, err)
+	} else {
+		log.WithField("plan", r.Plan).Infof("Self-test %v passed in %v", name, step.Duration)
+	}
+	r.Steps = append(r.Steps, step)
+	return err == nil
+}
+
+// Run seeds a disposable database on the plan target, backs it up through the plan
+// pipeline and destinations under the <plan>-selftest name, downloads every copy,
+// restores it into a second database and compares the data. Everything the test
+// created is removed at the end.
+func Run(ctx context.Context, plan config.Plan, conf *config.AppConfig, modules *config.ModuleConfig) *Report {
+	report := &Report{Plan: plan.Name, Passed: true}
+	if plan.Target.Uri == "" {
+		report.run("config", func() error {
+			return errors.New("self-test requires a MongoDB URI target")
+		})
+		return report
+	}
+
+	ts := clock.Now().Unix()
+	source := fmt.Sprintf("mgob_selftest_%v", ts)
+	restored := source + "_restored"
+
+	testPlan := plan
+	testPlan.Name = plan.Name + planSuffix
+	testPlan.Mode = config.BackupModeSingle
+	testPlan.Target.Database = source
+	testPlan.Target.Collection = ""
+	testPlan.Target.ExcludeCollections = nil
+	testPlan.Target.IncludeDatabases = nil
+	testPlan.Target.ExcludeDatabases = nil
+	// the test database alone can't be dumped with the oplog
+	testPlan.Target.PointInTime = false
+	testPlan.Scheduler.Retention = 0
+	uri := backup.UriWithFlavor(plan.Target)
+	testPlan.SMTP = nil
+	testPlan.Slack = nil
+
+	ctx = backup.WithEnv(ctx, testPlan)
+	downloadDir := filepath.Join(conf.TmpPath, fmt.Sprintf("%v-%v", testPlan.Name, ts))
+
+	var client *mongo.Client
+	var res backup.Result
+	defer func() {
+		report.run("cleanup", func() error {
+			return cleanup(ctx, client, testPlan, conf, res, downloadDir, source, restored)
+		})
+	}()
+
+	ok := report.run("connect", func() error {
+		var err error
+		client, err = connect(ctx, uri)
+		return err
+	})
+	if !ok {
+		return report
+	}
+
+	ok = report.run("seed", func() error {
+		return seed(ctx, client.Database(source))
+	})
+	if !ok {
+		return report
+	}
+
+	ok = report.run("backup", func() error {
+		var err error
+		res, err = backup.Run(ctx, testPlan, conf, modules)
+		if err == nil && len(res.Files) == 0 {
+			err = errors.New("backup produced no files")
+		}
+		return err
+	})
+	if !ok {
+		return report
+	}
+
+	if err := os.MkdirAll(downloadDir, 0755); err != nil {
+		report.run("download", func() error { return err })
+		return report
+	}
+
+	archive := res.Files[0]
+	for _, d := range backup.Destinations(testPlan, conf, res.Timestamp) {
+		dir := filepath.Join(downloadDir, strings.ToLower(d.Name()))
+		ok = report.run("download/"+d.Name(), func() error {
+			if err := os.MkdirAll(dir, 0755); err != nil {
+				return err
+			}
+			for _, file := range res.Files {
+				if err := d.Verify(ctx, file); err != nil {
+					return err
+				}
+				dst := filepath.Join(dir, filepath.Base(file))
+				if err := d.Download(ctx, file, dst); err != nil {
+					return err
+				}
+				if err := sameContent(file, dst); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if ok {
+			// restore from the last downloaded copy so the round trip is tested
+			archive = filepath.Join(dir, filepath.Base(res.Files[0]))
+		}
+	}
+
+	ok = report.run("restore", func() error {
+		args := []string{"--nsFrom", source + ".*", "--nsTo", restored + ".*"}
+		args = append(args, strings.Fields(plan.Target.Params)...)
+		_, err := restore.FromFile(ctx, archive, uri, args...)
+		return err
+	})
+	if !ok {
+		return report
+	}
+
+	report.run("compare", func() error {
+		return compare(ctx, client.Database(source), client.Database(restored))
+	})
+
+	return report
+}
+
+func connect(ctx context.Context, uri string) (*mongo.Client, error) {
+	client, err := mongo.Connect(ctx, options.Client().ApplyURI(uri))
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to connect to MongoDB")
+	}
+	if err := client.Ping(ctx, nil); err != nil {
+		client.Disconnect(context.Background())
+		return nil, errors.Wrap(err, "failed to ping MongoDB")
+	}
+	return client, nil
+}
+
+func seed(ctx context.Context, db *mongo.Database) error {
+	for _, name := range seedCollections {
+		docs := make([]interface{}, 0, seedDocuments)
+		for i := 0; i < seedDocuments; i++ {
+			docs = append(docs, bson.D{
+				{Key: "_id", Value: i},
+				{Key: "name", Value: fmt.Sprintf("%v-%v", name, i)},
+				{Key: "value", Value: float64(i) * 1.5},
+				{Key: "created", Value: time.Unix(int64(i), 0).UTC()},
+				{Key: "tags", Value: bson.A{name, i % 7}},
+			})
+		}
+		if _, err := db.Collection(name).InsertMany(ctx, docs); err != nil {
+			return errors.Wrapf(err, "seeding %v.%v failed", db.Name(), name)
+		}
+	}
+	return nil
+}
+
+// compare checks both databases hold the same collections with identical documents.
+func compare(ctx context.Context, source *mongo.Database, restored *mongo.Database) error {
+	for _, name := range seedCollections {
+		opts := options.Find().SetSort(bson.D{{Key: "_id", Value: 1}})
+		a, err := source.Collection(name).Find(ctx, bson.D{}, opts)
+		if err != nil {
+			return errors.Wrapf(err, "reading %v.%v failed", source.Name(), name)
+		}
+		b, err := restored.Collection(name).Find(ctx, bson.D{}, opts)
+		if err != nil {
+			a.Close(ctx)
+			return errors.Wrapf(err, "reading %v.%v failed", restored.Name(), name)
+		}
+		err = compareCursors(ctx, a, b)
+		a.Close(ctx)
+		b.Close(ctx)
+		if err != nil {
+			return errors.Wrapf(err, "collection %v differs", name)
+		}
+	}
+	return nil
+}
+
+func compareCursors(ctx context.Context, a *mongo.Cursor, b *mongo.Cursor) error {
+	count := 0
+	for {
+		nextA, nextB := a.Next(ctx), b.Next(ctx)
+		if !nextA || !nextB {
+			if nextA != nextB {
+				return errors.Errorf("document count differs after %v documents", count)
+			}
+			break
+		}
+		if !bytes.Equal(a.Current, b.Current) {
+			return errors.Errorf("document %v differs", count)
+		}
+		count++
+	}
+	if err := a.Err(); err != nil {
+		return err
+	}
+	if err := b.Err(); err != nil {
+		return err
+	}
+	if count != seedDocuments {
+		return errors.Errorf("expected %v documents, found %v", seedDocuments, count)
+	}
+	return nil
+}
+
+func sameContent(a string, b string) error {
+	sumA, err := fileSum(a)
+	if err != nil {
+		return err
+	}
+	sumB, err := fileSum(b)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(sumA, sumB) {
+		return errors.Errorf("downloaded copy of %v differs from the original", filepath.Base(a))
+	}
+	return nil
+}
+
+func fileSum(file string) ([]byte, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return nil, errors.Wrapf(err, "reading %v failed", file)
+	}
+	return h.Sum(nil), nil
+}
+
+// cleanup removes the test databases and every file the self-test stored.
+func cleanup(ctx context.Context, client *mongo.Client, plan config.Plan, conf *config.AppConfig,
+	res backup.Result, downloadDir string, dbs ...string) error {
+	// keep going on errors so as much as possible is removed
+	failed := make([]string, 0)
+	if client != nil {
+		for _, name := range dbs {
+			if err := client.Database(name).Drop(ctx); err != nil {
+				failed = append(failed, err.Error())
+			}
+		}
+		client.Disconnect(context.Background())
+	}
+
+	if len(res.Files) > 0 {
+		stored := make(map[string]bool)
+		for _, file := range res.Files {
+			stored[filepath.Base(file)] = true
+		}
+		for _, d := range backup.Destinations(plan, conf, res.Timestamp) {
+			objects, err := d.List(ctx)
+			if err != nil {
+				failed = append(failed, err.Error())
+				continue
+			}
+			for _, obj := range objects {
+				if !stored[filepath.Base(obj.Name)] {
+					continue
+				}
+				if err := d.Delete(ctx, obj.Name); err != nil {
+					failed = append(failed, err.Error())
+				}
+			}
+		}
+	}
+
+	for _, dir := range []string{downloadDir, config.PlanDir(conf.StoragePath, plan)} {
+		if err := os.RemoveAll(dir); err != nil {
+			failed = append(failed, err.Error())
+		}
+	}
+
+	if len(failed) > 0 {
+		return errors.Errorf("cleanup failed %v", strings.Join(failed, ", "))
+	}
+	return nil
+}
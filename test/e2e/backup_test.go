@@ -0,0 +1,224 @@
+//go:build e2e
+// +build e2e
+
+package e2e
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+
+	"github.com/stefanprodan/mgob/pkg/backup"
+	"github.com/stefanprodan/mgob/pkg/config"
+	"github.com/stefanprodan/mgob/pkg/restore"
+)
+
+func seed(t *testing.T, client *mongo.Client, n int) {
+	docs := make([]interface{}, n)
+	for i := range docs {
+		docs[i] = bson.M{"_id": i, "name": fmt.Sprintf("doc-%v", i)}
+	}
+	if _, err := client.Database("e2e").Collection("docs").InsertMany(context.Background(), docs); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func count(t *testing.T, client *mongo.Client) int64 {
+	n, err := client.Database("e2e").Collection("docs").CountDocuments(context.Background(), bson.M{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+// archives returns the gzip archives of the plan dir, oldest first.
+func archives(t *testing.T, e *env, plan config.Plan) []string {
+	files, err := filepath.Glob(filepath.Join(config.PlanDir(e.conf.StoragePath, plan), plan.Name+"-*.gz"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(files)
+	return files
+}
+
+// runBackup runs the plan at the current time of the fake clock, then moves it an hour.
+func runBackup(t *testing.T, e *env, plan config.Plan) backup.Result {
+	res, err := backup.Run(context.Background(), plan, e.conf, &config.ModuleConfig{})
+	if err != nil {
+		t.Fatalf("backup failed %v", err)
+	}
+	e.clock.Advance(time.Hour)
+	return res
+}
+
+// verifyRemote checks the archive was copied to every remote destination of the plan.
+func verifyRemote(t *testing.T, e *env, plan config.Plan, res backup.Result) {
+	file := filepath.Join(config.PlanDir(e.conf.StoragePath, plan), res.Name)
+	dests := backup.RemoteDestinations(plan, e.conf, res.Timestamp)
+	if len(dests) == 0 {
+		t.Fatal("the plan has no remote destination")
+	}
+	for _, d := range dests {
+		if err := d.Verify(context.Background(), file); err != nil {
+			t.Errorf("%v verify failed %v", d.Name(), err)
+		}
+	}
+}
+
+func TestDumpRetentionRestore(t *testing.T) {
+	e := newEnv(t, "mongodump", "mongorestore")
+	uri, client := startMongo(t)
+	seed(t, client, 100)
+
+	plan := config.Plan{
+		Name:      "e2e-local",
+		Target:    config.Target{Uri: uri + "/e2e", Database: "e2e"},
+		Scheduler: config.Scheduler{Cron: "0 * * * *", Retention: 2},
+		Restore:   &config.Restore{Uri: uri},
+	}
+	for i := 0; i < 3; i++ {
+		runBackup(t, e, plan)
+	}
+	if !e.ran("mongodump") {
+		t.Fatal("mongodump wasn't started")
+	}
+	files := archives(t, e, plan)
+	if len(files) != 2 {
+		t.Fatalf("retention kept %v archives instead of 2 %v", len(files), files)
+	}
+	first := fmt.Sprintf("%v-%v.gz", plan.Name, time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC).Unix())
+	if filepath.Base(files[0]) == first {
+		t.Fatalf("retention kept the oldest archive %v", first)
+	}
+
+	if err := client.Database("e2e").Drop(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	res, err := restore.Run(context.Background(), plan, files[len(files)-1], false, nil)
+	if err != nil {
+		t.Fatalf("restore failed %v", err)
+	}
+	if n := count(t, client); n != 100 {
+		t.Fatalf("restored %v documents instead of 100", n)
+	}
+	if res.Status != "ok" {
+		t.Fatalf("restore status %v", res.Status)
+	}
+}
+
+// TestDirectoryFormatRestore restores a gzipped tar of a dump directory, the
+// artifact of the directory format, sample and metadata modes.
+func TestDirectoryFormatRestore(t *testing.T) {
+	e := newEnv(t, "mongodump", "mongorestore")
+	uri, client := startMongo(t)
+	seed(t, client, 100)
+
+	plan := config.Plan{
+		Name:      "e2e-directory",
+		Target:    config.Target{Uri: uri + "/e2e", Database: "e2e", Format: config.DumpFormatDirectory},
+		Scheduler: config.Scheduler{Cron: "0 * * * *", Retention: 1},
+		Restore:   &config.Restore{Uri: uri},
+	}
+	res := runBackup(t, e, plan)
+	if !strings.HasSuffix(res.Name, ".tar.gz") {
+		t.Fatalf("the directory format stored %v instead of a .tar.gz", res.Name)
+	}
+
+	if err := client.Database("e2e").Drop(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	file := filepath.Join(config.PlanDir(e.conf.StoragePath, plan), res.Name)
+	if _, err := restore.Run(context.Background(), plan, file, false, nil); err != nil {
+		t.Fatalf("restore failed %v", err)
+	}
+	if n := count(t, client); n != 100 {
+		t.Fatalf("restored %v documents instead of 100", n)
+	}
+	unpacked := false
+	for _, args := range e.cmds.list() {
+		for _, arg := range args {
+			if args[0] == "mongorestore" && arg == "--dir" {
+				unpacked = true
+			}
+		}
+	}
+	if !unpacked {
+		t.Fatal("mongorestore wasn't run on the unpacked dump dir")
+	}
+}
+
+func TestUploadMinIO(t *testing.T) {
+	e := newEnv(t, "mongodump", "mc")
+	uri, client := startMongo(t)
+	seed(t, client, 10)
+	url := startMinIO(t)
+
+	plan := config.Plan{
+		Name:      "e2e-s3",
+		Target:    config.Target{Uri: uri + "/e2e", Database: "e2e"},
+		Scheduler: config.Scheduler{Cron: "0 * * * *", Retention: 1},
+		S3: &config.S3{
+			URL:       url,
+			Bucket:    "backup",
+			AccessKey: minioAccessKey,
+			SecretKey: minioSecretKey,
+			API:       "S3v4",
+		},
+	}
+	res := runBackup(t, e, plan)
+	verifyRemote(t, e, plan, res)
+	if !e.ran("mc") {
+		t.Fatal("mc wasn't started")
+	}
+}
+
+func TestUploadSFTP(t *testing.T) {
+	e := newEnv(t, "mongodump")
+	uri, client := startMongo(t)
+	seed(t, client, 10)
+	host, port := startSFTP(t)
+
+	plan := config.Plan{
+		Name:      "e2e-sftp",
+		Target:    config.Target{Uri: uri + "/e2e", Database: "e2e"},
+		Scheduler: config.Scheduler{Cron: "0 * * * *", Retention: 1},
+		SFTP: &config.SFTP{
+			Host:     host,
+			Port:     port,
+			Username: "test",
+			Password: "test",
+			Dir:      "backup",
+		},
+	}
+	var res backup.Result
+	// sshd may take a moment after the port opens
+	for i := 0; ; i++ {
+		r, err := backup.Run(context.Background(), plan, e.conf, &config.ModuleConfig{})
+		if err == nil {
+			res = r
+			break
+		}
+		if i == 10 {
+			t.Fatalf("backup failed %v", err)
+		}
+		e.clock.Advance(time.Minute)
+		time.Sleep(time.Second)
+	}
+	verifyRemote(t, e, plan, res)
+
+	files, err := ioutil.ReadDir(config.PlanDir(e.conf.StoragePath, plan))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) == 0 {
+		t.Fatal("the local copy is missing")
+	}
+}
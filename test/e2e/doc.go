@@ -0,0 +1,10 @@
+// Package e2e runs the backup, upload, retention and restore flows against
+// MongoDB, MinIO and SFTP containers. The tests are behind the e2e build tag,
+// they need docker, mongodump, mongorestore and mc on the PATH:
+//
+//	go test -tags e2e -v ./test/e2e
+//
+// The containers are started with the docker CLI rather than testcontainers-go,
+// which would add the docker and containerd modules to the mgob go.mod for the
+// few run, port and rm calls the tests make.
+package e2e